@@ -3,18 +3,24 @@ package main
 import (
 	"sync/atomic"
 
+	"github.com/calmh/syncthing/protocol"
 	"github.com/calmh/syncthing/scanner"
 )
 
 type bqAdd struct {
-	file scanner.File
-	have []scanner.Block
-	need []scanner.Block
+	file       scanner.File
+	have       []scanner.Block
+	need       []scanner.Block
+	maxRequest int  // adjacent needed blocks are requested together up to this size
+	maxBatch   int  // requests are batched together up to this many, when more than one
+	sparse     bool // zero blocks are not requested together with others
 }
 
 type bqBlock struct {
 	file  scanner.File
 	block scanner.Block   // get this block from the network
+	parts []scanner.Block // the blocks making up block, when more than one
+	batch []bqBlock       // the requests making up block, when batched
 	copy  []scanner.Block // copy these blocks from the old version of the file
 	last  bool
 }
@@ -50,17 +56,39 @@ func (q *blockQueue) addBlock(a bqAdd) {
 			copy: a.have,
 		})
 	}
-	// Queue the needed blocks individually
-	l := len(a.need)
-	for i, b := range a.need {
-		q.queued = append(q.queued, bqBlock{
+	// Queue the needed blocks, requesting adjacent ones together
+	var reqs []bqBlock
+	var lastZero bool
+	for _, b := range a.need {
+		// Runs of zero blocks are kept apart so that they can be left
+		// as holes in sparse files.
+		zero := a.sparse && isZeroBlock(b)
+		if l := len(reqs); l > 0 {
+			r := &reqs[l-1]
+			if r.block.Offset+int64(r.block.Size) == b.Offset && int(r.block.Size)+int(b.Size) <= a.maxRequest && zero == lastZero {
+				if len(r.parts) == 0 {
+					r.parts = []scanner.Block{r.block}
+				}
+				r.parts = append(r.parts, b)
+				r.block = scanner.Block{Offset: r.block.Offset, Size: r.block.Size + b.Size}
+				continue
+			}
+		}
+		reqs = append(reqs, bqBlock{
 			file:  a.file,
 			block: b,
-			last:  i == l-1,
 		})
+		lastZero = zero
+	}
+	if a.maxBatch > 1 {
+		reqs = batchRequests(reqs, a.maxBatch, a.sparse)
+	}
+	if l := len(reqs); l > 0 {
+		reqs[l-1].last = true
+		q.queued = append(q.queued, reqs...)
 	}
 
-	if l == 0 {
+	if len(a.need) == 0 {
 		// If we didn't have anything to fetch, queue an empty block with the "last" flag set to close the file.
 		q.queued = append(q.queued, bqBlock{
 			file: a.file,
@@ -69,6 +97,53 @@ func (q *blockQueue) addBlock(a bqAdd) {
 	}
 }
 
+// batchRequests batches consecutive requests together, up to max requests
+// and the largest batch size. Zero blocks are kept out of batches when
+// sparse, so that they can be left as holes.
+func batchRequests(reqs []bqBlock, max int, sparse bool) []bqBlock {
+	batchable := func(b bqBlock) bool {
+		return !sparse || !isZeroBlock(firstBlock(b))
+	}
+	var res []bqBlock
+	for i := 0; i < len(reqs); {
+		j, size := i+1, reqs[i].block.Size
+		if batchable(reqs[i]) {
+			for j < len(reqs) && j-i < max && int(size)+int(reqs[j].block.Size) <= protocol.MaxBatchSize && batchable(reqs[j]) {
+				size += reqs[j].block.Size
+				j++
+			}
+		}
+		res = append(res, batchBlock(reqs[i].file, reqs[i:j]))
+		i = j
+	}
+	return res
+}
+
+// batchBlock returns a block requesting the blocks in one batch, or the
+// block itself if there is only one.
+func batchBlock(f scanner.File, reqs []bqBlock) bqBlock {
+	if len(reqs) == 1 {
+		return reqs[0]
+	}
+	b := bqBlock{
+		file:  f,
+		block: scanner.Block{Offset: reqs[0].block.Offset},
+		batch: append([]bqBlock(nil), reqs...),
+	}
+	for _, r := range reqs {
+		b.block.Size += r.block.Size
+	}
+	return b
+}
+
+// firstBlock returns the first of the blocks requested.
+func firstBlock(b bqBlock) scanner.Block {
+	if len(b.parts) > 0 {
+		return b.parts[0]
+	}
+	return b.block
+}
+
 func (q *blockQueue) run() {
 	for {
 		if len(q.queued) == 0 {
@@ -0,0 +1,111 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/calmh/syncthing/protocol"
+	"github.com/calmh/syncthing/scanner"
+)
+
+// caseDeletes returns the needed deletions of regular files, keyed by their
+// lower cased names, to be matched against files needed under a name that
+// differs only in case.
+func caseDeletes(need []scanner.File) map[string]scanner.File {
+	const special = protocol.FlagDirectory | protocol.FlagSymlink
+	deletes := make(map[string]scanner.File)
+	for _, f := range need {
+		if f.Flags&protocol.FlagDeleted != 0 && f.Flags&special == 0 {
+			deletes[strings.ToLower(f.Name)] = f
+		}
+	}
+	return deletes
+}
+
+// renameCase handles a needed file that replaces the deleted file d, whose
+// name differs only in case, with identical contents. The local file is
+// renamed in place instead of the new one being created next to it, which
+// a case insensitive filesystem would not allow, and the old one removed.
+// Filesystems refusing to rename a file to a variant of its own name are
+// catered for by going through a temporary name. Returns true if the file
+// was handled.
+func (p *puller) renameCase(d, f scanner.File) bool {
+	const special = protocol.FlagDeleted | protocol.FlagDirectory | protocol.FlagSymlink
+	if d.Name == f.Name || f.Invalid || f.Flags&special != 0 {
+		return false
+	}
+	if lf := p.model.CurrentRepoFile(p.repo, f.Name); lf.Name == f.Name && lf.Flags&protocol.FlagDeleted == 0 {
+		return false
+	}
+	of := p.model.CurrentRepoFile(p.repo, d.Name)
+	if of.Name != d.Name || of.Invalid || of.Flags&special != 0 || !scanner.SameBlocks(of.Blocks, f.Blocks) {
+		return false
+	}
+
+	// Make sure the file on disk is still the one we scanned
+	from := filepath.Join(p.dir, d.Name)
+	info, err := p.model.fs.Stat(from)
+	if err != nil || info.Size() != of.Size || info.ModTime().Unix() != of.Modified {
+		return false
+	}
+
+	to := filepath.Join(p.dir, f.Name)
+	temp := filepath.Join(p.dir, defTempNamer.TempName(f.Name))
+	if err := p.model.fs.Rename(from, temp); err != nil {
+		if debugPull {
+			dlog.Printf("pull: error: %q / %q: %v", p.repo, f.Name, err)
+		}
+		return false
+	}
+	if err := p.model.fs.Rename(temp, to); err != nil {
+		if debugPull {
+			dlog.Printf("pull: error: %q / %q: %v", p.repo, f.Name, err)
+		}
+		p.model.fs.Rename(temp, from)
+		return false
+	}
+
+	if err := p.restorePerms(to, f); err != nil && debugPull {
+		dlog.Printf("pull: error: %q / %q: %v", p.repo, f.Name, err)
+	}
+	p.restoreCreateTime(to, f)
+	t := time.Unix(f.Modified, 0)
+	if err := p.model.fs.Chtimes(to, t, t); err != nil && debugPull {
+		dlog.Printf("pull: error: %q / %q: %v", p.repo, f.Name, err)
+	}
+
+	if debugPull {
+		dlog.Printf("pull: rename %q / %q to %q", p.repo, d.Name, f.Name)
+	}
+	p.model.updateLocal(p.repo, f)
+	p.model.updateLocal(p.repo, d)
+	p.report().FilesPulled++
+	p.report().FilesDeleted++
+	p.completed(f, nil, uint64(p.model.repoFiles[p.repo].Availability(f.Name)))
+	return true
+}
+
+// caseVariant returns true if the directory holding path lacks an entry by
+// its exact name but has one whose name differs only in case. On a case
+// insensitive filesystem path then refers to that entry, which must not be
+// removed in its stead. Directory listings are cached in listed.
+func (p *puller) caseVariant(listed map[string][]os.FileInfo, path string) bool {
+	dir, base := filepath.Split(path)
+	infos, ok := listed[dir]
+	if !ok {
+		infos, _ = p.model.fs.ReadDir(dir)
+		listed[dir] = infos
+	}
+	variant := false
+	for _, info := range infos {
+		switch {
+		case info.Name() == base:
+			return false
+		case strings.EqualFold(info.Name(), base):
+			variant = true
+		}
+	}
+	return variant
+}
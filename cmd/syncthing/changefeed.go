@@ -0,0 +1,71 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/calmh/syncthing/events"
+	"github.com/calmh/syncthing/protocol"
+	"github.com/calmh/syncthing/scanner"
+)
+
+// ChangedSincePrefix is like ChangedSince, but returns only the files at or
+// below the path prefix.
+func (m *Model) ChangedSincePrefix(repo string, seq int64, prefix string) ([]scanner.File, int64) {
+	fs, seq := m.ChangedSince(repo, seq)
+	prefix = cleanPrefix(prefix)
+	var res []scanner.File
+	for _, f := range fs {
+		if hasPathPrefix(f.Name, prefix) {
+			res = append(res, f)
+		}
+	}
+	return res, seq
+}
+
+// WatchPrefix subscribes to the LocalFileChanged and FilePulled events of the
+// files at or below the path prefix in the repository. FilePulled is logged
+// for every change applied by the puller, including deletions and metadata
+// updates, and for files imported from a tar stream. As for other
+// subscriptions, events are dropped while the subscriber is not keeping up;
+// ChangedSincePrefix tells what was missed. The subscription is ended with
+// events.Default.Unsubscribe.
+func (m *Model) WatchPrefix(repo, prefix string) *events.Subscription {
+	prefix = cleanPrefix(prefix)
+	return events.Default.SubscribeFunc(events.LocalFileChanged|events.FilePulled, func(e events.Event) bool {
+		data, ok := e.Data.(map[string]interface{})
+		if !ok || data["repo"] != repo {
+			return false
+		}
+		name, _ := data["file"].(string)
+		return hasPathPrefix(name, prefix)
+	})
+}
+
+// fileEvent logs an event of the given type for the file.
+func (m *Model) fileEvent(t events.EventType, repo string, f scanner.File) {
+	events.Default.Log(t, map[string]interface{}{
+		"repo":    repo,
+		"file":    f.Name,
+		"version": f.Version,
+		"deleted": f.Flags&protocol.FlagDeleted != 0,
+	})
+}
+
+// cleanPrefix returns the path prefix in the form of the file names in the
+// index, or the empty string for the whole repository.
+func cleanPrefix(prefix string) string {
+	prefix = filepath.Clean(prefix)
+	if prefix == "." {
+		return ""
+	}
+	return prefix
+}
+
+// hasPathPrefix returns true if the file name is the prefix, or is below
+// it. Only whole path components match; "foo" is not a prefix of "foobar".
+// The empty prefix matches every name.
+func hasPathPrefix(name, prefix string) bool {
+	return prefix == "" || name == prefix || strings.HasPrefix(name, prefix+string(os.PathSeparator))
+}
@@ -0,0 +1,133 @@
+package main
+
+import (
+	"bytes"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/calmh/syncthing/events"
+	"github.com/calmh/syncthing/protocol"
+	"github.com/calmh/syncthing/scanner"
+	"github.com/calmh/syncthing/testutil"
+)
+
+func TestHasPathPrefix(t *testing.T) {
+	sep := string(os.PathSeparator)
+	cases := []struct {
+		name, prefix string
+		match        bool
+	}{
+		{"foo", "foo", true},
+		{"foo" + sep + "x", "foo", true},
+		{"foo" + sep + "bar" + sep + "x", "foo" + sep + "bar", true},
+		{"foobar" + sep + "x", "foo", false},
+		{"foobar", "foo", false},
+		{"fo", "foo", false},
+		{"foo", "", true},
+	}
+	for _, c := range cases {
+		if m := hasPathPrefix(c.name, c.prefix); m != c.match {
+			t.Errorf("hasPathPrefix(%q, %q) = %v, expected %v", c.name, c.prefix, m, c.match)
+		}
+	}
+}
+
+// watched returns the names of the files in the events delivered to the
+// subscription, until none arrive for a while.
+func watched(s *events.Subscription) map[string]events.EventType {
+	names := make(map[string]events.EventType)
+	for {
+		e, err := s.Poll(100 * time.Millisecond)
+		if err != nil {
+			return names
+		}
+		names[e.Data.(map[string]interface{})["file"].(string)] = e.Type
+	}
+}
+
+func TestWatchPrefix(t *testing.T) {
+	dir := filepath.Join(string(os.PathSeparator), "repo")
+	fs := testutil.NewFakeFS()
+	fs.MkdirAll(filepath.Join(dir, "foo"), 0755)
+	fs.MkdirAll(filepath.Join(dir, "foobar"), 0755)
+	fs.WriteFile(filepath.Join(dir, "foo", "a"), []byte("a"), 0644)
+	fs.WriteFile(filepath.Join(dir, "foobar", "x"), []byte("x"), 0644)
+	fs.WriteFile(filepath.Join(dir, "other"), []byte("other"), 0644)
+
+	m := NewModel(1e6)
+	m.SetFilesystem(fs)
+	m.AddRepo("default", dir, []NodeConfiguration{{NodeID: "42"}})
+	m.ScanRepo("default")
+	_, seq := m.ChangedSince("default", 0)
+
+	s := m.WatchPrefix("default", "foo")
+	defer events.Default.Unsubscribe(s)
+
+	// Local changes inside and outside of the prefix.
+	fs.WriteFile(filepath.Join(dir, "foo", "a"), []byte("changed"), 0644)
+	fs.WriteFile(filepath.Join(dir, "foo", "b"), []byte("new"), 0644)
+	fs.WriteFile(filepath.Join(dir, "foobar", "x"), []byte("changed"), 0644)
+	fs.WriteFile(filepath.Join(dir, "other"), []byte("changed"), 0644)
+	m.ScanRepo("default")
+
+	local := []string{filepath.Join("foo", "a"), filepath.Join("foo", "b")}
+	names := watched(s)
+	for _, name := range local {
+		if names[name] != events.LocalFileChanged {
+			t.Errorf("No local change event for %q", name)
+		}
+	}
+	for name := range names {
+		if !hasPathPrefix(name, "foo") {
+			t.Errorf("Event for %q outside of the prefix", name)
+		}
+	}
+
+	changed, _ := m.ChangedSincePrefix("default", seq, "foo"+string(os.PathSeparator))
+	found := make(map[string]bool)
+	for _, f := range changed {
+		if !hasPathPrefix(f.Name, "foo") {
+			t.Errorf("Changed file %q outside of the prefix", f.Name)
+		}
+		found[f.Name] = true
+	}
+	for _, name := range local {
+		if !found[name] {
+			t.Errorf("%q not among the changed files", name)
+		}
+	}
+
+	// Files pulled inside and outside of the prefix.
+	data := []byte("pulled")
+	blocks, _ := scanner.Blocks(bytes.NewReader(data), BlockSize)
+	pulled := scanner.File{Name: filepath.Join("foo", "pulled"), Flags: 0644, Modified: 1234567890, Version: 1000, Size: int64(len(data)), Blocks: blocks}
+	outside := pulled
+	outside.Name = filepath.Join("foobar", "pulled")
+	m.Index("42", "default", []protocol.FileInfo{fileInfoFromFile(pulled), fileInfoFromFile(outside)})
+	fc := FakeConnection{id: "42", requestData: data}
+	m.AddConnection(fc, fc)
+	pullAll(t, m, "default", dir)
+
+	names = watched(s)
+	if len(names) != 1 || names[pulled.Name] != events.FilePulled {
+		t.Errorf("Incorrect events for pulled files %v", names)
+	}
+
+	// Deletions and metadata only changes are pulled as well.
+	deleted := m.CurrentRepoFile("default", filepath.Join("foo", "b"))
+	deleted.Flags |= protocol.FlagDeleted
+	deleted.Version += 1000
+	deleted.Blocks = nil
+	touched := m.CurrentRepoFile("default", pulled.Name)
+	touched.Modified += 60
+	touched.Version += 1000
+	m.IndexUpdate("42", "default", []protocol.FileInfo{fileInfoFromFile(deleted), fileInfoFromFile(touched)})
+	pullAll(t, m, "default", dir)
+
+	names = watched(s)
+	if len(names) != 2 || names[deleted.Name] != events.FilePulled || names[touched.Name] != events.FilePulled {
+		t.Errorf("Incorrect events for deleted and touched files %v", names)
+	}
+}
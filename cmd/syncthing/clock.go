@@ -0,0 +1,33 @@
+package main
+
+import "time"
+
+// A clock tells the time for measuring internal durations, such as how long
+// an index broadcast has been held back or how fast a file changes. Its
+// times are only meaningful relative to each other; file modification times
+// and timestamps shown to the user come from the wall clock.
+type clock interface {
+	Now() time.Time
+}
+
+// monotonicClock follows the monotonic clock, which unlike the wall clock
+// isn't stepped backwards when the system time is corrected.
+type monotonicClock struct {
+	start time.Time     // wall clock time when the clock was created
+	mono  time.Duration // monotonic time when the clock was created
+}
+
+func newMonotonicClock() monotonicClock {
+	return monotonicClock{time.Now(), monotonicNow()}
+}
+
+// Now returns the start time advanced by the monotonic time elapsed since.
+// The result carries no monotonic reading of its own, so it stays correct
+// however it is compared or stored.
+func (c monotonicClock) Now() time.Time {
+	return c.start.Round(0).Add(monotonicNow() - c.mono)
+}
+
+// processStart is the reference for monotonicNow where there is no monotonic
+// clock to read directly.
+var processStart = time.Now()
@@ -0,0 +1,20 @@
+package main
+
+import (
+	"syscall"
+	"time"
+	"unsafe"
+)
+
+const clockMonotonic = 1 // CLOCK_MONOTONIC
+
+// monotonicNow returns the time of the system's monotonic clock, which counts
+// from an unspecified point in the past.
+func monotonicNow() time.Duration {
+	var ts syscall.Timespec
+	_, _, errno := syscall.Syscall(syscall.SYS_CLOCK_GETTIME, clockMonotonic, uintptr(unsafe.Pointer(&ts)), 0)
+	if errno != 0 {
+		return time.Since(processStart)
+	}
+	return time.Duration(ts.Nano())
+}
@@ -0,0 +1,12 @@
+// +build !linux
+
+package main
+
+import "time"
+
+// monotonicNow returns the time elapsed since the process started. The
+// runtime measures this on the monotonic clock from Go 1.9 on; earlier
+// versions fall back to the wall clock.
+func monotonicNow() time.Duration {
+	return time.Since(processStart)
+}
@@ -0,0 +1,44 @@
+package main
+
+import (
+	"sync"
+	"testing"
+	"time"
+)
+
+// fakeClock is a clock that only moves when told to.
+type fakeClock struct {
+	mut sync.Mutex
+	now time.Time
+}
+
+func newFakeClock() *fakeClock {
+	return &fakeClock{now: time.Unix(1234567890, 0)}
+}
+
+func (c *fakeClock) Now() time.Time {
+	c.mut.Lock()
+	defer c.mut.Unlock()
+	return c.now
+}
+
+func (c *fakeClock) advance(d time.Duration) {
+	c.mut.Lock()
+	c.now = c.now.Add(d)
+	c.mut.Unlock()
+}
+
+func TestMonotonicClock(t *testing.T) {
+	c := newMonotonicClock()
+	t0 := c.Now()
+	time.Sleep(10 * time.Millisecond)
+	t1 := c.Now()
+	if d := t1.Sub(t0); d < 10*time.Millisecond {
+		t.Errorf("Clock advanced only %v", d)
+	}
+	// Stripping the monotonic reading, as serializing does, must not
+	// change the time.
+	if !t1.Round(0).Equal(t1) {
+		t.Errorf("Clock time %v carries a monotonic reading", t1)
+	}
+}
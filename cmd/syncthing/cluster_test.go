@@ -0,0 +1,334 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"os"
+	"path/filepath"
+	"sort"
+	"testing"
+	"time"
+
+	"github.com/calmh/syncthing/cid"
+	"github.com/calmh/syncthing/protocol"
+)
+
+// A testCluster is a set of models sharing the repository "default", each
+// with its own temporary directory, connected to each other over the
+// protocol. The cluster is driven in rounds: every model scans, sends its
+// index to the others and pulls what it needs.
+type testCluster struct {
+	t      testing.TB
+	nodes  []string
+	models map[string]*Model
+	dirs   map[string]string
+	conns  []net.Conn
+	mtime  int64 // the modification time given to the next written file
+}
+
+// newTestCluster creates and connects n models, named node0 and onwards,
+// with empty repositories. The cluster must be closed after use.
+func newTestCluster(t testing.TB, n int) *testCluster {
+	c := &testCluster{
+		t:      t,
+		models: make(map[string]*Model),
+		dirs:   make(map[string]string),
+		mtime:  time.Now().Add(-24 * time.Hour).Unix(),
+	}
+	for i := 0; i < n; i++ {
+		c.nodes = append(c.nodes, fmt.Sprintf("node%d", i))
+	}
+
+	for _, node := range c.nodes {
+		dir, err := ioutil.TempDir("", "cluster")
+		if err != nil {
+			c.close()
+			t.Fatal(err)
+		}
+		var others []NodeConfiguration
+		for _, other := range c.nodes {
+			if other != node {
+				others = append(others, NodeConfiguration{NodeID: other})
+			}
+		}
+		m := NewModel(1e6)
+		m.AddRepo("default", dir, others)
+		m.ScanRepo("default")
+		c.models[node] = m
+		c.dirs[node] = dir
+	}
+
+	for i, a := range c.nodes {
+		for _, b := range c.nodes[i+1:] {
+			ac, bc := net.Pipe()
+			c.conns = append(c.conns, ac, bc)
+			// A connection is named after the node at the other end.
+			c.models[a].AddConnection(ac, protocol.NewConnection(b, ac, ac, c.models[a]))
+			c.models[b].AddConnection(bc, protocol.NewConnection(a, bc, bc, c.models[b]))
+		}
+	}
+
+	timeout := time.After(5 * time.Second)
+	for _, a := range c.nodes {
+		for _, b := range c.nodes {
+			for a != b && !c.models[a].IndexReceived(b) {
+				select {
+				case <-timeout:
+					c.close()
+					t.Fatalf("Timeout waiting for the index of %s on %s", b, a)
+				case <-time.After(10 * time.Millisecond):
+				}
+			}
+		}
+	}
+	return c
+}
+
+// close disconnects the models and removes their directories.
+func (c *testCluster) close() {
+	for _, conn := range c.conns {
+		conn.Close()
+	}
+	for _, dir := range c.dirs {
+		os.RemoveAll(dir)
+	}
+}
+
+// writeFile writes the file in the repository of the node.
+func (c *testCluster) writeFile(node, name string, data []byte) {
+	path := filepath.Join(c.dirs[node], filepath.FromSlash(name))
+	if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+		c.t.Fatal(err)
+	}
+	if err := ioutil.WriteFile(path, data, 0644); err != nil {
+		c.t.Fatal(err)
+	}
+	c.touch(path)
+}
+
+// touch gives the file a modification time distinct from all earlier ones,
+// so that the scanner notices the change.
+func (c *testCluster) touch(path string) {
+	c.mtime++
+	t := time.Unix(c.mtime, 0)
+	if err := os.Chtimes(path, t, t); err != nil {
+		c.t.Fatal(err)
+	}
+}
+
+// removeFile removes the file from the repository of the node.
+func (c *testCluster) removeFile(node, name string) {
+	if err := os.Remove(filepath.Join(c.dirs[node], filepath.FromSlash(name))); err != nil {
+		c.t.Fatal(err)
+	}
+}
+
+// chmod changes the permissions of the file in the repository of the node.
+func (c *testCluster) chmod(node, name string, mode os.FileMode) {
+	path := filepath.Join(c.dirs[node], filepath.FromSlash(name))
+	if err := os.Chmod(path, mode); err != nil {
+		c.t.Fatal(err)
+	}
+	c.touch(path)
+}
+
+// round has every model scan, send its index to the others, and pull what
+// it needs.
+func (c *testCluster) round() {
+	for _, node := range c.nodes {
+		c.models[node].ScanRepo("default")
+	}
+	for _, node := range c.nodes {
+		m := c.models[node]
+		m.rmut.RLock()
+		idx := m.protocolIndex("default")
+		m.rmut.RUnlock()
+		m.pmut.RLock()
+		var conns []protocol.Connection
+		for _, conn := range m.protoConn {
+			conns = append(conns, conn)
+		}
+		m.pmut.RUnlock()
+		for _, conn := range conns {
+			conn.Index("default", idx)
+		}
+	}
+	// Indexes are applied asynchronously by the receiving side.
+	time.Sleep(50 * time.Millisecond)
+	for _, node := range c.nodes {
+		if r := pullAll(c.t, c.models[node], "default", c.dirs[node]); len(r.Failures) != 0 {
+			c.t.Logf("%s: pull failures %+v", node, r.Failures)
+		}
+	}
+}
+
+// waitForConvergence runs rounds until all models have the same local
+// index and the same files on disk, or the timeout expires.
+func (c *testCluster) waitForConvergence(timeout time.Duration) error {
+	deadline := time.Now().Add(timeout)
+	for {
+		c.round()
+		err := c.converged()
+		if err == nil || time.Now().After(deadline) {
+			return err
+		}
+	}
+}
+
+// converged returns nil if all models have the same files, in their local
+// indexes and on disk, or an error describing the first difference.
+func (c *testCluster) converged() error {
+	first := c.nodes[0]
+	idx0 := c.localIndex(first)
+	tree0, err := c.tree(first)
+	if err != nil {
+		return err
+	}
+	for _, node := range c.nodes[1:] {
+		if idx := c.localIndex(node); idx != idx0 {
+			return fmt.Errorf("index of %s differs from %s:\n%s\n%s", node, first, idx, idx0)
+		}
+		tree, err := c.tree(node)
+		if err != nil {
+			return err
+		}
+		if tree != tree0 {
+			return fmt.Errorf("files of %s differ from %s:\n%s\n%s", node, first, tree, tree0)
+		}
+	}
+	return nil
+}
+
+// localIndex describes the files in the local index of the node. Deleted
+// files are left out, since a node that never had a file doesn't record
+// its deletion.
+func (c *testCluster) localIndex(node string) string {
+	var lines []string
+	for _, f := range c.models[node].repoFiles["default"].Have(cid.LocalID) {
+		if f.Flags&protocol.FlagDeleted == 0 {
+			lines = append(lines, fmt.Sprintf("%s v=%d f=%o", filepath.ToSlash(f.Name), f.Version, f.Flags))
+		}
+	}
+	sort.Strings(lines)
+	return fmt.Sprint(lines)
+}
+
+// tree describes the files in the repository directory of the node.
+func (c *testCluster) tree(node string) (string, error) {
+	dir := c.dirs[node]
+	var lines []string
+	err := filepath.Walk(dir, func(path string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		rel, _ := filepath.Rel(dir, path)
+		if rel == "." || defTempNamer.IsTemporary(info.Name()) {
+			return nil
+		}
+		line := fmt.Sprintf("%s %v", filepath.ToSlash(rel), info.Mode())
+		if info.Mode().IsRegular() {
+			data, err := ioutil.ReadFile(path)
+			if err != nil {
+				return err
+			}
+			line += fmt.Sprintf(" %q", data)
+		}
+		lines = append(lines, line)
+		return nil
+	})
+	return fmt.Sprint(lines), err
+}
+
+// exists returns true if the node has the file with the given contents on
+// disk.
+func (c *testCluster) exists(node, name string, data []byte) bool {
+	bs, err := ioutil.ReadFile(filepath.Join(c.dirs[node], filepath.FromSlash(name)))
+	return err == nil && bytes.Equal(bs, data)
+}
+
+func TestClusterAdd(t *testing.T) {
+	c := newTestCluster(t, 3)
+	defer c.close()
+
+	c.writeFile("node0", "file", []byte("added on node0"))
+	c.writeFile("node1", "dir/sub", []byte("added on node1"))
+	if err := c.waitForConvergence(10 * time.Second); err != nil {
+		t.Fatal(err)
+	}
+	for _, node := range c.nodes {
+		if !c.exists(node, "file", []byte("added on node0")) || !c.exists(node, "dir/sub", []byte("added on node1")) {
+			t.Errorf("%s: files not added", node)
+		}
+	}
+}
+
+func TestClusterModify(t *testing.T) {
+	c := newTestCluster(t, 3)
+	defer c.close()
+
+	c.writeFile("node0", "file", []byte("original"))
+	if err := c.waitForConvergence(10 * time.Second); err != nil {
+		t.Fatal(err)
+	}
+
+	c.writeFile("node2", "file", []byte("modified on node2"))
+	if err := c.waitForConvergence(10 * time.Second); err != nil {
+		t.Fatal(err)
+	}
+	for _, node := range c.nodes {
+		if !c.exists(node, "file", []byte("modified on node2")) {
+			t.Errorf("%s: file not modified", node)
+		}
+	}
+
+	c.chmod("node1", "file", 0600)
+	if err := c.waitForConvergence(10 * time.Second); err != nil {
+		t.Fatal(err)
+	}
+	for _, node := range c.nodes {
+		fi, err := os.Stat(filepath.Join(c.dirs[node], "file"))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if fi.Mode().Perm() != 0600 {
+			t.Errorf("%s: unexpected permissions %v", node, fi.Mode())
+		}
+	}
+}
+
+func TestClusterDelete(t *testing.T) {
+	c := newTestCluster(t, 3)
+	defer c.close()
+
+	c.writeFile("node0", "file", []byte("to be deleted"))
+	c.writeFile("node0", "kept", []byte("to be kept"))
+	if err := c.waitForConvergence(10 * time.Second); err != nil {
+		t.Fatal(err)
+	}
+
+	c.removeFile("node1", "file")
+	if err := c.waitForConvergence(10 * time.Second); err != nil {
+		t.Fatal(err)
+	}
+	for _, node := range c.nodes {
+		if _, err := os.Stat(filepath.Join(c.dirs[node], "file")); !os.IsNotExist(err) {
+			t.Errorf("%s: file not deleted: %v", node, err)
+		}
+		if !c.exists(node, "kept", []byte("to be kept")) {
+			t.Errorf("%s: kept file missing", node)
+		}
+	}
+
+	// Further rounds don't bring the file back.
+	c.round()
+	if err := c.converged(); err != nil {
+		t.Error(err)
+	}
+	for _, node := range c.nodes {
+		if f := c.models[node].CurrentRepoFile("default", "file"); f.Flags&protocol.FlagDeleted == 0 {
+			t.Errorf("%s: file not deleted in index: %v", node, f)
+		}
+	}
+}
@@ -21,11 +21,12 @@ type Configuration struct {
 }
 
 type RepositoryConfiguration struct {
-	ID        string              `xml:"id,attr"`
-	Directory string              `xml:"directory,attr"`
-	Nodes     []NodeConfiguration `xml:"node"`
-	ReadOnly  bool                `xml:"ro,attr"`
-	Invalid   string              `xml:"-"` // Set at runtime when there is an error, not saved
+	ID        string               `xml:"id,attr"`
+	Directory string               `xml:"directory,attr"`
+	Nodes     []NodeConfiguration  `xml:"node"`
+	ReadOnly  bool                 `xml:"ro,attr"`
+	Mounts    []MountConfiguration `xml:"mount"`
+	Invalid   string               `xml:"-"` // Set at runtime when there is an error, not saved
 	nodeIDs   []string
 }
 
@@ -38,10 +39,20 @@ func (r *RepositoryConfiguration) NodeIDs() []string {
 	return r.nodeIDs
 }
 
+// MountConfiguration gives the policy for a directory in the repository that
+// may be a mount point: "content" to scan it as any other directory, or
+// "guard" to leave the files below it alone while nothing is mounted on it.
+type MountConfiguration struct {
+	Path   string `xml:"path,attr"`
+	Policy string `xml:"policy,attr"`
+}
+
 type NodeConfiguration struct {
-	NodeID    string   `xml:"id,attr"`
-	Name      string   `xml:"name,attr,omitempty"`
-	Addresses []string `xml:"address,omitempty"`
+	NodeID           string   `xml:"id,attr"`
+	Name             string   `xml:"name,attr,omitempty"`
+	Addresses        []string `xml:"address,omitempty"`
+	InitialIndexKbps int      `xml:"initialIndexKbps,attr,omitempty"` // zero for no limit
+	IgnoreDeletes    bool     `xml:"ignoreDeletes,attr,omitempty"`    // don't carry out deletions announced only by this node
 }
 
 type OptionsConfiguration struct {
@@ -56,6 +67,33 @@ type OptionsConfiguration struct {
 	MaxChangeKbps      int      `xml:"maxChangeKbps" default:"1000"`
 	StartBrowser       bool     `xml:"startBrowser" default:"true"`
 	UPnPEnabled        bool     `xml:"upnpEnabled" default:"true"`
+	MaxPullFailures    int      `xml:"maxPullFailures" default:"5"`
+	MaxDiskReadKbps    int      `xml:"maxDiskReadKbps"`
+	MaxDiskWriteKbps   int      `xml:"maxDiskWriteKbps"`
+	MaxIndexAgeS       int      `xml:"maxIndexAgeS"`
+	VerifyRenames      bool     `xml:"verifyRenames" default:"true"`
+	MaxLockedAttempts  int      `xml:"maxLockedAttempts" default:"3"`
+	LockedBackoffS     int      `xml:"lockedBackoffS" default:"3600"`
+	Symlinks           string   `xml:"symlinks" default:"ignore"`
+	PreserveOriginals  bool     `xml:"preserveOriginals" default:"true"`
+	Copiers            int      `xml:"copiers" default:"1"`
+	NodeStatsSaveS     int      `xml:"nodeStatsSaveS" default:"300"`
+	MaxInvalidS        int      `xml:"maxInvalidS" default:"86400"`
+	GuardPlaceholders  bool     `xml:"guardPlaceholders" default:"true"`
+	TombstoneExpiryS   int      `xml:"tombstoneExpiryS"`
+	CheckSizes         bool     `xml:"checkSizes" default:"true"`
+	PullPriority       []string `xml:"pullPriority"`
+	CreateTimes        bool     `xml:"createTimes"`
+	MaxDeletes         int      `xml:"maxDeletes"`
+	MaxDeletePercent   int      `xml:"maxDeletePercent"`
+	SparseFiles        bool     `xml:"sparseFiles"`
+	KeepVersions       int      `xml:"keepVersions"`
+	MaxCompressedConns int      `xml:"maxCompressedConnections"`
+	MaxScanDepth       int      `xml:"maxScanDepth" default:"-1"`
+	SettleTimeS        int      `xml:"settleTimeS"`
+	IgnorePerms        bool     `xml:"ignorePerms"`
+	DiskReserveMB      int      `xml:"diskReserveMB" default:"100"`
+	SourceRetryS       int      `xml:"sourceRetryS" default:"300"`
 
 	Deprecated_ReadOnly   bool   `xml:"readOnly,omitempty" json:"-"`
 	Deprecated_GUIEnabled bool   `xml:"guiEnabled,omitempty" json:"-"`
@@ -21,6 +21,32 @@ func TestDefaultValues(t *testing.T) {
 		MaxChangeKbps:      1000,
 		StartBrowser:       true,
 		UPnPEnabled:        true,
+		MaxPullFailures:    5,
+		MaxDiskReadKbps:    0,
+		MaxDiskWriteKbps:   0,
+		MaxIndexAgeS:       0,
+		VerifyRenames:      true,
+		MaxLockedAttempts:  3,
+		LockedBackoffS:     3600,
+		Symlinks:           "ignore",
+		PreserveOriginals:  true,
+		Copiers:            1,
+		NodeStatsSaveS:     300,
+		MaxInvalidS:        86400,
+		GuardPlaceholders:  true,
+		TombstoneExpiryS:   0,
+		CheckSizes:         true,
+		CreateTimes:        false,
+		MaxDeletes:         0,
+		MaxDeletePercent:   0,
+		SparseFiles:        false,
+		KeepVersions:       0,
+		MaxCompressedConns: 0,
+		MaxScanDepth:       -1,
+		SettleTimeS:        0,
+		IgnorePerms:        false,
+		DiskReserveMB:      100,
+		SourceRetryS:       300,
 	}
 
 	cfg, err := readConfigXML(bytes.NewReader(nil), "nodeID")
@@ -152,6 +178,34 @@ func TestOverriddenValues(t *testing.T) {
         <maxChangeKbps>2345</maxChangeKbps>
         <startBrowser>false</startBrowser>
         <upnpEnabled>false</upnpEnabled>
+        <maxPullFailures>10</maxPullFailures>
+        <maxDiskReadKbps>3456</maxDiskReadKbps>
+        <maxDiskWriteKbps>4567</maxDiskWriteKbps>
+        <maxIndexAgeS>7200</maxIndexAgeS>
+        <verifyRenames>false</verifyRenames>
+        <maxLockedAttempts>5</maxLockedAttempts>
+        <lockedBackoffS>600</lockedBackoffS>
+        <symlinks>recreate</symlinks>
+        <preserveOriginals>false</preserveOriginals>
+        <copiers>4</copiers>
+        <nodeStatsSaveS>0</nodeStatsSaveS>
+        <maxInvalidS>600</maxInvalidS>
+        <guardPlaceholders>false</guardPlaceholders>
+        <tombstoneExpiryS>2592000</tombstoneExpiryS>
+        <checkSizes>false</checkSizes>
+        <pullPriority>*.md</pullPriority>
+        <pullPriority>**/Makefile</pullPriority>
+        <createTimes>true</createTimes>
+        <maxDeletes>100</maxDeletes>
+        <maxDeletePercent>25</maxDeletePercent>
+        <sparseFiles>true</sparseFiles>
+        <keepVersions>5</keepVersions>
+        <maxCompressedConnections>20</maxCompressedConnections>
+        <maxScanDepth>3</maxScanDepth>
+        <settleTimeS>10</settleTimeS>
+        <ignorePerms>true</ignorePerms>
+        <diskReserveMB>500</diskReserveMB>
+        <sourceRetryS>30</sourceRetryS>
     </options>
 </configuration>
 `)
@@ -168,6 +222,33 @@ func TestOverriddenValues(t *testing.T) {
 		MaxChangeKbps:      2345,
 		StartBrowser:       false,
 		UPnPEnabled:        false,
+		MaxPullFailures:    10,
+		MaxDiskReadKbps:    3456,
+		MaxDiskWriteKbps:   4567,
+		MaxIndexAgeS:       7200,
+		VerifyRenames:      false,
+		MaxLockedAttempts:  5,
+		LockedBackoffS:     600,
+		Symlinks:           "recreate",
+		PreserveOriginals:  false,
+		Copiers:            4,
+		NodeStatsSaveS:     0,
+		MaxInvalidS:        600,
+		GuardPlaceholders:  false,
+		TombstoneExpiryS:   2592000,
+		CheckSizes:         false,
+		PullPriority:       []string{"*.md", "**/Makefile"},
+		CreateTimes:        true,
+		MaxDeletes:         100,
+		MaxDeletePercent:   25,
+		SparseFiles:        true,
+		KeepVersions:       5,
+		MaxCompressedConns: 20,
+		MaxScanDepth:       3,
+		SettleTimeS:        10,
+		IgnorePerms:        true,
+		DiskReserveMB:      500,
+		SourceRetryS:       30,
 	}
 
 	cfg, err := readConfigXML(bytes.NewReader(data), "nodeID")
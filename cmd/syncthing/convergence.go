@@ -0,0 +1,164 @@
+package main
+
+import (
+	"time"
+
+	"github.com/calmh/syncthing/events"
+	"github.com/calmh/syncthing/scanner"
+)
+
+// ConvergenceStats is how long changes made locally took to show in the
+// index of a node, that is, until the node had pulled them.
+type ConvergenceStats struct {
+	Changes int           `json:"changes"` // the number of changes measured
+	Last    time.Duration `json:"last"`
+	Mean    time.Duration `json:"mean"`
+	Max     time.Duration `json:"max"`
+}
+
+func (s *ConvergenceStats) add(d time.Duration) {
+	s.Mean = (s.Mean*time.Duration(s.Changes) + d) / time.Duration(s.Changes+1)
+	s.Changes++
+	s.Last = d
+	if d > s.Max {
+		s.Max = d
+	}
+}
+
+// The longest a local change waits to show in the index of a node. A node
+// that ignores the file never announces it.
+const convergenceExpiry = 24 * time.Hour
+
+// A localChange is a change found by scanning, waiting to show in the
+// indexes of the nodes that were connected when it was found.
+type localChange struct {
+	version uint64
+	at      time.Time
+	nodes   map[string]bool
+}
+
+// ConvergenceStats returns the convergence of local changes for each node
+// that has announced any.
+func (m *Model) ConvergenceStats() map[string]ConvergenceStats {
+	m.cmut.Lock()
+	defer m.cmut.Unlock()
+	res := make(map[string]ConvergenceStats, len(m.convergence))
+	for node, s := range m.convergence {
+		res[node] = *s
+	}
+	return res
+}
+
+// localChanged starts measuring the convergence of the files changed by a
+// scan, for the connected nodes sharing the repository.
+func (m *Model) localChanged(repo string, fs []scanner.File) {
+	if len(fs) == 0 {
+		return
+	}
+	connected := m.connectedNodes()
+	nodes := make(map[string]bool)
+	m.rmut.RLock()
+	for _, node := range m.repoNodes[repo] {
+		if connected[node] {
+			nodes[node] = true
+		}
+	}
+	m.rmut.RUnlock()
+	if len(nodes) == 0 {
+		return
+	}
+
+	now := m.clock.Now()
+	m.cmut.Lock()
+	defer m.cmut.Unlock()
+	changes, ok := m.changes[repo]
+	if !ok {
+		changes = make(map[string]*localChange)
+		m.changes[repo] = changes
+	}
+	for name, c := range changes {
+		if now.Sub(c.at) > convergenceExpiry {
+			delete(changes, name)
+		}
+	}
+	for _, f := range fs {
+		c := &localChange{version: f.Version, at: now, nodes: make(map[string]bool, len(nodes))}
+		for node := range nodes {
+			c.nodes[node] = true
+		}
+		changes[f.Name] = c
+	}
+}
+
+// indexConverged records the convergence of the local changes that show in
+// the index received from the node. A newer version ends the wait without
+// counting, as under Lamport clocks it may come from a change made without
+// seeing ours.
+func (m *Model) indexConverged(nodeID, repo string, fs []scanner.File) {
+	now := m.clock.Now()
+	var n int
+	var max time.Duration
+
+	m.cmut.Lock()
+	changes := m.changes[repo]
+	if len(changes) == 0 {
+		m.cmut.Unlock()
+		return
+	}
+	for _, f := range fs {
+		c, ok := changes[f.Name]
+		if !ok || !c.nodes[nodeID] || f.Version < c.version {
+			continue
+		}
+		delete(c.nodes, nodeID)
+		if len(c.nodes) == 0 {
+			delete(changes, f.Name)
+		}
+		if f.Version > c.version {
+			continue
+		}
+
+		d := now.Sub(c.at)
+		s, ok := m.convergence[nodeID]
+		if !ok {
+			s = &ConvergenceStats{}
+			m.convergence[nodeID] = s
+		}
+		s.add(d)
+		n++
+		if d > max {
+			max = d
+		}
+	}
+	m.cmut.Unlock()
+
+	if n > 0 {
+		if debugIdx {
+			dlog.Printf("IDX(in): %s / %q: %d local changes converged, max %v", nodeID, repo, n, max)
+		}
+		events.Default.Log(events.ChangesConverged, map[string]interface{}{
+			"node":    nodeID,
+			"repo":    repo,
+			"changes": n,
+			"max":     max,
+		})
+	}
+}
+
+// dropChanges stops waiting for the local changes in the repository, or in
+// all repositories if repo is empty, to show in the index of the node.
+func (m *Model) dropChanges(nodeID, repo string) {
+	m.cmut.Lock()
+	for r, changes := range m.changes {
+		if repo != "" && r != repo {
+			continue
+		}
+		for name, c := range changes {
+			delete(c.nodes, nodeID)
+			if len(c.nodes) == 0 {
+				delete(changes, name)
+			}
+		}
+	}
+	m.cmut.Unlock()
+}
@@ -0,0 +1,85 @@
+package main
+
+import (
+	"github.com/calmh/syncthing/buffers"
+	"github.com/calmh/syncthing/scanner"
+	"github.com/calmh/syncthing/vfs"
+)
+
+// The largest number of blocks handed to a copier at once. The unchanged
+// blocks of a large file are split into jobs of this size so that several
+// copiers can work on the same file.
+const copyJobBlocks = 16
+
+// A copyJob copies blocks from the existing version of a file into the
+// temporary file being pulled.
+type copyJob struct {
+	repo    string
+	file    scanner.File
+	src     string   // path of the existing file
+	dst     vfs.File // the temporary file
+	temp    string   // path of the temporary file
+	blocks  []scanner.Block
+	results chan<- copyResult
+}
+
+type copyResult struct {
+	file     scanner.File
+	verified int // blocks copied, all checked against their hash
+	err      error
+}
+
+// SetCopiers sets the number of workers copying unchanged blocks from
+// existing files when pulling. The workers are shared by all repositories.
+// The number can only be increased. Copied data counts towards the disk
+// write limit set by SetDiskIORate, so with a limit in place more copiers
+// don't mean faster copying.
+func (m *Model) SetCopiers(n int) {
+	m.rmut.Lock()
+	for ; m.copiers < n; m.copiers++ {
+		go m.copier()
+	}
+	m.rmut.Unlock()
+}
+
+// copier runs copy jobs until the model goes away.
+func (m *Model) copier() {
+	for job := range m.copyJobs {
+		res := copyResult{file: job.file, err: m.copyBlocks(job)}
+		if res.err == nil {
+			res.verified = len(job.blocks)
+		}
+		job.results <- res
+	}
+}
+
+// copyBlocks copies the blocks of the job, checking each against its hash
+// so that the file need not be read back once pulled. A block that no
+// longer matches, because the existing file has changed since it was
+// scanned, fails the job.
+func (m *Model) copyBlocks(job copyJob) error {
+	src, err := m.fs.Open(job.src)
+	if err != nil {
+		return err
+	}
+	defer src.Close()
+	vfs.Advise(src, vfs.AdviceSequential)
+
+	for _, b := range job.blocks {
+		bs := buffers.Get(int(b.Size))
+		err = vfs.ReadFullAt(src, job.src, bs, b.Offset)
+		if err == nil {
+			err = verifyParts(bs, b.Offset, []scanner.Block{b})
+		}
+		if err == nil {
+			m.waitDiskWrite(len(bs))
+			err = vfs.WriteFullAt(job.dst, job.temp, bs, b.Offset)
+		}
+		buffers.Put(bs)
+		if err != nil {
+			return err
+		}
+		m.transferWritten(job.repo, job.file.Name, int(b.Size))
+	}
+	return nil
+}
@@ -0,0 +1,145 @@
+package main
+
+import (
+	"sort"
+
+	"github.com/calmh/syncthing/cid"
+	"github.com/calmh/syncthing/events"
+	"github.com/calmh/syncthing/protocol"
+	"github.com/calmh/syncthing/scanner"
+)
+
+// The number of file names listed in the warning about held deletions.
+const deleteSampleSize = 10
+
+type deleteGuard struct {
+	held      []scanner.File    // deletions held in the last pull round
+	confirmed map[string]uint64 // file name -> version of a confirmed deletion
+}
+
+// SetDeleteLimit sets the number of deletions, and the percentage of the
+// local files, that a single pull round may carry out in a repository.
+// Beyond either limit the deletions of the round are held, while other
+// changes are pulled as usual, until confirmed by ConfirmPendingDeletes.
+// Zero means no limit.
+func (m *Model) SetDeleteLimit(files, percent int) {
+	m.rmut.Lock()
+	m.maxDelete = files
+	m.maxDelPct = percent
+	m.rmut.Unlock()
+}
+
+// HeldDeletes returns the deletions in the repository held in the last pull
+// round for exceeding the delete limits.
+func (m *Model) HeldDeletes(repo string) []scanner.File {
+	m.rmut.RLock()
+	defer m.rmut.RUnlock()
+	if g, ok := m.delGuards[repo]; ok {
+		return append([]scanner.File(nil), g.held...)
+	}
+	return nil
+}
+
+// ConfirmPendingDeletes allows the deletions in the repository held in the
+// last pull round to be carried out in the next one, and returns their
+// number. A confirmation lapses for a file that is changed again before it
+// is deleted.
+func (m *Model) ConfirmPendingDeletes(repo string) int {
+	m.rmut.Lock()
+	defer m.rmut.Unlock()
+	g, ok := m.delGuards[repo]
+	if !ok {
+		return 0
+	}
+	n := len(g.held)
+	for _, f := range g.held {
+		g.confirmed[f.Name] = f.Version
+	}
+	g.held = nil
+	return n
+}
+
+// holdDeletes returns the deletions needed in the repository, and true if
+// they exceed the delete limits and are not confirmed, in which case no
+// deletions are to be carried out this round. Otherwise exactly the returned
+// deletions are to be carried out, as the need may have grown since. The
+// needed deletions are evaluated anew every round, so deletions since
+// reverted by the cluster neither count nor stay held.
+func (m *Model) holdDeletes(repo string) ([]scanner.File, bool) {
+	m.rmut.Lock()
+	rf, ok := m.repoFiles[repo]
+	if !ok {
+		delete(m.delGuards, repo)
+		m.rmut.Unlock()
+		return nil, false
+	}
+	var deletes []scanner.File
+	for _, f := range m.trustedNeed(rf) {
+		if f.Flags&protocol.FlagDeleted != 0 {
+			deletes = append(deletes, f)
+		}
+	}
+	if m.maxDelete == 0 && m.maxDelPct == 0 {
+		delete(m.delGuards, repo)
+		m.rmut.Unlock()
+		return deletes, false
+	}
+	g, ok := m.delGuards[repo]
+	if !ok {
+		g = &deleteGuard{confirmed: make(map[string]uint64)}
+		m.delGuards[repo] = g
+	}
+
+	var unconfirmed []scanner.File
+	confirmed := make(map[string]uint64)
+	for _, f := range deletes {
+		if v, ok := g.confirmed[f.Name]; ok && v == f.Version {
+			confirmed[f.Name] = v
+		} else {
+			unconfirmed = append(unconfirmed, f)
+		}
+	}
+	g.confirmed = confirmed
+	sort.Sort(fileList(unconfirmed))
+
+	local, _, _ := sizeOf(rf.Have(cid.LocalID))
+	n := len(unconfirmed)
+	over := m.maxDelete > 0 && n > m.maxDelete || m.maxDelPct > 0 && local > 0 && n*100 > m.maxDelPct*local
+	if !over {
+		g.held = nil
+		m.rmut.Unlock()
+		return deletes, false
+	}
+	changed := !sameFiles(g.held, unconfirmed)
+	g.held = unconfirmed
+	m.rmut.Unlock()
+
+	if changed {
+		sample := make([]string, 0, deleteSampleSize)
+		for i := 0; i < n && i < deleteSampleSize; i++ {
+			sample = append(sample, unconfirmed[i].Name)
+		}
+		warnf("Holding %d deletions of %d files in repo %q until confirmed, including %q", n, local, repo, sample)
+		events.Default.Log(events.DeletesHeld, map[string]interface{}{
+			"repo":   repo,
+			"count":  n,
+			"local":  local,
+			"sample": sample,
+		})
+	}
+	return deletes, true
+}
+
+// sameFiles returns true if the lists hold the same file versions in the
+// same order.
+func sameFiles(a, b []scanner.File) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for i := range a {
+		if a[i].Name != b[i].Name || a[i].Version != b[i].Version {
+			return false
+		}
+	}
+	return true
+}
@@ -0,0 +1,90 @@
+package main
+
+import (
+	"github.com/calmh/syncthing/cid"
+	"github.com/calmh/syncthing/files"
+	"github.com/calmh/syncthing/protocol"
+	"github.com/calmh/syncthing/scanner"
+)
+
+// A PendingDelete is a deletion announced only by nodes whose deletes are not
+// trusted, and so not carried out locally.
+type PendingDelete struct {
+	File  scanner.File `json:"file"`
+	Nodes []string     `json:"nodes"` // the nodes announcing the deletion
+}
+
+// SetDeleteTrust sets whether deletions announced by the node are carried
+// out locally. Nodes are trusted by default. A deletion is carried out when
+// at least one trusted node announces it; others are held as pending
+// deletes, which are carried out as soon as an announcing node becomes
+// trusted.
+func (m *Model) SetDeleteTrust(nodeID string, trusted bool) {
+	m.rmut.Lock()
+	if trusted {
+		delete(m.noDeletes, nodeID)
+	} else {
+		m.noDeletes[nodeID] = true
+	}
+	m.rmut.Unlock()
+}
+
+// PendingDeletes returns the deletions in the repository announced only by
+// nodes whose deletes are not trusted.
+func (m *Model) PendingDeletes(repo string) []PendingDelete {
+	m.rmut.RLock()
+	defer m.rmut.RUnlock()
+	rf, ok := m.repoFiles[repo]
+	if !ok {
+		return nil
+	}
+
+	var res []PendingDelete
+	for _, f := range rf.Need(cid.LocalID) {
+		if m.untrustedDelete(rf, f) {
+			res = append(res, PendingDelete{
+				File:  f,
+				Nodes: m.sources(uint64(rf.Availability(f.Name))),
+			})
+		}
+	}
+	return res
+}
+
+// untrustedDelete returns true if f is a deletion announced only by nodes
+// whose deletes are not trusted. Must be called with rmut held.
+func (m *Model) untrustedDelete(rf *files.Set, f scanner.File) bool {
+	if f.Flags&protocol.FlagDeleted == 0 || len(m.noDeletes) == 0 {
+		return false
+	}
+	for _, node := range m.sources(uint64(rf.Availability(f.Name))) {
+		if !m.noDeletes[node] {
+			return false
+		}
+	}
+	return true
+}
+
+// trustedNeed returns the needed files, less the deletions not carried out
+// and the files announced as invalid, which there is nothing to pull of.
+// Must be called with rmut held.
+func (m *Model) trustedNeed(rf *files.Set) []scanner.File {
+	fs := rf.Need(cid.LocalID)
+	var res []scanner.File
+	for _, f := range fs {
+		if !f.Invalid && !m.untrustedDelete(rf, f) {
+			res = append(res, f)
+		}
+	}
+	return res
+}
+
+// globalDelete returns true if the global version of the file is a deletion
+// that is carried out locally.
+func (m *Model) globalDelete(repo, name string) bool {
+	m.rmut.RLock()
+	defer m.rmut.RUnlock()
+	rf := m.repoFiles[repo]
+	f := rf.GetGlobal(name)
+	return f.Name == name && f.Flags&protocol.FlagDeleted != 0 && !m.untrustedDelete(rf, f)
+}
@@ -0,0 +1,102 @@
+package main
+
+import (
+	"errors"
+
+	"github.com/calmh/syncthing/events"
+	"github.com/calmh/syncthing/vfs"
+)
+
+var errOutOfDiskSpace = errors.New("out of disk space")
+
+// SetDiskReserve sets the number of bytes that pulling leaves free on the
+// filesystem of each repository. A file is not pulled while the free space
+// less the reserve is smaller than the file; it is tried again once enough
+// space has been freed. Free space is not checked on filesystems that
+// cannot tell it.
+func (m *Model) SetDiskReserve(bytes int64) {
+	m.rmut.Lock()
+	m.reserve = bytes
+	m.rmut.Unlock()
+}
+
+// spaceCheck keeps track of the free space for files queued for pulling.
+type spaceCheck struct {
+	known    bool  // whether the free space could be told
+	free     int64 // bytes free less the reserve and the files queued so far
+	reserve  int64
+	deferred int // files that did not fit
+}
+
+// spaceCheck returns a check of the free space in the directory. The space
+// is unknown if it cannot be told.
+func (m *Model) spaceCheck(dir string) *spaceCheck {
+	m.rmut.RLock()
+	fn := m.freeSpace
+	reserve := m.reserve
+	m.rmut.RUnlock()
+
+	var free int64
+	var err error
+	if fn != nil {
+		free, err = fn(dir)
+	} else {
+		free, err = vfs.FreeSpace(m.fs, dir)
+	}
+	if err != nil {
+		if err != vfs.ErrNoFreeSpace && debugPull {
+			dlog.Printf("free space of %q: %v", dir, err)
+		}
+		return &spaceCheck{}
+	}
+	return &spaceCheck{known: true, free: free - reserve, reserve: reserve}
+}
+
+// fits returns true if a file of the given size fits in the free space, in
+// which case the space is taken by the file.
+func (s *spaceCheck) fits(size int64) bool {
+	if !s.known {
+		return true
+	}
+	if size > s.free {
+		s.deferred++
+		return false
+	}
+	s.free -= size
+	return true
+}
+
+// diskSpaceChecked warns once when files in the repository are deferred for
+// lack of disk space, until a check finds that all files fit again.
+func (m *Model) diskSpaceChecked(repo string, s *spaceCheck) {
+	if !s.known {
+		return
+	}
+	low := s.deferred > 0
+
+	m.rmut.Lock()
+	warned := m.lowSpace[repo]
+	if low {
+		m.lowSpace[repo] = true
+	} else {
+		delete(m.lowSpace, repo)
+	}
+	m.rmut.Unlock()
+
+	switch {
+	case low && !warned:
+		free := s.free + s.reserve
+		if free < 0 {
+			free = 0
+		}
+		warnf("Out of disk space in repo %q; deferring %d files (%s free, %s reserved)", repo, s.deferred, binaryBytes(free), binaryBytes(s.reserve))
+		events.Default.Log(events.DiskSpaceLow, map[string]interface{}{
+			"repo":     repo,
+			"deferred": s.deferred,
+			"free":     free,
+			"reserve":  s.reserve,
+		})
+	case !low && warned:
+		infof("Disk space available again in repo %q", repo)
+	}
+}
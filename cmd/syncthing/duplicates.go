@@ -0,0 +1,116 @@
+package main
+
+import (
+	"encoding/binary"
+	"hash/fnv"
+	"sort"
+	"time"
+
+	"github.com/calmh/syncthing/events"
+	"github.com/calmh/syncthing/scanner"
+)
+
+const (
+	// Full indexes from the same node that arrive closer together than
+	// this are compared for signs of two nodes sharing the node ID.
+	dupWindow = 5 * time.Minute
+
+	// The number of conflicting full indexes in a row after which we warn.
+	dupThreshold = 2
+)
+
+type indexSource struct {
+	node string
+	repo string
+}
+
+// fullIndex remembers enough about a full index to tell whether the next one
+// is likely to come from the same node.
+type fullIndex struct {
+	received  time.Time
+	files     []uint64 // sorted hashes of name and version
+	conflicts int      // conflicting indexes in a row
+}
+
+// checkDuplicateNode compares the full index received from the node with
+// the previous one. A node's full indexes normally have most files in
+// common. Two nodes sharing a node ID, connecting in turn, instead send
+// alternating indexes with little in common, which we warn about.
+func (m *Model) checkDuplicateNode(nodeID, repo string, fs []scanner.File) {
+	now := m.clock.Now()
+	hashes := fileHashes(fs)
+
+	m.amut.Lock()
+	src := indexSource{nodeID, repo}
+	prev, ok := m.fullIndexes[src]
+	if !ok {
+		prev = &fullIndex{}
+		m.fullIndexes[src] = prev
+	}
+	if ok && now.Sub(prev.received) < dupWindow && conflicting(prev.files, hashes) {
+		prev.conflicts++
+	} else {
+		prev.conflicts = 0
+	}
+	prev.received = now
+	prev.files = hashes
+	conflicts := prev.conflicts
+	m.amut.Unlock()
+
+	if conflicts == dupThreshold {
+		warnf("Node %s sends conflicting indexes for repository %q; duplicate node ID suspected. Check that no two nodes share a certificate.", nodeID, repo)
+		events.Default.Log(events.DuplicateNodeSuspected, map[string]interface{}{
+			"node":      nodeID,
+			"repo":      repo,
+			"conflicts": conflicts,
+		})
+	}
+}
+
+func fileHashes(fs []scanner.File) []uint64 {
+	hashes := make([]uint64, len(fs))
+	for i, f := range fs {
+		h := fnv.New64a()
+		h.Write([]byte(f.Name))
+		var v [8]byte
+		binary.BigEndian.PutUint64(v[:], f.Version)
+		h.Write(v[:])
+		hashes[i] = h.Sum64()
+	}
+	sort.Sort(uint64Slice(hashes))
+	return hashes
+}
+
+// conflicting returns true if the two sorted lists of file hashes have less
+// than half of the shorter one in common.
+func conflicting(a, b []uint64) bool {
+	if len(a) == 0 || len(b) == 0 {
+		return false
+	}
+
+	var shared int
+	for i, j := 0, 0; i < len(a) && j < len(b); {
+		switch {
+		case a[i] == b[j]:
+			shared++
+			i++
+			j++
+		case a[i] < b[j]:
+			i++
+		default:
+			j++
+		}
+	}
+
+	min := len(a)
+	if len(b) < min {
+		min = len(b)
+	}
+	return 2*shared < min
+}
+
+type uint64Slice []uint64
+
+func (s uint64Slice) Len() int           { return len(s) }
+func (s uint64Slice) Less(a, b int) bool { return s[a] < s[b] }
+func (s uint64Slice) Swap(a, b int)      { s[a], s[b] = s[b], s[a] }
@@ -0,0 +1,195 @@
+package main
+
+import (
+	"os"
+	"sort"
+	"syscall"
+	"time"
+
+	"github.com/calmh/syncthing/events"
+	"github.com/calmh/syncthing/scanner"
+)
+
+// FileError describes a file that has failed to be pulled.
+type FileError struct {
+	Name     string
+	Version  uint64 // the version that failed to be pulled
+	Err      string // the most recent error
+	Failures int
+
+	// A quarantined file is still needed, but is not retried until a new
+	// version is announced or RetryFile is called.
+	Quarantined bool
+
+	// The number of failures caused by the destination being locked by
+	// another application. After MaxLockedAttempts such failures the file
+	// is not retried before RetryAfter.
+	LockedFailures int
+	RetryAfter     time.Time
+
+	// A file awaiting a source is needed, but no connected node has it. It
+	// is tried again when a node connects or sends an index, and at the
+	// source retry interval.
+	AwaitingSource bool
+}
+
+// The error of a file that is awaiting a source and hasn't failed otherwise.
+const errAwaitingSource = "awaiting source"
+
+type fileErrorList []FileError
+
+func (l fileErrorList) Len() int           { return len(l) }
+func (l fileErrorList) Less(a, b int) bool { return l[a].Name < l[b].Name }
+func (l fileErrorList) Swap(a, b int)      { l[a], l[b] = l[b], l[a] }
+
+// FileErrors returns the files in the repository that have failed to be
+// pulled, sorted by name.
+func (m *Model) FileErrors(repo string) []FileError {
+	m.rmut.RLock()
+	var res []FileError
+	for _, fe := range m.fileErrs[repo] {
+		res = append(res, *fe)
+	}
+	m.rmut.RUnlock()
+
+	sort.Sort(fileErrorList(res))
+	return res
+}
+
+// RetryFile clears the errors and any quarantine for the named file, so that
+// the puller tries it again.
+func (m *Model) RetryFile(repo, name string) {
+	m.clearFileError(repo, name)
+}
+
+// pullFailed records a failed attempt at pulling the given version of a
+// file. The file is quarantined when it has failed MaxPullFailures times, or
+// deferred for LockedBackoffS when its destination has been locked for
+// MaxLockedAttempts attempts.
+func (m *Model) pullFailed(repo string, f scanner.File, err error) {
+	locked := isLocked(err)
+
+	m.rmut.Lock()
+	fe, ok := m.fileErrs[repo][f.Name]
+	if !ok || fe.Version != f.Version {
+		fe = &FileError{Name: f.Name, Version: f.Version}
+		m.fileErrs[repo][f.Name] = fe
+	}
+	fe.Err = err.Error()
+	fe.Failures++
+	fe.AwaitingSource = false
+	var quarantine, deferred bool
+	if locked {
+		fe.LockedFailures++
+		max := cfg.Options.MaxLockedAttempts
+		if max > 0 && fe.LockedFailures >= max {
+			fe.Err = "destination locked: " + fe.Err
+			fe.RetryAfter = time.Now().Add(time.Duration(cfg.Options.LockedBackoffS) * time.Second)
+			deferred = true
+		}
+	} else {
+		max := cfg.Options.MaxPullFailures
+		quarantine = !fe.Quarantined && max > 0 && fe.Failures-fe.LockedFailures >= max
+		if quarantine {
+			fe.Quarantined = true
+		}
+	}
+	failures := fe.Failures
+	m.rmut.Unlock()
+
+	if quarantine {
+		warnf("Giving up on %q in repository %q after %d failed attempts: %v", f.Name, repo, failures, err)
+		events.Default.Log(events.FileQuarantined, map[string]interface{}{
+			"repo":     repo,
+			"file":     f.Name,
+			"version":  f.Version,
+			"failures": failures,
+			"error":    err.Error(),
+		})
+	}
+	if deferred {
+		warnf("%q in repository %q is locked by another application; retrying in %ds", f.Name, repo, cfg.Options.LockedBackoffS)
+	}
+}
+
+// quarantined returns true if the given version of the file is quarantined.
+func (m *Model) quarantined(repo string, f scanner.File) bool {
+	m.rmut.RLock()
+	defer m.rmut.RUnlock()
+	fe, ok := m.fileErrs[repo][f.Name]
+	return ok && fe.Quarantined && fe.Version == f.Version
+}
+
+// skipPull returns true if the puller should leave the given version of the
+// file alone for now, because it is quarantined or deferred, or below a
+// guarded mount point that is not mounted. Internal paths and files below
+// the scan depth limit are always left alone.
+func (m *Model) skipPull(repo string, f scanner.File) bool {
+	m.rmut.RLock()
+	defer m.rmut.RUnlock()
+	if isInternal(m.internal, f.Name) || m.belowScanDepth(f.Name) || m.isUnmounted(repo, f.Name) {
+		return true
+	}
+	fe, ok := m.fileErrs[repo][f.Name]
+	if !ok || fe.Version != f.Version {
+		return false
+	}
+	return fe.Quarantined || time.Now().Before(fe.RetryAfter)
+}
+
+// awaitingSource records that no connected node has the given version of
+// the file. This is not a failure; the file is listed with the file errors
+// until a source is found.
+func (m *Model) awaitingSource(repo string, f scanner.File) {
+	m.rmut.Lock()
+	defer m.rmut.Unlock()
+	fe, ok := m.fileErrs[repo][f.Name]
+	if !ok || fe.Version != f.Version {
+		fe = &FileError{Name: f.Name, Version: f.Version, Err: errAwaitingSource}
+		m.fileErrs[repo][f.Name] = fe
+	}
+	fe.AwaitingSource = true
+}
+
+// sourceFound clears the awaiting source state of the file, along with the
+// file error if that is all there was.
+func (m *Model) sourceFound(repo, name string) {
+	m.rmut.Lock()
+	defer m.rmut.Unlock()
+	fe, ok := m.fileErrs[repo][name]
+	if !ok || !fe.AwaitingSource {
+		return
+	}
+	if fe.Failures == 0 {
+		delete(m.fileErrs[repo], name)
+	} else {
+		fe.AwaitingSource = false
+	}
+}
+
+func (m *Model) clearFileError(repo, name string) {
+	m.rmut.Lock()
+	delete(m.fileErrs[repo], name)
+	m.rmut.Unlock()
+}
+
+// isLocked returns true if the error is caused by a file being locked by
+// another application.
+func isLocked(err error) bool {
+	switch e := err.(type) {
+	case *os.LinkError:
+		err = e.Err
+	case *os.PathError:
+		err = e.Err
+	case *os.SyscallError:
+		err = e.Err
+	}
+	if errno, ok := err.(syscall.Errno); ok {
+		for _, l := range lockedErrnos {
+			if errno == l {
+				return true
+			}
+		}
+	}
+	return false
+}
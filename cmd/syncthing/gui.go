@@ -10,10 +10,12 @@ import (
 	"net"
 	"net/http"
 	"runtime"
+	"strconv"
 	"sync"
 	"time"
 
 	"code.google.com/p/go.crypto/bcrypt"
+	"github.com/calmh/syncthing/protocol"
 	"github.com/codegangsta/martini"
 )
 
@@ -45,6 +47,17 @@ func startGUI(cfg GUIConfiguration, m *Model) error {
 	router.Get("/rest/version", restGetVersion)
 	router.Get("/rest/model", restGetModel)
 	router.Get("/rest/connections", restGetConnections)
+	router.Get("/rest/traffic", restGetTraffic)
+	router.Get("/rest/nodedata", restGetNodeData)
+	router.Get("/rest/convergence", restGetConvergence)
+	router.Get("/rest/invalid", restGetInvalid)
+	router.Get("/rest/invalid/since", restGetInvalidSince)
+	router.Get("/rest/fileerrors", restGetFileErrors)
+	router.Get("/rest/need", restGetNeed)
+	router.Get("/rest/need/deletes", restGetPendingDeletes)
+	router.Get("/rest/transfers", restGetTransfers)
+	router.Get("/rest/tempfiles", restGetTempFiles)
+	router.Get("/rest/versions", restGetVersions)
 	router.Get("/rest/config", restGetConfig)
 	router.Get("/rest/config/sync", restGetConfigInSync)
 	router.Get("/rest/system", restGetSystem)
@@ -58,6 +71,11 @@ func startGUI(cfg GUIConfiguration, m *Model) error {
 	router.Post("/rest/error", restPostError)
 	router.Post("/rest/error/clear", restClearErrors)
 	router.Post("/rest/discovery/hint", restPostDiscoveryHint)
+	router.Post("/rest/retry", restPostRetry)
+	router.Post("/rest/rehash", restPostRehash)
+	router.Post("/rest/tempfiles/clean", restPostCleanTempFiles)
+	router.Post("/rest/versions/restore", restPostRestoreVersion)
+	router.Post("/rest/nodedata/reset", restPostResetNodeData)
 
 	mr := martini.New()
 	if len(cfg.User) > 0 && len(cfg.Password) > 0 {
@@ -109,8 +127,14 @@ func restGetModel(m *Model, w http.ResponseWriter, r *http.Request) {
 
 	needFiles, needBytes := m.NeedSize(repo)
 	res["needFiles"], res["needBytes"] = needFiles, needBytes
+	res["remainingBytes"] = m.RemainingBytes(repo)
 
-	res["inSyncFiles"], res["inSyncBytes"] = globalFiles-needFiles, globalBytes-needBytes
+	available, partial, unavailable, waiting := m.NeedAvailabilitySummary(repo)
+	res["availableFiles"], res["partialFiles"], res["unavailableFiles"] = available, partial, unavailable
+	res["waitingFor"] = waiting
+
+	inSyncBytes, _ := m.SyncProgress(repo)
+	res["inSyncFiles"], res["inSyncBytes"] = globalFiles-needFiles, inSyncBytes
 
 	res["state"] = m.State(repo)
 
@@ -124,6 +148,144 @@ func restGetConnections(m *Model, w http.ResponseWriter) {
 	json.NewEncoder(w).Encode(res)
 }
 
+func restGetTraffic(m *Model, w http.ResponseWriter) {
+	in, out := m.TrafficStats()
+	res := map[string]interface{}{
+		"in":            in,
+		"out":           out,
+		"inIndexBytes":  in.IndexBytes(),
+		"inDataBytes":   in.DataBytes(),
+		"outIndexBytes": out.IndexBytes(),
+		"outDataBytes":  out.DataBytes(),
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(res)
+}
+
+func restGetNodeData(m *Model, w http.ResponseWriter) {
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(m.NodeDataStats())
+}
+
+func restGetConvergence(m *Model, w http.ResponseWriter) {
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(m.ConvergenceStats())
+}
+
+var invalidReasons = map[uint32]string{
+	protocol.InvalidReasonUnknown:     "unknown reason",
+	protocol.InvalidReasonSuppressed:  "changes too frequently",
+	protocol.InvalidReasonUnreadable:  "file is unreadable",
+	protocol.InvalidReasonBadName:     "file name is invalid",
+	protocol.InvalidReasonChanged:     "changed; waiting to be rehashed",
+	protocol.InvalidReasonUnavailable: "filesystem not mounted",
+	protocol.InvalidReasonPlaceholder: "placeholder; contents not present",
+	protocol.InvalidReasonFiltered:    "withheld by a filter",
+	protocol.InvalidReasonSettling:    "being written; waiting to settle",
+}
+
+func restGetInvalid(m *Model, w http.ResponseWriter, r *http.Request) {
+	var qs = r.URL.Query()
+	var repo = qs.Get("repo")
+	var res = make(map[string]string)
+
+	for _, f := range m.InvalidFiles(repo) {
+		reason, ok := invalidReasons[f.InvalidReason]
+		if !ok {
+			reason = invalidReasons[protocol.InvalidReasonUnknown]
+		}
+		res[f.Name] = reason
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(res)
+}
+
+func restGetInvalidSince(m *Model, w http.ResponseWriter, r *http.Request) {
+	var qs = r.URL.Query()
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(m.InvalidSince(qs.Get("repo")))
+}
+
+func restGetFileErrors(m *Model, w http.ResponseWriter, r *http.Request) {
+	var qs = r.URL.Query()
+	var repo = qs.Get("repo")
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(m.FileErrors(repo))
+}
+
+func restGetNeed(m *Model, w http.ResponseWriter, r *http.Request) {
+	var qs = r.URL.Query()
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(m.NeedDetails(qs.Get("repo")))
+}
+
+func restGetPendingDeletes(m *Model, w http.ResponseWriter, r *http.Request) {
+	var qs = r.URL.Query()
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(m.PendingDeletes(qs.Get("repo")))
+}
+
+func restGetTransfers(m *Model, w http.ResponseWriter) {
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(m.ActiveTransfers())
+}
+
+func restGetTempFiles(m *Model, w http.ResponseWriter, r *http.Request) {
+	var qs = r.URL.Query()
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(m.OrphanTempFiles(qs.Get("repo")))
+}
+
+func restPostCleanTempFiles(m *Model, w http.ResponseWriter, r *http.Request) {
+	var qs = r.URL.Query()
+	if err := m.RemoveOrphanTempFiles(qs.Get("repo")); err != nil {
+		http.Error(w, err.Error(), 500)
+	}
+}
+
+func restGetVersions(m *Model, w http.ResponseWriter, r *http.Request) {
+	var qs = r.URL.Query()
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(m.Versions(qs.Get("repo"), qs.Get("file")))
+}
+
+func restPostRestoreVersion(m *Model, w http.ResponseWriter, r *http.Request) {
+	var qs = r.URL.Query()
+	version, err := time.Parse(time.RFC3339, qs.Get("time"))
+	if err != nil {
+		http.Error(w, err.Error(), 400)
+		return
+	}
+	var seq int
+	if s := qs.Get("seq"); s != "" {
+		if seq, err = strconv.Atoi(s); err != nil {
+			http.Error(w, err.Error(), 400)
+			return
+		}
+	}
+	if err := m.RestoreVersion(qs.Get("repo"), qs.Get("file"), version, seq); err != nil {
+		http.Error(w, err.Error(), 500)
+	}
+}
+
+func restPostRetry(m *Model, r *http.Request) {
+	var qs = r.URL.Query()
+	m.RetryFile(qs.Get("repo"), qs.Get("file"))
+}
+
+func restPostResetNodeData(m *Model, r *http.Request) {
+	var qs = r.URL.Query()
+	m.ResetNodeDataStats(qs.Get("node"))
+}
+
+func restPostRehash(m *Model, w http.ResponseWriter, r *http.Request) {
+	var qs = r.URL.Query()
+	if err := m.ForceRehash(qs.Get("repo"), qs.Get("sub")); err != nil {
+		http.Error(w, err.Error(), 500)
+	}
+}
+
 func restGetConfig(w http.ResponseWriter) {
 	encCfg := cfg
 	if encCfg.GUI.Password != "" {
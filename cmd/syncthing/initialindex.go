@@ -0,0 +1,76 @@
+package main
+
+import (
+	"time"
+
+	"github.com/calmh/syncthing/protocol"
+	"github.com/juju/ratelimit"
+)
+
+// The initial index sent at a limited rate is split into segments of this
+// much sending time each.
+const indexSegmentTime = 100 * time.Millisecond
+
+// SetInitialIndexRate limits the rate at which the initial index is sent
+// to the node after it connects, in bytes per second. Zero means no limit.
+// A limited index is sent as a partial index followed by updates adding
+// the rest, so that a large index doesn't saturate a slow link all at
+// once. Other index updates to the node are held back meanwhile.
+func (m *Model) SetInitialIndexRate(nodeID string, rate int) {
+	m.pmut.Lock()
+	if rate > 0 {
+		m.indexRate[nodeID] = rate
+	} else {
+		delete(m.indexRate, nodeID)
+	}
+	m.pmut.Unlock()
+}
+
+// sendIndexLimited sends the index to the node at the given rate, the first
+// segment as the index and each following segment as an update to it.
+func (m *Model) sendIndexLimited(conn protocol.Connection, repo string, idx []protocol.FileInfo, rate int) {
+	segment := int64(float64(rate) * indexSegmentTime.Seconds())
+	if segment < 1 {
+		segment = 1
+	}
+	bucket := ratelimit.NewBucketWithRate(float64(rate), segment)
+
+	if len(idx) == 0 {
+		conn.Index(repo, idx)
+		return
+	}
+	for start := 0; start < len(idx); {
+		end, size := start, int64(0)
+		for end < len(idx) {
+			s := indexEntrySize(idx[end])
+			if end > start && size+s > segment {
+				break
+			}
+			size += s
+			end++
+		}
+		bucket.Wait(size)
+		if debugNet {
+			dlog.Printf("IDX(out/limited): %s: %q: files %d-%d of %d (%d bytes)", conn.ID(), repo, start, end, len(idx), size)
+		}
+		if start == 0 {
+			conn.Index(repo, idx[:end])
+		} else {
+			conn.IndexUpdate(repo, idx[start:end])
+		}
+		start = end
+	}
+}
+
+// indexEntrySize returns the XDR encoded size of the file info.
+func indexEntrySize(f protocol.FileInfo) int64 {
+	size := 4 + xdrPad(len(f.Name)) + 4 + 8 + 8 + 4 + 4 + xdrPad(len(f.Hash))
+	for _, b := range f.Blocks {
+		size += 4 + 4 + xdrPad(len(b.Hash))
+	}
+	return int64(size)
+}
+
+func xdrPad(l int) int {
+	return (l + 3) &^ 3
+}
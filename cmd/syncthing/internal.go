@@ -0,0 +1,46 @@
+package main
+
+import (
+	"errors"
+	"path/filepath"
+)
+
+var ErrInternalPath = errors.New("path is internal to the application")
+
+// RegisterInternalPath registers a file or directory, relative to the top of
+// each repository, that holds data of the application rather than repository
+// contents. Internal paths, and everything below them, are never scanned,
+// announced or served, and are left alone by the puller whatever other nodes
+// announce.
+func (m *Model) RegisterInternalPath(path string) {
+	path = filepath.Clean(path)
+	m.rmut.Lock()
+	defer m.rmut.Unlock()
+	for _, p := range m.internal {
+		if p == path {
+			return
+		}
+	}
+	m.internal = append(m.internal, path)
+	for _, rf := range m.repoFiles {
+		m.setAnnounced(rf)
+	}
+}
+
+// internalPaths returns the registered internal paths.
+func (m *Model) internalPaths() []string {
+	m.rmut.RLock()
+	defer m.rmut.RUnlock()
+	return append([]string(nil), m.internal...)
+}
+
+// isInternal returns true if the file name is, or is below, one of the
+// internal paths.
+func isInternal(paths []string, name string) bool {
+	for _, p := range paths {
+		if hasPathPrefix(name, p) {
+			return true
+		}
+	}
+	return false
+}
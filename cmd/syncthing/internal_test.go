@@ -0,0 +1,81 @@
+package main
+
+import (
+	"bytes"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+
+	"github.com/calmh/syncthing/protocol"
+	"github.com/calmh/syncthing/scanner"
+	"github.com/calmh/syncthing/testutil"
+)
+
+func TestInternalPaths(t *testing.T) {
+	data := []byte("internal data")
+	internal := []string{
+		filepath.Join(versionsDir, "a~20140101-000000"),
+		".stmarker",
+		filepath.Join("logs", "audit.log"),
+		filepath.Join("logs", "old", "audit.log"),
+	}
+
+	dir := filepath.Join(string(os.PathSeparator), "repo")
+	fs := testutil.NewFakeFS()
+	fs.MkdirAll(filepath.Join(dir, versionsDir), 0755)
+	fs.MkdirAll(filepath.Join(dir, "logs", "old"), 0755)
+	fs.WriteFile(filepath.Join(dir, "a"), []byte("contents"), 0644)
+	for _, name := range internal {
+		fs.WriteFile(filepath.Join(dir, name), data, 0644)
+	}
+
+	m := NewModel(1e6)
+	m.SetFilesystem(fs)
+	m.SetKeepVersions(1)
+	m.RegisterInternalPath(".stmarker")
+	m.RegisterInternalPath("logs")
+	m.AddRepo("default", dir, []NodeConfiguration{{NodeID: "42"}})
+	m.ScanRepo("default")
+
+	if f := m.CurrentRepoFile("default", "logs"); f.Name != "" {
+		t.Errorf("Internal directory scanned: %v", f)
+	}
+
+	// Internal files are neither announced nor served, even when they are
+	// in the local index.
+	blocks, _ := scanner.Blocks(bytes.NewReader(data), BlockSize)
+	for _, name := range internal {
+		if f := m.CurrentRepoFile("default", name); f.Name != "" {
+			t.Errorf("Internal file scanned: %v", f)
+		}
+		m.updateLocal("default", scanner.File{Name: name, Flags: 0644, Version: 1000, Size: int64(len(data)), Blocks: blocks})
+		if _, err := m.Request("42", "default", name, 0, len(data)); err != ErrInternalPath {
+			t.Errorf("Request for %q: %v, expected %v", name, err, ErrInternalPath)
+		}
+	}
+	var announced []string
+	for _, f := range m.protocolIndex("default") {
+		announced = append(announced, f.Name)
+	}
+	if !reflect.DeepEqual(announced, []string{"a"}) {
+		t.Errorf("Incorrect index %v", announced)
+	}
+
+	// Deletes and updates of internal files from other nodes are ignored.
+	var remote []protocol.FileInfo
+	for _, name := range internal {
+		remote = append(remote, protocol.FileInfo{Name: name, Flags: protocol.FlagDeleted, Version: 2000})
+	}
+	remote = append(remote, fileInfoFromFile(scanner.File{Name: "logs", Flags: protocol.FlagDirectory | protocol.FlagDeleted, Version: 2000}))
+	m.Index("42", "default", remote)
+	if need := m.NeedFilesRepo("default"); len(need) != 0 {
+		t.Errorf("Internal files needed: %v", need)
+	}
+	pullAll(t, m, "default", dir)
+	for _, name := range internal {
+		if _, err := fs.Stat(filepath.Join(dir, name)); err != nil {
+			t.Errorf("Internal file %q: %v", name, err)
+		}
+	}
+}
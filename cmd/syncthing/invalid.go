@@ -0,0 +1,97 @@
+package main
+
+import (
+	"sort"
+	"time"
+
+	"github.com/calmh/syncthing/cid"
+	"github.com/calmh/syncthing/events"
+	"github.com/calmh/syncthing/protocol"
+)
+
+// An InvalidFile is a file that has been invalid, and so not synchronized,
+// in every scan since Since. Stuck is set once that has been the case for
+// longer than MaxInvalidS.
+type InvalidFile struct {
+	Name          string
+	InvalidReason uint32 // protocol.InvalidReason*
+	Since         time.Time
+	Stuck         bool
+}
+
+type invalidFile struct {
+	since time.Time
+	stuck bool
+}
+
+type invalidFileList []InvalidFile
+
+func (l invalidFileList) Len() int           { return len(l) }
+func (l invalidFileList) Less(a, b int) bool { return l[a].Name < l[b].Name }
+func (l invalidFileList) Swap(a, b int)      { l[a], l[b] = l[b], l[a] }
+
+// InvalidSince returns the files in the repository that are currently
+// invalid, with the time they have been so since, sorted by name.
+func (m *Model) InvalidSince(repo string) []InvalidFile {
+	m.rmut.RLock()
+	var res []InvalidFile
+	if rf, ok := m.repoFiles[repo]; ok {
+		for _, f := range rf.Have(cid.LocalID) {
+			inv, ok := m.invalid[repo][f.Name]
+			if !f.Invalid || !ok {
+				// Files marked invalid since the last scan are not yet
+				// tracked.
+				continue
+			}
+			res = append(res, InvalidFile{f.Name, f.InvalidReason, inv.since, inv.stuck})
+		}
+	}
+	m.rmut.RUnlock()
+
+	sort.Sort(invalidFileList(res))
+	return res
+}
+
+// checkInvalid updates the times the files in the repository have been
+// invalid since, after a scan at the given time. A warning is given for
+// each file that has been invalid for longer than MaxInvalidS; a file that
+// keeps changing or can't be read is never synchronized, and the user may
+// want to ignore it instead.
+func (m *Model) checkInvalid(repo string, now time.Time) {
+	max := time.Duration(cfg.Options.MaxInvalidS) * time.Second
+
+	m.rmut.Lock()
+	current := make(map[string]*invalidFile)
+	var stuck []InvalidFile
+	for _, f := range m.repoFiles[repo].Have(cid.LocalID) {
+		if !f.Invalid {
+			continue
+		}
+		inv, ok := m.invalid[repo][f.Name]
+		if !ok {
+			inv = &invalidFile{since: now}
+		}
+		// Files withheld by a filter are invalid by design.
+		if !inv.stuck && max > 0 && now.Sub(inv.since) > max && f.InvalidReason != protocol.InvalidReasonFiltered {
+			inv.stuck = true
+			stuck = append(stuck, InvalidFile{f.Name, f.InvalidReason, inv.since, true})
+		}
+		current[f.Name] = inv
+	}
+	m.invalid[repo] = current
+	m.rmut.Unlock()
+
+	for _, f := range stuck {
+		reason, ok := invalidReasons[f.InvalidReason]
+		if !ok {
+			reason = invalidReasons[protocol.InvalidReasonUnknown]
+		}
+		warnf("%q in repository %q has not been synchronized since %s (%s); consider ignoring it", f.Name, repo, f.Since.Format(time.RFC3339), reason)
+		events.Default.Log(events.FileStuckInvalid, map[string]interface{}{
+			"repo":   repo,
+			"file":   f.Name,
+			"reason": reason,
+			"since":  f.Since,
+		})
+	}
+}
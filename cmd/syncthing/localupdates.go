@@ -0,0 +1,60 @@
+package main
+
+import "sync"
+
+// localUpdates tracks the files updated in the local index other than by
+// scanning, such as by pulling, while a scan of the repository is running.
+// The scan may have seen such files before they were updated, so its results
+// for them must not replace the updated entries.
+type localUpdates struct {
+	mut     sync.Mutex
+	counter uint64
+	scans   map[string]int               // repo -> scans in progress
+	updated map[string]map[string]uint64 // repo -> file name -> counter at update
+}
+
+// scanStarted registers a scan of the repository and returns the value to
+// pass to scanDone when it is finished.
+func (u *localUpdates) scanStarted(repo string) uint64 {
+	u.mut.Lock()
+	defer u.mut.Unlock()
+	if u.scans == nil {
+		u.scans = make(map[string]int)
+		u.updated = make(map[string]map[string]uint64)
+	}
+	u.scans[repo]++
+	return u.counter
+}
+
+// update records that the file was updated, if a scan of the repository is
+// in progress.
+func (u *localUpdates) update(repo, name string) {
+	u.mut.Lock()
+	defer u.mut.Unlock()
+	if u.scans[repo] == 0 {
+		return
+	}
+	u.counter++
+	if u.updated[repo] == nil {
+		u.updated[repo] = make(map[string]uint64)
+	}
+	u.updated[repo][name] = u.counter
+}
+
+// scanDone unregisters a scan and returns the names of the files updated
+// since it was started.
+func (u *localUpdates) scanDone(repo string, since uint64) map[string]bool {
+	u.mut.Lock()
+	defer u.mut.Unlock()
+	names := make(map[string]bool)
+	for name, c := range u.updated[repo] {
+		if c > since {
+			names[name] = true
+		}
+	}
+	if u.scans[repo]--; u.scans[repo] == 0 {
+		delete(u.scans, repo)
+		delete(u.updated, repo)
+	}
+	return names
+}
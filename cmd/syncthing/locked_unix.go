@@ -0,0 +1,12 @@
+// +build !windows
+
+package main
+
+import "syscall"
+
+// Unix doesn't have mandatory locks, but a running executable or a mount
+// point can't be replaced.
+var lockedErrnos = []syscall.Errno{
+	syscall.ETXTBSY,
+	syscall.EBUSY,
+}
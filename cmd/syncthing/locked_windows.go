@@ -0,0 +1,12 @@
+// +build windows
+
+package main
+
+import "syscall"
+
+// Errors returned when a file is open in another application that doesn't
+// share it, or has parts of it locked.
+var lockedErrnos = []syscall.Errno{
+	32, // ERROR_SHARING_VIOLATION
+	33, // ERROR_LOCK_VIOLATION
+}
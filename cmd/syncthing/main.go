@@ -22,6 +22,7 @@ import (
 
 	"github.com/calmh/syncthing/discover"
 	"github.com/calmh/syncthing/protocol"
+	"github.com/calmh/syncthing/scanner"
 	"github.com/calmh/syncthing/upnp"
 	"github.com/juju/ratelimit"
 )
@@ -84,10 +85,12 @@ func main() {
 	var reset bool
 	var showVersion bool
 	var doUpgrade bool
+	var showIndexSize bool
 	flag.StringVar(&confDir, "home", getDefaultConfDir(), "Set configuration directory")
 	flag.BoolVar(&reset, "reset", false, "Prepare to resync from cluster")
 	flag.BoolVar(&showVersion, "version", false, "Show version")
 	flag.BoolVar(&doUpgrade, "upgrade", false, "Perform upgrade")
+	flag.BoolVar(&showIndexSize, "index-size", false, "Show the size of the cached index of each repository and exit")
 	flag.Usage = usageFor(flag.CommandLine, usage, extraUsage)
 	flag.Parse()
 
@@ -237,7 +240,40 @@ func main() {
 		rateBucket = ratelimit.NewBucketWithRate(float64(1000*cfg.Options.MaxSendKbps), int64(5*1000*cfg.Options.MaxSendKbps))
 	}
 
+	protocol.SetMaxCompressedConnections(cfg.Options.MaxCompressedConns)
+
 	m := NewModel(cfg.Options.MaxChangeKbps * 1000)
+	m.SetDiskIORate(int64(1000*cfg.Options.MaxDiskReadKbps), int64(1000*cfg.Options.MaxDiskWriteKbps))
+	m.SetMaxIndexAge(time.Duration(cfg.Options.MaxIndexAgeS) * time.Second)
+	m.SetCopiers(cfg.Options.Copiers)
+	m.SetPlaceholderGuard(cfg.Options.GuardPlaceholders)
+	m.SetSizeCheck(cfg.Options.CheckSizes)
+	m.SetSettleTime(time.Duration(cfg.Options.SettleTimeS) * time.Second)
+	m.SetSourceRetry(time.Duration(cfg.Options.SourceRetryS) * time.Second)
+	m.SetIgnorePermissions(cfg.Options.IgnorePerms)
+	m.SetPreserveCreateTime(cfg.Options.CreateTimes)
+	m.SetSparseFiles(cfg.Options.SparseFiles)
+	m.SetPreserveOriginals(cfg.Options.PreserveOriginals)
+	m.SetVerifyRenames(cfg.Options.VerifyRenames)
+	m.SetDiskReserve(int64(cfg.Options.DiskReserveMB) << 20)
+	m.SetKeepVersions(cfg.Options.KeepVersions)
+	m.SetDeleteLimit(cfg.Options.MaxDeletes, cfg.Options.MaxDeletePercent)
+	m.SetPullPriority(cfg.Options.PullPriority)
+	m.SetMaxScanDepth(cfg.Options.MaxScanDepth)
+	m.SetLockDir(confDir)
+	for _, node := range cfg.Nodes {
+		m.SetInitialIndexRate(node.NodeID, 1000*node.InitialIndexKbps)
+		m.SetDeleteTrust(node.NodeID, !node.IgnoreDeletes)
+	}
+	switch cfg.Options.Symlinks {
+	case "ignore", "":
+	case "recreate":
+		m.SetSymlinkPolicy(scanner.SymlinkRecreate)
+	case "follow":
+		m.SetSymlinkPolicy(scanner.SymlinkFollowContent)
+	default:
+		warnf("Unknown symlink policy %q; ignoring symlinks", cfg.Options.Symlinks)
+	}
 
 	for _, repo := range cfg.Repositories {
 		if repo.Invalid != "" {
@@ -245,6 +281,9 @@ func main() {
 		}
 		dir := expandTilde(repo.Directory)
 		m.AddRepo(repo.ID, dir, repo.Nodes)
+		if len(repo.Mounts) > 0 {
+			m.SetMounts(repo.ID, repoMountPolicies(repo))
+		}
 	}
 
 	// GUI
@@ -283,6 +322,16 @@ func main() {
 	infoln("Populating repository index")
 	m.LoadIndexes(confDir)
 
+	if showIndexSize {
+		for _, repo := range cfg.Repositories {
+			if repo.Invalid != "" {
+				continue
+			}
+			fmt.Printf("%s:\n%v\n", repo.ID, protocol.MeasureIndex(repo.ID, m.protocolIndex(repo.ID)))
+		}
+		return
+	}
+
 	for _, repo := range cfg.Repositories {
 		if repo.Invalid != "" {
 			continue
@@ -305,9 +354,21 @@ func main() {
 		ensureDir(dir, -1)
 	}
 
+	m.ReconcileRepos()
 	m.ScanRepos()
 	m.SaveIndexes(confDir)
 
+	// Per node data statistics, kept across restarts unless disabled.
+
+	if cfg.Options.NodeStatsSaveS > 0 {
+		if err := m.LoadNodeDataStats(confDir); err != nil {
+			warnln("Loading node statistics:", err)
+		}
+		go saveNodeDataStatsLoop(m, confDir, time.Duration(cfg.Options.NodeStatsSaveS)*time.Second)
+	}
+
+	go printSyncStatusLoop(m, syncRateWindow)
+
 	// UPnP
 
 	var externalPort = 0
@@ -333,8 +394,14 @@ func main() {
 			okf("Ready to synchronize %s (read only; no external updates accepted)", repo.ID)
 			m.StartRepoRO(repo.ID)
 		} else {
-			okf("Ready to synchronize %s (read-write)", repo.ID)
-			m.StartRepoRW(repo.ID, cfg.Options.ParallelRequests)
+			err := m.StartRepoRW(repo.ID, cfg.Options.ParallelRequests)
+			if err == nil {
+				okf("Ready to synchronize %s (read-write)", repo.ID)
+			} else {
+				warnf("Cannot synchronize %s read-write: %v", repo.ID, err)
+				okf("Ready to synchronize %s (read only; no external updates accepted)", repo.ID)
+				m.StartRepoRO(repo.ID)
+			}
 		}
 	}
 
@@ -348,6 +415,12 @@ func main() {
 	}
 
 	<-stop
+	m.ReleaseRepoLocks()
+	if cfg.Options.NodeStatsSaveS > 0 {
+		if err := m.SaveNodeDataStats(confDir); err != nil {
+			warnln("Saving node statistics:", err)
+		}
+	}
 }
 
 func setupUPnP() int {
@@ -392,12 +465,13 @@ func resetRepositories() {
 		}
 	}
 
-	pat := filepath.Join(confDir, "*.idx.gz")
-	idxs, err := filepath.Glob(pat)
-	if err == nil {
-		for _, idx := range idxs {
-			infof("Reset: Removing %s", idx)
-			os.Remove(idx)
+	for _, pat := range []string{"*.idx.gz", "*.seq.gz"} {
+		idxs, err := filepath.Glob(filepath.Join(confDir, pat))
+		if err == nil {
+			for _, idx := range idxs {
+				infof("Reset: Removing %s", idx)
+				os.Remove(idx)
+			}
 		}
 	}
 }
@@ -470,7 +544,7 @@ func saveConfig() {
 }
 
 func listenConnect(myID string, m *Model, tlsCfg *tls.Config) {
-	var conns = make(chan *tls.Conn)
+	var conns = make(chan directedConn)
 
 	// Listen
 	for _, addr := range cfg.Options.ListenAddress {
@@ -501,7 +575,7 @@ func listenConnect(myID string, m *Model, tlsCfg *tls.Config) {
 					continue
 				}
 
-				conns <- tc
+				conns <- directedConn{tc, false}
 			}
 		}()
 	}
@@ -553,7 +627,7 @@ func listenConnect(myID string, m *Model, tlsCfg *tls.Config) {
 						continue
 					}
 
-					conns <- conn
+					conns <- directedConn{conn, true}
 					continue nextNode
 				}
 			}
@@ -564,13 +638,12 @@ func listenConnect(myID string, m *Model, tlsCfg *tls.Config) {
 
 next:
 	for conn := range conns {
-		certs := conn.ConnectionState().PeerCertificates
-		if l := len(certs); l != 1 {
-			warnf("Got peer certificate list of length %d != 1; protocol error", l)
+		remoteID, err := tlsNodeID(conn.Conn.(*tls.Conn))
+		if err != nil {
+			warnln(err)
 			conn.Close()
 			continue
 		}
-		remoteID := certID(certs[0].Raw)
 
 		if remoteID == myID {
 			warnf("Connected to myself (%s) - should not happen", remoteID)
@@ -578,12 +651,6 @@ next:
 			continue
 		}
 
-		if m.ConnectedTo(remoteID) {
-			warnf("Connected to already connected node (%s)", remoteID)
-			conn.Close()
-			continue
-		}
-
 		for _, nodeCfg := range cfg.Nodes {
 			if nodeCfg.NodeID == remoteID {
 				var wr io.Writer = conn
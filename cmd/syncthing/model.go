@@ -1,23 +1,32 @@
 package main
 
 import (
+	"bytes"
 	"compress/gzip"
 	"crypto/sha1"
+	"encoding/json"
 	"errors"
 	"fmt"
 	"io"
 	"net"
 	"os"
 	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
 	"sync"
+	"sync/atomic"
 	"time"
 
 	"github.com/calmh/syncthing/buffers"
 	"github.com/calmh/syncthing/cid"
+	"github.com/calmh/syncthing/events"
 	"github.com/calmh/syncthing/files"
 	"github.com/calmh/syncthing/lamport"
 	"github.com/calmh/syncthing/protocol"
 	"github.com/calmh/syncthing/scanner"
+	"github.com/calmh/syncthing/vfs"
+	"github.com/juju/ratelimit"
 )
 
 type repoState int
@@ -30,64 +39,217 @@ const (
 )
 
 type Model struct {
-	repoDirs  map[string]string     // repo -> dir
-	repoFiles map[string]*files.Set // repo -> files
-	repoNodes map[string][]string   // repo -> nodeIDs
-	nodeRepos map[string][]string   // nodeID -> repos
-	repoState map[string]repoState  // repo -> state
-	rmut      sync.RWMutex          // protects the above
+	// Accessed atomically and first in the struct for alignment; see
+	// sourcesChanged.
+	sourceGen uint64
+
+	repoDirs  map[string]string                  // repo -> dir
+	repoFiles map[string]*files.Set              // repo -> files
+	repoNodes map[string][]string                // repo -> nodeIDs
+	nodeRepos map[string][]string                // nodeID -> repos
+	repoState map[string]repoState               // repo -> state
+	repoStats map[string]*PullStats              // repo -> pull statistics
+	fileErrs  map[string]map[string]*FileError   // repo -> file name -> pull errors
+	invalid   map[string]map[string]*invalidFile // repo -> file name -> invalid since
+	deleted   map[string]map[string]time.Time    // repo -> file name -> tombstone known since
+	diskRead  *ratelimit.Bucket                  // disk reads when scanning, or nil
+	diskWrite *ratelimit.Bucket                  // disk writes when pulling, or nil
+	symlinks  scanner.SymlinkPolicy              // how symlinks are scanned and pulled
+	phGuard   bool                               // whether emptied files may be placeholders
+	sizeCheck bool                               // whether size changes alone cause a rehash
+	ctimes    bool                               // whether creation times are scanned and pulled
+	sparse    bool                               // whether zero blocks are left as holes when pulling
+	keepOrig  bool                               // whether replaced files are backed up until the update is in place
+	verifyRen bool                               // whether pulled files are verified after being renamed into place
+	keepVers  int                                // old versions kept of replaced and deleted files
+	priority  []string                           // patterns of files pulled before others
+	noDeletes map[string]bool                    // nodeIDs whose deletes are not carried out
+	maxDelete int                                // deletions per pull round before holding them, zero for no limit
+	maxDelPct int                                // same, in percent of the local files
+	delGuards map[string]*deleteGuard            // repo -> deletions held or confirmed
+	phDetect  func(string, os.FileInfo) bool     // tells placeholders, or nil
+	nameFilt  func(string) bool                  // vetoes file names from the local index, or nil
+	dataFilt  func(string, []byte) bool          // vetoes file contents from the local index, or nil
+	dataSize  int                                // bytes passed to dataFilt
+	doneHook  func(scanner.File, string)         // called with each file pulled, or nil
+	scanDepth int                                // directory levels scanned below the repository, negative for no limit
+	settle    time.Duration                      // time a changed file must be left alone before it is hashed
+	srcRetry  time.Duration                      // how often files awaiting a source are looked at again
+	noPerms   bool                               // whether permission bits are neither scanned nor pulled
+	reserve   int64                              // bytes left free on the disk when pulling
+	freeSpace func(string) (int64, error)        // tells the free space in a directory, or nil for the filesystem's
+	lowSpace  map[string]bool                    // repos warned about running out of disk space
+	mounts    map[string]*repoMounts             // repo -> mount point policies and state
+	copyJobs  chan copyJob                       // unchanged blocks to copy, fed to the copiers
+	copiers   int                                // number of copiers started
+	repoLocks map[string]*repoLock               // repo -> lock held while read/write
+	lockDir   string                             // where the repo locks are taken, or empty for none
+	repoMode  map[string]int                     // repo -> pull threads once started, zero when read only
+	internal  []string                           // paths in each repository holding data of the application
+	rmut      sync.RWMutex                       // protects the above
+
+	cm    *cid.Map
+	fs    vfs.FS     // the filesystem holding the repositories
+	names NameMapper // translates file names to and from the wire
+	clock clock      // measures internal durations
+
+	updates  localUpdates // local updates during scans
+	syncRate syncRate     // pull throughput for the sync status
+
+	protoConn  map[string]protocol.Connection
+	rawConn    map[string]io.Closer
+	connAddr   map[string]ConnectionInfo // nodeID -> address fields of the connection
+	nodeVer    map[string]string
+	nodeReady  map[string]chan bool      // nodeID -> handshake result, while pending
+	rejected   map[string]map[string]int // nodeID -> repo -> number of rejected index entries
+	connFilter func(nodeID string, addr net.Addr) bool
+	forgotten  map[string]bool // nodeIDs refused until unforgotten
+	indexDone  map[string]bool // nodeIDs whose first full index has been applied
+	maxRequest map[string]int  // nodeID -> largest request accepted
+	maxBatch   map[string]int  // nodeID -> most blocks accepted in a batch request
+	indexRate  map[string]int  // nodeID -> initial index send rate, bytes per second
+	idxSending map[string]bool // nodeIDs being sent a rate limited initial index
+	pmut       sync.RWMutex    // protects the above
 
-	cm *cid.Map
+	sup suppressor
 
-	protoConn map[string]protocol.Connection
-	rawConn   map[string]io.Closer
-	nodeVer   map[string]string
-	pmut      sync.RWMutex // protects protoConn and rawConn
+	dropPending map[string]bool // nodeID -> index drop pending
+	dropTimer   *time.Timer
+	dmut        sync.Mutex // protects dropPending and dropTimer
 
-	sup suppressor
+	indexTime   map[string]map[string]time.Time // repo -> nodeID -> last index received
+	maxIndexAge time.Duration                   // zero for no limit
+	fullIndexes map[indexSource]*fullIndex      // last full index received
+	amut        sync.Mutex                      // protects the above
+
+	transfers map[transferKey]*Transfer // files being pulled
+	canceled  map[transferKey]uint64    // canceled pulls -> version not to pull
+	tempHave  map[string]tempHave       // temp file path -> bytes of the file present in it
+	tmut      sync.Mutex                // protects the above
+
+	changes     map[string]map[string]*localChange // repo -> file name -> local change not yet announced by all nodes
+	convergence map[string]*ConvergenceStats       // nodeID -> convergence of local changes
+	cmut        sync.Mutex                         // protects the above
+
+	nodeData map[string]*NodeDataStats // nodeID -> file data exchanged
+	nmut     sync.Mutex                // protects nodeData
+
+	reportFile string
+	repmut     sync.Mutex // protects reportFile and writes to it
 
 	addedRepo bool
 	started   bool
 }
 
+// The time to wait for further disconnects before dropping the index of a
+// closed connection and recalculating the global view.
+const indexDropDelay = 50 * time.Millisecond
+
+// The time to wait for the cluster configuration from a newly connected peer
+// before giving up on the connection.
+const handshakeTimeout = 60 * time.Second
+
+// How often to look for remote indexes older than the maximum index age.
+const indexAgeCheckInterval = 60 * time.Second
+
 var (
-	ErrNoSuchFile = errors.New("no such file")
-	ErrInvalid    = errors.New("file is invalid")
+	ErrNoSuchFile       = errors.New("no such file")
+	ErrInvalid          = errors.New("file is invalid")
+	ErrHandshakeTimeout = errors.New("timeout waiting for cluster configuration")
+	ErrNoSuchNode       = errors.New("no such node")
+	ErrNodeForgotten    = errors.New("node has been forgotten")
+	ErrUnsafePath       = errors.New("path is outside of repository")
+	ErrNotAnnounced     = errors.New("requested range is not covered by announced blocks")
 )
 
 // NewModel creates and starts a new model. The model starts in read-only mode,
 // where it sends index information to connected peers and responds to requests
 // for file data without altering the local repository in any way.
 func NewModel(maxChangeBw int) *Model {
+	return newModel(maxChangeBw, newMonotonicClock())
+}
+
+// newModel creates and starts a new model measuring internal durations with
+// the given clock. The clock is in place before the model's goroutines start.
+func newModel(maxChangeBw int, clock clock) *Model {
 	m := &Model{
-		repoDirs:  make(map[string]string),
-		repoFiles: make(map[string]*files.Set),
-		repoNodes: make(map[string][]string),
-		nodeRepos: make(map[string][]string),
-		repoState: make(map[string]repoState),
-		cm:        cid.NewMap(),
-		protoConn: make(map[string]protocol.Connection),
-		rawConn:   make(map[string]io.Closer),
-		nodeVer:   make(map[string]string),
-		sup:       suppressor{threshold: int64(maxChangeBw)},
+		repoDirs:    make(map[string]string),
+		repoFiles:   make(map[string]*files.Set),
+		repoNodes:   make(map[string][]string),
+		nodeRepos:   make(map[string][]string),
+		repoState:   make(map[string]repoState),
+		repoStats:   make(map[string]*PullStats),
+		fileErrs:    make(map[string]map[string]*FileError),
+		invalid:     make(map[string]map[string]*invalidFile),
+		deleted:     make(map[string]map[string]time.Time),
+		mounts:      make(map[string]*repoMounts),
+		cm:          cid.NewMap(),
+		fs:          vfs.OS,
+		names:       identityMapper{},
+		clock:       clock,
+		phGuard:     true,
+		sizeCheck:   true,
+		scanDepth:   -1,
+		protoConn:   make(map[string]protocol.Connection),
+		rawConn:     make(map[string]io.Closer),
+		connAddr:    make(map[string]ConnectionInfo),
+		nodeVer:     make(map[string]string),
+		nodeReady:   make(map[string]chan bool),
+		rejected:    make(map[string]map[string]int),
+		forgotten:   make(map[string]bool),
+		indexDone:   make(map[string]bool),
+		maxRequest:  make(map[string]int),
+		maxBatch:    make(map[string]int),
+		indexRate:   make(map[string]int),
+		idxSending:  make(map[string]bool),
+		sup:         suppressor{threshold: int64(maxChangeBw), clock: newMonotonicClock()},
+		dropPending: make(map[string]bool),
+		indexTime:   make(map[string]map[string]time.Time),
+		fullIndexes: make(map[indexSource]*fullIndex),
+		transfers:   make(map[transferKey]*Transfer),
+		canceled:    make(map[transferKey]uint64),
+		tempHave:    make(map[string]tempHave),
+		changes:     make(map[string]map[string]*localChange),
+		convergence: make(map[string]*ConvergenceStats),
+		nodeData:    make(map[string]*NodeDataStats),
+		copyJobs:    make(chan copyJob),
+		repoLocks:   make(map[string]*repoLock),
+		repoMode:    make(map[string]int),
+		noDeletes:   make(map[string]bool),
+		delGuards:   make(map[string]*deleteGuard),
+		lowSpace:    make(map[string]bool),
 	}
 
+	m.SetCopiers(1)
 	go m.broadcastIndexLoop()
+	go m.indexAgeLoop()
 	return m
 }
 
 // StartRW starts read/write processing on the current model. When in
 // read/write mode the model will attempt to keep in sync with the cluster by
-// pulling needed files from peer nodes.
-func (m *Model) StartRepoRW(repo string, threads int) {
-	m.rmut.RLock()
-	defer m.rmut.RUnlock()
+// pulling needed files from peer nodes. A repository on the filesystem of
+// the operating system is locked in the lock directory for as long as the
+// model runs; ErrRepoLocked is returned, and nothing is started, when
+// another instance holds the lock.
+func (m *Model) StartRepoRW(repo string, threads int) error {
+	m.rmut.Lock()
+	defer m.rmut.Unlock()
 
-	if dir, ok := m.repoDirs[repo]; !ok {
+	dir, ok := m.repoDirs[repo]
+	if !ok {
 		panic("cannot start without repo")
-	} else {
-		newPuller(repo, dir, m, threads)
 	}
+	if threads > 0 && m.fs == vfs.OS && m.lockDir != "" {
+		l, err := acquireRepoLock(m.lockDir, dir)
+		if err != nil {
+			return err
+		}
+		m.repoLocks[repo] = l
+	}
+	m.repoMode[repo] = threads
+	newPuller(repo, dir, m, threads)
+	return nil
 }
 
 // StartRO starts read only processing on the current model. When in
@@ -97,42 +259,487 @@ func (m *Model) StartRepoRO(repo string) {
 	m.StartRepoRW(repo, 0) // zero threads => read only
 }
 
+// SetLockDir sets the directory where the locks on repositories started
+// read/write are taken, normally the configuration directory next to the
+// index caches. No locks are taken without one.
+func (m *Model) SetLockDir(dir string) {
+	m.rmut.Lock()
+	m.lockDir = dir
+	m.rmut.Unlock()
+}
+
+// ReleaseRepoLocks removes the locks taken on the repositories started
+// read/write. It is called when shutting down.
+func (m *Model) ReleaseRepoLocks() {
+	m.rmut.Lock()
+	for repo, l := range m.repoLocks {
+		l.release()
+		delete(m.repoLocks, repo)
+	}
+	m.rmut.Unlock()
+}
+
+// SetFilesystem sets the filesystem holding the repositories, replacing the
+// filesystem of the operating system. It must be called before any
+// repositories are added. All pulled data goes through it: blocks are
+// written with WriteAt to a temporary file, read back for verification
+// unless each block was verified as it was written, and renamed into place,
+// so a filesystem can store the data elsewhere, such as in an object store.
+func (m *Model) SetFilesystem(fs vfs.FS) {
+	m.fs = fs
+}
+
+// SetSymlinkPolicy sets how symbolic links are handled when scanning and
+// pulling. Symlinks announced by other nodes are only created when the
+// policy is to recreate them.
+func (m *Model) SetSymlinkPolicy(p scanner.SymlinkPolicy) {
+	m.rmut.Lock()
+	m.symlinks = p
+	m.rmut.Unlock()
+}
+
+func (m *Model) symlinkPolicy() scanner.SymlinkPolicy {
+	m.rmut.RLock()
+	defer m.rmut.RUnlock()
+	return m.symlinks
+}
+
+// SetPlaceholderGuard sets whether files that were larger than a block but
+// are found empty with an unchanged modification time are taken to be
+// placeholders, as left by cloud storage clients, instead of announced as
+// truncated. The guard is enabled by default. Placeholders are announced as
+// invalid so that other nodes keep their copies.
+func (m *Model) SetPlaceholderGuard(enabled bool) {
+	m.rmut.Lock()
+	m.phGuard = enabled
+	m.rmut.Unlock()
+}
+
+// SetSizeCheck sets whether files whose size has changed since the last scan
+// are rehashed even if their modification time is unchanged. The check is
+// enabled by default.
+func (m *Model) SetSizeCheck(enabled bool) {
+	m.rmut.Lock()
+	m.sizeCheck = enabled
+	m.rmut.Unlock()
+}
+
+// SetSettleTime sets how long a changed file must have been left unchanged
+// before a scan hashes it. Files modified more recently may still be being
+// written; they are announced as invalid until a later scan finds them
+// settled. Zero, the default, hashes changed files right away.
+func (m *Model) SetSettleTime(d time.Duration) {
+	m.rmut.Lock()
+	m.settle = d
+	m.rmut.Unlock()
+}
+
+// SetSourceRetry sets how often the puller looks again at files that no
+// connected node could provide, even if no node has connected or sent an
+// index since. Zero, the default, waits for such a change.
+func (m *Model) SetSourceRetry(d time.Duration) {
+	m.rmut.Lock()
+	m.srcRetry = d
+	m.rmut.Unlock()
+}
+
+func (m *Model) sourceRetry() time.Duration {
+	m.rmut.RLock()
+	defer m.rmut.RUnlock()
+	return m.srcRetry
+}
+
+// SetIgnorePermissions sets whether permission bits are ignored, for
+// filesystems that cannot store them. Changes to them are then neither
+// picked up when scanning nor applied when pulling, and files keep the
+// permission bits they were last indexed with. It is disabled by default.
+func (m *Model) SetIgnorePermissions(enabled bool) {
+	m.rmut.Lock()
+	m.noPerms = enabled
+	m.rmut.Unlock()
+}
+
+func (m *Model) ignorePermissions() bool {
+	m.rmut.RLock()
+	defer m.rmut.RUnlock()
+	return m.noPerms
+}
+
+// SetPreserveCreateTime sets whether the creation times of files are
+// recorded when scanning and applied when pulling, on platforms where files
+// have a creation time that can be set. It is disabled by default.
+func (m *Model) SetPreserveCreateTime(enabled bool) {
+	m.rmut.Lock()
+	m.ctimes = enabled
+	m.rmut.Unlock()
+}
+
+// SetSparseFiles sets whether blocks of all zeros are left as holes in the
+// pulled files instead of being fetched and written, making the files
+// sparse on filesystems that support it. It is disabled by default.
+func (m *Model) SetSparseFiles(enabled bool) {
+	m.rmut.Lock()
+	m.sparse = enabled
+	m.rmut.Unlock()
+}
+
+func (m *Model) sparseFiles() bool {
+	m.rmut.RLock()
+	defer m.rmut.RUnlock()
+	return m.sparse
+}
+
+// SetPreserveOriginals sets whether a file being replaced by a pulled
+// version is backed up until the new version is in place, so that the
+// original is put back if the update fails. It is disabled by default.
+func (m *Model) SetPreserveOriginals(enabled bool) {
+	m.rmut.Lock()
+	m.keepOrig = enabled
+	m.rmut.Unlock()
+}
+
+func (m *Model) preserveOriginals() bool {
+	m.rmut.RLock()
+	defer m.rmut.RUnlock()
+	return m.keepOrig
+}
+
+// SetVerifyRenames sets whether a pulled file is checked against its index
+// entry once renamed into place, catching files replaced by another
+// application in the meantime. It is disabled by default.
+func (m *Model) SetVerifyRenames(enabled bool) {
+	m.rmut.Lock()
+	m.verifyRen = enabled
+	m.rmut.Unlock()
+}
+
+func (m *Model) verifyRenames() bool {
+	m.rmut.RLock()
+	defer m.rmut.RUnlock()
+	return m.verifyRen
+}
+
+// SetNameFilter sets a function vetoing files from the local index by name,
+// for applications that must keep certain files from being synchronized
+// regardless of the ignore files. It is called with the name of every
+// regular file and symlink scanned, and returns false to veto it. Vetoed
+// files are neither announced nor served. One already in the index is kept
+// there as invalid, so that no deletion is announced for it.
+func (m *Model) SetNameFilter(fn func(name string) bool) {
+	m.rmut.Lock()
+	m.nameFilt = fn
+	m.rmut.Unlock()
+}
+
+// SetContentFilter sets a function vetoing files from the local index by
+// content, like SetNameFilter. It is called with the first size bytes of
+// each file about to be hashed, which costs an extra read per file hashed.
+// Files that are unchanged since they were last hashed are not checked
+// again unless rehashed with ForceRehash.
+func (m *Model) SetContentFilter(fn func(name string, head []byte) bool, size int) {
+	m.rmut.Lock()
+	m.dataFilt = fn
+	m.dataSize = size
+	m.rmut.Unlock()
+}
+
+// vetoed returns true if the name filter vetoes the file.
+func (m *Model) vetoed(name string) bool {
+	m.rmut.RLock()
+	fn := m.nameFilt
+	m.rmut.RUnlock()
+	return fn != nil && !fn(name)
+}
+
+// SetPlaceholderDetector sets a function telling if the file at the given
+// path is a placeholder for contents not present locally, for filesystems
+// where that can be told from the file itself. It is consulted regardless
+// of the placeholder guard.
+func (m *Model) SetPlaceholderDetector(fn func(path string, info os.FileInfo) bool) {
+	m.rmut.Lock()
+	m.phDetect = fn
+	m.rmut.Unlock()
+}
+
+// SetFileCompleteHook sets a function called once for every file that has
+// been pulled and committed to the local index, with its metadata and the
+// node that served most of its data. For files pulled without transferring
+// any data, such as empty files, the node is one that announced the file.
+// It is called from the puller without any locks held, and holds up
+// pulling until it returns.
+func (m *Model) SetFileCompleteHook(fn func(f scanner.File, sourceNode string)) {
+	m.rmut.Lock()
+	m.doneHook = fn
+	m.rmut.Unlock()
+}
+
+// fileComplete logs the file as pulled and calls the file complete hook, if
+// any.
+func (m *Model) fileComplete(repo string, f scanner.File, node string) {
+	m.fileEvent(events.FilePulled, repo, f)
+	m.rmut.RLock()
+	fn := m.doneHook
+	m.rmut.RUnlock()
+	if fn != nil {
+		fn(f, node)
+	}
+}
+
+// SetDiskIORate limits the rate of disk reads when scanning and of disk
+// writes when pulling, in bytes per second. Zero means unlimited. This is
+// separate from the limit on network traffic.
+func (m *Model) SetDiskIORate(read, write int64) {
+	m.rmut.Lock()
+	m.diskRead = diskBucket(read)
+	m.diskWrite = diskBucket(write)
+	m.rmut.Unlock()
+}
+
+func diskBucket(rate int64) *ratelimit.Bucket {
+	if rate <= 0 {
+		return nil
+	}
+	// Allow bursts of up to one second's worth of I/O
+	return ratelimit.NewBucketWithRate(float64(rate), rate)
+}
+
+// waitDiskWrite blocks until n bytes may be written to disk.
+func (m *Model) waitDiskWrite(n int) {
+	m.rmut.RLock()
+	b := m.diskWrite
+	m.rmut.RUnlock()
+	if b != nil {
+		b.Wait(int64(n))
+	}
+}
+
+// SetMaxIndexAge sets the longest time the index of a connected node is kept
+// without receiving an index or index update from it. Older indexes are
+// dropped so that they stop affecting the global view. Zero means no limit.
+func (m *Model) SetMaxIndexAge(d time.Duration) {
+	m.amut.Lock()
+	m.maxIndexAge = d
+	m.amut.Unlock()
+}
+
+// indexReceived records that an index or index update was received from the
+// node.
+func (m *Model) indexReceived(nodeID, repo string) {
+	m.amut.Lock()
+	if m.indexTime[repo] == nil {
+		m.indexTime[repo] = make(map[string]time.Time)
+	}
+	m.indexTime[repo][nodeID] = m.clock.Now()
+	m.amut.Unlock()
+	atomic.AddUint64(&m.sourceGen, 1)
+}
+
+// MessageReceived is called when any message, pings included, has been
+// received from the node. A node that is still talking to us is keeping its
+// indexes up to date, even when it has no changes to send, so their age is
+// reset.
+func (m *Model) MessageReceived(nodeID string) {
+	now := m.clock.Now()
+	m.amut.Lock()
+	for _, nodes := range m.indexTime {
+		if _, ok := nodes[nodeID]; ok {
+			nodes[nodeID] = now
+		}
+	}
+	m.amut.Unlock()
+}
+
+func (m *Model) indexAgeLoop() {
+	for {
+		time.Sleep(indexAgeCheckInterval)
+		m.dropStaleIndexes(m.clock.Now())
+	}
+}
+
+// dropStaleIndexes drops the indexes that have not been updated for longer
+// than the maximum index age, as of the given time. Connected nodes are asked
+// to send their full index again, and until it arrives their index is not
+// considered received.
+func (m *Model) dropStaleIndexes(now time.Time) {
+	var stale = make(map[string][]string)
+	m.amut.Lock()
+	if m.maxIndexAge > 0 {
+		for repo, nodes := range m.indexTime {
+			for node, t := range nodes {
+				if now.Sub(t) > m.maxIndexAge {
+					stale[repo] = append(stale[repo], node)
+					delete(nodes, node)
+				}
+			}
+		}
+	}
+	maxAge := m.maxIndexAge
+	m.amut.Unlock()
+
+	if len(stale) == 0 {
+		return
+	}
+
+	m.rmut.RLock()
+	for repo, nodes := range stale {
+		var ids []uint
+		for _, node := range nodes {
+			warnf("No index update for repo %q from %s in %v; dropping its index", repo, node, maxAge)
+			ids = append(ids, m.cm.Get(node))
+		}
+		if rf, ok := m.repoFiles[repo]; ok {
+			rf.Drop(ids)
+		}
+	}
+	m.rmut.RUnlock()
+
+	var conns = make(map[string][]protocol.Connection)
+	m.pmut.Lock()
+	for repo, nodes := range stale {
+		for _, node := range nodes {
+			delete(m.indexDone, node)
+			if conn, ok := m.protoConn[node]; ok {
+				conns[repo] = append(conns[repo], conn)
+			}
+		}
+	}
+	m.pmut.Unlock()
+
+	for repo, cs := range conns {
+		for _, conn := range cs {
+			conn.RequestIndex(repo)
+		}
+	}
+}
+
+type remoteAddrer interface {
+	RemoteAddr() net.Addr
+}
+
 type ConnectionInfo struct {
 	protocol.Statistics
 	Address       string
+	IP            string
+	Port          int
+	Family        string // "ipv4" or "ipv6"
+	Private       bool   // loopback, link local or private range
 	ClientVersion string
 	Completion    int
+	RejectedFiles int
+
+	// File data exchanged with the node across all connections, as
+	// returned by NodeDataStats.
+	BytesServed     int64
+	BytesDownloaded int64
+}
+
+// setAddress fills in the address fields from the remote address of the
+// connection.
+func (ci *ConnectionInfo) setAddress(addr net.Addr) {
+	ci.Address = addr.String()
+
+	var ip net.IP
+	if ta, ok := addr.(*net.TCPAddr); ok {
+		ip = ta.IP
+		ci.Port = ta.Port
+	} else {
+		host, port, err := net.SplitHostPort(ci.Address)
+		if err != nil {
+			return
+		}
+		ip = net.ParseIP(host)
+		ci.Port, _ = strconv.Atoi(port)
+	}
+	if ip == nil {
+		return
+	}
+
+	ci.IP = ip.String()
+	if ip.To4() != nil {
+		ci.Family = "ipv4"
+	} else {
+		ci.Family = "ipv6"
+	}
+	ci.Private = ip.IsLoopback() || ip.IsLinkLocalUnicast() || isPrivateIP(ip)
+}
+
+// The private IPv4 ranges of RFC 1918 and the unique local IPv6 range of
+// RFC 4193.
+var privateNets = parseNets("10.0.0.0/8", "172.16.0.0/12", "192.168.0.0/16", "fc00::/7")
+
+func parseNets(cidrs ...string) []*net.IPNet {
+	var nets []*net.IPNet
+	for _, cidr := range cidrs {
+		_, n, err := net.ParseCIDR(cidr)
+		if err != nil {
+			panic(err)
+		}
+		nets = append(nets, n)
+	}
+	return nets
+}
+
+// isPrivateIP returns true if the address is in one of the private ranges.
+func isPrivateIP(ip net.IP) bool {
+	for _, n := range privateNets {
+		if n.Contains(ip) {
+			return true
+		}
+	}
+	return false
 }
 
 // ConnectionStats returns a map with connection statistics for each connected node.
 func (m *Model) ConnectionStats() map[string]ConnectionInfo {
-	type remoteAddrer interface {
-		RemoteAddr() net.Addr
-	}
+	var res = make(map[string]ConnectionInfo)
+	m.ConnectionStatsInto(res)
+	return res
+}
 
+// ConnectionStatsInto fills in dst with the connection statistics for each
+// connected node, as returned by ConnectionStats. Entries for nodes that are
+// no longer connected are removed. Reusing the map between calls saves
+// allocating a new one each time.
+func (m *Model) ConnectionStatsInto(dst map[string]ConnectionInfo) {
 	m.pmut.RLock()
 	m.rmut.RLock()
 
-	var res = make(map[string]ConnectionInfo)
+	for node := range dst {
+		if _, ok := m.protoConn[node]; !ok {
+			delete(dst, node)
+		}
+	}
+	// The global size of a repository is the same for all nodes.
+	globalSize := make(map[string]int64, len(m.repoFiles))
 	for node, conn := range m.protoConn {
-		ci := ConnectionInfo{
-			Statistics:    conn.Statistics(),
-			ClientVersion: m.nodeVer[node],
+		ci := m.connAddr[node]
+		ci.Statistics = conn.Statistics()
+		ci.ClientVersion = m.nodeVer[node]
+		for _, n := range m.rejected[node] {
+			ci.RejectedFiles += n
 		}
-		if nc, ok := m.rawConn[node].(remoteAddrer); ok {
-			ci.Address = nc.RemoteAddr().String()
+		m.nmut.Lock()
+		if ds, ok := m.nodeData[node]; ok {
+			ci.BytesServed = ds.BytesServed
+			ci.BytesDownloaded = ds.BytesDownloaded
 		}
+		m.nmut.Unlock()
 
 		var tot int64
 		var have int64
 
 		for _, repo := range m.nodeRepos[node] {
-			for _, f := range m.repoFiles[repo].Global() {
-				if f.Flags&protocol.FlagDeleted == 0 {
-					tot += f.Size
-					have += f.Size
+			size, ok := globalSize[repo]
+			if !ok {
+				for _, f := range m.repoFiles[repo].Global() {
+					if f.Flags&protocol.FlagDeleted == 0 {
+						size += f.Size
+					}
 				}
+				globalSize[repo] = size
 			}
+			tot += size
+			have += size
 
 			for _, f := range m.repoFiles[repo].Need(m.cm.Get(node)) {
 				if f.Flags&protocol.FlagDeleted == 0 {
@@ -141,73 +748,486 @@ func (m *Model) ConnectionStats() map[string]ConnectionInfo {
 			}
 		}
 
-		ci.Completion = 100
-		if tot != 0 {
-			ci.Completion = int(100 * have / tot)
+		ci.Completion = 100
+		if tot != 0 {
+			ci.Completion = int(100 * have / tot)
+		}
+
+		dst[node] = ci
+	}
+
+	m.rmut.RUnlock()
+	m.pmut.RUnlock()
+}
+
+// TrafficStats returns the traffic to and from all connected nodes, broken
+// down by message type. Use IndexBytes and DataBytes on the result to tell
+// index overhead from file data.
+func (m *Model) TrafficStats() (in, out protocol.MessageStatistics) {
+	m.pmut.RLock()
+	defer m.pmut.RUnlock()
+	for _, conn := range m.protoConn {
+		s := conn.Statistics()
+		in = in.Add(s.InBytesByType)
+		out = out.Add(s.OutBytesByType)
+	}
+	return
+}
+
+// PullStats returns the pull statistics for the given repository.
+func (m *Model) PullStats(repo string) PullStats {
+	return m.pullStats(repo).snapshot()
+}
+
+func (m *Model) pullStats(repo string) *PullStats {
+	m.rmut.RLock()
+	ps, ok := m.repoStats[repo]
+	m.rmut.RUnlock()
+	if !ok {
+		return &PullStats{}
+	}
+	return ps
+}
+
+func sizeOf(fs []scanner.File) (files, deleted int, bytes int64) {
+	for _, f := range fs {
+		if f.Flags&protocol.FlagDeleted == 0 {
+			files++
+			bytes += f.Size
+		} else {
+			deleted++
+		}
+	}
+	return
+}
+
+// GlobalSize returns the number of files, deleted files and total bytes for all
+// files in the global model.
+func (m *Model) GlobalSize(repo string) (files, deleted int, bytes int64) {
+	m.rmut.RLock()
+	defer m.rmut.RUnlock()
+	if rf, ok := m.repoFiles[repo]; ok {
+		return sizeOf(rf.Global())
+	}
+	return 0, 0, 0
+}
+
+// LocalSize returns the number of files, deleted files and total bytes for all
+// files in the local repository.
+func (m *Model) LocalSize(repo string) (files, deleted int, bytes int64) {
+	m.rmut.RLock()
+	defer m.rmut.RUnlock()
+	if rf, ok := m.repoFiles[repo]; ok {
+		return sizeOf(rf.Have(cid.LocalID))
+	}
+	return 0, 0, 0
+}
+
+// NeedFiles returns the list of currently needed files and the total size.
+func (m *Model) NeedSize(repo string) (files int, bytes int64) {
+	var nf = m.NeedFilesRepo(repo)
+
+	for _, f := range nf {
+		bytes += f.Size
+	}
+
+	return len(nf), bytes
+}
+
+// RemainingBytes returns the number of bytes that remain to be transferred
+// to bring the repository in sync. Unlike NeedSize, blocks of needed files
+// that are already present in the local version of the file are not
+// counted.
+func (m *Model) RemainingBytes(repo string) int64 {
+	m.rmut.RLock()
+	defer m.rmut.RUnlock()
+	rf, ok := m.repoFiles[repo]
+	if !ok {
+		return 0
+	}
+
+	var bytes int64
+	for _, f := range rf.Need(cid.LocalID) {
+		bytes += remainingBytes(rf.Get(cid.LocalID, f.Name), f)
+	}
+	return bytes
+}
+
+// remainingBytes returns the number of bytes to transfer to turn the local
+// file lf into the needed file f.
+func remainingBytes(lf, f scanner.File) int64 {
+	if f.Flags&(protocol.FlagDeleted|protocol.FlagDirectory) != 0 {
+		return 0
+	}
+	var bytes int64
+	_, need := scanner.BlockDiff(lf.Blocks, f.Blocks)
+	for _, b := range need {
+		bytes += int64(b.Size)
+	}
+	return bytes
+}
+
+// NeedReason tells why a file is needed.
+type NeedReason int
+
+const (
+	NeedNew     NeedReason = iota // we don't have the file
+	NeedUpdated                   // we have an older version of the file
+	NeedDelete                    // the file has been deleted in the cluster
+)
+
+func (r NeedReason) String() string {
+	switch r {
+	case NeedNew:
+		return "new"
+	case NeedUpdated:
+		return "updated"
+	case NeedDelete:
+		return "delete"
+	default:
+		return "unknown"
+	}
+}
+
+func (r NeedReason) MarshalText() ([]byte, error) {
+	return []byte(r.String()), nil
+}
+
+// NeedAvailability tells whether a needed file can currently be pulled.
+type NeedAvailability int
+
+const (
+	NeedAvailable   NeedAvailability = iota // a connected node has the file, or nothing needs to be transferred
+	NeedPartial                             // no connected node has the file, but some of its data is already here
+	NeedUnavailable                         // no connected node has the file
+)
+
+func (a NeedAvailability) String() string {
+	switch a {
+	case NeedAvailable:
+		return "available"
+	case NeedPartial:
+		return "partial"
+	case NeedUnavailable:
+		return "unavailable"
+	default:
+		return "unknown"
+	}
+}
+
+func (a NeedAvailability) MarshalText() ([]byte, error) {
+	return []byte(a.String()), nil
+}
+
+// A NeedEntry describes a needed file.
+type NeedEntry struct {
+	File           scanner.File
+	Reason         NeedReason
+	Availability   NeedAvailability
+	Sources        []string // the connected nodes that have the needed version
+	Waiting        []string // the nodes that have the needed version but aren't connected
+	RemainingBytes int64    // as for RemainingBytes
+}
+
+// NeedDetails returns the needed files of the repository, with the reason
+// each is needed and where it is available from, in the order they are
+// pulled.
+func (m *Model) NeedDetails(repo string) []NeedEntry {
+	connected := m.connectedNodes()
+
+	m.rmut.RLock()
+	defer m.rmut.RUnlock()
+	rf, ok := m.repoFiles[repo]
+	if !ok {
+		return nil
+	}
+
+	var res []NeedEntry
+	for _, f := range m.prioritized(m.trustedNeed(rf)) {
+		lf := rf.Get(cid.LocalID, f.Name)
+		e := NeedEntry{
+			File:           f,
+			RemainingBytes: remainingBytes(lf, f),
+		}
+		e.Availability, e.Sources, e.Waiting = m.needAvailability(lf, f, uint64(rf.Availability(f.Name)), connected)
+		switch {
+		case f.Flags&protocol.FlagDeleted != 0:
+			e.Reason = NeedDelete
+		case lf.Name != f.Name || lf.Flags&protocol.FlagDeleted != 0:
+			e.Reason = NeedNew
+		default:
+			e.Reason = NeedUpdated
+		}
+		res = append(res, e)
+	}
+	return res
+}
+
+// sources returns the sorted names of the nodes in the availability bitset.
+func (m *Model) sources(availability uint64) []string {
+	var nodes []string
+	for _, node := range m.cm.Names() {
+		id := m.cm.Get(node)
+		if id != cid.LocalID && availability&(1<<id) != 0 {
+			nodes = append(nodes, node)
+		}
+	}
+	sort.Strings(nodes)
+	return nodes
+}
+
+// connectedNodes returns the set of nodes currently connected.
+func (m *Model) connectedNodes() map[string]bool {
+	m.pmut.RLock()
+	defer m.pmut.RUnlock()
+	connected := make(map[string]bool, len(m.protoConn))
+	for node := range m.protoConn {
+		connected[node] = true
+	}
+	return connected
+}
+
+// needAvailability classifies the needed file f, given the local version lf
+// and the availability bitset of f. Returns the nodes that have f, split by
+// whether they are connected.
+func (m *Model) needAvailability(lf, f scanner.File, availability uint64, connected map[string]bool) (a NeedAvailability, sources, waiting []string) {
+	for _, node := range m.sources(availability) {
+		if connected[node] {
+			sources = append(sources, node)
+		} else {
+			waiting = append(waiting, node)
+		}
+	}
+
+	remaining := remainingBytes(lf, f)
+	switch {
+	case len(sources) > 0 || remaining == 0:
+		a = NeedAvailable
+	case remaining < f.Size:
+		a = NeedPartial
+	default:
+		a = NeedUnavailable
+	}
+	return
+}
+
+// NeedAvailabilitySummary returns the number of needed files in the
+// repository by availability, and the sorted names of the nodes that files
+// not available are waiting for.
+func (m *Model) NeedAvailabilitySummary(repo string) (available, partial, unavailable int, waiting []string) {
+	var nodes = make(map[string]bool)
+	for _, e := range m.NeedDetails(repo) {
+		switch e.Availability {
+		case NeedAvailable:
+			available++
+			continue
+		case NeedPartial:
+			partial++
+		case NeedUnavailable:
+			unavailable++
+		}
+		for _, node := range e.Waiting {
+			nodes[node] = true
+		}
+	}
+	for node := range nodes {
+		waiting = append(waiting, node)
+	}
+	sort.Strings(waiting)
+	return
+}
+
+// sourcesChanged returns a counter that increases whenever a node connects
+// or sends an index, i.e. whenever files that were not available may have
+// become so.
+func (m *Model) sourcesChanged() uint64 {
+	return atomic.LoadUint64(&m.sourceGen)
+}
+
+// SyncProgress returns the number of bytes in sync and the total number of
+// bytes in the global repository. Files currently being pulled contribute
+// the bytes written to their temporary file so far; other needed files
+// contribute the blocks already present in a left over temporary file.
+func (m *Model) SyncProgress(repo string) (inSyncBytes, totalBytes int64) {
+	m.rmut.RLock()
+	rf, ok := m.repoFiles[repo]
+	dir := m.repoDirs[repo]
+	m.rmut.RUnlock()
+
+	if !ok {
+		return 0, 0
+	}
+
+	_, _, totalBytes = sizeOf(rf.Global())
+	inSyncBytes = totalBytes
+
+	for _, f := range rf.Need(cid.LocalID) {
+		if f.Flags&protocol.FlagDeleted != 0 {
+			continue
+		}
+		inSyncBytes -= f.Size
+		inSyncBytes += m.tempFileBytes(repo, dir, f)
+	}
+
+	return
+}
+
+// tempHave caches the number of bytes of a file version present in its
+// temporary file, as long as the temporary file isn't modified.
+type tempHave struct {
+	version uint64
+	size    int64
+	modTime time.Time
+	bytes   int64
+}
+
+// tempFileBytes returns the number of bytes of f that are already present in
+// its temporary file. The puller's count is used for files being pulled, so
+// that a temporary file is only hashed when it was left over and has changed
+// since it was last looked at.
+func (m *Model) tempFileBytes(repo, dir string, f scanner.File) int64 {
+	temp := filepath.Join(dir, defTempNamer.TempName(f.Name))
+
+	m.tmut.Lock()
+	if t, ok := m.transfers[transferKey{repo, f.Name}]; ok && t.version == f.Version {
+		written := t.Written
+		m.tmut.Unlock()
+		if written > f.Size {
+			written = f.Size
 		}
+		return written
+	}
+	cached, ok := m.tempHave[temp]
+	m.tmut.Unlock()
 
-		res[node] = ci
+	info, err := m.fs.Stat(temp)
+	if err != nil {
+		m.tmut.Lock()
+		delete(m.tempHave, temp)
+		m.tmut.Unlock()
+		return 0
+	}
+	if ok && cached.version == f.Version && cached.size == info.Size() && cached.modTime.Equal(info.ModTime()) {
+		return cached.bytes
 	}
 
-	m.rmut.RUnlock()
-	m.pmut.RUnlock()
+	var bytes int64
+	for _, b := range tempFileBlocks(m.fs, temp, f) {
+		bytes += int64(b.Size)
+	}
 
-	return res
+	m.tmut.Lock()
+	m.tempHave[temp] = tempHave{
+		version: f.Version,
+		size:    info.Size(),
+		modTime: info.ModTime(),
+		bytes:   bytes,
+	}
+	m.tmut.Unlock()
+	return bytes
 }
 
-func sizeOf(fs []scanner.File) (files, deleted int, bytes int64) {
-	for _, f := range fs {
-		if f.Flags&protocol.FlagDeleted == 0 {
-			files++
-			bytes += f.Size
-		} else {
-			deleted++
-		}
+// tempFileBlocks returns the blocks of f that are already present in the
+// temporary file, if any.
+func tempFileBlocks(fs vfs.FS, temp string, f scanner.File) []scanner.Block {
+	fd, err := fs.Open(temp)
+	if err != nil {
+		return nil
 	}
-	return
+	defer fd.Close()
+
+	blocks, err := scanner.Blocks(fd, BlockSize)
+	if err != nil {
+		return nil
+	}
+
+	have, _ := scanner.BlockDiff(blocks, f.Blocks)
+	return have
 }
 
-// GlobalSize returns the number of files, deleted files and total bytes for all
-// files in the global model.
-func (m *Model) GlobalSize(repo string) (files, deleted int, bytes int64) {
+// NeedFilesRepo returns the currently needed files, those matching the pull
+// priority patterns first.
+func (m *Model) NeedFilesRepo(repo string) []scanner.File {
 	m.rmut.RLock()
 	defer m.rmut.RUnlock()
-	if rf, ok := m.repoFiles[repo]; ok {
-		return sizeOf(rf.Global())
+	if rf, ok := m.repoFiles[repo]; ok && !m.inSync(repo) {
+		return m.prioritized(m.trustedNeed(rf))
 	}
-	return 0, 0, 0
+	return nil
 }
 
-// LocalSize returns the number of files, deleted files and total bytes for all
-// files in the local repository.
-func (m *Model) LocalSize(repo string) (files, deleted int, bytes int64) {
+// InvalidFiles returns the files in the local repository that are marked
+// invalid and thus not synchronized.
+func (m *Model) InvalidFiles(repo string) []scanner.File {
 	m.rmut.RLock()
 	defer m.rmut.RUnlock()
+	var invalid []scanner.File
 	if rf, ok := m.repoFiles[repo]; ok {
-		return sizeOf(rf.Have(cid.LocalID))
+		for _, f := range rf.Have(cid.LocalID) {
+			if f.Invalid {
+				invalid = append(invalid, f)
+			}
+		}
 	}
-	return 0, 0, 0
+	return invalid
 }
 
-// NeedFiles returns the list of currently needed files and the total size.
-func (m *Model) NeedSize(repo string) (files int, bytes int64) {
-	var nf = m.NeedFilesRepo(repo)
+// DiffWithNode compares the local index with the latest index received from
+// the given node. It returns the names of files that only we have, that only
+// the node has and that we both have but in different versions. Files that
+// are deleted on the side that has them are not listed as present. As in the
+// file set, files are considered the same when their versions are equal.
+func (m *Model) DiffWithNode(repo, nodeID string) (weHave, theyHave, differ []string, err error) {
+	m.rmut.RLock()
+	defer m.rmut.RUnlock()
 
-	for _, f := range nf {
-		bytes += f.Size
+	fs, ok := m.repoFiles[repo]
+	if !ok {
+		return nil, nil, nil, ErrNoSuchRepo
+	}
+	var shared bool
+	for _, n := range m.repoNodes[repo] {
+		if n == nodeID {
+			shared = true
+			break
+		}
+	}
+	if !shared {
+		return nil, nil, nil, ErrNoSuchNode
 	}
 
-	return len(nf), bytes
-}
+	id := m.cm.Get(nodeID)
+	if bytes.Equal(fs.Root(cid.LocalID), fs.Root(id)) {
+		return
+	}
 
-// NeedFiles returns the list of currently needed files and the total size.
-func (m *Model) NeedFilesRepo(repo string) []scanner.File {
-	m.rmut.RLock()
-	defer m.rmut.RUnlock()
-	if rf, ok := m.repoFiles[repo]; ok {
-		return rf.Need(cid.LocalID)
+	remote := make(map[string]scanner.File)
+	for _, f := range fs.Have(id) {
+		remote[f.Name] = f
 	}
-	return nil
+
+	for _, lf := range fs.Have(cid.LocalID) {
+		rf, ok := remote[lf.Name]
+		delete(remote, lf.Name)
+		switch {
+		case !ok:
+			if lf.Flags&protocol.FlagDeleted == 0 {
+				weHave = append(weHave, lf.Name)
+			}
+		case lf.Version != rf.Version:
+			differ = append(differ, lf.Name)
+		}
+	}
+	for _, rf := range remote {
+		if rf.Flags&protocol.FlagDeleted == 0 {
+			theyHave = append(theyHave, rf.Name)
+		}
+	}
+
+	sort.Strings(weHave)
+	sort.Strings(theyHave)
+	sort.Strings(differ)
+	return
 }
 
 // Index is called when a new node is connected and we receive their full index.
@@ -217,20 +1237,123 @@ func (m *Model) Index(nodeID string, repo string, fs []protocol.FileInfo) {
 		dlog.Printf("IDX(in): %s / %q: %d files", nodeID, repo, len(fs))
 	}
 
-	var files = make([]scanner.File, len(fs))
-	for i := range fs {
-		lamport.Default.Tick(fs[i].Version)
-		files[i] = fileFromFileInfo(fs[i])
+	if m.isForgotten(nodeID) {
+		// Sent before the connection was closed.
+		return
 	}
 
+	files := m.verifiedFiles(nodeID, repo, fs, true)
+
 	id := m.cm.Get(nodeID)
 	m.rmut.RLock()
-	if r, ok := m.repoFiles[repo]; ok {
+	r, ok := m.repoFiles[repo]
+	if ok && !m.sharedWith(repo, nodeID) {
+		warnf("Index from %s for repo %q not shared with it; dropping", nodeID, repo)
+		ok = false
+	} else if ok {
+		m.checkDuplicateNode(nodeID, repo, files)
 		r.Replace(id, files)
+		m.indexReceived(nodeID, repo)
 	} else {
 		warnf("Index from %s for nonexistant repo %q; dropping", nodeID, repo)
 	}
 	m.rmut.RUnlock()
+
+	if ok {
+		m.indexConverged(nodeID, repo, files)
+		m.pmut.Lock()
+		m.indexDone[nodeID] = true
+		m.pmut.Unlock()
+	}
+}
+
+// IndexReceived returns true if the first full index from the node on the
+// current connection has been received and applied. Until then, what we
+// know about the files available from the node is incomplete.
+func (m *Model) IndexReceived(nodeID string) bool {
+	m.pmut.RLock()
+	defer m.pmut.RUnlock()
+	return m.indexDone[nodeID]
+}
+
+// verifiedFiles converts the file infos received from the given node to
+// files with canonical names. Files with an invalid name or an inconsistent
+// block list are kept, without blocks, marked invalid so that they are not
+// pulled, and are counted as rejected; a full index resets the count for the
+// repository. Of several files with the same canonical name, the newest
+// version is kept.
+func (m *Model) verifiedFiles(nodeID, repo string, fs []protocol.FileInfo, full bool) []scanner.File {
+	var files = make([]scanner.File, 0, len(fs))
+	var seen = make(map[string]int, len(fs)) // canonical name -> index in files
+	var rejected int
+	internal := m.internalPaths()
+	for i := range fs {
+		lamport.Default.Tick(fs[i].Version)
+		f := fileFromFileInfo(fs[i])
+		if err := verifyBlocks(fs[i]); err != nil {
+			if debugIdx {
+				dlog.Printf("IDX(in): %s: rejecting %q: %v", nodeID, fs[i].Name, err)
+			}
+			rejected++
+			f = rejectedFile(f, protocol.InvalidReasonUnknown)
+		}
+		f.Name = m.names.ToLocal(f.Name)
+		name, err := canonicalName(f.Name, f.Flags&protocol.FlagDirectory != 0)
+		if err != nil {
+			if debugIdx {
+				dlog.Printf("IDX(in): %s: rejecting %q: %v", nodeID, fs[i].Name, err)
+			}
+			if !f.Invalid {
+				rejected++
+			}
+			f = rejectedFile(f, protocol.InvalidReasonBadName)
+			name = f.Name
+		}
+		f.Name = name
+		if isInternal(internal, name) {
+			if debugIdx {
+				dlog.Printf("IDX(in): %s: ignoring internal %q", nodeID, fs[i].Name)
+			}
+			continue
+		}
+
+		if j, ok := seen[name]; ok {
+			if debugIdx {
+				dlog.Printf("IDX(in): %s: duplicate %q", nodeID, fs[i].Name)
+			}
+			if f.Version > files[j].Version {
+				files[j] = f
+			}
+			continue
+		}
+		seen[name] = len(files)
+		files = append(files, f)
+	}
+
+	m.pmut.Lock()
+	if full {
+		delete(m.rejected[nodeID], repo)
+	}
+	if rejected > 0 {
+		warnf("Rejected %d files with invalid names or inconsistent block lists from %s", rejected, nodeID)
+		if m.rejected[nodeID] == nil {
+			m.rejected[nodeID] = make(map[string]int)
+		}
+		m.rejected[nodeID][repo] += rejected
+	}
+	m.pmut.Unlock()
+
+	return files
+}
+
+// rejectedFile returns the file marked invalid for the given reason, without
+// any blocks to pull.
+func rejectedFile(f scanner.File, reason uint32) scanner.File {
+	f.Invalid = true
+	f.InvalidReason = reason
+	f.Blocks = nil
+	f.Size = 0
+	return f
 }
 
 // IndexUpdate is called for incremental updates to connected nodes' indexes.
@@ -240,20 +1363,29 @@ func (m *Model) IndexUpdate(nodeID string, repo string, fs []protocol.FileInfo)
 		dlog.Printf("IDXUP(in): %s / %q: %d files", nodeID, repo, len(fs))
 	}
 
-	var files = make([]scanner.File, len(fs))
-	for i := range fs {
-		lamport.Default.Tick(fs[i].Version)
-		files[i] = fileFromFileInfo(fs[i])
+	if m.isForgotten(nodeID) {
+		return
 	}
 
+	files := m.verifiedFiles(nodeID, repo, fs, false)
+
 	id := m.cm.Get(nodeID)
 	m.rmut.RLock()
-	if r, ok := m.repoFiles[repo]; ok {
+	r, ok := m.repoFiles[repo]
+	if ok && !m.sharedWith(repo, nodeID) {
+		warnf("Index update from %s for repo %q not shared with it; dropping", nodeID, repo)
+		ok = false
+	} else if ok {
 		r.Update(id, files)
+		m.indexReceived(nodeID, repo)
 	} else {
 		warnf("Index update from %s for nonexistant repo %q; dropping", nodeID, repo)
 	}
 	m.rmut.RUnlock()
+
+	if ok {
+		m.indexConverged(nodeID, repo, files)
+	}
 }
 
 func (m *Model) ClusterConfig(nodeID string, config protocol.ClusterConfigMessage) {
@@ -269,6 +1401,12 @@ func (m *Model) ClusterConfig(nodeID string, config protocol.ClusterConfigMessag
 	}
 
 	m.pmut.Lock()
+	if ready, ok := m.nodeReady[nodeID]; ok && compErr == nil {
+		ready <- true
+		delete(m.nodeReady, nodeID)
+	}
+	m.maxRequest[nodeID] = protocol.PeerMaxRequestSize(config)
+	m.maxBatch[nodeID] = protocol.PeerMaxBatch(config)
 	if config.ClientName == "syncthing" {
 		m.nodeVer[nodeID] = config.ClientVersion
 	} else {
@@ -280,6 +1418,28 @@ func (m *Model) ClusterConfig(nodeID string, config protocol.ClusterConfigMessag
 // Close removes the peer from the model and closes the underlying connection if possible.
 // Implements the protocol.Model interface.
 func (m *Model) Close(node string, err error) {
+	m.close(node, nil, err)
+}
+
+// ConnectionClosed is called by a protocol connection when it has been
+// closed. Only the registered connection to the node is torn down; closing a
+// duplicate or rejected connection leaves the existing one alone.
+func (m *Model) ConnectionClosed(conn protocol.Connection, err error) {
+	m.close(conn.ID(), conn, err)
+}
+
+// close tears down the connection to the node, if it is conn or if conn is
+// nil.
+func (m *Model) close(node string, conn protocol.Connection, err error) {
+	m.pmut.Lock()
+	if conn != nil && m.protoConn[node] != conn {
+		m.pmut.Unlock()
+		if debugNet {
+			dlog.Printf("%s: unregistered connection closed: %v", node, err)
+		}
+		return
+	}
+
 	if debugNet {
 		dlog.Printf("%s: %v", node, err)
 	}
@@ -290,71 +1450,331 @@ func (m *Model) Close(node string, err error) {
 		warnf("Connection to %s closed: %v", node, err)
 	}
 
-	cid := m.cm.Get(node)
+	if raw, ok := m.rawConn[node]; ok {
+		raw.Close()
+	}
+	if ready, ok := m.nodeReady[node]; ok {
+		ready <- false
+		delete(m.nodeReady, node)
+	}
+	delete(m.protoConn, node)
+	delete(m.rawConn, node)
+	delete(m.connAddr, node)
+	delete(m.nodeVer, node)
+	delete(m.indexDone, node)
+	delete(m.maxRequest, node)
+	delete(m.maxBatch, node)
+	m.pmut.Unlock()
+
+	m.dropChanges(node, "")
+	m.scheduleIndexDrop(node)
+}
+
+// scheduleIndexDrop marks the index of the given node for removal. The
+// removal happens once no further disconnects have been seen for
+// indexDropDelay, so that a burst of disconnects results in only one
+// recalculation of the global view. Until then the stale index stays in
+// place; the worst that can happen is that we try to request blocks from a
+// node that is no longer connected.
+func (m *Model) scheduleIndexDrop(node string) {
+	m.dmut.Lock()
+	m.dropPending[node] = true
+	if m.dropTimer == nil {
+		m.dropTimer = time.AfterFunc(indexDropDelay, m.dropPendingIndexes)
+	} else {
+		m.dropTimer.Reset(indexDropDelay)
+	}
+	m.dmut.Unlock()
+}
+
+// dropPendingIndexes removes the indexes of nodes that have disconnected and
+// not reconnected since, and releases their connection IDs.
+func (m *Model) dropPendingIndexes() {
+	m.dmut.Lock()
+	pending := m.dropPending
+	m.dropPending = make(map[string]bool)
+	m.dmut.Unlock()
+
+	m.pmut.RLock()
 	m.rmut.RLock()
-	for _, repo := range m.nodeRepos[node] {
-		m.repoFiles[repo].Replace(cid, nil)
+
+	var dropped []string
+	for node := range pending {
+		if _, ok := m.protoConn[node]; ok {
+			// The node has reconnected. The index it sends on the new
+			// connection will replace the old one.
+			continue
+		}
+		dropped = append(dropped, node)
 	}
+	m.dropIndexes(dropped)
+
 	m.rmut.RUnlock()
-	m.cm.Clear(node)
+	m.pmut.RUnlock()
+
+	if debugNet && len(dropped) > 0 {
+		dlog.Printf("dropped indexes for %v", dropped)
+	}
+}
+
+// dropIndexes removes the indexes of the given nodes, recalculating the
+// global view once per repository, and releases their connection IDs. The
+// caller must hold rmut.
+func (m *Model) dropIndexes(nodes []string) {
+	var repoIDs = make(map[string][]uint)
+	for _, node := range nodes {
+		id := m.cm.Get(node)
+		for _, repo := range m.nodeRepos[node] {
+			repoIDs[repo] = append(repoIDs[repo], id)
+		}
+	}
+
+	for repo, ids := range repoIDs {
+		m.repoFiles[repo].Drop(ids)
+	}
+
+	m.amut.Lock()
+	for _, node := range nodes {
+		m.cm.Clear(node)
+		for _, times := range m.indexTime {
+			delete(times, node)
+		}
+	}
+	m.amut.Unlock()
+}
 
+// ForgetNode closes any connection to the node and drops its index,
+// statistics and settings. Files that only the node had are no longer
+// available. Further connections from the node are refused until
+// UnforgetNode is called.
+func (m *Model) ForgetNode(nodeID string) {
 	m.pmut.Lock()
-	conn, ok := m.rawConn[node]
-	if ok {
-		conn.Close()
+	m.forgotten[nodeID] = true
+	_, connected := m.rawConn[nodeID]
+	delete(m.rejected, nodeID)
+	delete(m.maxRequest, nodeID)
+	delete(m.indexRate, nodeID)
+	m.pmut.Unlock()
+
+	if connected {
+		m.Close(nodeID, ErrNodeForgotten)
 	}
-	delete(m.protoConn, node)
-	delete(m.rawConn, node)
-	delete(m.nodeVer, node)
+
+	m.rmut.Lock()
+	m.dropIndexes([]string{nodeID})
+	delete(m.noDeletes, nodeID)
+	m.rmut.Unlock()
+
+	m.amut.Lock()
+	for src := range m.fullIndexes {
+		if src.node == nodeID {
+			delete(m.fullIndexes, src)
+		}
+	}
+	m.amut.Unlock()
+
+	m.dropChanges(nodeID, "")
+	m.cmut.Lock()
+	delete(m.convergence, nodeID)
+	m.cmut.Unlock()
+
+	// The saved statistics are rewritten without the node on the next save.
+	m.ResetNodeDataStats(nodeID)
+
+	infof("Forgot node %s", nodeID)
+}
+
+// UnforgetNode allows connections from a node previously forgotten by
+// ForgetNode again.
+func (m *Model) UnforgetNode(nodeID string) {
+	m.pmut.Lock()
+	delete(m.forgotten, nodeID)
 	m.pmut.Unlock()
 }
 
+func (m *Model) isForgotten(nodeID string) bool {
+	m.pmut.RLock()
+	defer m.pmut.RUnlock()
+	return m.forgotten[nodeID]
+}
+
 // Request returns the specified data segment by reading it from local disk.
 // Implements the protocol.Model interface.
 func (m *Model) Request(nodeID, repo, name string, offset int64, size int) ([]byte, error) {
+	name = m.names.ToLocal(name)
+
 	// Verify that the requested file exists in the local model.
 	m.rmut.RLock()
 	r, ok := m.repoFiles[repo]
+	shared := nodeID == "<local>" || m.sharedWith(repo, nodeID)
+	internal := isInternal(m.internal, name)
 	m.rmut.RUnlock()
 
 	if !ok {
 		warnf("Request from %s for file %s in nonexistent repo %q", nodeID, name, repo)
 		return nil, ErrNoSuchFile
 	}
+	if !shared {
+		warnf("Request from %s for file %s in repo %q not shared with it", nodeID, name, repo)
+		return nil, ErrNotShared
+	}
+	if internal {
+		if debugNet {
+			dlog.Printf("REQ(in; internal): %s: %q / %q", nodeID, repo, name)
+		}
+		return nil, ErrInternalPath
+	}
 
 	lf := r.Get(cid.LocalID, name)
-	if lf.Suppressed || lf.Flags&protocol.FlagDeleted != 0 {
+	if lf.Invalid || lf.Flags&protocol.FlagDeleted != 0 || m.vetoed(name) {
 		return nil, ErrInvalid
 	}
 
-	if offset > lf.Size {
+	// The requested range may span blocks, but must be within the file.
+	if offset < 0 || size < 0 || size > protocol.MaxRequestSize || offset+int64(size) > lf.Size {
 		if debugNet {
 			dlog.Printf("REQ(in; nonexistent): %s: %q o=%d s=%d", nodeID, name, offset, size)
 		}
 		return nil, ErrNoSuchFile
 	}
 
+	// The range is served from the announced blocks covering it, which are
+	// read and verified whole.
+	blocks := announcedBlocks(lf.Blocks, offset, size)
+	if blocks == nil {
+		if debugNet {
+			dlog.Printf("REQ(in; not announced): %s: %q o=%d s=%d", nodeID, name, offset, size)
+		}
+		return nil, ErrNotAnnounced
+	}
+
 	if debugNet && nodeID != "<local>" {
 		dlog.Printf("REQ(in): %s: %q / %q o=%d s=%d", nodeID, repo, name, offset, size)
 	}
 	m.rmut.RLock()
-	fn := filepath.Join(m.repoDirs[repo], name)
+	fn, err := safePath(m.repoDirs[repo], name)
 	m.rmut.RUnlock()
-	fd, err := os.Open(fn) // XXX: Inefficient, should cache fd?
+	if err != nil {
+		warnf("Security: request from %s for file %q in repo %q: %v", nodeID, name, repo, err)
+		return nil, err
+	}
+	if lf.Flags&protocol.FlagSymlink != 0 {
+		buf, err := m.symlinkTarget(repo, fn, lf, offset, size, blocks)
+		if err == nil && nodeID != "<local>" {
+			m.countNodeData(nodeID, int64(len(buf)), 0)
+		}
+		return buf, err
+	}
+	fd, err := m.fs.Open(fn) // XXX: Inefficient, should cache fd?
+	if os.IsNotExist(err) {
+		// The file may have been removed since it was scanned, or be missing
+		// only for a moment, such as while the puller moves it aside. Stop
+		// offering it and let the next scan decide, unless the whole
+		// repository has gone missing.
+		m.rmut.RLock()
+		dir := m.repoDirs[repo]
+		m.rmut.RUnlock()
+		if _, serr := m.fs.Stat(dir); serr == nil {
+			infof("%q in repository %q is missing; not serving it until rescanned", name, repo)
+			m.markChanged(repo, lf)
+		}
+		return nil, ErrNoSuchFile
+	}
 	if err != nil {
 		return nil, err
 	}
 	defer fd.Close()
+	vfs.Advise(fd, vfs.AdviceSequential)
 
-	buf := buffers.Get(int(size))
-	_, err = fd.ReadAt(buf, offset)
+	start, end := blocksRange(blocks)
+	buf := buffers.Get(int(end - start))
+	err = vfs.ReadFullAt(fd, fn, buf, start)
 	if err != nil {
+		buffers.Put(buf)
+		if ioe, ok := err.(*vfs.IOError); ok && ioe.Err == io.ErrUnexpectedEOF {
+			// The file has shrunk since it was scanned. Stop offering it
+			// until it has been rehashed.
+			infof("%q in repository %q has shrunk since it was scanned; not serving it until rehashed", name, repo)
+			m.markChanged(repo, lf)
+			return nil, ErrNoSuchFile
+		}
 		return nil, err
 	}
 
+	if err := verifyParts(buf, start, blocks); err != nil {
+		// The file has changed since it was scanned. Serving the data would
+		// give out contents never announced.
+		buffers.Put(buf)
+		infof("%q in repository %q has changed since it was scanned; not serving it until rehashed", name, repo)
+		m.markChanged(repo, lf)
+		return nil, protocol.ErrBlockChanged
+	}
+	if start != offset || int(end-start) != size {
+		part := buffers.Get(size)
+		copy(part, buf[offset-start:])
+		buffers.Put(buf)
+		buf = part
+	}
+
+	if nodeID != "<local>" {
+		m.countNodeData(nodeID, int64(len(buf)), 0)
+	}
 	return buf, nil
 }
 
+// symlinkTarget returns the range of the target of the symlink at fn, the
+// target being what is announced as the contents of a symlink.
+func (m *Model) symlinkTarget(repo, fn string, lf scanner.File, offset int64, size int, blocks []scanner.Block) ([]byte, error) {
+	target, err := m.fs.Readlink(fn)
+	if os.IsNotExist(err) {
+		return nil, ErrNoSuchFile
+	}
+	if err != nil {
+		return nil, err
+	}
+	data := []byte(target)
+	start, end := blocksRange(blocks)
+	if end > int64(len(data)) || verifyParts(data[start:end], start, blocks) != nil {
+		infof("%q in repository %q has changed since it was scanned; not serving it until rehashed", lf.Name, repo)
+		m.markChanged(repo, lf)
+		return nil, protocol.ErrBlockChanged
+	}
+	return data[offset : offset+int64(size)], nil
+}
+
+// announcedBlocks returns the blocks covering the range, which may start
+// and end anywhere within them, or nil if the blocks don't cover it.
+func announcedBlocks(blocks []scanner.Block, offset int64, size int) []scanner.Block {
+	if size == 0 && offset == 0 && len(blocks) == 1 && blocks[0].Size == 0 {
+		// The single empty block of an empty file
+		return blocks
+	}
+	i := sort.Search(len(blocks), func(i int) bool {
+		return blocks[i].Offset+int64(blocks[i].Size) > offset
+	})
+	if i == len(blocks) || blocks[i].Offset > offset {
+		return nil
+	}
+	end := offset + int64(size)
+	j := i + 1
+	for j < len(blocks) && blocks[j].Offset < end {
+		if blocks[j].Offset != blocks[j-1].Offset+int64(blocks[j-1].Size) {
+			return nil
+		}
+		j++
+	}
+	if last := blocks[j-1]; last.Offset+int64(last.Size) < end {
+		return nil
+	}
+	return blocks[i:j]
+}
+
+// blocksRange returns the start and end offsets of the consecutive blocks.
+func blocksRange(blocks []scanner.Block) (int64, int64) {
+	last := blocks[len(blocks)-1]
+	return blocks[0].Offset, last.Offset + int64(last.Size)
+}
+
 // ReplaceLocal replaces the local repository index with the given list of files.
 func (m *Model) ReplaceLocal(repo string, fs []scanner.File) {
 	m.rmut.RLock()
@@ -363,11 +1783,7 @@ func (m *Model) ReplaceLocal(repo string, fs []scanner.File) {
 }
 
 func (m *Model) SeedLocal(repo string, fs []protocol.FileInfo) {
-	var sfs = make([]scanner.File, len(fs))
-	for i := 0; i < len(fs); i++ {
-		lamport.Default.Tick(fs[i].Version)
-		sfs[i] = fileFromFileInfo(fs[i])
-	}
+	sfs := m.verifiedFiles(cid.LocalName, repo, fs, true)
 
 	m.rmut.RLock()
 	m.repoFiles[repo].Replace(cid.LocalID, sfs)
@@ -406,39 +1822,180 @@ func (m *Model) ConnectedTo(nodeID string) bool {
 	return ok
 }
 
-// AddConnection adds a new peer connection to the model. An initial index will
-// be sent to the connected peer, thereafter index updates whenever the local
-// repository changes.
-func (m *Model) AddConnection(rawConn io.Closer, protoConn protocol.Connection) {
-	nodeID := protoConn.ID()
+// SetConnectionFilter sets a function that is consulted for each new
+// connection before it is added to the model. Connections for which it
+// returns false are closed. The address is nil if it is unknown. A nil filter
+// accepts all connections.
+func (m *Model) SetConnectionFilter(filter func(nodeID string, addr net.Addr) bool) {
+	m.pmut.Lock()
+	m.connFilter = filter
+	m.pmut.Unlock()
+}
+
+var errConnReplaced = errors.New("replaced by a new connection")
+
+// A dialer is a raw connection that tells whether we dialed it, as opposed
+// to accepted it from the peer.
+type dialer interface {
+	Dialed() bool
+}
+
+// A directedConn is a network connection and whether we dialed it.
+type directedConn struct {
+	net.Conn
+	dialed bool
+}
+
+func (c directedConn) Dialed() bool {
+	return c.dialed
+}
+
+// replacesConn returns true if the new raw connection to the node is to
+// replace the existing one. When two nodes dial each other at the same time
+// both must keep the same connection, which is the one dialed by the node
+// with the lower ID. A connection dialed the same way as the existing one,
+// or by an unknown party, doesn't replace it.
+func replacesConn(nodeID string, existing, conn io.Closer) bool {
+	ed, ok := existing.(dialer)
+	if !ok {
+		return false
+	}
+	cd, ok := conn.(dialer)
+	if !ok || ed.Dialed() == cd.Dialed() {
+		return false
+	}
+	return cd.Dialed() == (myID < nodeID)
+}
+
+// AddConnection adds a new peer connection to the model. An initial index will
+// be sent to the connected peer once it has sent a matching cluster
+// configuration, thereafter index updates whenever the local repository
+// changes. Of two connections to the same node, the one dialed by the node
+// with the lower ID is kept when known; otherwise the new one is closed and
+// ignored.
+func (m *Model) AddConnection(rawConn io.Closer, protoConn protocol.Connection) {
+	nodeID := protoConn.ID()
+
+	var addr net.Addr
+	var addrInfo ConnectionInfo
+	if ra, ok := rawConn.(remoteAddrer); ok {
+		addr = ra.RemoteAddr()
+		addrInfo.setAddress(addr)
+	}
+
+	m.pmut.RLock()
+	filter := m.connFilter
+	m.pmut.RUnlock()
+	if filter != nil {
+		if !filter(nodeID, addr) {
+			infof("Connection from %s at %v rejected by filter", nodeID, addr)
+			rawConn.Close()
+			return
+		}
+	}
+
 	m.pmut.Lock()
-	if _, ok := m.protoConn[nodeID]; ok {
-		panic("add existing node")
+	for {
+		if m.forgotten[nodeID] {
+			m.pmut.Unlock()
+			infof("Connection from forgotten node %s rejected", nodeID)
+			rawConn.Close()
+			return
+		}
+		old, ok := m.protoConn[nodeID]
+		if !ok {
+			break
+		}
+		if !replacesConn(nodeID, m.rawConn[nodeID], rawConn) {
+			m.pmut.Unlock()
+			if debugNet {
+				dlog.Printf("%s: already connected; closing new connection", nodeID)
+			}
+			rawConn.Close()
+			return
+		}
+		m.pmut.Unlock()
+		if debugNet {
+			dlog.Printf("%s: already connected; replacing connection", nodeID)
+		}
+		m.close(nodeID, old, errConnReplaced)
+		m.pmut.Lock()
 	}
 	m.protoConn[nodeID] = protoConn
-	if _, ok := m.rawConn[nodeID]; ok {
-		panic("add existing node")
-	}
 	m.rawConn[nodeID] = rawConn
+	m.connAddr[nodeID] = addrInfo
+	ready := make(chan bool, 1)
+	m.nodeReady[nodeID] = ready
 	m.pmut.Unlock()
+	atomic.AddUint64(&m.sourceGen, 1)
 
 	cm := m.clusterConfig(nodeID)
 	protoConn.ClusterConfig(cm)
 
-	var idxToSend = make(map[string][]protocol.FileInfo)
+	go func() {
+		select {
+		case ok := <-ready:
+			if !ok {
+				// The connection was closed before the handshake completed.
+				return
+			}
 
-	m.rmut.RLock()
-	for _, repo := range m.nodeRepos[nodeID] {
-		idxToSend[repo] = m.protocolIndex(repo)
-	}
-	m.rmut.RUnlock()
+		case <-time.After(handshakeTimeout):
+			m.pmut.RLock()
+			pending := m.nodeReady[nodeID] == ready
+			m.pmut.RUnlock()
+			if pending {
+				m.Close(nodeID, ErrHandshakeTimeout)
+			}
+			return
+		}
+
+		m.pmut.Lock()
+		rate := m.indexRate[nodeID]
+		if rate > 0 {
+			m.idxSending[nodeID] = true
+		}
+		m.pmut.Unlock()
+
+		var idxToSend = make(map[string][]protocol.FileInfo)
+		var rootToSend = make(map[string][]byte)
+
+		m.rmut.RLock()
+		for _, repo := range m.nodeRepos[nodeID] {
+			idxToSend[repo] = m.protocolIndex(repo)
+			rootToSend[repo] = m.repoFiles[repo].Root(cid.LocalID)
+		}
+		m.rmut.RUnlock()
 
-	go func() {
 		for repo, idx := range idxToSend {
 			if debugNet {
 				dlog.Printf("IDX(out/initial): %s: %q: %d files", nodeID, repo, len(idx))
 			}
-			protoConn.Index(repo, idx)
+			if rate > 0 {
+				m.sendIndexLimited(protoConn, repo, idx, rate)
+			} else {
+				protoConn.Index(repo, idx)
+				protoConn.Root(repo, rootToSend[repo])
+			}
+		}
+
+		if rate > 0 {
+			m.pmut.Lock()
+			delete(m.idxSending, nodeID)
+			m.pmut.Unlock()
+
+			// Send what changed while the index was being sent, which the
+			// broadcasts held back.
+			m.rmut.RLock()
+			for repo := range idxToSend {
+				idxToSend[repo] = m.protocolIndex(repo)
+				rootToSend[repo] = m.repoFiles[repo].Root(cid.LocalID)
+			}
+			m.rmut.RUnlock()
+			for repo, idx := range idxToSend {
+				protoConn.Index(repo, idx)
+				protoConn.Root(repo, rootToSend[repo])
+			}
 		}
 	}()
 }
@@ -450,6 +2007,10 @@ func (m *Model) protocolIndex(repo string) []protocol.FileInfo {
 	fs := m.repoFiles[repo].Have(cid.LocalID)
 
 	for _, f := range fs {
+		if isInternal(m.internal, f.Name) {
+			continue
+		}
+		f.Name = m.names.ToWire(f.Name)
 		mf := fileInfoFromFile(f)
 		if debugIdx {
 			var flagComment string
@@ -464,13 +2025,128 @@ func (m *Model) protocolIndex(repo string) []protocol.FileInfo {
 	return index
 }
 
+// markChanged marks the local file as changed since it was last scanned, so
+// that it is announced as invalid until the next scan rehashes it. Nothing is
+// done if the entry has been updated since f was read from the index.
+func (m *Model) markChanged(repo string, f scanner.File) {
+	m.rmut.Lock()
+	rf := m.repoFiles[repo]
+	if cur := rf.Get(cid.LocalID, f.Name); cur.Version != f.Version || cur.Invalid {
+		m.rmut.Unlock()
+		return
+	}
+	f.Invalid = true
+	f.InvalidReason = protocol.InvalidReasonChanged
+	f.Version = lamport.Default.Tick(f.Version)
+	rf.Update(cid.LocalID, []scanner.File{f})
+	m.updates.update(repo, f.Name)
+	m.rmut.Unlock()
+	m.clearFileError(repo, f.Name)
+}
+
+// replaceScanned replaces the local index with the results of a scan and
+// returns the files changed by it. Files updated by other means since the
+// scan was started keep their current entries; the scan may have seen them
+// before the update.
+func (m *Model) replaceScanned(repo string, fs []scanner.File, since uint64) []scanner.File {
+	// Updates take the read lock, so none can happen in between.
+	m.rmut.Lock()
+	defer m.rmut.Unlock()
+	rf := m.repoFiles[repo]
+	if updated := m.updates.scanDone(repo, since); len(updated) > 0 {
+		for i, f := range fs {
+			if updated[f.Name] {
+				fs[i] = rf.Get(cid.LocalID, f.Name)
+				delete(updated, f.Name)
+			}
+		}
+		// Files the scan didn't see at all
+		for name := range updated {
+			if f := rf.Get(cid.LocalID, name); f.Name == name {
+				fs = append(fs, f)
+			}
+		}
+	}
+	seq := rf.LocalVersion()
+	rf.ReplaceWithDelete(cid.LocalID, fs)
+	changed, _ := rf.ChangedSince(seq)
+
+	// Files awaiting a source may have turned up locally, or no longer be
+	// needed at all.
+	for name, fe := range m.fileErrs[repo] {
+		if !fe.AwaitingSource {
+			continue
+		}
+		if g := rf.GetGlobal(name); g.Version == fe.Version && rf.Get(cid.LocalID, name).Version != g.Version {
+			continue
+		}
+		if fe.Failures == 0 {
+			delete(m.fileErrs[repo], name)
+		} else {
+			fe.AwaitingSource = false
+		}
+	}
+	return changed
+}
+
 func (m *Model) updateLocal(repo string, f scanner.File) {
 	m.rmut.RLock()
 	m.repoFiles[repo].Update(cid.LocalID, []scanner.File{f})
+	m.updates.update(repo, f.Name)
+	m.rmut.RUnlock()
+	m.clearFileError(repo, f.Name)
+}
+
+// maxRequestSize returns the largest request accepted by all nodes that can
+// serve the file.
+func (m *Model) maxRequestSize(repo, name string) int {
+	m.rmut.RLock()
+	availability := uint64(m.repoFiles[repo].Availability(name))
+	m.rmut.RUnlock()
+
+	size := protocol.MaxRequestSize
+	m.pmut.RLock()
+	for _, node := range m.cm.Names() {
+		id := m.cm.Get(node)
+		if id == cid.LocalID || availability&(1<<id) == 0 {
+			continue
+		}
+		if s, ok := m.maxRequest[node]; !ok {
+			size = protocol.BlockSize
+		} else if s < size {
+			size = s
+		}
+	}
+	m.pmut.RUnlock()
+	return size
+}
+
+// maxBatchBlocks returns the most blocks accepted in a batch request by all
+// nodes that can serve the file, zero if any of them doesn't accept batch
+// requests.
+func (m *Model) maxBatchBlocks(repo, name string) int {
+	m.rmut.RLock()
+	availability := uint64(m.repoFiles[repo].Availability(name))
 	m.rmut.RUnlock()
+
+	n := protocol.MaxBatchBlocks
+	m.pmut.RLock()
+	for _, node := range m.cm.Names() {
+		id := m.cm.Get(node)
+		if id == cid.LocalID || availability&(1<<id) == 0 {
+			continue
+		}
+		if b := m.maxBatch[node]; b < n {
+			n = b
+		}
+	}
+	m.pmut.RUnlock()
+	return n
 }
 
-func (m *Model) requestGlobal(nodeID, repo, name string, offset int64, size int, hash []byte) ([]byte, error) {
+// requestGlobal requests a block of the file from the node. A non-nil cancel
+// channel abandons the request when closed, returning errPullCanceled.
+func (m *Model) requestGlobal(nodeID, repo, name string, offset int64, size int, hash []byte, cancel <-chan struct{}) ([]byte, error) {
 	m.pmut.RLock()
 	nc, ok := m.protoConn[nodeID]
 	m.pmut.RUnlock()
@@ -483,49 +2159,217 @@ func (m *Model) requestGlobal(nodeID, repo, name string, offset int64, size int,
 		dlog.Printf("REQ(out): %s: %q / %q o=%d s=%d h=%x", nodeID, repo, name, offset, size, hash)
 	}
 
-	return nc.Request(repo, name, offset, size)
+	request := func() ([]byte, error) {
+		data, err := nc.Request(repo, m.names.ToWire(name), offset, size)
+		if err == nil {
+			m.countNodeData(nodeID, 0, int64(len(data)))
+		}
+		return data, err
+	}
+	if cancel == nil {
+		return request()
+	}
+
+	type result struct {
+		data []byte
+		err  error
+	}
+	done := make(chan result, 1)
+	go func() {
+		data, err := request()
+		done <- result{data, err}
+	}()
+
+	select {
+	case r := <-done:
+		return r.data, r.err
+	case <-cancel:
+		// The request is left to finish on its own.
+		return nil, errPullCanceled
+	}
+}
+
+// requestBatch requests the blocks of the file from the node in one batch,
+// returning the result for each. A non-nil cancel channel abandons the
+// request when closed, failing every block with errPullCanceled.
+func (m *Model) requestBatch(nodeID, repo, name string, blocks []scanner.Block, cancel <-chan struct{}) []protocol.BlockResult {
+	m.pmut.RLock()
+	nc, ok := m.protoConn[nodeID]
+	m.pmut.RUnlock()
+
+	if !ok {
+		return batchError(len(blocks), fmt.Errorf("requestBatch: no such node: %s", nodeID))
+	}
+
+	if debugNet {
+		dlog.Printf("REQ(out): %s: %q / %q o=%d n=%d", nodeID, repo, name, blocks[0].Offset, len(blocks))
+	}
+
+	reqs := make([]protocol.RequestBlock, len(blocks))
+	for i, b := range blocks {
+		reqs[i] = protocol.RequestBlock{Offset: uint64(b.Offset), Size: b.Size, Hash: b.Hash}
+	}
+	request := func() []protocol.BlockResult {
+		res := nc.RequestBatch(repo, m.names.ToWire(name), reqs)
+		var bytes int64
+		for _, r := range res {
+			if r.Err == nil {
+				bytes += int64(len(r.Data))
+			}
+		}
+		m.countNodeData(nodeID, 0, bytes)
+		return res
+	}
+	if cancel == nil {
+		return request()
+	}
+
+	done := make(chan []protocol.BlockResult, 1)
+	go func() {
+		done <- request()
+	}()
+
+	select {
+	case res := <-done:
+		return res
+	case <-cancel:
+		// The request is left to finish on its own.
+		return batchError(len(blocks), errPullCanceled)
+	}
+}
+
+func batchError(n int, err error) []protocol.BlockResult {
+	res := make([]protocol.BlockResult, n)
+	for i := range res {
+		res[i].Err = err
+	}
+	return res
+}
+
+const (
+	// How often to check for local changes to broadcast.
+	idxBcastInterval = 5 * time.Second
+
+	// The longest time an index broadcast is held back while the puller is
+	// busy.
+	idxBcastHoldBusy = 120 * time.Second
+
+	// The puller is considered busy at or above these levels of activity.
+	busyBytesPerSecond = 256 * 1024
+	busyOpenFiles      = 8
+)
+
+type pullActivity struct {
+	bytesPerSecond int64
+	openFiles      int
+}
+
+// shouldBroadcast returns true if a local index change that has been pending
+// for the given time should be broadcast now. While the puller is busy,
+// broadcasts are held back since they compete for bandwidth with the block
+// transfers; once it quiets down, pending changes are sent immediately.
+func shouldBroadcast(pending time.Duration, a pullActivity) bool {
+	if a.bytesPerSecond >= busyBytesPerSecond || a.openFiles >= busyOpenFiles {
+		return pending >= idxBcastHoldBusy
+	}
+	return true
+}
+
+// broadcastState is what the index broadcast loop remembers between rounds.
+type broadcastState struct {
+	lastChange   map[string]uint64    // repo -> local changes counter at last broadcast
+	lastPulled   map[string]int64     // repo -> bytes pulled at last round
+	pendingSince map[string]time.Time // repo -> first round a change was held back
+	lastTick     time.Time
+}
+
+func newBroadcastState(now time.Time) *broadcastState {
+	return &broadcastState{
+		lastChange:   make(map[string]uint64),
+		lastPulled:   make(map[string]int64),
+		pendingSince: make(map[string]time.Time),
+		lastTick:     now,
+	}
 }
 
 func (m *Model) broadcastIndexLoop() {
-	var lastChange = map[string]uint64{}
+	b := newBroadcastState(m.clock.Now())
 	for {
-		time.Sleep(5 * time.Second)
+		time.Sleep(idxBcastInterval)
+		m.broadcastIndexes(b, m.clock.Now())
+	}
+}
 
-		m.pmut.RLock()
-		m.rmut.RLock()
+// broadcastIndexes sends the local index of each repository that has
+// changed since the last broadcast to the connected nodes, unless it is held
+// back while pulling is busy.
+func (m *Model) broadcastIndexes(b *broadcastState, now time.Time) {
+	secs := int64(now.Sub(b.lastTick) / time.Second)
+	if secs <= 0 {
+		secs = 1
+	}
+	b.lastTick = now
 
-		for repo, fs := range m.repoFiles {
-			c := fs.Changes(cid.LocalID)
-			if c == lastChange[repo] {
-				continue
-			}
-			lastChange[repo] = c
+	m.pmut.RLock()
+	m.rmut.RLock()
+	defer m.rmut.RUnlock()
+	defer m.pmut.RUnlock()
 
-			idx := m.protocolIndex(repo)
-			m.saveIndex(repo, confDir, idx)
+	for repo, fs := range m.repoFiles {
+		stats := m.repoStats[repo].snapshot()
+		activity := pullActivity{
+			bytesPerSecond: (stats.BytesPulled - b.lastPulled[repo]) / secs,
+			openFiles:      int(stats.OpenFiles),
+		}
+		b.lastPulled[repo] = stats.BytesPulled
 
-			var indexWg sync.WaitGroup
-			for _, nodeID := range m.repoNodes[repo] {
-				if conn, ok := m.protoConn[nodeID]; ok {
-					indexWg.Add(1)
-					if debugNet {
-						dlog.Printf("IDX(out/loop): %s: %d files", nodeID, len(idx))
-					}
-					go func() {
-						conn.Index(repo, idx)
-						indexWg.Done()
-					}()
+		c := fs.Changes(cid.LocalID)
+		if c == b.lastChange[repo] {
+			continue
+		}
+		if b.pendingSince[repo].IsZero() {
+			b.pendingSince[repo] = now
+		}
+		if !shouldBroadcast(now.Sub(b.pendingSince[repo]), activity) {
+			if debugNet {
+				dlog.Printf("IDX(out/loop): %q: holding back broadcast; %d B/s, %d open files", repo, activity.bytesPerSecond, activity.openFiles)
+			}
+			continue
+		}
+		b.lastChange[repo] = c
+		delete(b.pendingSince, repo)
+
+		idx := m.protocolIndex(repo)
+		root := fs.Root(cid.LocalID)
+		m.saveIndex(repo, confDir, idx)
+
+		var indexWg sync.WaitGroup
+		for _, nodeID := range m.repoNodes[repo] {
+			if _, pending := m.nodeReady[nodeID]; pending || m.idxSending[nodeID] {
+				// The initial index is sent once the handshake completes,
+				// and includes any changes made while it is sent.
+				continue
+			}
+			if conn, ok := m.protoConn[nodeID]; ok {
+				indexWg.Add(1)
+				if debugNet {
+					dlog.Printf("IDX(out/loop): %s: %d files", nodeID, len(idx))
 				}
+				go func() {
+					conn.Index(repo, idx)
+					conn.Root(repo, root)
+					indexWg.Done()
+				}()
 			}
-
-			indexWg.Wait()
 		}
 
-		m.rmut.RUnlock()
-		m.pmut.RUnlock()
+		indexWg.Wait()
 	}
 }
 
+// AddRepo adds a repository shared with the given nodes. If the directory
+// is reached through symlinks it is resolved once here, so that the names
+// of the files in it are relative to the same path however they are found.
 func (m *Model) AddRepo(id, dir string, nodes []NodeConfiguration) {
 	if m.started {
 		panic("cannot add repo to started model")
@@ -534,9 +2378,20 @@ func (m *Model) AddRepo(id, dir string, nodes []NodeConfiguration) {
 		panic("cannot add empty repo id")
 	}
 
+	// A directory that doesn't exist yet is used as is, and fails the
+	// checks on scanning.
+	if rd, err := vfs.EvalSymlinks(m.fs, dir); err == nil {
+		dir = rd
+	}
+
 	m.rmut.Lock()
 	m.repoDirs[id] = dir
 	m.repoFiles[id] = files.NewSet()
+	m.setAnnounced(m.repoFiles[id])
+	m.repoStats[id] = &PullStats{}
+	m.fileErrs[id] = make(map[string]*FileError)
+	m.invalid[id] = make(map[string]*invalidFile)
+	m.deleted[id] = make(map[string]time.Time)
 
 	m.repoNodes[id] = make([]string, len(nodes))
 	for i, node := range nodes {
@@ -562,8 +2417,28 @@ func (m *Model) ScanRepos() {
 }
 
 func (m *Model) ScanRepo(repo string) error {
-	sup := &suppressor{threshold: int64(cfg.Options.MaxChangeKbps)}
+	return m.scanRepo(repo, nil)
+}
+
+// ForceRehash rescans the repository, rehashing the files at or below the
+// given path even if their modification time is unchanged. This picks up
+// changes made in place by tools that preserve the modification time. An
+// empty path rehashes the entire repository. Files whose contents are
+// unchanged keep their current version.
+func (m *Model) ForceRehash(repo, prefix string) error {
+	prefix = filepath.Clean(prefix)
+	if prefix == "." {
+		return m.scanRepo(repo, func(string) bool { return true })
+	}
+	return m.scanRepo(repo, func(name string) bool {
+		return name == prefix || strings.HasPrefix(name, prefix+string(os.PathSeparator))
+	})
+}
+
+func (m *Model) scanRepo(repo string, rehash func(name string) bool) error {
+	sup := &suppressor{threshold: int64(cfg.Options.MaxChangeKbps), clock: m.clock}
 	m.rmut.RLock()
+	mounts, deviceID := m.mountPolicies(repo)
 	w := &scanner.Walker{
 		Dir:          m.repoDirs[repo],
 		IgnoreFile:   ".stignore",
@@ -571,18 +2446,169 @@ func (m *Model) ScanRepo(repo string) error {
 		TempNamer:    defTempNamer,
 		Suppressor:   sup,
 		CurrentFiler: cFiler{m, repo},
+		ForceRehash:  rehash,
+		CheckSize:    m.sizeCheck,
+		ReadLimit:    m.diskRead,
+		FS:           m.fs,
+		Symlinks:     m.symlinks,
+		Mounts:       mounts,
+		DeviceID:     deviceID,
+
+		GuardPlaceholders: m.phGuard,
+		IsPlaceholder:     m.phDetect,
+		CreateTimes:       m.ctimes,
+		NameFilter:        m.nameFilt,
+		ContentFilter:     m.dataFilt,
+		ContentFilterSize: m.dataSize,
+		SkipPaths:         m.internal,
+		LimitDepth:        m.scanDepth >= 0,
+		MaxDepth:          m.scanDepth,
+		SettleTime:        m.settle,
+		IgnorePerms:       m.noPerms,
 	}
 	m.rmut.RUnlock()
 	m.setState(repo, RepoScanning)
+	since := m.updates.scanStarted(repo)
 	fs, _, err := w.Walk()
 	if err != nil {
+		m.updates.scanDone(repo, since)
 		return err
 	}
-	m.ReplaceLocal(repo, fs)
+	for _, name := range w.Placeholders() {
+		warnf("%q in repository %q looks like a placeholder for contents not present locally; other nodes keep their copies", name, repo)
+		events.Default.Log(events.PlaceholderDetected, map[string]interface{}{
+			"repo": repo,
+			"file": name,
+		})
+	}
+	fs = append(fs, m.setUnmounted(repo, w.Unavailable())...)
+	fs = append(fs, m.tooDeep(repo, w.TooDeep())...)
+	changed := m.replaceScanned(repo, fs, since)
+	m.localChanged(repo, changed)
+	for _, f := range changed {
+		m.fileEvent(events.LocalFileChanged, repo, f)
+	}
+	m.checkInvalid(repo, m.clock.Now())
+	m.expireDeleted(repo, time.Now())
 	m.setState(repo, RepoIdle)
 	return nil
 }
 
+// The number of files to stat in parallel when reconciling.
+const reconcileWorkers = 16
+
+// ReconcileRepos brings the cached indexes of all repositories in line with
+// the files on disk, as far as can be told without hashing. See
+// ReconcileLocal.
+func (m *Model) ReconcileRepos() {
+	m.rmut.RLock()
+	var repos = make([]string, 0, len(m.repoDirs))
+	for repo := range m.repoDirs {
+		repos = append(repos, repo)
+	}
+	m.rmut.RUnlock()
+
+	for _, repo := range repos {
+		m.ReconcileLocal(repo)
+	}
+}
+
+// ReconcileLocal stats every file in the local index of the repository.
+// Files that no longer exist are marked deleted and files whose size or
+// modification time differ from the index are marked invalid until the next
+// scan has rehashed them. This is much faster than a scan and keeps an index
+// loaded from cache from announcing files we can no longer serve. Nothing is
+// changed if the repository directory itself is missing, and files below
+// guarded mount points that are not mounted are marked unavailable, as a
+// scan would.
+func (m *Model) ReconcileLocal(repo string) {
+	m.rmut.RLock()
+	dir := m.repoDirs[repo]
+	rf, ok := m.repoFiles[repo]
+	mounts, deviceID := m.mountPolicies(repo)
+	m.rmut.RUnlock()
+	if !ok {
+		return
+	}
+	if fi, err := m.fs.Stat(dir); err != nil || !fi.IsDir() {
+		return
+	}
+
+	w := &scanner.Walker{Dir: dir, FS: m.fs, Mounts: mounts, DeviceID: deviceID}
+	unmounted := w.UnmountedPaths()
+
+	var work = make(chan scanner.File)
+	var results = make(chan scanner.File)
+	var wg sync.WaitGroup
+	for i := 0; i < reconcileWorkers; i++ {
+		wg.Add(1)
+		go func() {
+			for f := range work {
+				if cf, changed := m.reconcileFile(dir, f); changed {
+					results <- cf
+				}
+			}
+			wg.Done()
+		}()
+	}
+
+	go func() {
+		for _, f := range rf.Have(cid.LocalID) {
+			if f.Flags&protocol.FlagDeleted == 0 && !f.Invalid && !below(f.Name, unmounted) {
+				work <- f
+			}
+		}
+		close(work)
+		wg.Wait()
+		close(results)
+	}()
+
+	var changed []scanner.File
+	for f := range results {
+		changed = append(changed, f)
+	}
+	changed = append(changed, m.setUnmounted(repo, unmounted)...)
+
+	if len(changed) > 0 {
+		infof("Reconciled index for repository %q; %d files changed since last run", repo, len(changed))
+		rf.Update(cid.LocalID, changed)
+	}
+}
+
+// reconcileFile returns the updated file and true if f doesn't match what is
+// on disk.
+func (m *Model) reconcileFile(dir string, f scanner.File) (scanner.File, bool) {
+	fi, err := m.fs.Lstat(filepath.Join(dir, f.Name))
+	switch {
+	case os.IsNotExist(err):
+		if debugIdx {
+			dlog.Printf("reconcile: %q: deleted", f.Name)
+		}
+		f.Flags |= protocol.FlagDeleted
+		f.Blocks = nil
+		f.Size = 0
+		f.Version = lamport.Default.Tick(f.Version)
+		return f, true
+
+	case err != nil:
+		// The scan will have to sort it out.
+		return f, false
+
+	case f.Flags&protocol.FlagDirectory != 0:
+		return f, false
+
+	case fi.Size() != f.Size || fi.ModTime().Unix() != f.Modified:
+		if debugIdx {
+			dlog.Printf("reconcile: %q: changed", f.Name)
+		}
+		f.Invalid = true
+		f.InvalidReason = protocol.InvalidReasonChanged
+		f.Version = lamport.Default.Tick(f.Version)
+		return f, true
+	}
+	return f, false
+}
+
 func (m *Model) SaveIndexes(dir string) {
 	m.rmut.RLock()
 	for repo := range m.repoDirs {
@@ -593,17 +2619,53 @@ func (m *Model) SaveIndexes(dir string) {
 }
 
 func (m *Model) LoadIndexes(dir string) {
+	deleted := make(map[string]map[string]time.Time)
 	m.rmut.RLock()
 	for repo := range m.repoDirs {
 		fs := m.loadIndex(repo, dir)
 		m.SeedLocal(repo, fs)
+		if since := m.loadLocalVersions(repo, dir); since != nil {
+			deleted[repo] = since
+		}
+	}
+	m.rmut.RUnlock()
+
+	m.rmut.Lock()
+	for repo, since := range deleted {
+		m.deleted[repo] = since
 	}
+	m.rmut.Unlock()
+}
+
+// ChangedSince returns the files in the local repository index that have
+// changed since the given local version, in the order they changed, and
+// the current local version. Every change to a local file, deletes
+// included, gives it a new, higher local version.
+func (m *Model) ChangedSince(repo string, seq int64) ([]scanner.File, int64) {
+	m.rmut.RLock()
+	rf, ok := m.repoFiles[repo]
 	m.rmut.RUnlock()
+	if !ok {
+		return nil, 0
+	}
+	return rf.ChangedSince(seq)
+}
+
+// indexCaches are the suffixes of the index cache file names, newest first,
+// and the index message version each is written in. The older ones are read
+// when upgrading and removed once the index is saved in the newest format.
+var indexCaches = []struct {
+	suffix  string
+	version int
+}{
+	{".v2.idx.gz", 2},
+	{".v1.idx.gz", 1},
+	{".idx.gz", 0},
 }
 
 func (m *Model) saveIndex(repo string, dir string, fs []protocol.FileInfo) {
 	id := fmt.Sprintf("%x", sha1.Sum([]byte(m.repoDirs[repo])))
-	name := id + ".idx.gz"
+	name := id + indexCaches[0].suffix
 	name = filepath.Join(dir, name)
 
 	idxf, err := os.Create(name + ".tmp")
@@ -613,40 +2675,124 @@ func (m *Model) saveIndex(repo string, dir string, fs []protocol.FileInfo) {
 
 	gzw := gzip.NewWriter(idxf)
 
-	protocol.IndexMessage{
+	protocol.EncodeIndex(gzw, protocol.IndexMessage{
 		Repository: repo,
 		Files:      fs,
-	}.EncodeXDR(gzw)
+	}, indexCaches[0].version)
 	gzw.Close()
 	idxf.Close()
 
+	if Rename(name+".tmp", name) == nil {
+		for _, c := range indexCaches[1:] {
+			os.Remove(filepath.Join(dir, id+c.suffix))
+		}
+	}
+	m.saveLocalVersions(repo, dir)
+}
+
+// The local versions of the files in a repository, and the times its
+// tombstones became known, saved next to its index.
+type savedLocalVersions struct {
+	LocalVersion int64
+	Files        map[string]int64
+	DeletedSince map[string]time.Time
+}
+
+func (m *Model) saveLocalVersions(repo string, dir string) {
+	id := fmt.Sprintf("%x", sha1.Sum([]byte(m.repoDirs[repo])))
+	name := filepath.Join(dir, id+".v1.seq.gz")
+
+	fd, err := os.Create(name + ".tmp")
+	if err != nil {
+		return
+	}
+
+	var saved savedLocalVersions
+	saved.Files, saved.LocalVersion = m.repoFiles[repo].LocalVersions()
+	saved.DeletedSince = m.deleted[repo]
+	gzw := gzip.NewWriter(fd)
+	err = json.NewEncoder(gzw).Encode(saved)
+	if cerr := gzw.Close(); err == nil {
+		err = cerr
+	}
+	if cerr := fd.Close(); err == nil {
+		err = cerr
+	}
+	if err != nil {
+		os.Remove(name + ".tmp")
+		return
+	}
+
 	Rename(name+".tmp", name)
 }
 
+// loadLocalVersions restores the local versions saved along with the index
+// of the repository. Without them, the files get new local versions. Returns
+// the saved times the tombstones became known, if any.
+func (m *Model) loadLocalVersions(repo string, dir string) map[string]time.Time {
+	id := fmt.Sprintf("%x", sha1.Sum([]byte(m.repoDirs[repo])))
+	name := filepath.Join(dir, id+".v1.seq.gz")
+
+	fd, err := os.Open(name)
+	if err != nil {
+		return nil
+	}
+	defer fd.Close()
+
+	gzr, err := gzip.NewReader(fd)
+	if err != nil {
+		return nil
+	}
+	defer gzr.Close()
+
+	var saved savedLocalVersions
+	if err := json.NewDecoder(gzr).Decode(&saved); err != nil {
+		return nil
+	}
+	m.repoFiles[repo].SetLocalVersions(saved.Files, saved.LocalVersion)
+	return saved.DeletedSince
+}
+
+// loadIndex returns the cached index of the repository, read from the newest
+// index cache file there is.
 func (m *Model) loadIndex(repo string, dir string) []protocol.FileInfo {
 	id := fmt.Sprintf("%x", sha1.Sum([]byte(m.repoDirs[repo])))
-	name := id + ".idx.gz"
-	name = filepath.Join(dir, name)
+	for _, c := range indexCaches {
+		name := filepath.Join(dir, id+c.suffix)
+		files, err := loadIndexFile(name, repo, c.version)
+		if err == nil {
+			return files
+		}
+		if !os.IsNotExist(err) {
+			// Fall back to an older cache, if there is one left.
+			warnf("Loading index cache %s: %v", name, err)
+		}
+	}
+	return nil
+}
 
+func loadIndexFile(name, repo string, version int) ([]protocol.FileInfo, error) {
 	idxf, err := os.Open(name)
 	if err != nil {
-		return nil
+		return nil, err
 	}
 	defer idxf.Close()
 
 	gzr, err := gzip.NewReader(idxf)
 	if err != nil {
-		return nil
+		return nil, err
 	}
 	defer gzr.Close()
 
-	var im protocol.IndexMessage
-	err = im.DecodeXDR(gzr)
-	if err != nil || im.Repository != repo {
-		return nil
+	im, err := protocol.DecodeIndex(gzr, version)
+	if err != nil {
+		return nil, err
+	}
+	if im.Repository != repo {
+		return nil, fmt.Errorf("index is for repository %q", im.Repository)
 	}
 
-	return im.Files
+	return im.Files, nil
 }
 
 // clusterConfig returns a ClusterConfigMessage that is correct for the given peer node
@@ -2,14 +2,29 @@ package main
 
 import (
 	"bytes"
+	"compress/gzip"
+	"crypto/sha1"
+	"errors"
 	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
 	"os"
+	"path/filepath"
+	"reflect"
+	"sort"
+	"sync/atomic"
 	"testing"
 	"time"
 
+	"code.google.com/p/go.text/unicode/norm"
 	"github.com/calmh/syncthing/cid"
+	"github.com/calmh/syncthing/events"
+	"github.com/calmh/syncthing/files"
+	"github.com/calmh/syncthing/lamport"
 	"github.com/calmh/syncthing/protocol"
 	"github.com/calmh/syncthing/scanner"
+	"github.com/calmh/syncthing/testutil"
 )
 
 var testDataExpected = map[string]scanner.File{
@@ -48,7 +63,7 @@ func init() {
 
 func TestRequest(t *testing.T) {
 	m := NewModel(1e6)
-	m.AddRepo("default", "testdata", nil)
+	m.AddRepo("default", "testdata", []NodeConfiguration{{NodeID: "some node"}})
 	m.ScanRepo("default")
 
 	bs, err := m.Request("some node", "default", "foo", 0, 6)
@@ -66,6 +81,193 @@ func TestRequest(t *testing.T) {
 	if bs != nil {
 		t.Errorf("Unexpected non nil data on insecure file read: %q", string(bs))
 	}
+
+	// Names that escape the repository are refused even when they are in
+	// the index.
+	for _, name := range []string{filepath.Join("..", "walk.go"), filepath.Join(string(os.PathSeparator), "etc", "passwd")} {
+		m.updateLocal("default", scanner.File{Name: name, Flags: 0644, Version: 1000, Size: 6, Blocks: []scanner.Block{{Size: 6}}})
+		bs, err = m.Request("some node", "default", name, 0, 6)
+		if err != ErrUnsafePath {
+			t.Errorf("Incorrect error %v for insecure read of %q", err, name)
+		}
+		if bs != nil {
+			t.Errorf("Unexpected non nil data on insecure read of %q: %q", name, string(bs))
+		}
+	}
+}
+
+// Ranges are served from the blocks in the local index covering them, and
+// only while the data still matches their hashes.
+func TestRequestAnnounced(t *testing.T) {
+	data := make([]byte, 2*BlockSize)
+	for i := range data {
+		data[i] = byte(i % 251)
+	}
+	dir := filepath.Join(string(os.PathSeparator), "repo")
+	fn := filepath.Join(dir, "file")
+	fs := testutil.NewFakeFS()
+	fs.MkdirAll(dir, 0755)
+	fs.WriteFile(fn, data, 0644)
+
+	m := NewModel(1e6)
+	m.SetFilesystem(fs)
+	m.AddRepo("default", dir, []NodeConfiguration{{NodeID: "some node"}})
+	m.ScanRepo("default")
+
+	ranges := []struct {
+		offset int64
+		size   int
+	}{
+		{BlockSize, BlockSize},
+		{1, BlockSize},
+		{BlockSize - 100, 200},
+		{0, BlockSize - 1},
+		{0, BlockSize + 1},
+	}
+	for _, r := range ranges {
+		bs, err := m.Request("some node", "default", "file", r.offset, r.size)
+		if err != nil {
+			t.Errorf("Request o=%d s=%d: %v", r.offset, r.size, err)
+		} else if !bytes.Equal(bs, data[r.offset:r.offset+int64(r.size)]) {
+			t.Errorf("Request o=%d s=%d: incorrect data", r.offset, r.size)
+		}
+	}
+
+	// A range the index has no blocks for isn't served.
+	m.updateLocal("default", scanner.File{Name: "file", Flags: 0644, Version: 1000, Size: int64(len(data))})
+	if _, err := m.Request("some node", "default", "file", 0, 100); err != ErrNotAnnounced {
+		t.Errorf("Request without blocks: %v, expected %v", err, ErrNotAnnounced)
+	}
+	m.ScanRepo("default")
+
+	// The file is modified without being rescanned; the announced hash of
+	// the first block is stale, also for a range covering part of it.
+	data[0] ^= 0xff
+	fs.WriteFile(fn, data, 0644)
+	if _, err := m.Request("some node", "default", "file", 100, 200); err != protocol.ErrBlockChanged {
+		t.Errorf("Request for stale block: %v, expected %v", err, protocol.ErrBlockChanged)
+	}
+}
+
+func TestRequestSpanningBlocks(t *testing.T) {
+	data := make([]byte, 2*BlockSize+1000)
+	for i := range data {
+		data[i] = byte(i % 251)
+	}
+	dir := filepath.Join(string(os.PathSeparator), "repo")
+	fs := testutil.NewFakeFS()
+	fs.MkdirAll(dir, 0755)
+	fs.WriteFile(filepath.Join(dir, "file"), data, 0644)
+
+	m := NewModel(1e6)
+	m.SetFilesystem(fs)
+	m.AddRepo("default", dir, []NodeConfiguration{{NodeID: "some node"}})
+	m.ScanRepo("default")
+
+	// Starts in the middle of the first block and ends in the second.
+	offset, size := int64(BlockSize-100), 300
+	bs, err := m.Request("some node", "default", "file", offset, size)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(bs, data[offset:offset+int64(size)]) {
+		t.Error("Incorrect data from request spanning blocks")
+	}
+
+	// Three blocks' worth is larger than allowed in one request.
+	if _, err := m.Request("some node", "default", "file", 0, 3*BlockSize); err == nil {
+		t.Error("Unexpected nil error on too large request")
+	}
+	// Past the end of the file.
+	if _, err := m.Request("some node", "default", "file", int64(len(data)-100), 200); err == nil {
+		t.Error("Unexpected nil error on request past end of file")
+	}
+}
+
+func TestRequestShrunkFile(t *testing.T) {
+	data := make([]byte, 2*BlockSize)
+	dir := filepath.Join(string(os.PathSeparator), "repo")
+	fs := testutil.NewFakeFS()
+	fs.MkdirAll(dir, 0755)
+	fs.WriteFile(filepath.Join(dir, "file"), data, 0644)
+
+	m := NewModel(1e6)
+	m.SetFilesystem(fs)
+	m.AddRepo("default", dir, []NodeConfiguration{{NodeID: "some node"}})
+	m.ScanRepo("default")
+	v := m.CurrentRepoFile("default", "file").Version
+
+	// Truncated behind our back.
+	fs.WriteFile(filepath.Join(dir, "file"), data[:BlockSize+100], 0644)
+
+	if _, err := m.Request("some node", "default", "file", BlockSize, BlockSize); err != ErrNoSuchFile {
+		t.Errorf("Incorrect error %v for request past the new end of file", err)
+	}
+	f := m.CurrentRepoFile("default", "file")
+	if !f.Invalid || f.InvalidReason != protocol.InvalidReasonChanged || f.Version <= v {
+		t.Errorf("File not marked changed; %v", f)
+	}
+	if _, err := m.Request("some node", "default", "file", 0, 100); err != ErrInvalid {
+		t.Errorf("Incorrect error %v for request of changed file", err)
+	}
+}
+
+func TestRequestRemovedFile(t *testing.T) {
+	dir := filepath.Join(string(os.PathSeparator), "repo")
+	fs := testutil.NewFakeFS()
+	fs.MkdirAll(dir, 0755)
+	fs.WriteFile(filepath.Join(dir, "file"), []byte("data"), 0644)
+	fs.WriteFile(filepath.Join(dir, "other"), []byte("data"), 0644)
+
+	m := NewModel(1e6)
+	m.SetFilesystem(fs)
+	m.AddRepo("default", dir, []NodeConfiguration{{NodeID: "some node"}})
+	m.ScanRepo("default")
+	v := m.CurrentRepoFile("default", "file").Version
+	_, seq := m.ChangedSince("default", 0)
+
+	// Removed behind our back.
+	fs.Remove(filepath.Join(dir, "file"))
+
+	if _, err := m.Request("some node", "default", "file", 0, 4); err != ErrNoSuchFile {
+		t.Errorf("Incorrect error %v for request of removed file", err)
+	}
+	// The file is only invalid until the next scan decides, as it may be
+	// missing only for a moment.
+	f := m.CurrentRepoFile("default", "file")
+	if !f.Invalid || f.Flags&protocol.FlagDeleted != 0 || f.Version <= v {
+		t.Errorf("File not marked invalid; %v", f)
+	}
+	if changed, _ := m.ChangedSince("default", seq); len(changed) != 1 || changed[0].Name != "file" {
+		t.Errorf("Invalid file not announced; changed %v", changed)
+	}
+	if _, err := m.Request("some node", "default", "file", 0, 4); err != ErrInvalid {
+		t.Errorf("Incorrect error %v for request of invalid file", err)
+	}
+	m.ScanRepo("default")
+	if f := m.CurrentRepoFile("default", "file"); f.Flags&protocol.FlagDeleted == 0 {
+		t.Errorf("File not deleted by scan; %v", f)
+	}
+
+	// A request that saw the file missing doesn't touch an entry updated
+	// since, such as by a pull.
+	lf := m.CurrentRepoFile("default", "other")
+	nf := lf
+	nf.Version = lamport.Default.Tick(lf.Version)
+	m.updateLocal("default", nf)
+	m.markChanged("default", lf)
+	if f := m.CurrentRepoFile("default", "other"); f.Invalid || f.Version != nf.Version {
+		t.Errorf("Updated entry overwritten; %v", f)
+	}
+
+	// Files are not deleted because the whole repository is missing.
+	fs.Rename(dir, dir+".gone")
+	if _, err := m.Request("some node", "default", "other", 0, 4); err != ErrNoSuchFile {
+		t.Errorf("Incorrect error %v for request in missing repository", err)
+	}
+	if f := m.CurrentRepoFile("default", "other"); f.Flags&protocol.FlagDeleted != 0 {
+		t.Errorf("File in missing repository marked deleted; %v", f)
+	}
 }
 
 func genFiles(n int) []protocol.FileInfo {
@@ -75,7 +277,7 @@ func genFiles(n int) []protocol.FileInfo {
 		files[i] = protocol.FileInfo{
 			Name:     fmt.Sprintf("file%d", i),
 			Modified: t,
-			Blocks:   []protocol.BlockInfo{{100, []byte("some hash bytes")}},
+			Blocks:   []protocol.BlockInfo{{Size: 100, Hash: []byte("some hash bytes")}},
 		}
 	}
 
@@ -150,6 +352,7 @@ func BenchmarkIndexUpdate10000f00001(b *testing.B) {
 type FakeConnection struct {
 	id          string
 	requestData []byte
+	stats       protocol.Statistics
 }
 
 func (FakeConnection) Close() error {
@@ -166,18 +369,215 @@ func (f FakeConnection) Option(string) string {
 
 func (FakeConnection) Index(string, []protocol.FileInfo) {}
 
+func (FakeConnection) IndexUpdate(string, []protocol.FileInfo) {}
+
 func (f FakeConnection) Request(repo, name string, offset int64, size int) ([]byte, error) {
-	return f.requestData, nil
+	// The puller recycles the returned buffer, so each request gets its own.
+	return append([]byte(nil), f.requestData...), nil
 }
 
+func (f FakeConnection) RequestBatch(repo, name string, blocks []protocol.RequestBlock) []protocol.BlockResult {
+	res := make([]protocol.BlockResult, len(blocks))
+	for i := range blocks {
+		res[i].Data = append([]byte(nil), f.requestData...)
+	}
+	return res
+}
+
+func (FakeConnection) Root(string, []byte) {}
+
+func (FakeConnection) PeerRoot(string) []byte {
+	return nil
+}
+
+func (FakeConnection) RequestIndex(string) {}
+
 func (FakeConnection) ClusterConfig(protocol.ClusterConfigMessage) {}
 
 func (FakeConnection) Ping() bool {
 	return true
 }
 
-func (FakeConnection) Statistics() protocol.Statistics {
-	return protocol.Statistics{}
+func (f FakeConnection) Statistics() protocol.Statistics {
+	return f.stats
+}
+
+func (FakeConnection) SetTracer(protocol.Tracer) {}
+
+// indexRecorder is a FakeConnection that records the repositories of the
+// indexes sent to it.
+type indexRecorder struct {
+	FakeConnection
+	indexes chan string
+}
+
+func (r indexRecorder) Index(repo string, fs []protocol.FileInfo) {
+	r.indexes <- repo
+}
+
+// dialedConnection is a FakeConnection that tells whether it was dialed.
+type dialedConnection struct {
+	FakeConnection
+	dialed bool
+}
+
+func (c dialedConnection) Dialed() bool {
+	return c.dialed
+}
+
+// When two nodes dial each other at the same time, both keep the connection
+// dialed by the node with the lower ID, whichever was added first.
+func TestDuplicateConnectionTieBreak(t *testing.T) {
+	defer func(id string) { myID = id }(myID)
+
+	for _, tc := range []struct {
+		myID       string
+		keepDialed bool
+	}{
+		{"a", true},  // we have the lower ID
+		{"c", false}, // the peer has
+	} {
+		myID = tc.myID
+		for _, dialedFirst := range []bool{false, true} {
+			m := NewModel(1e6)
+			m.AddRepo("default", "testdata", []NodeConfiguration{{NodeID: "b"}})
+
+			first := &dialedConnection{FakeConnection{id: "b"}, dialedFirst}
+			second := &dialedConnection{FakeConnection{id: "b"}, !dialedFirst}
+			m.AddConnection(first, first)
+			m.AddConnection(second, second)
+
+			m.pmut.RLock()
+			kept := m.protoConn["b"]
+			m.pmut.RUnlock()
+			if kept == nil || kept.(*dialedConnection).dialed != tc.keepDialed {
+				t.Errorf("myID %s, dialed first %v: kept %v, expected the one dialed %v", tc.myID, dialedFirst, kept, tc.keepDialed)
+			}
+		}
+	}
+}
+
+func TestIndexSentAfterHandshake(t *testing.T) {
+	m := NewModel(1e6)
+	m.AddRepo("default", "testdata", []NodeConfiguration{{NodeID: "42"}})
+	m.ScanRepo("default")
+
+	rc := indexRecorder{FakeConnection{id: "42"}, make(chan string, 10)}
+	m.AddConnection(rc, rc)
+
+	// A duplicate connection must not cause a second index to be sent.
+	m.AddConnection(rc, rc)
+
+	select {
+	case repo := <-rc.indexes:
+		t.Fatalf("Unexpected index for %q before handshake", repo)
+	case <-time.After(100 * time.Millisecond):
+	}
+
+	m.ClusterConfig("42", m.clusterConfig("42"))
+
+	select {
+	case repo := <-rc.indexes:
+		if repo != "default" {
+			t.Errorf("Incorrect repo %q", repo)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("No index sent after handshake")
+	}
+
+	select {
+	case repo := <-rc.indexes:
+		t.Errorf("Unexpected second index for %q", repo)
+	case <-time.After(100 * time.Millisecond):
+	}
+}
+
+func TestRepoSharing(t *testing.T) {
+	fs := testutil.NewFakeFS()
+	for _, repo := range []string{"work", "photos"} {
+		dir := filepath.Join(string(os.PathSeparator), repo)
+		fs.MkdirAll(dir, 0755)
+		fs.WriteFile(filepath.Join(dir, repo+".txt"), []byte(repo), 0644)
+	}
+
+	m := NewModel(1e6)
+	m.SetFilesystem(fs)
+	m.AddRepo("work", filepath.Join(string(os.PathSeparator), "work"), []NodeConfiguration{{NodeID: "a"}, {NodeID: "b"}})
+	m.AddRepo("photos", filepath.Join(string(os.PathSeparator), "photos"), []NodeConfiguration{{NodeID: "b"}, {NodeID: "c"}})
+	m.ScanRepos()
+
+	conns := make(map[string]indexRecorder)
+	for _, node := range []string{"a", "b", "c"} {
+		rc := indexRecorder{FakeConnection{id: node}, make(chan string, 10)}
+		m.AddConnection(rc, rc)
+		m.ClusterConfig(node, m.clusterConfig(node))
+		conns[node] = rc
+	}
+
+	received := func(node string) []string {
+		var repos []string
+		for {
+			select {
+			case repo := <-conns[node].indexes:
+				repos = append(repos, repo)
+			case <-time.After(100 * time.Millisecond):
+				sort.Strings(repos)
+				return repos
+			}
+		}
+	}
+	expect := func(what string, exp map[string][]string) {
+		for node, repos := range exp {
+			if r := received(node); !reflect.DeepEqual(r, repos) {
+				t.Errorf("%s: %s received indexes for %v, expected %v", what, node, r, repos)
+			}
+		}
+	}
+
+	// The first broadcast repeats the indexes sent after the handshake.
+	b := newBroadcastState(time.Now())
+	m.broadcastIndexes(b, time.Now())
+	expect("initial", map[string][]string{"a": {"work", "work"}, "b": {"photos", "photos", "work", "work"}, "c": {"photos", "photos"}})
+
+	// Broadcasts only go to the nodes the repository is shared with.
+	fs.WriteFile(filepath.Join(string(os.PathSeparator), "photos", "new.jpg"), []byte("new"), 0644)
+	m.ScanRepo("photos")
+	m.broadcastIndexes(b, time.Now())
+	expect("broadcast", map[string][]string{"a": nil, "b": {"photos"}, "c": {"photos"}})
+
+	// Nodes may not exchange files in repositories not shared with them.
+	m.Index("c", "work", []protocol.FileInfo{{Name: "intruder", Version: 1000}})
+	if f := m.CurrentGlobalFile("work", "intruder"); f.Name != "" {
+		t.Error("Index accepted for repository not shared with the node")
+	}
+	if _, err := m.Request("a", "photos", "photos.txt", 0, 6); err != ErrNotShared {
+		t.Errorf("Incorrect error %v for request in repository not shared with the node", err)
+	}
+
+	// Changing who the repository is shared with keeps the connections.
+	m.Index("c", "photos", []protocol.FileInfo{{Name: "from c", Version: 1000}})
+	if f := m.CurrentGlobalFile("photos", "from c"); f.Name != "from c" {
+		t.Fatal("Index not accepted from node shared with")
+	}
+	if err := m.SetRepoNodes("photos", []string{"a", "b"}); err != nil {
+		t.Fatal(err)
+	}
+	expect("changed", map[string][]string{"a": {"photos"}, "b": nil, "c": nil})
+	if f := m.CurrentGlobalFile("photos", "from c"); f.Name != "" {
+		t.Error("Index kept from node no longer shared with")
+	}
+	if _, err := m.Request("c", "photos", "photos.txt", 0, 6); err != ErrNotShared {
+		t.Errorf("Incorrect error %v for request from node no longer shared with", err)
+	}
+	if bs, err := m.Request("a", "photos", "photos.txt", 0, 6); err != nil || string(bs) != "photos" {
+		t.Errorf("Incorrect response %q, %v for request from node now shared with", bs, err)
+	}
+	if !m.ConnectedTo("c") {
+		t.Error("Connection closed on sharing change")
+	}
+	if err := m.SetRepoNodes("other", nil); err != ErrNoSuchRepo {
+		t.Errorf("Incorrect error %v for nonexistent repository", err)
+	}
 }
 
 func BenchmarkRequest(b *testing.B) {
@@ -192,7 +592,7 @@ func BenchmarkRequest(b *testing.B) {
 		files[i] = protocol.FileInfo{
 			Name:     fmt.Sprintf("file%d", i),
 			Modified: t,
-			Blocks:   []protocol.BlockInfo{{100, []byte("some hash bytes")}},
+			Blocks:   []protocol.BlockInfo{{Size: 100, Hash: []byte("some hash bytes")}},
 		}
 	}
 
@@ -205,7 +605,7 @@ func BenchmarkRequest(b *testing.B) {
 
 	b.ResetTimer()
 	for i := 0; i < b.N; i++ {
-		data, err := m.requestGlobal("42", "default", files[i%n].Name, 0, 32, nil)
+		data, err := m.requestGlobal("42", "default", files[i%n].Name, 0, 32, nil, nil)
 		if err != nil {
 			b.Error(err)
 		}
@@ -215,28 +615,2362 @@ func BenchmarkRequest(b *testing.B) {
 	}
 }
 
-func TestActivityMap(t *testing.T) {
-	cm := cid.NewMap()
-	fooID := cm.Get("foo")
-	if fooID == 0 {
-		t.Fatal("ID cannot be zero")
+func TestCloseDefersIndexDrop(t *testing.T) {
+	m := NewModel(1e6)
+	m.AddRepo("default", "testdata", []NodeConfiguration{{NodeID: "42"}})
+	fc := FakeConnection{id: "42"}
+	files := genFiles(10)
+	for i := range files {
+		files[i].Version = 1000
 	}
-	barID := cm.Get("bar")
-	if barID == 0 {
-		t.Fatal("ID cannot be zero")
+
+	for i := 0; i < 5; i++ {
+		m.AddConnection(fc, fc)
+		m.Index("42", "default", files)
+		m.Close("42", io.EOF)
 	}
 
-	m := make(activityMap)
-	if node := m.leastBusyNode(1<<fooID, cm); node != "foo" {
-		t.Errorf("Incorrect least busy node %q", node)
+	if files, _, _ := m.GlobalSize("default"); files != 10 {
+		t.Fatalf("Index should be kept until the disconnects settle, not %d files", files)
 	}
-	if node := m.leastBusyNode(1<<barID, cm); node != "bar" {
-		t.Errorf("Incorrect least busy node %q", node)
+
+	t0 := time.Now()
+	for {
+		if files, _, _ := m.GlobalSize("default"); files == 0 {
+			break
+		}
+		if time.Since(t0) > time.Second {
+			t.Fatal("Index was never dropped")
+		}
+		time.Sleep(indexDropDelay / 2)
 	}
-	if node := m.leastBusyNode(1<<fooID|1<<barID, cm); node != "foo" {
-		t.Errorf("Incorrect least busy node %q", node)
+
+	if c := m.repoFiles["default"].Changes(m.cm.Get("42")); c == 0 {
+		t.Error("Drop should have been registered as a change")
 	}
-	if node := m.leastBusyNode(1<<fooID|1<<barID, cm); node != "bar" {
-		t.Errorf("Incorrect least busy node %q", node)
+}
+
+func BenchmarkNodeFlapping(b *testing.B) {
+	m := NewModel(1e6)
+	m.AddRepo("default", "testdata", []NodeConfiguration{{NodeID: "42"}})
+	m.ScanRepo("default")
+	files := genFiles(10000)
+	fc := FakeConnection{id: "42"}
+
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		m.AddConnection(fc, fc)
+		m.Index("42", "default", files)
+		m.Close("42", io.EOF)
+	}
+}
+
+func TestSyncProgress(t *testing.T) {
+	dir, err := ioutil.TempDir("", "syncprogress")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	full := []byte("this file is fully synced")
+	if err := ioutil.WriteFile(filepath.Join(dir, "full"), full, 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	m := NewModel(1e6)
+	m.AddRepo("default", dir, []NodeConfiguration{{NodeID: "42"}})
+	m.ScanRepo("default")
+
+	half := bytes.Repeat([]byte("0123456789abcdef"), 2*BlockSize/16)
+	blocks, _ := scanner.Blocks(bytes.NewReader(half), BlockSize)
+	hf := fileInfoFromFile(scanner.File{Name: "half", Flags: 0644, Version: 1 << 40, Blocks: blocks})
+
+	// Only the first block of the file has been written to the temp file
+	tmp := filepath.Join(dir, defTempNamer.TempName("half"))
+	if err := ioutil.WriteFile(tmp, half[:BlockSize], 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	lf := fileInfoFromFile(m.CurrentRepoFile("default", "full"))
+	m.Index("42", "default", []protocol.FileInfo{lf, hf})
+
+	inSync, total := m.SyncProgress("default")
+	if exp := int64(len(full) + len(half)); total != exp {
+		t.Errorf("Incorrect total %d != %d", total, exp)
+	}
+	if exp := int64(len(full) + BlockSize); inSync != exp {
+		t.Errorf("Incorrect in sync bytes %d != %d", inSync, exp)
+	}
+}
+
+func TestSyncProgressCached(t *testing.T) {
+	dir := filepath.Join(string(os.PathSeparator), "repo")
+	ffs := testutil.NewFakeFS()
+	ffs.MkdirAll(dir, 0755)
+	fs := &readCountFS{FS: ffs}
+
+	m := NewModel(1e6)
+	m.SetFilesystem(fs)
+	m.AddRepo("default", dir, []NodeConfiguration{{NodeID: "42"}})
+	m.ScanRepo("default")
+
+	data := bytes.Repeat([]byte("0123456789abcdef"), 4*BlockSize/16)
+	blocks, _ := scanner.Blocks(bytes.NewReader(data), BlockSize)
+	f := scanner.File{Name: "file", Flags: 0644, Version: 1 << 40, Size: int64(len(data)), Blocks: blocks}
+	m.Index("42", "default", []protocol.FileInfo{fileInfoFromFile(f)})
+
+	tmp := filepath.Join(dir, defTempNamer.TempName("file"))
+	if err := ffs.WriteFile(tmp, data[:BlockSize], 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	if inSync, _ := m.SyncProgress("default"); inSync != BlockSize {
+		t.Errorf("Incorrect in sync bytes %d != %d", inSync, BlockSize)
+	}
+
+	// An unchanged temp file isn't read again.
+	atomic.StoreInt64(&fs.read, 0)
+	if inSync, _ := m.SyncProgress("default"); inSync != BlockSize {
+		t.Errorf("Incorrect in sync bytes %d != %d", inSync, BlockSize)
+	}
+	if read := atomic.LoadInt64(&fs.read); read != 0 {
+		t.Errorf("Read %d bytes of an unchanged temp file", read)
+	}
+
+	// A changed one is.
+	if err := ffs.WriteFile(tmp, data[:2*BlockSize], 0644); err != nil {
+		t.Fatal(err)
+	}
+	if inSync, _ := m.SyncProgress("default"); inSync != 2*BlockSize {
+		t.Errorf("Incorrect in sync bytes %d != %d", inSync, 2*BlockSize)
+	}
+
+	// The puller's count is used for a file being pulled, without reading it.
+	m.transferStarted("default", f, tmp)
+	m.transferWritten("default", "file", 3*BlockSize)
+	atomic.StoreInt64(&fs.read, 0)
+	if inSync, _ := m.SyncProgress("default"); inSync != 3*BlockSize {
+		t.Errorf("Incorrect in sync bytes %d != %d", inSync, 3*BlockSize)
+	}
+	if read := atomic.LoadInt64(&fs.read); read != 0 {
+		t.Errorf("Read %d bytes of a temp file being pulled", read)
+	}
+	m.transferEnded("default", "file")
+}
+
+func TestRemainingBytes(t *testing.T) {
+	dir, err := ioutil.TempDir("", "remaining")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	data := bytes.Repeat([]byte("0123456789abcdef"), 4*BlockSize/16)
+	if err := ioutil.WriteFile(filepath.Join(dir, "large"), data, 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	m := NewModel(1e6)
+	m.AddRepo("default", dir, []NodeConfiguration{{NodeID: "42"}})
+	m.ScanRepo("default")
+
+	// The remote version changes the third block and appends a short one.
+	changed := append([]byte(nil), data...)
+	changed[2*BlockSize] = 'x'
+	changed = append(changed, []byte("appended")...)
+	blocks, _ := scanner.Blocks(bytes.NewReader(changed), BlockSize)
+	lf := m.CurrentRepoFile("default", "large")
+	f := scanner.File{Name: "large", Flags: 0644, Modified: lf.Modified, Version: lf.Version + 1, Size: int64(len(changed)), Blocks: blocks}
+	m.Index("42", "default", []protocol.FileInfo{fileInfoFromFile(f)})
+
+	if _, need := m.NeedSize("default"); need != int64(len(changed)) {
+		t.Errorf("Incorrect need size %d != %d", need, len(changed))
+	}
+	if rem, exp := m.RemainingBytes("default"), int64(BlockSize+len("appended")); rem != exp {
+		t.Errorf("Incorrect remaining bytes %d != %d", rem, exp)
+	}
+}
+
+func TestNeedDetails(t *testing.T) {
+	dir, err := ioutil.TempDir("", "needdetails")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	for _, name := range []string{"updated", "deleted"} {
+		if err := ioutil.WriteFile(filepath.Join(dir, name), []byte(name), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	m := NewModel(1e6)
+	m.AddRepo("default", dir, []NodeConfiguration{{NodeID: "42"}, {NodeID: "43"}})
+	m.ScanRepo("default")
+	for _, node := range []string{"42", "43"} {
+		fc := FakeConnection{id: node}
+		m.AddConnection(fc, fc)
+	}
+
+	updated := m.CurrentRepoFile("default", "updated")
+	deleted := m.CurrentRepoFile("default", "deleted")
+	blocks, _ := scanner.Blocks(bytes.NewReader([]byte("new")), BlockSize)
+	newFile := scanner.File{Name: "new", Flags: 0644, Modified: 1234567890, Version: 1000, Size: 3, Blocks: blocks}
+	blocks, _ = scanner.Blocks(bytes.NewReader([]byte("changed")), BlockSize)
+	updated.Version++
+	updated.Size = 7
+	updated.Blocks = blocks
+	deleted.Version++
+	deleted.Flags |= protocol.FlagDeleted
+	deleted.Blocks = nil
+
+	m.Index("42", "default", []protocol.FileInfo{fileInfoFromFile(newFile), fileInfoFromFile(updated), fileInfoFromFile(deleted)})
+	m.Index("43", "default", []protocol.FileInfo{fileInfoFromFile(newFile)})
+
+	need := m.NeedDetails("default")
+	if len(need) != 3 {
+		t.Fatalf("Incorrect need details %v", need)
+	}
+	exp := map[string]NeedEntry{
+		"new":     {Reason: NeedNew, Sources: []string{"42", "43"}, RemainingBytes: 3},
+		"updated": {Reason: NeedUpdated, Sources: []string{"42"}, RemainingBytes: 7},
+		"deleted": {Reason: NeedDelete, Sources: []string{"42"}},
+	}
+	for _, e := range need {
+		x, ok := exp[e.File.Name]
+		if !ok {
+			t.Errorf("Unexpected need entry %v", e)
+			continue
+		}
+		if e.Reason != x.Reason {
+			t.Errorf("%s: incorrect reason %v != %v", e.File.Name, e.Reason, x.Reason)
+		}
+		if !reflect.DeepEqual(e.Sources, x.Sources) {
+			t.Errorf("%s: incorrect sources %v != %v", e.File.Name, e.Sources, x.Sources)
+		}
+		if e.Availability != NeedAvailable || len(e.Waiting) != 0 {
+			t.Errorf("%s: incorrect availability %v, waiting for %v", e.File.Name, e.Availability, e.Waiting)
+		}
+		if e.RemainingBytes != x.RemainingBytes {
+			t.Errorf("%s: incorrect remaining bytes %d != %d", e.File.Name, e.RemainingBytes, x.RemainingBytes)
+		}
+	}
+}
+
+func TestScanUnmounted(t *testing.T) {
+	dir, err := ioutil.TempDir("", "unmounted")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	inner := filepath.Join("mnt", "inner")
+	os.Mkdir(filepath.Join(dir, "mnt"), 0755)
+	for _, name := range []string{"outer", inner} {
+		if err := ioutil.WriteFile(filepath.Join(dir, name), []byte(name), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	m := NewModel(1e6)
+	m.AddRepo("default", dir, nil)
+	m.SetMounts("default", map[string]scanner.MountPolicy{"mnt": scanner.MountGuard})
+	m.mounts["default"].deviceID = func(fi os.FileInfo) (uint64, bool) {
+		if fi.Name() == "mnt" {
+			return 2, true
+		}
+		return 1, true
+	}
+	m.ScanRepo("default")
+	if f := m.CurrentRepoFile("default", inner); f.Name != inner || f.Invalid {
+		t.Fatalf("Incorrect file %v below mounted guard", f)
+	}
+
+	// The mount point goes away entirely; the files below it must not be
+	// considered deleted.
+	os.RemoveAll(filepath.Join(dir, "mnt"))
+	m.ScanRepo("default")
+	f := m.CurrentRepoFile("default", inner)
+	if f.Flags&protocol.FlagDeleted != 0 {
+		t.Fatal("File below unmounted guard deleted")
+	}
+	if !f.Invalid || f.InvalidReason != protocol.InvalidReasonUnavailable {
+		t.Errorf("File below unmounted guard not unavailable: %v", f)
+	}
+	if !m.skipPull("default", f) {
+		t.Error("Puller not told to skip file below unmounted guard")
+	}
+
+	m.ScanRepo("default")
+	if f2 := m.CurrentRepoFile("default", inner); f2.Version != f.Version {
+		t.Errorf("Unavailable file changed version on rescan (%d != %d)", f2.Version, f.Version)
+	}
+
+	os.Mkdir(filepath.Join(dir, "mnt"), 0755)
+	ioutil.WriteFile(filepath.Join(dir, inner), []byte(inner), 0644)
+	m.ScanRepo("default")
+	if f := m.CurrentRepoFile("default", inner); f.Invalid {
+		t.Errorf("File still invalid after remount: %v", f)
+	}
+}
+
+func TestReconcileUnmounted(t *testing.T) {
+	dir, err := ioutil.TempDir("", "unmounted")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	inner := filepath.Join("mnt", "inner")
+	os.Mkdir(filepath.Join(dir, "mnt"), 0755)
+	if err := ioutil.WriteFile(filepath.Join(dir, inner), []byte(inner), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	m := NewModel(1e6)
+	m.AddRepo("default", dir, nil)
+	m.SetMounts("default", map[string]scanner.MountPolicy{"mnt": scanner.MountGuard})
+	m.mounts["default"].deviceID = func(fi os.FileInfo) (uint64, bool) {
+		if fi.Name() == "mnt" {
+			return 2, true
+		}
+		return 1, true
+	}
+	m.ScanRepo("default")
+
+	// Not mounted on startup; the files below are unavailable, not deleted.
+	os.RemoveAll(filepath.Join(dir, "mnt"))
+	m.ReconcileLocal("default")
+	f := m.CurrentRepoFile("default", inner)
+	if f.Flags&protocol.FlagDeleted != 0 {
+		t.Fatal("File below unmounted guard deleted")
+	}
+	if !f.Invalid || f.InvalidReason != protocol.InvalidReasonUnavailable {
+		t.Errorf("File below unmounted guard not unavailable: %v", f)
+	}
+}
+
+func TestScanMaxDepth(t *testing.T) {
+	dir := filepath.Join(string(os.PathSeparator), "repo")
+	deep := filepath.Join("a", "b", "file")
+	fs := testutil.NewFakeFS()
+	fs.MkdirAll(filepath.Join(dir, "a", "b"), 0755)
+	fs.WriteFile(filepath.Join(dir, "top"), []byte("top"), 0644)
+	fs.WriteFile(filepath.Join(dir, deep), []byte("deep"), 0644)
+
+	m := NewModel(1e6)
+	m.SetFilesystem(fs)
+	m.AddRepo("default", dir, nil)
+	m.ScanRepo("default")
+	f := m.CurrentRepoFile("default", deep)
+
+	// Files already indexed below the limit are neither rescanned nor
+	// deleted.
+	m.SetMaxScanDepth(0)
+	fs.WriteFile(filepath.Join(dir, "a", "b", "new"), []byte("new"), 0644)
+	m.ScanRepo("default")
+	if f2 := m.CurrentRepoFile("default", deep); f2.Flags&protocol.FlagDeleted != 0 || f2.Version != f.Version {
+		t.Errorf("File below the depth limit changed; %v", f2)
+	}
+	if f := m.CurrentRepoFile("default", filepath.Join("a", "b", "new")); f.Name != "" {
+		t.Errorf("File below the depth limit scanned; %v", f)
+	}
+
+	// Nor are files pulled below the limit.
+	if !m.skipPull("default", scanner.File{Name: filepath.Join("a", "pulled")}) {
+		t.Error("File below the depth limit not skipped by the puller")
+	}
+	if m.skipPull("default", scanner.File{Name: "pulled"}) {
+		t.Error("File within the depth limit skipped by the puller")
+	}
+
+	m.SetMaxScanDepth(-1)
+	m.ScanRepo("default")
+	if f := m.CurrentRepoFile("default", filepath.Join("a", "b", "new")); f.Name == "" {
+		t.Error("File not scanned without depth limit")
+	}
+}
+
+// fatFS is a filesystem that, like FAT, cannot store permission bits.
+type fatFS struct {
+	*testutil.FakeFS
+}
+
+type fatInfo struct {
+	os.FileInfo
+}
+
+func (i fatInfo) Mode() os.FileMode {
+	return i.FileInfo.Mode()&^os.ModePerm | 0755
+}
+
+func (fs fatFS) Stat(name string) (os.FileInfo, error) {
+	fi, err := fs.FakeFS.Stat(name)
+	if err != nil {
+		return nil, err
+	}
+	return fatInfo{fi}, nil
+}
+
+func (fs fatFS) Lstat(name string) (os.FileInfo, error) {
+	fi, err := fs.FakeFS.Lstat(name)
+	if err != nil {
+		return nil, err
+	}
+	return fatInfo{fi}, nil
+}
+
+func (fs fatFS) ReadDir(name string) ([]os.FileInfo, error) {
+	fis, err := fs.FakeFS.ReadDir(name)
+	for i := range fis {
+		fis[i] = fatInfo{fis[i]}
+	}
+	return fis, err
+}
+
+func (fs fatFS) Chmod(name string, mode os.FileMode) error {
+	return &os.PathError{Op: "chmod", Path: name, Err: errors.New("operation not permitted")}
+}
+
+func TestIgnorePermissions(t *testing.T) {
+	dir := filepath.Join(string(os.PathSeparator), "repo")
+	file := filepath.Join("d", "file")
+	fs := fatFS{testutil.NewFakeFS()}
+	fs.MkdirAll(filepath.Join(dir, "d"), 0755)
+	fs.WriteFile(filepath.Join(dir, file), []byte("data"), 0644)
+
+	m := NewModel(1e6)
+	m.SetFilesystem(fs)
+	m.SetIgnorePermissions(true)
+	m.AddRepo("default", dir, nil)
+	m.ScanRepo("default")
+	if f := m.CurrentRepoFile("default", file); f.Flags != 0644 {
+		t.Errorf("Incorrect flags %o for new file", f.Flags)
+	}
+
+	// As if pulled with permission bits the filesystem could not store
+	versions := make(map[string]uint64)
+	for _, name := range []string{"d", file} {
+		f := m.CurrentRepoFile("default", name)
+		f.Flags = f.Flags&^uint32(os.ModePerm) | 0700
+		f.Version = lamport.Default.Tick(f.Version)
+		m.updateLocal("default", f)
+		versions[name] = f.Version
+	}
+
+	m.ScanRepo("default")
+	for _, name := range []string{"d", file} {
+		if f := m.CurrentRepoFile("default", name); f.Version != versions[name] || f.Flags&uint32(os.ModePerm) != 0700 {
+			t.Errorf("Mode difference picked up; %v", f)
+		}
+	}
+	if f := m.CurrentRepoFile("default", "d"); f.Flags&protocol.FlagDirectory == 0 {
+		t.Errorf("Directory flag lost; %v", f)
+	}
+
+	// Changed files keep their permission bits.
+	fs.WriteFile(filepath.Join(dir, file), []byte("changed"), 0644)
+	fs.Chtimes(filepath.Join(dir, file), time.Unix(1234567890, 0), time.Unix(1234567890, 0))
+	m.ScanRepo("default")
+	if f := m.CurrentRepoFile("default", file); f.Version == versions[file] || f.Size != 7 || f.Flags != 0700 {
+		t.Errorf("Incorrect changed file %v", f)
+	}
+
+	m.SetIgnorePermissions(false)
+	m.ScanRepo("default")
+	if f := m.CurrentRepoFile("default", "d"); f.Version == versions["d"] || f.Flags != 0755|protocol.FlagDirectory {
+		t.Errorf("Mode difference not picked up when not ignored; %v", f)
+	}
+}
+
+func TestTrafficStats(t *testing.T) {
+	m := NewModel(1e6)
+	m.AddRepo("default", "testdata", []NodeConfiguration{{NodeID: "42"}, {NodeID: "43"}})
+
+	for i, id := range []string{"42", "43"} {
+		n := int64(i + 1)
+		fc := FakeConnection{id: id, stats: protocol.Statistics{
+			InBytesByType:  protocol.MessageStatistics{Index: 100 * n, IndexUpdate: 10 * n, Response: 1000 * n, Ping: n},
+			OutBytesByType: protocol.MessageStatistics{ClusterConfig: 20 * n, Request: 30 * n},
+		}}
+		m.AddConnection(fc, fc)
+	}
+
+	in, out := m.TrafficStats()
+	if in.IndexBytes() != 330 || in.DataBytes() != 3000 || in.Total() != 3333 {
+		t.Errorf("Incorrect inbound traffic %+v", in)
+	}
+	if out.IndexBytes() != 60 || out.DataBytes() != 90 || out.Total() != 150 {
+		t.Errorf("Incorrect outbound traffic %+v", out)
+	}
+}
+
+func TestActivityMap(t *testing.T) {
+	cm := cid.NewMap()
+	fooID := cm.Get("foo")
+	if fooID == 0 {
+		t.Fatal("ID cannot be zero")
+	}
+	barID := cm.Get("bar")
+	if barID == 0 {
+		t.Fatal("ID cannot be zero")
+	}
+
+	m := make(activityMap)
+	if node := m.leastBusyNode(1<<fooID, cm); node != "foo" {
+		t.Errorf("Incorrect least busy node %q", node)
+	}
+	if node := m.leastBusyNode(1<<barID, cm); node != "bar" {
+		t.Errorf("Incorrect least busy node %q", node)
+	}
+	if node := m.leastBusyNode(1<<fooID|1<<barID, cm); node != "foo" {
+		t.Errorf("Incorrect least busy node %q", node)
+	}
+	if node := m.leastBusyNode(1<<fooID|1<<barID, cm); node != "bar" {
+		t.Errorf("Incorrect least busy node %q", node)
+	}
+}
+
+func TestRejectInconsistentBlocks(t *testing.T) {
+	m := NewModel(1e6)
+	m.AddRepo("default", "testdata", []NodeConfiguration{{NodeID: "42"}})
+	fc := FakeConnection{id: "42"}
+	m.AddConnection(fc, fc)
+
+	hash := []byte("some hash bytes")
+	files := []protocol.FileInfo{
+		{Name: "good", Version: 1000, Blocks: []protocol.BlockInfo{{Size: BlockSize, Hash: hash}, {Size: 100, Hash: hash}}},
+		{Name: "large", Version: 1000, Blocks: []protocol.BlockInfo{{Size: BlockSize + 1, Hash: hash}}},
+		{Name: "short", Version: 1000, Blocks: []protocol.BlockInfo{{Size: 100, Hash: hash}, {Size: BlockSize, Hash: hash}}},
+		{Name: "overlap", Version: 1000, Blocks: []protocol.BlockInfo{{Size: BlockSize, Hash: hash}, {Size: 0, Hash: hash}}},
+	}
+	m.Index("42", "default", files[:2])
+	m.IndexUpdate("42", "default", files[2:])
+
+	need := m.NeedFilesRepo("default")
+	if len(need) != 1 || need[0].Name != "good" {
+		t.Errorf("Incorrect need set %v", need)
+	}
+
+	// The rejected files are kept, marked invalid and without blocks.
+	for _, name := range []string{"large", "short", "overlap"} {
+		f := m.CurrentGlobalFile("default", name)
+		if f.Name != name || !f.Invalid || len(f.Blocks) != 0 {
+			t.Errorf("Rejected file %q not kept as invalid: %+v", name, f)
+		}
+	}
+
+	if n := m.ConnectionStats()["42"].RejectedFiles; n != 3 {
+		t.Errorf("Incorrect number of rejected files %d != 3", n)
+	}
+
+	// A full index resets the count.
+	m.Index("42", "default", files[1:2])
+	if n := m.ConnectionStats()["42"].RejectedFiles; n != 1 {
+		t.Errorf("Incorrect number of rejected files %d != 1", n)
+	}
+}
+
+func TestDiffWithNode(t *testing.T) {
+	m := NewModel(1e6)
+	m.AddRepo("default", "testdata", []NodeConfiguration{{NodeID: "42"}})
+
+	m.repoFiles["default"].Replace(cid.LocalID, []scanner.File{
+		{Name: "same", Modified: 10, Version: 1000},
+		{Name: "ours", Modified: 10, Version: 1000},
+		{Name: "newer", Modified: 10, Version: 1002},
+		{Name: "older", Modified: 10, Version: 1000},
+		{Name: "gone", Modified: 10, Version: 1000, Flags: protocol.FlagDeleted},
+	})
+	m.Index("42", "default", []protocol.FileInfo{
+		{Name: "same", Modified: 10, Version: 1000},
+		{Name: "theirs", Modified: 10, Version: 1000},
+		{Name: "newer", Modified: 10, Version: 1000},
+		{Name: "older", Modified: 10, Version: 1001},
+		{Name: "deleted", Modified: 10, Version: 1000, Flags: protocol.FlagDeleted},
+	})
+
+	weHave, theyHave, differ, err := m.DiffWithNode("default", "42")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(weHave, []string{"ours"}) {
+		t.Errorf("Incorrect local only files %v", weHave)
+	}
+	if !reflect.DeepEqual(theyHave, []string{"theirs"}) {
+		t.Errorf("Incorrect remote only files %v", theyHave)
+	}
+	if !reflect.DeepEqual(differ, []string{"newer", "older"}) {
+		t.Errorf("Incorrect differing files %v", differ)
+	}
+
+	if _, _, _, err := m.DiffWithNode("default", "43"); err != ErrNoSuchNode {
+		t.Errorf("Incorrect error %v for unknown node", err)
+	}
+	if _, _, _, err := m.DiffWithNode("other", "42"); err != ErrNoSuchRepo {
+		t.Errorf("Incorrect error %v for unknown repo", err)
+	}
+}
+
+// Two models with the same files have the same repository root, and a single
+// changed file makes the roots differ.
+// The root covers exactly the announced index, by wire name.
+func TestRepoRootAnnounced(t *testing.T) {
+	dir := filepath.Join(string(os.PathSeparator), "repo")
+	fs := testutil.NewFakeFS()
+	fs.MkdirAll(filepath.Join(dir, "sub"), 0755)
+	fs.MkdirAll(filepath.Join(dir, "app"), 0755)
+	fs.WriteFile(filepath.Join(dir, "sub", "file"), []byte("data"), 0644)
+	fs.WriteFile(filepath.Join(dir, "app", "state"), []byte("data"), 0644)
+
+	m := NewModel(1e6)
+	m.SetFilesystem(fs)
+	m.AddRepo("default", dir, nil)
+	m.ScanRepo("default")
+	m.RegisterInternalPath("app")
+
+	var announced []scanner.File
+	for _, f := range m.protocolIndex("default") {
+		announced = append(announced, fileFromFileInfo(f))
+	}
+	set := files.NewSet()
+	set.Replace(1, announced)
+	if r, exp := m.RepoRoot("default"), set.Root(1); !bytes.Equal(r, exp) {
+		t.Errorf("Root not of the announced index; %x != %x", r, exp)
+	}
+}
+
+func TestRepoRoot(t *testing.T) {
+	dir, err := ioutil.TempDir("", "reporoot")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	src := NewModel(1e6)
+	src.AddRepo("default", "testdata", []NodeConfiguration{{NodeID: "dst"}})
+	src.ScanRepo("default")
+
+	dst := NewModel(1e6)
+	dst.AddRepo("default", dir, []NodeConfiguration{{NodeID: "src"}})
+	dst.ScanRepo("default")
+
+	connectModels(t, src, dst)
+	if bytes.Equal(src.RepoRoot("default"), dst.RepoRoot("default")) {
+		t.Fatal("Equal roots before pulling")
+	}
+	if dst.InSync("default", "src") {
+		t.Error("In sync before pulling")
+	}
+	if r := pullAll(t, dst, "default", dir); len(r.Failures) != 0 {
+		t.Fatalf("Unexpected failures %+v", r.Failures)
+	}
+
+	if r0, r1 := src.RepoRoot("default"), dst.RepoRoot("default"); !bytes.Equal(r0, r1) {
+		t.Errorf("Roots differ after pulling; %x != %x", r0, r1)
+	}
+	if weHave, theyHave, differ, _ := dst.DiffWithNode("default", "src"); len(weHave)+len(theyHave)+len(differ) != 0 {
+		t.Errorf("Unexpected differences %v %v %v", weHave, theyHave, differ)
+	}
+	timeout := time.After(5 * time.Second)
+	for !dst.InSync("default", "src") {
+		select {
+		case <-timeout:
+			t.Fatal("Not in sync after pulling")
+		case <-time.After(10 * time.Millisecond):
+		}
+	}
+
+	f := src.CurrentRepoFile("default", "foo")
+	src.markChanged("default", f)
+	if bytes.Equal(src.RepoRoot("default"), dst.RepoRoot("default")) {
+		t.Error("Equal roots after changing a file")
+	}
+}
+
+func TestMaxIndexAge(t *testing.T) {
+	clk := newFakeClock()
+	m := newModel(1e6, clk)
+	m.AddRepo("default", "testdata", []NodeConfiguration{{NodeID: "42"}, {NodeID: "43"}})
+	m.SetMaxIndexAge(time.Hour)
+
+	rc := indexRequestRecorder{FakeConnection{id: "42"}, make(chan string, 10)}
+	m.AddConnection(rc, rc)
+
+	m.Index("42", "default", []protocol.FileInfo{{Name: "stale", Version: 1000}})
+	m.Index("43", "default", []protocol.FileInfo{{Name: "fresh", Version: 1000}})
+
+	if files, _, _ := m.GlobalSize("default"); files != 2 {
+		t.Fatalf("Incorrect number of global files %d != 2", files)
+	}
+
+	// Any message from a node keeps its index fresh, even without updates.
+	clk.advance(45 * time.Minute)
+	m.MessageReceived("42")
+	m.MessageReceived("43")
+	clk.advance(45 * time.Minute)
+	m.dropStaleIndexes(clk.Now())
+	if files, _, _ := m.GlobalSize("default"); files != 2 {
+		t.Fatalf("Incorrect number of global files %d != 2 after pings", files)
+	}
+
+	// Only the index from 42 is past the limit.
+	m.MessageReceived("43")
+	clk.advance(30 * time.Minute)
+	m.dropStaleIndexes(clk.Now())
+
+	need := m.NeedFilesRepo("default")
+	if len(need) != 1 || need[0].Name != "fresh" {
+		t.Errorf("Incorrect need set %v", need)
+	}
+	if files, _, _ := m.GlobalSize("default"); files != 1 {
+		t.Errorf("Incorrect number of global files %d != 1", files)
+	}
+
+	// The dropped index is requested again and isn't considered received
+	// until it arrives.
+	select {
+	case repo := <-rc.requests:
+		if repo != "default" {
+			t.Errorf("Index requested for repo %q", repo)
+		}
+	default:
+		t.Error("Dropped index not requested again")
+	}
+	if m.IndexReceived("42") {
+		t.Error("Dropped index still considered received")
+	}
+
+	// A message without an index doesn't bring it back, a new index does.
+	m.MessageReceived("42")
+	if files, _, _ := m.GlobalSize("default"); files != 1 {
+		t.Errorf("Incorrect number of global files %d != 1", files)
+	}
+	m.Index("42", "default", []protocol.FileInfo{{Name: "stale", Version: 1001}})
+	if files, _, _ := m.GlobalSize("default"); files != 2 {
+		t.Errorf("Incorrect number of global files %d != 2", files)
+	}
+	if !m.IndexReceived("42") {
+		t.Error("Resent index not considered received")
+	}
+}
+
+// indexRequestRecorder is a FakeConnection that records the repositories
+// it is asked to resend the index for.
+type indexRequestRecorder struct {
+	FakeConnection
+	requests chan string
+}
+
+func (r indexRequestRecorder) RequestIndex(repo string) {
+	r.requests <- repo
+}
+
+// addrConnection is a FakeConnection with a remote address.
+type addrConnection struct {
+	FakeConnection
+	addr net.Addr
+}
+
+func (c addrConnection) RemoteAddr() net.Addr {
+	return c.addr
+}
+
+var addressTestcases = []struct {
+	addr    net.Addr
+	ip      string
+	port    int
+	family  string
+	private bool
+}{
+	{&net.TCPAddr{IP: net.ParseIP("2001:db8::1"), Port: 22000}, "2001:db8::1", 22000, "ipv6", false},
+	{&net.TCPAddr{IP: net.ParseIP("fe80::1"), Port: 22001}, "fe80::1", 22001, "ipv6", true},
+	{&net.TCPAddr{IP: net.ParseIP("fd00::1"), Port: 22002}, "fd00::1", 22002, "ipv6", true},
+	{&net.TCPAddr{IP: net.ParseIP("192.168.1.2"), Port: 22003}, "192.168.1.2", 22003, "ipv4", true},
+	{&net.TCPAddr{IP: net.ParseIP("8.8.8.8"), Port: 22004}, "8.8.8.8", 22004, "ipv4", false},
+	{&net.UDPAddr{IP: net.ParseIP("::1"), Port: 22005}, "::1", 22005, "ipv6", true},
+	{&net.TCPAddr{IP: net.ParseIP("10.1.2.3"), Port: 22006}, "10.1.2.3", 22006, "ipv4", true},
+	{&net.TCPAddr{IP: net.ParseIP("172.31.255.255"), Port: 22007}, "172.31.255.255", 22007, "ipv4", true},
+	{&net.TCPAddr{IP: net.ParseIP("172.32.0.1"), Port: 22008}, "172.32.0.1", 22008, "ipv4", false},
+	{&net.TCPAddr{IP: net.ParseIP("fc00::1"), Port: 22009}, "fc00::1", 22009, "ipv6", true},
+	{&net.TCPAddr{IP: net.ParseIP("fe00::1"), Port: 22010}, "fe00::1", 22010, "ipv6", false},
+}
+
+func TestConnectionAddress(t *testing.T) {
+	for i, tc := range addressTestcases {
+		m := NewModel(1e6)
+		fc := FakeConnection{id: "42"}
+		m.AddConnection(addrConnection{fc, tc.addr}, fc)
+
+		ci := m.ConnectionStats()["42"]
+		if ci.Address != tc.addr.String() {
+			t.Errorf("%d: incorrect address %q != %q", i, ci.Address, tc.addr.String())
+		}
+		if ci.IP != tc.ip {
+			t.Errorf("%d: incorrect IP %q != %q", i, ci.IP, tc.ip)
+		}
+		if ci.Port != tc.port {
+			t.Errorf("%d: incorrect port %d != %d", i, ci.Port, tc.port)
+		}
+		if ci.Family != tc.family {
+			t.Errorf("%d: incorrect family %q != %q", i, ci.Family, tc.family)
+		}
+		if ci.Private != tc.private {
+			t.Errorf("%d: incorrect private flag %v != %v", i, ci.Private, tc.private)
+		}
+	}
+}
+
+// connectedModel returns a model with the given number of connected nodes
+// sharing the test data repository.
+func connectedModel(nodes int) *Model {
+	var ncs []NodeConfiguration
+	for i := 0; i < nodes; i++ {
+		ncs = append(ncs, NodeConfiguration{NodeID: fmt.Sprintf("node%d", i)})
+	}
+	m := NewModel(1e6)
+	m.AddRepo("default", "testdata", ncs)
+	m.ScanRepo("default")
+	for i, nc := range ncs {
+		fc := FakeConnection{id: nc.NodeID, stats: protocol.Statistics{InBytesTotal: int64(i)}}
+		m.AddConnection(addrConnection{fc, &net.TCPAddr{IP: net.ParseIP("192.168.1.2"), Port: 22000 + i}}, fc)
+	}
+	return m
+}
+
+func TestConnectionStatsInto(t *testing.T) {
+	m := connectedModel(3)
+
+	dst := map[string]ConnectionInfo{"gone": {ClientVersion: "v0.1"}}
+	m.ConnectionStatsInto(dst)
+	if exp := m.ConnectionStats(); !reflect.DeepEqual(dst, exp) {
+		t.Errorf("Incorrect stats\n%v !=\n%v", dst, exp)
+	}
+
+	m.Close("node1", io.EOF)
+	m.ConnectionStatsInto(dst)
+	if exp := m.ConnectionStats(); len(dst) != 2 || !reflect.DeepEqual(dst, exp) {
+		t.Errorf("Incorrect stats after disconnect\n%v !=\n%v", dst, exp)
+	}
+}
+
+func BenchmarkConnectionStats(b *testing.B) {
+	m := connectedModel(50)
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		m.ConnectionStats()
+	}
+}
+
+func BenchmarkConnectionStatsInto(b *testing.B) {
+	m := connectedModel(50)
+	dst := make(map[string]ConnectionInfo)
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		m.ConnectionStatsInto(dst)
+	}
+}
+
+var broadcastTestcases = []struct {
+	pending   time.Duration
+	activity  pullActivity
+	broadcast bool
+}{
+	{0, pullActivity{}, true},
+	{0, pullActivity{busyBytesPerSecond - 1, busyOpenFiles - 1}, true},
+	{0, pullActivity{busyBytesPerSecond, 0}, false},
+	{0, pullActivity{0, busyOpenFiles}, false},
+	{idxBcastHoldBusy - time.Second, pullActivity{busyBytesPerSecond, busyOpenFiles}, false},
+	{idxBcastHoldBusy, pullActivity{busyBytesPerSecond, busyOpenFiles}, true},
+	{idxBcastHoldBusy - time.Second, pullActivity{}, true},
+}
+
+func TestShouldBroadcast(t *testing.T) {
+	for i, tc := range broadcastTestcases {
+		if b := shouldBroadcast(tc.pending, tc.activity); b != tc.broadcast {
+			t.Errorf("%d: incorrect broadcast decision %v != %v", i, b, tc.broadcast)
+		}
+	}
+}
+
+func TestForceRehash(t *testing.T) {
+	dir, err := ioutil.TempDir("", "rehash")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	mtime := time.Unix(1234567890, 0)
+	write := func(name, data string) {
+		path := filepath.Join(dir, name)
+		os.MkdirAll(filepath.Dir(path), 0777)
+		if err := ioutil.WriteFile(path, []byte(data), 0644); err != nil {
+			t.Fatal(err)
+		}
+		os.Chtimes(path, mtime, mtime)
+	}
+
+	write("sub/changed", "original contents")
+	write("sub/unchanged", "original contents")
+	write("subother/changed", "original contents")
+
+	m := NewModel(1e6)
+	m.AddRepo("default", dir, nil)
+	m.ScanRepo("default")
+
+	versions := make(map[string]uint64)
+	for _, name := range []string{"sub/changed", "sub/unchanged", "subother/changed"} {
+		versions[name] = m.CurrentRepoFile("default", filepath.FromSlash(name)).Version
+	}
+
+	// Change the contents in place, keeping size and modification time
+	write("sub/changed", "modified contents")
+	write("subother/changed", "modified contents")
+
+	m.ScanRepo("default")
+	if v := m.CurrentRepoFile("default", filepath.FromSlash("sub/changed")).Version; v != versions["sub/changed"] {
+		t.Fatal("Change detected by regular scan; test is broken")
+	}
+
+	if err := m.ForceRehash("default", "sub"); err != nil {
+		t.Fatal(err)
+	}
+
+	for name, changed := range map[string]bool{"sub/changed": true, "sub/unchanged": false, "subother/changed": false} {
+		f := m.CurrentRepoFile("default", filepath.FromSlash(name))
+		if bumped := f.Version != versions[name]; bumped != changed {
+			t.Errorf("%s: incorrect version change %v != %v", name, bumped, changed)
+		}
+	}
+
+	data := []byte("modified contents")
+	blocks, _ := scanner.Blocks(bytes.NewReader(data), BlockSize)
+	if f := m.CurrentRepoFile("default", filepath.FromSlash("sub/changed")); !scanner.SameBlocks(f.Blocks, blocks) {
+		t.Error("Incorrect blocks after rehash")
+	}
+}
+
+// closeRecorder is a FakeConnection that records whether it was closed.
+type closeRecorder struct {
+	FakeConnection
+	closed chan bool
+}
+
+func (c closeRecorder) Close() error {
+	c.closed <- true
+	return nil
+}
+
+func (c closeRecorder) RemoteAddr() net.Addr {
+	return &net.TCPAddr{IP: net.ParseIP("192.0.2.42"), Port: 22000}
+}
+
+func TestConnectionFilter(t *testing.T) {
+	m := NewModel(1e6)
+	var filterAddr net.Addr
+	m.SetConnectionFilter(func(nodeID string, addr net.Addr) bool {
+		filterAddr = addr
+		return nodeID != "denied"
+	})
+
+	denied := closeRecorder{FakeConnection{id: "denied"}, make(chan bool, 1)}
+	m.AddConnection(denied, denied)
+
+	select {
+	case <-denied.closed:
+	default:
+		t.Error("Rejected connection not closed")
+	}
+	if m.ConnectedTo("denied") {
+		t.Error("Rejected connection was added")
+	}
+	if filterAddr == nil || filterAddr.String() != "192.0.2.42:22000" {
+		t.Errorf("Incorrect address passed to filter %v", filterAddr)
+	}
+
+	allowed := closeRecorder{FakeConnection{id: "allowed"}, make(chan bool, 1)}
+	m.AddConnection(allowed, allowed)
+
+	select {
+	case <-allowed.closed:
+		t.Error("Accepted connection closed")
+	default:
+	}
+	if !m.ConnectedTo("allowed") {
+		t.Error("Accepted connection was not added")
+	}
+}
+
+func TestIndexReceived(t *testing.T) {
+	m := NewModel(1e6)
+	m.AddRepo("default", "testdata", []NodeConfiguration{{NodeID: "42"}})
+	fc := FakeConnection{id: "42"}
+	m.AddConnection(fc, fc)
+
+	if m.IndexReceived("42") {
+		t.Error("Index received before any index")
+	}
+
+	f := protocol.FileInfo{Name: "file", Flags: 0644, Modified: 1234567890, Version: 1000}
+	m.Index("42", "default", []protocol.FileInfo{f})
+	if !m.IndexReceived("42") {
+		t.Error("Index not received after full index")
+	}
+
+	m.Close("42", io.EOF)
+	if m.IndexReceived("42") {
+		t.Error("Index received after connection closed")
+	}
+}
+
+func TestForgetNode(t *testing.T) {
+	m := NewModel(1e6)
+	m.AddRepo("default", "testdata", []NodeConfiguration{{NodeID: "42"}})
+	m.SetDeleteTrust("42", false)
+	m.SetInitialIndexRate("42", 1000)
+
+	conn := closeRecorder{FakeConnection{id: "42"}, make(chan bool, 1)}
+	m.AddConnection(conn, conn)
+	m.ClusterConfig("42", protocol.ClusterConfigMessage{})
+	m.Index("42", "default", []protocol.FileInfo{{Name: "only42", Version: 1000}})
+	m.countNodeData("42", 10, 20)
+	m.convergence["42"] = &ConvergenceStats{}
+
+	if need := m.NeedFilesRepo("default"); len(need) != 1 {
+		t.Fatalf("Incorrect need set %v", need)
+	}
+	if av := m.repoFiles["default"].Availability("only42"); av == 0 {
+		t.Fatal("File not available from node")
+	}
+
+	m.ForgetNode("42")
+
+	select {
+	case <-conn.closed:
+	default:
+		t.Error("Connection to forgotten node not closed")
+	}
+	if m.ConnectedTo("42") {
+		t.Error("Forgotten node still connected")
+	}
+	if need := m.NeedFilesRepo("default"); len(need) != 0 {
+		t.Errorf("Incorrect need set %v after forgetting node", need)
+	}
+	if av := m.repoFiles["default"].Availability("only42"); av != 0 {
+		t.Errorf("File still available from forgotten node (%b)", av)
+	}
+	if _, ok := m.NodeDataStats()["42"]; ok {
+		t.Error("Data statistics kept for forgotten node")
+	}
+	if _, ok := m.convergence["42"]; ok {
+		t.Error("Convergence statistics kept for forgotten node")
+	}
+	if _, ok := m.fullIndexes[indexSource{"42", "default"}]; ok {
+		t.Error("Full index kept for forgotten node")
+	}
+	if m.noDeletes["42"] || m.indexRate["42"] != 0 {
+		t.Error("Settings kept for forgotten node")
+	}
+	if _, ok := m.maxRequest["42"]; ok {
+		t.Error("Request size kept for forgotten node")
+	}
+
+	again := closeRecorder{FakeConnection{id: "42"}, make(chan bool, 1)}
+	m.AddConnection(again, again)
+	select {
+	case <-again.closed:
+	default:
+		t.Error("Connection from forgotten node not closed")
+	}
+	if m.ConnectedTo("42") {
+		t.Error("Connection from forgotten node was added")
+	}
+	m.Index("42", "default", []protocol.FileInfo{{Name: "only42", Version: 1000}})
+	if need := m.NeedFilesRepo("default"); len(need) != 0 {
+		t.Errorf("Index from forgotten node was accepted: %v", need)
+	}
+
+	m.UnforgetNode("42")
+	m.AddConnection(again, again)
+	if !m.ConnectedTo("42") {
+		t.Error("Connection from unforgotten node was not added")
+	}
+}
+
+// fileIndexRecorder is a FakeConnection that records the indexes and index
+// updates sent to it.
+type fileIndexRecorder struct {
+	FakeConnection
+	indexes chan []protocol.FileInfo
+	updates chan []protocol.FileInfo
+}
+
+func (r fileIndexRecorder) Index(repo string, fs []protocol.FileInfo) {
+	r.indexes <- fs
+}
+
+func (r fileIndexRecorder) IndexUpdate(repo string, fs []protocol.FileInfo) {
+	r.updates <- fs
+}
+
+func TestReconcileCachedIndex(t *testing.T) {
+	confDir, err := ioutil.TempDir("", "reconcile")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(confDir)
+
+	dir := filepath.Join(string(os.PathSeparator), "repo")
+	fs := testutil.NewFakeFS()
+	fs.MkdirAll(dir, 0755)
+	fs.WriteFile(filepath.Join(dir, "removed"), []byte("removed while down"), 0644)
+	fs.WriteFile(filepath.Join(dir, "modified"), []byte("modified while down"), 0644)
+	fs.WriteFile(filepath.Join(dir, "unchanged"), []byte("unchanged"), 0644)
+
+	m := NewModel(1e6)
+	m.SetFilesystem(fs)
+	m.AddRepo("default", dir, nil)
+	m.ScanRepo("default")
+	m.SaveIndexes(confDir)
+
+	fs.Remove(filepath.Join(dir, "removed"))
+	fs.WriteFile(filepath.Join(dir, "modified"), []byte("now with different contents"), 0644)
+
+	m = NewModel(1e6)
+	m.SetFilesystem(fs)
+	m.AddRepo("default", dir, []NodeConfiguration{{NodeID: "42"}})
+	m.LoadIndexes(confDir)
+	m.ReconcileRepos()
+
+	rc := fileIndexRecorder{FakeConnection{id: "42"}, make(chan []protocol.FileInfo, 1), make(chan []protocol.FileInfo, 1)}
+	m.AddConnection(rc, rc)
+	m.ClusterConfig("42", m.clusterConfig("42"))
+
+	var idx []protocol.FileInfo
+	select {
+	case idx = <-rc.indexes:
+	case <-time.After(time.Second):
+		t.Fatal("No index sent")
+	}
+
+	files := make(map[string]protocol.FileInfo)
+	for _, f := range idx {
+		files[f.Name] = f
+	}
+	if len(files) != 3 {
+		t.Fatalf("Incorrect index %v", idx)
+	}
+	if f := files["removed"]; f.Flags&protocol.FlagDeleted == 0 {
+		t.Errorf("Removed file not marked deleted (flags %o)", f.Flags)
+	}
+	if f := files["modified"]; f.Flags&protocol.FlagInvalid == 0 || protocol.InvalidReason(f.Flags) != protocol.InvalidReasonChanged {
+		t.Errorf("Modified file not marked invalid (flags %o)", f.Flags)
+	}
+	if f := files["unchanged"]; f.Flags&(protocol.FlagDeleted|protocol.FlagInvalid) != 0 {
+		t.Errorf("Unchanged file marked deleted or invalid (flags %o)", f.Flags)
+	}
+}
+
+func TestDuplicateNodeSuspected(t *testing.T) {
+	sub := events.Default.Subscribe(events.DuplicateNodeSuspected)
+	defer events.Default.Unsubscribe(sub)
+
+	m := NewModel(1e6)
+	m.AddRepo("default", "testdata", []NodeConfiguration{{NodeID: "42"}})
+
+	first := []protocol.FileInfo{{Name: "a", Version: 1000}, {Name: "b", Version: 1000}}
+	second := []protocol.FileInfo{{Name: "c", Version: 1000}, {Name: "d", Version: 1000}}
+
+	// Repeated similar indexes are normal.
+	m.Index("42", "default", first)
+	m.Index("42", "default", first)
+	m.Index("42", "default", append(first, protocol.FileInfo{Name: "e", Version: 1000}))
+	if _, err := sub.Poll(10 * time.Millisecond); err != events.ErrTimeout {
+		t.Fatal("Unexpected duplicate warning for consistent indexes")
+	}
+
+	// Two nodes with the same ID taking turns.
+	m.Index("42", "default", second)
+	m.Index("42", "default", first)
+
+	ev, err := sub.Poll(time.Second)
+	if err != nil {
+		t.Fatal("No duplicate warning for alternating indexes")
+	}
+	if data := ev.Data.(map[string]interface{}); data["node"] != "42" || data["repo"] != "default" {
+		t.Errorf("Incorrect event data %v", data)
+	}
+}
+
+func TestNodeDataStats(t *testing.T) {
+	srcDir, err := ioutil.TempDir("", "nodestats")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(srcDir)
+	dstDir, err := ioutil.TempDir("", "nodestats")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dstDir)
+
+	const size = BlockSize + 10
+	writeFiles(t, srcDir, 1, size)
+
+	src := NewModel(1e6)
+	src.AddRepo("default", srcDir, []NodeConfiguration{{NodeID: "dst"}})
+	src.ScanRepo("default")
+	dst := NewModel(1e6)
+	dst.AddRepo("default", dstDir, []NodeConfiguration{{NodeID: "src"}})
+	dst.ScanRepo("default")
+
+	connectModels(t, src, dst)
+	pullAll(t, dst, "default", dstDir)
+	if cs := src.ConnectionStats()["dst"]; cs.BytesServed != size || cs.BytesDownloaded != 0 {
+		t.Errorf("Incorrect connection stats at source; %d served, %d downloaded", cs.BytesServed, cs.BytesDownloaded)
+	}
+
+	// The counts outlive the connection.
+	dst.Close("src", io.EOF)
+	src.Close("dst", io.EOF)
+	if ds := src.NodeDataStats()["dst"]; ds.BytesServed != size || ds.BytesDownloaded != 0 {
+		t.Errorf("Incorrect stats at source; %d served, %d downloaded", ds.BytesServed, ds.BytesDownloaded)
+	}
+	if ds := dst.NodeDataStats()["src"]; ds.BytesServed != 0 || ds.BytesDownloaded != size {
+		t.Errorf("Incorrect stats at destination; %d served, %d downloaded", ds.BytesServed, ds.BytesDownloaded)
+	}
+
+	// Saved counts are added to those of the next run.
+	confDir, err := ioutil.TempDir("", "nodestats")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(confDir)
+	if err := dst.SaveNodeDataStats(confDir); err != nil {
+		t.Fatal(err)
+	}
+	m := NewModel(1e6)
+	m.countNodeData("src", 0, 100)
+	if err := m.LoadNodeDataStats(confDir); err != nil {
+		t.Fatal(err)
+	}
+	if ds := m.NodeDataStats()["src"]; ds.BytesDownloaded != size+100 || !ds.Since.Equal(dst.NodeDataStats()["src"].Since) {
+		t.Errorf("Incorrect stats after load: %+v", ds)
+	}
+
+	m.ResetNodeDataStats("src")
+	if ds := m.NodeDataStats(); len(ds) != 0 {
+		t.Errorf("Stats remain after reset: %+v", ds)
+	}
+
+	// Counting starts at the time of the model clock.
+	clk := newFakeClock()
+	m = newModel(1e6, clk)
+	m.countNodeData("src", 0, 100)
+	if ds := m.NodeDataStats()["src"]; !ds.Since.Equal(clk.Now()) {
+		t.Errorf("Counting started at %v, not %v", ds.Since, clk.Now())
+	}
+}
+
+func TestInvalidStuck(t *testing.T) {
+	defer func(max int) {
+		cfg.Options.MaxInvalidS = max
+	}(cfg.Options.MaxInvalidS)
+	cfg.Options.MaxInvalidS = 3600
+
+	sub := events.Default.Subscribe(events.FileStuckInvalid)
+	defer events.Default.Unsubscribe(sub)
+
+	dir := filepath.Join(string(os.PathSeparator), "repo")
+	path := filepath.Join(dir, "file")
+	fs := testutil.NewFakeFS()
+	fs.MkdirAll(dir, 0755)
+	fs.WriteFile(path, []byte("data"), 0644)
+
+	clk := newFakeClock()
+	m := newModel(1e6, clk)
+	m.SetFilesystem(fs)
+	m.AddRepo("default", dir, nil)
+	m.ScanRepo("default")
+	if inv := m.InvalidSince("default"); len(inv) != 0 {
+		t.Fatalf("Unexpected invalid files %+v", inv)
+	}
+
+	// The file changes and can't be read, in this and every later scan.
+	t0 := time.Now().Add(-time.Hour)
+	fs.Chtimes(path, t0, t0)
+	fs.SetError("open", path, os.ErrPermission)
+	m.ScanRepo("default")
+	inv := m.InvalidSince("default")
+	if len(inv) != 1 || inv[0].Name != "file" || inv[0].InvalidReason != protocol.InvalidReasonUnreadable || inv[0].Stuck {
+		t.Fatalf("Incorrect invalid files %+v", inv)
+	}
+	if since := inv[0].Since; !since.Equal(clk.Now()) {
+		t.Errorf("Invalid since %v, not %v", since, clk.Now())
+	}
+	since := clk.Now()
+
+	clk.advance(30 * time.Minute)
+	m.ScanRepo("default")
+	if _, err := sub.Poll(10 * time.Millisecond); err != events.ErrTimeout {
+		t.Fatal("Unexpected warning before the limit")
+	}
+
+	clk.advance(90 * time.Minute)
+	m.ScanRepo("default")
+	ev, err := sub.Poll(time.Second)
+	if err != nil {
+		t.Fatal("No warning for file invalid past the limit")
+	}
+	if data := ev.Data.(map[string]interface{}); data["file"] != "file" || data["repo"] != "default" {
+		t.Errorf("Incorrect event data %v", data)
+	}
+	if inv := m.InvalidSince("default"); len(inv) != 1 || !inv[0].Stuck || !inv[0].Since.Equal(since) {
+		t.Errorf("Incorrect invalid files %+v", inv)
+	}
+
+	// The warning is given once.
+	clk.advance(time.Hour)
+	m.ScanRepo("default")
+	if _, err := sub.Poll(10 * time.Millisecond); err != events.ErrTimeout {
+		t.Error("Repeated warning")
+	}
+
+	// Once the file is readable again it is no longer tracked.
+	fs.SetError("open", path, nil)
+	m.ScanRepo("default")
+	if inv := m.InvalidSince("default"); len(inv) != 0 {
+		t.Errorf("Unexpected invalid files %+v", inv)
+	}
+}
+
+func TestScanPlaceholder(t *testing.T) {
+	sub := events.Default.Subscribe(events.PlaceholderDetected)
+	defer events.Default.Unsubscribe(sub)
+
+	dir := filepath.Join(string(os.PathSeparator), "repo")
+	path := filepath.Join(dir, "file")
+	fs := testutil.NewFakeFS()
+	fs.MkdirAll(dir, 0755)
+	fs.WriteFile(path, bytes.Repeat([]byte("data"), BlockSize), 0644)
+	fi, _ := fs.Stat(path)
+
+	m := NewModel(1e6)
+	m.SetFilesystem(fs)
+	m.AddRepo("default", dir, nil)
+	m.ScanRepo("default")
+	lf := m.CurrentRepoFile("default", "file")
+
+	// A cloud storage client replaces the file by an empty placeholder,
+	// keeping the modification time.
+	fs.WriteFile(path, nil, 0644)
+	fs.Chtimes(path, fi.ModTime(), fi.ModTime())
+	m.ReconcileLocal("default")
+	m.ScanRepo("default")
+
+	if _, err := sub.Poll(time.Second); err != nil {
+		t.Error("No event for placeholder")
+	}
+	for _, f := range m.protocolIndex("default") {
+		if f.Name != "file" {
+			continue
+		}
+		if f.Flags&protocol.FlagInvalid == 0 || protocol.InvalidReason(f.Flags) != protocol.InvalidReasonPlaceholder {
+			t.Errorf("Placeholder announced as valid; flags %x, size %d", f.Flags, len(f.Blocks))
+		}
+		if f.Version <= lf.Version {
+			t.Errorf("Version not bumped; %d <= %d", f.Version, lf.Version)
+		}
+	}
+
+	// With the guard disabled the truncation is announced.
+	m.SetPlaceholderGuard(false)
+	m.ScanRepo("default")
+	if f := m.CurrentRepoFile("default", "file"); f.Invalid || f.Size != 0 {
+		t.Errorf("Truncation not announced; %+v", f)
+	}
+}
+
+func TestExpireDeleted(t *testing.T) {
+	defer func(expiry int) {
+		cfg.Options.TombstoneExpiryS = expiry
+	}(cfg.Options.TombstoneExpiryS)
+	cfg.Options.TombstoneExpiryS = 3600
+
+	dir := filepath.Join(string(os.PathSeparator), "repo")
+	path := filepath.Join(dir, "file")
+	fs := testutil.NewFakeFS()
+	fs.MkdirAll(dir, 0755)
+	fs.WriteFile(path, []byte("data"), 0644)
+
+	m := NewModel(1e6)
+	m.SetFilesystem(fs)
+	m.AddRepo("default", dir, []NodeConfiguration{{NodeID: "42"}})
+	fc := FakeConnection{id: "42"}
+	m.AddConnection(fc, fc)
+	m.ScanRepo("default")
+	m.Index("42", "default", m.protocolIndex("default"))
+
+	fs.Remove(path)
+	m.ScanRepo("default")
+	lf := m.CurrentRepoFile("default", "file")
+	if lf.Flags&protocol.FlagDeleted == 0 {
+		t.Fatalf("File not deleted: %+v", lf)
+	}
+	since := m.deleted["default"]["file"]
+
+	// The tombstone is not expired while the peer still has the file.
+	m.expireDeleted("default", since.Add(2*time.Hour))
+	if f := m.CurrentRepoFile("default", "file"); f.Version != lf.Version {
+		t.Fatal("Tombstone expired before the peer caught up")
+	}
+
+	// Nor while the peer announces nothing for it, as when its index has
+	// been dropped.
+	m.Index("42", "default", nil)
+	m.expireDeleted("default", since.Add(2*time.Hour))
+	if f := m.CurrentRepoFile("default", "file"); f.Version != lf.Version {
+		t.Fatal("Tombstone expired without the peer announcing it")
+	}
+
+	// The times the tombstones became known survive a restart.
+	confDir, err := ioutil.TempDir("", "tombstones")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(confDir)
+	m.SaveIndexes(confDir)
+	m2 := NewModel(1e6)
+	m2.SetFilesystem(fs)
+	m2.AddRepo("default", dir, []NodeConfiguration{{NodeID: "42"}})
+	m2.LoadIndexes(confDir)
+	if s2 := m2.deleted["default"]["file"]; !s2.Equal(since) {
+		t.Errorf("Tombstone time not restored; %v != %v", s2, since)
+	}
+
+	// The peer deletes the file too.
+	m.Index("42", "default", m.protocolIndex("default"))
+
+	m.expireDeleted("default", since.Add(30*time.Minute))
+	if f := m.CurrentRepoFile("default", "file"); f.Version != lf.Version {
+		t.Fatal("Tombstone expired too early")
+	}
+
+	m.expireDeleted("default", since.Add(2*time.Hour))
+	if f := m.CurrentRepoFile("default", "file"); f.Name != "" {
+		t.Fatalf("Tombstone not expired: %+v", f)
+	}
+	if _, ok := m.deleted["default"]["file"]; ok {
+		t.Error("Expired tombstone still tracked")
+	}
+
+	// The peer still announces the deletion, but that doesn't bring the
+	// tombstone back.
+	if need := m.repoFiles["default"].Need(cid.LocalID); len(need) != 0 {
+		t.Errorf("Expired file needed: %+v", need)
+	}
+	m.Index("42", "default", []protocol.FileInfo{fileInfoFromFile(lf)})
+	m.ScanRepo("default")
+	if need := m.repoFiles["default"].Need(cid.LocalID); len(need) != 0 {
+		t.Errorf("Expired file needed: %+v", need)
+	}
+	if idx := m.protocolIndex("default"); len(idx) != 0 {
+		t.Errorf("Expired file announced: %+v", idx)
+	}
+}
+
+// nfdMapper stores names in NFD, like Mac OS X, and announces them in NFC.
+type nfdMapper struct{}
+
+func (nfdMapper) ToWire(local string) string { return norm.NFC.String(local) }
+func (nfdMapper) ToLocal(wire string) string { return norm.NFD.String(wire) }
+
+func TestNameMapper(t *testing.T) {
+	nfc := "caf\u00e9"
+	nfd := "cafe\u0301"
+	data := []byte("data")
+
+	dir := filepath.Join(string(os.PathSeparator), "repo")
+	fs := testutil.NewFakeFS()
+	fs.MkdirAll(dir, 0755)
+	fs.WriteFile(filepath.Join(dir, nfd), data, 0644)
+
+	m := NewModel(1e6)
+	m.SetFilesystem(fs)
+	m.SetNameMapper(nfdMapper{})
+	m.AddRepo("default", dir, []NodeConfiguration{{NodeID: "42"}})
+	fc := FakeConnection{id: "42"}
+	m.AddConnection(fc, fc)
+	m.ScanRepo("default")
+
+	idx := m.protocolIndex("default")
+	if len(idx) != 1 || idx[0].Name != nfc {
+		t.Fatalf("Incorrect index %+v", idx)
+	}
+
+	// The peer announces the same file under the wire name.
+	m.Index("42", "default", idx)
+	if g := m.repoFiles["default"].Global(); len(g) != 1 || g[0].Name != nfd {
+		t.Errorf("Incorrect global files %+v", g)
+	}
+	if need := m.repoFiles["default"].Need(cid.LocalID); len(need) != 0 {
+		t.Errorf("Unexpected needed files %+v", need)
+	}
+	if f := m.repoFiles["default"].Get(m.cm.Get("42"), nfd); f.Version != idx[0].Version {
+		t.Errorf("Peer file not found under the local name: %+v", f)
+	}
+
+	bs, err := m.Request("42", "default", nfc, 0, len(data))
+	if err != nil || !bytes.Equal(bs, data) {
+		t.Errorf("Incorrect response %q, %v", bs, err)
+	}
+}
+
+func TestLoadLegacyIndex(t *testing.T) {
+	dir := filepath.Join(string(os.PathSeparator), "repo")
+	fs := testutil.NewFakeFS()
+	fs.MkdirAll(dir, 0755)
+	fs.WriteFile(filepath.Join(dir, "file"), []byte("data"), 0644)
+
+	for _, c := range indexCaches[1:] {
+		confDir, err := ioutil.TempDir("", "legacyindex")
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer os.RemoveAll(confDir)
+
+		m := NewModel(1e6)
+		m.SetFilesystem(fs)
+		m.AddRepo("default", dir, nil)
+		m.ScanRepo("default")
+		f := m.CurrentRepoFile("default", "file")
+
+		// Write the index as an older version would have.
+		id := fmt.Sprintf("%x", sha1.Sum([]byte(dir)))
+		legacy := filepath.Join(confDir, id+c.suffix)
+		fd, err := os.Create(legacy)
+		if err != nil {
+			t.Fatal(err)
+		}
+		gzw := gzip.NewWriter(fd)
+		protocol.EncodeIndex(gzw, protocol.IndexMessage{
+			Repository: "default",
+			Files:      []protocol.FileInfo{fileInfoFromFile(f)},
+		}, c.version)
+		gzw.Close()
+		fd.Close()
+
+		// A corrupt newer cache falls back to the older one.
+		if c.version == 1 {
+			ioutil.WriteFile(filepath.Join(confDir, id+indexCaches[0].suffix), []byte("garbage"), 0644)
+		}
+
+		m = NewModel(1e6)
+		m.SetFilesystem(fs)
+		m.AddRepo("default", dir, nil)
+		m.LoadIndexes(confDir)
+		if lf := m.CurrentRepoFile("default", "file"); lf.Version != f.Version || !scanner.SameBlocks(lf.Blocks, f.Blocks) {
+			t.Errorf("Index in %s not loaded; %v != %v", c.suffix, lf, f)
+		}
+
+		m.SaveIndexes(confDir)
+		if _, err := os.Stat(legacy); !os.IsNotExist(err) {
+			t.Errorf("Stale index %s not removed; %v", c.suffix, err)
+		}
+		if _, err := os.Stat(filepath.Join(confDir, id+indexCaches[0].suffix)); err != nil {
+			t.Errorf("Index not saved in %s; %v", indexCaches[0].suffix, err)
+		}
+	}
+}
+
+func TestChangedSinceReload(t *testing.T) {
+	confDir, err := ioutil.TempDir("", "localversion")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(confDir)
+
+	dir := filepath.Join(string(os.PathSeparator), "repo")
+	fs := testutil.NewFakeFS()
+	fs.MkdirAll(dir, 0755)
+	for _, name := range []string{"a", "b", "c"} {
+		fs.WriteFile(filepath.Join(dir, name), []byte(name), 0644)
+	}
+
+	m := NewModel(1e6)
+	m.SetFilesystem(fs)
+	m.AddRepo("default", dir, nil)
+	m.ScanRepo("default")
+	fs.Remove(filepath.Join(dir, "b"))
+	m.ScanRepo("default")
+
+	before, seq := m.ChangedSince("default", 0)
+	if len(before) != 3 || before[2].Name != "b" || before[2].Flags&protocol.FlagDeleted == 0 {
+		t.Fatalf("Incorrect changes %v", before)
+	}
+	m.SaveIndexes(confDir)
+
+	m = NewModel(1e6)
+	m.SetFilesystem(fs)
+	m.AddRepo("default", dir, nil)
+	m.LoadIndexes(confDir)
+
+	after, aseq := m.ChangedSince("default", 0)
+	if len(after) != len(before) || aseq != seq {
+		t.Fatalf("Changes differ after reload;\n%v at %d !=\n%v at %d", after, aseq, before, seq)
+	}
+	for i := range after {
+		if after[i].Name != before[i].Name || after[i].Version != before[i].Version {
+			t.Errorf("Changes differ after reload;\n%v !=\n%v", after, before)
+		}
+	}
+
+	// Changes after the reload continue from the saved local version.
+	t0 := time.Now().Add(-time.Hour)
+	fs.WriteFile(filepath.Join(dir, "a"), []byte("changed"), 0644)
+	fs.Chtimes(filepath.Join(dir, "a"), t0, t0)
+	m.ScanRepo("default")
+	changed, _ := m.ChangedSince("default", seq)
+	if len(changed) != 1 || changed[0].Name != "a" {
+		t.Errorf("Incorrect changes since %d: %v", seq, changed)
+	}
+}
+
+func TestInitialIndexRate(t *testing.T) {
+	const files = 40
+	const rate = 10000
+
+	dir := filepath.Join(string(os.PathSeparator), "repo")
+	fs := testutil.NewFakeFS()
+	fs.MkdirAll(dir, 0755)
+	for i := 0; i < files; i++ {
+		fs.WriteFile(filepath.Join(dir, fmt.Sprintf("file%05d", i)), []byte("data"), 0644)
+	}
+
+	m := NewModel(1e6)
+	m.SetFilesystem(fs)
+	m.AddRepo("default", dir, []NodeConfiguration{{NodeID: "42"}})
+	m.ScanRepo("default")
+	m.SetInitialIndexRate("42", rate)
+
+	idx := m.protocolIndex("default")
+	segment := int64(rate * indexSegmentTime.Seconds())
+	perSegment := int(segment / indexEntrySize(idx[0]))
+
+	t0 := time.Now()
+	rc := fileIndexRecorder{FakeConnection{id: "42"}, make(chan []protocol.FileInfo, 2*files), make(chan []protocol.FileInfo, 2*files)}
+	m.AddConnection(rc, rc)
+	m.ClusterConfig("42", m.clusterConfig("42"))
+
+	// The first segment is sent as the index, the rest as updates.
+	var sent []int
+	var total int
+	select {
+	case fs := <-rc.indexes:
+		sent = append(sent, len(fs))
+		total += len(fs)
+	case <-time.After(5 * time.Second):
+		t.Fatal("No index sent")
+	}
+	for total < files {
+		select {
+		case fs := <-rc.updates:
+			sent = append(sent, len(fs))
+			total += len(fs)
+		case <-time.After(5 * time.Second):
+			t.Fatalf("Index incomplete; sent %v", sent)
+		}
+	}
+	d := time.Since(t0)
+
+	if total != files {
+		t.Errorf("Files sent more than once: %v", sent)
+	}
+	if len(sent) < files/perSegment {
+		t.Errorf("Index sent in too few segments: %v", sent)
+	}
+	for _, n := range sent {
+		if n > perSegment {
+			t.Errorf("Segment larger than %d files: %v", perSegment, sent)
+		}
+	}
+	// The first segment is sent at once.
+	if min := time.Duration(files/perSegment-1) * indexSegmentTime; d < min*9/10 {
+		t.Errorf("Index sent in %v, expected at least %v", d, min)
+	}
+}
+
+func TestSettings(t *testing.T) {
+	fs := testutil.NewFakeFS()
+	fs.MkdirAll("/rw", 0755)
+	fs.MkdirAll("/ro", 0755)
+	fs.MkdirAll("/idle", 0755)
+
+	m := NewModel(2e6)
+	m.SetFilesystem(fs)
+	m.SetSymlinkPolicy(scanner.SymlinkRecreate)
+	m.SetPlaceholderGuard(false)
+	m.SetSizeCheck(false)
+	m.SetSettleTime(10 * time.Second)
+	m.SetIgnorePermissions(true)
+	m.SetPreserveCreateTime(true)
+	m.SetSparseFiles(true)
+	m.SetDiskReserve(1 << 20)
+	m.SetPullPriority([]string{"*.md"})
+	m.SetMaxScanDepth(2)
+	m.SetCopiers(3)
+	m.SetDiskIORate(1e6, 5e5)
+	m.SetMaxIndexAge(time.Hour)
+	m.AddRepo("rw", "/rw", []NodeConfiguration{{NodeID: "42"}, {NodeID: "43"}})
+	m.AddRepo("ro", "/ro", []NodeConfiguration{{NodeID: "42"}})
+	m.AddRepo("idle", "/idle", nil)
+	if err := m.StartRepoRW("rw", 4); err != nil {
+		t.Fatal(err)
+	}
+	m.StartRepoRO("ro")
+
+	s := m.Settings()
+	exp := ModelSettings{
+		BlockSize:         BlockSize,
+		Symlinks:          "recreate",
+		GuardPlaceholders: false,
+		CheckSizes:        false,
+		SettleTime:        10 * time.Second,
+		IgnorePerms:       true,
+		CreateTimes:       true,
+		SparseFiles:       true,
+		DiskReserve:       1 << 20,
+		PullPriority:      []string{"*.md"},
+		MaxScanDepth:      2,
+		Copiers:           3,
+		DiskReadRate:      1e6,
+		DiskWriteRate:     5e5,
+		MaxChangeRate:     2e6,
+		MaxIndexAge:       time.Hour,
+		Repos: map[string]RepoStatus{
+			"rw":   {Dir: "/rw", Nodes: []string{"42", "43"}, Started: true, ReadWrite: true, Threads: 4},
+			"ro":   {Dir: "/ro", Nodes: []string{"42"}, Started: true},
+			"idle": {Dir: "/idle"},
+		},
+	}
+	if !reflect.DeepEqual(s, exp) {
+		t.Errorf("Incorrect settings\n%+v\nexpected\n%+v", s, exp)
+	}
+}
+
+func TestScanConcurrentUpdate(t *testing.T) {
+	dir := filepath.Join(string(os.PathSeparator), "repo")
+	fs := testutil.NewFakeFS()
+	fs.MkdirAll(dir, 0755)
+	fs.WriteFile(filepath.Join(dir, "file"), []byte("contents"), 0644)
+
+	m := NewModel(1e6)
+	m.SetFilesystem(fs)
+	m.AddRepo("default", dir, nil)
+	m.ScanRepo("default")
+	old := m.CurrentRepoFile("default", "file")
+
+	// Hold the next scan while it is looking at the file.
+	walking := make(chan struct{})
+	proceed := make(chan struct{})
+	m.SetPlaceholderDetector(func(path string, info os.FileInfo) bool {
+		if filepath.Base(path) == "file" {
+			close(walking)
+			<-proceed
+		}
+		return false
+	})
+	done := make(chan error)
+	go func() {
+		done <- m.ScanRepo("default")
+	}()
+	<-walking
+
+	// Meanwhile a newer version of the file and a new file are pulled.
+	pulled := old
+	pulled.Version = old.Version + 1000
+	pulled.Modified++
+	m.updateLocal("default", pulled)
+	created := scanner.File{Name: "created", Flags: 0644, Modified: old.Modified, Version: old.Version + 1001}
+	m.updateLocal("default", created)
+	close(proceed)
+	if err := <-done; err != nil {
+		t.Fatal(err)
+	}
+
+	if f := m.CurrentRepoFile("default", "file"); f.Version != pulled.Version || f.Modified != pulled.Modified {
+		t.Errorf("Pulled file overwritten by scan; %v", f)
+	}
+	if f := m.CurrentRepoFile("default", "created"); f.Version != created.Version || f.Flags&protocol.FlagDeleted != 0 {
+		t.Errorf("Created file overwritten by scan; %v", f)
+	}
+
+	// Later scans are not affected.
+	m.SetPlaceholderDetector(nil)
+	m.ScanRepo("default")
+	if f := m.CurrentRepoFile("default", "created"); f.Flags&protocol.FlagDeleted == 0 {
+		t.Errorf("File missing on disk not deleted by scan; %v", f)
+	}
+}
+
+// pipeListener is a listener accepting in-memory connections made by dial.
+type pipeListener struct {
+	conns  chan net.Conn
+	closed chan struct{}
+}
+
+func newPipeListener() *pipeListener {
+	return &pipeListener{
+		conns:  make(chan net.Conn),
+		closed: make(chan struct{}),
+	}
+}
+
+func (l *pipeListener) dial() net.Conn {
+	c1, c2 := net.Pipe()
+	l.conns <- c1
+	return c2
+}
+
+func (l *pipeListener) Accept() (net.Conn, error) {
+	select {
+	case c := <-l.conns:
+		return c, nil
+	case <-l.closed:
+		return nil, errors.New("listener closed")
+	}
+}
+
+func (l *pipeListener) Close() error {
+	close(l.closed)
+	return nil
+}
+
+func (l *pipeListener) Addr() net.Addr {
+	return nil
+}
+
+func TestServe(t *testing.T) {
+	server := NewModel(1e6)
+	server.AddRepo("default", "testdata", []NodeConfiguration{{NodeID: "client"}, {NodeID: "rejected"}})
+	server.SetConnectionFilter(func(nodeID string, addr net.Addr) bool {
+		return nodeID != "rejected"
+	})
+
+	l := newPipeListener()
+	served := make(chan error)
+	go func() {
+		served <- server.Serve(l, func(conn net.Conn) (string, error) {
+			// The client sends its ID first.
+			buf := make([]byte, 16)
+			n, err := conn.Read(buf)
+			return string(buf[:n]), err
+		})
+	}()
+
+	connect := func(id string) {
+		client := NewModel(1e6)
+		client.AddRepo("default", "testdata", []NodeConfiguration{{NodeID: "server"}})
+		conn := l.dial()
+		if _, err := conn.Write([]byte(id)); err != nil {
+			t.Fatal(err)
+		}
+		client.AddConnection(conn, protocol.NewConnection("server", conn, conn, client))
+	}
+
+	connect("rejected")
+	connect("stranger")
+	connect("client")
+	for i := 0; !server.ConnectedTo("client"); i++ {
+		if i == 500 {
+			t.Fatal("Accepted connection not added")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	if server.ConnectedTo("rejected") {
+		t.Error("Filtered connection added")
+	}
+	if server.ConnectedTo("stranger") {
+		t.Error("Connection from unconfigured node added")
+	}
+
+	l.Close()
+	select {
+	case err := <-served:
+		if err == nil {
+			t.Error("Unexpected nil error")
+		}
+	case <-time.After(5 * time.Second):
+		t.Error("Serve still running after listener closed")
+	}
+}
+
+// dropWriter discards everything written to it once dropping is set, like a
+// link that fails without the sender noticing.
+type dropWriter struct {
+	io.Writer
+	dropping int32
+}
+
+func (w *dropWriter) Write(bs []byte) (int, error) {
+	if atomic.LoadInt32(&w.dropping) != 0 {
+		return len(bs), nil
+	}
+	return w.Writer.Write(bs)
+}
+
+// An index update lost on a failing link is sent again once the nodes
+// reconnect, as every connection starts with a full index.
+func TestIndexResentAfterReconnect(t *testing.T) {
+	srcFS := testutil.NewFakeFS()
+	srcFS.MkdirAll("/src", 0755)
+	srcFS.WriteFile("/src/a", []byte("a"), 0644)
+	dstFS := testutil.NewFakeFS()
+	dstFS.MkdirAll("/dst", 0755)
+
+	src := NewModel(1e6)
+	src.SetFilesystem(srcFS)
+	src.AddRepo("default", "/src", []NodeConfiguration{{NodeID: "dst"}})
+	src.ScanRepo("default")
+	dst := NewModel(1e6)
+	dst.SetFilesystem(dstFS)
+	dst.AddRepo("default", "/dst", []NodeConfiguration{{NodeID: "src"}})
+	dst.ScanRepo("default")
+
+	var links []io.Closer
+	connect := func() *dropWriter {
+		ar, aw := io.Pipe()
+		br, bw := io.Pipe()
+		dw := &dropWriter{Writer: bw}
+		links = []io.Closer{pipeCloser{ar, bw}, pipeCloser{br, aw}}
+		src.AddConnection(links[0], protocol.NewConnection("dst", ar, dw, src))
+		dst.AddConnection(links[1], protocol.NewConnection("src", br, aw, dst))
+		return dw
+	}
+	waitFor := func(cond func() bool) bool {
+		for i := 0; i < 100; i++ {
+			if cond() {
+				return true
+			}
+			time.Sleep(10 * time.Millisecond)
+		}
+		return false
+	}
+	received := func(name string) func() bool {
+		return func() bool {
+			return dst.CurrentGlobalFile("default", name).Name == name
+		}
+	}
+
+	dw := connect()
+	if !waitFor(received("a")) {
+		t.Fatal("Initial index not received")
+	}
+
+	// The update is lost on the way, but the sender has recorded it as sent.
+	atomic.StoreInt32(&dw.dropping, 1)
+	srcFS.WriteFile("/src/b", []byte("b"), 0644)
+	src.ScanRepo("default")
+	src.rmut.RLock()
+	idx := src.protocolIndex("default")
+	src.rmut.RUnlock()
+	src.pmut.RLock()
+	conn := src.protoConn["dst"]
+	src.pmut.RUnlock()
+	conn.Index("default", idx)
+	time.Sleep(100 * time.Millisecond)
+	if received("b")() {
+		t.Fatal("Dropped update received")
+	}
+
+	for _, l := range links {
+		l.Close()
+	}
+	if !waitFor(func() bool { return !src.ConnectedTo("dst") && !dst.ConnectedTo("src") }) {
+		t.Fatal("Link failure not noticed")
+	}
+
+	connect()
+	defer func() {
+		for _, l := range links {
+			l.Close()
+		}
+	}()
+	if !waitFor(received("b")) {
+		t.Error("Lost update not resent after reconnect")
+	}
+}
+
+// A second connection between two nodes that are already connected, as from
+// both dialing each other at once, is closed without affecting the first.
+func TestDuplicateConnectionClosed(t *testing.T) {
+	srcFS := testutil.NewFakeFS()
+	srcFS.MkdirAll("/src", 0755)
+	srcFS.WriteFile("/src/a", []byte("a"), 0644)
+	dstFS := testutil.NewFakeFS()
+	dstFS.MkdirAll("/dst", 0755)
+
+	src := NewModel(1e6)
+	src.SetFilesystem(srcFS)
+	src.AddRepo("default", "/src", []NodeConfiguration{{NodeID: "dst"}})
+	src.ScanRepo("default")
+	dst := NewModel(1e6)
+	dst.SetFilesystem(dstFS)
+	dst.AddRepo("default", "/dst", []NodeConfiguration{{NodeID: "src"}})
+	dst.ScanRepo("default")
+
+	var links []io.Closer
+	connect := func() {
+		ar, aw := io.Pipe()
+		br, bw := io.Pipe()
+		links = append(links, pipeCloser{ar, bw}, pipeCloser{br, aw})
+		src.AddConnection(links[len(links)-2], protocol.NewConnection("dst", ar, bw, src))
+		dst.AddConnection(links[len(links)-1], protocol.NewConnection("src", br, aw, dst))
+	}
+	defer func() {
+		for _, l := range links {
+			l.Close()
+		}
+	}()
+
+	connect()
+	for i := 0; !dst.IndexReceived("src"); i++ {
+		if i == 100 {
+			t.Fatal("Initial index not received")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	connect()
+	time.Sleep(2 * indexDropDelay)
+
+	if !src.ConnectedTo("dst") || !dst.ConnectedTo("src") {
+		t.Fatal("Existing connection closed along with the duplicate")
+	}
+	if f := dst.CurrentGlobalFile("default", "a"); f.Name != "a" {
+		t.Error("Index of the existing connection dropped")
+	}
+	dst.pmut.RLock()
+	conn := dst.protoConn["src"]
+	dst.pmut.RUnlock()
+	if data, err := conn.Request("default", "a", 0, 1); err != nil || string(data) != "a" {
+		t.Errorf("Request over the existing connection: %q, %v", data, err)
+	}
+}
+
+func TestBroadcastHeldWhileBusy(t *testing.T) {
+	fs := testutil.NewFakeFS()
+	fs.MkdirAll("/repo", 0755)
+	fs.WriteFile("/repo/a", []byte("a"), 0644)
+
+	m := NewModel(1e6)
+	m.SetFilesystem(fs)
+	m.AddRepo("default", "/repo", []NodeConfiguration{{NodeID: "42"}})
+	m.ScanRepo("default")
+	rc := indexRecorder{FakeConnection{id: "42"}, make(chan string, 10)}
+	m.AddConnection(rc, rc)
+	m.ClusterConfig("42", m.clusterConfig("42"))
+	select {
+	case <-rc.indexes:
+	case <-time.After(time.Second):
+		t.Fatal("Initial index not sent")
+	}
+
+	c := newFakeClock()
+	b := newBroadcastState(c.Now())
+
+	// Index messages are sent before broadcastIndexes returns.
+	broadcast := func(now time.Time) bool {
+		m.broadcastIndexes(b, now)
+		select {
+		case <-rc.indexes:
+			return true
+		default:
+			return false
+		}
+	}
+
+	c.advance(idxBcastInterval)
+	if !broadcast(c.Now()) {
+		t.Fatal("Changes from the scan not broadcast")
+	}
+	if broadcast(c.Now()) {
+		t.Fatal("Broadcast without changes")
+	}
+
+	atomic.StoreInt64(&m.repoStats["default"].OpenFiles, busyOpenFiles)
+	m.updateLocal("default", scanner.File{Name: "b", Version: 1, Modified: 1234567890})
+
+	c.advance(idxBcastInterval)
+	start := c.Now()
+	for c.Now().Sub(start) < idxBcastHoldBusy {
+		if broadcast(c.Now()) {
+			t.Fatalf("Broadcast after %v while busy", c.Now().Sub(start))
+		}
+		c.advance(idxBcastInterval)
+	}
+	if !broadcast(c.Now()) {
+		t.Errorf("Not broadcast after %v while busy", c.Now().Sub(start))
+	}
+}
+
+func TestConvergenceLatency(t *testing.T) {
+	sub := events.Default.Subscribe(events.ChangesConverged)
+	defer events.Default.Unsubscribe(sub)
+
+	dir := filepath.Join(string(os.PathSeparator), "repo")
+	fs := testutil.NewFakeFS()
+	fs.MkdirAll(dir, 0755)
+	fs.WriteFile(filepath.Join(dir, "a"), []byte("a"), 0644)
+
+	m := NewModel(1e6)
+	m.SetFilesystem(fs)
+	m.AddRepo("default", dir, []NodeConfiguration{{NodeID: "42"}, {NodeID: "43"}})
+	m.ScanRepo("default")
+	old := m.CurrentRepoFile("default", "a")
+	for _, id := range []string{"42", "43"} {
+		fc := FakeConnection{id: id}
+		m.AddConnection(fc, fc)
+		m.Index(id, "default", []protocol.FileInfo{fileInfoFromFile(old)})
+	}
+
+	// A local change, applied by one node a while later.
+	fs.WriteFile(filepath.Join(dir, "a"), []byte("changed"), 0644)
+	fs.Chtimes(filepath.Join(dir, "a"), time.Unix(1234567890, 0), time.Unix(1234567890, 0))
+	m.ScanRepo("default")
+	lf := m.CurrentRepoFile("default", "a")
+	if lf.Version == old.Version {
+		t.Fatal("Change not scanned")
+	}
+
+	const delay = 50 * time.Millisecond
+	time.Sleep(delay)
+	m.IndexUpdate("42", "default", []protocol.FileInfo{fileInfoFromFile(lf)})
+	m.IndexUpdate("43", "default", []protocol.FileInfo{fileInfoFromFile(old)})
+
+	stats := m.ConvergenceStats()
+	if len(stats) != 1 {
+		t.Fatalf("Incorrect convergence stats %+v", stats)
+	}
+	s := stats["42"]
+	if s.Changes != 1 || s.Last < delay || s.Last > 5*time.Second || s.Mean != s.Last || s.Max != s.Last {
+		t.Errorf("Incorrect convergence stats %+v", s)
+	}
+	ev, err := sub.Poll(time.Second)
+	if err != nil {
+		t.Fatal("No event for converged changes")
+	}
+	if data := ev.Data.(map[string]interface{}); data["node"] != "42" || data["changes"] != 1 || data["max"] != s.Last {
+		t.Errorf("Incorrect event data %v", data)
+	}
+
+	// Announcing the version again is not another convergence.
+	m.IndexUpdate("42", "default", []protocol.FileInfo{fileInfoFromFile(lf)})
+	if s := m.ConvergenceStats()["42"]; s.Changes != 1 {
+		t.Errorf("Incorrect number of changes %d after repeated announcement", s.Changes)
+	}
+
+	// The other node catches up later.
+	time.Sleep(delay)
+	m.IndexUpdate("43", "default", []protocol.FileInfo{fileInfoFromFile(lf)})
+	if s43 := m.ConvergenceStats()["43"]; s43.Changes != 1 || s43.Last < s.Last+delay {
+		t.Errorf("Incorrect convergence stats %+v for late node", s43)
+	}
+}
+
+// Local changes stop being waited for when the node disconnects, is removed
+// from the repository, announces a newer version, or never announces them.
+func TestConvergencePending(t *testing.T) {
+	dir := filepath.Join(string(os.PathSeparator), "repo")
+	fs := testutil.NewFakeFS()
+	fs.MkdirAll(dir, 0755)
+
+	clk := newFakeClock()
+	m := newModel(1e6, clk)
+	m.SetFilesystem(fs)
+	m.AddRepo("default", dir, []NodeConfiguration{{NodeID: "42"}, {NodeID: "43"}, {NodeID: "44"}})
+	for _, id := range []string{"42", "43", "44"} {
+		fc := FakeConnection{id: id}
+		m.AddConnection(fc, fc)
+	}
+
+	pending := func() map[string]int {
+		m.cmut.Lock()
+		defer m.cmut.Unlock()
+		res := make(map[string]int)
+		for _, c := range m.changes["default"] {
+			for node := range c.nodes {
+				res[node]++
+			}
+		}
+		return res
+	}
+	change := func(name string) scanner.File {
+		fs.WriteFile(filepath.Join(dir, name), []byte(name), 0644)
+		m.ScanRepo("default")
+		return m.CurrentRepoFile("default", name)
+	}
+
+	a := change("a")
+	if p := pending(); p["42"] != 1 || p["43"] != 1 || p["44"] != 1 {
+		t.Fatalf("Incorrect pending changes %v", p)
+	}
+
+	// A newer version ends the wait for the node, but isn't counted.
+	newer := fileInfoFromFile(a)
+	newer.Version += 1000
+	m.IndexUpdate("42", "default", []protocol.FileInfo{newer})
+	if p := pending(); p["42"] != 0 {
+		t.Errorf("Incorrect pending changes %v after newer version", p)
+	}
+	if s := m.ConvergenceStats()["42"]; s.Changes != 0 {
+		t.Errorf("Newer version counted as convergence: %+v", s)
+	}
+
+	m.Close("43", io.EOF)
+	if p := pending(); p["43"] != 0 {
+		t.Errorf("Incorrect pending changes %v after disconnect", p)
+	}
+
+	m.SetRepoNodes("default", []string{"42", "43"})
+	if p := pending(); p["44"] != 0 {
+		t.Errorf("Incorrect pending changes %v after removal from repository", p)
+	}
+	if len(m.changes["default"]) != 0 {
+		t.Errorf("Changes kept with no node to wait for: %v", m.changes["default"])
+	}
+
+	// A change the node never announces, e.g. as it ignores the file, is
+	// given up on eventually.
+	change("b")
+	clk.advance(convergenceExpiry + time.Second)
+	change("c")
+	if p := pending(); p["42"] != 1 {
+		t.Errorf("Incorrect pending changes %v after expiry", p)
+	}
+}
+
+// indexNames returns the sorted names in the local index of the repository.
+func indexNames(m *Model, repo string) []string {
+	var names []string
+	for _, f := range m.protocolIndex(repo) {
+		names = append(names, f.Name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+func TestFilters(t *testing.T) {
+	dir := filepath.Join(string(os.PathSeparator), "repo")
+	fs := testutil.NewFakeFS()
+	fs.MkdirAll(dir, 0755)
+	fs.WriteFile(filepath.Join(dir, "notes"), []byte("nothing to see"), 0644)
+	fs.WriteFile(filepath.Join(dir, "plans"), []byte("SECRET plans"), 0644)
+	fs.WriteFile(filepath.Join(dir, "id.key"), []byte("key"), 0644)
+
+	m := NewModel(1e6)
+	m.SetFilesystem(fs)
+	m.AddRepo("default", dir, []NodeConfiguration{{NodeID: "some node"}})
+	m.SetNameFilter(func(name string) bool {
+		return filepath.Ext(name) != ".key"
+	})
+	m.SetContentFilter(func(name string, head []byte) bool {
+		return !bytes.Contains(head, []byte("SECRET"))
+	}, 1024)
+	m.ScanRepo("default")
+
+	if names := indexNames(m, "default"); !reflect.DeepEqual(names, []string{"notes"}) {
+		t.Errorf("Incorrect index %v", names)
+	}
+	for _, name := range []string{"plans", "id.key"} {
+		if _, err := m.Request("some node", "default", name, 0, 3); err == nil {
+			t.Errorf("Vetoed file %q served", name)
+		}
+	}
+
+	// A file already in the index that gets a secret is withheld, not
+	// announced as deleted.
+	fs.WriteFile(filepath.Join(dir, "notes"), []byte("SECRET notes"), 0644)
+	fs.Chtimes(filepath.Join(dir, "notes"), time.Unix(1234567890, 0), time.Unix(1234567890, 0))
+	m.ScanRepo("default")
+	for _, f := range m.protocolIndex("default") {
+		if f.Name != "notes" {
+			t.Errorf("Unexpected file %q in index", f.Name)
+			continue
+		}
+		if f.Flags&protocol.FlagInvalid == 0 || protocol.InvalidReason(f.Flags) != protocol.InvalidReasonFiltered || f.Flags&protocol.FlagDeleted != 0 {
+			t.Errorf("Incorrect flags %x for withheld file", f.Flags)
+		}
+	}
+	if _, err := m.Request("some node", "default", "notes", 0, 6); err != ErrInvalid {
+		t.Errorf("Incorrect error %v requesting withheld file", err)
+	}
+}
+
+func TestSyncEstimate(t *testing.T) {
+	var t0 = time.Unix(1234567890, 0)
+	var tests = []struct {
+		from, to syncSample
+		rate     int64
+		eta      time.Duration
+	}{
+		// Steady progress
+		{syncSample{t0, 0, 1 << 20}, syncSample{t0.Add(time.Minute), 60 << 10, 1<<20 - 60<<10}, 1 << 10, (1<<10 - 60) * time.Second},
+		// In sync
+		{syncSample{t0, 0, 1 << 20}, syncSample{t0.Add(time.Minute), 1 << 20, 0}, 1 << 20 / 60, 0},
+		// Too slow to tell
+		{syncSample{t0, 0, 1 << 20}, syncSample{t0.Add(time.Minute), 1 << 10, 1<<20 - 1<<10}, 17, 0},
+		// Needing more than was pulled
+		{syncSample{t0, 0, 1 << 20}, syncSample{t0.Add(time.Minute), 1 << 20, 4 << 20}, 1 << 20 / 60, 0},
+		// Counters reset
+		{syncSample{t0, 1 << 20, 1 << 20}, syncSample{t0.Add(time.Minute), 0, 1 << 20}, 0, 0},
+		// Beyond maxSyncETA
+		{syncSample{t0, 0, 1 << 40}, syncSample{t0.Add(time.Minute), 60 << 10, 1 << 40}, 1 << 10, 0},
+		// No time passed
+		{syncSample{t0, 0, 1 << 20}, syncSample{t0, 1 << 10, 1 << 20}, 0, 0},
+	}
+
+	for i, tc := range tests {
+		s := syncEstimate(tc.from, tc.to)
+		if s.BytesPerSecond != tc.rate {
+			t.Errorf("%d: incorrect rate %d != %d", i, s.BytesPerSecond, tc.rate)
+		}
+		if s.ETA != tc.eta {
+			t.Errorf("%d: incorrect ETA %v != %v", i, s.ETA, tc.eta)
+		}
+		if s.BytesRemaining != tc.to.remaining {
+			t.Errorf("%d: incorrect remaining %d != %d", i, s.BytesRemaining, tc.to.remaining)
+		}
+	}
+}
+
+func TestSyncRateWindow(t *testing.T) {
+	var r syncRate
+	c := newFakeClock()
+
+	var pulled int64
+	var s SyncStatus
+	for i := 0; i < 10; i++ {
+		s = r.add(syncSample{at: c.Now(), pulled: pulled, remaining: 100 << 20})
+		c.advance(20 * time.Second)
+		pulled += 20 << 10
+	}
+	if s.Period != syncRateWindow {
+		t.Errorf("Incorrect period %v != %v", s.Period, syncRateWindow)
+	}
+	if s.BytesSynced != 60<<10 {
+		t.Errorf("Incorrect bytes synced %d", s.BytesSynced)
+	}
+	if len(r.samples) > 4 {
+		t.Errorf("%d samples kept", len(r.samples))
+	}
+
+	// Calls further apart than the window measure from the previous one.
+	c.advance(time.Hour)
+	s = r.add(syncSample{at: c.Now(), pulled: pulled, remaining: 100 << 20})
+	if s.Period != time.Hour+20*time.Second || s.BytesSynced != 20<<10 {
+		t.Errorf("Incorrect status %+v after a pause", s)
 	}
 }
@@ -0,0 +1,107 @@
+package main
+
+import (
+	"os"
+	"sort"
+	"strings"
+
+	"github.com/calmh/syncthing/cid"
+	"github.com/calmh/syncthing/lamport"
+	"github.com/calmh/syncthing/protocol"
+	"github.com/calmh/syncthing/scanner"
+)
+
+type repoMounts struct {
+	policies  map[string]scanner.MountPolicy   // path relative to repo -> policy
+	unmounted []string                         // guarded paths not mounted at last scan
+	deviceID  func(os.FileInfo) (uint64, bool) // overrides the scanner's device lookup, for testing
+}
+
+// SetMounts sets the policy for directories in the repository that may be
+// mount points. The paths are relative to the repository directory.
+func (m *Model) SetMounts(repo string, policies map[string]scanner.MountPolicy) {
+	m.rmut.Lock()
+	m.mounts[repo] = &repoMounts{policies: policies}
+	m.rmut.Unlock()
+}
+
+// mountPolicies returns the mount point policies for the repository and the
+// device lookup to use, if not the default. Must be called with rmut held.
+func (m *Model) mountPolicies(repo string) (map[string]scanner.MountPolicy, func(os.FileInfo) (uint64, bool)) {
+	if rm, ok := m.mounts[repo]; ok {
+		return rm.policies, rm.deviceID
+	}
+	return nil, nil
+}
+
+// setUnmounted records the guarded paths that were found not mounted and
+// returns the files known below them, marked invalid as unavailable. Those
+// files are kept in the index so that they are neither deleted here nor on
+// other nodes while the filesystem is away.
+func (m *Model) setUnmounted(repo string, paths []string) []scanner.File {
+	sort.Strings(paths)
+	m.rmut.Lock()
+	var changed bool
+	if rm, ok := m.mounts[repo]; ok {
+		changed = strings.Join(rm.unmounted, "\x00") != strings.Join(paths, "\x00")
+		rm.unmounted = paths
+	}
+	rf := m.repoFiles[repo]
+	m.rmut.Unlock()
+
+	if len(paths) == 0 {
+		return nil
+	}
+	if changed {
+		warnf("Repository %q: %s not mounted; files below will not be synced until it is", repo, strings.Join(paths, ", "))
+	}
+
+	var fs []scanner.File
+	for _, f := range rf.Have(cid.LocalID) {
+		if !below(f.Name, paths) || f.Flags&protocol.FlagDeleted != 0 {
+			continue
+		}
+		if !f.Invalid || f.InvalidReason != protocol.InvalidReasonUnavailable {
+			f.Invalid = true
+			f.InvalidReason = protocol.InvalidReasonUnavailable
+			f.Version = lamport.Default.Tick(f.Version)
+		}
+		fs = append(fs, f)
+	}
+	return fs
+}
+
+// isUnmounted returns true if the file is below a guarded path that was not
+// mounted at the last scan. Must be called with rmut held.
+func (m *Model) isUnmounted(repo, name string) bool {
+	rm, ok := m.mounts[repo]
+	return ok && below(name, rm.unmounted)
+}
+
+// below returns true if name is one of paths or inside one of them.
+func below(name string, paths []string) bool {
+	for _, p := range paths {
+		if name == p || strings.HasPrefix(name, p+string(os.PathSeparator)) {
+			return true
+		}
+	}
+	return false
+}
+
+// repoMountPolicies returns the mount point policies configured for the
+// repository.
+func repoMountPolicies(repo RepositoryConfiguration) map[string]scanner.MountPolicy {
+	policies := make(map[string]scanner.MountPolicy, len(repo.Mounts))
+	for _, mc := range repo.Mounts {
+		switch mc.Policy {
+		case "content", "":
+			policies[mc.Path] = scanner.MountContent
+		case "guard":
+			policies[mc.Path] = scanner.MountGuard
+		default:
+			warnf("Unknown mount policy %q for %q in repository %q; scanning as content", mc.Policy, mc.Path, repo.ID)
+			policies[mc.Path] = scanner.MountContent
+		}
+	}
+	return policies
+}
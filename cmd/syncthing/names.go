@@ -0,0 +1,23 @@
+package main
+
+// A NameMapper translates file names between their local form, as found in
+// the repository directory, and the form announced to other nodes. Nodes
+// that store the same name differently, such as in another Unicode
+// normalization form, then agree on the file. Both forms use the native path
+// separator; converting it to and from slashes is done separately.
+type NameMapper interface {
+	ToWire(local string) string
+	ToLocal(wire string) string
+}
+
+type identityMapper struct{}
+
+func (identityMapper) ToWire(local string) string { return local }
+func (identityMapper) ToLocal(wire string) string { return wire }
+
+// SetNameMapper sets how file names are translated between their local and
+// wire forms. By default names are used as they are. It must be called
+// before any repositories are added.
+func (m *Model) SetNameMapper(nm NameMapper) {
+	m.names = nm
+}
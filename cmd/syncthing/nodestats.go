@@ -0,0 +1,120 @@
+package main
+
+import (
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"time"
+)
+
+// NodeDataStats is the file data exchanged with a node. Unlike the
+// connection statistics it only counts the contents of requested blocks,
+// and accumulates across reconnects until reset.
+type NodeDataStats struct {
+	BytesServed     int64     // sent in response to requests from the node
+	BytesDownloaded int64     // received in response to requests to the node
+	Since           time.Time // when counting started, or was last reset
+}
+
+// The file in the configuration directory holding the node data statistics
+// between runs.
+const nodeStatsFile = "nodestats.json"
+
+func (m *Model) countNodeData(nodeID string, served, downloaded int64) {
+	m.nmut.Lock()
+	ds, ok := m.nodeData[nodeID]
+	if !ok {
+		ds = &NodeDataStats{Since: m.clock.Now()}
+		m.nodeData[nodeID] = ds
+	}
+	ds.BytesServed += served
+	ds.BytesDownloaded += downloaded
+	m.nmut.Unlock()
+}
+
+// NodeDataStats returns the file data exchanged with each node that data has
+// been exchanged with.
+func (m *Model) NodeDataStats() map[string]NodeDataStats {
+	m.nmut.Lock()
+	defer m.nmut.Unlock()
+	res := make(map[string]NodeDataStats, len(m.nodeData))
+	for node, ds := range m.nodeData {
+		res[node] = *ds
+	}
+	return res
+}
+
+// ResetNodeDataStats restarts counting for the given node, or for all nodes
+// when nodeID is empty.
+func (m *Model) ResetNodeDataStats(nodeID string) {
+	m.nmut.Lock()
+	if nodeID == "" {
+		m.nodeData = make(map[string]*NodeDataStats)
+	} else {
+		delete(m.nodeData, nodeID)
+	}
+	m.nmut.Unlock()
+}
+
+// SaveNodeDataStats writes the node data statistics to the given directory,
+// to be picked up by LoadNodeDataStats on the next start.
+func (m *Model) SaveNodeDataStats(dir string) error {
+	name := filepath.Join(dir, nodeStatsFile)
+	fd, err := os.Create(name + ".tmp")
+	if err != nil {
+		return err
+	}
+	err = json.NewEncoder(fd).Encode(m.NodeDataStats())
+	if cerr := fd.Close(); err == nil {
+		err = cerr
+	}
+	if err != nil {
+		os.Remove(name + ".tmp")
+		return err
+	}
+	return Rename(name+".tmp", name)
+}
+
+// LoadNodeDataStats reads the node data statistics saved by
+// SaveNodeDataStats and adds them to the current counts. A missing file is
+// not an error.
+func (m *Model) LoadNodeDataStats(dir string) error {
+	fd, err := os.Open(filepath.Join(dir, nodeStatsFile))
+	if os.IsNotExist(err) {
+		return nil
+	} else if err != nil {
+		return err
+	}
+	defer fd.Close()
+
+	var saved map[string]NodeDataStats
+	if err := json.NewDecoder(fd).Decode(&saved); err != nil {
+		return err
+	}
+
+	m.nmut.Lock()
+	for node, s := range saved {
+		ds, ok := m.nodeData[node]
+		if !ok {
+			ds = &NodeDataStats{Since: s.Since}
+			m.nodeData[node] = ds
+		} else if s.Since.Before(ds.Since) {
+			ds.Since = s.Since
+		}
+		ds.BytesServed += s.BytesServed
+		ds.BytesDownloaded += s.BytesDownloaded
+	}
+	m.nmut.Unlock()
+	return nil
+}
+
+// saveNodeDataStatsLoop saves the node data statistics at the given
+// interval.
+func saveNodeDataStatsLoop(m *Model, dir string, interval time.Duration) {
+	for {
+		time.Sleep(interval)
+		if err := m.SaveNodeDataStats(dir); err != nil {
+			warnln("Saving node statistics:", err)
+		}
+	}
+}
@@ -0,0 +1,91 @@
+package main
+
+import (
+	"path"
+	"path/filepath"
+	"sort"
+	"strings"
+
+	"github.com/calmh/syncthing/scanner"
+)
+
+// SetPullPriority sets patterns for files that are pulled before all other
+// needed files, such as small files that make a working directory usable
+// while large ones are still on the way. Patterns without a slash are
+// matched against the file name, as in .stignore; patterns with one are
+// matched against the path within the repository, where a ** element
+// matches any number of directories.
+func (m *Model) SetPullPriority(patterns []string) {
+	m.rmut.Lock()
+	m.priority = append([]string(nil), patterns...)
+	m.rmut.Unlock()
+}
+
+// isPriority returns true if the file matches a priority pattern. Must be
+// called with rmut held.
+func (m *Model) isPriority(name string) bool {
+	for _, p := range m.priority {
+		if matchPattern(p, name) {
+			return true
+		}
+	}
+	return false
+}
+
+// prioritized returns the files in the order they are pulled: those matching
+// priority patterns first, each group sorted by name. Must be called with
+// rmut held.
+func (m *Model) prioritized(fs []scanner.File) []scanner.File {
+	sort.Sort(fileList(fs))
+	if len(m.priority) == 0 {
+		return fs
+	}
+	var first, rest []scanner.File
+	for _, f := range fs {
+		if m.isPriority(f.Name) {
+			first = append(first, f)
+		} else {
+			rest = append(rest, f)
+		}
+	}
+	return append(first, rest...)
+}
+
+type fileList []scanner.File
+
+func (l fileList) Len() int           { return len(l) }
+func (l fileList) Less(a, b int) bool { return l[a].Name < l[b].Name }
+func (l fileList) Swap(a, b int)      { l[a], l[b] = l[b], l[a] }
+
+// matchPattern returns true if the file name, with native separators,
+// matches the pattern.
+func matchPattern(pattern, name string) bool {
+	name = filepath.ToSlash(name)
+	if !strings.Contains(pattern, "/") {
+		ok, _ := path.Match(pattern, path.Base(name))
+		return ok
+	}
+	pattern = strings.TrimPrefix(pattern, "/")
+	return matchElements(strings.Split(pattern, "/"), strings.Split(name, "/"))
+}
+
+func matchElements(pats, names []string) bool {
+	for len(pats) > 0 {
+		if pats[0] == "**" {
+			for i := 0; i <= len(names); i++ {
+				if matchElements(pats[1:], names[i:]) {
+					return true
+				}
+			}
+			return false
+		}
+		if len(names) == 0 {
+			return false
+		}
+		if ok, _ := path.Match(pats[0], names[0]); !ok {
+			return false
+		}
+		pats, names = pats[1:], names[1:]
+	}
+	return len(names) == 0
+}
@@ -2,15 +2,20 @@ package main
 
 import (
 	"bytes"
+	"crypto/sha256"
 	"errors"
+	"fmt"
 	"os"
 	"path/filepath"
+	"strings"
 	"time"
 
 	"github.com/calmh/syncthing/buffers"
 	"github.com/calmh/syncthing/cid"
+	"github.com/calmh/syncthing/events"
 	"github.com/calmh/syncthing/protocol"
 	"github.com/calmh/syncthing/scanner"
+	"github.com/calmh/syncthing/vfs"
 )
 
 type requestResult struct {
@@ -18,18 +23,36 @@ type requestResult struct {
 	file     scanner.File
 	filepath string // full filepath name
 	offset   int64
+	size     int
+	parts    []scanner.Block // the blocks requested together, if more than one
+	hash     []byte          // of the block, when a single one was requested
 	data     []byte
 	err      error
+	batch    []requestResult // of the requests batched together, if any
 }
 
 type openFile struct {
 	filepath     string // full filepath name
 	temp         string // temporary filename
 	availability uint64 // availability bitset
-	file         *os.File
-	err          error // error when opening or writing to file, all following operations are cancelled
-	outstanding  int   // number of requests we still have outstanding
-	done         bool  // we have sent all requests for this file
+	file         vfs.File
+	err          error            // error when opening or writing to file, all following operations are cancelled
+	outstanding  int              // number of requests we still have outstanding
+	done         bool             // we have sent all requests for this file
+	cancel       <-chan struct{}  // closed when the pull is canceled
+	zeros        map[int64]bool   // offsets of zero blocks left as holes
+	verified     int              // blocks checked against their hash before being written
+	served       map[string]int64 // nodeID -> bytes written from the node
+	badData      bool             // a node served data not matching the block hashes
+}
+
+func (of openFile) canceled() bool {
+	select {
+	case <-of.cancel:
+		return true
+	default:
+		return false
+	}
 }
 
 type activityMap map[string]int
@@ -58,7 +81,44 @@ func (m activityMap) decrease(node string) {
 	m[node]--
 }
 
-var errNoNode = errors.New("no available source node")
+// A round of the puller is split into phases, executed in this order. Files
+// are deleted only once all creates and updates are done, and directories
+// only once the files in them are gone.
+type pullPhase int
+
+const (
+	phaseUpdate      pullPhase = iota // create and update files and directories
+	phaseDeleteFiles                  // remove deleted files
+	phaseDeleteDirs                   // remove deleted directories, deepest first
+	phaseDirMetadata                  // fix up directory permissions and modification times
+)
+
+func (p pullPhase) String() string {
+	switch p {
+	case phaseUpdate:
+		return "update"
+	case phaseDeleteFiles:
+		return "deleteFiles"
+	case phaseDeleteDirs:
+		return "deleteDirs"
+	case phaseDirMetadata:
+		return "dirMetadata"
+	default:
+		return "unknown"
+	}
+}
+
+var (
+	errNoNode        = errors.New("no available source node")
+	errShortResponse = errors.New("short block response")
+	errBlockHash     = errors.New("block hash mismatch")
+)
+
+// The original of a file being replaced is kept under its temporary name
+// with this suffix until the update has succeeded. Being a temporary name,
+// it is not picked up by the scanner. Originals left behind when the
+// process stopped halfway are recovered when pulling starts.
+const backupSuffix = ".orig"
 
 type puller struct {
 	repo              string
@@ -70,6 +130,15 @@ type puller struct {
 	requestSlots      chan bool
 	blocks            chan bqBlock
 	requestResults    chan requestResult
+	copyResults       chan copyResult
+	round             *PullReport // the current round, if anything was done
+	phase             pullPhase
+	phaseStart        time.Time         // zero when not in a phase
+	phaseOps          int               // operations in the round when the phase started
+	unavailable       map[string]uint64 // name -> version skipped as not available
+	noSpace           map[string]uint64 // name -> version deferred for lack of disk space
+	sourcesGen        uint64            // model.sourcesChanged() when unavailable was last reset
+	sourcesChecked    time.Time         // when unavailable was last reset
 }
 
 func newPuller(repo, dir string, model *Model, slots int) *puller {
@@ -83,6 +152,7 @@ func newPuller(repo, dir string, model *Model, slots int) *puller {
 		requestSlots:      make(chan bool, slots),
 		blocks:            make(chan bqBlock),
 		requestResults:    make(chan requestResult),
+		copyResults:       make(chan copyResult),
 	}
 
 	if slots > 0 {
@@ -105,6 +175,8 @@ func newPuller(repo, dir string, model *Model, slots int) *puller {
 }
 
 func (p *puller) run() {
+	p.recoverOriginals()
+
 	go func() {
 		// fill blocks queue when there are free slots
 		for {
@@ -122,15 +194,24 @@ func (p *puller) run() {
 	changed := true
 
 	for {
+		p.beginPhase(phaseUpdate)
+
 		// Run the pulling loop as long as there are blocks to fetch
+		stats := p.model.pullStats(p.repo)
 	pull:
 		for {
+			stats.setOpenFiles(len(p.openFiles))
 			select {
 			case res := <-p.requestResults:
 				p.model.setState(p.repo, RepoSyncing)
 				changed = true
-				p.requestSlots <- true
-				p.handleRequestResult(res)
+				if p.handleRequestResult(res) {
+					// Request was fully handled, free up the slot
+					p.requestSlots <- true
+				}
+
+			case res := <-p.copyResults:
+				p.handleCopyResult(res)
 
 			case b := <-p.blocks:
 				p.model.setState(p.repo, RepoSyncing)
@@ -159,12 +240,16 @@ func (p *puller) run() {
 			}
 		}
 
+		stats.setOpenFiles(0)
+
 		if changed {
 			p.model.setState(p.repo, RepoCleaning)
-			p.fixupDirectories()
+			p.cleanup()
 			changed = false
 		}
 
+		p.finishRound()
+
 		p.model.setState(p.repo, RepoIdle)
 
 		// Do a rescan if it's time for it
@@ -183,7 +268,9 @@ func (p *puller) run() {
 		}
 
 		// Queue more blocks to fetch, if any
-		p.queueNeededBlocks()
+		if p.queueNeededBlocks() {
+			changed = true
+		}
 	}
 }
 
@@ -202,51 +289,151 @@ func (p *puller) runRO() {
 	}
 }
 
-func (p *puller) fixupDirectories() {
-	var deleteDirs []string
-	filepath.Walk(p.dir, func(path string, info os.FileInfo, err error) error {
-		if !info.IsDir() {
-			return nil
-		}
+// cleanup runs the phases that follow the creates and updates of a round.
+func (p *puller) cleanup() {
+	if deletes, hold := p.model.holdDeletes(p.repo); !hold {
+		p.beginPhase(phaseDeleteFiles)
+		p.deleteFiles(deletes)
+		p.beginPhase(phaseDeleteDirs)
+		p.deleteDirectories()
+	}
+	p.beginPhase(phaseDirMetadata)
+	p.fixupDirectories()
+	p.endPhase()
+}
 
-		rn, err := filepath.Rel(p.dir, path)
-		if err != nil {
-			return nil
+// deleteFiles removes the files among the needed deletions, as checked
+// against the delete limits, that are still deleted in the cluster.
+func (p *puller) deleteFiles(deletes []scanner.File) {
+	listed := make(map[string][]os.FileInfo)
+	for _, f := range deletes {
+		if f.Flags&protocol.FlagDirectory != 0 || !p.model.globalDelete(p.repo, f.Name) {
+			continue
+		}
+		if p.model.skipPull(p.repo, f) || !p.handlesSymlink(f) || p.unsafePath(f) {
+			continue
 		}
+		if debugPull {
+			dlog.Printf("pull: delete %q / %q", p.repo, f.Name)
+		}
+		path := filepath.Join(p.dir, f.Name)
+		if p.caseVariant(listed, path) {
+			// The name is taken by a file since pulled under a name
+			// differing only in case.
+			p.model.updateLocal(p.repo, f)
+			p.model.fileEvent(events.FilePulled, p.repo, f)
+			continue
+		}
+		p.model.fs.Remove(filepath.Join(p.dir, defTempNamer.TempName(f.Name)))
+		var err error
+		if keep := p.model.keepVersions(); keep > 0 {
+			err = archiveVersion(p.model.fs, p.dir, f.Name, path)
+			pruneVersions(p.model.fs, p.dir, f.Name, keep)
+		} else {
+			err = p.model.fs.Remove(path)
+		}
+		if err != nil && !os.IsNotExist(err) {
+			p.model.pullFailed(p.repo, f, err)
+			p.failed(f.Name, err)
+			continue
+		}
+		p.report().FilesDeleted++
+		p.model.updateLocal(p.repo, f)
+		p.model.fileEvent(events.FilePulled, p.repo, f)
+	}
+}
 
-		if rn == "." {
+// deleteDirectories removes the directories that have been deleted in the
+// cluster, deepest first. Directories that could not be removed, i.e. that
+// still contain something, keep their entry in the local index and are
+// retried on the next round.
+func (p *puller) deleteDirectories() {
+	var deleteDirs []scanner.File
+	internal := p.model.internalPaths()
+	vfs.Walk(p.model.fs, p.dir, func(path string, info os.FileInfo, err error) error {
+		if err != nil || !info.IsDir() {
 			return nil
 		}
 
-		cur := p.model.CurrentGlobalFile(p.repo, rn)
-		if cur.Name != rn {
-			// No matching dir in current list; weird
+		rn, err := filepath.Rel(p.dir, path)
+		if err != nil || rn == "." {
 			return nil
 		}
+		if isInternal(internal, rn) {
+			return filepath.SkipDir
+		}
 
-		if cur.Flags&protocol.FlagDeleted != 0 {
+		if p.model.globalDelete(p.repo, rn) {
 			if debugPull {
-				dlog.Printf("queue delete dir: %v", cur)
+				dlog.Printf("queue delete dir: %q", rn)
 			}
 
 			// We queue the directories to delete since we walk the
 			// tree in depth first order and need to remove the
 			// directories in the opposite order.
 
-			deleteDirs = append(deleteDirs, path)
+			deleteDirs = append(deleteDirs, p.model.CurrentGlobalFile(p.repo, rn))
+		}
+		return nil
+	})
+
+	// Delete any queued directories
+	for i := len(deleteDirs) - 1; i >= 0; i-- {
+		f := deleteDirs[i]
+		path := filepath.Join(p.dir, f.Name)
+		if debugPull {
+			dlog.Println("delete dir:", path)
+		}
+		if err := p.model.fs.Remove(path); err != nil {
+			warnln(err)
+			continue
+		}
+		p.report().DirsUpdated++
+		p.model.updateLocal(p.repo, f)
+		p.model.fileEvent(events.FilePulled, p.repo, f)
+	}
+}
+
+// fixupDirectories restores the permissions and modification times of
+// directories, which are changed as a side effect of pulling the files in
+// them.
+func (p *puller) fixupDirectories() {
+	vfs.Walk(p.model.fs, p.dir, func(path string, info os.FileInfo, err error) error {
+		if err != nil || !info.IsDir() {
 			return nil
 		}
 
-		if cur.Flags&uint32(os.ModePerm) != uint32(info.Mode()&os.ModePerm) {
-			os.Chmod(path, os.FileMode(cur.Flags)&os.ModePerm)
+		rn, err := filepath.Rel(p.dir, path)
+		if err != nil {
+			return nil
+		}
+
+		if rn == "." {
+			return nil
+		}
+
+		cur := p.model.CurrentGlobalFile(p.repo, rn)
+		if cur.Name != rn || cur.Flags&protocol.FlagDeleted != 0 {
+			// No matching dir in current list; weird
+			return nil
+		}
+
+		if !p.model.ignorePermissions() && cur.Flags&uint32(os.ModePerm) != uint32(info.Mode()&os.ModePerm) {
+			p.model.fs.Chmod(path, os.FileMode(cur.Flags)&os.ModePerm)
+			p.report().DirsUpdated++
 			if debugPull {
 				dlog.Printf("restored dir flags: %o -> %v", info.Mode()&os.ModePerm, cur)
 			}
 		}
 
+		if ct, ok := vfs.CreateTime(info); ok && cur.Created != 0 && ct.Unix() != cur.Created {
+			p.restoreCreateTime(path, cur)
+		}
+
 		if cur.Modified != info.ModTime().Unix() {
 			t := time.Unix(cur.Modified, 0)
-			os.Chtimes(path, t, t)
+			p.model.fs.Chtimes(path, t, t)
+			p.report().DirsUpdated++
 			if debugPull {
 				dlog.Printf("restored dir modtime: %d -> %v", info.ModTime().Unix(), cur)
 			}
@@ -254,34 +441,175 @@ func (p *puller) fixupDirectories() {
 
 		return nil
 	})
+}
 
-	// Delete any queued directories
-	for i := len(deleteDirs) - 1; i >= 0; i-- {
-		if debugPull {
-			dlog.Println("delete dir:", deleteDirs[i])
-		}
-		err := os.Remove(deleteDirs[i])
-		if err != nil {
-			warnln(err)
+// beginPhase ends the current phase, if any, and starts the given one.
+func (p *puller) beginPhase(phase pullPhase) {
+	p.endPhase()
+	p.phase = phase
+	p.phaseStart = p.model.clock.Now()
+	if p.round != nil {
+		p.phaseOps = p.round.operations()
+	} else {
+		p.phaseOps = 0
+	}
+}
+
+// endPhase ends the current phase and adds it to the round report if it did
+// any work.
+func (p *puller) endPhase() {
+	if p.phaseStart.IsZero() {
+		return
+	}
+	if p.round != nil {
+		if ops := p.round.operations() - p.phaseOps; ops > 0 {
+			d := p.model.clock.Now().Sub(p.phaseStart)
+			if debugPull {
+				dlog.Printf("pull: %q: %v phase done; %d operations in %v", p.repo, p.phase, ops, d)
+			}
+			p.round.Phases = append(p.round.Phases, PhaseReport{
+				Phase:      p.phase.String(),
+				Duration:   d.Seconds(),
+				Operations: ops,
+			})
 		}
 	}
+	p.phaseStart = time.Time{}
+}
+
+// report returns the report of the current puller round, starting a new
+// round if necessary.
+func (p *puller) report() *PullReport {
+	if p.round == nil {
+		p.round = newPullReport(p.repo, p.model.clock.Now())
+	}
+	return p.round
 }
 
-func (p *puller) handleRequestResult(res requestResult) {
+// failed records that pulling the file failed and has been given up for this
+// round.
+func (p *puller) failed(name string, err error) {
+	r := p.report()
+	r.Failures = append(r.Failures, PullFailure{Name: name, Error: err.Error()})
+}
+
+// unsafePath returns true if the file name resolves to outside of the
+// repository, in which case the file is failed and must not be touched.
+func (p *puller) unsafePath(f scanner.File) bool {
+	_, err := safePath(p.dir, f.Name)
+	if err == nil {
+		err = linkedParent(p.model.fs, p.dir, f.Name)
+	}
+	if err == nil {
+		return false
+	}
+	warnf("Security: refusing to pull %q in repo %q: %v", f.Name, p.repo, err)
+	p.model.pullFailed(p.repo, f, err)
+	p.failed(f.Name, err)
+	return true
+}
+
+// dropOpenFile forgets about a file that is no longer being pulled, whether
+// it succeeded or failed.
+func (p *puller) dropOpenFile(name string) {
+	if of, ok := p.openFiles[name]; ok {
+		p.model.forgetTempFile(of.temp)
+	}
+	delete(p.openFiles, name)
+	p.model.transferEnded(p.repo, name)
+}
+
+// abandon stops pulling the open file because the pull was canceled. The
+// temporary file is removed and outstanding requests are discarded as they
+// come in. The file is not reported as failed to the model, so it stays
+// needed.
+func (p *puller) abandon(name string, of *openFile) {
+	if debugPull {
+		dlog.Printf("pull: %q / %q canceled", p.repo, name)
+	}
+	of.err = errPullCanceled
+	if of.file != nil {
+		of.file.Close()
+		of.file = nil
+		p.model.fs.Remove(of.temp)
+	}
+}
+
+// finishRound publishes the report of the current round, unless nothing was
+// done.
+func (p *puller) finishRound() {
+	p.endPhase()
+	r := p.round
+	p.round = nil
+	if r == nil || r.empty() {
+		return
+	}
+	r.Duration = p.model.clock.Now().Sub(r.started).Seconds()
+	p.model.pullRoundCompleted(r)
+}
+
+// handleRequestResult writes the result of a block request to the temporary
+// file. A block that the node failed to serve is requested again from
+// another node. Returns true if the request was fully handled, i.e. if the
+// slot can be reused.
+func (p *puller) handleRequestResult(res requestResult) bool {
 	p.oustandingPerNode.decrease(res.node)
 	f := res.file
 
 	of, ok := p.openFiles[f.Name]
-	if !ok || of.err != nil {
+	if !ok {
 		// no entry in openFiles means there was an error and we've cancelled the operation
-		return
+		return true
 	}
 
-	_, of.err = of.file.WriteAt(res.data, res.offset)
-	buffers.Put(res.data)
-
 	of.outstanding--
+
+	if of.err == nil && of.canceled() {
+		p.abandon(f.Name, &of)
+	}
+	if of.err != nil {
+		// We have already failed this file.
+		if of.done && of.outstanding == 0 {
+			p.dropOpenFile(f.Name)
+			p.failed(f.Name, of.err)
+		} else {
+			p.openFiles[f.Name] = of
+		}
+		return true
+	}
+
+	if res.batch != nil {
+		return p.handleBatchResult(res, of)
+	}
+
+	verified := verifyResult(&res)
+	if res.err != nil {
+		// The node announced the file but could not serve it, so its index is
+		// stale. Stop asking it for this file and try the block elsewhere.
+		if debugPull {
+			dlog.Printf("pull: error: %q / %q offset %d from %q: %v", p.repo, f.Name, res.offset, res.node, res.err)
+		}
+		of.availability &^= 1 << p.model.cm.Get(res.node)
+		if res.err == errBlockHash {
+			of.badData = true
+		}
+		p.openFiles[f.Name] = of
+
+		return p.handleRequestBlock(bqBlock{
+			file:  f,
+			block: scanner.Block{Offset: res.offset, Size: uint32(res.size), Hash: res.hash},
+			parts: res.parts,
+			last:  of.done && of.outstanding == 0,
+		})
+	}
+
+	if p.writeResult(&of, res, verified) != nil {
+		p.writeFailed(f, of)
+		return true
+	}
+
 	p.openFiles[f.Name] = of
+	p.model.transferWritten(p.repo, f.Name, res.size)
 
 	if debugPull {
 		dlog.Printf("pull: wrote %q / %q offset %d outstanding %d done %v", p.repo, f.Name, res.offset, of.outstanding, of.done)
@@ -290,6 +618,119 @@ func (p *puller) handleRequestResult(res requestResult) {
 	if of.done && of.outstanding == 0 {
 		p.closeFile(f)
 	}
+	return true
+}
+
+// handleBatchResult writes the results of a batch request. The requests
+// that failed are made again to another node, batched together. Returns
+// true if the slot can be reused.
+func (p *puller) handleBatchResult(res requestResult, of openFile) bool {
+	f := res.file
+	var failed []bqBlock
+	var written int
+	for _, br := range res.batch {
+		verified := verifyResult(&br)
+		if br.err != nil {
+			if debugPull {
+				dlog.Printf("pull: error: %q / %q offset %d from %q: %v", p.repo, f.Name, br.offset, br.node, br.err)
+			}
+			if br.err == errBlockHash {
+				of.badData = true
+			}
+			failed = append(failed, bqBlock{
+				file:  f,
+				block: scanner.Block{Offset: br.offset, Size: uint32(br.size), Hash: br.hash},
+				parts: br.parts,
+			})
+			continue
+		}
+
+		if p.writeResult(&of, br, verified) != nil {
+			p.writeFailed(f, of)
+			return true
+		}
+		written += br.size
+	}
+
+	p.openFiles[f.Name] = of
+	if written > 0 {
+		p.model.transferWritten(p.repo, f.Name, written)
+	}
+
+	if len(failed) > 0 {
+		// As for a single request, the node's index is stale.
+		of.availability &^= 1 << p.model.cm.Get(res.node)
+		p.openFiles[f.Name] = of
+
+		retry := batchBlock(f, failed)
+		retry.last = of.done && of.outstanding == 0
+		return p.handleRequestBlock(retry)
+	}
+
+	if debugPull {
+		dlog.Printf("pull: wrote %q / %q %d requests from offset %d outstanding %d done %v", p.repo, f.Name, len(res.batch), res.offset, of.outstanding, of.done)
+	}
+
+	if of.done && of.outstanding == 0 {
+		p.closeFile(f)
+	}
+	return true
+}
+
+// verifyResult checks the data received against the blocks requested,
+// setting the error of the result if it doesn't match. Returns the number
+// of blocks verified.
+func verifyResult(res *requestResult) int {
+	if res.err == nil && len(res.data) != res.size {
+		// Errors are not carried over the wire; a node that fails to serve
+		// the request responds with no data.
+		res.err = errShortResponse
+	}
+	if res.err != nil {
+		return 0
+	}
+	switch {
+	case len(res.parts) > 0:
+		res.err = verifyParts(res.data, res.offset, res.parts)
+		return len(res.parts)
+	case len(res.hash) > 0:
+		res.err = verifyParts(res.data, res.offset, []scanner.Block{{Offset: res.offset, Size: uint32(res.size), Hash: res.hash}})
+		return 1
+	}
+	return 0
+}
+
+// writeResult writes the data received to the temporary file and recycles
+// the buffer. The error, if any, is also recorded in the open file.
+func (p *puller) writeResult(of *openFile, res requestResult, verified int) error {
+	p.model.waitDiskWrite(len(res.data))
+	of.err = vfs.WriteFullAt(of.file, of.temp, res.data, res.offset)
+	of.verified += verified
+	p.model.pullStats(p.repo).addBytesPulled(len(res.data))
+	p.report().BytesPerNode[res.node] += int64(len(res.data))
+	if of.served == nil {
+		of.served = make(map[string]int64)
+	}
+	of.served[res.node] += int64(len(res.data))
+	buffers.Put(res.data)
+	return of.err
+}
+
+// writeFailed gives up on the file after writing to it failed, e.g. because
+// the disk is full. Remaining outstanding requests are discarded as they
+// come in.
+func (p *puller) writeFailed(f scanner.File, of openFile) {
+	dlog.Printf("pull: error: %q / %q: %v", p.repo, f.Name, of.err)
+	of.file.Close()
+	of.file = nil
+	p.model.fs.Remove(of.temp)
+	p.model.pullFailed(p.repo, f, of.err)
+	if of.done && of.outstanding == 0 {
+		p.dropOpenFile(f.Name)
+		p.failed(f.Name, of.err)
+	} else {
+		p.openFiles[f.Name] = of
+	}
 }
 
 // handleBlock fulfills the block request by copying, ignoring or fetching
@@ -298,14 +739,27 @@ func (p *puller) handleRequestResult(res requestResult) {
 func (p *puller) handleBlock(b bqBlock) bool {
 	f := b.file
 
-	// For directories, simply making sure they exist is enough
+	// For directories, simply making sure they exist is enough. This
+	// includes empty directories, which have nothing else that would cause
+	// them to be created. Permissions and modification time are set in the
+	// directory metadata phase.
 	if f.Flags&protocol.FlagDirectory != 0 {
 		path := filepath.Join(p.dir, f.Name)
-		_, err := os.Stat(path)
+		_, err := p.model.fs.Stat(path)
 		if err != nil && os.IsNotExist(err) {
-			os.MkdirAll(path, 0777)
+			err = p.model.fs.MkdirAll(path, 0777)
+		}
+		if err != nil {
+			if debugPull {
+				dlog.Printf("pull: error: %q / %q: %v", p.repo, f.Name, err)
+			}
+			p.model.pullFailed(p.repo, f, err)
+			p.failed(f.Name, err)
+			return true
 		}
 		p.model.updateLocal(p.repo, f)
+		p.model.fileEvent(events.FilePulled, p.repo, f)
+		p.report().DirsUpdated++
 		return true
 	}
 
@@ -322,25 +776,33 @@ func (p *puller) handleBlock(b bqBlock) bool {
 		of.temp = filepath.Join(p.dir, defTempNamer.TempName(f.Name))
 
 		dirName := filepath.Dir(of.filepath)
-		_, err := os.Stat(dirName)
+		_, err := p.model.fs.Stat(dirName)
 		if err != nil {
-			err = os.MkdirAll(dirName, 0777)
+			err = p.model.fs.MkdirAll(dirName, 0777)
 		}
 		if err != nil {
 			dlog.Printf("pull: error: %q / %q: %v", p.repo, f.Name, err)
 		}
 
-		of.file, of.err = os.Create(of.temp)
+		of.file, of.err = p.model.fs.Create(of.temp)
 		if of.err != nil {
 			if debugPull {
 				dlog.Printf("pull: error: %q / %q: %v", p.repo, f.Name, of.err)
 			}
-			if !b.last {
+			p.model.pullFailed(p.repo, f, of.err)
+			if b.last {
+				p.failed(f.Name, of.err)
+			} else {
 				p.openFiles[f.Name] = of
 			}
 			return true
 		}
 		defTempNamer.Hide(of.temp)
+		of.cancel = p.model.transferStarted(p.repo, f, of.temp)
+	}
+
+	if of.err == nil && of.canceled() {
+		p.abandon(f.Name, &of)
 	}
 
 	if of.err != nil {
@@ -350,7 +812,8 @@ func (p *puller) handleBlock(b bqBlock) bool {
 		}
 		if b.last {
 			dlog.Printf("pull: removing failed file %q / %q", p.repo, f.Name)
-			delete(p.openFiles, f.Name)
+			p.dropOpenFile(f.Name)
+			p.failed(f.Name, of.err)
 		}
 
 		return true
@@ -364,6 +827,9 @@ func (p *puller) handleBlock(b bqBlock) bool {
 		return true
 
 	case b.block.Size > 0:
+		if p.model.sparseFiles() && p.leaveHole(b) {
+			return true
+		}
 		return p.handleRequestBlock(b)
 
 	default:
@@ -372,8 +838,10 @@ func (p *puller) handleBlock(b bqBlock) bool {
 	}
 }
 
+// handleCopyBlock hands the blocks to copy from the existing file to the
+// copiers, split into jobs so that large files are copied in parallel. The
+// results come back through copyResults.
 func (p *puller) handleCopyBlock(b bqBlock) {
-	// We have blocks to copy from the existing file
 	f := b.file
 	of := p.openFiles[f.Name]
 
@@ -381,39 +849,67 @@ func (p *puller) handleCopyBlock(b bqBlock) {
 		dlog.Printf("pull: copying %d blocks for %q / %q", len(b.copy), p.repo, f.Name)
 	}
 
-	var exfd *os.File
-	exfd, of.err = os.Open(of.filepath)
-	if of.err != nil {
+	for i := 0; i < len(b.copy); i += copyJobBlocks {
+		j := i + copyJobBlocks
+		if j > len(b.copy) {
+			j = len(b.copy)
+		}
+		job := copyJob{
+			repo:    p.repo,
+			file:    f,
+			src:     of.filepath,
+			dst:     of.file,
+			temp:    of.temp,
+			blocks:  b.copy[i:j],
+			results: p.copyResults,
+		}
+		of.outstanding++
+		// The copiers are shared with other pullers and may be busy
+		// sending us results, so we must not wait for them here.
+		go func() {
+			p.model.copyJobs <- job
+		}()
+	}
+	p.openFiles[f.Name] = of
+}
+
+// handleCopyResult records the outcome of a copy job, closing the file if
+// it was the last thing outstanding.
+func (p *puller) handleCopyResult(res copyResult) {
+	f := res.file
+	of, ok := p.openFiles[f.Name]
+	if !ok {
+		return
+	}
+	of.outstanding--
+	of.verified += res.verified
+
+	if of.err == nil && of.canceled() {
+		p.abandon(f.Name, &of)
+	}
+	if res.err != nil && of.err == nil {
+		// Remaining blocks are discarded as they come in.
 		if debugPull {
-			dlog.Printf("pull: error: %q / %q: %v", p.repo, f.Name, of.err)
+			dlog.Printf("pull: error: %q / %q: %v", p.repo, f.Name, res.err)
 		}
+		of.err = res.err
 		of.file.Close()
 		of.file = nil
+		p.model.fs.Remove(of.temp)
+		p.model.pullFailed(p.repo, f, of.err)
+	}
 
+	if !of.done || of.outstanding > 0 {
 		p.openFiles[f.Name] = of
 		return
 	}
-	defer exfd.Close()
-
-	for _, b := range b.copy {
-		bs := buffers.Get(int(b.Size))
-		_, of.err = exfd.ReadAt(bs, b.Offset)
-		if of.err == nil {
-			_, of.err = of.file.WriteAt(bs, b.Offset)
-		}
-		buffers.Put(bs)
-		if of.err != nil {
-			if debugPull {
-				dlog.Printf("pull: error: %q / %q: %v", p.repo, f.Name, of.err)
-			}
-			exfd.Close()
-			of.file.Close()
-			of.file = nil
-
-			p.openFiles[f.Name] = of
-			return
-		}
+	if of.err != nil {
+		p.dropOpenFile(f.Name)
+		p.failed(f.Name, of.err)
+		return
 	}
+	p.openFiles[f.Name] = of
+	p.closeFile(f)
 }
 
 // handleRequestBlock tries to pull a block from the network. Returns true if
@@ -429,13 +925,20 @@ func (p *puller) handleRequestBlock(b bqBlock) bool {
 	node := p.oustandingPerNode.leastBusyNode(of.availability, p.model.cm)
 	if len(node) == 0 {
 		of.err = errNoNode
+		if of.badData {
+			// The data served doesn't match what was announced; the file
+			// may be corrupt at the source, which counts as a failure.
+			of.err = errBlockHash
+			p.model.pullFailed(p.repo, f, of.err)
+		}
 		if of.file != nil {
 			of.file.Close()
 			of.file = nil
-			os.Remove(of.temp)
+			p.model.fs.Remove(of.temp)
 		}
 		if b.last {
-			delete(p.openFiles, f.Name)
+			p.dropOpenFile(f.Name)
+			p.failed(f.Name, of.err)
 		} else {
 			p.openFiles[f.Name] = of
 		}
@@ -444,18 +947,27 @@ func (p *puller) handleRequestBlock(b bqBlock) bool {
 
 	of.outstanding++
 	p.openFiles[f.Name] = of
+	p.model.transferRequested(p.repo, f.Name, node)
+
+	if len(b.batch) > 0 {
+		go p.requestBatch(node, b, of)
+		return false
+	}
 
 	go func(node string, b bqBlock) {
 		if debugPull {
 			dlog.Printf("pull: requesting %q / %q offset %d size %d from %q outstanding %d", p.repo, f.Name, b.block.Offset, b.block.Size, node, of.outstanding)
 		}
 
-		bs, err := p.model.requestGlobal(node, p.repo, f.Name, b.block.Offset, int(b.block.Size), nil)
+		bs, err := p.model.requestGlobal(node, p.repo, f.Name, b.block.Offset, int(b.block.Size), nil, of.cancel)
 		p.requestResults <- requestResult{
 			node:     node,
 			file:     f,
 			filepath: of.filepath,
 			offset:   b.block.Offset,
+			size:     int(b.block.Size),
+			parts:    b.parts,
+			hash:     b.block.Hash,
 			data:     bs,
 			err:      err,
 		}
@@ -464,101 +976,531 @@ func (p *puller) handleRequestBlock(b bqBlock) bool {
 	return false
 }
 
+// requestBatch requests the batched requests from the node, passing the
+// results on together.
+func (p *puller) requestBatch(node string, b bqBlock, of openFile) {
+	f := b.file
+	if debugPull {
+		dlog.Printf("pull: requesting %q / %q %d requests from offset %d size %d from %q outstanding %d", p.repo, f.Name, len(b.batch), b.block.Offset, b.block.Size, node, of.outstanding)
+	}
+
+	blocks := make([]scanner.Block, len(b.batch))
+	for i, r := range b.batch {
+		blocks[i] = r.block
+	}
+	results := p.model.requestBatch(node, p.repo, f.Name, blocks, of.cancel)
+
+	res := requestResult{
+		node:     node,
+		file:     f,
+		filepath: of.filepath,
+		offset:   b.block.Offset,
+		size:     int(b.block.Size),
+		batch:    make([]requestResult, len(b.batch)),
+	}
+	for i, r := range b.batch {
+		res.batch[i] = requestResult{
+			node:   node,
+			offset: r.block.Offset,
+			size:   int(r.block.Size),
+			parts:  r.parts,
+			hash:   r.block.Hash,
+			data:   results[i].Data,
+			err:    results[i].Err,
+		}
+	}
+	p.requestResults <- res
+}
+
 func (p *puller) handleEmptyBlock(b bqBlock) {
 	f := b.file
 	of := p.openFiles[f.Name]
 
+	if of.outstanding > 0 {
+		// Blocks are still being copied; the file is closed once they are
+		// done.
+		return
+	}
+
 	if b.last {
 		if of.err == nil {
 			of.file.Close()
 		}
 	}
 
-	if f.Flags&protocol.FlagDeleted != 0 {
-		if debugPull {
-			dlog.Printf("pull: delete %q", f.Name)
-		}
-		os.Remove(of.temp)
-		os.Remove(of.filepath)
-	} else {
-		if debugPull {
-			dlog.Printf("pull: no blocks to fetch and nothing to copy for %q / %q", p.repo, f.Name)
-		}
-		t := time.Unix(f.Modified, 0)
-		os.Chtimes(of.temp, t, t)
-		os.Chmod(of.temp, os.FileMode(f.Flags&0777))
-		defTempNamer.Show(of.temp)
-		Rename(of.temp, of.filepath)
+	if debugPull {
+		dlog.Printf("pull: no blocks to fetch and nothing to copy for %q / %q", p.repo, f.Name)
 	}
-	delete(p.openFiles, f.Name)
+	p.restoreCreateTime(of.temp, f)
+	t := time.Unix(f.Modified, 0)
+	p.model.fs.Chtimes(of.temp, t, t)
+	p.restorePerms(of.temp, f)
+	defTempNamer.Show(of.temp)
+	p.dropOpenFile(f.Name)
+	if err := p.rename(of, f); err != nil {
+		dlog.Printf("pull: error: %q / %q: %v", p.repo, f.Name, err)
+		p.model.pullFailed(p.repo, f, err)
+		p.failed(f.Name, err)
+		return
+	}
+	p.report().FilesPulled++
 	p.model.updateLocal(p.repo, f)
+	p.completed(f, of.served, of.availability)
 }
 
-func (p *puller) queueNeededBlocks() {
+// queueNeededBlocks queues the blocks of the files and directories to create
+// or update. Deletes are left for the later phases of the round. Returns true
+// if there are any deletes to process.
+//
+// Files that no connected node can provide are skipped as awaiting a
+// source, and not looked at again until a node connects or sends an index,
+// or the source retry interval has passed.
+func (p *puller) queueNeededBlocks() (deletes bool) {
+	now := p.model.clock.Now()
+	retry := p.model.sourceRetry()
+	if gen := p.model.sourcesChanged(); gen != p.sourcesGen || p.unavailable == nil || retry > 0 && now.Sub(p.sourcesChecked) >= retry {
+		p.sourcesGen = gen
+		p.sourcesChecked = now
+		p.unavailable = make(map[string]uint64)
+	}
+	if p.noSpace == nil {
+		p.noSpace = make(map[string]uint64)
+	}
+	connected := p.model.connectedNodes()
+	space := p.model.spaceCheck(p.dir)
+
+	need := p.model.NeedFilesRepo(p.repo)
+	caseDeletes := caseDeletes(need)
 	queued := 0
-	for _, f := range p.model.NeedFilesRepo(p.repo) {
+	for _, f := range need {
+		if f.Flags&protocol.FlagDeleted != 0 {
+			deletes = true
+			continue
+		}
+		if v, ok := p.unavailable[f.Name]; ok && v == f.Version {
+			continue
+		}
+		if p.model.skipPull(p.repo, f) || p.model.pullCanceled(p.repo, f) || !p.handlesSymlink(f) || p.unsafePath(f) {
+			continue
+		}
 		lf := p.model.CurrentRepoFile(p.repo, f.Name)
 		have, need := scanner.BlockDiff(lf.Blocks, f.Blocks)
 		if debugNeed {
 			dlog.Printf("need:\n  local: %v\n  global: %v\n  haveBlocks: %v\n  needBlocks: %v", lf, f, have, need)
 		}
+		if p.updateMetadata(lf, f) {
+			continue
+		}
+		if d, ok := caseDeletes[strings.ToLower(f.Name)]; ok && p.renameCase(d, f) {
+			continue
+		}
+		availability := uint64(p.model.repoFiles[p.repo].Availability(f.Name))
+		if a, _, waiting := p.model.needAvailability(lf, f, availability, connected); a != NeedAvailable {
+			if debugPull {
+				dlog.Printf("%q: skipping %q; %v, waiting for %v", p.repo, f.Name, a, waiting)
+			}
+			p.unavailable[f.Name] = f.Version
+			p.model.awaitingSource(p.repo, f)
+			continue
+		}
+		p.model.sourceFound(p.repo, f.Name)
+		if !space.fits(f.Size) {
+			// The file is tried again in the next round; it is reported
+			// once per version.
+			if v, ok := p.noSpace[f.Name]; !ok || v != f.Version {
+				p.noSpace[f.Name] = f.Version
+				p.failed(f.Name, errOutOfDiskSpace)
+			}
+			continue
+		}
+		delete(p.noSpace, f.Name)
 		queued++
 		p.bq.put(bqAdd{
-			file: f,
-			have: have,
-			need: need,
+			file:       f,
+			have:       have,
+			need:       need,
+			maxRequest: p.model.maxRequestSize(p.repo, f.Name),
+			maxBatch:   p.model.maxBatchBlocks(p.repo, f.Name),
+			sparse:     p.model.sparseFiles(),
 		})
 	}
+	p.model.diskSpaceChecked(p.repo, space)
 	if debugPull && queued > 0 {
 		dlog.Printf("%q: queued %d blocks", p.repo, queued)
 	}
+	return
 }
 
-func (p *puller) closeFile(f scanner.File) {
-	if debugPull {
-		dlog.Printf("pull: closing %q / %q", p.repo, f.Name)
+// updateMetadata handles a needed file with contents identical to the local
+// version, i.e. one that has only been touched or had its permissions
+// changed. The metadata is updated in place without rewriting the contents.
+// Returns true if the file was handled.
+func (p *puller) updateMetadata(lf, f scanner.File) bool {
+	const special = protocol.FlagDeleted | protocol.FlagDirectory | protocol.FlagSymlink
+	if lf.Name != f.Name || lf.Invalid || f.Invalid || lf.Flags&special != 0 || f.Flags&special != 0 {
+		return false
+	}
+	if !scanner.SameBlocks(lf.Blocks, f.Blocks) {
+		return false
 	}
 
-	of := p.openFiles[f.Name]
-	of.file.Close()
-	defer os.Remove(of.temp)
-
-	delete(p.openFiles, f.Name)
+	// Make sure the file on disk is still the one we scanned
+	path := filepath.Join(p.dir, f.Name)
+	info, err := p.model.fs.Stat(path)
+	if err != nil || info.Size() != lf.Size || info.ModTime().Unix() != lf.Modified {
+		return false
+	}
 
-	fd, err := os.Open(of.temp)
-	if err != nil {
+	if err := p.restorePerms(path, f); err != nil {
 		if debugPull {
 			dlog.Printf("pull: error: %q / %q: %v", p.repo, f.Name, err)
 		}
-		return
+		return false
 	}
-	hb, _ := scanner.Blocks(fd, BlockSize)
-	fd.Close()
-
-	if l0, l1 := len(hb), len(f.Blocks); l0 != l1 {
+	p.restoreCreateTime(path, f)
+	t := time.Unix(f.Modified, 0)
+	if err := p.model.fs.Chtimes(path, t, t); err != nil {
 		if debugPull {
-			dlog.Printf("pull: %q / %q: nblocks %d != %d", p.repo, f.Name, l0, l1)
+			dlog.Printf("pull: error: %q / %q: %v", p.repo, f.Name, err)
 		}
-		return
+		return false
 	}
 
-	for i := range hb {
-		if bytes.Compare(hb[i].Hash, f.Blocks[i].Hash) != 0 {
-			dlog.Printf("pull: %q / %q: block %d hash mismatch", p.repo, f.Name, i)
-			return
+	if debugPull {
+		dlog.Printf("pull: metadata only update of %q / %q", p.repo, f.Name)
+	}
+	p.model.updateLocal(p.repo, f)
+	p.model.fileEvent(events.FilePulled, p.repo, f)
+	p.model.pullStats(p.repo).addMetadataOnly()
+	return true
+}
+
+// verifyParts checks the hashes of the blocks that make up the data of a
+// request for several blocks at once, starting at offset.
+func verifyParts(data []byte, offset int64, parts []scanner.Block) error {
+	for _, b := range parts {
+		start := b.Offset - offset
+		hash := sha256.Sum256(data[start : start+int64(b.Size)])
+		if bytes.Compare(hash[:], b.Hash) != 0 {
+			return errBlockHash
 		}
 	}
+	return nil
+}
+
+// restorePerms sets the permission bits of the file at path to those of f,
+// unless permissions are ignored.
+func (p *puller) restorePerms(path string, f scanner.File) error {
+	if p.model.ignorePermissions() {
+		return nil
+	}
+	return p.model.fs.Chmod(path, os.FileMode(f.Flags&0777))
+}
 
+// restoreCreateTime sets the creation time of the file at path to that of
+// f, if creation times are preserved and f has one.
+func (p *puller) restoreCreateTime(path string, f scanner.File) {
+	p.model.rmut.RLock()
+	enabled := p.model.ctimes
+	p.model.rmut.RUnlock()
+	if !enabled || f.Created == 0 {
+		return
+	}
+	err := vfs.SetCreateTime(p.model.fs, path, time.Unix(f.Created, 0))
+	if err != nil && err != vfs.ErrNoCreateTime && debugPull {
+		dlog.Printf("pull: error: %q / %q: %v", p.repo, f.Name, err)
+	}
+}
+
+func (p *puller) closeFile(f scanner.File) {
+	if debugPull {
+		dlog.Printf("pull: closing %q / %q", p.repo, f.Name)
+	}
+
+	of := p.openFiles[f.Name]
+	of.file.Close()
+	defer p.model.fs.Remove(of.temp)
+
+	p.dropOpenFile(f.Name)
+
+	var err error
+	if of.verified+len(of.zeros) == len(f.Blocks) {
+		// Every block was checked as it was written, so reading the file
+		// back would only check the hash of the entire file, which the
+		// block hashes already cover.
+		err = verifySize(p.model.fs, of.temp, f)
+		p.model.pullStats(p.repo).addSkippedCheck()
+	} else {
+		err = verifyFile(p.model.fs, of.temp, f, of.zeros)
+		p.model.pullStats(p.repo).addFullCheck()
+	}
+	if err != nil {
+		dlog.Printf("pull: %q / %q: %v", p.repo, f.Name, err)
+		p.model.pullFailed(p.repo, f, err)
+		p.failed(f.Name, err)
+		return
+	}
+
+	p.restoreCreateTime(of.temp, f)
 	t := time.Unix(f.Modified, 0)
-	os.Chtimes(of.temp, t, t)
-	os.Chmod(of.temp, os.FileMode(f.Flags&0777))
+	p.model.fs.Chtimes(of.temp, t, t)
+	p.restorePerms(of.temp, f)
 	defTempNamer.Show(of.temp)
 	if debugPull {
 		dlog.Printf("pull: rename %q / %q: %q", p.repo, f.Name, of.filepath)
 	}
-	if err := Rename(of.temp, of.filepath); err == nil {
+	if err := p.rename(of, f); err == nil {
 		p.model.updateLocal(p.repo, f)
+		p.report().FilesPulled++
+		p.completed(f, of.served, of.availability)
 	} else {
 		dlog.Printf("pull: error: %q / %q: %v", p.repo, f.Name, err)
+		p.model.pullFailed(p.repo, f, err)
+		p.failed(f.Name, err)
+	}
+}
+
+// completed passes the pulled file to the file complete hook, along with the
+// node that served most of its data, or else the first available node.
+func (p *puller) completed(f scanner.File, served map[string]int64, availability uint64) {
+	var source string
+	for node, bytes := range served {
+		if bytes > served[source] || bytes == served[source] && node < source {
+			source = node
+		}
+	}
+	if source == "" {
+		for _, node := range p.model.cm.Names() {
+			if id := p.model.cm.Get(node); id != cid.LocalID && availability&(1<<id) != 0 {
+				source = node
+				break
+			}
+		}
+	}
+	p.model.fileComplete(p.repo, f, source)
+}
+
+// handlesSymlink returns false if f is a symlink that should be left alone
+// under the current symlink policy.
+func (p *puller) handlesSymlink(f scanner.File) bool {
+	return f.Flags&protocol.FlagSymlink == 0 || p.model.symlinkPolicy() == scanner.SymlinkRecreate
+}
+
+// rename moves the finished temporary file into place and, if enabled,
+// checks that what ended up there is still the file we pulled. For symlinks
+// the temporary file holds the link target, and the link is created in its
+// place.
+//
+// If originals are preserved, an existing file is first backed up and is
+// put back if anything fails, so that a failed update leaves the previous
+// version of the file in place. With versioning it is always backed up, and
+// kept as a version once the update succeeds.
+func (p *puller) rename(of openFile, f scanner.File) error {
+	if f.Flags&protocol.FlagSymlink != 0 {
+		return p.createSymlink(of, f)
+	}
+
+	keep := p.model.keepVersions()
+	var backup string
+	if p.model.preserveOriginals() || keep > 0 {
+		backup = of.temp + backupSuffix
+		if ok, err := backupOriginal(p.model.fs, of.filepath, backup); err != nil {
+			return err
+		} else if !ok {
+			backup = ""
+		}
+	}
+
+	err := p.model.fs.Rename(of.temp, of.filepath)
+	if err == nil && p.model.verifyRenames() {
+		err = verifyRenamed(p.model.fs, of.filepath, f)
+	}
+
+	if backup != "" {
+		if err != nil {
+			if debugPull {
+				dlog.Printf("pull: %q / %q: restoring original: %v", p.repo, f.Name, err)
+			}
+			if rerr := p.model.fs.Rename(backup, of.filepath); rerr != nil {
+				warnf("Could not restore %q after failed update; the previous version is in %q: %v", of.filepath, backup, rerr)
+			}
+		} else if keep > 0 {
+			if err := archiveVersion(p.model.fs, p.dir, f.Name, backup); err != nil {
+				warnf("Could not keep the previous version of %q: %v", of.filepath, err)
+				p.model.fs.Remove(backup)
+			}
+			pruneVersions(p.model.fs, p.dir, f.Name, keep)
+		} else {
+			p.model.fs.Remove(backup)
+		}
+	}
+	return err
+}
+
+// backupOriginal makes backup a hard link to the file at path, so that the
+// file stays in place until it is replaced. Where hard links aren't
+// supported the file is moved aside instead. Returns false if there is no
+// file to back up.
+func backupOriginal(fs vfs.FS, path, backup string) (bool, error) {
+	if _, err := fs.Lstat(path); os.IsNotExist(err) {
+		return false, nil
+	}
+	// With the file in place, a backup left behind is of an older update.
+	if err := fs.Remove(backup); err != nil && !os.IsNotExist(err) {
+		return false, err
 	}
+	if err := fs.Link(path, backup); err == nil {
+		return true, nil
+	}
+	if err := fs.Rename(path, backup); os.IsNotExist(err) {
+		return false, nil
+	} else if err != nil {
+		return false, err
+	}
+	return true, nil
+}
+
+// recoverOriginals deals with the originals backed up by rename that were
+// left behind when the process stopped in the middle of an update. An
+// original whose file is missing was moved aside and is put back. Otherwise
+// the update either went through, and the original is kept as a version if
+// versioning is enabled, or it never happened and the backup is the file
+// itself.
+func (p *puller) recoverOriginals() {
+	keep := p.model.keepVersions()
+	for _, rn := range p.model.tempWalker(p.dir).TempFiles() {
+		if !strings.HasSuffix(rn, backupSuffix) {
+			continue
+		}
+		backup := filepath.Join(p.dir, rn)
+		name := defTempNamer.RealName(strings.TrimSuffix(rn, backupSuffix))
+		path := filepath.Join(p.dir, name)
+
+		bi, err := p.model.fs.Lstat(backup)
+		if err != nil {
+			continue
+		}
+		fi, err := p.model.fs.Lstat(path)
+		switch {
+		case os.IsNotExist(err):
+			infof("Restoring %q in repo %q, left aside by an interrupted update", name, p.repo)
+			if err := p.model.fs.Rename(backup, path); err != nil {
+				warnf("Could not restore %q; the previous version is in %q: %v", path, backup, err)
+			}
+		case err != nil:
+			warnf("Could not recover the original of %q: %v", path, err)
+		case keep > 0 && (fi.Size() != bi.Size() || !fi.ModTime().Equal(bi.ModTime())):
+			if err := archiveVersion(p.model.fs, p.dir, name, backup); err != nil {
+				warnf("Could not keep the previous version of %q: %v", path, err)
+				p.model.fs.Remove(backup)
+			}
+			pruneVersions(p.model.fs, p.dir, name, keep)
+		default:
+			p.model.fs.Remove(backup)
+		}
+	}
+}
+
+// createSymlink replaces the file with a symlink to the target held in the
+// temporary file. Targets that are absolute or lead out of the repository
+// are refused.
+func (p *puller) createSymlink(of openFile, f scanner.File) error {
+	target, err := vfs.ReadFile(p.model.fs, of.temp)
+	if err != nil {
+		return err
+	}
+	p.model.fs.Remove(of.temp)
+	if err := safeLinkTarget(p.model.fs, p.dir, f.Name, string(target)); err != nil {
+		warnf("Security: refusing to create symlink %q in repo %q pointing to %q: %v", f.Name, p.repo, target, err)
+		return err
+	}
+	if err := p.model.fs.Remove(of.filepath); err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	return p.model.fs.Symlink(string(target), of.filepath)
+}
+
+// verifyRenamed checks that the size and modification time of the file at
+// path match f, in case it was replaced by someone else after we verified
+// the contents of the temporary file.
+func verifyRenamed(fs vfs.FS, path string, f scanner.File) error {
+	fi, err := fs.Stat(path)
+	if err != nil {
+		return err
+	}
+	if fi.Size() != f.Size {
+		return fmt.Errorf("size %d != %d after rename", fi.Size(), f.Size)
+	}
+	// FAT file systems store modification times with two second
+	// resolution.
+	if d := fi.ModTime().Unix() - f.Modified; d < -1 || d > 1 {
+		return fmt.Errorf("modification time %d != %d after rename", fi.ModTime().Unix(), f.Modified)
+	}
+	return nil
+}
+
+// verifySize checks that the size of the file at path matches the blocks of
+// f.
+func verifySize(fs vfs.FS, path string, f scanner.File) error {
+	info, err := fs.Stat(path)
+	if err != nil {
+		return err
+	}
+	var size int64
+	for _, b := range f.Blocks {
+		size += int64(b.Size)
+	}
+	if info.Size() != size {
+		return fmt.Errorf("size %d != %d", info.Size(), size)
+	}
+	return nil
+}
+
+// verifyFile checks that the contents of the file at path match the blocks
+// of f and, when known, the hash of the entire file. The blocks in zeros, by
+// offset, were left as holes when pulling; they are checked to be zero
+// blocks without being read back.
+func verifyFile(fs vfs.FS, path string, f scanner.File, zeros map[int64]bool) error {
+	fd, err := fs.Open(path)
+	if err != nil {
+		return err
+	}
+	defer fd.Close()
+
+	if err := verifySize(fs, path, f); err != nil {
+		return err
+	}
+
+	hf := sha256.New()
+	buf := make([]byte, BlockSize)
+	for i, b := range f.Blocks {
+		var data []byte
+		if zeros[b.Offset] {
+			// A hole left in a sparse file; it reads as zeros, so
+			// there is no need to read it.
+			if !isZeroBlock(b) {
+				return fmt.Errorf("block %d hash mismatch", i)
+			}
+			data = zeroData(int(b.Size))
+		} else {
+			if int(b.Size) > len(buf) {
+				buf = make([]byte, b.Size)
+			}
+			data = buf[:b.Size]
+			if n, err := fd.ReadAt(data, b.Offset); n < len(data) {
+				return err
+			}
+			if hash := sha256.Sum256(data); bytes.Compare(hash[:], b.Hash) != 0 {
+				return fmt.Errorf("block %d hash mismatch", i)
+			}
+		}
+		hf.Write(data)
+	}
+
+	// Peers that predate the whole file hash don't send it.
+	if len(f.Hash) > 0 && bytes.Compare(hf.Sum(nil), f.Hash) != 0 {
+		return errors.New("file hash mismatch")
+	}
+
+	return nil
 }
@@ -0,0 +1,3024 @@
+package main
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/binary"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"sort"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"syscall"
+	"testing"
+	"time"
+
+	"github.com/calmh/syncthing/cid"
+	"github.com/calmh/syncthing/events"
+	"github.com/calmh/syncthing/protocol"
+	"github.com/calmh/syncthing/scanner"
+	"github.com/calmh/syncthing/testutil"
+	"github.com/calmh/syncthing/vfs"
+)
+
+func TestMetadataOnlyUpdate(t *testing.T) {
+	dir, err := ioutil.TempDir("", "puller")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	path := filepath.Join(dir, "touched")
+	if err := ioutil.WriteFile(path, []byte("unchanged contents"), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	m := NewModel(1e6)
+	m.AddRepo("default", dir, []NodeConfiguration{{NodeID: "42"}})
+	m.ScanRepo("default")
+
+	// The remote has touched the file and changed its permissions, but the
+	// contents are the same.
+	f := m.CurrentRepoFile("default", "touched")
+	f.Modified -= 3600
+	f.Flags = 0600
+	f.Version += 1000
+	m.Index("42", "default", []protocol.FileInfo{fileInfoFromFile(f)})
+
+	p := &puller{
+		repo:  "default",
+		dir:   dir,
+		bq:    newBlockQueue(),
+		model: m,
+	}
+	p.queueNeededBlocks()
+
+	if need := m.NeedFilesRepo("default"); len(need) != 0 {
+		t.Errorf("File should not be needed after metadata update: %v", need)
+	}
+	if lf := m.CurrentRepoFile("default", "touched"); lf.Version != f.Version {
+		t.Errorf("Local version not updated; %d != %d", lf.Version, f.Version)
+	}
+
+	info, err := os.Stat(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if mt := info.ModTime().Unix(); mt != f.Modified {
+		t.Errorf("Incorrect modtime %d != %d", mt, f.Modified)
+	}
+	if perm := info.Mode() & os.ModePerm; perm != 0600 {
+		t.Errorf("Incorrect permissions %o != 0600", perm)
+	}
+	if bs, _ := ioutil.ReadFile(path); string(bs) != "unchanged contents" {
+		t.Errorf("Contents changed: %q", bs)
+	}
+
+	if s := m.PullStats("default"); s.MetadataOnly != 1 {
+		t.Errorf("Incorrect metadata only count %d != 1", s.MetadataOnly)
+	}
+}
+
+func TestPullFallbackOnStaleNode(t *testing.T) {
+	dir, err := ioutil.TempDir("", "puller")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	data := []byte("contents from the good node")
+	f := scanner.File{Name: "file", Flags: 0644, Modified: 1234567890, Version: 1000, Size: int64(len(data))}
+	f.Blocks, _ = scanner.Blocks(bytes.NewReader(data), BlockSize)
+
+	m := NewModel(1e6)
+	m.AddRepo("default", dir, []NodeConfiguration{{NodeID: "stale"}, {NodeID: "good"}})
+	m.ScanRepo("default")
+
+	// Both nodes announce the file, but the stale node no longer has it and
+	// responds to requests with no data.
+	stale := FakeConnection{id: "stale"}
+	good := FakeConnection{id: "good", requestData: data}
+	m.AddConnection(stale, stale)
+	m.AddConnection(good, good)
+	m.Index("stale", "default", []protocol.FileInfo{fileInfoFromFile(f)})
+	m.Index("good", "default", []protocol.FileInfo{fileInfoFromFile(f)})
+
+	p := &puller{
+		repo:              "default",
+		dir:               dir,
+		bq:                newBlockQueue(),
+		model:             m,
+		oustandingPerNode: make(activityMap),
+		openFiles:         make(map[string]openFile),
+		requestResults:    make(chan requestResult),
+	}
+	p.queueNeededBlocks()
+
+	if p.handleBlock(p.bq.get()) {
+		t.Fatal("Block should have been requested")
+	}
+
+	res := <-p.requestResults
+	if res.node != "stale" {
+		t.Fatalf("Incorrect node %q != \"stale\"", res.node)
+	}
+	if p.handleRequestResult(res) {
+		t.Fatal("Block should have been requested again")
+	}
+
+	res = <-p.requestResults
+	if res.node != "good" {
+		t.Fatalf("Incorrect node %q != \"good\"", res.node)
+	}
+	if !p.handleRequestResult(res) {
+		t.Fatal("Request should have been fully handled")
+	}
+
+	if bs, _ := ioutil.ReadFile(filepath.Join(dir, "file")); !bytes.Equal(bs, data) {
+		t.Errorf("Incorrect contents %q", bs)
+	}
+	if need := m.NeedFilesRepo("default"); len(need) != 0 {
+		t.Errorf("File should not be needed after pull: %v", need)
+	}
+}
+
+func TestFileCompleteHook(t *testing.T) {
+	dir, err := ioutil.TempDir("", "puller")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	data := []byte("contents from the good node")
+	f := scanner.File{Name: "file", Flags: 0644, Modified: 1234567890, Version: 1000, Size: int64(len(data))}
+	f.Blocks, _ = scanner.Blocks(bytes.NewReader(data), BlockSize)
+
+	m := NewModel(1e6)
+	m.AddRepo("default", dir, []NodeConfiguration{{NodeID: "stale"}, {NodeID: "good"}})
+	m.ScanRepo("default")
+
+	type call struct {
+		file scanner.File
+		node string
+	}
+	var calls []call
+	m.SetFileCompleteHook(func(f scanner.File, node string) {
+		if lf := m.CurrentRepoFile("default", f.Name); lf.Version != f.Version {
+			t.Errorf("Hook called before the file was committed; version %d != %d", lf.Version, f.Version)
+		}
+		calls = append(calls, call{f, node})
+	})
+
+	// The stale node is asked first, but the data comes from the good one.
+	stale := FakeConnection{id: "stale"}
+	good := FakeConnection{id: "good", requestData: data}
+	m.AddConnection(stale, stale)
+	m.AddConnection(good, good)
+	m.Index("stale", "default", []protocol.FileInfo{fileInfoFromFile(f)})
+	m.Index("good", "default", []protocol.FileInfo{fileInfoFromFile(f)})
+
+	if r := pullAll(t, m, "default", dir); r.FilesPulled != 1 {
+		t.Fatalf("Incorrect pull; %d pulled, failures %+v", r.FilesPulled, r.Failures)
+	}
+	if len(calls) != 1 {
+		t.Fatalf("Hook called %d times, expected once", len(calls))
+	}
+	if c := calls[0]; c.file.Name != "file" || c.file.Version != f.Version || c.file.Size != f.Size || c.node != "good" {
+		t.Errorf("Incorrect hook call for %q version %d size %d from %q", c.file.Name, c.file.Version, c.file.Size, c.node)
+	}
+}
+
+func TestVerifyFileHash(t *testing.T) {
+	dir, err := ioutil.TempDir("", "puller")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	a := bytes.Repeat([]byte("a"), BlockSize)
+	b := bytes.Repeat([]byte("b"), BlockSize)
+	correct := append(append([]byte{}, a...), b...)
+	duplicated := append(append([]byte{}, a...), a...)
+
+	hash := func(data []byte) []byte {
+		h := sha256.Sum256(data)
+		return h[:]
+	}
+
+	// The announced block list duplicates the first block, so a temp file
+	// assembled from it passes the block checks. The file hash was computed
+	// over the real contents and catches the mistake.
+	f := scanner.File{Name: "file"}
+	f.Blocks, _ = scanner.Blocks(bytes.NewReader(duplicated), BlockSize)
+
+	path := filepath.Join(dir, "file")
+	if err := ioutil.WriteFile(path, duplicated, 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	f.Hash = nil
+	if err := verifyFile(vfs.OS, path, f, nil); err != nil {
+		t.Errorf("Unexpected error without file hash: %v", err)
+	}
+
+	f.Hash = hash(duplicated)
+	if err := verifyFile(vfs.OS, path, f, nil); err != nil {
+		t.Errorf("Unexpected error with matching file hash: %v", err)
+	}
+
+	f.Hash = hash(correct)
+	if err := verifyFile(vfs.OS, path, f, nil); err == nil {
+		t.Error("Unexpected nil error for mismatching file hash")
+	}
+}
+
+func TestQuarantineAfterFailures(t *testing.T) {
+	dir, err := ioutil.TempDir("", "puller")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	defer func(max int) {
+		cfg.Options.MaxPullFailures = max
+	}(cfg.Options.MaxPullFailures)
+	cfg.Options.MaxPullFailures = 3
+
+	sub := events.Default.Subscribe(events.FileQuarantined)
+	defer events.Default.Unsubscribe(sub)
+
+	// The announced file doesn't match the data the node serves.
+	f := scanner.File{Name: "corrupt", Flags: 0644, Modified: 1234567890, Version: 1000}
+	f.Blocks, _ = scanner.Blocks(bytes.NewReader([]byte("the real contents")), BlockSize)
+
+	m := NewModel(1e6)
+	m.AddRepo("default", dir, []NodeConfiguration{{NodeID: "42"}})
+	m.ScanRepo("default")
+	fc := FakeConnection{id: "42", requestData: []byte("corrupt contents!")}
+	m.AddConnection(fc, fc)
+	m.Index("42", "default", []protocol.FileInfo{fileInfoFromFile(f)})
+
+	p := &puller{
+		repo:              "default",
+		dir:               dir,
+		bq:                newBlockQueue(),
+		model:             m,
+		oustandingPerNode: make(activityMap),
+		openFiles:         make(map[string]openFile),
+		requestResults:    make(chan requestResult),
+	}
+
+	for i := 0; i < cfg.Options.MaxPullFailures; i++ {
+		if m.quarantined("default", f) {
+			t.Fatalf("Quarantined after %d failures", i)
+		}
+		p.queueNeededBlocks()
+		p.handleBlock(p.bq.get())
+		p.handleRequestResult(<-p.requestResults)
+	}
+
+	if !m.quarantined("default", f) {
+		t.Fatal("Not quarantined after max failures")
+	}
+	if fes := m.FileErrors("default"); len(fes) != 1 || fes[0].Failures != 3 || !fes[0].Quarantined {
+		t.Errorf("Incorrect file errors %+v", fes)
+	}
+	if _, err := sub.Poll(time.Second); err != nil {
+		t.Errorf("No quarantine event: %v", err)
+	}
+
+	// Quarantined files are still needed, but not queued.
+	if need := m.NeedFilesRepo("default"); len(need) != 1 {
+		t.Errorf("Incorrect need %v", need)
+	}
+	p.queueNeededBlocks()
+	select {
+	case b := <-p.bq.outbox:
+		t.Errorf("Unexpected queued block for %q", b.file.Name)
+	case <-time.After(100 * time.Millisecond):
+	}
+
+	m.RetryFile("default", "corrupt")
+	if m.quarantined("default", f) {
+		t.Error("Still quarantined after retry")
+	}
+	p.queueNeededBlocks()
+	select {
+	case <-p.bq.outbox:
+	case <-time.After(time.Second):
+		t.Error("File not queued after retry")
+	}
+}
+
+func TestPullRoundReport(t *testing.T) {
+	dir, err := ioutil.TempDir("", "puller")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	sub := events.Default.Subscribe(events.PullRoundCompleted)
+	defer events.Default.Unsubscribe(sub)
+
+	data := []byte("contents from the remote node")
+	pulled := scanner.File{Name: "file", Flags: 0644, Modified: 1234567890, Version: 1000, Size: int64(len(data))}
+	pulled.Blocks, _ = scanner.Blocks(bytes.NewReader(data), BlockSize)
+	missing := scanner.File{Name: "missing", Flags: 0644, Modified: 1234567890, Version: 1000, Size: 42}
+	missing.Blocks, _ = scanner.Blocks(bytes.NewReader(make([]byte, 42)), BlockSize)
+	subdir := scanner.File{Name: "dir", Flags: protocol.FlagDirectory | 0755, Modified: 1234567890, Version: 1000}
+
+	m := NewModel(1e6)
+	m.AddRepo("default", dir, []NodeConfiguration{{NodeID: "42"}})
+	m.ScanRepo("default")
+	reportFile := filepath.Join(dir, "report.json")
+	m.SetPullReportFile(reportFile)
+
+	// The remote serves the contents of "file" for every request, which is
+	// too short for "missing".
+	fc := FakeConnection{id: "42", requestData: data}
+	m.AddConnection(fc, fc)
+	m.Index("42", "default", []protocol.FileInfo{fileInfoFromFile(pulled), fileInfoFromFile(missing), fileInfoFromFile(subdir)})
+
+	p := &puller{
+		repo:              "default",
+		dir:               dir,
+		bq:                newBlockQueue(),
+		model:             m,
+		oustandingPerNode: make(activityMap),
+		openFiles:         make(map[string]openFile),
+		requestResults:    make(chan requestResult),
+	}
+
+	// Nothing done, nothing reported
+	p.finishRound()
+	if _, err := sub.Poll(100 * time.Millisecond); err != events.ErrTimeout {
+		t.Fatalf("Unexpected report for empty round: %v", err)
+	}
+
+	p.queueNeededBlocks()
+	for i := 0; i < 3; i++ {
+		handled := p.handleBlock(p.bq.get())
+		for !handled {
+			handled = p.handleRequestResult(<-p.requestResults)
+		}
+	}
+	p.finishRound()
+
+	ev, err := sub.Poll(time.Second)
+	if err != nil {
+		t.Fatal(err)
+	}
+	r := ev.Data.(*PullReport)
+	if r.Repo != "default" {
+		t.Errorf("Incorrect repo %q", r.Repo)
+	}
+	if r.FilesPulled != 1 {
+		t.Errorf("Incorrect files pulled %d != 1", r.FilesPulled)
+	}
+	if r.FilesDeleted != 0 {
+		t.Errorf("Incorrect files deleted %d != 0", r.FilesDeleted)
+	}
+	if r.DirsUpdated != 1 {
+		t.Errorf("Incorrect dirs updated %d != 1", r.DirsUpdated)
+	}
+	if b := r.BytesPerNode["42"]; b != int64(len(data)) {
+		t.Errorf("Incorrect bytes from node %d != %d", b, len(data))
+	}
+	if len(r.Failures) != 1 || r.Failures[0].Name != "missing" || r.Failures[0].Error != errNoNode.Error() {
+		t.Errorf("Incorrect failures %+v", r.Failures)
+	}
+	if r.Duration <= 0 {
+		t.Errorf("Incorrect duration %v", r.Duration)
+	}
+
+	bs, err := ioutil.ReadFile(reportFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var fr PullReport
+	if err := json.Unmarshal(bs, &fr); err != nil {
+		t.Fatal(err)
+	}
+	if fr.FilesPulled != 1 || fr.BytesPerNode["42"] != int64(len(data)) || len(fr.Failures) != 1 {
+		t.Errorf("Incorrect report in file %s", bs)
+	}
+}
+
+func TestPullPhaseOrder(t *testing.T) {
+	dir, err := ioutil.TempDir("", "puller")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	sub := events.Default.Subscribe(events.PullRoundCompleted)
+	defer events.Default.Unsubscribe(sub)
+
+	os.Mkdir(filepath.Join(dir, "old"), 0755)
+	os.Mkdir(filepath.Join(dir, "meta"), 0755)
+	if err := ioutil.WriteFile(filepath.Join(dir, "old", "file"), []byte("old contents"), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	m := NewModel(1e6)
+	m.AddRepo("default", dir, []NodeConfiguration{{NodeID: "42"}})
+	m.ScanRepo("default")
+
+	data := []byte("new contents")
+	created := scanner.File{Name: "new", Flags: 0644, Modified: 1234567890, Version: 1 << 40, Size: int64(len(data))}
+	created.Blocks, _ = scanner.Blocks(bytes.NewReader(data), BlockSize)
+
+	deletedFile := m.CurrentRepoFile("default", filepath.Join("old", "file"))
+	deletedFile.Flags |= protocol.FlagDeleted
+	deletedFile.Blocks = nil
+	deletedFile.Version += 1000
+
+	deletedDir := m.CurrentRepoFile("default", "old")
+	deletedDir.Flags |= protocol.FlagDeleted
+	deletedDir.Version += 1000
+
+	meta := m.CurrentRepoFile("default", "meta")
+	meta.Modified = 1234567890
+	meta.Version += 1000
+
+	fc := FakeConnection{id: "42", requestData: data}
+	m.AddConnection(fc, fc)
+	var fs []protocol.FileInfo
+	for _, f := range []scanner.File{created, deletedFile, deletedDir, meta} {
+		fs = append(fs, fileInfoFromFile(f))
+	}
+	m.Index("42", "default", fs)
+
+	p := &puller{
+		repo:              "default",
+		dir:               dir,
+		bq:                newBlockQueue(),
+		model:             m,
+		oustandingPerNode: make(activityMap),
+		openFiles:         make(map[string]openFile),
+		requestResults:    make(chan requestResult),
+	}
+
+	p.beginPhase(phaseUpdate)
+	if !p.queueNeededBlocks() {
+		t.Error("Deletes not reported by queueing")
+	}
+	for i := 0; i < 2; i++ {
+		handled := p.handleBlock(p.bq.get())
+		for !handled {
+			handled = p.handleRequestResult(<-p.requestResults)
+		}
+	}
+
+	// All creates and updates are done before anything is deleted
+	if _, err := os.Stat(filepath.Join(dir, "new")); err != nil {
+		t.Error("New file not created in update phase")
+	}
+	if _, err := os.Stat(filepath.Join(dir, "old", "file")); err != nil {
+		t.Error("Deleted file removed in update phase")
+	}
+
+	p.cleanup()
+	p.finishRound()
+
+	if _, err := os.Stat(filepath.Join(dir, "old")); !os.IsNotExist(err) {
+		t.Error("Deleted directory still exists")
+	}
+	if info, err := os.Stat(filepath.Join(dir, "meta")); err != nil || info.ModTime().Unix() != meta.Modified {
+		t.Error("Directory modification time not restored")
+	}
+	if need := m.NeedFilesRepo("default"); len(need) != 0 {
+		t.Errorf("Files still needed after round: %v", need)
+	}
+
+	ev, err := sub.Poll(time.Second)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var phases []string
+	for _, ph := range ev.Data.(*PullReport).Phases {
+		phases = append(phases, ph.Phase)
+	}
+	expected := []string{"update", "deleteFiles", "deleteDirs", "dirMetadata"}
+	if !reflect.DeepEqual(phases, expected) {
+		t.Errorf("Incorrect phases %v != %v", phases, expected)
+	}
+}
+
+func TestPullEmptyDirectories(t *testing.T) {
+	src, err := ioutil.TempDir("", "puller")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(src)
+	dst, err := ioutil.TempDir("", "puller")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dst)
+
+	// "empty" has no children at all, "parent" only an empty directory
+	os.Mkdir(filepath.Join(src, "empty"), 0755)
+	os.MkdirAll(filepath.Join(src, "parent", "child"), 0755)
+
+	w := scanner.Walker{Dir: src, BlockSize: BlockSize}
+	files, _, err := w.Walk()
+	if err != nil {
+		t.Fatal(err)
+	}
+	var fs []protocol.FileInfo
+	for _, f := range files {
+		fs = append(fs, fileInfoFromFile(f))
+	}
+	if len(fs) != 3 {
+		t.Fatalf("Incorrect number of indexed directories %d != 3", len(fs))
+	}
+
+	m := NewModel(1e6)
+	m.AddRepo("default", dst, []NodeConfiguration{{NodeID: "42"}})
+	m.ScanRepo("default")
+	m.Index("42", "default", fs)
+
+	p := &puller{
+		repo:              "default",
+		dir:               dst,
+		bq:                newBlockQueue(),
+		model:             m,
+		oustandingPerNode: make(activityMap),
+		openFiles:         make(map[string]openFile),
+		requestResults:    make(chan requestResult),
+	}
+	p.queueNeededBlocks()
+	for i := 0; i < len(fs); i++ {
+		if !p.handleBlock(p.bq.get()) {
+			t.Fatal("Directory block should be handled synchronously")
+		}
+	}
+	p.cleanup()
+
+	for _, name := range []string{"empty", filepath.Join("parent", "child")} {
+		if info, err := os.Stat(filepath.Join(dst, name)); err != nil || !info.IsDir() {
+			t.Errorf("Directory %q not created", name)
+		}
+	}
+	if need := m.NeedFilesRepo("default"); len(need) != 0 {
+		t.Errorf("Directories still needed after pull: %v", need)
+	}
+}
+
+// A deleted directory that still holds files unknown to the cluster is not
+// recorded as deleted until it has actually been removed.
+func TestPullDeleteNonEmptyDirectory(t *testing.T) {
+	dir := filepath.Join(string(os.PathSeparator), "repo")
+	fs := testutil.NewFakeFS()
+	fs.MkdirAll(filepath.Join(dir, "full"), 0755)
+	fs.MkdirAll(filepath.Join(dir, "empty"), 0755)
+
+	m := NewModel(1e6)
+	m.SetFilesystem(fs)
+	m.AddRepo("default", dir, []NodeConfiguration{{NodeID: "42"}})
+	m.ScanRepo("default")
+	// Created after the scan, so unknown to the index.
+	fs.WriteFile(filepath.Join(dir, "full", "unknown"), []byte("data"), 0644)
+
+	var deleted []protocol.FileInfo
+	for _, name := range []string{"full", "empty"} {
+		v := m.CurrentRepoFile("default", name).Version
+		deleted = append(deleted, fileInfoFromFile(scanner.File{Name: name, Flags: protocol.FlagDirectory | protocol.FlagDeleted, Version: v + 1000}))
+	}
+	m.Index("42", "default", deleted)
+
+	pullAll(t, m, "default", dir)
+	if _, err := fs.Stat(filepath.Join(dir, "empty")); err == nil {
+		t.Error("Empty directory not removed")
+	}
+	if f := m.CurrentRepoFile("default", "empty"); f.Flags&protocol.FlagDeleted == 0 {
+		t.Error("Removed directory not recorded as deleted")
+	}
+	if f := m.CurrentRepoFile("default", "full"); f.Flags&protocol.FlagDeleted != 0 {
+		t.Error("Directory that was not removed recorded as deleted")
+	}
+
+	fs.Remove(filepath.Join(dir, "full", "unknown"))
+	pullAll(t, m, "default", dir)
+	if _, err := fs.Stat(filepath.Join(dir, "full")); err == nil {
+		t.Error("Directory not removed when retried")
+	}
+	if f := m.CurrentRepoFile("default", "full"); f.Flags&protocol.FlagDeleted == 0 {
+		t.Error("Directory not recorded as deleted when retried")
+	}
+}
+
+var fakeFSErrorTestcases = []struct {
+	op  string
+	err error
+}{
+	{"create", syscall.EACCES},
+	{"write", syscall.ENOSPC},
+	{"rename", syscall.EXDEV},
+}
+
+func TestPullFilesystemErrors(t *testing.T) {
+	data := []byte("contents from the remote node")
+	f := scanner.File{Name: "file", Flags: 0644, Modified: 1234567890, Version: 1000, Size: int64(len(data))}
+	f.Blocks, _ = scanner.Blocks(bytes.NewReader(data), BlockSize)
+
+	dir := filepath.Join(string(os.PathSeparator), "repo")
+	temp := filepath.Join(dir, defTempNamer.TempName("file"))
+
+	for i, tc := range fakeFSErrorTestcases {
+		fs := testutil.NewFakeFS()
+		fs.MkdirAll(dir, 0755)
+		fs.SetError(tc.op, temp, tc.err)
+
+		m := NewModel(1e6)
+		m.SetFilesystem(fs)
+		m.AddRepo("default", dir, []NodeConfiguration{{NodeID: "42"}})
+		m.ScanRepo("default")
+		fc := FakeConnection{id: "42", requestData: data}
+		m.AddConnection(fc, fc)
+		m.Index("42", "default", []protocol.FileInfo{fileInfoFromFile(f)})
+
+		p := &puller{
+			repo:              "default",
+			dir:               dir,
+			bq:                newBlockQueue(),
+			model:             m,
+			oustandingPerNode: make(activityMap),
+			openFiles:         make(map[string]openFile),
+			requestResults:    make(chan requestResult),
+		}
+		p.queueNeededBlocks()
+		handled := p.handleBlock(p.bq.get())
+		for !handled {
+			handled = p.handleRequestResult(<-p.requestResults)
+		}
+
+		if len(p.openFiles) != 0 {
+			t.Errorf("%d: file left open after %s error", i, tc.op)
+		}
+		if _, err := fs.Stat(filepath.Join(dir, "file")); !os.IsNotExist(err) {
+			t.Errorf("%d: file created despite %s error", i, tc.op)
+		}
+		if _, err := fs.Stat(temp); !os.IsNotExist(err) {
+			t.Errorf("%d: temporary file left after %s error", i, tc.op)
+		}
+		if r := p.report(); len(r.Failures) != 1 || !strings.Contains(r.Failures[0].Error, tc.err.Error()) {
+			t.Errorf("%d: incorrect failures %+v", i, r.Failures)
+		}
+		if fes := m.FileErrors("default"); len(fes) != 1 || !strings.Contains(fes[0].Err, tc.err.Error()) {
+			t.Errorf("%d: incorrect file errors %+v", i, fes)
+		}
+	}
+}
+
+// swappingFS replaces the target of every rename with other contents, as if
+// another process had written the file just after we moved it into place.
+type swappingFS struct {
+	*testutil.FakeFS
+}
+
+func (fs swappingFS) Rename(from, to string) error {
+	if err := fs.FakeFS.Rename(from, to); err != nil {
+		return err
+	}
+	return fs.WriteFile(to, []byte("someone else's data"), 0644)
+}
+
+func TestPullVerifyRename(t *testing.T) {
+	data := []byte("contents from the remote node")
+	f := scanner.File{Name: "file", Flags: 0644, Modified: 1234567890, Version: 1000, Size: int64(len(data))}
+	f.Blocks, _ = scanner.Blocks(bytes.NewReader(data), BlockSize)
+
+	dir := filepath.Join(string(os.PathSeparator), "repo")
+	fs := swappingFS{testutil.NewFakeFS()}
+	fs.MkdirAll(dir, 0755)
+
+	m := NewModel(1e6)
+	m.SetFilesystem(fs)
+	m.SetVerifyRenames(true)
+	m.AddRepo("default", dir, []NodeConfiguration{{NodeID: "42"}})
+	m.ScanRepo("default")
+	fc := FakeConnection{id: "42", requestData: data}
+	m.AddConnection(fc, fc)
+	m.Index("42", "default", []protocol.FileInfo{fileInfoFromFile(f)})
+
+	p := &puller{
+		repo:              "default",
+		dir:               dir,
+		bq:                newBlockQueue(),
+		model:             m,
+		oustandingPerNode: make(activityMap),
+		openFiles:         make(map[string]openFile),
+		requestResults:    make(chan requestResult),
+	}
+	p.queueNeededBlocks()
+	handled := p.handleBlock(p.bq.get())
+	for !handled {
+		handled = p.handleRequestResult(<-p.requestResults)
+	}
+
+	if r := p.report(); r.FilesPulled != 0 || len(r.Failures) != 1 || !strings.Contains(r.Failures[0].Error, "after rename") {
+		t.Errorf("Swapped file not detected; %d pulled, failures %+v", r.FilesPulled, r.Failures)
+	}
+	if need := m.NeedFilesRepo("default"); len(need) != 1 {
+		t.Errorf("Swapped file no longer needed; need set %v", need)
+	}
+}
+
+// swapOnceFS is like swappingFS, but only for the first rename of a
+// temporary file into place.
+type swapOnceFS struct {
+	*testutil.FakeFS
+	swapped *bool
+}
+
+func (fs swapOnceFS) Rename(from, to string) error {
+	if err := fs.FakeFS.Rename(from, to); err != nil {
+		return err
+	}
+	if *fs.swapped || !defTempNamer.IsTemporary(from) || defTempNamer.IsTemporary(to) {
+		return nil
+	}
+	*fs.swapped = true
+	return fs.WriteFile(to, []byte("someone else's data"), 0644)
+}
+
+func TestPullPreserveOriginal(t *testing.T) {
+	dir := filepath.Join(string(os.PathSeparator), "repo")
+	path := filepath.Join(dir, "file")
+	fs := swapOnceFS{testutil.NewFakeFS(), new(bool)}
+	fs.MkdirAll(dir, 0755)
+	original := []byte("the original contents")
+	fs.WriteFile(path, original, 0644)
+
+	m := NewModel(1e6)
+	m.SetFilesystem(fs)
+	m.SetPreserveOriginals(true)
+	m.SetVerifyRenames(true)
+	m.AddRepo("default", dir, []NodeConfiguration{{NodeID: "42"}})
+	m.ScanRepo("default")
+	lf := m.CurrentRepoFile("default", "file")
+
+	data := []byte("contents from the remote node")
+	f := scanner.File{Name: "file", Flags: 0644, Modified: 1234567890, Version: lf.Version + 1, Size: int64(len(data))}
+	f.Blocks, _ = scanner.Blocks(bytes.NewReader(data), BlockSize)
+	fc := FakeConnection{id: "42", requestData: data}
+	m.AddConnection(fc, fc)
+	m.Index("42", "default", []protocol.FileInfo{fileInfoFromFile(f)})
+
+	// The file is swapped just after it is moved into place, failing the
+	// verification; the original must be put back.
+	r := pullAll(t, m, "default", dir)
+	if r.FilesPulled != 0 || len(r.Failures) != 1 {
+		t.Fatalf("Incorrect pull report; %d pulled, failures %+v", r.FilesPulled, r.Failures)
+	}
+	if bs, _ := vfs.ReadFile(fs, path); !bytes.Equal(bs, original) {
+		t.Errorf("Original not restored; contents %q", bs)
+	}
+	if cur := m.CurrentRepoFile("default", "file"); cur.Version != lf.Version {
+		t.Errorf("Local index updated after failed pull: %v", cur)
+	}
+	if _, err := fs.Stat(filepath.Join(dir, defTempNamer.TempName("file")+backupSuffix)); err == nil {
+		t.Error("Backup of original left behind")
+	}
+
+	// Next time around the update goes through and the backup is removed.
+	r = pullAll(t, m, "default", dir)
+	if r.FilesPulled != 1 {
+		t.Fatalf("Incorrect pull report; %d pulled, failures %+v", r.FilesPulled, r.Failures)
+	}
+	if bs, _ := vfs.ReadFile(fs, path); !bytes.Equal(bs, data) {
+		t.Errorf("Incorrect contents %q after pull", bs)
+	}
+	if _, err := fs.Stat(filepath.Join(dir, defTempNamer.TempName("file")+backupSuffix)); err == nil {
+		t.Error("Backup of original left behind")
+	}
+}
+
+// Originals left behind by an interrupted update are put back, kept as a
+// version or removed, depending on how far the update got. Until then they
+// aren't orphans to be cleaned up.
+func TestRecoverOriginals(t *testing.T) {
+	dir := filepath.Join(string(os.PathSeparator), "repo")
+	fs := testutil.NewFakeFS()
+	fs.MkdirAll(dir, 0755)
+	backup := func(name string) string {
+		return filepath.Join(dir, defTempNamer.TempName(name)+backupSuffix)
+	}
+
+	// Moved aside, never replaced.
+	fs.WriteFile(backup("moved"), []byte("moved"), 0644)
+	// Linked, never replaced.
+	fs.WriteFile(filepath.Join(dir, "linked"), []byte("linked"), 0644)
+	fs.Link(filepath.Join(dir, "linked"), backup("linked"))
+	// Replaced, the original not yet kept as a version.
+	fs.WriteFile(backup("updated"), []byte("old"), 0644)
+	fs.WriteFile(filepath.Join(dir, "updated"), []byte("new data"), 0644)
+
+	m := NewModel(1e6)
+	m.SetFilesystem(fs)
+	m.SetKeepVersions(5)
+	m.AddRepo("default", dir, nil)
+
+	if orphans := m.OrphanTempFiles("default"); len(orphans) != 0 {
+		t.Errorf("Originals reported as orphans: %v", orphans)
+	}
+
+	p := &puller{repo: "default", dir: dir, model: m}
+	p.recoverOriginals()
+
+	for _, tc := range []struct{ name, data string }{{"moved", "moved"}, {"linked", "linked"}, {"updated", "new data"}} {
+		if bs, err := vfs.ReadFile(fs, filepath.Join(dir, tc.name)); err != nil || string(bs) != tc.data {
+			t.Errorf("%q: contents %q, %v after recovery; expected %q", tc.name, bs, err, tc.data)
+		}
+		if _, err := fs.Lstat(backup(tc.name)); !os.IsNotExist(err) {
+			t.Errorf("%q: original left behind: %v", tc.name, err)
+		}
+	}
+	if vs := m.Versions("default", "updated"); len(vs) != 1 {
+		t.Errorf("Replaced original not kept as a version: %v", vs)
+	}
+	if vs := m.Versions("default", "linked"); len(vs) != 0 {
+		t.Errorf("Unreplaced original kept as a version: %v", vs)
+	}
+}
+
+// lockingFS fails every rename as if the destination was open in another
+// application.
+type lockingFS struct {
+	*testutil.FakeFS
+}
+
+func (fs lockingFS) Rename(from, to string) error {
+	return &os.LinkError{Op: "rename", Old: from, New: to, Err: lockedErrnos[0]}
+}
+
+func TestPullDestinationLocked(t *testing.T) {
+	defer func(maxPull, maxLocked, backoff int) {
+		cfg.Options.MaxPullFailures = maxPull
+		cfg.Options.MaxLockedAttempts = maxLocked
+		cfg.Options.LockedBackoffS = backoff
+	}(cfg.Options.MaxPullFailures, cfg.Options.MaxLockedAttempts, cfg.Options.LockedBackoffS)
+	cfg.Options.MaxPullFailures = 2
+	cfg.Options.MaxLockedAttempts = 3
+	cfg.Options.LockedBackoffS = 3600
+
+	data := []byte("contents from the remote node")
+	f := scanner.File{Name: "file", Flags: 0644, Modified: 1234567890, Version: 1000, Size: int64(len(data))}
+	f.Blocks, _ = scanner.Blocks(bytes.NewReader(data), BlockSize)
+
+	dir := filepath.Join(string(os.PathSeparator), "repo")
+	fs := lockingFS{testutil.NewFakeFS()}
+	fs.MkdirAll(dir, 0755)
+
+	m := NewModel(1e6)
+	m.SetFilesystem(fs)
+	m.AddRepo("default", dir, []NodeConfiguration{{NodeID: "42"}})
+	m.ScanRepo("default")
+	fc := FakeConnection{id: "42", requestData: data}
+	m.AddConnection(fc, fc)
+	m.Index("42", "default", []protocol.FileInfo{fileInfoFromFile(f)})
+
+	p := &puller{
+		repo:              "default",
+		dir:               dir,
+		bq:                newBlockQueue(),
+		model:             m,
+		oustandingPerNode: make(activityMap),
+		openFiles:         make(map[string]openFile),
+		requestResults:    make(chan requestResult),
+	}
+
+	for i := 0; i < cfg.Options.MaxLockedAttempts; i++ {
+		if m.skipPull("default", f) {
+			t.Fatalf("Deferred after %d failures", i)
+		}
+		p.queueNeededBlocks()
+		handled := p.handleBlock(p.bq.get())
+		for !handled {
+			handled = p.handleRequestResult(<-p.requestResults)
+		}
+	}
+
+	// Lock failures defer the file instead of quarantining it.
+	fes := m.FileErrors("default")
+	if len(fes) != 1 {
+		t.Fatalf("Incorrect file errors %+v", fes)
+	}
+	fe := fes[0]
+	if fe.LockedFailures != 3 || fe.Quarantined || !strings.HasPrefix(fe.Err, "destination locked") {
+		t.Errorf("Incorrect file error %+v", fe)
+	}
+	if fe.RetryAfter.Before(time.Now().Add(59 * time.Minute)) {
+		t.Errorf("Retry after %v is too soon", fe.RetryAfter)
+	}
+	if !m.skipPull("default", f) {
+		t.Fatal("Not deferred after max lock failures")
+	}
+
+	p.queueNeededBlocks()
+	select {
+	case b := <-p.bq.outbox:
+		t.Errorf("Unexpected queued block for %q", b.file.Name)
+	case <-time.After(100 * time.Millisecond):
+	}
+
+	m.RetryFile("default", "file")
+	p.queueNeededBlocks()
+	select {
+	case <-p.bq.outbox:
+	case <-time.After(time.Second):
+		t.Error("File not queued after retry")
+	}
+}
+
+func TestTransferInventory(t *testing.T) {
+	block := bytes.Repeat([]byte("x"), BlockSize)
+	data := append(append([]byte(nil), block...), block...)
+	f := scanner.File{Name: "file", Flags: 0644, Modified: 1234567890, Version: 1000, Size: int64(len(data))}
+	f.Blocks, _ = scanner.Blocks(bytes.NewReader(data), BlockSize)
+
+	dir := filepath.Join(string(os.PathSeparator), "repo")
+	fs := testutil.NewFakeFS()
+	fs.MkdirAll(filepath.Join(dir, "sub"), 0755)
+
+	// Left over from an earlier run
+	stray := []string{
+		defTempNamer.TempName("stray"),
+		defTempNamer.TempName(filepath.Join("sub", "old")),
+	}
+	for _, rn := range stray {
+		fs.WriteFile(filepath.Join(dir, rn), []byte("partial"), 0644)
+	}
+
+	m := NewModel(1e6)
+	m.SetFilesystem(fs)
+	m.AddRepo("default", dir, []NodeConfiguration{{NodeID: "42"}})
+	m.ScanRepo("default")
+	fc := FakeConnection{id: "42", requestData: block}
+	m.AddConnection(fc, fc)
+	m.Index("42", "default", []protocol.FileInfo{fileInfoFromFile(f)})
+
+	p := &puller{
+		repo:              "default",
+		dir:               dir,
+		bq:                newBlockQueue(),
+		model:             m,
+		oustandingPerNode: make(activityMap),
+		openFiles:         make(map[string]openFile),
+		requestResults:    make(chan requestResult),
+	}
+	p.queueNeededBlocks()
+	if p.handleBlock(p.bq.get()) {
+		t.Fatal("First block not requested")
+	}
+	p.handleRequestResult(<-p.requestResults)
+
+	temp := filepath.Join(dir, defTempNamer.TempName("file"))
+	exp := []Transfer{{Repo: "default", Name: "file", Temp: temp, Written: BlockSize, Nodes: []string{"42"}}}
+	if tr := m.ActiveTransfers(); !reflect.DeepEqual(tr, exp) {
+		t.Errorf("Incorrect active transfers\n%+v !=\n%+v", tr, exp)
+	}
+
+	orphans := m.OrphanTempFiles("default")
+	sort.Strings(orphans)
+	sort.Strings(stray)
+	if !reflect.DeepEqual(orphans, stray) {
+		t.Errorf("Incorrect orphans %v != %v", orphans, stray)
+	}
+
+	// What is known about the temporary files goes with them.
+	m.tmut.Lock()
+	for _, rn := range append(stray, defTempNamer.TempName("file")) {
+		m.tempHave[filepath.Join(dir, rn)] = tempHave{}
+	}
+	m.tmut.Unlock()
+
+	if err := m.RemoveOrphanTempFiles("default"); err != nil {
+		t.Fatal(err)
+	}
+	for _, rn := range stray {
+		if _, err := fs.Stat(filepath.Join(dir, rn)); !os.IsNotExist(err) {
+			t.Errorf("Orphan %q not removed: %v", rn, err)
+		}
+	}
+	m.tmut.Lock()
+	if len(m.tempHave) != 1 {
+		t.Errorf("Incorrect cached temp files %v after removing orphans", m.tempHave)
+	}
+	m.tmut.Unlock()
+	if _, err := fs.Stat(temp); err != nil {
+		t.Errorf("Active temp file removed: %v", err)
+	}
+
+	handled := p.handleBlock(p.bq.get())
+	for !handled {
+		handled = p.handleRequestResult(<-p.requestResults)
+	}
+	if r := p.report(); r.FilesPulled != 1 {
+		t.Errorf("File not pulled; failures %+v", r.Failures)
+	}
+	if tr := m.ActiveTransfers(); len(tr) != 0 {
+		t.Errorf("Transfers remain after pull: %+v", tr)
+	}
+	m.tmut.Lock()
+	if len(m.tempHave) != 0 {
+		t.Errorf("Cached temp files remain after pull: %v", m.tempHave)
+	}
+	m.tmut.Unlock()
+}
+
+// stuckConnection is a FakeConnection that doesn't answer requests until
+// released.
+type stuckConnection struct {
+	FakeConnection
+	release chan struct{}
+}
+
+func (c stuckConnection) Request(repo, name string, offset int64, size int) ([]byte, error) {
+	<-c.release
+	return c.FakeConnection.Request(repo, name, offset, size)
+}
+
+func TestCancelPull(t *testing.T) {
+	block := bytes.Repeat([]byte("x"), BlockSize)
+	data := append(append([]byte(nil), block...), block...)
+	f := scanner.File{Name: "file", Flags: 0644, Modified: 1234567890, Version: 1000, Size: int64(len(data))}
+	f.Blocks, _ = scanner.Blocks(bytes.NewReader(data), BlockSize)
+
+	dir := filepath.Join(string(os.PathSeparator), "repo")
+	fs := testutil.NewFakeFS()
+	fs.MkdirAll(dir, 0755)
+
+	m := NewModel(1e6)
+	m.SetFilesystem(fs)
+	m.AddRepo("default", dir, []NodeConfiguration{{NodeID: "42"}})
+	m.ScanRepo("default")
+	fc := stuckConnection{FakeConnection{id: "42", requestData: block}, make(chan struct{})}
+	defer close(fc.release)
+	m.AddConnection(fc, fc)
+	m.Index("42", "default", []protocol.FileInfo{fileInfoFromFile(f)})
+
+	p := &puller{
+		repo:              "default",
+		dir:               dir,
+		bq:                newBlockQueue(),
+		model:             m,
+		oustandingPerNode: make(activityMap),
+		openFiles:         make(map[string]openFile),
+		requestResults:    make(chan requestResult),
+	}
+	p.queueNeededBlocks()
+	if p.handleBlock(p.bq.get()) {
+		t.Fatal("First block not requested")
+	}
+
+	if pulls := m.ActivePulls("default"); !reflect.DeepEqual(pulls, []string{"file"}) {
+		t.Fatalf("Incorrect active pulls %v", pulls)
+	}
+	if err := m.CancelPull("default", "other"); err != ErrNotPulling {
+		t.Errorf("Incorrect error canceling file not being pulled: %v", err)
+	}
+	if err := m.CancelPull("default", "file"); err != nil {
+		t.Fatal(err)
+	}
+
+	// The stuck request is abandoned.
+	select {
+	case res := <-p.requestResults:
+		if res.err != errPullCanceled {
+			t.Errorf("Incorrect request error %v", res.err)
+		}
+		p.handleRequestResult(res)
+	case <-time.After(5 * time.Second):
+		t.Fatal("Request not abandoned")
+	}
+	if !p.handleBlock(p.bq.get()) {
+		t.Error("Last block requested after cancel")
+	}
+
+	temp := filepath.Join(dir, defTempNamer.TempName("file"))
+	if _, err := fs.Stat(temp); !os.IsNotExist(err) {
+		t.Errorf("Temp file not removed: %v", err)
+	}
+	if pulls := m.ActivePulls("default"); len(pulls) != 0 {
+		t.Errorf("Pulls remain after cancel: %v", pulls)
+	}
+	if need := m.NeedFilesRepo("default"); len(need) != 1 || need[0].Name != "file" {
+		t.Errorf("Canceled file no longer needed: %v", need)
+	}
+
+	// The canceled version is not pulled again, but a newer one is.
+	p.queueNeededBlocks()
+	select {
+	case b := <-p.bq.outbox:
+		t.Errorf("Canceled file queued again: %q", b.file.Name)
+	case <-time.After(100 * time.Millisecond):
+	}
+	f.Version++
+	m.Index("42", "default", []protocol.FileInfo{fileInfoFromFile(f)})
+	p.queueNeededBlocks()
+	select {
+	case b := <-p.bq.outbox:
+		if b.file.Version != f.Version {
+			t.Errorf("Incorrect version queued %d", b.file.Version)
+		}
+	case <-time.After(5 * time.Second):
+		t.Error("Newer version not queued")
+	}
+}
+
+type pipeCloser struct {
+	r *io.PipeReader
+	w *io.PipeWriter
+}
+
+func (c pipeCloser) Close() error {
+	c.r.Close()
+	return c.w.Close()
+}
+
+// requestCounter counts the requests a model receives.
+type requestCounter struct {
+	requests int64 // accessed atomically and first for alignment
+	*Model
+}
+
+func (c *requestCounter) Request(nodeID, repo, name string, offset int64, size int) ([]byte, error) {
+	atomic.AddInt64(&c.requests, 1)
+	return c.Model.Request(nodeID, repo, name, offset, size)
+}
+
+// connectModels connects the models "src" and "dst" over the protocol and
+// waits for dst to receive the index of src. Requests to src are counted.
+func connectModels(t testing.TB, src, dst *Model) *requestCounter {
+	rc := &requestCounter{Model: src}
+	ar, aw := io.Pipe()
+	br, bw := io.Pipe()
+	srcConn := protocol.NewConnection("dst", ar, bw, rc)
+	dstConn := protocol.NewConnection("src", br, aw, dst)
+	src.AddConnection(pipeCloser{ar, bw}, srcConn)
+	dst.AddConnection(pipeCloser{br, aw}, dstConn)
+
+	timeout := time.After(5 * time.Second)
+	for !dst.IndexReceived("src") {
+		select {
+		case <-timeout:
+			t.Fatal("Timeout waiting for index")
+		case <-time.After(10 * time.Millisecond):
+		}
+	}
+	return rc
+}
+
+// pullAll runs the puller until there is nothing more to pull.
+func pullAll(t testing.TB, m *Model, repo, dir string) *PullReport {
+	p := &puller{
+		repo:              repo,
+		dir:               dir,
+		bq:                newBlockQueue(),
+		model:             m,
+		oustandingPerNode: make(activityMap),
+		openFiles:         make(map[string]openFile),
+		requestResults:    make(chan requestResult),
+		copyResults:       make(chan copyResult),
+	}
+	p.queueNeededBlocks()
+	timeout := time.After(60 * time.Second)
+	for {
+		select {
+		case b := <-p.bq.outbox:
+			p.handleBlock(b)
+		case res := <-p.requestResults:
+			p.handleRequestResult(res)
+		case res := <-p.copyResults:
+			p.handleCopyResult(res)
+		case <-time.After(100 * time.Millisecond):
+			if len(p.openFiles) == 0 {
+				p.cleanup()
+				return p.report()
+			}
+		case <-timeout:
+			t.Fatal("Timeout pulling")
+		}
+	}
+}
+
+// Two models connected over the protocol; one serves the test data, the
+// other pulls it into an empty directory.
+func TestPullFromConnectedModel(t *testing.T) {
+	dir, err := ioutil.TempDir("", "puller")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	src := NewModel(1e6)
+	src.AddRepo("default", "testdata", []NodeConfiguration{{NodeID: "dst"}})
+	src.ScanRepo("default")
+
+	dst := NewModel(1e6)
+	dst.AddRepo("default", dir, []NodeConfiguration{{NodeID: "src"}})
+	dst.ScanRepo("default")
+
+	connectModels(t, src, dst)
+	if need := dst.NeedFilesRepo("default"); len(need) != 4 {
+		t.Fatalf("Incorrect need %v", need)
+	}
+
+	if r := pullAll(t, dst, "default", dir); len(r.Failures) != 0 {
+		t.Errorf("Unexpected failures %+v", r.Failures)
+	}
+	if need := dst.NeedFilesRepo("default"); len(need) != 0 {
+		t.Errorf("Still needed after pull: %v", need)
+	}
+	for _, name := range []string{"foo", "bar", "empty"} {
+		exp, _ := ioutil.ReadFile(filepath.Join("testdata", name))
+		data, err := ioutil.ReadFile(filepath.Join(dir, name))
+		if err != nil {
+			t.Error(err)
+		} else if !bytes.Equal(data, exp) {
+			t.Errorf("Incorrect contents of %q: %q != %q", name, data, exp)
+		}
+	}
+	if fi, err := os.Stat(filepath.Join(dir, "baz")); err != nil || !fi.IsDir() {
+		t.Errorf("Directory baz not created: %v", err)
+	}
+	if _, err := os.Stat(filepath.Join(dir, "baz", "quux")); !os.IsNotExist(err) {
+		t.Errorf("Ignored file baz/quux pulled: %v", err)
+	}
+}
+
+// Files that don't fit in the free space less the reserve are deferred, with
+// one warning, until space frees up.
+func TestPullDiskSpace(t *testing.T) {
+	sub := events.Default.Subscribe(events.DiskSpaceLow)
+	defer events.Default.Unsubscribe(sub)
+
+	dir, err := ioutil.TempDir("", "puller")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	src := NewModel(1e6)
+	src.AddRepo("default", "testdata", []NodeConfiguration{{NodeID: "dst"}})
+	src.ScanRepo("default")
+
+	const reserve = 1 << 20
+	free := int64(reserve + 8) // room for foo (7 bytes) but not bar (10 bytes)
+	dst := NewModel(1e6)
+	dst.freeSpace = func(string) (int64, error) {
+		return atomic.LoadInt64(&free), nil
+	}
+	dst.SetDiskReserve(reserve)
+	dst.AddRepo("default", dir, []NodeConfiguration{{NodeID: "src"}})
+	dst.ScanRepo("default")
+	connectModels(t, src, dst)
+
+	r := pullAll(t, dst, "default", dir)
+	if exp := []PullFailure{{"bar", errOutOfDiskSpace.Error()}}; !reflect.DeepEqual(r.Failures, exp) {
+		t.Errorf("Incorrect failures %+v != %+v", r.Failures, exp)
+	}
+	if need := dst.NeedFilesRepo("default"); len(need) != 1 || need[0].Name != "bar" {
+		t.Errorf("Incorrect need %v", need)
+	}
+	if _, err := os.Stat(filepath.Join(dir, "foo")); err != nil {
+		t.Errorf("File that fits not pulled: %v", err)
+	}
+	ev, err := sub.Poll(time.Second)
+	if err != nil {
+		t.Fatal("No disk space event:", err)
+	}
+	if data := ev.Data.(map[string]interface{}); data["repo"] != "default" || data["deferred"] != 1 {
+		t.Errorf("Incorrect event data %v", data)
+	}
+
+	// Still short of space; no further warning.
+	r = pullAll(t, dst, "default", dir)
+	if _, err := sub.Poll(10 * time.Millisecond); err != events.ErrTimeout {
+		t.Errorf("Repeated disk space event")
+	}
+
+	atomic.StoreInt64(&free, reserve+10)
+	r = pullAll(t, dst, "default", dir)
+	if len(r.Failures) != 0 {
+		t.Errorf("Unexpected failures %+v", r.Failures)
+	}
+	if need := dst.NeedFilesRepo("default"); len(need) != 0 {
+		t.Errorf("Still needed after space freed up: %v", need)
+	}
+	dst.rmut.RLock()
+	low := dst.lowSpace["default"]
+	dst.rmut.RUnlock()
+	if low {
+		t.Error("Disk space condition not cleared")
+	}
+}
+
+// writeFiles creates n files of the given size with distinct contents.
+func writeFiles(t testing.TB, dir string, n, size int) {
+	data := make([]byte, size)
+	for i := 0; i < n; i++ {
+		for j := range data {
+			data[j] = byte(i + j/BlockSize)
+		}
+		binary.BigEndian.PutUint32(data, uint32(i))
+		if err := ioutil.WriteFile(filepath.Join(dir, fmt.Sprintf("file%05d", i)), data, 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+}
+
+func TestPullCoalescedRequests(t *testing.T) {
+	testPullRequests(t, false)
+}
+
+// With the peer accepting single blocks only, the blocks of each file are
+// requested in a batch.
+func TestPullBatchedRequests(t *testing.T) {
+	testPullRequests(t, true)
+}
+
+func testPullRequests(t *testing.T, single bool) {
+	srcDir, err := ioutil.TempDir("", "puller")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(srcDir)
+	dstDir, err := ioutil.TempDir("", "puller")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dstDir)
+
+	// Three blocks per file, the last one short
+	writeFiles(t, srcDir, 3, 2*BlockSize+100)
+
+	src := NewModel(1e6)
+	src.AddRepo("default", srcDir, []NodeConfiguration{{NodeID: "dst"}})
+	src.ScanRepo("default")
+	dst := NewModel(1e6)
+	dst.AddRepo("default", dstDir, []NodeConfiguration{{NodeID: "src"}})
+	dst.ScanRepo("default")
+
+	rc := connectModels(t, src, dst)
+	expRequests := int64(3)
+	if single {
+		dst.pmut.Lock()
+		dst.maxRequest["src"] = BlockSize
+		dst.pmut.Unlock()
+		expRequests = 9
+	}
+	if r := pullAll(t, dst, "default", dstDir); len(r.Failures) != 0 || r.FilesPulled != 3 {
+		t.Errorf("Incorrect pull; %d pulled, failures %+v", r.FilesPulled, r.Failures)
+	}
+	if n := atomic.LoadInt64(&rc.requests); n != expRequests {
+		t.Errorf("Incorrect number of requests %d != %d", n, expRequests)
+	}
+	for i := 0; i < 3; i++ {
+		name := fmt.Sprintf("file%05d", i)
+		exp, _ := ioutil.ReadFile(filepath.Join(srcDir, name))
+		data, _ := ioutil.ReadFile(filepath.Join(dstDir, name))
+		if !bytes.Equal(data, exp) {
+			t.Errorf("Incorrect contents of %q", name)
+		}
+	}
+}
+
+func TestBatchRequests(t *testing.T) {
+	block := func(i int, zero bool) scanner.Block {
+		b := scanner.Block{Offset: int64(i) * BlockSize, Size: BlockSize, Hash: []byte{byte(i)}}
+		if zero {
+			b.Hash = zeroBlockHash[:]
+		}
+		return b
+	}
+	var q blockQueue
+	q.addBlock(bqAdd{
+		file:       scanner.File{Name: "file"},
+		need:       []scanner.Block{block(0, false), block(1, false), block(3, false), block(4, true), block(5, false), block(7, false)},
+		maxRequest: 2 * BlockSize,
+		maxBatch:   3,
+		sparse:     true,
+	})
+
+	// Adjacent blocks are requested together and the requests batched, but
+	// the zero block is left on its own.
+	var offsets [][]int64
+	for _, b := range q.queued {
+		var reqs []int64
+		for _, r := range b.batch {
+			reqs = append(reqs, r.block.Offset/BlockSize)
+		}
+		if len(b.batch) == 0 {
+			reqs = append(reqs, b.block.Offset/BlockSize)
+		}
+		offsets = append(offsets, reqs)
+	}
+	exp := [][]int64{{0, 3}, {4}, {5, 7}}
+	if !reflect.DeepEqual(offsets, exp) {
+		t.Errorf("Incorrect requests %v != %v", offsets, exp)
+	}
+	if b := q.queued[0]; b.block.Size != 3*BlockSize || len(b.batch[0].parts) != 2 {
+		t.Errorf("Incorrect first batch %+v", b)
+	}
+	if !q.queued[2].last {
+		t.Error("Last batch not marked last")
+	}
+}
+
+// fileConnection serves requests from the contents of a file, corrupting
+// the block at the given offset.
+type fileConnection struct {
+	FakeConnection
+	data    []byte
+	corrupt int64
+}
+
+func (c fileConnection) Request(repo, name string, offset int64, size int) ([]byte, error) {
+	data := append([]byte(nil), c.data[offset:offset+int64(size)]...)
+	if offset == c.corrupt {
+		data[0]++
+	}
+	return data, nil
+}
+
+func (c fileConnection) RequestBatch(repo, name string, blocks []protocol.RequestBlock) []protocol.BlockResult {
+	res := make([]protocol.BlockResult, len(blocks))
+	for i, b := range blocks {
+		res[i].Data, res[i].Err = c.Request(repo, name, int64(b.Offset), int(b.Size))
+	}
+	return res
+}
+
+func TestPullBatchPartialFailure(t *testing.T) {
+	dir, err := ioutil.TempDir("", "puller")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	data := make([]byte, 4*BlockSize)
+	for i := range data {
+		data[i] = byte(i / 1000)
+	}
+	f := scanner.File{Name: "file", Flags: 0644, Modified: 1234567890, Version: 1000, Size: int64(len(data))}
+	f.Blocks, _ = scanner.Blocks(bytes.NewReader(data), BlockSize)
+
+	m := NewModel(1e6)
+	m.AddRepo("default", dir, []NodeConfiguration{{NodeID: "bad"}, {NodeID: "good"}})
+	m.ScanRepo("default")
+
+	// The bad node serves one of the blocks corrupted.
+	bad := fileConnection{FakeConnection{id: "bad"}, data, BlockSize}
+	good := fileConnection{FakeConnection{id: "good"}, data, -1}
+	m.AddConnection(bad, bad)
+	m.AddConnection(good, good)
+	m.pmut.Lock()
+	m.maxBatch["bad"] = protocol.MaxBatchBlocks
+	m.maxBatch["good"] = protocol.MaxBatchBlocks
+	m.pmut.Unlock()
+	m.Index("bad", "default", []protocol.FileInfo{fileInfoFromFile(f)})
+	m.Index("good", "default", []protocol.FileInfo{fileInfoFromFile(f)})
+
+	p := &puller{
+		repo:              "default",
+		dir:               dir,
+		bq:                newBlockQueue(),
+		model:             m,
+		oustandingPerNode: make(activityMap),
+		openFiles:         make(map[string]openFile),
+		requestResults:    make(chan requestResult),
+	}
+	p.queueNeededBlocks()
+
+	if p.handleBlock(p.bq.get()) {
+		t.Fatal("Blocks should have been requested")
+	}
+
+	res := <-p.requestResults
+	if res.node != "bad" || len(res.batch) != 4 {
+		t.Fatalf("Incorrect result from %q with %d requests", res.node, len(res.batch))
+	}
+	if p.handleRequestResult(res) {
+		t.Fatal("Corrupt block should have been requested again")
+	}
+
+	// Only the corrupt block is requested again.
+	res = <-p.requestResults
+	if res.node != "good" || res.batch != nil || res.offset != BlockSize || res.size != BlockSize {
+		t.Fatalf("Incorrect request from %q at offset %d size %d", res.node, res.offset, res.size)
+	}
+	if !p.handleRequestResult(res) {
+		t.Fatal("Request should have been fully handled")
+	}
+
+	if bs, _ := ioutil.ReadFile(filepath.Join(dir, "file")); !bytes.Equal(bs, data) {
+		t.Error("Incorrect contents")
+	}
+	if need := m.NeedFilesRepo("default"); len(need) != 0 {
+		t.Errorf("File should not be needed after pull: %v", need)
+	}
+}
+
+func TestVerifyParts(t *testing.T) {
+	data := bytes.Repeat([]byte("abcd"), BlockSize/2)
+	parts, _ := scanner.Blocks(bytes.NewReader(data), BlockSize)
+	for i := range parts {
+		parts[i].Offset += 1000
+	}
+	if err := verifyParts(data, 1000, parts); err != nil {
+		t.Error(err)
+	}
+	data[BlockSize+10] = 'x'
+	if err := verifyParts(data, 1000, parts); err != errBlockHash {
+		t.Errorf("Corrupt second block not detected: %v", err)
+	}
+}
+
+// benchmarkPull pulls files of the given size over a loopback connection
+// and reports the number of requests per file. With single set, every
+// block is requested on its own.
+func benchmarkPull(b *testing.B, files, size int, single bool) {
+	srcDir, err := ioutil.TempDir("", "puller")
+	if err != nil {
+		b.Fatal(err)
+	}
+	defer os.RemoveAll(srcDir)
+	writeFiles(b, srcDir, files, size)
+
+	src := NewModel(1e6)
+	src.AddRepo("default", srcDir, []NodeConfiguration{{NodeID: "dst"}})
+	src.ScanRepo("default")
+
+	var requests int64
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		b.StopTimer()
+		dstDir, err := ioutil.TempDir("", "puller")
+		if err != nil {
+			b.Fatal(err)
+		}
+		dst := NewModel(1e6)
+		dst.AddRepo("default", dstDir, []NodeConfiguration{{NodeID: "src"}})
+		dst.ScanRepo("default")
+		rc := connectModels(b, src, dst)
+		if single {
+			dst.pmut.Lock()
+			dst.maxRequest["src"] = BlockSize
+			dst.pmut.Unlock()
+		}
+		b.StartTimer()
+
+		if r := pullAll(b, dst, "default", dstDir); r.FilesPulled != files {
+			b.Fatalf("Pulled %d files != %d; failures %+v", r.FilesPulled, files, r.Failures)
+		}
+
+		b.StopTimer()
+		requests += atomic.LoadInt64(&rc.requests)
+		src.Close("dst", io.EOF)
+		os.RemoveAll(dstDir)
+		time.Sleep(2 * indexDropDelay)
+		b.StartTimer()
+	}
+	b.StopTimer()
+	b.Logf("%d files of %d bytes: %.1f requests per file", files, size, float64(requests)/float64(b.N*files))
+}
+
+func BenchmarkPull1000FilesSingle(b *testing.B) {
+	benchmarkPull(b, 1000, BlockSize+1024, true)
+}
+
+func BenchmarkPull1000FilesCoalesced(b *testing.B) {
+	benchmarkPull(b, 1000, BlockSize+1024, false)
+}
+
+func TestPullSymlink(t *testing.T) {
+	target := []byte("target")
+	f := scanner.File{Name: "link", Flags: protocol.FlagSymlink | 0777, Modified: 1234567890, Version: 1000, Size: int64(len(target))}
+	f.Blocks, _ = scanner.Blocks(bytes.NewReader(target), BlockSize)
+
+	dir := filepath.Join(string(os.PathSeparator), "repo")
+	fs := testutil.NewFakeFS()
+	fs.MkdirAll(dir, 0755)
+
+	m := NewModel(1e6)
+	m.SetFilesystem(fs)
+	m.AddRepo("default", dir, []NodeConfiguration{{NodeID: "42"}})
+	m.ScanRepo("default")
+	fc := FakeConnection{id: "42", requestData: target}
+	m.AddConnection(fc, fc)
+	m.Index("42", "default", []protocol.FileInfo{fileInfoFromFile(f)})
+
+	p := &puller{
+		repo:              "default",
+		dir:               dir,
+		bq:                newBlockQueue(),
+		model:             m,
+		oustandingPerNode: make(activityMap),
+		openFiles:         make(map[string]openFile),
+		requestResults:    make(chan requestResult),
+	}
+
+	// Symlinks are ignored by default
+	p.queueNeededBlocks()
+	select {
+	case b := <-p.bq.outbox:
+		t.Fatalf("Unexpected queued block for %q", b.file.Name)
+	case <-time.After(100 * time.Millisecond):
+	}
+
+	m.SetSymlinkPolicy(scanner.SymlinkRecreate)
+	p.queueNeededBlocks()
+	handled := p.handleBlock(p.bq.get())
+	for !handled {
+		handled = p.handleRequestResult(<-p.requestResults)
+	}
+
+	if r := p.report(); r.FilesPulled != 1 {
+		t.Fatalf("Symlink not pulled; failures %+v", r.Failures)
+	}
+	if l, err := fs.Readlink(filepath.Join(dir, "link")); err != nil || l != "target" {
+		t.Errorf("Incorrect symlink %q, %v", l, err)
+	}
+	if need := m.NeedFilesRepo("default"); len(need) != 0 {
+		t.Errorf("Symlink still needed: %v", need)
+	}
+}
+
+// A symlink pointed elsewhere at the source is recreated with the new
+// target.
+func TestPullSymlinkRetarget(t *testing.T) {
+	srcDir := filepath.Join(string(os.PathSeparator), "src")
+	srcFS := testutil.NewFakeFS()
+	srcFS.MkdirAll(srcDir, 0755)
+	srcFS.Symlink("target", filepath.Join(srcDir, "link"))
+	dstDir := filepath.Join(string(os.PathSeparator), "dst")
+	dstFS := testutil.NewFakeFS()
+	dstFS.MkdirAll(dstDir, 0755)
+
+	src := NewModel(1e6)
+	src.SetFilesystem(srcFS)
+	src.SetSymlinkPolicy(scanner.SymlinkRecreate)
+	src.AddRepo("default", srcDir, []NodeConfiguration{{NodeID: "dst"}})
+	src.ScanRepo("default")
+	dst := NewModel(1e6)
+	dst.SetFilesystem(dstFS)
+	dst.SetSymlinkPolicy(scanner.SymlinkRecreate)
+	dst.AddRepo("default", dstDir, []NodeConfiguration{{NodeID: "src"}})
+	dst.ScanRepo("default")
+	connectModels(t, src, dst)
+
+	for _, target := range []string{"target", "elsewhere"} {
+		if target != "target" {
+			v := src.CurrentRepoFile("default", "link").Version
+			srcFS.Remove(filepath.Join(srcDir, "link"))
+			srcFS.Symlink(target, filepath.Join(srcDir, "link"))
+			src.ScanRepo("default")
+			f := src.CurrentRepoFile("default", "link")
+			if f.Version <= v {
+				t.Fatalf("Changed symlink kept version %d <= %d", f.Version, v)
+			}
+			dst.IndexUpdate("src", "default", []protocol.FileInfo{fileInfoFromFile(f)})
+		}
+
+		r := pullAll(t, dst, "default", dstDir)
+		if len(r.Failures) != 0 {
+			t.Errorf("Unexpected failures %+v", r.Failures)
+		}
+		if l, err := dstFS.Readlink(filepath.Join(dstDir, "link")); err != nil || l != target {
+			t.Errorf("Incorrect symlink %q, %v; expected %q", l, err, target)
+		}
+		if v, lv := src.CurrentRepoFile("default", "link").Version, dst.CurrentRepoFile("default", "link").Version; v != lv {
+			t.Errorf("Pulled version %d differs from source version %d", lv, v)
+		}
+	}
+}
+
+func TestPullUnsafePath(t *testing.T) {
+	data := []byte("contents from a malicious node")
+	blocks, _ := scanner.Blocks(bytes.NewReader(data), BlockSize)
+	escape := filepath.Join("..", "escape")
+	abs := filepath.Join(string(os.PathSeparator), "abs")
+	victim := filepath.Join("..", "victim")
+
+	dir := filepath.Join(string(os.PathSeparator), "repo")
+	fs := testutil.NewFakeFS()
+	fs.MkdirAll(dir, 0755)
+	fs.WriteFile(filepath.Join(string(os.PathSeparator), "victim"), []byte("victim"), 0644)
+
+	m := NewModel(1e6)
+	m.SetFilesystem(fs)
+	m.AddRepo("default", dir, []NodeConfiguration{{NodeID: "42"}})
+	m.ScanRepo("default")
+	// Deletes are only pulled for files we have, so pretend that we have
+	// the victim.
+	m.repoFiles["default"].Update(cid.LocalID, []scanner.File{{Name: victim, Flags: 0644, Version: 999}})
+	fc := FakeConnection{id: "42", requestData: data}
+	m.AddConnection(fc, fc)
+	// Unsafe names are rejected when the index is received; add them
+	// directly to check that the puller refuses them as well.
+	m.Index("42", "default", nil)
+	m.repoFiles["default"].Update(m.cm.Get("42"), []scanner.File{
+		{Name: escape, Flags: 0644, Version: 1000, Size: int64(len(data)), Blocks: blocks},
+		{Name: abs, Flags: 0644, Version: 1000, Size: int64(len(data)), Blocks: blocks},
+		{Name: victim, Flags: protocol.FlagDeleted, Version: 1000},
+	})
+
+	// Pulling includes the delete phases.
+	rep := pullAll(t, m, "default", dir)
+
+	if len(rep.Failures) != 3 {
+		t.Fatalf("Incorrect failures %v", rep.Failures)
+	}
+	for _, f := range rep.Failures {
+		if f.Error != ErrUnsafePath.Error() {
+			t.Errorf("Incorrect failure %v", f)
+		}
+	}
+	if _, err := fs.Stat(filepath.Join(string(os.PathSeparator), "escape")); err == nil {
+		t.Error("File written outside of repository")
+	}
+	if _, err := fs.Stat(filepath.Join(string(os.PathSeparator), "victim")); err != nil {
+		t.Errorf("File outside of repository deleted: %v", err)
+	}
+}
+
+func TestPullUnsafeSymlink(t *testing.T) {
+	dir := filepath.Join(string(os.PathSeparator), "repo")
+	etc := filepath.Join(string(os.PathSeparator), "etc")
+	passwd := filepath.Join(etc, "passwd")
+	newFS := func() *testutil.FakeFS {
+		fs := testutil.NewFakeFS()
+		fs.MkdirAll(dir, 0755)
+		fs.MkdirAll(etc, 0755)
+		fs.WriteFile(passwd, []byte("root"), 0644)
+		// A symlink leading out of the repository, left by someone else.
+		fs.Symlink("..", filepath.Join(dir, "up"))
+		return fs
+	}
+	newModel := func(fs *testutil.FakeFS, data []byte, files []scanner.File) *Model {
+		m := NewModel(1e6)
+		m.SetFilesystem(fs)
+		m.SetSymlinkPolicy(scanner.SymlinkRecreate)
+		m.AddRepo("default", dir, []NodeConfiguration{{NodeID: "42"}})
+		m.ScanRepo("default")
+		fc := FakeConnection{id: "42", requestData: data}
+		m.AddConnection(fc, fc)
+		m.Index("42", "default", nil)
+		m.repoFiles["default"].Update(m.cm.Get("42"), files)
+		return m
+	}
+
+	// Links pointing outside of the repository are not created.
+	for _, target := range []string{etc, filepath.Join("..", "etc"), filepath.Join("up", "etc")} {
+		blocks, _ := scanner.Blocks(bytes.NewReader([]byte(target)), BlockSize)
+		fs := newFS()
+		m := newModel(fs, []byte(target), []scanner.File{
+			{Name: "a", Flags: protocol.FlagSymlink | 0777, Version: 1000, Size: int64(len(target)), Blocks: blocks},
+		})
+		rep := pullAll(t, m, "default", dir)
+		if len(rep.Failures) != 1 || rep.Failures[0].Error != ErrUnsafePath.Error() {
+			t.Errorf("%q: incorrect failures %v", target, rep.Failures)
+		}
+		if _, err := fs.Lstat(filepath.Join(dir, "a")); err == nil {
+			t.Errorf("%q: symlink created", target)
+		}
+	}
+
+	// Nothing is written or deleted through a symlinked directory.
+	data := []byte("contents from a malicious node")
+	blocks, _ := scanner.Blocks(bytes.NewReader(data), BlockSize)
+	fs := newFS()
+	m := newModel(fs, data, []scanner.File{
+		{Name: filepath.Join("up", "etc", "shadow"), Flags: 0644, Version: 1000, Size: int64(len(data)), Blocks: blocks},
+		{Name: filepath.Join("up", "etc", "dir"), Flags: protocol.FlagDirectory | 0755, Version: 1000},
+		{Name: filepath.Join("up", "etc", "passwd"), Flags: protocol.FlagDeleted, Version: 1000},
+	})
+	// Deletes are only pulled for files we have.
+	m.repoFiles["default"].Update(cid.LocalID, []scanner.File{{Name: filepath.Join("up", "etc", "passwd"), Flags: 0644, Version: 999}})
+	rep := pullAll(t, m, "default", dir)
+	if len(rep.Failures) != 3 {
+		t.Errorf("Incorrect failures %v", rep.Failures)
+	}
+	for _, f := range rep.Failures {
+		if f.Error != ErrUnsafePath.Error() {
+			t.Errorf("Incorrect failure %v", f)
+		}
+	}
+	if bs, err := vfs.ReadFile(fs, passwd); err != nil || string(bs) != "root" {
+		t.Errorf("File outside of repository changed: %q, %v", bs, err)
+	}
+	for _, name := range []string{"shadow", "dir"} {
+		if _, err := fs.Lstat(filepath.Join(dir, "up", "etc", name)); err == nil {
+			t.Errorf("%q written below a symlink", name)
+		}
+	}
+}
+
+// largeEdit sets up a model with a large local file and a remote version of
+// it with the last block changed.
+func largeEdit(t testing.TB, fs vfs.FS, dir string, blocks, copiers int) *Model {
+	data := make([]byte, blocks*BlockSize)
+	for i := range data {
+		data[i] = byte(i / BlockSize)
+	}
+	fd, err := fs.Create(filepath.Join(dir, "large"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = fd.Write(data)
+	fd.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	m := NewModel(1e6)
+	m.SetFilesystem(fs)
+	m.SetCopiers(copiers)
+	m.AddRepo("default", dir, []NodeConfiguration{{NodeID: "42"}})
+	m.ScanRepo("default")
+
+	changed := bytes.Repeat([]byte("x"), BlockSize)
+	copy(data[len(data)-BlockSize:], changed)
+	f := m.CurrentRepoFile("default", "large")
+	f.Version++
+	f.Blocks, _ = scanner.Blocks(bytes.NewReader(data), BlockSize)
+	hash := sha256.Sum256(data)
+	f.Hash = hash[:]
+	fc := FakeConnection{id: "42", requestData: changed}
+	m.AddConnection(fc, fc)
+	m.Index("42", "default", []protocol.FileInfo{fileInfoFromFile(f)})
+	return m
+}
+
+func TestPullCopiedBlocks(t *testing.T) {
+	const blocks = 3*copyJobBlocks + 1
+
+	dir := filepath.Join(string(os.PathSeparator), "repo")
+	fs := testutil.NewFakeFS()
+	fs.MkdirAll(dir, 0755)
+	m := largeEdit(t, fs, dir, blocks, 4)
+	f := m.CurrentGlobalFile("default", "large")
+
+	r := pullAll(t, m, "default", dir)
+	if r.FilesPulled != 1 || len(r.Failures) != 0 {
+		t.Fatalf("Incorrect pull report; %d pulled, failures %+v", r.FilesPulled, r.Failures)
+	}
+	if lf := m.CurrentRepoFile("default", "large"); lf.Version != f.Version {
+		t.Errorf("Local version not updated; %d != %d", lf.Version, f.Version)
+	}
+	bs, _ := vfs.ReadFile(fs, filepath.Join(dir, "large"))
+	if hash, _ := scanner.Blocks(bytes.NewReader(bs), BlockSize); !scanner.SameBlocks(hash, f.Blocks) {
+		t.Error("Incorrect contents after pull")
+	}
+
+	// A failed copy fails the file.
+	m = largeEdit(t, fs, dir, blocks, 4)
+	fs.SetError("open", filepath.Join(dir, "large"), syscall.EIO)
+	r = pullAll(t, m, "default", dir)
+	if r.FilesPulled != 0 || len(r.Failures) != 1 {
+		t.Fatalf("Incorrect pull report; %d pulled, failures %+v", r.FilesPulled, r.Failures)
+	}
+	if _, err := fs.Stat(filepath.Join(dir, defTempNamer.TempName("large"))); !os.IsNotExist(err) {
+		t.Error("Temporary file left after failed copy")
+	}
+}
+
+func TestPullVerifiedBlocks(t *testing.T) {
+	const blocks = 4
+
+	dir := filepath.Join(string(os.PathSeparator), "repo")
+	fs := testutil.NewFakeFS()
+	fs.MkdirAll(dir, 0755)
+
+	// Copied and fetched blocks are all checked as they are written, so
+	// the file isn't read back.
+	m := largeEdit(t, fs, dir, blocks, 1)
+	if r := pullAll(t, m, "default", dir); r.FilesPulled != 1 || len(r.Failures) != 0 {
+		t.Fatalf("Incorrect pull report; %d pulled, failures %+v", r.FilesPulled, r.Failures)
+	}
+	if s := m.PullStats("default"); s.SkippedChecks != 1 || s.FullChecks != 0 {
+		t.Errorf("Incorrect checks; %d skipped, %d full", s.SkippedChecks, s.FullChecks)
+	}
+
+	// A block to copy that has changed since the scan fails the file.
+	m = largeEdit(t, fs, dir, blocks, 1)
+	fd, _ := fs.Create(filepath.Join(dir, "large"))
+	fd.Write(make([]byte, blocks*BlockSize))
+	fd.Close()
+	if r := pullAll(t, m, "default", dir); r.FilesPulled != 0 || len(r.Failures) != 1 {
+		t.Fatalf("Incorrect pull report; %d pulled, failures %+v", r.FilesPulled, r.Failures)
+	}
+
+	// A block without a hash cannot be checked when written; the file is
+	// read back in full.
+	m = largeEdit(t, fs, dir, blocks, 1)
+	f := m.CurrentGlobalFile("default", "large")
+	f.Version++
+	f.Blocks = append([]scanner.Block(nil), f.Blocks...)
+	f.Blocks[blocks-1].Hash = nil
+	m.Index("42", "default", []protocol.FileInfo{fileInfoFromFile(f)})
+	pullAll(t, m, "default", dir)
+	if s := m.PullStats("default"); s.SkippedChecks != 0 || s.FullChecks != 1 {
+		t.Errorf("Incorrect checks; %d skipped, %d full", s.SkippedChecks, s.FullChecks)
+	}
+}
+
+// slowReadFS adds a delay to every ReadAt, like a disk that is busy seeking
+// or a network filesystem.
+type slowReadFS struct {
+	vfs.FS
+}
+
+type slowReadFile struct {
+	vfs.File
+}
+
+func (fs slowReadFS) Open(name string) (vfs.File, error) {
+	fd, err := fs.FS.Open(name)
+	if err != nil {
+		return nil, err
+	}
+	return slowReadFile{fd}, nil
+}
+
+func (fd slowReadFile) ReadAt(bs []byte, offset int64) (int, error) {
+	time.Sleep(time.Millisecond)
+	return fd.File.ReadAt(bs, offset)
+}
+
+func benchmarkPullLargeEdit(b *testing.B, copiers int) {
+	const blocks = 512
+	for i := 0; i < b.N; i++ {
+		b.StopTimer()
+		dir, err := ioutil.TempDir("", "puller")
+		if err != nil {
+			b.Fatal(err)
+		}
+		m := largeEdit(b, slowReadFS{vfs.OS}, dir, blocks, copiers)
+		b.StartTimer()
+
+		if r := pullAll(b, m, "default", dir); r.FilesPulled != 1 {
+			b.Fatalf("Pulled %d files != 1; failures %+v", r.FilesPulled, r.Failures)
+		}
+
+		b.StopTimer()
+		os.RemoveAll(dir)
+		b.StartTimer()
+	}
+	b.SetBytes(blocks * BlockSize)
+}
+
+func BenchmarkPullLargeEdit1Copier(b *testing.B) {
+	benchmarkPullLargeEdit(b, 1)
+}
+
+func BenchmarkPullLargeEdit4Copiers(b *testing.B) {
+	benchmarkPullLargeEdit(b, 4)
+}
+
+// readCountFS counts the bytes read from its files.
+type readCountFS struct {
+	vfs.FS
+	read int64
+}
+
+type readCountFile struct {
+	vfs.File
+	fs *readCountFS
+}
+
+func (fs *readCountFS) Open(name string) (vfs.File, error) {
+	fd, err := fs.FS.Open(name)
+	if err != nil {
+		return nil, err
+	}
+	return readCountFile{fd, fs}, nil
+}
+
+func (fd readCountFile) Read(bs []byte) (int, error) {
+	n, err := fd.File.Read(bs)
+	atomic.AddInt64(&fd.fs.read, int64(n))
+	return n, err
+}
+
+func (fd readCountFile) ReadAt(bs []byte, offset int64) (int, error) {
+	n, err := fd.File.ReadAt(bs, offset)
+	atomic.AddInt64(&fd.fs.read, int64(n))
+	return n, err
+}
+
+// BenchmarkPullLargeEditReads reports the bytes read from disk to pull an
+// edit to the last block of a large file.
+func BenchmarkPullLargeEditReads(b *testing.B) {
+	const blocks = 1024
+	dir := filepath.Join(string(os.PathSeparator), "repo")
+	var read int64
+	for i := 0; i < b.N; i++ {
+		b.StopTimer()
+		fs := &readCountFS{FS: testutil.NewFakeFS()}
+		fs.MkdirAll(dir, 0755)
+		m := largeEdit(b, fs, dir, blocks, 4)
+		atomic.StoreInt64(&fs.read, 0)
+		b.StartTimer()
+
+		if r := pullAll(b, m, "default", dir); r.FilesPulled != 1 {
+			b.Fatalf("Pulled %d files != 1; failures %+v", r.FilesPulled, r.Failures)
+		}
+		read += atomic.LoadInt64(&fs.read)
+	}
+	b.SetBytes(blocks * BlockSize)
+	b.Logf("Read %d bytes per pull", read/int64(b.N))
+}
+
+// recordingFS records the writes to temporary files.
+type recordingFS struct {
+	*testutil.FakeFS
+	writes map[string][]recordedWrite // name -> writes
+	mut    sync.Mutex
+}
+
+type recordedWrite struct {
+	offset int64
+	size   int
+}
+
+type writeList []recordedWrite
+
+func (l writeList) Len() int           { return len(l) }
+func (l writeList) Less(a, b int) bool { return l[a].offset < l[b].offset }
+func (l writeList) Swap(a, b int)      { l[a], l[b] = l[b], l[a] }
+
+type recordingFile struct {
+	vfs.File
+	name string
+	fs   *recordingFS
+}
+
+func (fs *recordingFS) Create(name string) (vfs.File, error) {
+	fd, err := fs.FakeFS.Create(name)
+	if err != nil || !defTempNamer.IsTemporary(name) {
+		return fd, err
+	}
+	return recordingFile{fd, name, fs}, nil
+}
+
+func (fd recordingFile) WriteAt(bs []byte, offset int64) (int, error) {
+	fd.fs.mut.Lock()
+	fd.fs.writes[fd.name] = append(fd.fs.writes[fd.name], recordedWrite{offset, len(bs)})
+	fd.fs.mut.Unlock()
+	return fd.File.WriteAt(bs, offset)
+}
+
+// Pulled data arrives at the filesystem set on the model, block by block at
+// the offsets of the blocks, and is verified by reading it back.
+func TestPullToFilesystem(t *testing.T) {
+	srcDir, err := ioutil.TempDir("", "puller")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(srcDir)
+	writeFiles(t, srcDir, 1, 4*BlockSize+100)
+
+	src := NewModel(1e6)
+	src.AddRepo("default", srcDir, []NodeConfiguration{{NodeID: "dst"}})
+	src.ScanRepo("default")
+	f := src.CurrentRepoFile("default", "file00000")
+
+	dir := filepath.Join(string(os.PathSeparator), "repo")
+	fs := &recordingFS{FakeFS: testutil.NewFakeFS(), writes: make(map[string][]recordedWrite)}
+	fs.MkdirAll(dir, 0755)
+	dst := NewModel(1e6)
+	dst.SetFilesystem(fs)
+	dst.AddRepo("default", dir, []NodeConfiguration{{NodeID: "src"}})
+	dst.ScanRepo("default")
+
+	connectModels(t, src, dst)
+	if r := pullAll(t, dst, "default", dir); r.FilesPulled != 1 || len(r.Failures) != 0 {
+		t.Fatalf("Incorrect pull report; %d pulled, failures %+v", r.FilesPulled, r.Failures)
+	}
+
+	// Requests for adjacent blocks are coalesced, so a write may span
+	// several blocks, but always starts and ends at block boundaries and
+	// each block is written once.
+	bounds := map[int64]bool{f.Size: true}
+	for _, b := range f.Blocks {
+		bounds[b.Offset] = true
+	}
+	writes := fs.writes[filepath.Join(dir, defTempNamer.TempName(f.Name))]
+	sort.Sort(writeList(writes))
+	var next int64
+	for _, w := range writes {
+		if w.offset != next || !bounds[w.offset+int64(w.size)] {
+			t.Errorf("Write of %d bytes at offset %d doesn't continue at block offset %d", w.size, w.offset, next)
+		}
+		next = w.offset + int64(w.size)
+	}
+	if next != f.Size {
+		t.Errorf("Data written up to offset %d, expected %d", next, f.Size)
+	}
+
+	if err := verifyFile(fs, filepath.Join(dir, f.Name), f, nil); err != nil {
+		t.Error(err)
+	}
+	if _, err := os.Stat(filepath.Join(dir, f.Name)); !os.IsNotExist(err) {
+		t.Error("Pulled data written to the filesystem of the operating system")
+	}
+}
+
+// sparseData returns file contents of a data block, a zero block, another
+// data block and a short zero block at the end.
+func sparseData() []byte {
+	var data []byte
+	data = append(data, bytes.Repeat([]byte("x"), BlockSize)...)
+	data = append(data, make([]byte, BlockSize)...)
+	data = append(data, bytes.Repeat([]byte("y"), BlockSize)...)
+	data = append(data, make([]byte, 100)...)
+	return data
+}
+
+// readRecordingFS records the reads from opened files.
+type readRecordingFS struct {
+	*testutil.FakeFS
+	reads []recordedWrite
+	mut   sync.Mutex
+}
+
+type readRecordingFile struct {
+	vfs.File
+	fs *readRecordingFS
+}
+
+func (fs *readRecordingFS) Open(name string) (vfs.File, error) {
+	fd, err := fs.FakeFS.Open(name)
+	if err != nil {
+		return nil, err
+	}
+	return readRecordingFile{fd, fs}, nil
+}
+
+func (fd readRecordingFile) Read(bs []byte) (int, error) {
+	panic("sequential read")
+}
+
+func (fd readRecordingFile) ReadAt(bs []byte, offset int64) (int, error) {
+	fd.fs.mut.Lock()
+	fd.fs.reads = append(fd.fs.reads, recordedWrite{offset, len(bs)})
+	fd.fs.mut.Unlock()
+	return fd.File.ReadAt(bs, offset)
+}
+
+// Holes left in a sparse file are verified to be zero blocks without
+// reading them back.
+func TestVerifySparseFile(t *testing.T) {
+	data := sparseData()
+	f := scanner.File{Name: "file"}
+	f.Blocks, _ = scanner.Blocks(bytes.NewReader(data), BlockSize)
+	hash := sha256.Sum256(data)
+	f.Hash = hash[:]
+
+	fs := &readRecordingFS{FakeFS: testutil.NewFakeFS()}
+	fs.WriteFile("/file", data, 0644)
+	zeros := map[int64]bool{f.Blocks[1].Offset: true, f.Blocks[3].Offset: true}
+	if err := verifyFile(fs, "/file", f, zeros); err != nil {
+		t.Fatal(err)
+	}
+	for _, r := range fs.reads {
+		for _, b := range []scanner.Block{f.Blocks[1], f.Blocks[3]} {
+			if r.offset < b.Offset+int64(b.Size) && b.Offset < r.offset+int64(r.size) {
+				t.Errorf("Read of %d bytes at offset %d from hole at offset %d", r.size, r.offset, b.Offset)
+			}
+		}
+	}
+	if len(fs.reads) != 2 {
+		t.Errorf("Incorrect number of reads %d != 2", len(fs.reads))
+	}
+
+	// A data block is not taken to be a hole.
+	zeros[f.Blocks[0].Offset] = true
+	if err := verifyFile(fs, "/file", f, zeros); err == nil {
+		t.Error("Unexpected nil error for data block taken as hole")
+	}
+}
+
+// With sparse files enabled, zero blocks are neither requested nor written,
+// except for the last byte of the file.
+func TestPullSparse(t *testing.T) {
+	srcDir, err := ioutil.TempDir("", "puller")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(srcDir)
+	data := sparseData()
+	if err := ioutil.WriteFile(filepath.Join(srcDir, "file"), data, 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	src := NewModel(1e6)
+	src.AddRepo("default", srcDir, []NodeConfiguration{{NodeID: "dst"}})
+	src.ScanRepo("default")
+
+	dir := filepath.Join(string(os.PathSeparator), "repo")
+	fs := &recordingFS{FakeFS: testutil.NewFakeFS(), writes: make(map[string][]recordedWrite)}
+	fs.MkdirAll(dir, 0755)
+	dst := NewModel(1e6)
+	dst.SetFilesystem(fs)
+	dst.SetSparseFiles(true)
+	dst.AddRepo("default", dir, []NodeConfiguration{{NodeID: "src"}})
+	dst.ScanRepo("default")
+
+	connectModels(t, src, dst)
+	if r := pullAll(t, dst, "default", dir); r.FilesPulled != 1 || len(r.Failures) != 0 {
+		t.Fatalf("Incorrect pull report; %d pulled, failures %+v", r.FilesPulled, r.Failures)
+	}
+
+	writes := fs.writes[filepath.Join(dir, defTempNamer.TempName("file"))]
+	sort.Sort(writeList(writes))
+	exp := []recordedWrite{{0, BlockSize}, {2 * BlockSize, BlockSize}, {int64(len(data) - 1), 1}}
+	if !reflect.DeepEqual(writes, exp) {
+		t.Errorf("Incorrect writes %v != %v", writes, exp)
+	}
+
+	fd, err := fs.Open(filepath.Join(dir, "file"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer fd.Close()
+	if bs, _ := ioutil.ReadAll(fd); !bytes.Equal(bs, data) {
+		t.Error("Incorrect contents of sparse file")
+	}
+}
+
+// Files that no connected node has are skipped by the puller, and pulled
+// once the node that has them connects.
+func TestPullUnavailable(t *testing.T) {
+	data := []byte("contents")
+	local := bytes.Repeat([]byte("a"), BlockSize)
+
+	dir := filepath.Join(string(os.PathSeparator), "repo")
+	fs := testutil.NewFakeFS()
+	fs.MkdirAll(dir, 0755)
+	fs.WriteFile(filepath.Join(dir, "partial"), local, 0644)
+
+	m := NewModel(1e6)
+	m.SetFilesystem(fs)
+	m.AddRepo("default", dir, []NodeConfiguration{{NodeID: "42"}})
+	m.ScanRepo("default")
+
+	// The node has a new file and a version of the local file with a block
+	// appended, but isn't connected.
+	blocks, _ := scanner.Blocks(bytes.NewReader(data), BlockSize)
+	newFile := scanner.File{Name: "new", Flags: 0644, Modified: 1234567890, Version: 1000, Size: int64(len(data)), Blocks: blocks}
+	pf := m.CurrentRepoFile("default", "partial")
+	blocks, _ = scanner.Blocks(bytes.NewReader(append(local, data...)), BlockSize)
+	pf.Version++
+	pf.Size = int64(len(local) + len(data))
+	pf.Blocks = blocks
+	pf.Hash = nil
+	m.Index("42", "default", []protocol.FileInfo{fileInfoFromFile(newFile), fileInfoFromFile(pf)})
+
+	exp := map[string]NeedAvailability{"new": NeedUnavailable, "partial": NeedPartial}
+	need := m.NeedDetails("default")
+	if len(need) != 2 {
+		t.Fatalf("Incorrect need details %v", need)
+	}
+	for _, e := range need {
+		if e.Availability != exp[e.File.Name] || len(e.Sources) != 0 || !reflect.DeepEqual(e.Waiting, []string{"42"}) {
+			t.Errorf("%s: incorrect availability %v, sources %v, waiting for %v", e.File.Name, e.Availability, e.Sources, e.Waiting)
+		}
+	}
+	if a, p, u, w := m.NeedAvailabilitySummary("default"); a != 0 || p != 1 || u != 1 || !reflect.DeepEqual(w, []string{"42"}) {
+		t.Errorf("Incorrect summary %d, %d, %d, %v", a, p, u, w)
+	}
+
+	p := &puller{
+		repo:  "default",
+		dir:   dir,
+		bq:    newBlockQueue(),
+		model: m,
+	}
+	p.queueNeededBlocks()
+	if !p.bq.empty() {
+		t.Error("Unavailable files queued")
+	}
+	if len(p.unavailable) != 2 {
+		t.Errorf("Incorrect skipped files %v", p.unavailable)
+	}
+
+	fc := FakeConnection{id: "42", requestData: data}
+	m.AddConnection(fc, fc)
+
+	for _, e := range m.NeedDetails("default") {
+		if e.Availability != NeedAvailable || !reflect.DeepEqual(e.Sources, []string{"42"}) || len(e.Waiting) != 0 {
+			t.Errorf("%s: incorrect availability %v, sources %v, waiting for %v", e.File.Name, e.Availability, e.Sources, e.Waiting)
+		}
+	}
+	p.queueNeededBlocks()
+	if len(p.unavailable) != 0 {
+		t.Errorf("Files skipped after the node connected: %v", p.unavailable)
+	}
+
+	rep := pullAll(t, m, "default", dir)
+	if len(rep.Failures) != 0 {
+		t.Errorf("Unexpected failures %v", rep.Failures)
+	}
+	if need := m.NeedFilesRepo("default"); len(need) != 0 {
+		t.Fatalf("Files still needed after pull: %v", need)
+	}
+	for _, f := range []scanner.File{newFile, pf} {
+		if err := verifyFile(fs, filepath.Join(dir, f.Name), f, nil); err != nil {
+			t.Error(err)
+		}
+	}
+}
+
+func TestPullAwaitingSource(t *testing.T) {
+	data := []byte("contents")
+
+	dir := filepath.Join(string(os.PathSeparator), "repo")
+	fs := testutil.NewFakeFS()
+	fs.MkdirAll(dir, 0755)
+
+	c := newFakeClock()
+	m := newModel(1e6, c)
+	m.SetFilesystem(fs)
+	m.SetSourceRetry(300 * time.Second)
+	m.AddRepo("default", dir, []NodeConfiguration{{NodeID: "42"}})
+	m.ScanRepo("default")
+
+	blocks, _ := scanner.Blocks(bytes.NewReader(data), BlockSize)
+	f := scanner.File{Name: "new", Flags: 0644, Modified: 1234567890, Version: 1000, Size: int64(len(data)), Blocks: blocks}
+	m.Index("42", "default", []protocol.FileInfo{fileInfoFromFile(f)})
+
+	p := &puller{
+		repo:  "default",
+		dir:   dir,
+		bq:    newBlockQueue(),
+		model: m,
+	}
+	p.queueNeededBlocks()
+	if len(p.unavailable) != 1 {
+		t.Errorf("Incorrect skipped files %v", p.unavailable)
+	}
+	exp := []FileError{{Name: "new", Version: 1000, Err: errAwaitingSource, AwaitingSource: true}}
+	if errs := m.FileErrors("default"); !reflect.DeepEqual(errs, exp) {
+		t.Errorf("Incorrect file errors %+v != %+v", errs, exp)
+	}
+	if p.round != nil {
+		t.Errorf("File without a source reported as failed: %+v", p.round.Failures)
+	}
+
+	// The file is looked at again only after the retry interval.
+	checked := p.sourcesChecked
+	c.advance(time.Second)
+	p.queueNeededBlocks()
+	if !p.sourcesChecked.Equal(checked) {
+		t.Error("File without a source retried after a second")
+	}
+	c.advance(300 * time.Second)
+	p.queueNeededBlocks()
+	if !p.sourcesChecked.Equal(c.Now()) {
+		t.Error("File without a source not retried after the retry interval")
+	}
+	if errs := m.FileErrors("default"); len(errs) != 1 {
+		t.Errorf("Incorrect file errors %+v", errs)
+	}
+
+	// A node with the file connects.
+	fc := FakeConnection{id: "42", requestData: data}
+	m.AddConnection(fc, fc)
+	p.queueNeededBlocks()
+	if len(p.unavailable) != 0 {
+		t.Errorf("Files skipped after the node connected: %v", p.unavailable)
+	}
+	if errs := m.FileErrors("default"); len(errs) != 0 {
+		t.Errorf("Awaiting source not cleared: %+v", errs)
+	}
+
+	rep := pullAll(t, m, "default", dir)
+	if len(rep.Failures) != 0 {
+		t.Errorf("Unexpected failures %v", rep.Failures)
+	}
+	if need := m.NeedFilesRepo("default"); len(need) != 0 {
+		t.Errorf("Files still needed after pull: %v", need)
+	}
+}
+
+// A file awaiting a source stops doing so once a scan finds it locally.
+func TestAwaitingSourceScanned(t *testing.T) {
+	dir := filepath.Join(string(os.PathSeparator), "repo")
+	fs := testutil.NewFakeFS()
+	fs.MkdirAll(dir, 0755)
+
+	m := NewModel(1e6)
+	m.SetFilesystem(fs)
+	m.AddRepo("default", dir, []NodeConfiguration{{NodeID: "42"}})
+	m.ScanRepo("default")
+
+	data := []byte("contents")
+	blocks, _ := scanner.Blocks(bytes.NewReader(data), BlockSize)
+	f := scanner.File{Name: "new", Flags: 0644, Modified: 1234567890, Version: 1000, Size: int64(len(data)), Blocks: blocks}
+	m.Index("42", "default", []protocol.FileInfo{fileInfoFromFile(f)})
+	m.awaitingSource("default", f)
+	m.ScanRepo("default")
+	if errs := m.FileErrors("default"); len(errs) != 1 {
+		t.Fatalf("Incorrect file errors %+v", errs)
+	}
+
+	fs.WriteFile(filepath.Join(dir, "new"), []byte("made locally"), 0644)
+	m.ScanRepo("default")
+	if errs := m.FileErrors("default"); len(errs) != 0 {
+		t.Errorf("Awaiting source not cleared by scan: %+v", errs)
+	}
+}
+
+func TestPullPriority(t *testing.T) {
+	dir := filepath.Join(string(os.PathSeparator), "repo")
+	fs := testutil.NewFakeFS()
+	fs.MkdirAll(dir, 0755)
+
+	m := NewModel(1e6)
+	m.SetFilesystem(fs)
+	m.SetPullPriority([]string{"*.md", ".gitignore", "**/Makefile"})
+	m.AddRepo("default", dir, []NodeConfiguration{{NodeID: "42"}})
+	fc := FakeConnection{id: "42"}
+	m.AddConnection(fc, fc)
+	m.ClusterConfig("42", m.clusterConfig("42"))
+
+	data := []byte("contents")
+	blocks, _ := scanner.Blocks(bytes.NewReader(data), BlockSize)
+	var fs0 []protocol.FileInfo
+	for _, name := range []string{"big.iso", "README.md", "src/main.c", ".gitignore", "src/Makefile", "video.mp4"} {
+		f := scanner.File{Name: filepath.FromSlash(name), Flags: 0644, Modified: 1234567890, Version: 1000, Size: int64(len(data)), Blocks: blocks}
+		fs0 = append(fs0, fileInfoFromFile(f))
+	}
+	m.Index("42", "default", fs0)
+
+	isPriority := map[string]bool{"README.md": true, ".gitignore": true, filepath.FromSlash("src/Makefile"): true}
+	need := m.NeedFilesRepo("default")
+	if len(need) != len(fs0) {
+		t.Fatalf("Incorrect need %v", need)
+	}
+	for i, f := range need {
+		if isPriority[f.Name] != (i < len(isPriority)) {
+			t.Errorf("Incorrect need order %v", need)
+			break
+		}
+	}
+	for i, e := range m.NeedDetails("default") {
+		if e.File.Name != need[i].Name {
+			t.Errorf("Need details in different order; %q at %d", e.File.Name, i)
+		}
+	}
+
+	p := &puller{
+		repo:  "default",
+		dir:   dir,
+		bq:    newBlockQueue(),
+		model: m,
+	}
+	p.queueNeededBlocks()
+	var requested []string
+	for range need {
+		requested = append(requested, p.bq.get().file.Name)
+	}
+	if !reflect.DeepEqual(requested, names(need)) {
+		t.Errorf("Incorrect request order %v", requested)
+	}
+
+	// A priority file announced during a round goes ahead of the others in
+	// the next.
+	f := scanner.File{Name: "NEWS.md", Flags: 0644, Modified: 1234567890, Version: 1000, Size: int64(len(data)), Blocks: blocks}
+	m.IndexUpdate("42", "default", []protocol.FileInfo{fileInfoFromFile(f)})
+	isPriority["NEWS.md"] = true
+	p.queueNeededBlocks()
+	requested = nil
+	for len(requested) < len(fs0)+1 {
+		requested = append(requested, p.bq.get().file.Name)
+	}
+	for i, name := range requested {
+		if isPriority[name] != (i < len(isPriority)) {
+			t.Errorf("Incorrect request order %v", requested)
+			break
+		}
+	}
+}
+
+func names(fs []scanner.File) []string {
+	var ns []string
+	for _, f := range fs {
+		ns = append(ns, f.Name)
+	}
+	return ns
+}
+
+func TestMatchPattern(t *testing.T) {
+	tests := []struct {
+		pattern, name string
+		match         bool
+	}{
+		{"*.md", "README.md", true},
+		{"*.md", "doc/intro.md", true},
+		{"*.md", "README.txt", false},
+		{".gitignore", "sub/.gitignore", true},
+		{"**/Makefile", "Makefile", true},
+		{"**/Makefile", "a/b/Makefile", true},
+		{"**/Makefile", "a/Makefile.am", false},
+		{"doc/*.md", "doc/intro.md", true},
+		{"doc/*.md", "sub/doc/intro.md", false},
+		{"/doc/**", "doc/a/b", true},
+		{"src/**/*.h", "src/a/b/c.h", true},
+		{"src/**/*.h", "src/c.h", true},
+		{"src/**/*.h", "inc/c.h", false},
+	}
+	for _, tc := range tests {
+		if m := matchPattern(tc.pattern, filepath.FromSlash(tc.name)); m != tc.match {
+			t.Errorf("matchPattern(%q, %q) = %v, expected %v", tc.pattern, tc.name, m, tc.match)
+		}
+	}
+}
+
+func TestPullUntrustedDeletes(t *testing.T) {
+	dir := filepath.Join(string(os.PathSeparator), "repo")
+	fs := testutil.NewFakeFS()
+	fs.MkdirAll(dir, 0755)
+	for _, name := range []string{"a", "b", "c"} {
+		fs.WriteFile(filepath.Join(dir, name), []byte(name), 0644)
+	}
+
+	m := NewModel(1e6)
+	m.SetFilesystem(fs)
+	m.AddRepo("default", dir, []NodeConfiguration{{NodeID: "42"}, {NodeID: "43"}})
+	m.ScanRepo("default")
+	m.SetDeleteTrust("43", false)
+
+	deleted := func(name string) protocol.FileInfo {
+		f := m.CurrentRepoFile("default", name)
+		return protocol.FileInfo{Name: name, Flags: protocol.FlagDeleted | 0644, Modified: f.Modified, Version: f.Version + 1000}
+	}
+	// Both nodes delete b; a is deleted by the untrusted node only and c
+	// by the trusted one only.
+	m.Index("42", "default", []protocol.FileInfo{deleted("b"), deleted("c")})
+	m.Index("43", "default", []protocol.FileInfo{deleted("a"), deleted("b")})
+
+	exists := func(name string) bool {
+		_, err := fs.Stat(filepath.Join(dir, name))
+		return err == nil
+	}
+
+	pullAll(t, m, "default", dir)
+	if !exists("a") || exists("b") || exists("c") {
+		t.Errorf("Incorrect files after pull; a %v, b %v, c %v", exists("a"), exists("b"), exists("c"))
+	}
+	pd := m.PendingDeletes("default")
+	if len(pd) != 1 || pd[0].File.Name != "a" || !reflect.DeepEqual(pd[0].Nodes, []string{"43"}) {
+		t.Errorf("Incorrect pending deletes %+v", pd)
+	}
+	for _, f := range m.NeedFilesRepo("default") {
+		t.Errorf("Unexpected need %v", f)
+	}
+
+	// Trusting the node carries out its pending deletes.
+	m.SetDeleteTrust("43", true)
+	if pd := m.PendingDeletes("default"); len(pd) != 0 {
+		t.Errorf("Incorrect pending deletes %+v", pd)
+	}
+	pullAll(t, m, "default", dir)
+	if exists("a") {
+		t.Error("Pending delete not carried out")
+	}
+}
+
+// Deletions announced after the need was checked against the delete limits
+// wait for the next round, when they are checked in turn.
+func TestDeletesAfterLimitCheck(t *testing.T) {
+	dir := filepath.Join(string(os.PathSeparator), "repo")
+	fs := testutil.NewFakeFS()
+	fs.MkdirAll(dir, 0755)
+	for i := 0; i < 10; i++ {
+		fs.WriteFile(filepath.Join(dir, fmt.Sprintf("f%d", i)), []byte("data"), 0644)
+	}
+
+	m := NewModel(1e6)
+	m.SetFilesystem(fs)
+	m.AddRepo("default", dir, []NodeConfiguration{{NodeID: "42"}})
+	m.ScanRepo("default")
+	m.SetDeleteLimit(3, 0)
+
+	deleted := func(name string) protocol.FileInfo {
+		f := m.CurrentRepoFile("default", name)
+		return protocol.FileInfo{Name: name, Flags: protocol.FlagDeleted | 0644, Modified: f.Modified, Version: f.Version + 1000}
+	}
+	idx := []protocol.FileInfo{deleted("f0"), deleted("f1")}
+	m.Index("42", "default", idx)
+
+	deletes, hold := m.holdDeletes("default")
+	if hold || len(deletes) != 2 {
+		t.Fatalf("Incorrect deletes %v, held %v", deletes, hold)
+	}
+
+	// Enough further deletions to go over the limit arrive before the
+	// delete phase.
+	var more []protocol.FileInfo
+	for i := 2; i < 8; i++ {
+		more = append(more, deleted(fmt.Sprintf("f%d", i)))
+	}
+	m.IndexUpdate("42", "default", more)
+
+	p := &puller{repo: "default", dir: dir, model: m}
+	p.deleteFiles(deletes)
+	for i := 0; i < 10; i++ {
+		name := fmt.Sprintf("f%d", i)
+		if _, err := fs.Stat(filepath.Join(dir, name)); (err == nil) != (i >= 2) {
+			t.Errorf("Incorrect existence of %q: %v", name, err)
+		}
+	}
+	if _, hold := m.holdDeletes("default"); !hold {
+		t.Error("Deletions over the limit not held on the next round")
+	}
+}
+
+func TestHoldMassDeletes(t *testing.T) {
+	sub := events.Default.Subscribe(events.DeletesHeld)
+	defer events.Default.Unsubscribe(sub)
+
+	data := []byte("data")
+	dir := filepath.Join(string(os.PathSeparator), "repo")
+	fs := testutil.NewFakeFS()
+	fs.MkdirAll(dir, 0755)
+	for i := 0; i < 10; i++ {
+		fs.WriteFile(filepath.Join(dir, fmt.Sprintf("f%d", i)), data, 0644)
+	}
+
+	m := NewModel(1e6)
+	m.SetFilesystem(fs)
+	m.AddRepo("default", dir, []NodeConfiguration{{NodeID: "42"}})
+	m.ScanRepo("default")
+	m.SetDeleteLimit(3, 0)
+	fc := FakeConnection{id: "42", requestData: data}
+	m.AddConnection(fc, fc)
+
+	deleted := func(name string) protocol.FileInfo {
+		f := m.CurrentRepoFile("default", name)
+		return protocol.FileInfo{Name: name, Flags: protocol.FlagDeleted | 0644, Modified: f.Modified, Version: f.Version + 1000}
+	}
+	changed := func(name string) protocol.FileInfo {
+		f := scanner.File{Name: name, Flags: 0644, Modified: 1234567890, Version: 2000, Size: int64(len(data))}
+		f.Blocks, _ = scanner.Blocks(bytes.NewReader(data), BlockSize)
+		return fileInfoFromFile(f)
+	}
+	exists := func(name string) bool {
+		_, err := fs.Stat(filepath.Join(dir, name))
+		return err == nil
+	}
+	held := func() []string {
+		var names []string
+		for _, f := range m.HeldDeletes("default") {
+			names = append(names, f.Name)
+		}
+		return names
+	}
+
+	// The node deletes six files and adds one. The deletions are held; the
+	// new file is pulled.
+	idx := []protocol.FileInfo{changed("new")}
+	for i := 0; i < 6; i++ {
+		idx = append(idx, deleted(fmt.Sprintf("f%d", i)))
+	}
+	m.Index("42", "default", idx)
+	pullAll(t, m, "default", dir)
+	for i := 0; i < 10; i++ {
+		if name := fmt.Sprintf("f%d", i); !exists(name) {
+			t.Errorf("Held deletion of %q carried out", name)
+		}
+	}
+	if !exists("new") {
+		t.Error("New file not pulled while deletions held")
+	}
+	if h := held(); !reflect.DeepEqual(h, []string{"f0", "f1", "f2", "f3", "f4", "f5"}) {
+		t.Errorf("Incorrect held deletes %v", h)
+	}
+	ev, err := sub.Poll(time.Second)
+	if err != nil {
+		t.Fatal("No event for held deletes")
+	}
+	if data := ev.Data.(map[string]interface{}); data["count"] != 6 || data["local"] != 11 || len(data["sample"].([]string)) != 6 {
+		t.Errorf("Incorrect event data %v", data)
+	}
+
+	// The node restores two of the files. The remaining deletions are
+	// still over the limit and stay held.
+	idx = []protocol.FileInfo{idx[0], changed("f4"), changed("f5")}
+	for i := 0; i < 4; i++ {
+		idx = append(idx, deleted(fmt.Sprintf("f%d", i)))
+	}
+	m.Index("42", "default", idx)
+	pullAll(t, m, "default", dir)
+	for i := 0; i < 10; i++ {
+		if name := fmt.Sprintf("f%d", i); !exists(name) {
+			t.Errorf("Held deletion of %q carried out", name)
+		}
+	}
+	if h := held(); !reflect.DeepEqual(h, []string{"f0", "f1", "f2", "f3"}) {
+		t.Errorf("Incorrect held deletes %v", h)
+	}
+
+	if n := m.ConfirmPendingDeletes("default"); n != 4 {
+		t.Errorf("Incorrect number of confirmed deletes %d", n)
+	}
+	pullAll(t, m, "default", dir)
+	for i := 0; i < 10; i++ {
+		if name := fmt.Sprintf("f%d", i); exists(name) != (i >= 4) {
+			t.Errorf("Incorrect existence of %q after confirmation", name)
+		}
+	}
+	if h := held(); len(h) != 0 {
+		t.Errorf("Incorrect held deletes %v after confirmation", h)
+	}
+}
+
+// caseInsensitiveFS resolves names to existing entries whose names differ
+// only in case, like the filesystems on Windows and Mac OS X do. A rename of
+// a file to a variant of its own name is refused, as some of them do.
+type caseInsensitiveFS struct {
+	*testutil.FakeFS
+}
+
+func (fs caseInsensitiveFS) resolve(name string) string {
+	dir, base := filepath.Split(name)
+	infos, _ := fs.FakeFS.ReadDir(dir)
+	for _, info := range infos {
+		if strings.EqualFold(info.Name(), base) {
+			return filepath.Join(dir, info.Name())
+		}
+	}
+	return name
+}
+
+func (fs caseInsensitiveFS) Open(name string) (vfs.File, error) {
+	return fs.FakeFS.Open(fs.resolve(name))
+}
+
+func (fs caseInsensitiveFS) Create(name string) (vfs.File, error) {
+	return fs.FakeFS.Create(fs.resolve(name))
+}
+
+func (fs caseInsensitiveFS) Rename(from, to string) error {
+	from = fs.resolve(from)
+	switch cur := fs.resolve(to); {
+	case cur == from && cur != to:
+		return &os.LinkError{Op: "rename", Old: from, New: to, Err: os.ErrExist}
+	case cur != to:
+		fs.FakeFS.Remove(cur)
+	}
+	return fs.FakeFS.Rename(from, to)
+}
+
+func (fs caseInsensitiveFS) Remove(name string) error {
+	return fs.FakeFS.Remove(fs.resolve(name))
+}
+
+func (fs caseInsensitiveFS) Stat(name string) (os.FileInfo, error) {
+	return fs.FakeFS.Stat(fs.resolve(name))
+}
+
+func (fs caseInsensitiveFS) Lstat(name string) (os.FileInfo, error) {
+	return fs.FakeFS.Lstat(fs.resolve(name))
+}
+
+func (fs caseInsensitiveFS) Chtimes(name string, atime, mtime time.Time) error {
+	return fs.FakeFS.Chtimes(fs.resolve(name), atime, mtime)
+}
+
+func (fs caseInsensitiveFS) Chmod(name string, mode os.FileMode) error {
+	return fs.FakeFS.Chmod(fs.resolve(name), mode)
+}
+
+// A file renamed elsewhere to a name differing only in case is renamed
+// locally, even on a case insensitive filesystem, and not lost to the
+// deletion of the old name.
+func TestPullCaseRename(t *testing.T) {
+	data := []byte("contents kept through the rename")
+	dir := filepath.Join(string(os.PathSeparator), "repo")
+	fs := caseInsensitiveFS{testutil.NewFakeFS()}
+	fs.MkdirAll(dir, 0755)
+	fs.WriteFile(filepath.Join(dir, "Foo"), data, 0644)
+
+	m := NewModel(1e6)
+	m.SetFilesystem(fs)
+	m.AddRepo("default", dir, []NodeConfiguration{{NodeID: "42"}})
+	m.ScanRepo("default")
+	lf := m.CurrentRepoFile("default", "Foo")
+
+	// The node is not connected, so the contents can only come from the
+	// local file.
+	f := lf
+	f.Name = "foo"
+	f.Modified = 1234567890
+	f.Version = lf.Version + 1000
+	d := protocol.FileInfo{Name: "Foo", Flags: protocol.FlagDeleted | 0644, Modified: lf.Modified, Version: lf.Version + 1000}
+	m.Index("42", "default", []protocol.FileInfo{fileInfoFromFile(f), d})
+
+	if r := pullAll(t, m, "default", dir); r.FilesPulled != 1 || r.FilesDeleted != 1 || len(r.Failures) != 0 {
+		t.Fatalf("Incorrect pull report; %d pulled, %d deleted, failures %+v", r.FilesPulled, r.FilesDeleted, r.Failures)
+	}
+	if names := dirNames(fs, dir); !reflect.DeepEqual(names, []string{"foo"}) {
+		t.Errorf("Incorrect directory contents %v", names)
+	}
+	if bs, _ := vfs.ReadFile(fs, filepath.Join(dir, "foo")); !bytes.Equal(bs, data) {
+		t.Errorf("Incorrect contents %q after rename", bs)
+	}
+	if info, err := fs.Stat(filepath.Join(dir, "foo")); err != nil || info.ModTime().Unix() != f.Modified {
+		t.Errorf("Modification time not updated; %v, %v", info, err)
+	}
+	if cur := m.CurrentRepoFile("default", "foo"); cur.Version != f.Version {
+		t.Errorf("Renamed file not in local index: %v", cur)
+	}
+	if cur := m.CurrentRepoFile("default", "Foo"); cur.Flags&protocol.FlagDeleted == 0 {
+		t.Errorf("Old name not deleted in local index: %v", cur)
+	}
+	if need := m.NeedFilesRepo("default"); len(need) != 0 {
+		t.Errorf("Files still needed after rename: %v", need)
+	}
+}
+
+// A file replaced by one with different contents, under a name differing
+// only in case, is pulled as usual; the deletion of the old name must not
+// remove the new file.
+func TestPullCaseRenameChanged(t *testing.T) {
+	data := []byte("new contents from the remote node")
+	dir := filepath.Join(string(os.PathSeparator), "repo")
+	fs := caseInsensitiveFS{testutil.NewFakeFS()}
+	fs.MkdirAll(dir, 0755)
+	fs.WriteFile(filepath.Join(dir, "Foo"), []byte("old contents"), 0644)
+
+	m := NewModel(1e6)
+	m.SetFilesystem(fs)
+	m.AddRepo("default", dir, []NodeConfiguration{{NodeID: "42"}})
+	m.ScanRepo("default")
+	lf := m.CurrentRepoFile("default", "Foo")
+	fc := FakeConnection{id: "42", requestData: data}
+	m.AddConnection(fc, fc)
+
+	f := scanner.File{Name: "foo", Flags: 0644, Modified: 1234567890, Version: lf.Version + 1000, Size: int64(len(data))}
+	f.Blocks, _ = scanner.Blocks(bytes.NewReader(data), BlockSize)
+	d := protocol.FileInfo{Name: "Foo", Flags: protocol.FlagDeleted | 0644, Modified: lf.Modified, Version: lf.Version + 1000}
+	m.Index("42", "default", []protocol.FileInfo{fileInfoFromFile(f), d})
+
+	if r := pullAll(t, m, "default", dir); r.FilesPulled != 1 || len(r.Failures) != 0 {
+		t.Fatalf("Incorrect pull report; %d pulled, failures %+v", r.FilesPulled, r.Failures)
+	}
+	if names := dirNames(fs, dir); !reflect.DeepEqual(names, []string{"foo"}) {
+		t.Errorf("Incorrect directory contents %v", names)
+	}
+	if bs, _ := vfs.ReadFile(fs, filepath.Join(dir, "foo")); !bytes.Equal(bs, data) {
+		t.Errorf("Incorrect contents %q after pull", bs)
+	}
+	if need := m.NeedFilesRepo("default"); len(need) != 0 {
+		t.Errorf("Files still needed after pull: %v", need)
+	}
+}
+
+func dirNames(fs vfs.FS, dir string) []string {
+	infos, _ := fs.ReadDir(dir)
+	var names []string
+	for _, info := range infos {
+		names = append(names, info.Name())
+	}
+	return names
+}
+
+// Files replaced by the puller are kept as versions, which can be listed and
+// restored.
+func TestPullVersions(t *testing.T) {
+	dir := filepath.Join(string(os.PathSeparator), "repo")
+	path := filepath.Join(dir, "file")
+	fs := testutil.NewFakeFS()
+	fs.MkdirAll(dir, 0755)
+	original := []byte("the original contents")
+	fs.WriteFile(path, original, 0644)
+	t0 := time.Unix(1000000000, 0).UTC()
+	fs.Chtimes(path, t0, t0)
+
+	m := NewModel(1e6)
+	m.SetFilesystem(fs)
+	m.SetKeepVersions(5)
+	m.AddRepo("default", dir, []NodeConfiguration{{NodeID: "42"}, {NodeID: "43"}})
+	m.ScanRepo("default")
+	lf := m.CurrentRepoFile("default", "file")
+
+	// Two edits, from different nodes so that each serves its own data.
+	edit := func(node string, data []byte, modified int64, version uint64) scanner.File {
+		f := scanner.File{Name: "file", Flags: 0644, Modified: modified, Version: version, Size: int64(len(data))}
+		f.Blocks, _ = scanner.Blocks(bytes.NewReader(data), BlockSize)
+		fc := FakeConnection{id: node, requestData: data}
+		m.AddConnection(fc, fc)
+		m.Index(node, "default", []protocol.FileInfo{fileInfoFromFile(f)})
+		if r := pullAll(t, m, "default", dir); r.FilesPulled != 1 || len(r.Failures) != 0 {
+			t.Fatalf("Incorrect pull report; %d pulled, failures %+v", r.FilesPulled, r.Failures)
+		}
+		return f
+	}
+	first := []byte("the first edit")
+	edit("42", first, 1100000000, lf.Version+1000)
+	second := []byte("the second and last edit")
+	cur := edit("43", second, 1200000000, lf.Version+2000)
+
+	t1 := time.Unix(1100000000, 0).UTC()
+	exp := []VersionInfo{{t0, 0, int64(len(original))}, {t1, 0, int64(len(first))}}
+	if vs := m.Versions("default", "file"); !reflect.DeepEqual(vs, exp) {
+		t.Errorf("Incorrect versions %v != %v", vs, exp)
+	}
+	m.ScanRepo("default")
+	if names := indexNames(m, "default"); !reflect.DeepEqual(names, []string{"file"}) {
+		t.Errorf("Versions scanned into the index: %v", names)
+	}
+
+	// Restoring the original keeps the current file as a version and
+	// announces the original as a new version.
+	if err := m.RestoreVersion("default", "file", t0, 0); err != nil {
+		t.Fatal(err)
+	}
+	if bs, _ := vfs.ReadFile(fs, path); !bytes.Equal(bs, original) {
+		t.Errorf("Incorrect contents %q after restore", bs)
+	}
+	if f := m.CurrentRepoFile("default", "file"); f.Version <= cur.Version || !scanner.SameBlocks(f.Blocks, lf.Blocks) {
+		t.Errorf("Restored version not current: %v", f)
+	}
+	t2 := time.Unix(1200000000, 0).UTC()
+	exp = []VersionInfo{{t1, 0, int64(len(first))}, {t2, 0, int64(len(second))}}
+	if vs := m.Versions("default", "file"); !reflect.DeepEqual(vs, exp) {
+		t.Errorf("Incorrect versions %v != %v after restore", vs, exp)
+	}
+
+	if err := m.RestoreVersion("default", "file", t0, 0); err != ErrNoSuchVersion {
+		t.Errorf("Incorrect error %v restoring a missing version", err)
+	}
+}
+
+// Versions of the same modification time are kept side by side, and only
+// names written as versions are listed.
+func TestVersionsSameTime(t *testing.T) {
+	dir := filepath.Join(string(os.PathSeparator), "repo")
+	path := filepath.Join(dir, "file")
+	fs := testutil.NewFakeFS()
+	fs.MkdirAll(filepath.Join(dir, versionsDir), 0755)
+	t0 := time.Unix(1000000000, 0).UTC()
+	for _, data := range []string{"one", "three", "five!"} {
+		fs.WriteFile(path, []byte(data), 0644)
+		fs.Chtimes(path, t0, t0)
+		if err := archiveVersion(fs, dir, "file", path); err != nil {
+			t.Fatal(err)
+		}
+	}
+	fs.WriteFile(filepath.Join(dir, versionsDir, "file~20010909-014640.01"), nil, 0644)
+	fs.WriteFile(filepath.Join(dir, versionsDir, "file~20010909-014640~20010909-014640"), nil, 0644)
+
+	exp := []VersionInfo{{t0, 0, 3}, {t0, 1, 5}, {t0, 2, 5}}
+	if vs := listVersions(fs, dir, "file"); !reflect.DeepEqual(vs, exp) {
+		t.Errorf("Incorrect versions %v != %v", vs, exp)
+	}
+	pruneVersions(fs, dir, "file", 2)
+	if vs := listVersions(fs, dir, "file"); !reflect.DeepEqual(vs, exp[1:]) {
+		t.Errorf("Incorrect versions %v != %v after pruning", vs, exp[1:])
+	}
+}
+
+// Without versioning the versions directory is ordinary repository contents.
+func TestVersionsDisabled(t *testing.T) {
+	dir := filepath.Join(string(os.PathSeparator), "repo")
+	fs := testutil.NewFakeFS()
+	fs.MkdirAll(filepath.Join(dir, versionsDir), 0755)
+	vname := filepath.Join(versionsDir, "file~20010909-014640")
+	fs.WriteFile(filepath.Join(dir, "file"), []byte("data"), 0644)
+	fs.WriteFile(filepath.Join(dir, vname), []byte("more data"), 0644)
+
+	m := NewModel(1e6)
+	m.SetFilesystem(fs)
+	m.AddRepo("default", dir, []NodeConfiguration{{NodeID: "42"}})
+	m.ScanRepo("default")
+	if names := indexNames(m, "default"); !reflect.DeepEqual(names, []string{versionsDir, vname, "file"}) {
+		t.Errorf("Incorrect index %v", names)
+	}
+	if vs := m.Versions("default", "file"); len(vs) != 0 {
+		t.Errorf("Repository file listed as versions: %v", vs)
+	}
+
+	m.SetKeepVersions(1)
+	m.ScanRepo("default")
+	if names := indexNames(m, "default"); !reflect.DeepEqual(names, []string{"file"}) {
+		t.Errorf("Versions scanned into the index: %v", names)
+	}
+	if vs := m.Versions("default", "file"); len(vs) != 1 {
+		t.Errorf("Incorrect versions %v", vs)
+	}
+}
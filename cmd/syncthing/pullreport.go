@@ -0,0 +1,88 @@
+package main
+
+import (
+	"encoding/json"
+	"os"
+	"time"
+
+	"github.com/calmh/syncthing/events"
+)
+
+// PullReport summarizes the work done during one round of the puller, i.e.
+// from the first pulled block until the puller goes idle again.
+type PullReport struct {
+	Repo         string           `json:"repo"`
+	Start        time.Time        `json:"start"`
+	Duration     float64          `json:"duration"` // seconds
+	FilesPulled  int              `json:"filesPulled"`
+	FilesDeleted int              `json:"filesDeleted"`
+	DirsUpdated  int              `json:"dirsUpdated"` // created, changed or removed
+	BytesPerNode map[string]int64 `json:"bytesPerNode"`
+	Failures     []PullFailure    `json:"failures"`
+	Phases       []PhaseReport    `json:"phases"` // the phases that did any work, in order
+
+	started time.Time // by the model's clock, for the duration
+}
+
+type PhaseReport struct {
+	Phase      string  `json:"phase"`
+	Duration   float64 `json:"duration"` // seconds
+	Operations int     `json:"operations"`
+}
+
+type PullFailure struct {
+	Name  string `json:"name"`
+	Error string `json:"error"`
+}
+
+func newPullReport(repo string, started time.Time) *PullReport {
+	return &PullReport{
+		Repo:         repo,
+		Start:        time.Now(),
+		BytesPerNode: make(map[string]int64),
+		started:      started,
+	}
+}
+
+func (r *PullReport) empty() bool {
+	return r.operations() == 0 && len(r.BytesPerNode) == 0
+}
+
+// operations returns the number of files and directories handled so far.
+func (r *PullReport) operations() int {
+	return r.FilesPulled + r.FilesDeleted + r.DirsUpdated + len(r.Failures)
+}
+
+// SetPullReportFile sets the file that the report of each puller round is
+// appended to, as a line of JSON. An empty path disables the report file.
+func (m *Model) SetPullReportFile(path string) {
+	m.repmut.Lock()
+	m.reportFile = path
+	m.repmut.Unlock()
+}
+
+// pullRoundCompleted publishes the report of a finished puller round.
+func (m *Model) pullRoundCompleted(r *PullReport) {
+	events.Default.Log(events.PullRoundCompleted, r)
+
+	m.repmut.Lock()
+	defer m.repmut.Unlock()
+
+	if m.reportFile == "" {
+		return
+	}
+	fd, err := os.OpenFile(m.reportFile, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0644)
+	if err != nil {
+		warnln(err)
+		return
+	}
+	err = json.NewEncoder(fd).Encode(r)
+	if err == nil {
+		err = fd.Close()
+	} else {
+		fd.Close()
+	}
+	if err != nil {
+		warnln(err)
+	}
+}
@@ -0,0 +1,51 @@
+package main
+
+import "sync/atomic"
+
+// PullStats holds counters describing the work done by the puller for a
+// repository.
+type PullStats struct {
+	// Files whose contents were unchanged and only had their modification
+	// time or permissions updated.
+	MetadataOnly int64
+	// Bytes of block data received from other nodes.
+	BytesPulled int64
+	// Files currently being pulled.
+	OpenFiles int64
+	// Pulled files read back in full to check them before being put in
+	// place, and files that were not because every block was checked as
+	// it was written.
+	FullChecks    int64
+	SkippedChecks int64
+}
+
+func (s *PullStats) addMetadataOnly() {
+	atomic.AddInt64(&s.MetadataOnly, 1)
+}
+
+func (s *PullStats) addBytesPulled(n int) {
+	atomic.AddInt64(&s.BytesPulled, int64(n))
+}
+
+func (s *PullStats) addFullCheck() {
+	atomic.AddInt64(&s.FullChecks, 1)
+}
+
+func (s *PullStats) addSkippedCheck() {
+	atomic.AddInt64(&s.SkippedChecks, 1)
+}
+
+func (s *PullStats) setOpenFiles(n int) {
+	atomic.StoreInt64(&s.OpenFiles, int64(n))
+}
+
+func (s *PullStats) snapshot() PullStats {
+	return PullStats{
+		MetadataOnly: atomic.LoadInt64(&s.MetadataOnly),
+		BytesPulled:  atomic.LoadInt64(&s.BytesPulled),
+		OpenFiles:    atomic.LoadInt64(&s.OpenFiles),
+
+		FullChecks:    atomic.LoadInt64(&s.FullChecks),
+		SkippedChecks: atomic.LoadInt64(&s.SkippedChecks),
+	}
+}
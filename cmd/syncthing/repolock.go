@@ -0,0 +1,123 @@
+package main
+
+import (
+	"crypto/sha1"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// The suffix of the lock file names, which are otherwise named like the
+// index caches for the repository directory.
+const repoLockSuffix = ".lock"
+
+const (
+	// How long a restarted instance waits for the instance that started it
+	// to exit and release its locks.
+	repoLockRestartWait = 30 * time.Second
+	repoLockRetry       = 100 * time.Millisecond
+)
+
+var ErrRepoLocked = errors.New("repository is in use by another instance")
+
+// errLockHeld is returned by lockFile when another process holds the lock.
+var errLockHeld = errors.New("lock held")
+
+// A repoLock marks a repository directory as being synchronized by this
+// process. The lock is held on the lock file for as long as it is open, so
+// it is released by the operating system when the process dies and a stale
+// lock file doesn't need to be broken. The file holds the process id and the
+// time the lock was taken, for information.
+type repoLock struct {
+	path string
+	fd   *os.File
+}
+
+// repoLockPath returns the name of the lock file in lockDir for the
+// repository directory.
+func repoLockPath(lockDir, dir string) string {
+	return filepath.Join(lockDir, fmt.Sprintf("%x", sha1.Sum([]byte(dir)))+repoLockSuffix)
+}
+
+// acquireRepoLock takes the lock on the repository directory, in lockDir.
+// Returns ErrRepoLocked when the lock is held by another process, or by
+// this one for another model.
+func acquireRepoLock(lockDir, dir string) (*repoLock, error) {
+	path := repoLockPath(lockDir, dir)
+	var waited time.Duration
+	for {
+		fd, err := os.OpenFile(path, os.O_RDWR|os.O_CREATE, 0644)
+		if err != nil {
+			return nil, err
+		}
+		err = lockFile(fd)
+		if err == errLockHeld && waited < repoLockRestartWait && heldByParent(path) {
+			// We were started by a restarting instance that is about to
+			// exit.
+			fd.Close()
+			time.Sleep(repoLockRetry)
+			waited += repoLockRetry
+			continue
+		}
+		if err == errLockHeld {
+			fd.Close()
+			return nil, ErrRepoLocked
+		}
+		if err != nil {
+			fd.Close()
+			return nil, err
+		}
+
+		// The previous holder removes the file before letting go of the
+		// lock, so what we locked may no longer be the lock file.
+		if fi, err := fd.Stat(); err != nil {
+			fd.Close()
+			return nil, err
+		} else if cur, err := os.Stat(path); err != nil || !os.SameFile(fi, cur) {
+			fd.Close()
+			continue
+		}
+
+		if err := fd.Truncate(0); err != nil {
+			fd.Close()
+			return nil, err
+		}
+		if _, err := fmt.Fprintf(fd, "%d\n%d\n", os.Getpid(), time.Now().Unix()); err != nil {
+			fd.Close()
+			return nil, err
+		}
+		return &repoLock{path: path, fd: fd}, nil
+	}
+}
+
+// lockHolder returns the process id recorded in the lock file, or zero if
+// there is none.
+func lockHolder(path string) int {
+	bs, err := ioutil.ReadFile(path)
+	if err != nil {
+		return 0
+	}
+	fields := strings.Fields(string(bs))
+	if len(fields) == 0 {
+		return 0
+	}
+	pid, _ := strconv.Atoi(fields[0])
+	return pid
+}
+
+// heldByParent returns true if we were started by a restarting instance and
+// it is the one holding the lock.
+func heldByParent(path string) bool {
+	return os.Getenv("STRESTART") != "" && lockHolder(path) == os.Getppid()
+}
+
+// release removes the lock file and then lets go of the lock.
+func (l *repoLock) release() {
+	os.Remove(l.path)
+	l.fd.Close()
+}
@@ -0,0 +1,84 @@
+package main
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestRepoLock(t *testing.T) {
+	dir, err := ioutil.TempDir("", "repolock")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	confDir := filepath.Join(dir, "conf")
+	repoDir := filepath.Join(dir, "repo")
+	os.Mkdir(confDir, 0755)
+	os.Mkdir(repoDir, 0755)
+	lock := repoLockPath(confDir, repoDir)
+
+	m1 := NewModel(1e6)
+	m1.SetLockDir(confDir)
+	m1.AddRepo("default", repoDir, nil)
+	if err := m1.StartRepoRW("default", 1); err != nil {
+		t.Fatal(err)
+	}
+	if pid := lockHolder(lock); pid != os.Getpid() {
+		t.Errorf("lock held by %d, expected %d", pid, os.Getpid())
+	}
+
+	// The lock is taken on the open file, not by its existence, so a second
+	// model is refused even in the same process.
+	m2 := NewModel(1e6)
+	m2.SetLockDir(confDir)
+	m2.AddRepo("default", repoDir, nil)
+	if err := m2.StartRepoRW("default", 1); err != ErrRepoLocked {
+		t.Fatalf("incorrect error %v for locked repo", err)
+	}
+
+	// Nothing is created in the repository itself, where it could collide
+	// with a pulled file.
+	if fis, err := ioutil.ReadDir(repoDir); err != nil || len(fis) != 0 {
+		t.Errorf("lock left files %v (%v) in the repository", fis, err)
+	}
+
+	m1.ReleaseRepoLocks()
+	if _, err := os.Stat(lock); !os.IsNotExist(err) {
+		t.Fatal("lock remains after release:", err)
+	}
+	if err := m2.StartRepoRW("default", 1); err != nil {
+		t.Fatal(err)
+	}
+	m2.ReleaseRepoLocks()
+}
+
+// A lock file left behind by a process that is gone isn't locked and is
+// simply taken over.
+func TestRepoLockStale(t *testing.T) {
+	dir, err := ioutil.TempDir("", "repolock")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	lock := repoLockPath(dir, "/repo")
+
+	// Larger than any process id in use
+	dead := fmt.Sprintf("%d\n%d\n", 1<<30, 0)
+	if err := ioutil.WriteFile(lock, []byte(dead), 0644); err != nil {
+		t.Fatal(err)
+	}
+	l, err := acquireRepoLock(dir, "/repo")
+	if err != nil {
+		t.Fatal("stale lock not taken over:", err)
+	}
+	if pid := lockHolder(lock); pid != os.Getpid() {
+		t.Errorf("lock held by %d, expected %d", pid, os.Getpid())
+	}
+	if _, err := acquireRepoLock(dir, "/repo"); err != ErrRepoLocked {
+		t.Errorf("incorrect error %v for locked repo", err)
+	}
+	l.release()
+}
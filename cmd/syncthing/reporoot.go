@@ -0,0 +1,56 @@
+package main
+
+import (
+	"bytes"
+	"path/filepath"
+
+	"github.com/calmh/syncthing/cid"
+	"github.com/calmh/syncthing/files"
+)
+
+// setAnnounced makes the roots of the repository files cover what is
+// announced to other nodes: the wire names of the files not internal to the
+// application. Must be called with rmut held for writing.
+func (m *Model) setAnnounced(rf *files.Set) {
+	internal := append([]string(nil), m.internal...)
+	names := m.names
+	rf.SetAnnounced(func(name string) (string, bool) {
+		if isInternal(internal, name) {
+			return "", false
+		}
+		return filepath.ToSlash(names.ToWire(name)), true
+	})
+}
+
+// RepoRoot returns the root hash of the local files in the repository, as
+// announced to the connected nodes, or nil if there is no such repository.
+func (m *Model) RepoRoot(repo string) []byte {
+	m.rmut.RLock()
+	defer m.rmut.RUnlock()
+	if rf, ok := m.repoFiles[repo]; ok {
+		return rf.Root(cid.LocalID)
+	}
+	return nil
+}
+
+// InSync returns true if the node has announced the same root for the
+// repository as that of the local files, meaning that the node has the same
+// files, in the same versions, as we do.
+func (m *Model) InSync(repo, nodeID string) bool {
+	m.pmut.RLock()
+	conn, ok := m.protoConn[nodeID]
+	m.pmut.RUnlock()
+	if !ok {
+		return false
+	}
+	peer := conn.PeerRoot(repo)
+	return peer != nil && bytes.Equal(peer, m.RepoRoot(repo))
+}
+
+// inSync returns true if the global view of the repository is the same as
+// the local files, in which case nothing is needed. Must be called with
+// rmut held.
+func (m *Model) inSync(repo string) bool {
+	rf := m.repoFiles[repo]
+	return bytes.Equal(rf.Root(cid.LocalID), rf.GlobalRoot())
+}
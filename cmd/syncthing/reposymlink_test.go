@@ -0,0 +1,65 @@
+// +build !windows
+
+package main
+
+import (
+	"bytes"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+// A repository directory reached through symlinks is scanned and served
+// like the directory itself, with clean relative names.
+func TestSymlinkedRepo(t *testing.T) {
+	tmp, err := ioutil.TempDir("", "model")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(tmp)
+	testdata, err := filepath.Abs("testdata")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Symlink(testdata, filepath.Join(tmp, "abs")); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Symlink("abs", filepath.Join(tmp, "rel")); err != nil {
+		t.Fatal(err)
+	}
+
+	ref := NewModel(1e6)
+	ref.AddRepo("default", "testdata", nil)
+	ref.ScanRepo("default")
+	exp := indexNames(ref, "default")
+	if len(exp) == 0 {
+		t.Fatal("Nothing scanned in testdata")
+	}
+
+	for _, link := range []string{"abs", "rel"} {
+		m := NewModel(1e6)
+		m.AddRepo("default", filepath.Join(tmp, link), []NodeConfiguration{{NodeID: "some node"}})
+		m.ScanRepo("default")
+
+		names := indexNames(m, "default")
+		if !reflect.DeepEqual(names, exp) {
+			t.Errorf("Incorrect names %v through %q, expected %v", names, link, exp)
+		}
+		for _, name := range names {
+			if filepath.IsAbs(name) || strings.HasPrefix(name, "..") || filepath.Clean(name) != name {
+				t.Errorf("Unclean name %q through %q", name, link)
+			}
+		}
+
+		bs, err := m.Request("some node", "default", "foo", 0, 6)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !bytes.Equal(bs, []byte("foobar")) {
+			t.Errorf("Incorrect data from request through %q: %q", link, string(bs))
+		}
+	}
+}
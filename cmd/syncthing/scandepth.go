@@ -0,0 +1,48 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/calmh/syncthing/cid"
+	"github.com/calmh/syncthing/scanner"
+)
+
+// SetMaxScanDepth limits scans to n directory levels below the repository
+// directory; at zero only the files and directories directly in it are
+// scanned. A negative n, the default, removes the limit. Files already in
+// the index below the limit are kept as they are rather than deleted, and
+// files are not pulled below the limit, as they would not be rescanned.
+func (m *Model) SetMaxScanDepth(n int) {
+	m.rmut.Lock()
+	m.scanDepth = n
+	m.rmut.Unlock()
+}
+
+// tooDeep returns the files in the local index below the directories whose
+// contents a scan left out by the depth limit, so that they are not taken
+// as deleted.
+func (m *Model) tooDeep(repo string, dirs []string) []scanner.File {
+	if len(dirs) == 0 {
+		return nil
+	}
+
+	m.rmut.RLock()
+	rf := m.repoFiles[repo]
+	m.rmut.RUnlock()
+
+	var fs []scanner.File
+	for _, f := range rf.Have(cid.LocalID) {
+		if below(filepath.Dir(f.Name), dirs) {
+			fs = append(fs, f)
+		}
+	}
+	return fs
+}
+
+// belowScanDepth returns true if the file is below the directories at the
+// depth limit, so that scans leave it out. Must be called with rmut held.
+func (m *Model) belowScanDepth(name string) bool {
+	return m.scanDepth >= 0 && strings.Count(name, string(os.PathSeparator)) > m.scanDepth
+}
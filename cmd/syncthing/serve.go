@@ -0,0 +1,88 @@
+package main
+
+import (
+	"crypto/tls"
+	"errors"
+	"io"
+	"net"
+	"time"
+
+	"github.com/calmh/syncthing/protocol"
+)
+
+var errNotTLS = errors.New("not a TLS connection")
+
+// Serve accepts connections from the listener and adds them to the model,
+// until the listener is closed. The node ID of a connection is told by
+// idFunc; if it is nil, connections must be TLS and the ID is that of the
+// peer certificate. Connections from nodes that share no repository with us
+// are closed, as are those refused by the connection filter as when added
+// with AddConnection. Returns the error that stopped Accept.
+func (m *Model) Serve(l net.Listener, idFunc func(net.Conn) (string, error)) error {
+	if idFunc == nil {
+		idFunc = tlsConnID
+	}
+	for {
+		conn, err := l.Accept()
+		if err != nil {
+			if ne, ok := err.(net.Error); ok && ne.Temporary() {
+				warnln(err)
+				time.Sleep(time.Second)
+				continue
+			}
+			return err
+		}
+		if debugNet {
+			dlog.Println("connect from", conn.RemoteAddr())
+		}
+		// Telling the ID may involve a handshake, which mustn't hold up
+		// other connections.
+		go m.serveConn(conn, idFunc)
+	}
+}
+
+func (m *Model) serveConn(conn net.Conn, idFunc func(net.Conn) (string, error)) {
+	nodeID, err := idFunc(conn)
+	if err != nil {
+		warnf("Connection from %v: %v", conn.RemoteAddr(), err)
+		conn.Close()
+		return
+	}
+	if nodeID == myID {
+		warnf("Connected to myself (%s) - should not happen", nodeID)
+		conn.Close()
+		return
+	}
+	if !m.knownNode(nodeID) {
+		warnf("Connection from unknown node %s at %v; closing", nodeID, conn.RemoteAddr())
+		conn.Close()
+		return
+	}
+
+	var wr io.Writer = conn
+	if rateBucket != nil {
+		wr = &limitedWriter{conn, rateBucket}
+	}
+	m.AddConnection(directedConn{conn, false}, protocol.NewConnection(nodeID, conn, wr, m))
+}
+
+// tlsConnID completes the handshake of a TLS connection and returns the node
+// ID of the peer.
+func tlsConnID(conn net.Conn) (string, error) {
+	tc, ok := conn.(*tls.Conn)
+	if !ok {
+		return "", errNotTLS
+	}
+	if err := tc.Handshake(); err != nil {
+		return "", err
+	}
+	return tlsNodeID(tc)
+}
+
+// knownNode returns true if the node is configured to share a repository
+// with us.
+func (m *Model) knownNode(nodeID string) bool {
+	m.rmut.RLock()
+	defer m.rmut.RUnlock()
+	return len(m.nodeRepos[nodeID]) > 0
+}
@@ -0,0 +1,88 @@
+package main
+
+import (
+	"time"
+
+	"github.com/juju/ratelimit"
+)
+
+// ModelSettings is a snapshot of the operational parameters of the model.
+type ModelSettings struct {
+	BlockSize         int                   `json:"blockSize"`
+	Symlinks          string                `json:"symlinks"`
+	GuardPlaceholders bool                  `json:"guardPlaceholders"`
+	CheckSizes        bool                  `json:"checkSizes"`
+	SettleTime        time.Duration         `json:"settleTime"` // zero to hash changed files right away
+	IgnorePerms       bool                  `json:"ignorePerms"`
+	CreateTimes       bool                  `json:"createTimes"`
+	SparseFiles       bool                  `json:"sparseFiles"`
+	DiskReserve       int64                 `json:"diskReserve"` // bytes
+	KeepVersions      int                   `json:"keepVersions"`
+	PullPriority      []string              `json:"pullPriority"`
+	MaxScanDepth      int                   `json:"maxScanDepth"` // negative for no limit
+	Copiers           int                   `json:"copiers"`
+	DiskReadRate      int64                 `json:"diskReadRate"`  // bytes/s, zero for no limit
+	DiskWriteRate     int64                 `json:"diskWriteRate"` // bytes/s, zero for no limit
+	MaxChangeRate     int64                 `json:"maxChangeRate"` // bytes/s
+	MaxIndexAge       time.Duration         `json:"maxIndexAge"`   // zero for no limit
+	Repos             map[string]RepoStatus `json:"repos"`
+}
+
+// RepoStatus is the mode a repository runs in.
+type RepoStatus struct {
+	Dir       string   `json:"dir"`
+	Nodes     []string `json:"nodes"`
+	Started   bool     `json:"started"`
+	ReadWrite bool     `json:"readWrite"`
+	Threads   int      `json:"threads"` // pull threads, zero when read only
+}
+
+// Settings returns a consistent snapshot of the current settings of the
+// model and the mode of each repository.
+func (m *Model) Settings() ModelSettings {
+	m.amut.Lock()
+	maxIndexAge := m.maxIndexAge
+	m.amut.Unlock()
+
+	m.rmut.RLock()
+	defer m.rmut.RUnlock()
+
+	s := ModelSettings{
+		BlockSize:         BlockSize,
+		Symlinks:          m.symlinks.String(),
+		GuardPlaceholders: m.phGuard,
+		CheckSizes:        m.sizeCheck,
+		SettleTime:        m.settle,
+		IgnorePerms:       m.noPerms,
+		CreateTimes:       m.ctimes,
+		SparseFiles:       m.sparse,
+		DiskReserve:       m.reserve,
+		KeepVersions:      m.keepVers,
+		PullPriority:      append([]string(nil), m.priority...),
+		MaxScanDepth:      m.scanDepth,
+		Copiers:           m.copiers,
+		DiskReadRate:      bucketRate(m.diskRead),
+		DiskWriteRate:     bucketRate(m.diskWrite),
+		MaxChangeRate:     m.sup.threshold,
+		MaxIndexAge:       maxIndexAge,
+		Repos:             make(map[string]RepoStatus, len(m.repoDirs)),
+	}
+	for repo, dir := range m.repoDirs {
+		threads, started := m.repoMode[repo]
+		s.Repos[repo] = RepoStatus{
+			Dir:       dir,
+			Nodes:     append([]string(nil), m.repoNodes[repo]...),
+			Started:   started,
+			ReadWrite: threads > 0,
+			Threads:   threads,
+		}
+	}
+	return s
+}
+
+func bucketRate(b *ratelimit.Bucket) int64 {
+	if b == nil {
+		return 0
+	}
+	return int64(b.Rate())
+}
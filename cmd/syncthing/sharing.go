@@ -0,0 +1,110 @@
+package main
+
+import (
+	"errors"
+
+	"github.com/calmh/syncthing/cid"
+	"github.com/calmh/syncthing/protocol"
+)
+
+var (
+	ErrNoSuchRepo = errors.New("no such repository")
+	ErrNotShared  = errors.New("repository not shared with node")
+)
+
+// SetRepoNodes changes the nodes the repository is shared with, without
+// restarting any connections. Connected nodes that are added are sent the
+// index of the repository. Nodes that are removed are sent no further
+// updates, and the index received from them for the repository is dropped.
+func (m *Model) SetRepoNodes(repo string, nodes []string) error {
+	m.pmut.RLock()
+	m.rmut.Lock()
+
+	rf, ok := m.repoFiles[repo]
+	if !ok {
+		m.rmut.Unlock()
+		m.pmut.RUnlock()
+		return ErrNoSuchRepo
+	}
+
+	keep := make(map[string]bool, len(nodes))
+	for _, n := range nodes {
+		keep[n] = true
+	}
+	var dropped []uint
+	var removed []string
+	for _, n := range m.repoNodes[repo] {
+		if keep[n] {
+			delete(keep, n)
+			continue
+		}
+		m.nodeRepos[n] = without(m.nodeRepos[n], repo)
+		dropped = append(dropped, m.cm.Get(n))
+		removed = append(removed, n)
+	}
+	// What remains in keep are the nodes added.
+	var added []protocol.Connection
+	for n := range keep {
+		m.nodeRepos[n] = append(m.nodeRepos[n], repo)
+		if _, pending := m.nodeReady[n]; pending || m.idxSending[n] {
+			// The initial index will include the repository.
+			continue
+		}
+		if conn, ok := m.protoConn[n]; ok {
+			added = append(added, conn)
+		}
+	}
+	m.repoNodes[repo] = append([]string(nil), nodes...)
+
+	if len(dropped) > 0 {
+		rf.Drop(dropped)
+	}
+	var idx []protocol.FileInfo
+	var root []byte
+	if len(added) > 0 {
+		idx = m.protocolIndex(repo)
+		root = rf.Root(cid.LocalID)
+	}
+	m.rmut.Unlock()
+	m.pmut.RUnlock()
+
+	m.amut.Lock()
+	for _, n := range removed {
+		delete(m.indexTime[repo], n)
+	}
+	m.amut.Unlock()
+	for _, n := range removed {
+		m.dropChanges(n, repo)
+	}
+
+	for _, conn := range added {
+		if debugNet {
+			dlog.Printf("IDX(out/shared): %s: %q: %d files", conn.ID(), repo, len(idx))
+		}
+		conn.Index(repo, idx)
+		conn.Root(repo, root)
+	}
+	return nil
+}
+
+// sharedWith returns true if the repository is shared with the node. Must be
+// called with rmut held.
+func (m *Model) sharedWith(repo, nodeID string) bool {
+	for _, n := range m.repoNodes[repo] {
+		if n == nodeID {
+			return true
+		}
+	}
+	return false
+}
+
+// without returns the strings in ss other than s.
+func without(ss []string, s string) []string {
+	var res []string
+	for _, e := range ss {
+		if e != s {
+			res = append(res, e)
+		}
+	}
+	return res
+}
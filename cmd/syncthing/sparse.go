@@ -0,0 +1,70 @@
+package main
+
+import (
+	"bytes"
+	"crypto/sha256"
+
+	"github.com/calmh/syncthing/scanner"
+)
+
+var (
+	zeroBlock     = make([]byte, BlockSize)
+	zeroBlockHash = sha256.Sum256(zeroBlock)
+)
+
+// isZeroBlock returns true if the block holds only zeros.
+func isZeroBlock(b scanner.Block) bool {
+	if b.Size == BlockSize {
+		return bytes.Compare(b.Hash, zeroBlockHash[:]) == 0
+	}
+	hash := sha256.Sum256(zeroData(int(b.Size)))
+	return bytes.Compare(b.Hash, hash[:]) == 0
+}
+
+// zeroData returns n zero bytes, which must not be modified.
+func zeroData(n int) []byte {
+	if n <= len(zeroBlock) {
+		return zeroBlock[:n]
+	}
+	return make([]byte, n)
+}
+
+// leaveHole skips fetching and writing the block if it holds only zeros,
+// leaving a hole in the temporary file that reads back as zeros. Returns
+// true if it did so, in which case the block is fully handled.
+func (p *puller) leaveHole(b bqBlock) bool {
+	parts := b.parts
+	if len(parts) == 0 {
+		parts = []scanner.Block{b.block}
+	}
+	for _, pb := range parts {
+		if !isZeroBlock(pb) {
+			return false
+		}
+	}
+
+	f := b.file
+	of := p.openFiles[f.Name]
+	if end := b.block.Offset + int64(b.block.Size); end == f.Size {
+		// A hole at the end of the file needs its last byte written to
+		// give the file its full size.
+		if _, err := of.file.WriteAt([]byte{0}, end-1); err != nil {
+			return false
+		}
+	}
+
+	if debugPull {
+		dlog.Printf("pull: leaving hole at %q / %q offset %d size %d", p.repo, f.Name, b.block.Offset, b.block.Size)
+	}
+	if of.zeros == nil {
+		of.zeros = make(map[int64]bool)
+	}
+	for _, pb := range parts {
+		of.zeros[pb.Offset] = true
+	}
+	p.openFiles[f.Name] = of
+	if of.done && of.outstanding == 0 {
+		p.closeFile(f)
+	}
+	return true
+}
@@ -25,6 +25,7 @@ type suppressor struct {
 	sync.Mutex
 	changes   map[string]changeHistory
 	threshold int64 // bytes/s
+	clock     clock
 }
 
 func (h changeHistory) bandwidth(t time.Time) int64 {
@@ -53,7 +54,7 @@ func (h *changeHistory) append(size int64, t time.Time) {
 }
 
 func (s *suppressor) Suppress(name string, fi os.FileInfo) bool {
-	sup, _ := s.suppress(name, fi.Size(), time.Now())
+	sup, _ := s.suppress(name, fi.Size(), s.clock.Now())
 	return sup
 }
 
@@ -3,6 +3,8 @@ package main
 import (
 	"testing"
 	"time"
+
+	"github.com/calmh/syncthing/testutil"
 )
 
 func TestSuppressor(t *testing.T) {
@@ -111,3 +113,28 @@ func TestHistory(t *testing.T) {
 	}
 
 }
+
+func TestSuppressorClock(t *testing.T) {
+	fs := testutil.NewFakeFS()
+	fs.WriteFile("/foo", make([]byte, 10000), 0644)
+	fi, _ := fs.Stat("/foo")
+
+	c := newFakeClock()
+	s := suppressor{threshold: 1000, clock: c}
+
+	// A change every ten seconds is right at the threshold.
+	for i := 0; i <= MaxChangeHistory; i++ {
+		if i > 0 {
+			c.advance(10 * time.Second)
+		}
+		if s.Suppress("foo", fi) {
+			t.Fatalf("%d: suppressed at threshold", i)
+		}
+	}
+
+	// One a second after the previous is too much.
+	c.advance(time.Second)
+	if !s.Suppress("foo", fi) {
+		t.Error("Not suppressed above threshold")
+	}
+}
@@ -0,0 +1,137 @@
+package main
+
+import (
+	"fmt"
+	"sync"
+	"time"
+)
+
+// The period over which the sync throughput is measured.
+const syncRateWindow = time.Minute
+
+// Below this throughput, in bytes per second, no ETA is estimated; it would
+// be too far off to be of use.
+const minSyncRate = 1024
+
+// ETAs longer than this are not estimated.
+const maxSyncETA = 7 * 24 * time.Hour
+
+// SyncStatus tells how far the repositories are from being in sync and how
+// fast they are getting there.
+type SyncStatus struct {
+	BytesSynced    int64         `json:"bytesSynced"` // pulled during the last Period
+	Period         time.Duration `json:"period"`
+	BytesPerSecond int64         `json:"bytesPerSecond"`
+	BytesRemaining int64         `json:"bytesRemaining"` // of the needed files
+	ETA            time.Duration `json:"eta"`            // zero when in sync or when it cannot be estimated
+}
+
+type syncSample struct {
+	at        time.Time
+	pulled    int64 // bytes pulled since start
+	remaining int64 // bytes of needed files
+}
+
+// syncRate keeps the samples taken over the last syncRateWindow, and the
+// last one taken before, that the throughput is measured from.
+type syncRate struct {
+	samples []syncSample
+	mut     sync.Mutex
+}
+
+// add records the sample and returns the status over the window up to it.
+func (r *syncRate) add(s syncSample) SyncStatus {
+	r.mut.Lock()
+	defer r.mut.Unlock()
+
+	r.samples = append(r.samples, s)
+	start := s.at.Add(-syncRateWindow)
+	for len(r.samples) > 2 && !r.samples[1].at.After(start) {
+		r.samples = r.samples[1:]
+	}
+	return syncEstimate(r.samples[0], s)
+}
+
+// syncEstimate returns the status between the samples. No ETA is given
+// when the throughput is too low to tell, or when the needed bytes grow
+// faster than they are pulled.
+func syncEstimate(from, to syncSample) SyncStatus {
+	s := SyncStatus{
+		BytesRemaining: to.remaining,
+		Period:         to.at.Sub(from.at),
+	}
+	if s.Period <= 0 {
+		return s
+	}
+
+	s.BytesSynced = to.pulled - from.pulled
+	if s.BytesSynced < 0 {
+		// The counters have been reset
+		s.BytesSynced = 0
+	}
+	s.BytesPerSecond = int64(float64(s.BytesSynced) / s.Period.Seconds())
+
+	if s.BytesRemaining == 0 || s.BytesPerSecond < minSyncRate || to.remaining > from.remaining {
+		return s
+	}
+	secs := float64(s.BytesRemaining) / float64(s.BytesPerSecond)
+	if secs < maxSyncETA.Seconds() {
+		s.ETA = time.Duration(secs * float64(time.Second))
+	}
+	return s
+}
+
+// SyncStatus returns the pull throughput over the last minute, or since the
+// previous call if that was longer ago, and an estimate of the time left
+// until all repositories are in sync.
+func (m *Model) SyncStatus() SyncStatus {
+	m.rmut.RLock()
+	var repos = make([]string, 0, len(m.repoFiles))
+	var pulled int64
+	for repo := range m.repoFiles {
+		repos = append(repos, repo)
+		pulled += m.repoStats[repo].snapshot().BytesPulled
+	}
+	m.rmut.RUnlock()
+
+	var remaining int64
+	for _, repo := range repos {
+		_, bytes := m.NeedSize(repo)
+		remaining += bytes
+	}
+
+	return m.syncRate.add(syncSample{at: m.clock.Now(), pulled: pulled, remaining: remaining})
+}
+
+// printSyncStatusLoop logs the sync status at the given interval, whenever
+// there is something to sync.
+func printSyncStatusLoop(m *Model, interval time.Duration) {
+	for {
+		time.Sleep(interval)
+		s := m.SyncStatus()
+		if s.BytesSynced == 0 && s.BytesRemaining == 0 {
+			continue
+		}
+		eta := "unknown"
+		if s.ETA > 0 {
+			eta = (s.ETA - s.ETA%time.Second).String()
+		}
+		period := s.Period - s.Period%time.Second
+		infof("Synced %s in the last %v, %s remaining, ETA %s", binaryBytes(s.BytesSynced), period, binaryBytes(s.BytesRemaining), eta)
+	}
+}
+
+// binaryBytes formats the number of bytes with a binary prefix.
+func binaryBytes(n int64) string {
+	const units = "KMGTPE"
+	if n < 1024 {
+		return fmt.Sprintf("%d B", n)
+	}
+	v := float64(n)
+	i := -1
+	for v >= 1024 && i < len(units)-1 {
+		v /= 1024
+		i++
+	}
+	return fmt.Sprintf("%.1f %ciB", v, units[i])
+}
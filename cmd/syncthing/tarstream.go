@@ -0,0 +1,332 @@
+package main
+
+import (
+	"archive/tar"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"time"
+
+	"github.com/calmh/syncthing/buffers"
+	"github.com/calmh/syncthing/cid"
+	"github.com/calmh/syncthing/events"
+	"github.com/calmh/syncthing/files"
+	"github.com/calmh/syncthing/lamport"
+	"github.com/calmh/syncthing/protocol"
+	"github.com/calmh/syncthing/scanner"
+	"github.com/calmh/syncthing/vfs"
+)
+
+// The name of the first entry of a tar stream, holding the version of each
+// file in the stream as a JSON object keyed by entry name, so that the files
+// imported from it are in sync with the cluster right away. Only the first
+// entry is taken as the manifest; a repository file of the same name further
+// on is an ordinary file.
+const tarManifestName = ".stmanifest.json"
+
+// StreamTar writes the named files and directories of the repository, or
+// all of them if no names are given, to w as a tar stream. Only what the
+// local index announces is streamed; deleted, invalid, symlinked and
+// internal entries are left out, and a file that has changed since it was scanned ends the
+// stream with an error.
+func (m *Model) StreamTar(repo string, w io.Writer, names []string) error {
+	m.rmut.RLock()
+	rf, ok := m.repoFiles[repo]
+	dir := m.repoDirs[repo]
+	m.rmut.RUnlock()
+	if !ok {
+		return ErrNoSuchRepo
+	}
+
+	var files []scanner.File
+	if len(names) == 0 {
+		files = rf.Have(cid.LocalID)
+	} else {
+		for _, name := range names {
+			f := rf.Get(cid.LocalID, name)
+			if f.Name != name {
+				return fmt.Errorf("%q: %v", name, ErrNoSuchFile)
+			}
+			files = append(files, f)
+		}
+	}
+	// Directories come before their contents.
+	sort.Sort(fileList(files))
+
+	internal := m.internalPaths()
+	var streamed []scanner.File
+	manifest := make(map[string]uint64)
+	for _, f := range files {
+		const skip = protocol.FlagDeleted | protocol.FlagSymlink
+		if f.Invalid || f.Flags&skip != 0 || m.vetoed(f.Name) || isInternal(internal, f.Name) {
+			continue
+		}
+		streamed = append(streamed, f)
+		manifest[tarName(f)] = f.Version
+	}
+
+	tw := tar.NewWriter(w)
+	if err := writeManifest(tw, manifest); err != nil {
+		return err
+	}
+	for _, f := range streamed {
+		if err := m.streamFile(tw, repo, dir, f); err != nil {
+			return err
+		}
+	}
+	return tw.Close()
+}
+
+// tarName returns the name of the tar entry for f.
+func tarName(f scanner.File) string {
+	if f.Flags&protocol.FlagDirectory != 0 {
+		return filepath.ToSlash(f.Name) + "/"
+	}
+	return filepath.ToSlash(f.Name)
+}
+
+func writeManifest(tw *tar.Writer, manifest map[string]uint64) error {
+	bs, err := json.Marshal(manifest)
+	if err != nil {
+		return err
+	}
+	hdr := &tar.Header{
+		Name:     tarManifestName,
+		Typeflag: tar.TypeReg,
+		Mode:     0644,
+		ModTime:  time.Now(),
+		Size:     int64(len(bs)),
+	}
+	if err := tw.WriteHeader(hdr); err != nil {
+		return err
+	}
+	_, err = tw.Write(bs)
+	return err
+}
+
+// streamFile writes the header and, for files, the contents of f, checking
+// each block against the index as it is read.
+func (m *Model) streamFile(tw *tar.Writer, repo, dir string, f scanner.File) error {
+	hdr := &tar.Header{
+		Name:    tarName(f),
+		Mode:    int64(f.Flags & 0777),
+		ModTime: time.Unix(f.Modified, 0),
+	}
+	if f.Flags&protocol.FlagDirectory != 0 {
+		hdr.Typeflag = tar.TypeDir
+		return tw.WriteHeader(hdr)
+	}
+	hdr.Typeflag = tar.TypeReg
+	hdr.Size = f.Size
+
+	fn, err := safePath(dir, f.Name)
+	if err != nil {
+		return err
+	}
+	fd, err := m.fs.Open(fn)
+	if err != nil {
+		return err
+	}
+	defer fd.Close()
+	vfs.Advise(fd, vfs.AdviceSequential)
+
+	if err := tw.WriteHeader(hdr); err != nil {
+		return err
+	}
+	for _, b := range f.Blocks {
+		buf := buffers.Get(int(b.Size))
+		err := vfs.ReadFullAt(fd, fn, buf, b.Offset)
+		if err == nil && verifyParts(buf, b.Offset, []scanner.Block{b}) != nil {
+			infof("%q in repository %q has changed since it was scanned; not serving it until rehashed", f.Name, repo)
+			m.markChanged(repo, f)
+			err = protocol.ErrBlockChanged
+		}
+		if err == nil {
+			_, err = tw.Write(buf)
+		}
+		buffers.Put(buf)
+		if err != nil {
+			return fmt.Errorf("%q: %v", f.Name, err)
+		}
+	}
+	return nil
+}
+
+// ImportTar unpacks the files and directories of a tar stream, as written by
+// StreamTar, into the repository and adds them to the local index. Files
+// that the local index already has at the same or a later version are left
+// alone, as are internal paths and entries of other types. The version in
+// the manifest is taken only for files that are the same as the global
+// version; the rest are imported as local changes.
+func (m *Model) ImportTar(repo string, r io.Reader) error {
+	m.rmut.RLock()
+	rf, ok := m.repoFiles[repo]
+	dir := m.repoDirs[repo]
+	m.rmut.RUnlock()
+	if !ok {
+		return ErrNoSuchRepo
+	}
+
+	// Directory metadata is set last, as creating their contents changes
+	// their modification times.
+	var dirs []scanner.File
+	internal := m.internalPaths()
+
+	var manifest map[string]uint64
+	tr := tar.NewReader(r)
+	for first := true; ; first = false {
+		hdr, err := tr.Next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return err
+		}
+		if first && hdr.Name == tarManifestName {
+			if err := json.NewDecoder(tr).Decode(&manifest); err != nil {
+				return fmt.Errorf("version manifest: %v", err)
+			}
+			continue
+		}
+
+		f := scanner.File{
+			Name:     filepath.Clean(filepath.FromSlash(hdr.Name)),
+			Flags:    uint32(hdr.Mode & 0777),
+			Modified: hdr.ModTime.Unix(),
+		}
+		switch {
+		case f.Name == "." || isInternal(internal, f.Name):
+			continue
+		case hdr.Typeflag == tar.TypeDir:
+			f.Flags |= protocol.FlagDirectory
+		case hdr.Typeflag == tar.TypeReg:
+		default:
+			if debugPull {
+				dlog.Printf("import: %q / %q: skipping entry of type %q", repo, hdr.Name, hdr.Typeflag)
+			}
+			continue
+		}
+		v, inManifest := manifest[hdr.Name]
+		if lf := rf.Get(cid.LocalID, f.Name); inManifest && lf.Name == f.Name && lf.Version >= v {
+			continue
+		}
+		path, err := safePath(dir, f.Name)
+		if err != nil {
+			warnf("Security: tar entry %q for repo %q: %v", hdr.Name, repo, err)
+			return err
+		}
+
+		if f.Flags&protocol.FlagDirectory != 0 {
+			if !importVersion(rf, &f, v, inManifest) {
+				continue
+			}
+			if err := m.fs.MkdirAll(path, 0777); err != nil {
+				return err
+			}
+			dirs = append(dirs, f)
+			continue
+		}
+		imported, err := m.importFile(path, &f, tr, hdr.Size, func(f *scanner.File) bool {
+			return importVersion(rf, f, v, inManifest)
+		})
+		if err != nil {
+			return fmt.Errorf("%q: %v", f.Name, err)
+		}
+		if imported {
+			m.updateLocal(repo, f)
+			m.fileEvent(events.FilePulled, repo, f)
+		}
+	}
+
+	for i := len(dirs) - 1; i >= 0; i-- {
+		f := dirs[i]
+		path := filepath.Join(dir, f.Name)
+		m.setImportedMetadata(path, f)
+		m.updateLocal(repo, f)
+		m.fileEvent(events.FilePulled, repo, f)
+	}
+	return nil
+}
+
+// importVersion sets the version of the imported file, returning false if
+// the local index already has the file as it is. The version v from the
+// manifest is taken only if the file has the same contents as the global
+// version, lest a stale stream undo changes made in the cluster since it
+// was written; without a manifest entry the global version itself is taken.
+// A file that differs from the global version is a local change, as if it
+// had been written into the repository and scanned.
+func importVersion(rf *files.Set, f *scanner.File, v uint64, inManifest bool) bool {
+	lf := rf.Get(cid.LocalID, f.Name)
+	if g := rf.GetGlobal(f.Name); sameContents(*f, g) {
+		if !inManifest {
+			v = g.Version
+		}
+		if lf.Name == f.Name && lf.Version >= v {
+			return false
+		}
+		f.Version = v
+		lamport.Default.Tick(v)
+		return true
+	}
+	if sameContents(*f, lf) {
+		return false
+	}
+	f.Version = lamport.Default.Tick(lf.Version)
+	return true
+}
+
+// sameContents returns true if the imported file f has the same contents as
+// the indexed file g, being either a directory or a file with the same
+// blocks.
+func sameContents(f, g scanner.File) bool {
+	const kind = protocol.FlagDirectory | protocol.FlagDeleted | protocol.FlagSymlink
+	return g.Name == f.Name && g.Flags&kind == f.Flags&kind && scanner.SameBlocks(f.Blocks, g.Blocks)
+}
+
+// importFile writes the contents of the file from r to a temporary file,
+// hashing it on the way. If keep then returns true for the hashed file, it
+// is moved into place at path; otherwise it is discarded and importFile
+// returns false.
+func (m *Model) importFile(path string, f *scanner.File, r io.Reader, size int64, keep func(f *scanner.File) bool) (bool, error) {
+	if err := m.fs.MkdirAll(filepath.Dir(path), 0777); err != nil {
+		return false, err
+	}
+	temp := filepath.Join(filepath.Dir(path), defTempNamer.TempName(filepath.Base(path)))
+	fd, err := m.fs.Create(temp)
+	if err != nil {
+		return false, err
+	}
+	defer m.fs.Remove(temp)
+
+	err = scanner.HashBlocks(io.TeeReader(r, fd), BlockSize, size, nil, func(b scanner.Block) error {
+		f.Blocks = append(f.Blocks, b)
+		return nil
+	})
+	if cerr := fd.Close(); err == nil {
+		err = cerr
+	}
+	if err != nil {
+		return false, err
+	}
+	f.Size = size
+	if !keep(f) {
+		return false, nil
+	}
+
+	m.setImportedMetadata(temp, *f)
+	defTempNamer.Show(temp)
+	return true, m.fs.Rename(temp, path)
+}
+
+// setImportedMetadata sets the modification time and, unless permissions
+// are ignored, the permissions of the file at path to those of f.
+func (m *Model) setImportedMetadata(path string, f scanner.File) {
+	t := time.Unix(f.Modified, 0)
+	m.fs.Chtimes(path, t, t)
+	if !m.ignorePermissions() {
+		m.fs.Chmod(path, os.FileMode(f.Flags&0777))
+	}
+}
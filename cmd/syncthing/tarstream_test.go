@@ -0,0 +1,245 @@
+package main
+
+import (
+	"archive/tar"
+	"bytes"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/calmh/syncthing/cid"
+	"github.com/calmh/syncthing/events"
+	"github.com/calmh/syncthing/protocol"
+	"github.com/calmh/syncthing/scanner"
+	"github.com/calmh/syncthing/testutil"
+	"github.com/calmh/syncthing/vfs"
+)
+
+func TestStreamTar(t *testing.T) {
+	src := filepath.Join(string(os.PathSeparator), "src")
+	dst := filepath.Join(string(os.PathSeparator), "dst")
+	fs := testutil.NewFakeFS()
+	fs.MkdirAll(filepath.Join(src, "dir"), 0755)
+	fs.MkdirAll(dst, 0755)
+	fs.WriteFile(filepath.Join(src, "a"), []byte("some data"), 0644)
+	fs.WriteFile(filepath.Join(src, "empty"), nil, 0600)
+	large := make([]byte, 2*BlockSize+100)
+	for i := range large {
+		large[i] = byte(i % 251)
+	}
+	fs.WriteFile(filepath.Join(src, "dir", "large"), large, 0755)
+
+	m0 := NewModel(1e6)
+	m0.SetFilesystem(fs)
+	m0.AddRepo("default", src, nil)
+	m0.ScanRepo("default")
+
+	m1 := NewModel(1e6)
+	m1.SetFilesystem(fs)
+	m1.AddRepo("default", dst, []NodeConfiguration{{NodeID: "42"}})
+	announceIndex(m1, m0)
+
+	var buf bytes.Buffer
+	if err := m0.StreamTar("default", &buf, nil); err != nil {
+		t.Fatal(err)
+	}
+	if err := m1.ImportTar("default", &buf); err != nil {
+		t.Fatal(err)
+	}
+
+	want := m0.repoFiles["default"].Have(cid.LocalID)
+	got := m1.repoFiles["default"].Have(cid.LocalID)
+	if len(want) != 4 {
+		t.Fatalf("%d files in the source index, expected 4", len(want))
+	}
+	if len(got) != len(want) {
+		t.Fatalf("%d files imported, expected %d", len(got), len(want))
+	}
+	for _, f := range want {
+		g := m1.CurrentRepoFile("default", f.Name)
+		if g.Flags != f.Flags || g.Modified != f.Modified || g.Version != f.Version || g.Size != f.Size || !scanner.SameBlocks(g.Blocks, f.Blocks) {
+			t.Errorf("Imported %v, expected %v", g, f)
+		}
+	}
+
+	bs, err := vfs.ReadFile(fs, filepath.Join(dst, "dir", "large"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(bs, large) {
+		t.Error("Incorrect data imported")
+	}
+
+	// A rescan finds the imported files unchanged.
+	m1.ScanRepo("default")
+	for _, f := range want {
+		if g := m1.CurrentRepoFile("default", f.Name); g.Version != f.Version {
+			t.Errorf("%q has version %d after rescan, expected %d", f.Name, g.Version, f.Version)
+		}
+	}
+}
+
+// announceIndex gives m the local index of src as the index of node 42, as
+// when m is connected to the cluster before importing a stream from it.
+func announceIndex(m, src *Model) {
+	var fs []protocol.FileInfo
+	for _, f := range src.repoFiles["default"].Have(cid.LocalID) {
+		fs = append(fs, fileInfoFromFile(f))
+	}
+	m.Index("42", "default", fs)
+}
+
+func TestStreamTarSelected(t *testing.T) {
+	src := filepath.Join(string(os.PathSeparator), "src")
+	dst := filepath.Join(string(os.PathSeparator), "dst")
+	fs := testutil.NewFakeFS()
+	fs.MkdirAll(src, 0755)
+	fs.MkdirAll(dst, 0755)
+	fs.WriteFile(filepath.Join(src, "a"), []byte("aaa"), 0644)
+	fs.WriteFile(filepath.Join(src, "b"), []byte("bbb"), 0644)
+
+	m0 := NewModel(1e6)
+	m0.SetFilesystem(fs)
+	m0.AddRepo("default", src, nil)
+	m0.ScanRepo("default")
+
+	m1 := NewModel(1e6)
+	m1.SetFilesystem(fs)
+	m1.AddRepo("default", dst, nil)
+	sub := m1.WatchPrefix("default", "")
+	defer events.Default.Unsubscribe(sub)
+
+	var buf bytes.Buffer
+	if err := m0.StreamTar("default", &buf, []string{"b"}); err != nil {
+		t.Fatal(err)
+	}
+	if err := m1.ImportTar("default", &buf); err != nil {
+		t.Fatal(err)
+	}
+
+	got := m1.repoFiles["default"].Have(cid.LocalID)
+	if len(got) != 1 || got[0].Name != "b" {
+		t.Errorf("Imported %v, expected only b", got)
+	}
+	if names := watched(sub); len(names) != 1 || names["b"] != events.FilePulled {
+		t.Errorf("Incorrect events for imported files %v", names)
+	}
+
+	if err := m0.StreamTar("default", &buf, []string{"nonexistent"}); err == nil {
+		t.Error("Unexpected nil error streaming a nonexistent file")
+	}
+}
+
+// A repository file named like the version manifest is streamed as any
+// other file, as only the first entry of the stream is the manifest.
+func TestStreamTarManifestName(t *testing.T) {
+	src := filepath.Join(string(os.PathSeparator), "src")
+	dst := filepath.Join(string(os.PathSeparator), "dst")
+	fs := testutil.NewFakeFS()
+	fs.MkdirAll(src, 0755)
+	fs.MkdirAll(dst, 0755)
+	fs.WriteFile(filepath.Join(src, tarManifestName), []byte("not a manifest"), 0644)
+
+	m0 := NewModel(1e6)
+	m0.SetFilesystem(fs)
+	m0.AddRepo("default", src, nil)
+	m0.ScanRepo("default")
+
+	m1 := NewModel(1e6)
+	m1.SetFilesystem(fs)
+	m1.AddRepo("default", dst, []NodeConfiguration{{NodeID: "42"}})
+	announceIndex(m1, m0)
+
+	var buf bytes.Buffer
+	if err := m0.StreamTar("default", &buf, nil); err != nil {
+		t.Fatal(err)
+	}
+	if err := m1.ImportTar("default", &buf); err != nil {
+		t.Fatal(err)
+	}
+
+	f := m0.CurrentRepoFile("default", tarManifestName)
+	if f.Name != tarManifestName {
+		t.Fatalf("%q not scanned", tarManifestName)
+	}
+	if g := m1.CurrentRepoFile("default", tarManifestName); g.Version != f.Version {
+		t.Errorf("Imported version %d, expected %d", g.Version, f.Version)
+	}
+	if bs, err := vfs.ReadFile(fs, filepath.Join(dst, tarManifestName)); err != nil || string(bs) != "not a manifest" {
+		t.Errorf("Incorrect data imported %q, %v", bs, err)
+	}
+}
+
+// The versions in the manifest are taken only for files that are the same
+// as the global version. A stale stream, or one without a manifest, doesn't
+// override what the cluster has.
+func TestImportTarVersions(t *testing.T) {
+	src := filepath.Join(string(os.PathSeparator), "src")
+	dst := filepath.Join(string(os.PathSeparator), "dst")
+	fs := testutil.NewFakeFS()
+	fs.MkdirAll(src, 0755)
+	fs.MkdirAll(dst, 0755)
+	fs.WriteFile(filepath.Join(src, "same"), []byte("same"), 0644)
+	fs.WriteFile(filepath.Join(src, "changed"), []byte("old"), 0644)
+
+	m0 := NewModel(1e6)
+	m0.SetFilesystem(fs)
+	m0.AddRepo("default", src, nil)
+	m0.ScanRepo("default")
+
+	var buf bytes.Buffer
+	if err := m0.StreamTar("default", &buf, nil); err != nil {
+		t.Fatal(err)
+	}
+
+	// The cluster has moved on since the stream was written.
+	fs.WriteFile(filepath.Join(src, "changed"), []byte("new data"), 0644)
+	m0.ScanRepo("default")
+	same := m0.CurrentRepoFile("default", "same")
+	changed := m0.CurrentRepoFile("default", "changed")
+
+	m1 := NewModel(1e6)
+	m1.SetFilesystem(fs)
+	m1.AddRepo("default", dst, []NodeConfiguration{{NodeID: "42"}})
+	announceIndex(m1, m0)
+
+	if err := m1.ImportTar("default", &buf); err != nil {
+		t.Fatal(err)
+	}
+	if g := m1.CurrentRepoFile("default", "same"); g.Version != same.Version {
+		t.Errorf("Unchanged file imported at version %d, expected %d", g.Version, same.Version)
+	}
+	if g := m1.CurrentRepoFile("default", "changed"); g.Version <= changed.Version {
+		t.Errorf("Stale file imported at version %d, not as a local change to %d", g.Version, changed.Version)
+	}
+
+	// Without a manifest, a file the same as the global version takes that
+	// version and one the cluster doesn't have is a local change.
+	var plain bytes.Buffer
+	tw := tar.NewWriter(&plain)
+	for _, e := range []struct{ name, data string }{{"same", "same"}, {"other", "other"}} {
+		tw.WriteHeader(&tar.Header{Name: e.name, Mode: 0644, Size: int64(len(e.data)), ModTime: time.Unix(same.Modified, 0), Typeflag: tar.TypeReg})
+		tw.Write([]byte(e.data))
+	}
+	tw.Close()
+
+	m2 := NewModel(1e6)
+	m2.SetFilesystem(fs)
+	m2.AddRepo("default", filepath.Join(string(os.PathSeparator), "dst2"), []NodeConfiguration{{NodeID: "42"}})
+	fs.MkdirAll(filepath.Join(string(os.PathSeparator), "dst2"), 0755)
+	announceIndex(m2, m0)
+
+	if err := m2.ImportTar("default", &plain); err != nil {
+		t.Fatal(err)
+	}
+	if g := m2.CurrentRepoFile("default", "same"); g.Version != same.Version {
+		t.Errorf("Unchanged file imported at version %d, expected %d", g.Version, same.Version)
+	}
+	if g := m2.CurrentRepoFile("default", "other"); g.Name != "other" || g.Version == 0 {
+		t.Errorf("New file not imported as a local change: %v", g)
+	}
+	if need := m2.NeedFilesRepo("default"); len(need) != 1 || need[0].Name != "changed" {
+		t.Errorf("Incorrect need set %v", need)
+	}
+}
@@ -24,6 +24,13 @@ func (t tempNamer) TempName(name string) string {
 	return filepath.Join(tdir, tname)
 }
 
+// RealName returns the name of the file that the temporary file is for.
+func (t tempNamer) RealName(name string) string {
+	tdir := filepath.Dir(name)
+	base := strings.TrimPrefix(filepath.Base(name), t.prefix+".")
+	return filepath.Join(tdir, base)
+}
+
 func (t tempNamer) Hide(path string) error {
 	return nil
 }
@@ -25,6 +25,14 @@ func (t tempNamer) TempName(name string) string {
 	return filepath.Join(tdir, tname)
 }
 
+// RealName returns the name of the file that the temporary file is for.
+func (t tempNamer) RealName(name string) string {
+	tdir := filepath.Dir(name)
+	base := strings.TrimPrefix(filepath.Base(name), t.prefix+".")
+	base = strings.TrimSuffix(base, ".tmp")
+	return filepath.Join(tdir, base)
+}
+
 func (t tempNamer) Hide(path string) error {
 	p, err := syscall.UTF16PtrFromString(path)
 	if err != nil {
@@ -10,6 +10,7 @@ import (
 	"encoding/base32"
 	"encoding/binary"
 	"encoding/pem"
+	"fmt"
 	"math/big"
 	"os"
 	"path/filepath"
@@ -33,6 +34,16 @@ func certID(bs []byte) string {
 	return strings.Trim(base32.StdEncoding.EncodeToString(id), "=")
 }
 
+// tlsNodeID returns the node ID of the peer of the connection, which must
+// have completed the handshake.
+func tlsNodeID(conn *tls.Conn) (string, error) {
+	certs := conn.ConnectionState().PeerCertificates
+	if l := len(certs); l != 1 {
+		return "", fmt.Errorf("got peer certificate list of length %d != 1; protocol error", l)
+	}
+	return certID(certs[0].Raw), nil
+}
+
 func certSeed(bs []byte) int64 {
 	hf := sha256.New()
 	hf.Write(bs)
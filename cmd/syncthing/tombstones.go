@@ -0,0 +1,60 @@
+package main
+
+import (
+	"time"
+
+	"github.com/calmh/syncthing/cid"
+	"github.com/calmh/syncthing/protocol"
+)
+
+// expireDeleted forgets the local tombstones in the repository that have
+// been known for longer than TombstoneExpiryS, after a scan at the given
+// time. A tombstone is kept until the current index of every other node
+// sharing the repository holds the identical tombstone; otherwise a node
+// that hasn't seen the delete yet could bring the file back. The times the
+// tombstones became known are saved with the index.
+func (m *Model) expireDeleted(repo string, now time.Time) {
+	expiry := time.Duration(cfg.Options.TombstoneExpiryS) * time.Second
+
+	m.rmut.Lock()
+	fs := m.repoFiles[repo]
+	nodes := m.repoNodes[repo]
+	current := make(map[string]time.Time)
+	var candidates []string
+	for _, f := range fs.Have(cid.LocalID) {
+		if f.Flags&protocol.FlagDeleted == 0 {
+			continue
+		}
+		since, ok := m.deleted[repo][f.Name]
+		if !ok {
+			since = now
+		}
+		current[f.Name] = since
+		if expiry > 0 && now.Sub(since) > expiry {
+			candidates = append(candidates, f.Name)
+		}
+	}
+	m.deleted[repo] = current
+	m.rmut.Unlock()
+
+	if len(candidates) == 0 {
+		return
+	}
+
+	var remotes []uint
+	for _, nodeID := range nodes {
+		if nodeID != myID {
+			remotes = append(remotes, m.cm.Get(nodeID))
+		}
+	}
+
+	expired := fs.ExpireDeleted(candidates, remotes)
+	m.rmut.Lock()
+	for _, n := range expired {
+		delete(m.deleted[repo], n)
+	}
+	m.rmut.Unlock()
+	if len(expired) > 0 {
+		infof("Expired %d deleted files in repository %q", len(expired), repo)
+	}
+}
@@ -0,0 +1,232 @@
+package main
+
+import (
+	"errors"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+
+	"github.com/calmh/syncthing/cid"
+	"github.com/calmh/syncthing/scanner"
+)
+
+// A Transfer describes a file that is currently being pulled.
+type Transfer struct {
+	Repo    string
+	Name    string
+	Temp    string   // full path of the temporary file
+	Written int64    // bytes written to the temporary file so far
+	Nodes   []string // the nodes that blocks have been requested from
+
+	version uint64        // the version being pulled
+	cancel  chan struct{} // closed when the pull is cancelled
+}
+
+var (
+	ErrNotPulling   = errors.New("file is not being pulled")
+	errPullCanceled = errors.New("pull canceled")
+)
+
+type transferKey struct {
+	repo, name string
+}
+
+type transferList []Transfer
+
+func (l transferList) Len() int { return len(l) }
+func (l transferList) Less(a, b int) bool {
+	if l[a].Repo != l[b].Repo {
+		return l[a].Repo < l[b].Repo
+	}
+	return l[a].Name < l[b].Name
+}
+func (l transferList) Swap(a, b int) { l[a], l[b] = l[b], l[a] }
+
+// ActiveTransfers returns the files currently being pulled in all
+// repositories, sorted by repository and name.
+func (m *Model) ActiveTransfers() []Transfer {
+	m.tmut.Lock()
+	var res []Transfer
+	for _, t := range m.transfers {
+		c := *t
+		c.Nodes = append([]string(nil), t.Nodes...)
+		c.version, c.cancel = 0, nil
+		res = append(res, c)
+	}
+	m.tmut.Unlock()
+
+	sort.Sort(transferList(res))
+	return res
+}
+
+// ActivePulls returns the names of the files currently being pulled in the
+// repository, sorted by name.
+func (m *Model) ActivePulls(repo string) []string {
+	var names []string
+	for _, t := range m.ActiveTransfers() {
+		if t.Repo == repo {
+			names = append(names, t.Name)
+		}
+	}
+	return names
+}
+
+// CancelPull stops pulling the file and removes its temporary file. Requests
+// for its blocks are abandoned. The file is still needed, but the version
+// being pulled isn't pulled again. Returns ErrNotPulling if the file isn't
+// being pulled.
+func (m *Model) CancelPull(repo, name string) error {
+	m.tmut.Lock()
+	defer m.tmut.Unlock()
+	k := transferKey{repo, name}
+	t, ok := m.transfers[k]
+	if !ok {
+		return ErrNotPulling
+	}
+	select {
+	case <-t.cancel:
+	default:
+		m.canceled[k] = t.version
+		close(t.cancel)
+	}
+	return nil
+}
+
+// pullCanceled returns true if pulling this version of the file has been
+// canceled.
+func (m *Model) pullCanceled(repo string, f scanner.File) bool {
+	m.tmut.Lock()
+	defer m.tmut.Unlock()
+	k := transferKey{repo, f.Name}
+	v, ok := m.canceled[k]
+	if ok && v != f.Version {
+		// A newer version is pulled as usual.
+		delete(m.canceled, k)
+		return false
+	}
+	return ok
+}
+
+// OrphanTempFiles returns the names, relative to the repository directory,
+// of the temporary files in the repository that belong to neither a needed
+// file nor an active transfer. These are left over from earlier runs and
+// can safely be removed. Originals backed up while replacing a file are
+// never included, as they are recovered when pulling starts.
+func (m *Model) OrphanTempFiles(repo string) []string {
+	m.rmut.RLock()
+	dir, ok := m.repoDirs[repo]
+	var need []scanner.File
+	if ok {
+		need = m.repoFiles[repo].Need(cid.LocalID)
+	}
+	m.rmut.RUnlock()
+	if !ok {
+		return nil
+	}
+
+	used := make(map[string]bool)
+	for _, f := range need {
+		used[defTempNamer.TempName(f.Name)] = true
+	}
+	m.tmut.Lock()
+	for k, t := range m.transfers {
+		if k.repo == repo {
+			if rn, err := filepath.Rel(dir, t.Temp); err == nil {
+				used[rn] = true
+			}
+		}
+	}
+	m.tmut.Unlock()
+
+	var orphans []string
+	for _, rn := range m.tempWalker(dir).TempFiles() {
+		if !used[rn] && !strings.HasSuffix(rn, backupSuffix) {
+			orphans = append(orphans, rn)
+		}
+	}
+	return orphans
+}
+
+// RemoveOrphanTempFiles removes the temporary files returned by
+// OrphanTempFiles. Returns the first error encountered, after attempting to
+// remove all of them.
+func (m *Model) RemoveOrphanTempFiles(repo string) error {
+	m.rmut.RLock()
+	dir := m.repoDirs[repo]
+	m.rmut.RUnlock()
+
+	var firstErr error
+	for _, rn := range m.OrphanTempFiles(repo) {
+		path := filepath.Join(dir, rn)
+		err := m.fs.Remove(path)
+		if err != nil && !os.IsNotExist(err) && firstErr == nil {
+			firstErr = err
+		}
+		m.forgetTempFile(path)
+	}
+	return firstErr
+}
+
+// forgetTempFile drops what is cached about the temporary file at path.
+func (m *Model) forgetTempFile(path string) {
+	m.tmut.Lock()
+	delete(m.tempHave, path)
+	m.tmut.Unlock()
+}
+
+func (m *Model) tempWalker(dir string) *scanner.Walker {
+	return &scanner.Walker{
+		Dir:       dir,
+		TempNamer: defTempNamer,
+		FS:        m.fs,
+	}
+}
+
+// transferStarted registers the pull of the file. Returns a channel that is
+// closed if the pull is canceled.
+func (m *Model) transferStarted(repo string, f scanner.File, temp string) <-chan struct{} {
+	t := &Transfer{
+		Repo:    repo,
+		Name:    f.Name,
+		Temp:    temp,
+		version: f.Version,
+		cancel:  make(chan struct{}),
+	}
+	m.tmut.Lock()
+	m.transfers[transferKey{repo, f.Name}] = t
+	m.tmut.Unlock()
+	return t.cancel
+}
+
+func (m *Model) transferRequested(repo, name, node string) {
+	m.tmut.Lock()
+	defer m.tmut.Unlock()
+	t, ok := m.transfers[transferKey{repo, name}]
+	if !ok {
+		return
+	}
+	for _, n := range t.Nodes {
+		if n == node {
+			return
+		}
+	}
+	t.Nodes = append(t.Nodes, node)
+}
+
+func (m *Model) transferWritten(repo, name string, bytes int) {
+	m.tmut.Lock()
+	if t, ok := m.transfers[transferKey{repo, name}]; ok {
+		t.Written += int64(bytes)
+	}
+	m.tmut.Unlock()
+}
+
+func (m *Model) transferEnded(repo, name string) {
+	m.tmut.Lock()
+	if t, ok := m.transfers[transferKey{repo, name}]; ok {
+		delete(m.tempHave, t.Temp)
+	}
+	delete(m.transfers, transferKey{repo, name})
+	m.tmut.Unlock()
+}
@@ -1,28 +1,24 @@
 package main
 
 import (
+	"errors"
 	"fmt"
 	"os"
 	"path/filepath"
-	"runtime"
+	"strings"
 
 	"github.com/calmh/syncthing/protocol"
 	"github.com/calmh/syncthing/scanner"
+	"github.com/calmh/syncthing/vfs"
 )
 
 func Rename(from, to string) error {
-	if runtime.GOOS == "windows" {
-		err := os.Remove(to)
-		if err != nil && !os.IsNotExist(err) {
-			warnln(err)
-		}
-	}
-	return os.Rename(from, to)
+	return vfs.OS.Rename(from, to)
 }
 
 func fileFromFileInfo(f protocol.FileInfo) scanner.File {
 	var blocks = make([]scanner.Block, len(f.Blocks))
-	var offset int64
+	var offset int64 // files may be larger than 4 GiB
 	for i, b := range f.Blocks {
 		blocks[i] = scanner.Block{
 			Offset: offset,
@@ -33,14 +29,126 @@ func fileFromFileInfo(f protocol.FileInfo) scanner.File {
 	}
 	return scanner.File{
 		// Name is with native separator and normalization
-		Name:       filepath.FromSlash(f.Name),
-		Size:       offset,
-		Flags:      f.Flags &^ protocol.FlagInvalid,
-		Modified:   f.Modified,
-		Version:    f.Version,
-		Blocks:     blocks,
-		Suppressed: f.Flags&protocol.FlagInvalid != 0,
+		Name:          filepath.FromSlash(f.Name),
+		Size:          offset,
+		Flags:         f.Flags &^ (protocol.FlagInvalid | protocol.FlagInvalidReason),
+		Modified:      f.Modified,
+		Version:       f.Version,
+		Blocks:        blocks,
+		Hash:          f.Hash,
+		Created:       f.Created,
+		Invalid:       f.Flags&protocol.FlagInvalid != 0,
+		InvalidReason: protocol.InvalidReason(f.Flags),
+	}
+}
+
+var (
+	errBlockTooLarge = errors.New("block larger than block size")
+	errShortBlock    = errors.New("short block before end of file")
+	errEmptyBlock    = errors.New("empty block in non-empty file")
+)
+
+// verifyBlocks checks that the advertised block list is consistent with how
+// files are split into blocks; all blocks but the last are of exactly
+// BlockSize, and only an empty file has an empty block.
+func verifyBlocks(f protocol.FileInfo) error {
+	last := len(f.Blocks) - 1
+	for i, b := range f.Blocks {
+		switch {
+		case b.Size > BlockSize:
+			return errBlockTooLarge
+		case i < last && b.Size != BlockSize:
+			return errShortBlock
+		case b.Size == 0 && last != 0:
+			return errEmptyBlock
+		}
+	}
+	return nil
+}
+
+// safePath returns the path of the named file in the repository directory
+// dir, or ErrUnsafePath if the name is absolute or resolves to outside of
+// the directory.
+func safePath(dir, name string) (string, error) {
+	if filepath.IsAbs(name) || filepath.VolumeName(name) != "" {
+		return "", ErrUnsafePath
+	}
+	path := filepath.Join(dir, name)
+	if !within(dir, path) {
+		return "", ErrUnsafePath
+	}
+	return path, nil
+}
+
+// within returns true if path is dir or is below it.
+func within(dir, path string) bool {
+	rel, err := filepath.Rel(dir, path)
+	return err == nil && rel != ".." && !strings.HasPrefix(rel, ".."+string(filepath.Separator))
+}
+
+// safeLinkTarget returns ErrUnsafePath if the target of a symlink named name
+// in the repository directory dir is absolute or points to outside of the
+// directory, either as written or, if the target exists, once the symlinks
+// on the way there are resolved.
+func safeLinkTarget(fs vfs.FS, dir, name, target string) error {
+	if filepath.IsAbs(target) || filepath.VolumeName(target) != "" {
+		return ErrUnsafePath
+	}
+	path, err := safePath(dir, filepath.Join(filepath.Dir(name), target))
+	if err != nil {
+		return err
+	}
+	if rp, err := vfs.EvalSymlinks(fs, path); err == nil && !within(dir, rp) {
+		return ErrUnsafePath
+	}
+	return nil
+}
+
+// linkedParent returns ErrUnsafePath if any of the directories leading up to
+// the named file in the repository directory dir is a symlink, as anything
+// written or removed through it could end up outside of the directory.
+func linkedParent(fs vfs.FS, dir, name string) error {
+	path := dir
+	parents := strings.Split(filepath.Dir(name), string(filepath.Separator))
+	for _, elem := range parents {
+		if elem == "." {
+			break
+		}
+		path = filepath.Join(path, elem)
+		info, err := fs.Lstat(path)
+		if err != nil {
+			// Nothing further down exists yet.
+			return nil
+		}
+		if info.Mode()&os.ModeSymlink != 0 {
+			return ErrUnsafePath
+		}
+	}
+	return nil
+}
+
+var errInvalidName = errors.New("invalid file name")
+
+// canonicalName returns the clean form of a file name received from another
+// node or loaded from a saved index, so that "foo", "./foo" and "foo/" all
+// refer to the same file. Returns ErrUnsafePath for names that are absolute
+// or resolve to outside of the repository, and errInvalidName for empty
+// names and for files other than directories with a trailing separator.
+func canonicalName(name string, isDir bool) (string, error) {
+	if filepath.IsAbs(name) || filepath.VolumeName(name) != "" {
+		return "", ErrUnsafePath
+	}
+	if !isDir && strings.HasSuffix(name, string(filepath.Separator)) {
+		return "", errInvalidName
+	}
+	clean := filepath.Clean(name)
+	switch {
+	case clean == ".":
+		return "", errInvalidName
+	case clean == ".." || strings.HasPrefix(clean, ".."+string(filepath.Separator)):
+		return "", ErrUnsafePath
 	}
+	return clean, nil
 }
 
 func fileInfoFromFile(f scanner.File) protocol.FileInfo {
@@ -57,9 +165,11 @@ func fileInfoFromFile(f scanner.File) protocol.FileInfo {
 		Modified: f.Modified,
 		Version:  f.Version,
 		Blocks:   blocks,
+		Hash:     f.Hash,
+		Created:  f.Created,
 	}
-	if f.Suppressed {
-		pf.Flags |= protocol.FlagInvalid
+	if f.Invalid {
+		pf.Flags |= protocol.FlagInvalid | protocol.InvalidReasonFlags(f.InvalidReason)
 	}
 	return pf
 }
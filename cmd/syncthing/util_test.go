@@ -1,9 +1,14 @@
 package main
 
 import (
+	"bytes"
+	"encoding/binary"
+	"os"
+	"path/filepath"
 	"testing"
 
 	"github.com/calmh/syncthing/protocol"
+	"github.com/calmh/syncthing/scanner"
 )
 
 var testcases = []struct {
@@ -181,3 +186,237 @@ func TestCompareClusterConfig(t *testing.T) {
 		}
 	}
 }
+
+func TestInvalidFileInfoRoundtrip(t *testing.T) {
+	f := scanner.File{
+		Name:          "foo",
+		Flags:         0644,
+		Version:       1000,
+		Invalid:       true,
+		InvalidReason: protocol.InvalidReasonUnreadable,
+	}
+
+	fi := fileInfoFromFile(f)
+	if fi.Flags&protocol.FlagInvalid == 0 {
+		t.Error("Invalid flag not set")
+	}
+	if r := protocol.InvalidReason(fi.Flags); r != protocol.InvalidReasonUnreadable {
+		t.Errorf("Incorrect reason %d on the wire", r)
+	}
+
+	f2 := fileFromFileInfo(fi)
+	if !f2.Invalid || f2.InvalidReason != protocol.InvalidReasonUnreadable {
+		t.Errorf("Incorrect invalid state after roundtrip: %v %d", f2.Invalid, f2.InvalidReason)
+	}
+	if f2.Flags != 0644 {
+		t.Errorf("Flags should not contain invalid bits: %o", f2.Flags)
+	}
+}
+
+var blockTestcases = []struct {
+	sizes []uint32
+	err   error
+}{
+	{nil, nil},
+	{[]uint32{0}, nil},
+	{[]uint32{100}, nil},
+	{[]uint32{BlockSize}, nil},
+	{[]uint32{BlockSize, BlockSize, 1}, nil},
+	{[]uint32{BlockSize + 1}, errBlockTooLarge},
+	{[]uint32{BlockSize, 2 * BlockSize}, errBlockTooLarge},
+	{[]uint32{100, BlockSize}, errShortBlock},
+	{[]uint32{BlockSize, 100, 100}, errShortBlock},
+	{[]uint32{BlockSize, 0}, errEmptyBlock},
+	{[]uint32{0, 0}, errShortBlock},
+}
+
+func TestVerifyBlocks(t *testing.T) {
+	for i, tc := range blockTestcases {
+		var f protocol.FileInfo
+		for _, s := range tc.sizes {
+			f.Blocks = append(f.Blocks, protocol.BlockInfo{Size: s})
+		}
+		if err := verifyBlocks(f); err != tc.err {
+			t.Errorf("%d: unexpected error %v != %v", i, err, tc.err)
+		}
+	}
+}
+
+func TestLargeFileArithmetic(t *testing.T) {
+	// Block metadata for a file a bit over 5 GiB, without the data
+	const size = 5<<30 + 1000
+	const nblocks = size/BlockSize + 1
+	var blocks []protocol.BlockInfo
+	for i := 0; i < nblocks; i++ {
+		b := protocol.BlockInfo{Size: BlockSize, Hash: make([]byte, 32)}
+		if i == nblocks-1 {
+			b.Size = size % BlockSize
+		}
+		binary.BigEndian.PutUint32(b.Hash, uint32(i))
+		blocks = append(blocks, b)
+	}
+	fi := protocol.FileInfo{Name: "large", Flags: 0644, Modified: 1234567890, Version: 1000, Blocks: blocks}
+
+	if s := fi.Size(); s != size {
+		t.Errorf("Incorrect size %d != %d", s, int64(size))
+	}
+	if err := verifyBlocks(fi); err != nil {
+		t.Error(err)
+	}
+
+	// Index round trip
+	var buf bytes.Buffer
+	if _, err := (protocol.IndexMessage{Repository: "default", Files: []protocol.FileInfo{fi}}).EncodeXDR(&buf); err != nil {
+		t.Fatal(err)
+	}
+	var im protocol.IndexMessage
+	if err := im.DecodeXDR(&buf); err != nil {
+		t.Fatal(err)
+	}
+	if len(im.Files) != 1 || im.Files[0].Size() != size {
+		t.Fatalf("Incorrect index after round trip")
+	}
+
+	f := fileFromFileInfo(im.Files[0])
+	if f.Size != size {
+		t.Errorf("Incorrect file size %d != %d", f.Size, int64(size))
+	}
+	last := f.Blocks[nblocks-1]
+	if exp := int64(size - size%BlockSize); last.Offset != exp {
+		t.Errorf("Incorrect last block offset %d != %d", last.Offset, exp)
+	}
+
+	// The local version differs in the last two blocks
+	lf := f
+	lf.Blocks = append([]scanner.Block{}, f.Blocks...)
+	for _, i := range []int{nblocks - 2, nblocks - 1} {
+		lf.Blocks[i].Hash = make([]byte, 32)
+	}
+	have, need := scanner.BlockDiff(lf.Blocks, f.Blocks)
+	if len(have) != nblocks-2 || len(need) != 2 {
+		t.Fatalf("Incorrect block diff; %d have, %d need", len(have), len(need))
+	}
+	if exp := int64(nblocks-2) * BlockSize; need[0].Offset != exp {
+		t.Errorf("Incorrect needed block offset %d != %d", need[0].Offset, exp)
+	}
+
+	// Pull planning
+	bq := newBlockQueue()
+	bq.put(bqAdd{file: f, have: have, need: need})
+	if b := bq.get(); len(b.copy) != nblocks-2 || b.copy[len(b.copy)-1].Offset != need[0].Offset-BlockSize {
+		t.Errorf("Incorrect copy block")
+	}
+	for i := range need {
+		b := bq.get()
+		if b.block.Offset != need[i].Offset || b.block.Size != need[i].Size || b.last != (i == len(need)-1) {
+			t.Errorf("Incorrect queued block %d; offset %d size %d last %v", i, b.block.Offset, b.block.Size, b.last)
+		}
+	}
+
+	// Need computation
+	m := NewModel(1e6)
+	m.AddRepo("default", "testdata", []NodeConfiguration{{NodeID: "42"}})
+	m.Index("42", "default", []protocol.FileInfo{fi})
+	if files, bytes := m.NeedSize("default"); files != 1 || bytes != size {
+		t.Errorf("Incorrect need size %d, %d != 1, %d", files, bytes, int64(size))
+	}
+	if _, _, bytes := m.GlobalSize("default"); bytes != size {
+		t.Errorf("Incorrect global size %d != %d", bytes, int64(size))
+	}
+}
+
+func TestSafePath(t *testing.T) {
+	dir := filepath.Join(string(os.PathSeparator), "repo")
+	var cases = []struct {
+		name string
+		safe bool
+	}{
+		{"file", true},
+		{filepath.Join("dir", "file"), true},
+		{filepath.Join("dir", "..", "file"), true},
+		{"..file", true},
+		{"..", false},
+		{filepath.Join("..", "file"), false},
+		{filepath.Join("dir", "..", "..", "file"), false},
+		{filepath.Join(string(os.PathSeparator), "etc", "passwd"), false},
+	}
+	for _, tc := range cases {
+		path, err := safePath(dir, tc.name)
+		if tc.safe && (err != nil || path != filepath.Join(dir, tc.name)) {
+			t.Errorf("%q: unexpected %q, %v", tc.name, path, err)
+		}
+		if !tc.safe && err != ErrUnsafePath {
+			t.Errorf("%q: incorrect error %v for unsafe name", tc.name, err)
+		}
+	}
+}
+
+func TestCanonicalNames(t *testing.T) {
+	var cases = []struct {
+		name    string // as sent, with slashes
+		flags   uint32
+		version uint64
+		result  string // with native separators; empty if rejected
+	}{
+		{"foo", 0644, 1001, "foo"},
+		{"./foo", 0644, 1003, "foo"},
+		{"foo//", 0644, 1004, ""},
+		{"./bar", 0644, 1000, "bar"},
+		{"bar", 0644, 1001, "bar"},
+		{"dir/", protocol.FlagDirectory | 0755, 1000, "dir"},
+		{"./dir/./sub", 0644, 1000, filepath.Join("dir", "sub")},
+		{"dir//other", 0644, 1000, filepath.Join("dir", "other")},
+		{"dir/../up", 0644, 1000, "up"},
+		{".", protocol.FlagDirectory | 0755, 1000, ""},
+		{"", 0644, 1000, ""},
+		{"../escape", 0644, 1000, ""},
+		{"dir/../../escape", 0644, 1000, ""},
+		{"/abs", 0644, 1000, ""},
+	}
+
+	var fs []protocol.FileInfo
+	var expected = make(map[string]uint64)
+	var invalid = make(map[string]bool)
+	var rejected int
+	for _, tc := range cases {
+		fs = append(fs, protocol.FileInfo{Name: tc.name, Flags: tc.flags, Modified: 1234567890, Version: tc.version})
+
+		isDir := tc.flags&protocol.FlagDirectory != 0
+		name, err := canonicalName(filepath.FromSlash(tc.name), isDir)
+		if tc.result == "" {
+			rejected++
+			if err == nil {
+				t.Errorf("%q: unexpected %q", tc.name, name)
+			}
+			// Kept as invalid under the name as sent.
+			expected[filepath.FromSlash(tc.name)] = tc.version
+			invalid[filepath.FromSlash(tc.name)] = true
+			continue
+		}
+		if err != nil || name != tc.result {
+			t.Errorf("%q: incorrect %q, %v != %q", tc.name, name, err, tc.result)
+		}
+		if tc.version > expected[tc.result] {
+			expected[tc.result] = tc.version
+		}
+	}
+
+	m := NewModel(1e6)
+	m.AddRepo("default", "testdata", []NodeConfiguration{{NodeID: "42"}})
+	fc := FakeConnection{id: "42"}
+	m.AddConnection(fc, fc)
+	m.Index("42", "default", fs)
+
+	global := m.repoFiles["default"].Global()
+	if len(global) != len(expected) {
+		t.Errorf("Incorrect global files %v", global)
+	}
+	for _, f := range global {
+		if v, ok := expected[f.Name]; !ok || f.Version != v || f.Invalid != invalid[f.Name] {
+			t.Errorf("Unexpected global file %v", f)
+		}
+	}
+	if n := m.ConnectionStats()["42"].RejectedFiles; n != rejected {
+		t.Errorf("Incorrect number of rejected files %d != %d", n, rejected)
+	}
+}
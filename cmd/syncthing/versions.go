@@ -0,0 +1,226 @@
+package main
+
+import (
+	"errors"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/calmh/syncthing/vfs"
+)
+
+// The directory, at the top of each repository, holding old versions of
+// files replaced or deleted by the puller. It is an internal path while
+// versioning is enabled, and ordinary repository contents otherwise.
+const versionsDir = ".stversions"
+
+// The format of the time stamp appended to the names of old versions.
+const versionTimeFormat = "20060102-150405"
+
+var ErrNoSuchVersion = errors.New("no such version")
+
+// VersionInfo describes an old version of a file kept in the versions
+// directory. Versions are told apart by the modification time of the file
+// they were taken from and, among those of the same time, by a sequence
+// number counting from zero.
+type VersionInfo struct {
+	Time time.Time `json:"time"`
+	Seq  int       `json:"seq"`
+	Size int64     `json:"size"`
+}
+
+type versionList []VersionInfo
+
+func (l versionList) Len() int      { return len(l) }
+func (l versionList) Swap(a, b int) { l[a], l[b] = l[b], l[a] }
+func (l versionList) Less(a, b int) bool {
+	if !l[a].Time.Equal(l[b].Time) {
+		return l[a].Time.Before(l[b].Time)
+	}
+	return l[a].Seq < l[b].Seq
+}
+
+// SetKeepVersions sets the number of old versions kept of each file when the
+// puller replaces or deletes it. They are kept below the versions directory
+// at the top of the repository, which is an internal path only while
+// versioning is enabled. Zero, the default, disables versioning.
+func (m *Model) SetKeepVersions(n int) {
+	m.rmut.Lock()
+	m.keepVers = n
+	var internal []string
+	for _, p := range m.internal {
+		if p != versionsDir {
+			internal = append(internal, p)
+		}
+	}
+	if n > 0 {
+		internal = append(internal, versionsDir)
+	}
+	m.internal = internal
+	for _, rf := range m.repoFiles {
+		m.setAnnounced(rf)
+	}
+	m.rmut.Unlock()
+}
+
+func (m *Model) keepVersions() int {
+	m.rmut.RLock()
+	defer m.rmut.RUnlock()
+	return m.keepVers
+}
+
+// Versions returns the old versions kept of the file in the repository,
+// oldest first. There are none while versioning is disabled, as the
+// versions directory then belongs to the repository.
+func (m *Model) Versions(repo, name string) []VersionInfo {
+	m.rmut.RLock()
+	dir, ok := m.repoDirs[repo]
+	keep := m.keepVers
+	m.rmut.RUnlock()
+	if !ok || keep == 0 {
+		return nil
+	}
+	name, err := canonicalName(name, false)
+	if err != nil {
+		return nil
+	}
+	return listVersions(m.fs, dir, name)
+}
+
+// RestoreVersion puts the old version of the file with the given time and
+// sequence number back in place, keeping the current file as a version in
+// turn. The restored file is rehashed, so that it gets a new version and is
+// announced to the cluster like a local change.
+func (m *Model) RestoreVersion(repo, name string, version time.Time, seq int) error {
+	m.rmut.RLock()
+	dir, ok := m.repoDirs[repo]
+	keep := m.keepVers
+	m.rmut.RUnlock()
+	if !ok || keep == 0 {
+		return ErrNoSuchVersion
+	}
+	name, err := canonicalName(name, false)
+	if err != nil {
+		return err
+	}
+	path := filepath.Join(dir, name)
+
+	src := filepath.Join(dir, versionsDir, versionName(name, version, seq))
+	if info, err := m.fs.Lstat(src); err != nil || !info.Mode().IsRegular() {
+		return ErrNoSuchVersion
+	}
+
+	// The version is moved aside first, so that the current file can be
+	// archived before the version is put in its place.
+	temp := defTempNamer.TempName(path)
+	if err := m.fs.MkdirAll(filepath.Dir(path), 0755); err != nil {
+		return err
+	}
+	if err := m.fs.Rename(src, temp); err != nil {
+		return err
+	}
+	if err := archiveVersion(m.fs, dir, name, path); err != nil && !os.IsNotExist(err) {
+		m.fs.Rename(temp, src)
+		return err
+	}
+	if err := m.fs.Rename(temp, path); err != nil {
+		m.fs.Rename(temp, src)
+		return err
+	}
+	pruneVersions(m.fs, dir, name, keep)
+
+	infof("Restored version %s of %q in repository %q", version.UTC().Format(versionTimeFormat), name, repo)
+	return m.ForceRehash(repo, name)
+}
+
+// versionName returns the name, relative to the versions directory, of the
+// version of the file with the given modification time and sequence number.
+// The sequence number is left out when zero.
+func versionName(name string, t time.Time, seq int) string {
+	vn := name + "~" + t.UTC().Format(versionTimeFormat)
+	if seq > 0 {
+		vn += "." + strconv.Itoa(seq)
+	}
+	return vn
+}
+
+// parseVersion returns the time and sequence number of the version name
+// suffix, as written by versionName.
+func parseVersion(s string) (time.Time, int, bool) {
+	ts, seq := s, 0
+	if i := strings.IndexByte(s, '.'); i >= 0 {
+		n, err := strconv.Atoi(s[i+1:])
+		if err != nil || n <= 0 || strconv.Itoa(n) != s[i+1:] {
+			return time.Time{}, 0, false
+		}
+		ts, seq = s[:i], n
+	}
+	t, err := time.Parse(versionTimeFormat, ts)
+	if err != nil {
+		return time.Time{}, 0, false
+	}
+	return t, seq, true
+}
+
+// archiveVersion moves the file at path, holding the current contents of
+// name, into the versions directory, under the first free sequence number
+// for its modification time. Anything but a regular file is removed
+// instead.
+func archiveVersion(fs vfs.FS, dir, name, path string) error {
+	info, err := fs.Lstat(path)
+	if err != nil {
+		return err
+	}
+	if !info.Mode().IsRegular() {
+		return fs.Remove(path)
+	}
+	for seq := 0; ; seq++ {
+		dst := filepath.Join(dir, versionsDir, versionName(name, info.ModTime(), seq))
+		if _, err := fs.Lstat(dst); err == nil {
+			continue
+		} else if !os.IsNotExist(err) {
+			return err
+		}
+		if err := fs.MkdirAll(filepath.Dir(dst), 0755); err != nil {
+			return err
+		}
+		return fs.Rename(path, dst)
+	}
+}
+
+// pruneVersions removes the oldest versions of name beyond the number kept.
+func pruneVersions(fs vfs.FS, dir, name string, keep int) {
+	vs := listVersions(fs, dir, name)
+	for ; len(vs) > keep; vs = vs[1:] {
+		path := filepath.Join(dir, versionsDir, versionName(name, vs[0].Time, vs[0].Seq))
+		if err := fs.Remove(path); err != nil && debugPull {
+			dlog.Printf("pull: error: removing version %q: %v", path, err)
+		}
+	}
+}
+
+func listVersions(fs vfs.FS, dir, name string) []VersionInfo {
+	vdir, base := filepath.Split(filepath.Join(dir, versionsDir, name))
+	infos, err := fs.ReadDir(vdir)
+	if err != nil {
+		return nil
+	}
+
+	var vs []VersionInfo
+	for _, info := range infos {
+		n := info.Name()
+		if !info.Mode().IsRegular() || !strings.HasPrefix(n, base+"~") {
+			continue
+		}
+		t, seq, ok := parseVersion(n[len(base)+1:])
+		if !ok {
+			continue
+		}
+		vs = append(vs, VersionInfo{Time: t, Seq: seq, Size: info.Size()})
+	}
+	sort.Sort(versionList(vs))
+	return vs
+}
@@ -0,0 +1,163 @@
+// Package events provides a simple event log with subscriptions.
+package events
+
+import (
+	"errors"
+	"sync"
+	"time"
+)
+
+type EventType uint64
+
+const (
+	FileQuarantined EventType = 1 << iota
+	PullRoundCompleted
+	DuplicateNodeSuspected
+	FileStuckInvalid
+	PlaceholderDetected
+	DeletesHeld
+	ChangesConverged
+	DiskSpaceLow
+	LocalFileChanged
+	FilePulled
+
+	AllEvents = ^EventType(0)
+)
+
+func (t EventType) String() string {
+	switch t {
+	case FileQuarantined:
+		return "FileQuarantined"
+	case PullRoundCompleted:
+		return "PullRoundCompleted"
+	case DuplicateNodeSuspected:
+		return "DuplicateNodeSuspected"
+	case FileStuckInvalid:
+		return "FileStuckInvalid"
+	case PlaceholderDetected:
+		return "PlaceholderDetected"
+	case DeletesHeld:
+		return "DeletesHeld"
+	case ChangesConverged:
+		return "ChangesConverged"
+	case DiskSpaceLow:
+		return "DiskSpaceLow"
+	case LocalFileChanged:
+		return "LocalFileChanged"
+	case FilePulled:
+		return "FilePulled"
+	default:
+		return "Unknown"
+	}
+}
+
+func (t EventType) MarshalText() ([]byte, error) {
+	return []byte(t.String()), nil
+}
+
+// The number of events buffered per subscription. Events logged while the
+// buffer is full are dropped for that subscription.
+const BufferSize = 64
+
+type Event struct {
+	ID   int         `json:"id"`
+	Time time.Time   `json:"time"`
+	Type EventType   `json:"type"`
+	Data interface{} `json:"data"`
+}
+
+type Logger struct {
+	subs   map[int]*Subscription
+	nextID int
+	mutex  sync.Mutex
+}
+
+type Subscription struct {
+	mask   EventType
+	accept func(Event) bool
+	id     int
+	events chan Event
+}
+
+var Default = NewLogger()
+
+var (
+	ErrTimeout = errors.New("timeout")
+	ErrClosed  = errors.New("closed")
+)
+
+func NewLogger() *Logger {
+	return &Logger{
+		subs: make(map[int]*Subscription),
+	}
+}
+
+// Log sends an event of the given type to all subscriptions interested in
+// it. It never blocks.
+func (l *Logger) Log(t EventType, data interface{}) {
+	l.mutex.Lock()
+	e := Event{
+		ID:   l.nextID,
+		Time: time.Now(),
+		Type: t,
+		Data: data,
+	}
+	l.nextID++
+	for _, s := range l.subs {
+		if s.mask&t != 0 && (s.accept == nil || s.accept(e)) {
+			select {
+			case s.events <- e:
+			default:
+				// The subscriber is not keeping up; drop the event.
+			}
+		}
+	}
+	l.mutex.Unlock()
+}
+
+// Subscribe returns a subscription for the event types set in mask.
+func (l *Logger) Subscribe(mask EventType) *Subscription {
+	return l.SubscribeFunc(mask, nil)
+}
+
+// SubscribeFunc returns a subscription for the events of the types set in
+// mask that accept returns true for, or all of them if accept is nil.
+// accept is called with the logger locked, so it must be quick and must
+// not log events itself.
+func (l *Logger) SubscribeFunc(mask EventType, accept func(Event) bool) *Subscription {
+	l.mutex.Lock()
+	s := &Subscription{
+		mask:   mask,
+		accept: accept,
+		id:     l.nextID,
+		events: make(chan Event, BufferSize),
+	}
+	l.nextID++
+	l.subs[s.id] = s
+	l.mutex.Unlock()
+	return s
+}
+
+// Unsubscribe removes the subscription. Pending and future calls to Poll
+// return ErrClosed.
+func (l *Logger) Unsubscribe(s *Subscription) {
+	l.mutex.Lock()
+	if _, ok := l.subs[s.id]; ok {
+		delete(l.subs, s.id)
+		close(s.events)
+	}
+	l.mutex.Unlock()
+}
+
+// Poll returns the next event, waiting at most timeout for one to arrive.
+func (s *Subscription) Poll(timeout time.Duration) (Event, error) {
+	select {
+	case e, ok := <-s.events:
+		if !ok {
+			return e, ErrClosed
+		}
+		return e, nil
+	case <-time.After(timeout):
+		return Event{}, ErrTimeout
+	}
+}
@@ -0,0 +1,106 @@
+package events
+
+import (
+	"testing"
+	"time"
+)
+
+const timeout = 100 * time.Millisecond
+
+func TestSubscribePoll(t *testing.T) {
+	l := NewLogger()
+	s := l.Subscribe(FileQuarantined)
+	defer l.Unsubscribe(s)
+
+	l.Log(FileQuarantined, "foo")
+
+	e, err := s.Poll(timeout)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if e.Type != FileQuarantined {
+		t.Errorf("Incorrect event type %v", e.Type)
+	}
+	if e.Data != "foo" {
+		t.Errorf("Incorrect event data %v", e.Data)
+	}
+}
+
+func TestPollTimeout(t *testing.T) {
+	l := NewLogger()
+	s := l.Subscribe(AllEvents)
+	defer l.Unsubscribe(s)
+
+	if _, err := s.Poll(timeout); err != ErrTimeout {
+		t.Errorf("Unexpected non-timeout error %v", err)
+	}
+}
+
+func TestSubscriptionMask(t *testing.T) {
+	l := NewLogger()
+	s := l.Subscribe(0)
+	defer l.Unsubscribe(s)
+
+	l.Log(FileQuarantined, nil)
+
+	if _, err := s.Poll(timeout); err != ErrTimeout {
+		t.Errorf("Unexpected event for unsubscribed type; err %v", err)
+	}
+}
+
+func TestSubscribeFunc(t *testing.T) {
+	l := NewLogger()
+	s := l.SubscribeFunc(AllEvents, func(e Event) bool {
+		return e.Data == "foo"
+	})
+	defer l.Unsubscribe(s)
+
+	l.Log(FileQuarantined, "bar")
+	l.Log(FileQuarantined, "foo")
+
+	e, err := s.Poll(timeout)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if e.Data != "foo" {
+		t.Errorf("Incorrect event data %v", e.Data)
+	}
+	if _, err := s.Poll(timeout); err != ErrTimeout {
+		t.Errorf("Unexpected event not accepted; err %v", err)
+	}
+}
+
+func TestUnsubscribe(t *testing.T) {
+	l := NewLogger()
+	s := l.Subscribe(AllEvents)
+	l.Unsubscribe(s)
+
+	l.Log(FileQuarantined, nil)
+
+	if _, err := s.Poll(timeout); err != ErrClosed {
+		t.Errorf("Unexpected non-closed error %v", err)
+	}
+}
+
+func TestBufferOverflow(t *testing.T) {
+	l := NewLogger()
+	s := l.Subscribe(AllEvents)
+	defer l.Unsubscribe(s)
+
+	for i := 0; i < 2*BufferSize; i++ {
+		l.Log(FileQuarantined, i)
+	}
+
+	for i := 0; i < BufferSize; i++ {
+		e, err := s.Poll(timeout)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if e.Data != i {
+			t.Errorf("Incorrect event data %v != %d", e.Data, i)
+		}
+	}
+	if _, err := s.Poll(timeout); err != ErrTimeout {
+		t.Errorf("Unexpected event after overflow; err %v", err)
+	}
+}
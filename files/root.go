@@ -0,0 +1,185 @@
+package files
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/binary"
+	"sort"
+
+	"github.com/calmh/syncthing/scanner"
+)
+
+// A rootHash is a node of the Merkle tree summarizing a list of files, the
+// root of which is its root hash.
+type rootHash [sha256.Size]byte
+
+// A rootLeaf is the leaf of a file, with the name it is announced as, which
+// the leaves are sorted by.
+type rootLeaf struct {
+	name string
+	hash rootHash
+}
+
+// A cachedRoot is a root hash computed for a generation of the files.
+type cachedRoot struct {
+	gen  uint64
+	ok   bool
+	root rootHash
+}
+
+// leafHash hashes the announced name, version and block hashes of the file.
+func leafHash(name string, f scanner.File) rootHash {
+	h := sha256.New()
+	h.Write([]byte{0}) // a leaf
+	h.Write([]byte(name))
+	var v [9]byte // a zero byte to end the name, then the version
+	binary.BigEndian.PutUint64(v[1:], f.Version)
+	h.Write(v[:])
+	for _, b := range f.Blocks {
+		h.Write(b.Hash)
+	}
+	var r rootHash
+	h.Sum(r[:0])
+	return r
+}
+
+type rootLeafList []rootLeaf
+
+func (l rootLeafList) Len() int      { return len(l) }
+func (l rootLeafList) Swap(a, b int) { l[a], l[b] = l[b], l[a] }
+func (l rootLeafList) Less(a, b int) bool {
+	if l[a].name != l[b].name {
+		return l[a].name < l[b].name
+	}
+	return bytes.Compare(l[a].hash[:], l[b].hash[:]) < 0
+}
+
+// merkleRoot returns the root of the Merkle tree over the leaves sorted by
+// name. Each inner node hashes its two children; a node without a sibling
+// moves up a level as it is. The root of no leaves is all zeros.
+func merkleRoot(leaves []rootLeaf) rootHash {
+	if len(leaves) == 0 {
+		return rootHash{}
+	}
+	sort.Sort(rootLeafList(leaves))
+	level := make([]rootHash, len(leaves))
+	for i, l := range leaves {
+		level[i] = l.hash
+	}
+	for len(level) > 1 {
+		next := level[:0]
+		for i := 0; i < len(level); i += 2 {
+			if i+1 == len(level) {
+				next = append(next, level[i])
+				continue
+			}
+			h := sha256.New()
+			h.Write([]byte{1}) // an inner node
+			h.Write(level[i][:])
+			h.Write(level[i+1][:])
+			var r rootHash
+			h.Sum(r[:0])
+			next = append(next, r)
+		}
+		level = next
+	}
+	return level[0]
+}
+
+// SetAnnounced sets how the names of the files are announced to other nodes,
+// which is what the roots are computed over. The function returns the
+// announced name of a file, or false if the file isn't announced at all. By
+// default all files are announced under their own names.
+func (m *Set) SetAnnounced(fn func(name string) (string, bool)) {
+	m.Lock()
+	defer m.Unlock()
+	m.announce = fn
+	for k, r := range m.files {
+		m.setLeaf(&r)
+		m.files[k] = r
+	}
+	for i := range m.rootGen {
+		m.rootGen[i]++
+	}
+	m.globalGen++
+}
+
+// setLeaf sets the leaf hash of the file record.
+func (m *Set) setLeaf(r *fileRecord) {
+	name, ok := r.File.Name, true
+	if m.announce != nil {
+		name, ok = m.announce(name)
+	}
+	r.Announced = ok
+	r.Leaf = rootLeaf{}
+	if ok {
+		r.Leaf = rootLeaf{name, leafHash(name, r.File)}
+	}
+}
+
+// rootOf returns the root of the announced files with the given keys.
+func (m *Set) rootOf(keys map[string]key) rootHash {
+	leaves := make([]rootLeaf, 0, len(keys))
+	for _, k := range keys {
+		if r := m.files[k]; r.Announced {
+			leaves = append(leaves, r.Leaf)
+		}
+	}
+	return merkleRoot(leaves)
+}
+
+// Root returns the Merkle root of the files announced by the connection ID,
+// sorted by announced name. Sets with the same files announced by the ID,
+// down to the versions and block hashes, have the same root. The root is
+// recomputed only when the files have changed.
+func (m *Set) Root(id uint) []byte {
+	m.Lock()
+	defer m.Unlock()
+	c := &m.rootCache[id]
+	if !c.ok || c.gen != m.rootGen[id] {
+		*c = cachedRoot{m.rootGen[id], true, m.rootOf(m.remoteKey[id])}
+	}
+	r := c.root
+	return r[:]
+}
+
+// GlobalRoot returns the Merkle root of the global view of the files, as
+// Root does of the files announced by one connection ID.
+func (m *Set) GlobalRoot() []byte {
+	m.Lock()
+	defer m.Unlock()
+	c := &m.globalCache
+	if !c.ok || c.gen != m.globalGen {
+		*c = cachedRoot{m.globalGen, true, m.rootOf(m.globalKey)}
+	}
+	r := c.root
+	return r[:]
+}
+
+// setGlobal makes the file with the given key the global version of the
+// name.
+func (m *Set) setGlobal(n string, k key) {
+	if gk, ok := m.globalKey[n]; !ok || gk != k {
+		m.globalGen++
+	}
+	m.globalKey[n] = k
+}
+
+// clearGlobal removes the name from the global view.
+func (m *Set) clearGlobal(n string) {
+	if _, ok := m.globalKey[n]; ok {
+		m.globalGen++
+	}
+	delete(m.globalKey, n)
+}
+
+// remove removes the file from those announced by the connection ID.
+func (m *Set) remove(id uint, n string) {
+	k, ok := m.remoteKey[id][n]
+	if !ok {
+		return
+	}
+	m.rootGen[id]++
+	m.release(k)
+	delete(m.remoteKey[id], n)
+}
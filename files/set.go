@@ -2,6 +2,7 @@
 package files
 
 import (
+	"sort"
 	"sync"
 
 	"github.com/calmh/syncthing/cid"
@@ -11,13 +12,21 @@ import (
 )
 
 type fileRecord struct {
-	File   scanner.File
-	Usage  int
-	Global bool
+	File      scanner.File
+	Usage     int
+	Global    bool
+	Announced bool     // the file is announced to other nodes
+	Leaf      rootLeaf // see leafHash
 }
 
 type bitset uint64
 
+// A seqName is the sequence number given to a local file when it changed.
+type seqName struct {
+	seq  int64
+	name string
+}
+
 type Set struct {
 	sync.Mutex
 	files              map[key]fileRecord
@@ -25,6 +34,14 @@ type Set struct {
 	changes            [64]uint64
 	globalAvailability map[string]bitset
 	globalKey          map[string]key
+	rootGen            [64]uint64 // increased when the files announced by the ID change
+	rootCache          [64]cachedRoot
+	globalGen          uint64 // increased when the global view changes
+	globalCache        cachedRoot
+	announce           func(name string) (string, bool) // see SetAnnounced
+	localVersion       int64                            // the highest sequence number given to a local file
+	localSeq           map[string]int64                 // name -> sequence number of the local file
+	localOrder         []seqName                        // by sequence number; stale if superseded in localSeq
 }
 
 func NewSet() *Set {
@@ -32,6 +49,7 @@ func NewSet() *Set {
 		files:              make(map[key]fileRecord),
 		globalAvailability: make(map[string]bitset),
 		globalKey:          make(map[string]key),
+		localSeq:           make(map[string]int64),
 	}
 	return &m
 }
@@ -45,9 +63,8 @@ func (m *Set) Replace(id uint, fs []scanner.File) {
 	}
 
 	m.Lock()
-	if len(fs) == 0 || !m.equals(id, fs) {
+	if (len(fs) == 0 || !m.equals(id, fs)) && m.replace(id, fs) {
 		m.changes[id]++
-		m.replace(id, fs)
 	}
 	m.Unlock()
 }
@@ -62,8 +79,6 @@ func (m *Set) ReplaceWithDelete(id uint, fs []scanner.File) {
 
 	m.Lock()
 	if len(fs) == 0 || !m.equals(id, fs) {
-		m.changes[id]++
-
 		var nf = make(map[string]key, len(fs))
 		for _, f := range fs {
 			nf[f.Name] = keyFor(f)
@@ -89,8 +104,28 @@ func (m *Set) ReplaceWithDelete(id uint, fs []scanner.File) {
 			}
 		}
 
-		m.replace(id, fs)
+		if m.replace(id, fs) {
+			m.changes[id]++
+		}
+	}
+	m.Unlock()
+}
+
+// Drop removes all files announced by the given connection IDs. The global
+// view is recalculated once, regardless of the number of IDs given.
+func (m *Set) Drop(ids []uint) {
+	if debug {
+		dlog.Printf("Drop(%v)", ids)
+	}
+	m.Lock()
+	for _, id := range ids {
+		if id > 63 {
+			panic("Connection ID must be in the range 0 - 63 inclusive")
+		}
+		m.changes[id]++
+		m.clearRemote(id)
 	}
+	m.recalcGlobal()
 	m.Unlock()
 }
 
@@ -99,7 +134,18 @@ func (m *Set) Update(id uint, fs []scanner.File) {
 		dlog.Printf("Update(%d, [%d])", id, len(fs))
 	}
 	m.Lock()
+	var changed []string
+	if id == cid.LocalID {
+		for _, f := range fs {
+			if k, ok := m.remoteKey[id][f.Name]; !ok || k != keyFor(f) {
+				changed = append(changed, f.Name)
+			}
+		}
+	}
 	m.update(id, fs)
+	for _, n := range changed {
+		m.nextSeq(n)
+	}
 	m.changes[id]++
 	m.Unlock()
 }
@@ -117,6 +163,15 @@ func (m *Set) Need(id uint) []scanner.File {
 		}
 
 		file := gf.File
+		if file.Flags&protocol.FlagDeleted != 0 {
+			if _, ok := rkID[gk.Name]; !ok {
+				// Deleting a file the node has never had, or has already
+				// expired the tombstone for, is a no-op. Not needing it
+				// keeps expired tombstones from coming back from nodes
+				// that haven't expired theirs yet.
+				continue
+			}
+		}
 		switch {
 		case file.Flags&protocol.FlagDirectory == 0 && gk.newerThan(rkID[gk.Name]):
 			fs = append(fs, file)
@@ -128,6 +183,43 @@ func (m *Set) Need(id uint) []scanner.File {
 	return fs
 }
 
+// ExpireDeleted removes the local entries for the named files, provided
+// they are deleted and each of the given remotes announces the identical
+// tombstone. A remote without an entry may simply not have announced its
+// index yet. Returns the names of the removed entries.
+func (m *Set) ExpireDeleted(names []string, remotes []uint) []string {
+	if debug {
+		dlog.Printf("ExpireDeleted([%d], %v)", len(names), remotes)
+	}
+	m.Lock()
+	defer m.Unlock()
+
+	var expired []string
+	local := m.remoteKey[cid.LocalID]
+nextName:
+	for _, n := range names {
+		lk, ok := local[n]
+		if !ok || m.files[lk].File.Flags&protocol.FlagDeleted == 0 {
+			continue
+		}
+		for _, id := range remotes {
+			if rk, ok := m.remoteKey[id][n]; !ok || rk != lk {
+				continue nextName
+			}
+		}
+
+		m.remove(cid.LocalID, n)
+		m.forgetSeq(n)
+		m.recalcGlobalFile(n)
+		expired = append(expired, n)
+	}
+
+	if len(expired) > 0 {
+		m.changes[cid.LocalID]++
+	}
+	return expired
+}
+
 func (m *Set) Have(id uint) []scanner.File {
 	if debug {
 		dlog.Printf("Have(%d)", id)
@@ -214,11 +306,16 @@ func (m *Set) equals(id uint, fs []scanner.File) bool {
 
 func (m *Set) update(cid uint, fs []scanner.File) {
 	remFiles := m.remoteKey[cid]
+	if remFiles == nil {
+		remFiles = make(map[string]key)
+		m.remoteKey[cid] = remFiles
+	}
 	for _, f := range fs {
 		n := f.Name
 		fk := keyFor(f)
 
-		if ck, ok := remFiles[n]; ok && ck == fk {
+		ck, had := remFiles[n]
+		if had && ck == fk {
 			// The remote already has exactly this file, skip it
 			continue
 		}
@@ -227,14 +324,17 @@ func (m *Set) update(cid uint, fs []scanner.File) {
 
 		// Keep the block list or increment the usage
 		if br, ok := m.files[fk]; !ok {
-			m.files[fk] = fileRecord{
+			br = fileRecord{
 				Usage: 1,
 				File:  f,
 			}
+			m.setLeaf(&br)
+			m.files[fk] = br
 		} else {
 			br.Usage++
 			m.files[fk] = br
 		}
+		m.rootGen[cid]++
 
 		// Update global view
 		gk, ok := m.globalKey[n]
@@ -252,57 +352,241 @@ func (m *Set) update(cid uint, fs []scanner.File) {
 			f := m.files[fk]
 			f.Global = true
 			m.files[fk] = f
-			m.globalKey[n] = fk
+			m.setGlobal(n, fk)
 			m.globalAvailability[n] = 1 << cid
 		}
 	}
 }
 
-func (m *Set) replace(cid uint, fs []scanner.File) {
-	// Decrement usage for all files belonging to this remote, and remove
-	// those that are no longer needed.
-	for _, fk := range m.remoteKey[cid] {
-		br, ok := m.files[fk]
-		switch {
-		case ok && br.Usage == 1:
-			delete(m.files, fk)
-		case ok && br.Usage > 1:
-			br.Usage--
-			m.files[fk] = br
+// replace makes fs the complete list of files announced by the remote.
+// Only the entries that differ from what the remote announced before are
+// touched, so replacing a large index with a mostly unchanged one is cheap.
+// Returns true if anything changed.
+func (m *Set) replace(id uint, fs []scanner.File) bool {
+	rem := m.remoteKey[id]
+	if rem == nil {
+		rem = make(map[string]key)
+		m.remoteKey[id] = rem
+	}
+
+	var present = make(map[string]bool, len(fs))
+	var changed []scanner.File
+	for _, f := range fs {
+		present[f.Name] = true
+		if k, ok := rem[f.Name]; !ok || k != keyFor(f) {
+			changed = append(changed, f)
+		}
+	}
+	var removed []string
+	for n := range rem {
+		if !present[n] {
+			removed = append(removed, n)
+		}
+	}
+	if len(changed) == 0 && len(removed) == 0 {
+		return false
+	}
+
+	for _, n := range removed {
+		m.remove(id, n)
+		m.recalcGlobalFile(n)
+		if id == cid.LocalID {
+			m.forgetSeq(n)
 		}
 	}
 
+	for _, f := range changed {
+		m.remove(id, f.Name)
+	}
+	m.update(id, changed)
+	for _, f := range changed {
+		// The new version may be older than the one it replaces, which
+		// may have been the global one.
+		m.recalcGlobalFile(f.Name)
+	}
+
+	if id == cid.LocalID {
+		// Changes in the same replace are numbered in name order.
+		var names = make([]string, len(changed))
+		for i, f := range changed {
+			names[i] = f.Name
+		}
+		sort.Strings(names)
+		for _, n := range names {
+			m.nextSeq(n)
+		}
+	}
+	return true
+}
+
+// release decrements the usage of the file, removing it once it is no
+// longer used.
+func (m *Set) release(fk key) {
+	br, ok := m.files[fk]
+	switch {
+	case ok && br.Usage == 1:
+		delete(m.files, fk)
+	case ok && br.Usage > 1:
+		br.Usage--
+		m.files[fk] = br
+	}
+}
+
+// clearRemote decrements usage for all files belonging to this remote,
+// removes those that are no longer needed and clears the remote's key map.
+// The global view must be recalculated afterwards.
+func (m *Set) clearRemote(cid uint) {
+	for _, fk := range m.remoteKey[cid] {
+		m.release(fk)
+	}
+
 	// Clear existing remote remoteKey
 	m.remoteKey[cid] = make(map[string]key)
+	m.rootGen[cid]++
+}
 
-	// Recalculate global based on all remaining remoteKey
+// recalcGlobal recalculates the global view based on all remaining remoteKey.
+func (m *Set) recalcGlobal() {
 	for n := range m.globalKey {
-		var nk key    // newest key
-		var na bitset // newest availability
-
-		for i, rem := range m.remoteKey {
-			if rk, ok := rem[n]; ok {
-				switch {
-				case rk == nk:
-					na |= 1 << uint(i)
-				case rk.newerThan(nk):
-					nk = rk
-					na = 1 << uint(i)
-				}
+		m.recalcGlobalFile(n)
+	}
+}
+
+// recalcGlobalFile recalculates the global view of a single file.
+func (m *Set) recalcGlobalFile(n string) {
+	var nk key    // newest key
+	var na bitset // newest availability
+
+	for i, rem := range m.remoteKey {
+		if rk, ok := rem[n]; ok {
+			switch {
+			case rk == nk:
+				na |= 1 << uint(i)
+			case rk.newerThan(nk):
+				nk = rk
+				na = 1 << uint(i)
 			}
 		}
+	}
+
+	if gk, ok := m.globalKey[n]; ok && (na == 0 || gk != nk) {
+		if f, ok := m.files[gk]; ok {
+			f.Global = false
+			m.files[gk] = f
+		}
+	}
+
+	if na != 0 {
+		// Someone had the file
+		f := m.files[nk]
+		f.Global = true
+		m.files[nk] = f
+		m.setGlobal(n, nk)
+		m.globalAvailability[n] = na
+	} else {
+		// Noone had the file
+		m.clearGlobal(n)
+		delete(m.globalAvailability, n)
+	}
+}
+
+// ChangedSince returns the local files that have changed since the given
+// sequence number, in the order they changed, and the current sequence
+// number. A file that changed several times is returned once, as of its
+// last change. Files that have been removed altogether, as opposed to
+// deleted, are not returned.
+func (m *Set) ChangedSince(seq int64) ([]scanner.File, int64) {
+	if debug {
+		dlog.Printf("ChangedSince(%d)", seq)
+	}
+	m.Lock()
+	defer m.Unlock()
 
-		if na != 0 {
-			// Someone had the file
-			m.globalKey[n] = nk
-			m.globalAvailability[n] = na
+	i := sort.Search(len(m.localOrder), func(i int) bool {
+		return m.localOrder[i].seq > seq
+	})
+	var fs []scanner.File
+	for _, e := range m.localOrder[i:] {
+		if m.localSeq[e.name] != e.seq {
+			continue
+		}
+		fs = append(fs, m.files[m.remoteKey[cid.LocalID][e.name]].File)
+	}
+	return fs, m.localVersion
+}
+
+// LocalVersion returns the current sequence number of the local files.
+func (m *Set) LocalVersion() int64 {
+	m.Lock()
+	defer m.Unlock()
+	return m.localVersion
+}
+
+// LocalVersions returns the sequence numbers of the local files and the
+// current sequence number, to be saved along with the local index.
+func (m *Set) LocalVersions() (map[string]int64, int64) {
+	m.Lock()
+	defer m.Unlock()
+	seqs := make(map[string]int64, len(m.localSeq))
+	for n, s := range m.localSeq {
+		seqs[n] = s
+	}
+	return seqs, m.localVersion
+}
+
+// SetLocalVersions restores the sequence numbers saved by LocalVersions,
+// after the local index has been loaded. Local files without a saved
+// sequence number are given new ones.
+func (m *Set) SetLocalVersions(seqs map[string]int64, max int64) {
+	m.Lock()
+	defer m.Unlock()
+
+	if max > m.localVersion {
+		m.localVersion = max
+	}
+	m.localSeq = make(map[string]int64)
+	m.localOrder = nil
+
+	var unsequenced []string
+	for n := range m.remoteKey[cid.LocalID] {
+		if s, ok := seqs[n]; ok && s <= max {
+			m.localSeq[n] = s
+			m.localOrder = append(m.localOrder, seqName{s, n})
 		} else {
-			// Noone had the file
-			delete(m.globalKey, n)
-			delete(m.globalAvailability, n)
+			unsequenced = append(unsequenced, n)
 		}
 	}
+	sort.Sort(seqOrder(m.localOrder))
+	sort.Strings(unsequenced)
+	for _, n := range unsequenced {
+		m.nextSeq(n)
+	}
+}
 
-	// Add new remote remoteKey to the mix
-	m.update(cid, fs)
+// nextSeq gives the local file a new sequence number.
+func (m *Set) nextSeq(name string) {
+	m.localVersion++
+	m.localSeq[name] = m.localVersion
+	m.localOrder = append(m.localOrder, seqName{m.localVersion, name})
+
+	// Drop the stale entries once they make up more than half the list.
+	if len(m.localOrder) > 2*len(m.localSeq)+64 {
+		live := m.localOrder[:0]
+		for _, e := range m.localOrder {
+			if m.localSeq[e.name] == e.seq {
+				live = append(live, e)
+			}
+		}
+		m.localOrder = live
+	}
+}
+
+func (m *Set) forgetSeq(name string) {
+	delete(m.localSeq, name)
 }
+
+type seqOrder []seqName
+
+func (l seqOrder) Len() int           { return len(l) }
+func (l seqOrder) Less(a, b int) bool { return l[a].seq < l[b].seq }
+func (l seqOrder) Swap(a, b int)      { l[a], l[b] = l[b], l[a] }
@@ -1,9 +1,12 @@
 package files
 
 import (
+	"bytes"
+	"crypto/sha256"
 	"fmt"
 	"reflect"
 	"sort"
+	"strings"
 	"testing"
 
 	"github.com/calmh/syncthing/cid"
@@ -322,6 +325,63 @@ func TestGlobalReset(t *testing.T) {
 	}
 }
 
+func TestDrop(t *testing.T) {
+	m := NewSet()
+
+	local := []scanner.File{
+		scanner.File{Name: "a", Version: 1000},
+		scanner.File{Name: "b", Version: 1000},
+	}
+
+	remote1 := []scanner.File{
+		scanner.File{Name: "a", Version: 1001},
+		scanner.File{Name: "c", Version: 1000},
+	}
+
+	remote2 := []scanner.File{
+		scanner.File{Name: "b", Version: 1002},
+		scanner.File{Name: "d", Version: 1000},
+	}
+
+	expectedGlobalKey := map[string]key{
+		"a": keyFor(local[0]),
+		"b": keyFor(local[1]),
+	}
+
+	m.ReplaceWithDelete(cid.LocalID, local)
+	m.Replace(1, remote1)
+	m.Replace(2, remote2)
+	c1, c2 := m.Changes(1), m.Changes(2)
+
+	m.Drop([]uint{1, 2})
+
+	if !reflect.DeepEqual(m.globalKey, expectedGlobalKey) {
+		t.Errorf("Global incorrect;\n%v !=\n%v", m.globalKey, expectedGlobalKey)
+	}
+
+	if lb := len(m.files); lb != 2 {
+		t.Errorf("Num files incorrect %d != 2\n%v", lb, m.files)
+	}
+
+	if m.Changes(1) == c1 || m.Changes(2) == c2 {
+		t.Error("Change numbers should have incremented")
+	}
+}
+
+func TestUpdateWithoutReplace(t *testing.T) {
+	m := NewSet()
+
+	f := scanner.File{Name: "a", Version: 1000}
+	m.Update(cid.LocalID, []scanner.File{f})
+
+	if g := m.Get(cid.LocalID, "a"); g.Version != f.Version {
+		t.Errorf("Local file has version %d, expected %d", g.Version, f.Version)
+	}
+	if g := m.GetGlobal("a"); g.Version != f.Version {
+		t.Errorf("Global file has version %d, expected %d", g.Version, f.Version)
+	}
+}
+
 func TestNeed(t *testing.T) {
 	m := NewSet()
 
@@ -358,6 +418,50 @@ func TestNeed(t *testing.T) {
 	}
 }
 
+func TestExpireDeleted(t *testing.T) {
+	m := NewSet()
+
+	local := []scanner.File{
+		scanner.File{Name: "a", Version: 1000, Flags: protocol.FlagDeleted},
+		scanner.File{Name: "b", Version: 1000, Flags: protocol.FlagDeleted},
+		scanner.File{Name: "c", Version: 1000, Flags: protocol.FlagDeleted},
+		scanner.File{Name: "d", Version: 1000},
+	}
+
+	remote := []scanner.File{
+		scanner.File{Name: "a", Version: 1000, Flags: protocol.FlagDeleted},
+		scanner.File{Name: "b", Version: 999},
+		scanner.File{Name: "d", Version: 1000},
+	}
+
+	m.ReplaceWithDelete(cid.LocalID, local)
+	m.Replace(1, remote)
+	c0 := m.Changes(cid.LocalID)
+
+	// "c" is not expired, as the remote may not have announced its
+	// deletion yet.
+	expired := m.ExpireDeleted([]string{"a", "b", "c", "d"}, []uint{1})
+	sort.Strings(expired)
+	if !reflect.DeepEqual(expired, []string{"a"}) {
+		t.Errorf("Incorrect expired files %v", expired)
+	}
+	if m.Changes(cid.LocalID) == c0 {
+		t.Error("Expiry not counted as a change")
+	}
+
+	have := m.Have(cid.LocalID)
+	sort.Sort(fileList(have))
+	if !reflect.DeepEqual(have, []scanner.File{local[1], local[2], local[3]}) {
+		t.Errorf("Have incorrect;\n%v", have)
+	}
+
+	// The remote's tombstone for "a" is not needed locally, since there is
+	// nothing to delete.
+	if need := m.Need(cid.LocalID); len(need) != 0 {
+		t.Errorf("Need incorrect;\n%v", need)
+	}
+}
+
 func TestChanges(t *testing.T) {
 	m := NewSet()
 
@@ -391,3 +495,253 @@ func TestChanges(t *testing.T) {
 		t.Fatal("Change number should be unchanged")
 	}
 }
+
+func names(fs []scanner.File) []string {
+	var ns []string
+	for _, f := range fs {
+		ns = append(ns, f.Name)
+	}
+	return ns
+}
+
+func TestChangedSince(t *testing.T) {
+	m := NewSet()
+
+	local := []scanner.File{
+		scanner.File{Name: "a", Version: 1000},
+		scanner.File{Name: "b", Version: 1000},
+		scanner.File{Name: "c", Version: 1000},
+	}
+	m.ReplaceWithDelete(cid.LocalID, local)
+
+	fs, seq := m.ChangedSince(0)
+	if exp := []string{"a", "b", "c"}; !reflect.DeepEqual(names(fs), exp) || seq != 3 {
+		t.Fatalf("Incorrect changes %v at %d", names(fs), seq)
+	}
+
+	// An unchanged replace doesn't change anything; an update of a file
+	// moves it to the end.
+	m.ReplaceWithDelete(cid.LocalID, local)
+	m.Update(cid.LocalID, []scanner.File{scanner.File{Name: "a", Version: 1001}})
+	m.Update(cid.LocalID, []scanner.File{scanner.File{Name: "b", Version: 1000}})
+	fs, seq = m.ChangedSince(0)
+	if exp := []string{"b", "c", "a"}; !reflect.DeepEqual(names(fs), exp) || seq != 4 {
+		t.Errorf("Incorrect changes %v at %d", names(fs), seq)
+	}
+	if fs, _ := m.ChangedSince(3); len(fs) != 1 || fs[0].Version != 1001 {
+		t.Errorf("Incorrect changes since 3: %v", fs)
+	}
+
+	// Deleting a file gives the tombstone a new sequence number.
+	m.ReplaceWithDelete(cid.LocalID, []scanner.File{local[2]})
+	fs, seq = m.ChangedSince(4)
+	sort.Sort(fileList(fs))
+	if exp := []string{"a", "b"}; !reflect.DeepEqual(names(fs), exp) || seq != 6 {
+		t.Fatalf("Incorrect changes %v at %d", names(fs), seq)
+	}
+	for _, f := range fs {
+		if f.Flags&protocol.FlagDeleted == 0 {
+			t.Errorf("File not deleted: %v", f)
+		}
+	}
+
+	if fs, seq := m.ChangedSince(seq); len(fs) != 0 || seq != 6 {
+		t.Errorf("Incorrect changes %v at %d", fs, seq)
+	}
+}
+
+func TestLocalVersionsRestore(t *testing.T) {
+	m := NewSet()
+	m.ReplaceWithDelete(cid.LocalID, []scanner.File{
+		scanner.File{Name: "a", Version: 1000},
+		scanner.File{Name: "b", Version: 1000},
+	})
+	m.Update(cid.LocalID, []scanner.File{scanner.File{Name: "a", Version: 1001}})
+	seqs, max := m.LocalVersions()
+
+	// A new set seeded with the same files, plus one that was not saved.
+	n := NewSet()
+	n.Replace(cid.LocalID, append(m.Have(cid.LocalID), scanner.File{Name: "c", Version: 1000}))
+	n.SetLocalVersions(seqs, max)
+
+	fs, seq := n.ChangedSince(0)
+	if exp := []string{"b", "a", "c"}; !reflect.DeepEqual(names(fs), exp) || seq != max+1 {
+		t.Errorf("Incorrect changes %v at %d", names(fs), seq)
+	}
+	if fs, _ := n.ChangedSince(max); !reflect.DeepEqual(names(fs), []string{"c"}) {
+		t.Errorf("Incorrect changes since %d: %v", max, names(fs))
+	}
+}
+
+func TestReplaceIncremental(t *testing.T) {
+	m := NewSet()
+
+	local := []scanner.File{
+		scanner.File{Name: "a", Version: 1000},
+		scanner.File{Name: "b", Version: 1000},
+	}
+	remote := []scanner.File{
+		scanner.File{Name: "a", Version: 1000},
+		scanner.File{Name: "b", Version: 1001},
+		scanner.File{Name: "c", Version: 1002, Flags: protocol.FlagDeleted},
+	}
+
+	m.ReplaceWithDelete(cid.LocalID, local)
+	m.Replace(1, remote)
+	g0 := m.Global()
+	sort.Sort(fileList(g0))
+	c0 := m.Changes(1)
+
+	// The remote resends an identical full index, tombstone included.
+	m.Replace(1, append([]scanner.File(nil), remote...))
+	if c := m.Changes(1); c != c0 {
+		t.Errorf("Identical index counted as a change")
+	}
+	g := m.Global()
+	sort.Sort(fileList(g))
+	if !reflect.DeepEqual(g, g0) {
+		t.Errorf("Global changed;\n%v !=\n%v", g, g0)
+	}
+	if lb := len(m.files); lb != 4 {
+		t.Errorf("Num files incorrect %d != 4\n%v", lb, m.files)
+	}
+
+	// The remote goes back to the local version of "b" and forgets "c".
+	m.Replace(1, []scanner.File{
+		scanner.File{Name: "a", Version: 1000},
+		scanner.File{Name: "b", Version: 1000},
+	})
+	if c := m.Changes(1); c == c0 {
+		t.Errorf("Changed index not counted as a change")
+	}
+	expectedGlobal := []scanner.File{
+		scanner.File{Name: "a", Version: 1000},
+		scanner.File{Name: "b", Version: 1000},
+	}
+	g = m.Global()
+	sort.Sort(fileList(g))
+	if !reflect.DeepEqual(g, expectedGlobal) {
+		t.Errorf("Global incorrect;\n%v !=\n%v", g, expectedGlobal)
+	}
+	if need := m.Need(cid.LocalID); len(need) != 0 {
+		t.Errorf("Need incorrect;\n%v", need)
+	}
+	if lb := len(m.files); lb != 2 {
+		t.Errorf("Num files incorrect %d != 2\n%v", lb, m.files)
+	}
+}
+
+// rootOf returns the root of a set announcing just the given files.
+func rootOf(fs []scanner.File) []byte {
+	m := NewSet()
+	m.Replace(1, fs)
+	return m.Root(1)
+}
+
+func TestRoot(t *testing.T) {
+	files := []scanner.File{
+		scanner.File{Name: "a", Version: 1000, Blocks: []scanner.Block{{Hash: []byte{1}}}},
+		scanner.File{Name: "b", Version: 1000, Blocks: []scanner.Block{{Hash: []byte{2}}}},
+		scanner.File{Name: "c", Version: 1000},
+	}
+	reversed := []scanner.File{files[2], files[1], files[0]}
+	if r0, r1 := rootOf(files), rootOf(reversed); !reflect.DeepEqual(r0, r1) {
+		t.Errorf("Roots of the same files differ; %x != %x", r0, r1)
+	}
+
+	changed := append([]scanner.File(nil), files...)
+	changed[1].Version++
+	if r0, r1 := rootOf(files), rootOf(changed); reflect.DeepEqual(r0, r1) {
+		t.Errorf("Changed version gives the same root %x", r0)
+	}
+	changed = append([]scanner.File(nil), files...)
+	changed[1].Blocks = []scanner.Block{{Hash: []byte{3}}}
+	if r0, r1 := rootOf(files), rootOf(changed); reflect.DeepEqual(r0, r1) {
+		t.Errorf("Changed blocks give the same root %x", r0)
+	}
+}
+
+func TestRootIncremental(t *testing.T) {
+	m := NewSet()
+
+	m.ReplaceWithDelete(cid.LocalID, []scanner.File{
+		scanner.File{Name: "a", Version: 1000},
+		scanner.File{Name: "b", Version: 1000},
+	})
+	m.Replace(1, []scanner.File{
+		scanner.File{Name: "a", Version: 1000},
+		scanner.File{Name: "b", Version: 1001},
+		scanner.File{Name: "c", Version: 1002},
+	})
+	m.Update(cid.LocalID, []scanner.File{
+		scanner.File{Name: "b", Version: 1001},
+		scanner.File{Name: "d", Version: 1003},
+	})
+	m.Replace(2, []scanner.File{
+		scanner.File{Name: "c", Version: 1004},
+	})
+	m.ReplaceWithDelete(cid.LocalID, []scanner.File{
+		scanner.File{Name: "b", Version: 1001},
+	})
+	m.Drop([]uint{2})
+
+	for _, id := range []uint{cid.LocalID, 1, 2} {
+		if r, e := m.Root(id), rootOf(m.Have(id)); !reflect.DeepEqual(r, e) {
+			t.Errorf("Root of %d incorrect; %x != %x", id, r, e)
+		}
+	}
+	if r, e := m.GlobalRoot(), rootOf(m.Global()); !reflect.DeepEqual(r, e) {
+		t.Errorf("Global root incorrect; %x != %x", r, e)
+	}
+}
+
+func TestRootMerkle(t *testing.T) {
+	files := []scanner.File{
+		scanner.File{Name: "b", Version: 1000},
+		scanner.File{Name: "a", Version: 1000},
+		scanner.File{Name: "c", Version: 1000},
+	}
+	a, b, c := leafHash("a", files[1]), leafHash("b", files[0]), leafHash("c", files[2])
+	node := func(l, r rootHash) rootHash {
+		var n rootHash
+		h := sha256.New()
+		h.Write([]byte{1})
+		h.Write(l[:])
+		h.Write(r[:])
+		h.Sum(n[:0])
+		return n
+	}
+	exp := node(node(a, b), c)
+	if r := rootOf(files); !bytes.Equal(r, exp[:]) {
+		t.Errorf("Incorrect root %x != %x", r, exp)
+	}
+}
+
+func TestRootAnnounced(t *testing.T) {
+	announce := func(name string) (string, bool) {
+		if name == "internal" {
+			return "", false
+		}
+		return strings.Replace(name, "\\", "/", -1), true
+	}
+
+	m := NewSet()
+	m.Replace(1, []scanner.File{
+		scanner.File{Name: "dir\\file", Version: 1000},
+		scanner.File{Name: "internal", Version: 1000},
+	})
+	m.SetAnnounced(announce)
+	exp := rootOf([]scanner.File{scanner.File{Name: "dir/file", Version: 1000}})
+	if r := m.Root(1); !bytes.Equal(r, exp) {
+		t.Errorf("Root not of the announced files; %x != %x", r, exp)
+	}
+	if r := m.GlobalRoot(); !bytes.Equal(r, exp) {
+		t.Errorf("Global root not of the announced files; %x != %x", r, exp)
+	}
+
+	// Files added later are announced the same way.
+	m.Update(1, []scanner.File{scanner.File{Name: "internal", Version: 1001}})
+	if r := m.Root(1); !bytes.Equal(r, exp) {
+		t.Errorf("Root includes a file not announced; %x != %x", r, exp)
+	}
+}
@@ -0,0 +1,87 @@
+package protocol
+
+import (
+	"bytes"
+	"compress/flate"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"sync"
+)
+
+// The block compression option is announced in the cluster config message
+// by nodes that accept version one response messages, in which the data
+// may be compressed.
+const (
+	blockCompressionOptionKey = "block-compression"
+	blockCompressionVersion   = "1"
+)
+
+// The highest supported response message version.
+const responseMessageVersion = 1
+
+// Encodings of the data in version one response messages.
+const (
+	encodingNone    uint32 = 0
+	encodingDeflate uint32 = 1
+)
+
+// Response data is only sent compressed when that makes it smaller by at
+// least one part in this many. Data that is already compressed, such as
+// most media, is sent as is, saving the receiver the work.
+const compressionMinSaving = 8
+
+var errResponseTooLarge = errors.New("protocol error: decompressed response exceeds maximum request size")
+
+var deflaters = sync.Pool{
+	New: func() interface{} {
+		fw, _ := flate.NewWriter(nil, flate.BestSpeed)
+		return fw
+	},
+}
+
+// compressedResponse returns a version one response carrying the data,
+// compressed if that saves enough to be worthwhile.
+func compressedResponse(data []byte) ResponseMessage {
+	if len(data) < compressionMinSaving {
+		return ResponseMessage{encodingNone, data}
+	}
+
+	var buf bytes.Buffer
+	fw := deflaters.Get().(*flate.Writer)
+	fw.Reset(&buf)
+	_, err := fw.Write(data)
+	if err == nil {
+		err = fw.Close()
+	}
+	deflaters.Put(fw)
+
+	if err != nil || buf.Len() > len(data)-len(data)/compressionMinSaving {
+		return ResponseMessage{encodingNone, data}
+	}
+	return ResponseMessage{encodingDeflate, buf.Bytes()}
+}
+
+// data returns the response data as it was before compression.
+func (r ResponseMessage) data() ([]byte, error) {
+	switch r.Encoding {
+	case encodingNone:
+		return r.Data, nil
+
+	case encodingDeflate:
+		fr := flate.NewReader(bytes.NewReader(r.Data))
+		defer fr.Close()
+		data, err := ioutil.ReadAll(io.LimitReader(fr, MaxRequestSize+1))
+		if err != nil {
+			return nil, err
+		}
+		if len(data) > MaxRequestSize {
+			return nil, errResponseTooLarge
+		}
+		return data, nil
+
+	default:
+		return nil, fmt.Errorf("protocol error: unknown response encoding %d", r.Encoding)
+	}
+}
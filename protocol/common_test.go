@@ -12,6 +12,8 @@ type TestModel struct {
 	offset   int64
 	size     int
 	closedCh chan bool
+	indexCh  chan []FileInfo
+	updateCh chan []FileInfo
 }
 
 func newTestModel() *TestModel {
@@ -21,9 +23,15 @@ func newTestModel() *TestModel {
 }
 
 func (t *TestModel) Index(nodeID string, repo string, files []FileInfo) {
+	if t.indexCh != nil {
+		t.indexCh <- files
+	}
 }
 
 func (t *TestModel) IndexUpdate(nodeID string, repo string, files []FileInfo) {
+	if t.updateCh != nil {
+		t.updateCh <- files
+	}
 }
 
 func (t *TestModel) Request(nodeID, repo, name string, offset int64, size int) ([]byte, error) {
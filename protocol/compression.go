@@ -0,0 +1,137 @@
+package protocol
+
+import (
+	"compress/flate"
+	"io"
+	"io/ioutil"
+	"sync"
+)
+
+// The memory held by the compression state of a connection, as allocated by
+// the standard library. A flate writer allocates its window and hash tables
+// up front whatever the compression level, which makes it most of the memory
+// held by an idle connection. A writer storing the data uncompressed only
+// needs a block's worth of window.
+const (
+	flateWriterMemory      = 475 << 10
+	flateStoreWriterMemory = 70 << 10
+	flateReaderMemory      = 40 << 10
+)
+
+// Writers compressing the message streams of connections are pooled, so that
+// reconnecting nodes reuse the writers of closed connections rather than each
+// allocating new ones. Writers using the preset dictionary keep it when
+// reset, and so are pooled apart, as are those storing the data
+// uncompressed.
+var (
+	streamWriters      sync.Pool
+	dictStreamWriters  sync.Pool
+	storeStreamWriters sync.Pool
+)
+
+func streamWriterPool(dict, compress bool) *sync.Pool {
+	switch {
+	case !compress:
+		return &storeStreamWriters
+	case dict:
+		return &dictStreamWriters
+	default:
+		return &streamWriters
+	}
+}
+
+// getStreamWriter returns a writer compressing to w, using the preset
+// dictionary if dict is set. Unless compress is set the writer stores the
+// data in uncompressed blocks, which the peer reads as any other stream, and
+// dict makes no difference.
+func getStreamWriter(w io.Writer, dict, compress bool) *flate.Writer {
+	if fw, ok := streamWriterPool(dict, compress).Get().(*flate.Writer); ok {
+		fw.Reset(w)
+		return fw
+	}
+
+	var fw *flate.Writer
+	var err error
+	switch {
+	case !compress:
+		fw, err = flate.NewWriter(w, flate.NoCompression)
+	case dict:
+		fw, err = flate.NewWriterDict(w, flate.BestSpeed, presetDictionary)
+	default:
+		fw, err = flate.NewWriter(w, flate.BestSpeed)
+	}
+	if err != nil {
+		// Only for invalid compression levels
+		panic(err)
+	}
+	return fw
+}
+
+// putStreamWriter returns a writer from getStreamWriter to the pool. It must
+// not be used after.
+func putStreamWriter(fw *flate.Writer, dict, compress bool) {
+	// Drop the reference to the connection's writer
+	fw.Reset(ioutil.Discard)
+	streamWriterPool(dict, compress).Put(fw)
+}
+
+// The number of connections compressing response data, and the most that
+// may do so at the same time; zero for no limit.
+var (
+	compressedConns    int
+	maxCompressedConns int
+	compressedMut      sync.Mutex
+)
+
+// SetMaxCompressedConnections sets the most connections that may use
+// compression at the same time, zero meaning no limit. Connections beyond
+// the limit send their message stream in uncompressed deflate blocks, which
+// needs a fraction of the memory, and response data uncompressed. The limit
+// applies to connections made after it is set.
+func SetMaxCompressedConnections(n int) {
+	compressedMut.Lock()
+	maxCompressedConns = n
+	compressedMut.Unlock()
+}
+
+// acquireCompression returns whether another connection may use compression,
+// counting it if so. Each true return must be matched by a call to
+// releaseCompression.
+func acquireCompression() bool {
+	compressedMut.Lock()
+	defer compressedMut.Unlock()
+
+	if maxCompressedConns > 0 && compressedConns >= maxCompressedConns {
+		return false
+	}
+	compressedConns++
+	return true
+}
+
+func releaseCompression() {
+	compressedMut.Lock()
+	compressedConns--
+	compressedMut.Unlock()
+}
+
+// closedWriter takes the place of the compressed stream once the connection
+// is closed and its writer returned to the pool.
+type closedWriter struct{}
+
+func (closedWriter) Write([]byte) (int, error) {
+	return 0, ErrClosed
+}
+
+// compressionMemory returns the estimated memory held by the compression
+// state of the connection.
+func (c *rawConnection) compressionMemory() int64 {
+	select {
+	case <-c.closed:
+		return 0
+	default:
+	}
+	if !c.compress {
+		return flateStoreWriterMemory + flateReaderMemory
+	}
+	return flateWriterMemory + flateReaderMemory
+}
@@ -0,0 +1,67 @@
+package protocol
+
+import (
+	"compress/flate"
+	"io"
+	"strings"
+)
+
+// The dictionary option is announced in the cluster config message by nodes
+// that accept a compression stream restarted with the preset dictionary.
+const (
+	dictionaryOptionKey = "compression-dictionary"
+	dictionaryVersion   = "1"
+)
+
+// presetDictionary primes the compressor with strings that are common in
+// index messages. Deflate favours matches near the end of the dictionary, so
+// the most common strings come last.
+var presetDictionary = []byte(strings.Join([]string{
+	".hg/", ".svn/", "CVS/", ".idea/", "target/", "build/", "dist/",
+	"vendor/", "node_modules/", "Godeps/_workspace/src/", "__pycache__/",
+	"Library/", "Application Support/", "Documents/", "Downloads/",
+	"Desktop/", "Music/", "Pictures/", "Photos/", "Movies/", "Videos/",
+	"iTunes/", "Thumbs.db", ".DS_Store", "desktop.ini", "README", "LICENSE",
+	"Makefile", ".gitignore", ".stignore", ".txt", ".md", ".html", ".css",
+	".js", ".json", ".xml", ".pdf", ".doc", ".docx", ".xls", ".xlsx",
+	".mp3", ".m4a", ".flac", ".mp4", ".mov", ".avi", ".png", ".gif",
+	".jpeg", ".JPG", ".jpg", ".py", ".pyc", ".c", ".h", ".java", ".class",
+	".go", "src/", "lib/", "bin/", "test/", "docs/", "images/", "assets/",
+	".git/objects/", ".git/refs/heads/", ".git/logs/", ".git/",
+}, "\x00\x00\x00"))
+
+// dictionaryReader reads a compressed stream that may, once, end and
+// restart with the preset dictionary.
+type dictionaryReader struct {
+	src       flate.Reader
+	fr        io.ReadCloser
+	restarted bool
+}
+
+func newDictionaryReader(src flate.Reader) *dictionaryReader {
+	return &dictionaryReader{
+		src: src,
+		fr:  flate.NewReader(src),
+	}
+}
+
+func (d *dictionaryReader) Read(bs []byte) (int, error) {
+	n, err := d.fr.Read(bs)
+	if err == io.EOF && !d.restarted {
+		// The sender finished the initial stream and started a new one
+		// using the preset dictionary.
+		d.restarted = true
+		if err := d.fr.(flate.Resetter).Reset(d.src, presetDictionary); err != nil {
+			return n, err
+		}
+		if n > 0 {
+			return n, nil
+		}
+		return d.Read(bs)
+	}
+	return n, err
+}
+
+func (d *dictionaryReader) Close() error {
+	return d.fr.Close()
+}
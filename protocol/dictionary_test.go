@@ -0,0 +1,101 @@
+package protocol
+
+import (
+	"bytes"
+	"compress/flate"
+	"fmt"
+	"io"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/calmh/syncthing/xdr"
+)
+
+func testIndex() IndexMessage {
+	var files []FileInfo
+	dirs := []string{"Documents/Projects/syncthing/src/", "Pictures/2014/Holiday/", ".git/objects/a3/", "node_modules/express/lib/"}
+	exts := []string{".go", ".jpg", "", ".js"}
+	for i := 0; i < 200; i++ {
+		files = append(files, FileInfo{
+			Name:     fmt.Sprintf("%sfile%d%s", dirs[i%len(dirs)], i, exts[i%len(exts)]),
+			Flags:    0644,
+			Modified: 1400000000 + int64(i),
+			Version:  uint64(i),
+			Blocks:   []BlockInfo{{Size: 1234, Hash: bytes.Repeat([]byte{byte(i)}, 32)}},
+		})
+	}
+	return IndexMessage{"default", files}
+}
+
+func compressedIndex(t *testing.T, im IndexMessage, dict []byte) []byte {
+	var buf bytes.Buffer
+	fw, err := flate.NewWriterDict(&buf, flate.BestSpeed, dict)
+	if err != nil {
+		t.Fatal(err)
+	}
+	im.encodeXDR(xdr.NewWriter(fw))
+	fw.Close()
+	return buf.Bytes()
+}
+
+func TestDictionaryCompression(t *testing.T) {
+	im := testIndex()
+
+	plain := compressedIndex(t, im, nil)
+	dict := compressedIndex(t, im, presetDictionary)
+	if len(dict) >= len(plain) {
+		t.Errorf("Dictionary does not improve compression; %d >= %d", len(dict), len(plain))
+	}
+
+	var res IndexMessage
+	xr := xdr.NewReader(flate.NewReaderDict(bytes.NewReader(dict), presetDictionary))
+	if err := res.decodeXDR(xr); err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(im, res) {
+		t.Error("Index differs after round trip")
+	}
+}
+
+func TestDictionaryNegotiation(t *testing.T) {
+	m0 := newTestModel()
+	m1 := newTestModel()
+	m1.indexCh = make(chan []FileInfo, 1)
+
+	ar, aw := io.Pipe()
+	br, bw := io.Pipe()
+
+	c0 := NewConnection("c0", ar, bw, m0).(wireFormatConnection).next.(*rawConnection)
+	c1 := NewConnection("c1", br, aw, m1).(wireFormatConnection).next.(*rawConnection)
+
+	c0.ClusterConfig(ClusterConfigMessage{})
+	c1.ClusterConfig(ClusterConfigMessage{})
+
+	var switched bool
+	for i := 0; i < 100 && !switched; i++ {
+		time.Sleep(10 * time.Millisecond)
+		c0.wmut.Lock()
+		switched = c0.wdict
+		c0.wmut.Unlock()
+	}
+	if !switched {
+		t.Fatal("Connection did not switch to the preset dictionary")
+	}
+
+	im := testIndex()
+	c0.Index(im.Repository, im.Files)
+
+	select {
+	case fs := <-m1.indexCh:
+		if !reflect.DeepEqual(fs, im.Files) {
+			t.Error("Index differs after transfer")
+		}
+	case <-time.After(time.Second):
+		t.Fatal("Index not received")
+	}
+
+	if !c0.ping() || !c1.ping() {
+		t.Error("Ping failed after switching to the preset dictionary")
+	}
+}
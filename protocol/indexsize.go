@@ -0,0 +1,116 @@
+package protocol
+
+import (
+	"bytes"
+	"compress/flate"
+	"fmt"
+	"io/ioutil"
+
+	"github.com/calmh/syncthing/xdr"
+)
+
+// IndexSize is a breakdown of the size of an index message, for tuning the
+// index format.
+type IndexSize struct {
+	Files       int
+	Blocks      int
+	Names       int // file names, including length and padding
+	Metadata    int // flags, modification time, version and creation time
+	BlockSizes  int
+	BlockHashes int // including length and padding
+	FileHashes  int // including length and padding
+	Framing     int // message header, repository and list lengths
+	Total       int // the uncompressed message, including the header
+
+	Compressed     int // compressed as the first message on a connection
+	CompressedDict int // same, with the preset dictionary
+}
+
+// MeasureIndex returns the size of an index message holding the files, as
+// sent on a connection using the current index message version. Each field
+// category is counted by writing it with the same encoder as the message;
+// what remains of the total is framing.
+func MeasureIndex(repo string, files []FileInfo) IndexSize {
+	msg := []encodable{header{indexMessageVersion, 0, messageTypeIndex}, IndexMessage{repo, files}}
+
+	var s IndexSize
+	s.Files = len(files)
+
+	xw := xdr.NewWriter(ioutil.Discard)
+	count := func(dst *int, write func()) {
+		start := xw.Tot()
+		write()
+		*dst += xw.Tot() - start
+	}
+	for _, f := range files {
+		s.Blocks += len(f.Blocks)
+		count(&s.Names, func() { xw.WriteString(f.Name) })
+		count(&s.Metadata, func() {
+			xw.WriteUint32(f.Flags)
+			xw.WriteUint64(uint64(f.Modified))
+			xw.WriteUint64(f.Version)
+			xw.WriteUint64(uint64(f.Created))
+		})
+		count(&s.FileHashes, func() { xw.WriteBytes(f.Hash) })
+		for _, b := range f.Blocks {
+			count(&s.BlockSizes, func() { xw.WriteUint32(b.Size) })
+			count(&s.BlockHashes, func() { xw.WriteBytes(b.Hash) })
+		}
+	}
+
+	xw = xdr.NewWriter(ioutil.Discard)
+	for _, e := range msg {
+		e.encodeXDR(xw)
+	}
+	s.Total = xw.Tot()
+	s.Framing = s.Total - s.Names - s.Metadata - s.BlockSizes - s.BlockHashes - s.FileHashes
+
+	s.Compressed = compressedSize(msg, nil)
+	s.CompressedDict = compressedSize(msg, presetDictionary)
+	return s
+}
+
+// compressedSize returns the size of the encoded message compressed and
+// flushed the way the connection does it.
+func compressedSize(msg []encodable, dict []byte) int {
+	cw := &countingWriter{Writer: ioutil.Discard}
+	flwr, err := flate.NewWriterDict(cw, flate.BestSpeed, dict)
+	if err != nil {
+		panic(err)
+	}
+	xw := xdr.NewWriter(flwr)
+	for _, e := range msg {
+		e.encodeXDR(xw)
+	}
+	flwr.Flush()
+	return int(cw.Tot())
+}
+
+func (s IndexSize) String() string {
+	var buf bytes.Buffer
+	fmt.Fprintf(&buf, "%d files, %d blocks\n", s.Files, s.Blocks)
+	for _, c := range []struct {
+		name string
+		size int
+	}{
+		{"names", s.Names},
+		{"metadata", s.Metadata},
+		{"block sizes", s.BlockSizes},
+		{"block hashes", s.BlockHashes},
+		{"file hashes", s.FileHashes},
+		{"framing", s.Framing},
+		{"total", s.Total},
+		{"compressed", s.Compressed},
+		{"compressed (dict)", s.CompressedDict},
+	} {
+		fmt.Fprintf(&buf, "%-18s %10d %5.1f%%\n", c.name, c.size, percent(c.size, s.Total))
+	}
+	return buf.String()
+}
+
+func percent(a, b int) float64 {
+	if b == 0 {
+		return 0
+	}
+	return 100 * float64(a) / float64(b)
+}
@@ -0,0 +1,95 @@
+package protocol
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"fmt"
+	"testing"
+
+	"github.com/calmh/syncthing/xdr"
+)
+
+// syntheticIndex returns an index of n files of up to 20 blocks each, in a
+// handful of directories.
+func syntheticIndex(n int) []FileInfo {
+	files := make([]FileInfo, n)
+	for i := range files {
+		f := FileInfo{
+			Name:     fmt.Sprintf("dir%d/subdir%d/file%d.txt", i%7, i%31, i),
+			Flags:    0644,
+			Modified: 1234567890 + int64(i),
+			Version:  uint64(i),
+			Blocks:   make([]BlockInfo, i%20+1),
+		}
+		for j := range f.Blocks {
+			h := sha256.Sum256([]byte(fmt.Sprintf("%d/%d", i, j)))
+			f.Blocks[j] = BlockInfo{Size: 128 << 10, Hash: h[:]}
+		}
+		h := sha256.Sum256([]byte(f.Name))
+		f.Hash = h[:]
+		files[i] = f
+	}
+	return files
+}
+
+func TestMeasureIndex(t *testing.T) {
+	files := syntheticIndex(100)
+	s := MeasureIndex("default", files)
+
+	var buf bytes.Buffer
+	header{indexMessageVersion, 0, messageTypeIndex}.encodeXDR(xdr.NewWriter(&buf))
+	IndexMessage{"default", files}.EncodeXDR(&buf)
+	if s.Total != buf.Len() {
+		t.Errorf("Incorrect total %d != %d", s.Total, buf.Len())
+	}
+
+	// Header, repository, file count and a block count per file
+	if exp := 4 + 4 + 8 + 4 + 4*len(files); s.Framing != exp {
+		t.Errorf("Incorrect framing %d != %d", s.Framing, exp)
+	}
+	if exp := 28 * len(files); s.Metadata != exp {
+		t.Errorf("Incorrect metadata %d != %d", s.Metadata, exp)
+	}
+	if exp := 4 * s.Blocks; s.BlockSizes != exp {
+		t.Errorf("Incorrect block sizes %d != %d", s.BlockSizes, exp)
+	}
+	if exp := 36 * s.Blocks; s.BlockHashes != exp {
+		t.Errorf("Incorrect block hashes %d != %d", s.BlockHashes, exp)
+	}
+
+	if s.Compressed <= 0 || s.Compressed >= s.Total {
+		t.Errorf("Implausible compressed size %d of %d", s.Compressed, s.Total)
+	}
+	if s.CompressedDict <= 0 || s.CompressedDict >= s.Total {
+		t.Errorf("Implausible compressed size %d of %d", s.CompressedDict, s.Total)
+	}
+}
+
+func BenchmarkIndexMarshal(b *testing.B) {
+	im := IndexMessage{"default", syntheticIndex(10000)}
+	b.SetBytes(int64(len(im.MarshalXDR())))
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		im.MarshalXDR()
+	}
+}
+
+func BenchmarkIndexUnmarshal(b *testing.B) {
+	bs := IndexMessage{"default", syntheticIndex(10000)}.MarshalXDR()
+	b.SetBytes(int64(len(bs)))
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		var im IndexMessage
+		if err := im.UnmarshalXDR(bs); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
+
+func BenchmarkIndexCompress(b *testing.B) {
+	msg := []encodable{IndexMessage{"default", syntheticIndex(10000)}}
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		compressedSize(msg, presetDictionary)
+	}
+}
@@ -0,0 +1,48 @@
+package protocol
+
+import (
+	"io"
+
+	"github.com/calmh/syncthing/xdr"
+)
+
+// EncodeIndex writes the index message in the format of the given index
+// message version. Fields the version predates are left out.
+func EncodeIndex(w io.Writer, im IndexMessage, version int) (int, error) {
+	return versionedIndex(im, version).encodeXDR(xdr.NewWriter(w))
+}
+
+// DecodeIndex reads an index message in the format of the given index
+// message version.
+func DecodeIndex(r io.Reader, version int) (IndexMessage, error) {
+	xr := xdr.NewReader(r)
+	im := decodeIndex(xr, version)
+	return im, xr.Error()
+}
+
+func versionedIndex(im IndexMessage, version int) encodable {
+	switch {
+	case version >= 2:
+		return im
+	case version == 1:
+		return indexMessageV1FromIndex(im)
+	default:
+		return indexMessageV0FromIndex(im)
+	}
+}
+
+func decodeIndex(xr *xdr.Reader, version int) IndexMessage {
+	switch version {
+	case 0:
+		var im indexMessageV0
+		im.decodeXDR(xr)
+		return indexFromIndexMessageV0(im)
+	case 1:
+		var im indexMessageV1
+		im.decodeXDR(xr)
+		return indexFromIndexMessageV1(im)
+	}
+	var im IndexMessage
+	im.decodeXDR(xr)
+	return im
+}
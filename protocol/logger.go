@@ -0,0 +1,8 @@
+package protocol
+
+import (
+	"log"
+	"os"
+)
+
+var l = log.New(os.Stderr, "protocol: ", log.Lmicroseconds|log.Lshortfile)
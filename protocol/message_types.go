@@ -11,6 +11,8 @@ type FileInfo struct {
 	Modified int64
 	Version  uint64
 	Blocks   []BlockInfo // max:100000
+	Hash     []byte      // max:64
+	Created  int64
 }
 
 type BlockInfo struct {
@@ -25,6 +27,12 @@ type RequestMessage struct {
 	Size       uint32
 }
 
+// Version one response messages carry the encoding of the data.
+type ResponseMessage struct {
+	Encoding uint32
+	Data     []byte // max:524288
+}
+
 type ClusterConfigMessage struct {
 	ClientName    string       // max:64
 	ClientVersion string       // max:64
@@ -46,3 +54,38 @@ type Option struct {
 	Key   string // max:64
 	Value string // max:1024
 }
+
+type IndexSequenceMessage struct {
+	Repository string // max:64
+	Sent       uint64
+	Flags      uint32
+}
+
+type RootMessage struct {
+	Repository string // max:64
+	Root       []byte // max:32
+}
+
+type MultiRequestMessage struct {
+	Repository string         // max:64
+	Name       string         // max:1024
+	Blocks     []RequestBlock // max:16
+}
+
+type RequestBlock struct {
+	Offset uint64
+	Size   uint32
+	Hash   []byte // max:64
+}
+
+type MultiResponseMessage struct {
+	Blocks []ResponseBlock // max:16
+}
+
+// The code tells whether the block was served; the data is encoded as in
+// version one response messages.
+type ResponseBlock struct {
+	Code     uint32
+	Encoding uint32
+	Data     []byte // max:524288
+}
@@ -0,0 +1,32 @@
+package protocol
+
+// Version 0 index messages predate the whole file hash.
+
+type indexMessageV0 struct {
+	Repository string       // max:64
+	Files      []fileInfoV0 // max:100000
+}
+
+type fileInfoV0 struct {
+	Name     string // max:1024
+	Flags    uint32
+	Modified int64
+	Version  uint64
+	Blocks   []BlockInfo // max:100000
+}
+
+func indexMessageV0FromIndex(im IndexMessage) indexMessageV0 {
+	files := make([]fileInfoV0, len(im.Files))
+	for i, f := range im.Files {
+		files[i] = fileInfoV0{f.Name, f.Flags, f.Modified, f.Version, f.Blocks}
+	}
+	return indexMessageV0{im.Repository, files}
+}
+
+func indexFromIndexMessageV0(im indexMessageV0) IndexMessage {
+	files := make([]FileInfo, len(im.Files))
+	for i, f := range im.Files {
+		files[i] = FileInfo{Name: f.Name, Flags: f.Flags, Modified: f.Modified, Version: f.Version, Blocks: f.Blocks}
+	}
+	return IndexMessage{im.Repository, files}
+}
@@ -0,0 +1,33 @@
+package protocol
+
+// Version 1 index messages predate the creation time.
+
+type indexMessageV1 struct {
+	Repository string       // max:64
+	Files      []fileInfoV1 // max:100000
+}
+
+type fileInfoV1 struct {
+	Name     string // max:1024
+	Flags    uint32
+	Modified int64
+	Version  uint64
+	Blocks   []BlockInfo // max:100000
+	Hash     []byte      // max:64
+}
+
+func indexMessageV1FromIndex(im IndexMessage) indexMessageV1 {
+	files := make([]fileInfoV1, len(im.Files))
+	for i, f := range im.Files {
+		files[i] = fileInfoV1{f.Name, f.Flags, f.Modified, f.Version, f.Blocks, f.Hash}
+	}
+	return indexMessageV1{im.Repository, files}
+}
+
+func indexFromIndexMessageV1(im indexMessageV1) IndexMessage {
+	files := make([]FileInfo, len(im.Files))
+	for i, f := range im.Files {
+		files[i] = FileInfo{Name: f.Name, Flags: f.Flags, Modified: f.Modified, Version: f.Version, Blocks: f.Blocks, Hash: f.Hash}
+	}
+	return IndexMessage{im.Repository, files}
+}
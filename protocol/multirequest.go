@@ -0,0 +1,243 @@
+package protocol
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"errors"
+	"fmt"
+	"strconv"
+	"sync"
+)
+
+// The multi request option is announced in the cluster config message by
+// nodes that accept multi request messages, and holds the most blocks they
+// accept in one.
+const multiRequestOptionKey = "multi-request"
+
+// The most blocks that may be requested in one batch, and the most data
+// they may add up to.
+const (
+	MaxBatchBlocks = 16
+	MaxBatchSize   = 16 * BlockSize
+)
+
+// Codes of the blocks in multi response messages.
+const (
+	blockCodeOK          uint32 = 0
+	blockCodeUnavailable uint32 = 1
+	blockCodeChanged     uint32 = 2
+)
+
+var (
+	ErrBlockUnavailable = errors.New("block not available from peer")
+	ErrBlockChanged     = errors.New("block data at peer does not match the requested hash")
+)
+
+// A BlockResult is the outcome of requesting one of the blocks of a batch.
+type BlockResult struct {
+	Data []byte
+	Err  error
+}
+
+// RequestBatch requests the blocks of the file in one message, if the peer
+// accepts that, and returns the result for each. Towards other peers the
+// blocks are requested one by one, concurrently. The peer checks the data
+// against the block hashes, when given, before sending it.
+func (c *rawConnection) RequestBatch(repo string, name string, blocks []RequestBlock) []BlockResult {
+	if err := checkBatch(blocks); err != nil {
+		return batchError(len(blocks), err)
+	}
+
+	c.imut.Lock()
+	maxBatch := c.maxBatch
+	c.imut.Unlock()
+	if len(blocks) == 0 || len(blocks) > maxBatch {
+		return c.requestEach(repo, name, blocks)
+	}
+
+	var id int
+	select {
+	case id = <-c.nextID:
+	case <-c.closed:
+		return batchError(len(blocks), ErrClosed)
+	}
+
+	c.imut.Lock()
+	if ch := c.awaiting[id]; ch != nil {
+		panic("id taken")
+	}
+	rc := make(chan asyncResult)
+	c.awaiting[id] = rc
+	c.imut.Unlock()
+
+	ok := c.send(header{0, id, messageTypeMultiRequest},
+		MultiRequestMessage{repo, name, blocks})
+	if !ok {
+		return batchError(len(blocks), ErrClosed)
+	}
+
+	res, ok := <-rc
+	switch {
+	case !ok:
+		return batchError(len(blocks), ErrClosed)
+	case res.err != nil:
+		return batchError(len(blocks), res.err)
+	case len(res.blocks) != len(blocks):
+		return batchError(len(blocks), fmt.Errorf("protocol error: %d blocks in response to request for %d", len(res.blocks), len(blocks)))
+	}
+	return res.blocks
+}
+
+// requestEach requests the blocks with one request message each.
+func (c *rawConnection) requestEach(repo string, name string, blocks []RequestBlock) []BlockResult {
+	res := make([]BlockResult, len(blocks))
+	var wg sync.WaitGroup
+	for i := range blocks {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			b := blocks[i]
+			data, err := c.Request(repo, name, int64(b.Offset), int(b.Size))
+			if err == nil && len(data) != int(b.Size) {
+				// Request messages carry no error; the peer responds with no
+				// data.
+				err = ErrBlockUnavailable
+			}
+			res[i] = BlockResult{data, err}
+		}(i)
+	}
+	wg.Wait()
+	return res
+}
+
+func checkBatch(blocks []RequestBlock) error {
+	if len(blocks) > MaxBatchBlocks {
+		return fmt.Errorf("batch of %d blocks exceeds maximum of %d", len(blocks), MaxBatchBlocks)
+	}
+	var size int
+	for _, b := range blocks {
+		if b.Size > MaxRequestSize {
+			return fmt.Errorf("request size %d out of range", b.Size)
+		}
+		size += int(b.Size)
+	}
+	if size > MaxBatchSize {
+		return fmt.Errorf("batch size %d exceeds maximum of %d", size, MaxBatchSize)
+	}
+	return nil
+}
+
+func batchError(n int, err error) []BlockResult {
+	res := make([]BlockResult, n)
+	for i := range res {
+		res[i].Err = err
+	}
+	return res
+}
+
+func (c *rawConnection) handleMultiRequest(hdr header) error {
+	var req MultiRequestMessage
+	req.decodeXDR(c.xr)
+	if err := c.xr.Error(); err != nil {
+		return err
+	}
+	go c.processMultiRequest(hdr.msgID, req)
+	return nil
+}
+
+func (c *rawConnection) handleMultiResponse(hdr header) error {
+	var res MultiResponseMessage
+	res.decodeXDR(c.xr)
+	if err := c.xr.Error(); err != nil {
+		return err
+	}
+
+	go func(hdr header) {
+		blocks := make([]BlockResult, len(res.Blocks))
+		for i, b := range res.Blocks {
+			blocks[i] = b.result()
+		}
+
+		c.imut.Lock()
+		rc := c.awaiting[hdr.msgID]
+		c.awaiting[hdr.msgID] = nil
+		c.imut.Unlock()
+
+		if rc != nil {
+			rc <- asyncResult{blocks: blocks}
+			close(rc)
+		}
+	}(hdr)
+
+	return nil
+}
+
+// result returns the outcome of requesting the block.
+func (b ResponseBlock) result() BlockResult {
+	switch b.Code {
+	case blockCodeOK:
+		data, err := ResponseMessage{b.Encoding, b.Data}.data()
+		return BlockResult{data, err}
+	case blockCodeUnavailable:
+		return BlockResult{Err: ErrBlockUnavailable}
+	case blockCodeChanged:
+		return BlockResult{Err: ErrBlockChanged}
+	default:
+		return BlockResult{Err: fmt.Errorf("protocol error: unknown block code %d", b.Code)}
+	}
+}
+
+func (c *rawConnection) processMultiRequest(msgID int, req MultiRequestMessage) {
+	c.imut.Lock()
+	compress := c.blockCompress
+	c.imut.Unlock()
+
+	res := MultiResponseMessage{Blocks: make([]ResponseBlock, len(req.Blocks))}
+	var size int
+	for i, b := range req.Blocks {
+		// The size is checked before it is added, as a size beyond the
+		// range of int would wrap around to a negative count on 32 bit
+		// platforms.
+		if b.Size > MaxRequestSize || size+int(b.Size) > MaxBatchSize {
+			res.Blocks[i].Code = blockCodeUnavailable
+			continue
+		}
+		size += int(b.Size)
+
+		data, err := c.receiver.Request(c.id, req.Repository, req.Name, int64(b.Offset), int(b.Size))
+		switch {
+		case err == ErrBlockChanged:
+			res.Blocks[i].Code = blockCodeChanged
+		case err != nil || len(data) != int(b.Size):
+			res.Blocks[i].Code = blockCodeUnavailable
+		case len(b.Hash) > 0 && !hashMatches(data, b.Hash):
+			res.Blocks[i].Code = blockCodeChanged
+		case compress:
+			cr := compressedResponse(data)
+			res.Blocks[i] = ResponseBlock{blockCodeOK, cr.Encoding, cr.Data}
+		default:
+			res.Blocks[i] = ResponseBlock{blockCodeOK, encodingNone, data}
+		}
+	}
+
+	c.send(header{0, msgID, messageTypeMultiResponse}, res)
+}
+
+func hashMatches(data, hash []byte) bool {
+	h := sha256.Sum256(data)
+	return bytes.Equal(h[:], hash)
+}
+
+// PeerMaxBatch returns the most blocks that the peer that sent the cluster
+// config accepts in one batch request, or zero if it doesn't accept batch
+// requests.
+func PeerMaxBatch(cm ClusterConfigMessage) int {
+	v, err := strconv.Atoi(optionValue(cm.Options, multiRequestOptionKey))
+	if err != nil || v < 0 {
+		return 0
+	}
+	if v > MaxBatchBlocks {
+		return MaxBatchBlocks
+	}
+	return v
+}
@@ -0,0 +1,233 @@
+package protocol
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"errors"
+	"io"
+	"math/rand"
+	"sync"
+	"testing"
+	"time"
+)
+
+// fileModel serves requests from the contents of a single file.
+type fileModel struct {
+	*TestModel
+	data []byte
+}
+
+func (m *fileModel) Request(nodeID, repo, name string, offset int64, size int) ([]byte, error) {
+	if offset+int64(size) > int64(len(m.data)) {
+		return nil, errors.New("no such block")
+	}
+	return m.data[offset : offset+int64(size)], nil
+}
+
+// latencyWriter delays the delivery of written data, as a link with
+// latency but no bandwidth limit would.
+type latencyWriter struct {
+	chunks chan latencyChunk
+	delay  time.Duration
+}
+
+type latencyChunk struct {
+	data []byte
+	due  time.Time
+}
+
+func newLatencyWriter(w io.Writer, delay time.Duration) latencyWriter {
+	lw := latencyWriter{make(chan latencyChunk, 4096), delay}
+	go func() {
+		for c := range lw.chunks {
+			time.Sleep(c.due.Sub(time.Now()))
+			w.Write(c.data)
+		}
+	}()
+	return lw
+}
+
+func (w latencyWriter) Write(bs []byte) (int, error) {
+	w.chunks <- latencyChunk{append([]byte(nil), bs...), time.Now().Add(w.delay)}
+	return len(bs), nil
+}
+
+// batchConns returns a connection that requests from the model over a link
+// with the given latency, with the multi request option negotiated if
+// requested.
+func batchConns(t testing.TB, m Model, delay time.Duration, negotiated bool) *rawConnection {
+	ar, aw := io.Pipe()
+	br, bw := io.Pipe()
+
+	c0 := NewConnection("c0", ar, newLatencyWriter(bw, delay), m).(wireFormatConnection).next.(*rawConnection)
+	c1 := NewConnection("c1", br, newLatencyWriter(aw, delay), newTestModel()).(wireFormatConnection).next.(*rawConnection)
+
+	if negotiated {
+		c0.ClusterConfig(ClusterConfigMessage{})
+		for j := 0; j < 100; j++ {
+			c1.imut.Lock()
+			n := c1.maxBatch
+			c1.imut.Unlock()
+			if n > 0 {
+				return c1
+			}
+			time.Sleep(10 * time.Millisecond)
+		}
+		t.Fatal("Multi request option not negotiated")
+	}
+	return c1
+}
+
+func testFile(blocks int) ([]byte, []RequestBlock) {
+	data := make([]byte, blocks*BlockSize)
+	rand.New(rand.NewSource(42)).Read(data)
+	reqs := make([]RequestBlock, blocks)
+	for i := range reqs {
+		offset := i * BlockSize
+		hash := sha256.Sum256(data[offset : offset+BlockSize])
+		reqs[i] = RequestBlock{uint64(offset), BlockSize, hash[:]}
+	}
+	return data, reqs
+}
+
+func TestRequestBatch(t *testing.T) {
+	for _, negotiated := range []bool{true, false} {
+		data, reqs := testFile(4)
+		c := batchConns(t, &fileModel{newTestModel(), data}, 0, negotiated)
+
+		// Every other block is requested, along with one past the end of the
+		// file.
+		reqs = append(reqs[:1], reqs[2], RequestBlock{Offset: uint64(len(data)), Size: BlockSize})
+		res := c.RequestBatch("default", "foo", reqs)
+		if len(res) != len(reqs) {
+			t.Fatalf("%d results for %d blocks", len(res), len(reqs))
+		}
+		for i, r := range res[:2] {
+			offset := reqs[i].Offset
+			if r.Err != nil {
+				t.Errorf("Block at %d: unexpected error %v", offset, r.Err)
+			} else if !bytes.Equal(r.Data, data[offset:offset+BlockSize]) {
+				t.Errorf("Block at %d: incorrect data received", offset)
+			}
+		}
+		if res[2].Err != ErrBlockUnavailable {
+			t.Errorf("Block past the end: %v, expected %v", res[2].Err, ErrBlockUnavailable)
+		}
+	}
+}
+
+func TestRequestBatchChanged(t *testing.T) {
+	data, reqs := testFile(2)
+	c := batchConns(t, &fileModel{newTestModel(), data}, 0, true)
+
+	// The second block has changed since it was announced.
+	data[BlockSize] ^= 0xff
+
+	res := c.RequestBatch("default", "foo", reqs)
+	if res[0].Err != nil {
+		t.Errorf("Unchanged block: unexpected error %v", res[0].Err)
+	}
+	if res[1].Err != ErrBlockChanged {
+		t.Errorf("Changed block: %v, expected %v", res[1].Err, ErrBlockChanged)
+	}
+}
+
+// changedModel refuses every request, as the data has changed since the
+// file was announced.
+type changedModel struct {
+	*TestModel
+}
+
+func (m changedModel) Request(nodeID, repo, name string, offset int64, size int) ([]byte, error) {
+	return nil, ErrBlockChanged
+}
+
+func TestRequestBatchChangedAtPeer(t *testing.T) {
+	_, reqs := testFile(1)
+	c := batchConns(t, changedModel{newTestModel()}, 0, true)
+
+	res := c.RequestBatch("default", "foo", reqs)
+	if res[0].Err != ErrBlockChanged {
+		t.Errorf("Changed block: %v, expected %v", res[0].Err, ErrBlockChanged)
+	}
+}
+
+func TestRequestBatchLimits(t *testing.T) {
+	c := batchConns(t, newTestModel(), 0, true)
+
+	tooMany := make([]RequestBlock, MaxBatchBlocks+1)
+	tooLarge := []RequestBlock{{Size: MaxRequestSize + 1}}
+	for _, reqs := range [][]RequestBlock{tooMany, tooLarge} {
+		for _, r := range c.RequestBatch("default", "foo", reqs) {
+			if r.Err == nil {
+				t.Errorf("Batch of %d blocks accepted", len(reqs))
+			}
+		}
+	}
+}
+
+// The blocks of a batch are requested with a single message, so that they
+// arrive after one round trip instead of one per block. The difference in
+// time on a link with latency is shown by the latency benchmarks.
+func TestRequestBatchRoundTrips(t *testing.T) {
+	data, reqs := testFile(MaxBatchBlocks)
+	c := batchConns(t, &fileModel{newTestModel(), data}, 0, true)
+
+	var mut sync.Mutex
+	sent := make(map[int]int)
+	c.SetTracer(func(dir Direction, msgType int, msgID int, size int) {
+		if dir == DirectionOut {
+			mut.Lock()
+			sent[msgType]++
+			mut.Unlock()
+		}
+	})
+
+	for _, r := range c.RequestBatch("default", "foo", reqs) {
+		if r.Err != nil {
+			t.Fatal(r.Err)
+		}
+	}
+
+	// Trace events are delivered asynchronously, in order.
+	for i := 0; i < 100; i++ {
+		mut.Lock()
+		done := sent[messageTypeMultiRequest] > 0
+		mut.Unlock()
+		if done {
+			break
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	mut.Lock()
+	defer mut.Unlock()
+	if n := sent[messageTypeMultiRequest]; n != 1 {
+		t.Errorf("%d multi request messages for a batch of %d blocks, expected 1", n, len(reqs))
+	}
+	if n := sent[messageTypeRequest]; n != 0 {
+		t.Errorf("%d request messages for a batch of %d blocks, expected 0", n, len(reqs))
+	}
+}
+
+func BenchmarkRequestBatchLatency(b *testing.B) {
+	data, reqs := testFile(MaxBatchBlocks)
+	c := batchConns(b, &fileModel{newTestModel(), data}, time.Millisecond, true)
+	b.SetBytes(int64(len(data)))
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		c.RequestBatch("default", "foo", reqs)
+	}
+}
+
+func BenchmarkRequestSequentialLatency(b *testing.B) {
+	data, reqs := testFile(MaxBatchBlocks)
+	c := batchConns(b, &fileModel{newTestModel(), data}, time.Millisecond, true)
+	b.SetBytes(int64(len(data)))
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		for _, r := range reqs {
+			c.Request("default", "foo", int64(r.Offset), int(r.Size))
+		}
+	}
+}
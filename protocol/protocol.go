@@ -6,7 +6,9 @@ import (
 	"errors"
 	"fmt"
 	"io"
+	"strconv"
 	"sync"
+	"sync/atomic"
 	"time"
 
 	"github.com/calmh/syncthing/xdr"
@@ -14,6 +16,13 @@ import (
 
 const BlockSize = 128 * 1024
 
+// The largest amount of data that may be requested in one request. A request
+// may span block boundaries, as long as it is no larger than this and than
+// what the peer announces, see PeerMaxRequestSize.
+const MaxRequestSize = 4 * BlockSize
+
+const maxRequestSizeOptionKey = "max-request-size"
+
 const (
 	messageTypeClusterConfig = 0
 	messageTypeIndex         = 1
@@ -22,18 +31,75 @@ const (
 	messageTypePing          = 4
 	messageTypePong          = 5
 	messageTypeIndexUpdate   = 6
+	messageTypeIndexSequence = 7
+	messageTypeMultiRequest  = 8
+	messageTypeMultiResponse = 9
+	messageTypeRoot          = 10
+)
+
+// The highest supported message version for index and index update
+// messages. Version 1 adds the whole file hash and version 2 the creation
+// time. Response messages also have a version 1, see
+// responseMessageVersion. All other messages are version 0.
+const indexMessageVersion = 2
+
+// The index message version option is announced in the cluster config
+// message and holds the highest index message version the node accepts.
+const indexVersionOptionKey = "index-version"
+
+// The index sequence option is announced in the cluster config message by
+// nodes that accept index sequence messages.
+const (
+	indexSequenceOptionKey = "index-sequence"
+	indexSequenceVersion   = "1"
 )
 
+// Set in an index sequence message to ask the peer to start over with a full
+// index for the repository.
+const indexSequenceResend uint32 = 1 << 0
+
 const (
 	FlagDeleted   uint32 = 1 << 12
 	FlagInvalid          = 1 << 13
 	FlagDirectory        = 1 << 14
+	FlagEncrypted        = 1 << 15
+	FlagSymlink          = 1 << 16
+
+	// When FlagInvalid is set, the top eight bits carry the reason for the
+	// file being invalid.
+	FlagInvalidReason uint32 = 0xff << invalidReasonShift
 )
 
+const invalidReasonShift = 24
+
 const (
-	FlagShareTrusted  uint32 = 1 << 0
-	FlagShareReadOnly        = 1 << 1
-	FlagShareBits            = 0x000000ff
+	InvalidReasonUnknown uint32 = iota
+	InvalidReasonSuppressed
+	InvalidReasonUnreadable
+	InvalidReasonBadName
+	InvalidReasonChanged
+	InvalidReasonUnavailable
+	InvalidReasonPlaceholder
+	InvalidReasonFiltered
+	InvalidReasonSettling
+)
+
+// InvalidReason returns the invalid reason code carried in flags.
+func InvalidReason(flags uint32) uint32 {
+	return (flags & FlagInvalidReason) >> invalidReasonShift
+}
+
+// InvalidReasonFlags returns the flag bits that represent the given invalid
+// reason code.
+func InvalidReasonFlags(reason uint32) uint32 {
+	return (reason << invalidReasonShift) & FlagInvalidReason
+}
+
+const (
+	FlagShareTrusted   uint32 = 1 << 0
+	FlagShareReadOnly         = 1 << 1
+	FlagShareUntrusted        = 1 << 2
+	FlagShareBits             = 0x000000ff
 )
 
 var (
@@ -54,40 +120,125 @@ type Model interface {
 	Close(nodeID string, err error)
 }
 
+// A ConnectionCloser is a Model that is told which connection was closed,
+// as there may be more than one to the same node. ConnectionClosed is called
+// instead of Close.
+type ConnectionCloser interface {
+	ConnectionClosed(conn Connection, err error)
+}
+
+// A MessageReceiver is a Model that is told whenever a message of any kind,
+// pings included, has been received from the peer node. MessageReceived is
+// called from the connection's read loop and must not block.
+type MessageReceiver interface {
+	MessageReceived(nodeID string)
+}
+
 type Connection interface {
 	ID() string
 	Index(repo string, files []FileInfo)
+	IndexUpdate(repo string, files []FileInfo)
 	Request(repo string, name string, offset int64, size int) ([]byte, error)
+	RequestBatch(repo string, name string, blocks []RequestBlock) []BlockResult
+	Root(repo string, root []byte)
+	PeerRoot(repo string) []byte
+	RequestIndex(repo string)
 	ClusterConfig(config ClusterConfigMessage)
 	Statistics() Statistics
+	SetTracer(t Tracer)
 }
 
+// Direction tells whether a traced message was received or sent.
+type Direction int
+
+const (
+	DirectionIn Direction = iota
+	DirectionOut
+)
+
+// A Tracer is called once for every message received or sent on a
+// connection. The message type is the numeric type from the message header
+// and size is the uncompressed length of the message, including the header.
+// Tracers are called from a separate goroutine; if the tracer falls behind,
+// trace events are dropped rather than stalling the connection.
+type Tracer func(dir Direction, msgType int, msgID int, size int)
+
 type rawConnection struct {
+	// Accessed atomically and first in the struct for alignment on 32 bit
+	// platforms.
+	inBytes  [messageTypeRoot + 1]uint64
+	outBytes [messageTypeRoot + 1]uint64
+
 	id       string
 	receiver Model
+	closer   ConnectionCloser // the receiver, if it wants to know the connection
+	activity MessageReceiver  // the receiver, if it wants to know of every message
+	wrapped  Connection       // this connection as handed out by NewConnection
 
 	reader io.ReadCloser
 	cr     *countingReader
 	xr     *xdr.Reader
-	writer io.WriteCloser
-
-	cw   *countingWriter
-	wb   *bufio.Writer
-	xw   *xdr.Writer
-	wmut sync.Mutex
+	writer *flate.Writer // nil once closed
+
+	cw    *countingWriter
+	wb    *bufio.Writer
+	xw    *xdr.Writer
+	wdict bool // the write stream uses the preset dictionary
+	wmut  sync.Mutex
+
+	// The connection holds one of the limited places for compressing
+	// connections, and so compresses its write stream and response data.
+	// Set when the connection is made.
+	compress bool
+
+	indexSent     map[string]map[string][2]int64
+	indexVersion  int                   // highest index message version accepted by the peer
+	indexSeq      map[string]uint64     // index messages sent since the last full index
+	indexRecv     map[string]uint64     // index messages received since the last full index
+	indexLast     map[string][]FileInfo // the latest index passed to Index, with the updates since
+	indexSequence bool                  // the peer accepts index sequence messages
+	blockCompress bool                  // the peer accepts compressed response data
+	maxBatch      int                   // most blocks the peer accepts in a multi request
+	peerRoots     bool                  // the peer accepts root messages
+	rootLocal     map[string][]byte     // the latest root given to Root
+	rootSent      map[string][]byte     // the latest root sent to the peer
+	rootPeer      map[string][]byte     // the latest root received from the peer
+	awaiting      []chan asyncResult
+	imut          sync.Mutex
+
+	// Held while sending index and index sequence messages, so that the
+	// sequence numbers sent match the order of the index messages on the
+	// wire.
+	smut sync.Mutex
+
+	nextID  chan int
+	outbox  chan []encodable
+	indexes chan indexBatch
+	closed  chan struct{}
+
+	tracer Tracer
+	traces chan traceEvent
+	tmut   sync.Mutex
+}
 
-	indexSent map[string]map[string][2]int64
-	awaiting  []chan asyncResult
-	imut      sync.Mutex
+type traceEvent struct {
+	dir     Direction
+	msgType int
+	msgID   int
+	size    int
+}
 
-	nextID chan int
-	outbox chan []encodable
-	closed chan struct{}
+// An indexBatch is a received index or index update, waiting to be passed
+// to the model.
+type indexBatch struct {
+	update bool
+	msg    IndexMessage
 }
 
 type asyncResult struct {
-	val []byte
-	err error
+	val    []byte
+	blocks []BlockResult // of a multi request
+	err    error
 }
 
 const (
@@ -95,15 +246,21 @@ const (
 	pingIdleTime = 5 * time.Minute
 )
 
+const traceBufferSize = 256
+
+// The number of received index messages that may wait for the model before
+// the read loop stops reading from the connection.
+const indexQueueSize = 64
+
 func NewConnection(nodeID string, reader io.Reader, writer io.Writer, receiver Model) Connection {
 	cr := &countingReader{Reader: reader}
 	cw := &countingWriter{Writer: writer}
 
-	flrd := flate.NewReader(cr)
-	flwr, err := flate.NewWriter(cw, flate.BestSpeed)
-	if err != nil {
-		panic(err)
-	}
+	// The flate reader must not read past the end of a stream, so that it
+	// can be restarted with the preset dictionary.
+	flrd := newDictionaryReader(bufio.NewReader(cr))
+	compress := acquireCompression()
+	flwr := getStreamWriter(cw, false, compress)
 	wb := bufio.NewWriter(flwr)
 
 	c := rawConnection{
@@ -116,19 +273,32 @@ func NewConnection(nodeID string, reader io.Reader, writer io.Writer, receiver M
 		cw:        cw,
 		wb:        wb,
 		xw:        xdr.NewWriter(wb),
+		compress:  compress,
 		awaiting:  make([]chan asyncResult, 0x1000),
 		indexSent: make(map[string]map[string][2]int64),
+		indexSeq:  make(map[string]uint64),
+		indexRecv: make(map[string]uint64),
+		indexLast: make(map[string][]FileInfo),
+		rootLocal: make(map[string][]byte),
+		rootSent:  make(map[string][]byte),
+		rootPeer:  make(map[string][]byte),
 		outbox:    make(chan []encodable),
+		indexes:   make(chan indexBatch, indexQueueSize),
 		nextID:    make(chan int),
 		closed:    make(chan struct{}),
 	}
 
+	c.wrapped = wireFormatConnection{&c}
+	c.closer, _ = receiver.(ConnectionCloser)
+	c.activity, _ = receiver.(MessageReceiver)
+
 	go c.readerLoop()
 	go c.writerLoop()
+	go c.indexLoop()
 	go c.pingerLoop()
 	go c.idGenerator()
 
-	return wireFormatConnection{&c}
+	return c.wrapped
 }
 
 func (c *rawConnection) ID() string {
@@ -137,7 +307,64 @@ func (c *rawConnection) ID() string {
 
 // Index writes the list of file information to the connected peer node
 func (c *rawConnection) Index(repo string, idx []FileInfo) {
+	c.smut.Lock()
+	defer c.smut.Unlock()
+
+	c.index(repo, idx)
+}
+
+// IndexUpdate writes the files to the connected peer node as an update to
+// the index sent before, or as the index if none has been sent yet. Unlike
+// Index, only the given files are compared to what has been sent.
+func (c *rawConnection) IndexUpdate(repo string, files []FileInfo) {
+	c.smut.Lock()
+	defer c.smut.Unlock()
+
 	c.imut.Lock()
+	if c.indexSent[repo] == nil {
+		c.imut.Unlock()
+		c.index(repo, files)
+		return
+	}
+	// Retained for a resend, as in index, without modifying the caller's
+	// slices.
+	last := c.indexLast[repo]
+	c.indexLast[repo] = append(last[:len(last):len(last)], files...)
+	diff := c.unsent(repo, files)
+	version := c.indexVersion
+	c.imut.Unlock()
+
+	c.sendIndex(repo, messageTypeIndexUpdate, diff, version)
+}
+
+// resendIndex sends the latest index for the repository as a full index,
+// after the peer has told us that it lost track of our updates.
+func (c *rawConnection) resendIndex(repo string) {
+	c.smut.Lock()
+	defer c.smut.Unlock()
+
+	c.imut.Lock()
+	idx, ok := c.indexLast[repo]
+	delete(c.indexSent, repo)
+	c.imut.Unlock()
+
+	if ok {
+		l.Printf("%s: %q: resending full index (%d files) on request", c.id, repo, len(idx))
+		c.index(repo, idx)
+	}
+}
+
+// RequestIndex asks the peer to send its full index for the repository
+// again, replacing whatever we have received of it so far.
+func (c *rawConnection) RequestIndex(repo string) {
+	c.send(header{0, -1, messageTypeIndexSequence}, IndexSequenceMessage{Repository: repo, Flags: indexSequenceResend})
+}
+
+func (c *rawConnection) index(repo string, idx []FileInfo) {
+	c.imut.Lock()
+	// The index is retained in case the peer asks for it to be resent. It
+	// is not modified after this point, here or by the caller.
+	c.indexLast[repo] = idx
 	var msgType int
 	if c.indexSent[repo] == nil {
 		// This is the first time we send an index.
@@ -150,22 +377,56 @@ func (c *rawConnection) Index(repo string, idx []FileInfo) {
 	} else {
 		// We have sent one full index. Only send updates now.
 		msgType = messageTypeIndexUpdate
-		var diff []FileInfo
-		for _, f := range idx {
-			if vs, ok := c.indexSent[repo][f.Name]; !ok || f.Modified != vs[0] || int64(f.Version) != vs[1] {
-				diff = append(diff, f)
-				c.indexSent[repo][f.Name] = [2]int64{f.Modified, int64(f.Version)}
-			}
-		}
-		idx = diff
+		idx = c.unsent(repo, idx)
 	}
+	version := c.indexVersion
 	c.imut.Unlock()
 
-	c.send(header{0, -1, msgType}, IndexMessage{repo, idx})
+	c.sendIndex(repo, msgType, idx, version)
+}
+
+// unsent returns the files that differ from what has been sent of the
+// repository, and records them as sent. Must be called with imut held.
+func (c *rawConnection) unsent(repo string, idx []FileInfo) []FileInfo {
+	var diff []FileInfo
+	for _, f := range idx {
+		if vs, ok := c.indexSent[repo][f.Name]; !ok || f.Modified != vs[0] || int64(f.Version) != vs[1] {
+			diff = append(diff, f)
+			c.indexSent[repo][f.Name] = [2]int64{f.Modified, int64(f.Version)}
+		}
+	}
+	return diff
+}
+
+// sendIndex sends the index message of the given type and counts it in the
+// index sequence.
+func (c *rawConnection) sendIndex(repo string, msgType int, idx []FileInfo, version int) {
+	if version < 0 {
+		version = 0
+	}
+	ok := c.send(header{version, -1, msgType}, versionedIndex(IndexMessage{repo, idx}, version))
+
+	if ok {
+		c.imut.Lock()
+		if msgType == messageTypeIndex {
+			c.indexSeq[repo] = 1
+		} else {
+			c.indexSeq[repo]++
+		}
+		c.imut.Unlock()
+	}
 }
 
 // Request returns the bytes for the specified block after fetching them from the connected peer.
 func (c *rawConnection) Request(repo string, name string, offset int64, size int) ([]byte, error) {
+	if size < 0 || size > MaxRequestSize {
+		return nil, fmt.Errorf("request size %d out of range", size)
+	}
+	if offset < 0 {
+		// Would wrap around to an offset beyond any file on the wire
+		return nil, fmt.Errorf("request offset %d out of range", offset)
+	}
+
 	var id int
 	select {
 	case id = <-c.nextID:
@@ -196,6 +457,16 @@ func (c *rawConnection) Request(repo string, name string, offset int64, size int
 
 // ClusterConfig send the cluster configuration message to the peer and returns any error
 func (c *rawConnection) ClusterConfig(config ClusterConfigMessage) {
+	opts := make([]Option, len(config.Options), len(config.Options)+6)
+	copy(opts, config.Options)
+	config.Options = append(opts,
+		Option{dictionaryOptionKey, dictionaryVersion},
+		Option{indexVersionOptionKey, strconv.Itoa(indexMessageVersion)},
+		Option{indexSequenceOptionKey, indexSequenceVersion},
+		Option{maxRequestSizeOptionKey, strconv.Itoa(MaxRequestSize)},
+		Option{blockCompressionOptionKey, blockCompressionVersion},
+		Option{multiRequestOptionKey, strconv.Itoa(MaxBatchBlocks)},
+		Option{rootOptionKey, rootVersion})
 	c.send(header{0, -1, messageTypeClusterConfig}, config)
 }
 
@@ -233,23 +504,25 @@ func (c *rawConnection) readerLoop() (err error) {
 		default:
 		}
 
+		start := c.xr.Tot()
+
 		var hdr header
 		hdr.decodeXDR(c.xr)
 		if err := c.xr.Error(); err != nil {
 			return err
 		}
-		if hdr.version != 0 {
+		if hdr.version > maxMessageVersion(hdr.msgType) {
 			return fmt.Errorf("protocol error: %s: unknown message version %#x", c.id, hdr.version)
 		}
 
 		switch hdr.msgType {
 		case messageTypeIndex:
-			if err := c.handleIndex(); err != nil {
+			if err := c.handleIndex(hdr); err != nil {
 				return err
 			}
 
 		case messageTypeIndexUpdate:
-			if err := c.handleIndexUpdate(); err != nil {
+			if err := c.handleIndexUpdate(hdr); err != nil {
 				return err
 			}
 
@@ -274,40 +547,109 @@ func (c *rawConnection) readerLoop() (err error) {
 				return err
 			}
 
+		case messageTypeIndexSequence:
+			if err := c.handleIndexSequence(); err != nil {
+				return err
+			}
+
+		case messageTypeMultiRequest:
+			if err := c.handleMultiRequest(hdr); err != nil {
+				return err
+			}
+
+		case messageTypeMultiResponse:
+			if err := c.handleMultiResponse(hdr); err != nil {
+				return err
+			}
+
+		case messageTypeRoot:
+			if err := c.handleRoot(); err != nil {
+				return err
+			}
+
 		default:
 			return fmt.Errorf("protocol error: %s: unknown message type %#x", c.id, hdr.msgType)
 		}
+
+		c.account(DirectionIn, hdr, c.xr.Tot()-start)
+		if c.activity != nil {
+			c.activity.MessageReceived(c.id)
+		}
+	}
+}
+
+func maxMessageVersion(msgType int) int {
+	switch msgType {
+	case messageTypeIndex, messageTypeIndexUpdate:
+		return indexMessageVersion
+	case messageTypeResponse:
+		return responseMessageVersion
+	default:
+		return 0
 	}
 }
 
-func (c *rawConnection) handleIndex() error {
-	var im IndexMessage
-	im.decodeXDR(c.xr)
+func (c *rawConnection) readIndex(hdr header) IndexMessage {
+	return decodeIndex(c.xr, hdr.version)
+}
+
+func (c *rawConnection) handleIndex(hdr header) error {
+	im := c.readIndex(hdr)
 	if err := c.xr.Error(); err != nil {
 		return err
 	} else {
+		c.imut.Lock()
+		c.indexRecv[im.Repository] = 1
+		c.imut.Unlock()
 
-		// We run this (and the corresponding one for update, below)
-		// in a separate goroutine to avoid blocking the read loop.
-		// There is otherwise a potential deadlock where both sides
-		// has the model locked because it's sending a large index
-		// update and can't receive the large index update from the
-		// other side.
-
-		go c.receiver.Index(c.id, im.Repository, im.Files)
+		return c.queueIndex(indexBatch{false, im})
 	}
-	return nil
 }
 
-func (c *rawConnection) handleIndexUpdate() error {
-	var im IndexMessage
-	im.decodeXDR(c.xr)
+func (c *rawConnection) handleIndexUpdate(hdr header) error {
+	im := c.readIndex(hdr)
 	if err := c.xr.Error(); err != nil {
 		return err
 	} else {
-		go c.receiver.IndexUpdate(c.id, im.Repository, im.Files)
+		c.imut.Lock()
+		c.indexRecv[im.Repository]++
+		c.imut.Unlock()
+
+		return c.queueIndex(indexBatch{true, im})
+	}
+}
+
+// queueIndex passes a received index to the index loop. We don't hand it to
+// the model from the read loop, since applying a large index can take a
+// while and responses to our requests would queue up behind it. There is
+// also a potential deadlock where both sides have the model locked because
+// they're sending a large index update and can't receive the large index
+// update from the other side. The read loop blocks only when the queue is
+// full.
+func (c *rawConnection) queueIndex(b indexBatch) error {
+	select {
+	case c.indexes <- b:
+		return nil
+	case <-c.closed:
+		return ErrClosed
+	}
+}
+
+// indexLoop hands received indexes to the model, one at a time and in the
+// order they were received.
+func (c *rawConnection) indexLoop() {
+	for {
+		select {
+		case b := <-c.indexes:
+			if b.update {
+				c.receiver.IndexUpdate(c.id, b.msg.Repository, b.msg.Files)
+			} else {
+				c.receiver.Index(c.id, b.msg.Repository, b.msg.Files)
+			}
+		case <-c.closed:
+			return
+		}
 	}
-	return nil
 }
 
 func (c *rawConnection) handleRequest(hdr header) error {
@@ -321,23 +663,30 @@ func (c *rawConnection) handleRequest(hdr header) error {
 }
 
 func (c *rawConnection) handleResponse(hdr header) error {
-	data := c.xr.ReadBytesMax(256 * 1024) // Sufficiently larger than max expected block size
+	var res ResponseMessage
+	if hdr.version == 0 {
+		res.Data = c.xr.ReadBytesMax(MaxRequestSize)
+	} else {
+		res.decodeXDR(c.xr)
+	}
 
 	if err := c.xr.Error(); err != nil {
 		return err
 	}
 
-	go func(hdr header, err error) {
+	go func(hdr header) {
+		data, err := res.data()
+
 		c.imut.Lock()
 		rc := c.awaiting[hdr.msgID]
 		c.awaiting[hdr.msgID] = nil
 		c.imut.Unlock()
 
 		if rc != nil {
-			rc <- asyncResult{data, err}
+			rc <- asyncResult{val: data, err: err}
 			close(rc)
 		}
-	}(hdr, c.xr.Error())
+	}(hdr)
 
 	return nil
 }
@@ -361,11 +710,108 @@ func (c *rawConnection) handleClusterConfig() error {
 	if err := c.xr.Error(); err != nil {
 		return err
 	} else {
+		if v, err := strconv.Atoi(optionValue(cm.Options, indexVersionOptionKey)); err == nil {
+			if v > indexMessageVersion {
+				v = indexMessageVersion
+			}
+			c.imut.Lock()
+			c.indexVersion = v
+			c.imut.Unlock()
+		}
+		if optionValue(cm.Options, indexSequenceOptionKey) == indexSequenceVersion {
+			c.imut.Lock()
+			c.indexSequence = true
+			c.imut.Unlock()
+		}
+		if optionValue(cm.Options, blockCompressionOptionKey) == blockCompressionVersion {
+			c.imut.Lock()
+			c.blockCompress = c.compress
+			c.imut.Unlock()
+		}
+		c.imut.Lock()
+		c.maxBatch = PeerMaxBatch(cm)
+		c.imut.Unlock()
+		if optionValue(cm.Options, rootOptionKey) == rootVersion {
+			c.imut.Lock()
+			accepted := !c.peerRoots
+			c.peerRoots = true
+			c.imut.Unlock()
+			if accepted {
+				go c.sendRoots()
+			}
+		}
+		if optionValue(cm.Options, dictionaryOptionKey) == dictionaryVersion {
+			// Switching writes to the peer, which must not block the read
+			// loop.
+			go func() {
+				if err := c.useDictionary(); err != nil {
+					c.close(err)
+				}
+			}()
+		}
 		go c.receiver.ClusterConfig(c.id, cm)
 	}
 	return nil
 }
 
+func (c *rawConnection) handleIndexSequence() error {
+	var sm IndexSequenceMessage
+	sm.decodeXDR(c.xr)
+	if err := c.xr.Error(); err != nil {
+		return err
+	}
+
+	if sm.Flags&indexSequenceResend != 0 {
+		// Sending the index must not block the read loop.
+		go c.resendIndex(sm.Repository)
+		return nil
+	}
+
+	// The peer's index messages are read in order, so by now we have seen
+	// every index message it sent before this one.
+	c.imut.Lock()
+	recv := c.indexRecv[sm.Repository]
+	c.imut.Unlock()
+
+	if recv != sm.Sent {
+		l.Printf("%s: %q: index out of sync (peer sent %d updates, we received %d); requesting full index", c.id, sm.Repository, sm.Sent, recv)
+		c.RequestIndex(sm.Repository)
+	}
+	return nil
+}
+
+// useDictionary ends the current compression stream and starts a new one
+// using the preset dictionary. The peer must have announced that it accepts
+// this.
+func (c *rawConnection) useDictionary() error {
+	c.wmut.Lock()
+	defer c.wmut.Unlock()
+
+	select {
+	case <-c.closed:
+		return ErrClosed
+	default:
+	}
+
+	if c.wdict || !c.compress {
+		// A stored stream has nothing to gain from the dictionary
+		return nil
+	}
+
+	if err := c.wb.Flush(); err != nil {
+		return err
+	}
+	if err := c.writer.Close(); err != nil {
+		return err
+	}
+	putStreamWriter(c.writer, false, true)
+	flwr := getStreamWriter(c.cw, true, true)
+	c.writer = flwr
+	c.wb.Reset(flwr)
+	c.wdict = true
+	return nil
+}
+
 type encodable interface {
 	encodeXDR(*xdr.Writer) (int, error)
 }
@@ -395,24 +841,30 @@ func (c *rawConnection) send(h header, es ...encodable) bool {
 }
 
 func (c *rawConnection) writerLoop() {
-	var err error
-	for es := range c.outbox {
+	for {
+		var es []encodable
+		select {
+		case es = <-c.outbox:
+		case <-c.closed:
+			return
+		}
+
 		c.wmut.Lock()
+		start := c.xw.Tot()
 		for _, e := range es {
 			e.encodeXDR(c.xw)
 		}
 
-		if err = c.flush(); err != nil {
+		if err := c.flush(); err != nil {
 			c.wmut.Unlock()
 			c.close(err)
 			return
 		}
+		size := c.xw.Tot() - start
 		c.wmut.Unlock()
-	}
-}
 
-type flusher interface {
-	Flush() error
+		c.account(DirectionOut, es[0].(header), size)
+	}
 }
 
 func (c *rawConnection) flush() error {
@@ -424,11 +876,10 @@ func (c *rawConnection) flush() error {
 		return err
 	}
 
-	if f, ok := c.writer.(flusher); ok {
-		return f.Flush()
+	if c.writer == nil {
+		return ErrClosed
 	}
-
-	return nil
+	return c.writer.Flush()
 }
 
 func (c *rawConnection) close(err error) {
@@ -450,10 +901,22 @@ func (c *rawConnection) close(err error) {
 			}
 		}
 
+		if c.compress {
+			releaseCompression()
+		}
+		c.blockCompress = false
+
 		c.writer.Close()
+		putStreamWriter(c.writer, c.wdict, c.compress)
+		c.writer = nil
+		c.wb.Reset(closedWriter{})
 		c.reader.Close()
 
-		go c.receiver.Close(c.id, err)
+		if c.closer != nil {
+			go c.closer.ConnectionClosed(c.wrapped, err)
+		} else {
+			go c.receiver.Close(c.id, err)
+		}
 	}
 }
 
@@ -475,6 +938,7 @@ func (c *rawConnection) pingerLoop() {
 	for {
 		select {
 		case <-ticker:
+			go c.sendIndexSequences()
 			go func() {
 				rc <- c.ping()
 			}()
@@ -495,23 +959,210 @@ func (c *rawConnection) pingerLoop() {
 	}
 }
 
+// sendIndexSequences tells the peer how many index messages we have sent for
+// each repository, so that it can detect if it has lost track of our index.
+func (c *rawConnection) sendIndexSequences() {
+	c.smut.Lock()
+	defer c.smut.Unlock()
+
+	c.imut.Lock()
+	if !c.indexSequence {
+		c.imut.Unlock()
+		return
+	}
+	msgs := make([]IndexSequenceMessage, 0, len(c.indexSeq))
+	for repo, seq := range c.indexSeq {
+		msgs = append(msgs, IndexSequenceMessage{Repository: repo, Sent: seq})
+	}
+	c.imut.Unlock()
+
+	for _, msg := range msgs {
+		if !c.send(header{0, -1, messageTypeIndexSequence}, msg) {
+			return
+		}
+	}
+}
+
 func (c *rawConnection) processRequest(msgID int, req RequestMessage) {
 	data, _ := c.receiver.Request(c.id, req.Repository, req.Name, int64(req.Offset), int(req.Size))
 
-	c.send(header{0, msgID, messageTypeResponse},
-		encodableBytes(data))
+	c.imut.Lock()
+	compress := c.blockCompress
+	c.imut.Unlock()
+
+	if compress {
+		c.send(header{1, msgID, messageTypeResponse}, compressedResponse(data))
+	} else {
+		c.send(header{0, msgID, messageTypeResponse}, encodableBytes(data))
+	}
+}
+
+// SetTracer installs a tracer that is called for every message received or
+// sent on the connection. A nil tracer disables tracing.
+func (c *rawConnection) SetTracer(t Tracer) {
+	c.tmut.Lock()
+	defer c.tmut.Unlock()
+
+	c.tracer = t
+	if t != nil && c.traces == nil {
+		c.traces = make(chan traceEvent, traceBufferSize)
+		go c.tracerLoop(c.traces)
+	}
+}
+
+// account attributes the uncompressed size of a message to its message type
+// and passes it on to the tracer, if any.
+func (c *rawConnection) account(dir Direction, hdr header, size int) {
+	counters := &c.inBytes
+	if dir == DirectionOut {
+		counters = &c.outBytes
+	}
+	if hdr.msgType >= 0 && hdr.msgType < len(counters) {
+		atomic.AddUint64(&counters[hdr.msgType], uint64(size))
+	}
+
+	c.trace(dir, hdr, size)
+}
+
+func (c *rawConnection) trace(dir Direction, hdr header, size int) {
+	c.tmut.Lock()
+	if c.tracer == nil {
+		c.tmut.Unlock()
+		return
+	}
+	traces := c.traces
+	c.tmut.Unlock()
+
+	select {
+	case traces <- traceEvent{dir, hdr.msgType, hdr.msgID, size}:
+	default:
+		// The tracer is not keeping up; drop the event.
+	}
+}
+
+func (c *rawConnection) tracerLoop(traces <-chan traceEvent) {
+	for {
+		select {
+		case ev := <-traces:
+			c.tmut.Lock()
+			t := c.tracer
+			c.tmut.Unlock()
+			if t != nil {
+				t(ev.dir, ev.msgType, ev.msgID, ev.size)
+			}
+		case <-c.closed:
+			return
+		}
+	}
 }
 
 type Statistics struct {
-	At            time.Time
-	InBytesTotal  int
-	OutBytesTotal int
+	At                time.Time
+	InBytesTotal      int64
+	OutBytesTotal     int64
+	InBytesByType     MessageStatistics
+	OutBytesByType    MessageStatistics
+	CompressionMemory int64 // estimated bytes held by compression state, zero once closed
+}
+
+// MessageStatistics breaks traffic down by message type. The counts are of
+// uncompressed message bytes including the message header, so they do not
+// sum up to the on-the-wire totals in Statistics.
+type MessageStatistics struct {
+	ClusterConfig int64
+	Index         int64
+	IndexUpdate   int64
+	Request       int64 // single and multi requests
+	Response      int64 // single and multi responses
+	Ping          int64 // ping and pong messages
+	IndexSequence int64 // index sequence and root messages
+}
+
+// Add returns the sum of the two statistics.
+func (s MessageStatistics) Add(o MessageStatistics) MessageStatistics {
+	return MessageStatistics{
+		ClusterConfig: s.ClusterConfig + o.ClusterConfig,
+		Index:         s.Index + o.Index,
+		IndexUpdate:   s.IndexUpdate + o.IndexUpdate,
+		Request:       s.Request + o.Request,
+		Response:      s.Response + o.Response,
+		Ping:          s.Ping + o.Ping,
+		IndexSequence: s.IndexSequence + o.IndexSequence,
+	}
+}
+
+// IndexBytes returns the bytes spent on exchanging indexes and cluster
+// configuration.
+func (s MessageStatistics) IndexBytes() int64 {
+	return s.ClusterConfig + s.Index + s.IndexUpdate + s.IndexSequence
+}
+
+// DataBytes returns the bytes spent on requesting and transferring file
+// data.
+func (s MessageStatistics) DataBytes() int64 {
+	return s.Request + s.Response
+}
+
+// Total returns the bytes of all message types.
+func (s MessageStatistics) Total() int64 {
+	return s.IndexBytes() + s.DataBytes() + s.Ping
 }
 
 func (c *rawConnection) Statistics() Statistics {
 	return Statistics{
-		At:            time.Now(),
-		InBytesTotal:  int(c.cr.Tot()),
-		OutBytesTotal: int(c.cw.Tot()),
+		At:                time.Now(),
+		InBytesTotal:      int64(c.cr.Tot()),
+		OutBytesTotal:     int64(c.cw.Tot()),
+		CompressionMemory: c.compressionMemory(),
+		InBytesByType:     messageStatistics(&c.inBytes),
+		OutBytesByType:    messageStatistics(&c.outBytes),
+	}
+}
+
+func messageStatistics(counters *[messageTypeRoot + 1]uint64) MessageStatistics {
+	load := func(msgType int) int64 {
+		return int64(atomic.LoadUint64(&counters[msgType]))
+	}
+	return MessageStatistics{
+		ClusterConfig: load(messageTypeClusterConfig),
+		Index:         load(messageTypeIndex),
+		IndexUpdate:   load(messageTypeIndexUpdate),
+		Request:       load(messageTypeRequest) + load(messageTypeMultiRequest),
+		Response:      load(messageTypeResponse) + load(messageTypeMultiResponse),
+		Ping:          load(messageTypePing) + load(messageTypePong),
+		IndexSequence: load(messageTypeIndexSequence) + load(messageTypeRoot),
+	}
+}
+
+// PeerMaxRequestSize returns the largest request that the peer that sent the
+// cluster config accepts. Peers that don't announce a maximum accept requests
+// for a single block.
+func PeerMaxRequestSize(cm ClusterConfigMessage) int {
+	v, err := strconv.Atoi(optionValue(cm.Options, maxRequestSizeOptionKey))
+	if err != nil || v < BlockSize {
+		return BlockSize
+	}
+	if v > MaxRequestSize {
+		return MaxRequestSize
+	}
+	return v
+}
+
+// optionValue returns the value of the named option, or the empty string if
+// it is not set.
+func optionValue(opts []Option, key string) string {
+	for _, opt := range opts {
+		if opt.Key == key {
+			return opt.Value
+		}
+	}
+	return ""
+}
+
+// Size returns the size of the file in bytes, as described by its blocks.
+func (f FileInfo) Size() (bytes int64) {
+	for _, b := range f.Blocks {
+		bytes += int64(b.Size)
 	}
+	return
 }
@@ -1,10 +1,15 @@
 package protocol
 
 import (
+	"bytes"
 	"errors"
 	"io"
+	"math/rand"
+	"reflect"
+	"sync"
 	"testing"
 	"testing/quick"
+	"time"
 )
 
 func TestHeaderFunctions(t *testing.T) {
@@ -192,3 +197,803 @@ func TestClose(t *testing.T) {
 		t.Error("Request should return an error")
 	}
 }
+
+// closerModel records the connection it is told has been closed.
+type closerModel struct {
+	*TestModel
+	conns chan Connection
+}
+
+func (m closerModel) ConnectionClosed(conn Connection, err error) {
+	m.conns <- conn
+}
+
+func TestConnectionClosed(t *testing.T) {
+	m0 := closerModel{newTestModel(), make(chan Connection, 1)}
+	m1 := newTestModel()
+
+	ar, aw := io.Pipe()
+	br, bw := io.Pipe()
+
+	c0 := NewConnection("c0", ar, bw, m0)
+	NewConnection("c1", br, aw, m1)
+
+	c0.(wireFormatConnection).next.(*rawConnection).close(nil)
+
+	select {
+	case conn := <-m0.conns:
+		if conn != c0 {
+			t.Error("Incorrect connection closed")
+		}
+	case <-time.After(time.Second):
+		t.Fatal("ConnectionClosed not called")
+	}
+	if m0.isClosed() {
+		t.Error("Close called as well as ConnectionClosed")
+	}
+}
+
+// receiverModel records the nodes it is told have sent a message.
+type receiverModel struct {
+	*TestModel
+	nodes chan string
+}
+
+func (m receiverModel) MessageReceived(nodeID string) {
+	m.nodes <- nodeID
+}
+
+func TestMessageReceived(t *testing.T) {
+	m0 := newTestModel()
+	m1 := receiverModel{newTestModel(), make(chan string, 10)}
+
+	ar, aw := io.Pipe()
+	br, bw := io.Pipe()
+
+	c0 := NewConnection("c0", ar, bw, m0).(wireFormatConnection).next.(*rawConnection)
+	NewConnection("c1", br, aw, m1)
+
+	if !c0.ping() {
+		t.Fatal("Ping failed")
+	}
+
+	select {
+	case node := <-m1.nodes:
+		if node != "c1" {
+			t.Errorf("Incorrect node %q", node)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("MessageReceived not called for a ping")
+	}
+}
+
+func TestTracer(t *testing.T) {
+	m0 := newTestModel()
+	m1 := newTestModel()
+	m1.data = []byte("response data")
+
+	ar, aw := io.Pipe()
+	br, bw := io.Pipe()
+
+	c0 := NewConnection("c0", ar, bw, m0)
+	c1 := NewConnection("c1", br, aw, m1)
+
+	var mut sync.Mutex
+	seen := make(map[Direction]map[int]int)
+	seen[DirectionIn] = make(map[int]int)
+	seen[DirectionOut] = make(map[int]int)
+	c1.SetTracer(func(dir Direction, msgType int, msgID int, size int) {
+		if size < 4 {
+			t.Errorf("Incorrect size %d for message type %d", size, msgType)
+		}
+		mut.Lock()
+		seen[dir][msgType]++
+		mut.Unlock()
+	})
+
+	c0.Index("default", []FileInfo{{Name: "foo", Version: 1}})
+	if _, err := c0.Request("default", "foo", 0, 13); err != nil {
+		t.Fatal(err)
+	}
+
+	// Trace events are delivered asynchronously.
+	for i := 0; i < 100; i++ {
+		mut.Lock()
+		done := seen[DirectionOut][messageTypeResponse] > 0
+		mut.Unlock()
+		if done {
+			break
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	mut.Lock()
+	defer mut.Unlock()
+	if n := seen[DirectionIn][messageTypeIndex]; n != 1 {
+		t.Errorf("Incorrect number of traced index messages %d != 1", n)
+	}
+	if n := seen[DirectionIn][messageTypeRequest]; n != 1 {
+		t.Errorf("Incorrect number of traced request messages %d != 1", n)
+	}
+	if n := seen[DirectionOut][messageTypeResponse]; n != 1 {
+		t.Errorf("Incorrect number of traced response messages %d != 1", n)
+	}
+}
+
+func TestStatisticsByType(t *testing.T) {
+	m0 := newTestModel()
+	m1 := newTestModel()
+	m1.data = []byte("response data")
+
+	ar, aw := io.Pipe()
+	br, bw := io.Pipe()
+
+	c0 := NewConnection("c0", ar, bw, m0)
+	c1 := NewConnection("c1", br, aw, m1)
+
+	c0.Index("default", []FileInfo{{Name: "foo", Version: 1}})
+	if _, err := c0.Request("default", "foo", 0, 13); err != nil {
+		t.Fatal(err)
+	}
+
+	// Header (4) + repo (4+8) + file count (4) + name (4+4) + flags (4) +
+	// modified (8) + version (8) + block count (4)
+	const indexSize = 52
+	// Header (4) + repo (4+8) + name (4+4) + offset (8) + size (4)
+	const requestSize = 36
+	// Header (4) + data (4+16)
+	const responseSize = 24
+
+	// The receiving side accounts for messages after handing them off.
+	var s0, s1 Statistics
+	for i := 0; i < 100; i++ {
+		s0, s1 = c0.Statistics(), c1.Statistics()
+		if s0.InBytesByType.Response > 0 && s1.OutBytesByType.Response > 0 {
+			break
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	if s0.OutBytesByType.Index != indexSize || s1.InBytesByType.Index != indexSize {
+		t.Errorf("Incorrect index bytes %d, %d != %d", s0.OutBytesByType.Index, s1.InBytesByType.Index, indexSize)
+	}
+	if s0.OutBytesByType.Request != requestSize || s1.InBytesByType.Request != requestSize {
+		t.Errorf("Incorrect request bytes %d, %d != %d", s0.OutBytesByType.Request, s1.InBytesByType.Request, requestSize)
+	}
+	if s1.OutBytesByType.Response != responseSize || s0.InBytesByType.Response != responseSize {
+		t.Errorf("Incorrect response bytes %d, %d != %d", s1.OutBytesByType.Response, s0.InBytesByType.Response, responseSize)
+	}
+	if s0.OutBytesByType.IndexUpdate != 0 || s0.OutBytesByType.Ping != 0 {
+		t.Errorf("Unexpected index update or ping bytes %+v", s0.OutBytesByType)
+	}
+
+	out := s0.OutBytesByType
+	if out.IndexBytes() != indexSize || out.DataBytes() != requestSize {
+		t.Errorf("Incorrect index and data split %d, %d", out.IndexBytes(), out.DataBytes())
+	}
+	if tot := out.Total(); tot != out.IndexBytes()+out.DataBytes() {
+		t.Errorf("Incorrect total %d", tot)
+	}
+	if sum := s0.OutBytesByType.Add(s1.OutBytesByType); sum.Total() != s0.OutBytesByType.Total()+s1.OutBytesByType.Total() {
+		t.Errorf("Incorrect sum %+v", sum)
+	}
+}
+
+func TestInvalidReasonFlags(t *testing.T) {
+	for _, reason := range []uint32{InvalidReasonUnknown, InvalidReasonSuppressed, InvalidReasonUnreadable, InvalidReasonBadName, 0xff} {
+		flags := FlagInvalid | 0644 | InvalidReasonFlags(reason)
+		if r := InvalidReason(flags); r != reason {
+			t.Errorf("Incorrect reason %d != %d", r, reason)
+		}
+		if flags&^FlagInvalidReason != FlagInvalid|0644 {
+			t.Errorf("Reason %d overlaps other flags: %o", reason, flags)
+		}
+	}
+}
+
+func TestIndexVersion(t *testing.T) {
+	for _, negotiate := range []bool{false, true} {
+		m0 := newTestModel()
+		m1 := newTestModel()
+		m1.indexCh = make(chan []FileInfo, 1)
+
+		ar, aw := io.Pipe()
+		br, bw := io.Pipe()
+
+		c0 := NewConnection("c0", ar, bw, m0).(wireFormatConnection).next.(*rawConnection)
+		c1 := NewConnection("c1", br, aw, m1).(wireFormatConnection).next.(*rawConnection)
+
+		if negotiate {
+			c1.ClusterConfig(ClusterConfigMessage{})
+			for i := 0; i < 100; i++ {
+				c0.imut.Lock()
+				v := c0.indexVersion
+				c0.imut.Unlock()
+				if v == indexMessageVersion {
+					break
+				}
+				time.Sleep(10 * time.Millisecond)
+			}
+		}
+
+		files := []FileInfo{{Name: "foo", Version: 1, Hash: []byte("file hash"), Created: 1234567890}}
+		c0.Index("default", files)
+
+		var expected []byte
+		var expCreated int64
+		if negotiate {
+			expected = files[0].Hash
+			expCreated = files[0].Created
+		}
+
+		select {
+		case fs := <-m1.indexCh:
+			if len(fs) != 1 || fs[0].Name != "foo" {
+				t.Fatalf("Incorrect index %v", fs)
+			}
+			if string(fs[0].Hash) != string(expected) {
+				t.Errorf("Incorrect hash %q != %q (negotiated %v)", fs[0].Hash, expected, negotiate)
+			}
+			if fs[0].Created != expCreated {
+				t.Errorf("Incorrect creation time %d != %d (negotiated %v)", fs[0].Created, expCreated, negotiate)
+			}
+		case <-time.After(time.Second):
+			t.Fatal("Index not received")
+		}
+	}
+}
+
+func TestIndexVersionOne(t *testing.T) {
+	m0 := newTestModel()
+	m1 := newTestModel()
+	m1.indexCh = make(chan []FileInfo, 1)
+
+	ar, aw := io.Pipe()
+	br, bw := io.Pipe()
+
+	c0 := NewConnection("c0", ar, bw, m0).(wireFormatConnection).next.(*rawConnection)
+	NewConnection("c1", br, aw, m1)
+
+	// A peer that predates version two.
+	c0.imut.Lock()
+	c0.indexVersion = 1
+	c0.imut.Unlock()
+
+	c0.Index("default", []FileInfo{{Name: "foo", Version: 1, Hash: []byte("file hash"), Created: 1234567890}})
+
+	select {
+	case fs := <-m1.indexCh:
+		if len(fs) != 1 || string(fs[0].Hash) != "file hash" || fs[0].Created != 0 {
+			t.Errorf("Incorrect index %+v", fs)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("Index not received")
+	}
+}
+
+func TestRequestLargeOffset(t *testing.T) {
+	req := RequestMessage{Repository: "default", Name: "large", Offset: 5<<30 + BlockSize, Size: BlockSize}
+
+	var buf bytes.Buffer
+	if _, err := req.EncodeXDR(&buf); err != nil {
+		t.Fatal(err)
+	}
+	var dec RequestMessage
+	if err := dec.DecodeXDR(&buf); err != nil {
+		t.Fatal(err)
+	}
+	if dec != req {
+		t.Errorf("Incorrect request after round trip %+v != %+v", dec, req)
+	}
+}
+
+func TestRequestOutOfRange(t *testing.T) {
+	m0 := newTestModel()
+	m1 := newTestModel()
+	m1.data = []byte("data")
+
+	ar, aw := io.Pipe()
+	br, bw := io.Pipe()
+
+	c0 := NewConnection("c0", ar, bw, m0)
+	NewConnection("c1", br, aw, m1)
+
+	for _, r := range []struct {
+		offset int64
+		size   int
+	}{{-1, BlockSize}, {0, -1}, {0, MaxRequestSize + 1}} {
+		if _, err := c0.Request("default", "foo", r.offset, r.size); err == nil {
+			t.Errorf("Unexpected nil error requesting offset %d size %d", r.offset, r.size)
+		}
+	}
+	if m1.name != "" {
+		t.Error("Out of range request sent")
+	}
+}
+
+func TestIndexSequenceResend(t *testing.T) {
+	m0 := newTestModel()
+	m1 := newTestModel()
+	m1.indexCh = make(chan []FileInfo, 1)
+
+	ar, aw := io.Pipe()
+	br, bw := io.Pipe()
+
+	c0 := NewConnection("c0", ar, bw, m0).(wireFormatConnection).next.(*rawConnection)
+	c1 := NewConnection("c1", br, aw, m1).(wireFormatConnection).next.(*rawConnection)
+
+	c1.ClusterConfig(ClusterConfigMessage{})
+	for i := 0; i < 100; i++ {
+		c0.imut.Lock()
+		ok := c0.indexSequence
+		c0.imut.Unlock()
+		if ok {
+			break
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	files := []FileInfo{{Name: "foo", Version: 1}, {Name: "bar", Version: 1}}
+	c0.Index("default", files)
+	select {
+	case <-m1.indexCh:
+	case <-time.After(time.Second):
+		t.Fatal("Index not received")
+	}
+
+	// Make c1 believe it has missed an index update.
+	c1.imut.Lock()
+	c1.indexRecv["default"] = 0
+	c1.imut.Unlock()
+
+	c0.sendIndexSequences()
+
+	select {
+	case fs := <-m1.indexCh:
+		if len(fs) != len(files) {
+			t.Errorf("Incorrect number of files in resent index %d != %d", len(fs), len(files))
+		}
+	case <-time.After(time.Second):
+		t.Fatal("Full index not resent")
+	}
+
+	c0.imut.Lock()
+	sent := c0.indexSeq["default"]
+	c0.imut.Unlock()
+	c1.imut.Lock()
+	recv := c1.indexRecv["default"]
+	c1.imut.Unlock()
+	if sent != 1 || recv != 1 {
+		t.Errorf("Sequences not reset after resend; sent %d, received %d", sent, recv)
+	}
+}
+
+func TestIndexUpdate(t *testing.T) {
+	m0 := newTestModel()
+	m1 := newTestModel()
+	m1.indexCh = make(chan []FileInfo, 1)
+	m1.updateCh = make(chan []FileInfo, 1)
+
+	ar, aw := io.Pipe()
+	br, bw := io.Pipe()
+
+	c0 := NewConnection("c0", ar, bw, m0).(wireFormatConnection).next.(*rawConnection)
+	c1 := NewConnection("c1", br, aw, m1).(wireFormatConnection).next.(*rawConnection)
+
+	c1.ClusterConfig(ClusterConfigMessage{})
+	for i := 0; i < 100; i++ {
+		c0.imut.Lock()
+		ok := c0.indexSequence
+		c0.imut.Unlock()
+		if ok {
+			break
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	files := []FileInfo{{Name: "foo", Version: 1}, {Name: "bar", Version: 1}}
+	c0.Index("default", files[:1])
+	select {
+	case <-m1.indexCh:
+	case <-time.After(time.Second):
+		t.Fatal("Index not received")
+	}
+
+	// Only the files passed are sent, as an update.
+	c0.IndexUpdate("default", files[1:])
+	select {
+	case fs := <-m1.updateCh:
+		if len(fs) != 1 || fs[0].Name != "bar" {
+			t.Errorf("Incorrect index update %v", fs)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("Index update not received")
+	}
+
+	// A resent index includes the update.
+	c1.imut.Lock()
+	c1.indexRecv["default"] = 0
+	c1.imut.Unlock()
+	c0.sendIndexSequences()
+	select {
+	case fs := <-m1.indexCh:
+		if len(fs) != len(files) {
+			t.Errorf("Incorrect number of files in resent index %d != %d", len(fs), len(files))
+		}
+	case <-time.After(time.Second):
+		t.Fatal("Full index not resent")
+	}
+}
+
+func TestIndexSequenceInSync(t *testing.T) {
+	m0 := newTestModel()
+	m1 := newTestModel()
+	m1.indexCh = make(chan []FileInfo, 2)
+
+	ar, aw := io.Pipe()
+	br, bw := io.Pipe()
+
+	c0 := NewConnection("c0", ar, bw, m0).(wireFormatConnection).next.(*rawConnection)
+	c1 := NewConnection("c1", br, aw, m1).(wireFormatConnection).next.(*rawConnection)
+
+	c1.ClusterConfig(ClusterConfigMessage{})
+	for i := 0; i < 100; i++ {
+		c0.imut.Lock()
+		ok := c0.indexSequence
+		c0.imut.Unlock()
+		if ok {
+			break
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	c0.Index("default", []FileInfo{{Name: "foo", Version: 1}})
+	c0.Index("default", []FileInfo{{Name: "foo", Version: 2}})
+	c0.sendIndexSequences()
+	// A ping round trip ensures the sequence message has been handled.
+	if !c0.ping() {
+		t.Fatal("Ping failed")
+	}
+	time.Sleep(50 * time.Millisecond)
+
+	if n := c1.Statistics().OutBytesByType.IndexSequence; n != 0 {
+		t.Errorf("Unexpected resend request (%d bytes) for an index in sync", n)
+	}
+	if n := len(m1.indexCh); n != 1 {
+		t.Errorf("Unexpected number of full indexes %d != 1", n)
+	}
+}
+
+func TestRoot(t *testing.T) {
+	ar, aw := io.Pipe()
+	br, bw := io.Pipe()
+
+	c0 := NewConnection("c0", ar, bw, newTestModel()).(wireFormatConnection).next.(*rawConnection)
+	c1 := NewConnection("c1", br, aw, newTestModel()).(wireFormatConnection).next.(*rawConnection)
+
+	// The root is held back until the peer accepts root messages.
+	r0 := bytes.Repeat([]byte{1}, 32)
+	c0.Root("default", r0)
+	c1.ClusterConfig(ClusterConfigMessage{})
+	for i := 0; i < 100 && c1.PeerRoot("default") == nil; i++ {
+		time.Sleep(10 * time.Millisecond)
+	}
+	if r := c1.PeerRoot("default"); !bytes.Equal(r, r0) {
+		t.Fatalf("Incorrect root %x != %x", r, r0)
+	}
+
+	// An unchanged root is not sent again.
+	sent := c0.Statistics().OutBytesByType.IndexSequence
+	c0.Root("default", r0)
+	if n := c0.Statistics().OutBytesByType.IndexSequence; n != sent {
+		t.Errorf("Unchanged root sent again (%d bytes)", n-sent)
+	}
+
+	r1 := bytes.Repeat([]byte{2}, 32)
+	c0.Root("default", r1)
+	// A ping round trip ensures the root message has been handled.
+	if !c0.ping() {
+		t.Fatal("Ping failed")
+	}
+	if r := c1.PeerRoot("default"); !bytes.Equal(r, r1) {
+		t.Errorf("Incorrect root %x != %x", r, r1)
+	}
+	if r := c1.PeerRoot("other"); r != nil {
+		t.Errorf("Unexpected root %x for unannounced repository", r)
+	}
+}
+
+// slowIndexModel is a TestModel that takes its time applying indexes and
+// records the order they were applied in.
+type slowIndexModel struct {
+	*TestModel
+	release chan struct{}
+	mut     sync.Mutex
+	applied []string
+}
+
+func (m *slowIndexModel) Index(nodeID string, repo string, files []FileInfo) {
+	<-m.release
+	m.record(files)
+}
+
+func (m *slowIndexModel) IndexUpdate(nodeID string, repo string, files []FileInfo) {
+	m.record(files)
+}
+
+func (m *slowIndexModel) record(files []FileInfo) {
+	m.mut.Lock()
+	for _, f := range files {
+		m.applied = append(m.applied, f.Name)
+	}
+	m.mut.Unlock()
+}
+
+func TestIndexDoesNotDelayResponses(t *testing.T) {
+	m0 := newTestModel()
+	m0.data = []byte("response data")
+	m1 := &slowIndexModel{TestModel: newTestModel(), release: make(chan struct{})}
+
+	ar, aw := io.Pipe()
+	br, bw := io.Pipe()
+
+	c0 := NewConnection("c0", ar, bw, m0)
+	c1 := NewConnection("c1", br, aw, m1)
+
+	c0.Index("default", []FileInfo{{Name: "first", Version: 1}})
+	c0.Index("default", []FileInfo{{Name: "first", Version: 1}, {Name: "second", Version: 1}})
+
+	// The index is still being applied by c1's model, but responses to its
+	// requests are received regardless.
+	done := make(chan error)
+	go func() {
+		_, err := c1.Request("default", "foo", 0, 13)
+		done <- err
+	}()
+	select {
+	case err := <-done:
+		if err != nil {
+			t.Fatal(err)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("Response delayed by index")
+	}
+
+	close(m1.release)
+	for i := 0; i < 100; i++ {
+		m1.mut.Lock()
+		n := len(m1.applied)
+		m1.mut.Unlock()
+		if n == 2 {
+			break
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	m1.mut.Lock()
+	defer m1.mut.Unlock()
+	if !reflect.DeepEqual(m1.applied, []string{"first", "second"}) {
+		t.Errorf("Incorrect order of applied indexes %v", m1.applied)
+	}
+}
+
+func TestBlockCompression(t *testing.T) {
+	compressible := bytes.Repeat([]byte("2014-06-01 12:00:00 INFO: nothing to report\n"), BlockSize/44)
+	incompressible := make([]byte, BlockSize)
+	rand.New(rand.NewSource(42)).Read(incompressible)
+
+	cases := []struct {
+		data       []byte
+		negotiated bool
+		compressed bool
+	}{
+		{compressible, true, true},
+		{incompressible, true, false},
+		{compressible, false, false},
+	}
+
+	for i, tc := range cases {
+		m0 := newTestModel()
+		m1 := newTestModel()
+		m1.data = tc.data
+
+		ar, aw := io.Pipe()
+		br, bw := io.Pipe()
+
+		c0 := NewConnection("c0", ar, bw, m0).(wireFormatConnection).next.(*rawConnection)
+		c1 := NewConnection("c1", br, aw, m1).(wireFormatConnection).next.(*rawConnection)
+
+		if tc.negotiated {
+			c0.ClusterConfig(ClusterConfigMessage{})
+			for j := 0; j < 100; j++ {
+				c1.imut.Lock()
+				ok := c1.blockCompress
+				c1.imut.Unlock()
+				if ok {
+					break
+				}
+				time.Sleep(10 * time.Millisecond)
+			}
+		}
+
+		data, err := c0.Request("default", "foo", 0, len(tc.data))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !bytes.Equal(data, tc.data) {
+			t.Errorf("%d: incorrect data received", i)
+		}
+
+		// The sending side accounts for the response once it is written.
+		var sent int64
+		for j := 0; j < 100; j++ {
+			if sent = c1.Statistics().OutBytesByType.Response; sent > 0 {
+				break
+			}
+			time.Sleep(10 * time.Millisecond)
+		}
+		if compressed := sent < int64(len(tc.data)); compressed != tc.compressed {
+			t.Errorf("%d: response of %d bytes for %d bytes of data; compressed %v, expected %v", i, sent, len(tc.data), compressed, tc.compressed)
+		}
+	}
+}
+
+func TestCompressedResponseLimit(t *testing.T) {
+	res := compressedResponse(make([]byte, MaxRequestSize))
+	if res.Encoding != encodingDeflate {
+		t.Fatal("Zeroes not compressed")
+	}
+	if data, err := res.data(); err != nil || len(data) != MaxRequestSize {
+		t.Fatalf("Incorrect decompression; %d bytes, %v", len(data), err)
+	}
+
+	// A compressed response may not expand to more than can be requested.
+	res = compressedResponse(make([]byte, MaxRequestSize+1))
+	if _, err := res.data(); err != errResponseTooLarge {
+		t.Errorf("Incorrect error %v for oversized response", err)
+	}
+
+	res = ResponseMessage{Encoding: 42}
+	if _, err := res.data(); err == nil {
+		t.Error("No error for unknown encoding")
+	}
+}
+
+func TestCompressionMemory(t *testing.T) {
+	ar, aw := io.Pipe()
+	br, bw := io.Pipe()
+	defer aw.Close()
+	defer bw.Close()
+
+	c0 := NewConnection("c0", ar, bw, newTestModel()).(wireFormatConnection).next.(*rawConnection)
+	NewConnection("c1", br, aw, newTestModel())
+
+	if m := c0.Statistics().CompressionMemory; m != flateWriterMemory+flateReaderMemory {
+		t.Errorf("Incorrect compression memory %d for open connection", m)
+	}
+	c0.close(nil)
+	if m := c0.Statistics().CompressionMemory; m != 0 {
+		t.Errorf("Incorrect compression memory %d for closed connection", m)
+	}
+
+	// The writer has gone back to the pool and must not be written to.
+	c0.Index("default", []FileInfo{{Name: "foo"}})
+	if err := c0.flush(); err != ErrClosed {
+		t.Errorf("Incorrect error %v flushing closed connection", err)
+	}
+}
+
+func TestMaxCompressedConnections(t *testing.T) {
+	// Connections left open by other tests count as well.
+	compressedMut.Lock()
+	open := compressedConns
+	compressedMut.Unlock()
+	SetMaxCompressedConnections(open + 1)
+	defer SetMaxCompressedConnections(0)
+
+	var conns []*rawConnection
+	var models []*TestModel
+	for i := 0; i < 2; i++ {
+		ar, aw := io.Pipe()
+		br, bw := io.Pipe()
+		defer aw.Close()
+		defer bw.Close()
+
+		m0, m1 := newTestModel(), newTestModel()
+		m1.indexCh = make(chan []FileInfo, 1)
+		c0 := NewConnection("c0", ar, bw, m0).(wireFormatConnection).next.(*rawConnection)
+		c1 := NewConnection("c1", br, aw, m1).(wireFormatConnection).next.(*rawConnection)
+		conns = append(conns, c0, c1)
+		models = append(models, m0, m1)
+	}
+
+	for i, c := range conns {
+		if c.compress != (i == 0) {
+			t.Errorf("Connection %d compressing %v", i, c.compress)
+		}
+	}
+	if m := conns[1].Statistics().CompressionMemory; m != flateStoreWriterMemory+flateReaderMemory {
+		t.Errorf("Incorrect compression memory %d beyond the limit", m)
+	}
+
+	// A connection beyond the limit neither compresses response data nor
+	// switches to the dictionary, and its stream reads as any other.
+	conns[3].ClusterConfig(ClusterConfigMessage{Options: []Option{
+		{blockCompressionOptionKey, blockCompressionVersion},
+		{rootOptionKey, rootVersion},
+	}})
+	for j := 0; j < 100; j++ {
+		conns[2].imut.Lock()
+		done := conns[2].peerRoots
+		conns[2].imut.Unlock()
+		if done {
+			break
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	if err := conns[2].useDictionary(); err != nil {
+		t.Fatal(err)
+	}
+	conns[2].Index("default", []FileInfo{{Name: "foo"}})
+	select {
+	case fs := <-models[3].indexCh:
+		if len(fs) != 1 || fs[0].Name != "foo" {
+			t.Errorf("Incorrect index %v", fs)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("Index not received")
+	}
+	conns[2].imut.Lock()
+	if conns[2].blockCompress {
+		t.Error("Block compression beyond the limit")
+	}
+	conns[2].imut.Unlock()
+	conns[2].wmut.Lock()
+	if conns[2].wdict {
+		t.Error("Dictionary used beyond the limit")
+	}
+	conns[2].wmut.Unlock()
+
+	// Closing the compressing connection frees its place, once.
+	compressedMut.Lock()
+	before := compressedConns
+	compressedMut.Unlock()
+	for _, c := range conns {
+		c.close(nil)
+		c.close(nil)
+	}
+	compressedMut.Lock()
+	if compressedConns != before-1 {
+		t.Errorf("%d connections compressing after close, expected %d", compressedConns, before-1)
+	}
+	compressedMut.Unlock()
+}
+
+// Connections come and go as nodes reconnect. Each iteration sets up 100
+// connections and closes them again, so that the allocations per operation
+// show the compression state that is not reused from closed connections.
+func BenchmarkConnections100(b *testing.B) {
+	const pairs = 50
+	b.ReportAllocs()
+	for i := 0; i < b.N; i++ {
+		var conns []*rawConnection
+		var pipes []io.Closer
+		for j := 0; j < pairs; j++ {
+			ar, aw := io.Pipe()
+			br, bw := io.Pipe()
+			c0 := NewConnection("c0", ar, bw, newTestModel()).(wireFormatConnection).next.(*rawConnection)
+			c1 := NewConnection("c1", br, aw, newTestModel()).(wireFormatConnection).next.(*rawConnection)
+			conns = append(conns, c0, c1)
+			pipes = append(pipes, ar, aw, br, bw)
+		}
+
+		// Closing the pipes first keeps the connections from blocking on
+		// each other while closing.
+		for _, p := range pipes {
+			p.Close()
+		}
+		for _, c := range conns {
+			c.close(nil)
+		}
+	}
+}
@@ -0,0 +1,78 @@
+package protocol
+
+import "bytes"
+
+// The root option is announced in the cluster config message by nodes that
+// accept root messages.
+const (
+	rootOptionKey = "repository-root"
+	rootVersion   = "1"
+)
+
+// Root announces the root hash of our files in the repository to the peer,
+// unless it is the same as the one last announced. Roots given before the
+// peer has accepted root messages are announced once it does.
+func (c *rawConnection) Root(repo string, root []byte) {
+	c.smut.Lock()
+	defer c.smut.Unlock()
+
+	c.imut.Lock()
+	c.rootLocal[repo] = append([]byte(nil), root...)
+	c.imut.Unlock()
+
+	c.sendRoot(repo)
+}
+
+// sendRoot sends the latest root of the repository, if the peer accepts it
+// and hasn't been sent it already. Must be called with smut held, so that
+// the root follows the index messages sent before it.
+func (c *rawConnection) sendRoot(repo string) {
+	c.imut.Lock()
+	root, ok := c.rootLocal[repo]
+	if !c.peerRoots || !ok || bytes.Equal(root, c.rootSent[repo]) {
+		c.imut.Unlock()
+		return
+	}
+	c.rootSent[repo] = root
+	c.imut.Unlock()
+
+	c.send(header{0, -1, messageTypeRoot}, RootMessage{repo, root})
+}
+
+// sendRoots sends the roots given before the peer accepted root messages.
+func (c *rawConnection) sendRoots() {
+	c.smut.Lock()
+	defer c.smut.Unlock()
+
+	c.imut.Lock()
+	repos := make([]string, 0, len(c.rootLocal))
+	for repo := range c.rootLocal {
+		repos = append(repos, repo)
+	}
+	c.imut.Unlock()
+
+	for _, repo := range repos {
+		c.sendRoot(repo)
+	}
+}
+
+// PeerRoot returns the root hash of the peer's files in the repository, as
+// last announced by the peer, or nil if it hasn't announced one.
+func (c *rawConnection) PeerRoot(repo string) []byte {
+	c.imut.Lock()
+	defer c.imut.Unlock()
+	return c.rootPeer[repo]
+}
+
+func (c *rawConnection) handleRoot() error {
+	var rm RootMessage
+	rm.decodeXDR(c.xr)
+	if err := c.xr.Error(); err != nil {
+		return err
+	}
+
+	c.imut.Lock()
+	c.rootPeer[rm.Repository] = rm.Root
+	c.imut.Unlock()
+	return nil
+}
@@ -25,11 +25,39 @@ func (c wireFormatConnection) Index(node string, fs []FileInfo) {
 	c.next.Index(node, myFs)
 }
 
+func (c wireFormatConnection) IndexUpdate(node string, fs []FileInfo) {
+	var myFs = make([]FileInfo, len(fs))
+	copy(myFs, fs)
+
+	for i := range fs {
+		myFs[i].Name = norm.NFC.String(filepath.ToSlash(myFs[i].Name))
+	}
+
+	c.next.IndexUpdate(node, myFs)
+}
+
 func (c wireFormatConnection) Request(repo, name string, offset int64, size int) ([]byte, error) {
 	name = norm.NFC.String(filepath.ToSlash(name))
 	return c.next.Request(repo, name, offset, size)
 }
 
+func (c wireFormatConnection) RequestBatch(repo, name string, blocks []RequestBlock) []BlockResult {
+	name = norm.NFC.String(filepath.ToSlash(name))
+	return c.next.RequestBatch(repo, name, blocks)
+}
+
+func (c wireFormatConnection) Root(repo string, root []byte) {
+	c.next.Root(repo, root)
+}
+
+func (c wireFormatConnection) PeerRoot(repo string) []byte {
+	return c.next.PeerRoot(repo)
+}
+
+func (c wireFormatConnection) RequestIndex(repo string) {
+	c.next.RequestIndex(repo)
+}
+
 func (c wireFormatConnection) ClusterConfig(config ClusterConfigMessage) {
 	c.next.ClusterConfig(config)
 }
@@ -37,3 +65,7 @@ func (c wireFormatConnection) ClusterConfig(config ClusterConfigMessage) {
 func (c wireFormatConnection) Statistics() Statistics {
 	return c.next.Statistics()
 }
+
+func (c wireFormatConnection) SetTracer(t Tracer) {
+	c.next.SetTracer(t)
+}
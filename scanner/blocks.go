@@ -3,6 +3,7 @@ package scanner
 import (
 	"bytes"
 	"crypto/sha256"
+	"errors"
 	"io"
 )
 
@@ -12,41 +13,84 @@ type Block struct {
 	Hash   []byte
 }
 
+var (
+	// ErrCancelled is returned by HashBlocks when hashing is cancelled.
+	ErrCancelled = errors.New("hashing cancelled")
+	// ErrSizeMismatch is returned by HashBlocks when the reader does not
+	// hold the expected amount of data.
+	ErrSizeMismatch = errors.New("size differs from expected")
+)
+
 // Blocks returns the blockwise hash of the reader.
 func Blocks(r io.Reader, blocksize int) ([]Block, error) {
 	var blocks []Block
+	err := HashBlocks(r, blocksize, -1, nil, func(b Block) error {
+		blocks = append(blocks, b)
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return blocks, nil
+}
+
+// HashBlocks reads r to the end and calls fn with each block as soon as it
+// has been hashed, so that the caller can act on the blocks as they come.
+// Reading stops and the error is returned if fn returns one. An empty reader
+// results in a single empty block.
+//
+// If size is not negative, it is the amount of data expected from the
+// reader; ErrSizeMismatch is returned as soon as the reader is found to
+// hold a different amount. If cancel is not nil, hashing stops with
+// ErrCancelled at the next block boundary once it is closed.
+func HashBlocks(r io.Reader, blocksize int, size int64, cancel <-chan struct{}, fn func(Block) error) error {
 	var offset int64
 	for {
+		select {
+		case <-cancel:
+			return ErrCancelled
+		default:
+		}
+
 		lr := &io.LimitedReader{R: r, N: int64(blocksize)}
 		hf := sha256.New()
 		n, err := io.Copy(hf, lr)
 		if err != nil {
-			return nil, err
+			return err
 		}
 
 		if n == 0 {
 			break
 		}
 
+		if size >= 0 && offset+n > size {
+			return ErrSizeMismatch
+		}
 		b := Block{
 			Offset: offset,
 			Size:   uint32(n),
 			Hash:   hf.Sum(nil),
 		}
-		blocks = append(blocks, b)
-		offset += int64(n)
+		if err := fn(b); err != nil {
+			return err
+		}
+		offset += n
 	}
 
-	if len(blocks) == 0 {
+	if size >= 0 && offset != size {
+		return ErrSizeMismatch
+	}
+
+	if offset == 0 {
 		// Empty file
-		blocks = append(blocks, Block{
+		return fn(Block{
 			Offset: 0,
 			Size:   0,
 			Hash:   []uint8{0xe3, 0xb0, 0xc4, 0x42, 0x98, 0xfc, 0x1c, 0x14, 0x9a, 0xfb, 0xf4, 0xc8, 0x99, 0x6f, 0xb9, 0x24, 0x27, 0xae, 0x41, 0xe4, 0x64, 0x9b, 0x93, 0x4c, 0xa4, 0x95, 0x99, 0x1b, 0x78, 0x52, 0xb8, 0x55},
 		})
 	}
 
-	return blocks, nil
+	return nil
 }
 
 // BlockDiff returns lists of common and missing (to transform src into tgt)
@@ -72,3 +116,16 @@ func BlockDiff(src, tgt []Block) (have, need []Block) {
 
 	return have, need
 }
+
+// SameBlocks returns true if the two block lists describe identical contents.
+func SameBlocks(a, b []Block) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for i := range a {
+		if a[i].Size != b[i].Size || bytes.Compare(a[i].Hash, b[i].Hash) != 0 {
+			return false
+		}
+	}
+	return true
+}
@@ -2,8 +2,12 @@ package scanner
 
 import (
 	"bytes"
+	"errors"
 	"fmt"
+	"io"
+	"reflect"
 	"testing"
+	"testing/iotest"
 )
 
 var blocksTestData = []struct {
@@ -114,3 +118,71 @@ func TestDiff(t *testing.T) {
 		}
 	}
 }
+
+func TestHashBlocksShortReads(t *testing.T) {
+	data := bytes.Repeat([]byte("0123456789"), 100)
+	exp, err := Blocks(bytes.NewReader(data), 64)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, r := range []io.Reader{iotest.OneByteReader(bytes.NewReader(data)), iotest.HalfReader(bytes.NewReader(data)), iotest.DataErrReader(bytes.NewReader(data))} {
+		var blocks []Block
+		err := HashBlocks(r, 64, int64(len(data)), nil, func(b Block) error {
+			blocks = append(blocks, b)
+			return nil
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !reflect.DeepEqual(blocks, exp) {
+			t.Errorf("Incorrect blocks from short reads\n%v\n%v", blocks, exp)
+		}
+	}
+}
+
+func TestHashBlocksCancel(t *testing.T) {
+	data := bytes.Repeat([]byte("0123456789"), 100)
+	r := bytes.NewReader(data)
+	cancel := make(chan struct{})
+
+	var n int
+	err := HashBlocks(r, 64, -1, cancel, func(b Block) error {
+		n++
+		if n == 2 {
+			close(cancel)
+		}
+		return nil
+	})
+	if err != ErrCancelled {
+		t.Errorf("Incorrect error %v after cancel", err)
+	}
+	if n != 2 {
+		t.Errorf("Incorrect number of blocks %d after cancel", n)
+	}
+	if rem := r.Len(); rem != len(data)-2*64 {
+		t.Errorf("Read past cancel; %d bytes remain", rem)
+	}
+
+	// An error from the callback aborts as well.
+	errStop := errors.New("stop")
+	err = HashBlocks(bytes.NewReader(data), 64, -1, nil, func(b Block) error {
+		return errStop
+	})
+	if err != errStop {
+		t.Errorf("Incorrect error %v from callback", err)
+	}
+}
+
+func TestHashBlocksSize(t *testing.T) {
+	data := []byte("contents")
+	nop := func(Block) error { return nil }
+	for _, size := range []int64{0, 7, 9} {
+		if err := HashBlocks(bytes.NewReader(data), 3, size, nil, nop); err != ErrSizeMismatch {
+			t.Errorf("Incorrect error %v for expected size %d", err, size)
+		}
+	}
+	if err := HashBlocks(bytes.NewReader(data), 3, 8, nil, nop); err != nil {
+		t.Error(err)
+	}
+}
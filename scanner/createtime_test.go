@@ -0,0 +1,65 @@
+// +build darwin windows
+
+package scanner
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/calmh/syncthing/vfs"
+)
+
+func TestWalkCreateTime(t *testing.T) {
+	dir, err := ioutil.TempDir("", "createtime")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	src := filepath.Join(dir, "src")
+	dst := filepath.Join(dir, "dst")
+	ioutil.WriteFile(src, []byte("data"), 0644)
+	ioutil.WriteFile(dst, []byte("data"), 0644)
+
+	// Earlier than now, as some platforms can only move it back.
+	created := time.Unix(1234567890, 0)
+	if err := vfs.SetCreateTime(vfs.OS, src, created); err != nil {
+		t.Fatal(err)
+	}
+
+	walk := func() map[string]File {
+		w := Walker{Dir: dir, BlockSize: 128 * 1024, CreateTimes: true}
+		files, _, err := w.Walk()
+		if err != nil {
+			t.Fatal(err)
+		}
+		res := make(map[string]File)
+		for _, f := range files {
+			res[f.Name] = f
+		}
+		return res
+	}
+
+	f := walk()["src"]
+	if f.Created != created.Unix() {
+		t.Fatalf("Incorrect creation time %d != %d", f.Created, created.Unix())
+	}
+
+	if err := vfs.SetCreateTime(vfs.OS, dst, time.Unix(f.Created, 0)); err != nil {
+		t.Fatal(err)
+	}
+	if c := walk()["dst"].Created; c != f.Created {
+		t.Errorf("Creation time not restored; %d != %d", c, f.Created)
+	}
+
+	w := Walker{Dir: dir, BlockSize: 128 * 1024}
+	files, _, _ := w.Walk()
+	for _, f := range files {
+		if f.Created != 0 {
+			t.Errorf("Creation time %d recorded for %q when not enabled", f.Created, f.Name)
+		}
+	}
+}
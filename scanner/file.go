@@ -3,13 +3,23 @@ package scanner
 import "fmt"
 
 type File struct {
-	Name       string
-	Flags      uint32
-	Modified   int64
-	Version    uint64
-	Size       int64
-	Blocks     []Block
-	Suppressed bool
+	Name     string
+	Flags    uint32
+	Modified int64
+	Version  uint64
+	Size     int64
+	Blocks   []Block
+
+	// Hash is the SHA256 hash of the entire file contents, if known.
+	Hash []byte
+
+	// Created is the creation time of the file, or zero if not known.
+	Created int64
+
+	// Invalid is set when the file is not available for synchronization,
+	// for the reason given by InvalidReason (protocol.InvalidReason*).
+	Invalid       bool
+	InvalidReason uint32
 }
 
 func (f File) String() string {
@@ -0,0 +1,92 @@
+package scanner
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// MountPolicy tells how a directory that may be a mount point is handled.
+type MountPolicy int
+
+const (
+	// The directory is scanned as normal content, whether or not anything
+	// is mounted on it.
+	MountContent MountPolicy = iota
+	// The directory is scanned only when something is mounted on it. When
+	// it is not, the files below it are reported as unavailable rather than
+	// deleted.
+	MountGuard
+)
+
+func (p MountPolicy) String() string {
+	switch p {
+	case MountContent:
+		return "content"
+	case MountGuard:
+		return "guard"
+	default:
+		return "unknown"
+	}
+}
+
+// UnmountedPaths returns the guarded mount paths that do not currently have
+// anything mounted on them, as a walk would find them, without walking.
+func (w *Walker) UnmountedPaths() []string {
+	w.lazyInit()
+	return w.unmountedPaths()
+}
+
+// unmountedPaths returns the guarded mount paths that do not currently have
+// anything mounted on them.
+func (w *Walker) unmountedPaths() []string {
+	var paths []string
+	for rn, policy := range w.Mounts {
+		if policy != MountGuard {
+			continue
+		}
+		rn = filepath.Clean(rn)
+		if !w.isMountPoint(filepath.Join(w.Dir, rn)) {
+			if debug {
+				dlog.Println("not mounted:", rn)
+			}
+			paths = append(paths, rn)
+		}
+	}
+	return paths
+}
+
+// isMountPoint returns true if p is a directory on a different device than
+// its parent. A directory is assumed to be a mount point if the device
+// cannot be told.
+func (w *Walker) isMountPoint(p string) bool {
+	fi, err := w.FS.Lstat(p)
+	if err != nil || !fi.IsDir() {
+		return false
+	}
+	pfi, err := w.FS.Lstat(filepath.Dir(p))
+	if err != nil {
+		return false
+	}
+	dev, ok := w.DeviceID(fi)
+	pdev, pok := w.DeviceID(pfi)
+	return !ok || !pok || dev != pdev
+}
+
+// unmounted returns true if rn is at or below a guarded path that is not
+// mounted.
+func (w *Walker) unmounted(rn string) bool {
+	for _, p := range w.unavailable {
+		if rn == p || strings.HasPrefix(rn, p+string(os.PathSeparator)) {
+			return true
+		}
+	}
+	return false
+}
+
+// Unavailable returns the guarded mount paths that were found not mounted
+// during the last walk. The files below them are left out of the result and
+// should not be considered deleted.
+func (w *Walker) Unavailable() []string {
+	return w.unavailable
+}
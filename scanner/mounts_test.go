@@ -0,0 +1,86 @@
+package scanner
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+)
+
+func TestMountPolicies(t *testing.T) {
+	dir, err := ioutil.TempDir("", "mounts")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	if err := os.Mkdir(filepath.Join(dir, "mnt"), 0755); err != nil {
+		t.Fatal(err)
+	}
+	for _, name := range []string{"file", filepath.Join("mnt", "file")} {
+		if err := ioutil.WriteFile(filepath.Join(dir, name), []byte(name), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	var mounted bool
+	w := Walker{
+		Dir:       dir,
+		BlockSize: 128 * 1024,
+		Mounts:    map[string]MountPolicy{"mnt": MountGuard},
+		DeviceID: func(fi os.FileInfo) (uint64, bool) {
+			if mounted && fi.Name() == "mnt" {
+				return 2, true
+			}
+			return 1, true
+		},
+	}
+	inner := filepath.Join("mnt", "file")
+	walk := func() map[string]File {
+		files, _, err := w.Walk()
+		if err != nil {
+			t.Fatal(err)
+		}
+		res := make(map[string]File)
+		for _, f := range files {
+			res[f.Name] = f
+		}
+		return res
+	}
+
+	mounted = true
+	if _, ok := walk()[inner]; !ok {
+		t.Error("File below mounted guard not walked")
+	}
+	if u := w.Unavailable(); len(u) != 0 {
+		t.Errorf("Unexpected unavailable paths %v", u)
+	}
+
+	mounted = false
+	files := walk()
+	if f, ok := files[inner]; ok {
+		t.Errorf("File below unmounted guard walked: %v", f)
+	}
+	if f, ok := files["mnt"]; ok {
+		t.Errorf("Unmounted guard walked: %v", f)
+	}
+	if _, ok := files["file"]; !ok {
+		t.Error("File outside guard not walked")
+	}
+	if u := w.Unavailable(); !reflect.DeepEqual(u, []string{"mnt"}) {
+		t.Errorf("Incorrect unavailable paths %v", u)
+	}
+
+	w.Mounts["mnt"] = MountContent
+	if _, ok := walk()[inner]; !ok {
+		t.Error("File below unmounted content directory not walked")
+	}
+
+	w.Mounts["mnt"] = MountGuard
+	os.RemoveAll(filepath.Join(dir, "mnt"))
+	walk()
+	if u := w.Unavailable(); !reflect.DeepEqual(u, []string{"mnt"}) {
+		t.Errorf("Incorrect unavailable paths %v for missing guard", u)
+	}
+}
@@ -0,0 +1,16 @@
+// +build !windows
+
+package scanner
+
+import (
+	"os"
+	"syscall"
+)
+
+func deviceID(fi os.FileInfo) (uint64, bool) {
+	st, ok := fi.Sys().(*syscall.Stat_t)
+	if !ok {
+		return 0, false
+	}
+	return uint64(st.Dev), true
+}
@@ -0,0 +1,12 @@
+// +build windows
+
+package scanner
+
+import "os"
+
+// The device is not available from a FileInfo on Windows; directories are
+// assumed to be mount points, so guarded paths are always scanned when they
+// exist.
+func deviceID(fi os.FileInfo) (uint64, bool) {
+	return 0, false
+}
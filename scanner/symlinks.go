@@ -0,0 +1,156 @@
+package scanner
+
+import (
+	"crypto/sha256"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/calmh/syncthing/lamport"
+	"github.com/calmh/syncthing/protocol"
+	"github.com/calmh/syncthing/vfs"
+)
+
+// SymlinkPolicy tells how symbolic links are handled.
+type SymlinkPolicy int
+
+const (
+	// Symlinks are skipped.
+	SymlinkIgnore SymlinkPolicy = iota
+	// The link itself is synced, with the link target as contents, and
+	// recreated as a link by the puller.
+	SymlinkRecreate
+	// The link is followed and what it points to is synced as a regular
+	// file or directory at the path of the link.
+	SymlinkFollowContent
+)
+
+func (p SymlinkPolicy) String() string {
+	switch p {
+	case SymlinkIgnore:
+		return "ignore"
+	case SymlinkRecreate:
+		return "recreate"
+	case SymlinkFollowContent:
+		return "follow"
+	default:
+		return "unknown"
+	}
+}
+
+// walkSymlink handles the symlink at path p according to the policy.
+func (w *Walker) walkSymlink(res *[]File, ign map[string][]string, p, rn string, info os.FileInfo) error {
+	switch w.Symlinks {
+	case SymlinkRecreate:
+		w.appendSymlink(res, p, rn, info)
+		return nil
+
+	case SymlinkFollowContent:
+		return w.followSymlink(res, ign, p)
+
+	default:
+		if debug {
+			dlog.Println("symlink ignored:", rn)
+		}
+		return nil
+	}
+}
+
+// appendSymlink adds the symlink at path p to the result, with the link
+// target as contents. The current version is kept if the target is
+// unchanged, as the modification time of the link can't be set when it is
+// recreated; a new target gives the link a new version.
+func (w *Walker) appendSymlink(res *[]File, p, rn string, info os.FileInfo) {
+	target, err := w.FS.Readlink(p)
+	if err != nil {
+		if debug {
+			dlog.Println("readlink:", p, err)
+		}
+		w.appendUnreadable(res, rn)
+		return
+	}
+
+	blocks, _ := Blocks(strings.NewReader(target), w.BlockSize)
+	if w.CurrentFiler != nil {
+		cf := w.CurrentFiler.CurrentFile(rn)
+		if cf.Name == rn && cf.Flags&protocol.FlagSymlink != 0 && cf.Flags&protocol.FlagDeleted == 0 && !cf.Invalid && SameBlocks(cf.Blocks, blocks) {
+			if debug {
+				dlog.Println("unchanged symlink:", cf)
+			}
+			*res = append(*res, cf)
+			return
+		}
+	}
+
+	hash := sha256.Sum256([]byte(target))
+	f := File{
+		Name:     rn,
+		Version:  lamport.Default.Tick(0),
+		Size:     int64(len(target)),
+		Flags:    protocol.FlagSymlink | uint32(info.Mode()&os.ModePerm),
+		Modified: info.ModTime().Unix(),
+		Blocks:   blocks,
+		Hash:     hash[:],
+	}
+	if debug {
+		dlog.Println("symlink:", f)
+	}
+	*res = append(*res, f)
+}
+
+// followSymlink walks what the symlink at path p points to as if it was
+// found at p. Links to directories that would lead back to a directory
+// containing the link are not followed, as the walk would never end.
+func (w *Walker) followSymlink(res *[]File, ign map[string][]string, p string) error {
+	info, err := w.FS.Stat(p)
+	if err != nil {
+		// A dangling link
+		if debug {
+			dlog.Println("stat:", p, err)
+		}
+		return nil
+	}
+
+	walkFn := w.walkAndHashFiles(res, ign)
+	if !info.IsDir() {
+		return walkFn(p, info, nil)
+	}
+
+	if w.symlinkCycle(p, info) {
+		if debug {
+			dlog.Println("symlink cycle:", p)
+		}
+		return nil
+	}
+	if err := walkFn(p, info, nil); err != nil {
+		if err == filepath.SkipDir {
+			return nil
+		}
+		return err
+	}
+	infos, err := w.FS.ReadDir(p)
+	if err != nil {
+		return nil
+	}
+	for _, fi := range infos {
+		if err := vfs.Walk(w.FS, filepath.Join(p, fi.Name()), walkFn); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// symlinkCycle returns true if the directory, found by following the symlink
+// at path p, is the repository directory or any directory between it and
+// the link.
+func (w *Walker) symlinkCycle(p string, dir os.FileInfo) bool {
+	for d := filepath.Dir(p); len(d) >= len(w.Dir); d = filepath.Dir(d) {
+		if info, err := w.FS.Stat(d); err == nil && os.SameFile(info, dir) {
+			return true
+		}
+		if d == w.Dir || d == filepath.Dir(d) {
+			break
+		}
+	}
+	return false
+}
@@ -0,0 +1,152 @@
+package scanner
+
+import (
+	"bytes"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"runtime"
+	"strings"
+	"testing"
+
+	"github.com/calmh/syncthing/protocol"
+)
+
+func symlinkDir(t *testing.T) string {
+	if runtime.GOOS == "windows" {
+		t.Skip("symlinks require privileges on Windows")
+	}
+	dir, err := ioutil.TempDir("", "symlinks")
+	if err != nil {
+		t.Fatal(err)
+	}
+	return dir
+}
+
+func walkNames(t *testing.T, w Walker) map[string]File {
+	files, _, err := w.Walk()
+	if err != nil {
+		t.Fatal(err)
+	}
+	res := make(map[string]File)
+	for _, f := range files {
+		res[f.Name] = f
+	}
+	return res
+}
+
+func TestSymlinkPolicies(t *testing.T) {
+	dir := symlinkDir(t)
+	defer os.RemoveAll(dir)
+
+	contents := []byte("the contents of the target")
+	if err := ioutil.WriteFile(filepath.Join(dir, "target"), contents, 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Symlink("target", filepath.Join(dir, "link")); err != nil {
+		t.Fatal(err)
+	}
+	targetBlocks, _ := Blocks(bytes.NewReader(contents), 128*1024)
+	linkBlocks, _ := Blocks(strings.NewReader("target"), 128*1024)
+
+	w := Walker{Dir: dir, BlockSize: 128 * 1024}
+
+	w.Symlinks = SymlinkIgnore
+	if f, ok := walkNames(t, w)["link"]; ok {
+		t.Errorf("Ignored symlink walked: %v", f)
+	}
+
+	w.Symlinks = SymlinkRecreate
+	f, ok := walkNames(t, w)["link"]
+	if !ok {
+		t.Fatal("Symlink not walked")
+	}
+	if f.Flags&protocol.FlagSymlink == 0 || f.Size != int64(len("target")) || !SameBlocks(f.Blocks, linkBlocks) {
+		t.Errorf("Incorrect symlink entry %v", f)
+	}
+
+	w.Symlinks = SymlinkFollowContent
+	f, ok = walkNames(t, w)["link"]
+	if !ok {
+		t.Fatal("Followed symlink not walked")
+	}
+	if f.Flags&protocol.FlagSymlink != 0 || f.Size != int64(len(contents)) || !SameBlocks(f.Blocks, targetBlocks) {
+		t.Errorf("Incorrect followed symlink entry %v", f)
+	}
+}
+
+func TestSymlinkRecreateUnchanged(t *testing.T) {
+	dir := symlinkDir(t)
+	defer os.RemoveAll(dir)
+
+	if err := os.Symlink("target", filepath.Join(dir, "link")); err != nil {
+		t.Fatal(err)
+	}
+
+	w := Walker{Dir: dir, BlockSize: 128 * 1024, Symlinks: SymlinkRecreate}
+	f := walkNames(t, w)["link"]
+
+	// The modification time of a recreated link differs from the
+	// announced one; the version is kept as long as the target is the same.
+	cf := f
+	cf.Modified--
+	w.CurrentFiler = fakeCurrentFiler{"link": cf}
+	if f2 := walkNames(t, w)["link"]; f2.Version != cf.Version {
+		t.Errorf("Unchanged symlink got a new version %d != %d", f2.Version, cf.Version)
+	}
+}
+
+func TestSymlinkRecreateChanged(t *testing.T) {
+	dir := symlinkDir(t)
+	defer os.RemoveAll(dir)
+
+	link := filepath.Join(dir, "link")
+	if err := os.Symlink("target", link); err != nil {
+		t.Fatal(err)
+	}
+
+	w := Walker{Dir: dir, BlockSize: 128 * 1024, Symlinks: SymlinkRecreate}
+	f := walkNames(t, w)["link"]
+	w.CurrentFiler = fakeCurrentFiler{"link": f}
+
+	// Pointing the link elsewhere is a change, whatever its modification
+	// time.
+	os.Remove(link)
+	if err := os.Symlink("other", link); err != nil {
+		t.Fatal(err)
+	}
+	blocks, _ := Blocks(strings.NewReader("other"), 128*1024)
+	f2 := walkNames(t, w)["link"]
+	if f2.Version <= f.Version {
+		t.Errorf("Changed symlink kept version %d <= %d", f2.Version, f.Version)
+	}
+	if f2.Size != int64(len("other")) || !SameBlocks(f2.Blocks, blocks) {
+		t.Errorf("Incorrect changed symlink entry %v", f2)
+	}
+}
+
+func TestSymlinkFollowCycle(t *testing.T) {
+	dir := symlinkDir(t)
+	defer os.RemoveAll(dir)
+
+	os.Mkdir(filepath.Join(dir, "dir"), 0755)
+	ioutil.WriteFile(filepath.Join(dir, "dir", "file"), []byte("data"), 0644)
+	os.Symlink("..", filepath.Join(dir, "dir", "loop"))
+	os.Symlink(".", filepath.Join(dir, "self"))
+	os.Symlink("dir", filepath.Join(dir, "other"))
+
+	w := Walker{Dir: dir, BlockSize: 128 * 1024, Symlinks: SymlinkFollowContent}
+	files := walkNames(t, w)
+
+	for name := range files {
+		if strings.HasPrefix(name, filepath.Join("dir", "loop")) || strings.HasPrefix(name, "self") {
+			t.Errorf("Cycle followed to %q", name)
+		}
+	}
+	if f, ok := files["other"]; !ok || f.Flags&protocol.FlagDirectory == 0 {
+		t.Errorf("Symlink to directory not walked as directory: %v", f)
+	}
+	if _, ok := files[filepath.Join("other", "file")]; !ok {
+		t.Error("File in symlinked directory not walked")
+	}
+}
@@ -2,18 +2,25 @@ package scanner
 
 import (
 	"bytes"
+	"crypto/sha256"
 	"errors"
-	"io/ioutil"
+	"io"
 	"log"
 	"os"
 	"path/filepath"
 	"strings"
 	"time"
+	"unicode/utf8"
 
 	"github.com/calmh/syncthing/lamport"
 	"github.com/calmh/syncthing/protocol"
+	"github.com/calmh/syncthing/vfs"
+	"github.com/juju/ratelimit"
 )
 
+// Files at least this large are dropped from the page cache after hashing.
+const dropCacheSize = 8 << 20
+
 type Walker struct {
 	// Dir is the base directory for the walk
 	Dir string
@@ -26,11 +33,84 @@ type Walker struct {
 	// If CurrentFiler is not nil, it is queried for the current file before rescanning.
 	CurrentFiler CurrentFiler
 	// If Suppressor is not nil, it is queried for supression of modified files.
-	// Suppressed files will be returned with empty metadata and the Suppressed flag set.
+	// Suppressed files will be returned with empty metadata and the Invalid flag set.
 	// Requires CurrentFiler to be set.
 	Suppressor Suppressor
-
-	suppressed map[string]bool // file name -> suppression status
+	// If ForceRehash is not nil, regular files for which it returns true are
+	// rehashed even if their modification time is unchanged. Such files keep
+	// their current version if the contents turn out to be unchanged.
+	// Requires CurrentFiler to be set.
+	ForceRehash func(name string) bool
+	// If CheckSize is set, regular files whose size differs from the last
+	// scan are rehashed even if their modification time is unchanged, which
+	// catches most edits made in place without updating it.
+	// Requires CurrentFiler to be set.
+	CheckSize bool
+	// If ReadLimit is not nil, reads when hashing files are limited by it.
+	ReadLimit *ratelimit.Bucket
+	// FS is the filesystem to walk. If nil, the operating system's
+	// filesystem is used.
+	FS vfs.FS
+	// Symlinks tells how symbolic links are handled. By default they are
+	// ignored.
+	Symlinks SymlinkPolicy
+	// Mounts gives the policy for directories, relative to Dir, that may be
+	// mount points. Directories not listed are scanned as normal content.
+	Mounts map[string]MountPolicy
+	// DeviceID returns the device a file resides on, and false if that
+	// cannot be told. If nil, the device is taken from the operating
+	// system.
+	DeviceID func(fi os.FileInfo) (uint64, bool)
+	// If GuardPlaceholders is set, a file that spanned several blocks at
+	// the last scan but is now empty, with an unchanged modification time,
+	// is taken to be a placeholder left by a cloud storage client rather
+	// than truncated. It is returned with the Invalid flag set.
+	// Requires CurrentFiler to be set.
+	GuardPlaceholders bool
+	// If IsPlaceholder is not nil, regular files for which it returns true
+	// are treated as placeholders as well.
+	IsPlaceholder func(path string, info os.FileInfo) bool
+	// If CreateTimes is set, the creation time of changed files and
+	// directories is recorded, on platforms that have one.
+	CreateTimes bool
+	// If NameFilter is not nil, regular files and symlinks for which it
+	// returns false are vetoed. A vetoed file is left out like an ignored
+	// one, except that a file already in the index is returned with the
+	// Invalid flag set instead, so that it is not announced as deleted.
+	NameFilter func(name string) bool
+	// If ContentFilter is not nil, it is called with the first
+	// ContentFilterSize bytes (BlockSize if zero) of each regular file
+	// about to be hashed, and vetoes the file like NameFilter when it
+	// returns false. This costs an extra read of the start of every file
+	// hashed. Unchanged files are not hashed and so not filtered again;
+	// ForceRehash makes them so.
+	ContentFilter     func(name string, head []byte) bool
+	ContentFilterSize int
+	// SkipPaths lists files and directories, relative to Dir, that hold
+	// data of the application rather than repository contents. They are
+	// not walked.
+	SkipPaths []string
+	// If LimitDepth is set, the walk descends at most MaxDepth directory
+	// levels below Dir; at zero only the entries directly in Dir are
+	// walked. The directories at the limit are returned, but not their
+	// contents. They are listed by TooDeep.
+	LimitDepth bool
+	MaxDepth   int
+	// If SettleTime is not zero, changed regular files modified less than
+	// SettleTime ago are not hashed, as they may still be being written.
+	// They are returned with the Invalid flag set and hashed by a later
+	// walk, once they have been left alone for long enough.
+	SettleTime time.Duration
+	// If IgnorePerms is set, permission bits are neither compared nor
+	// picked up from the filesystem, for filesystems that cannot store
+	// them. Files keep the permission bits they were last indexed with;
+	// new ones get 0644, or 0755 for directories.
+	IgnorePerms bool
+
+	suppressed   map[string]bool // file name -> suppression status
+	unavailable  []string        // guarded mount paths not mounted
+	placeholders []string        // files newly found to be placeholders
+	deep         []string        // directories whose contents were too deep
 }
 
 type TempNamer interface {
@@ -59,18 +139,22 @@ func (w *Walker) Walk() (files []File, ignore map[string][]string, err error) {
 		dlog.Println("Walk", w.Dir, w.BlockSize, w.IgnoreFile)
 	}
 
-	err = checkDir(w.Dir)
+	err = checkDir(w.FS, w.Dir)
 	if err != nil {
 		return
 	}
 
 	t0 := time.Now()
 
+	w.unavailable = w.unmountedPaths()
+	w.placeholders = nil
+	w.deep = nil
 	ignore = make(map[string][]string)
 	hashFiles := w.walkAndHashFiles(&files, ignore)
 
-	filepath.Walk(w.Dir, w.loadIgnoreFiles(w.Dir, ignore))
-	filepath.Walk(w.Dir, hashFiles)
+	vfs.Walk(w.FS, w.Dir, w.loadIgnoreFiles(w.Dir, ignore))
+	vfs.Walk(w.FS, w.Dir, hashFiles)
+	w.pruneSuppressed(files)
 
 	if debug {
 		t1 := time.Now()
@@ -78,19 +162,64 @@ func (w *Walker) Walk() (files []File, ignore map[string][]string, err error) {
 		dlog.Printf("Walk in %.02f ms, %.0f files/s", d*1000, float64(len(files))/d)
 	}
 
-	err = checkDir(w.Dir)
+	err = checkDir(w.FS, w.Dir)
 	return
 }
 
+// TempFiles returns the names, relative to the walked directory, of all
+// files that match the temporary filename pattern.
+func (w *Walker) TempFiles() []string {
+	w.lazyInit()
+	var temps []string
+	vfs.Walk(w.FS, w.Dir, func(path string, info os.FileInfo, err error) error {
+		if err != nil {
+			return nil
+		}
+		if info.Mode()&os.ModeType == 0 && w.TempNamer.IsTemporary(path) {
+			if rn, err := filepath.Rel(w.Dir, path); err == nil {
+				temps = append(temps, rn)
+			}
+		}
+		return nil
+	})
+	return temps
+}
+
 // CleanTempFiles removes all files that match the temporary filename pattern.
 func (w *Walker) CleanTempFiles() {
-	filepath.Walk(w.Dir, w.cleanTempFile)
+	for _, rn := range w.TempFiles() {
+		w.FS.Remove(filepath.Join(w.Dir, rn))
+	}
+}
+
+// pruneSuppressed forgets the suppression of files that weren't found, so
+// that a Walker used for many walks doesn't remember every file that ever
+// changed too often.
+func (w *Walker) pruneSuppressed(files []File) {
+	if len(w.suppressed) == 0 {
+		return
+	}
+	found := make(map[string]bool, len(files))
+	for _, f := range files {
+		found[f.Name] = true
+	}
+	for name := range w.suppressed {
+		if !found[name] {
+			delete(w.suppressed, name)
+		}
+	}
 }
 
 func (w *Walker) lazyInit() {
 	if w.suppressed == nil {
 		w.suppressed = make(map[string]bool)
 	}
+	if w.FS == nil {
+		w.FS = vfs.OS
+	}
+	if w.DeviceID == nil {
+		w.DeviceID = deviceID
+	}
 }
 
 func (w *Walker) loadIgnoreFiles(dir string, ign map[string][]string) filepath.WalkFunc {
@@ -104,9 +233,14 @@ func (w *Walker) loadIgnoreFiles(dir string, ign map[string][]string) filepath.W
 			return nil
 		}
 
+		if info.IsDir() && rn != "." && w.atMaxDepth(rn) {
+			// Ignore files below would only apply to what isn't walked
+			return filepath.SkipDir
+		}
+
 		if pn, sn := filepath.Split(rn); sn == w.IgnoreFile {
 			pn := strings.Trim(pn, "/")
-			bs, _ := ioutil.ReadFile(p)
+			bs, _ := vfs.ReadFile(w.FS, p)
 			lines := bytes.Split(bs, []byte("\n"))
 			var patterns []string
 			for _, line := range lines {
@@ -142,6 +276,28 @@ func (w *Walker) walkAndHashFiles(res *[]File, ign map[string][]string) filepath
 			return nil
 		}
 
+		if w.unmounted(rn) {
+			// Below a guarded mount point with nothing mounted
+			if debug {
+				dlog.Println("unmounted:", rn)
+			}
+			if info.IsDir() {
+				return filepath.SkipDir
+			}
+			return nil
+		}
+
+		if w.skipPath(rn) {
+			// A file or directory of the application
+			if debug {
+				dlog.Println("skipped:", rn)
+			}
+			if info.IsDir() {
+				return filepath.SkipDir
+			}
+			return nil
+		}
+
 		if w.TempNamer != nil && w.TempNamer.IsTemporary(rn) {
 			// A temporary file
 			if debug {
@@ -158,6 +314,27 @@ func (w *Walker) walkAndHashFiles(res *[]File, ign map[string][]string) filepath
 			return nil
 		}
 
+		if !utf8.ValidString(rn) {
+			// The name cannot be represented on the wire
+			if debug {
+				dlog.Printf("invalid name: %q", rn)
+			}
+			var cf File
+			if w.CurrentFiler != nil {
+				cf = w.CurrentFiler.CurrentFile(rn)
+			}
+			f := File{
+				Name:     rn,
+				Flags:    uint32(info.Mode() & os.ModePerm),
+				Modified: info.ModTime().Unix(),
+			}
+			if info.IsDir() {
+				f.Flags |= protocol.FlagDirectory
+			}
+			*res = append(*res, invalidFile(f, cf, protocol.InvalidReasonBadName))
+			return nil
+		}
+
 		if w.ignoreFile(ign, rn) {
 			// An ignored file
 			if debug {
@@ -169,46 +346,93 @@ func (w *Walker) walkAndHashFiles(res *[]File, ign map[string][]string) filepath
 			return nil
 		}
 
+		if !info.IsDir() && w.NameFilter != nil && !w.NameFilter(rn) {
+			w.veto(res, rn, info)
+			return nil
+		}
+
+		if info.Mode()&os.ModeSymlink != 0 {
+			return w.walkSymlink(res, ign, p, rn, info)
+		}
+
 		if info.Mode().IsDir() {
+			// Directories are indexed on their own, so that empty ones are
+			// synced as well.
+			var cf File
 			if w.CurrentFiler != nil {
-				cf := w.CurrentFiler.CurrentFile(rn)
-				if cf.Modified == info.ModTime().Unix() && cf.Flags == uint32(info.Mode()&os.ModePerm|protocol.FlagDirectory) {
-					if debug {
-						dlog.Println("unchanged:", cf)
-					}
-					*res = append(*res, cf)
-				} else {
-					f := File{
-						Name:     rn,
-						Version:  lamport.Default.Tick(0),
-						Flags:    uint32(info.Mode()&os.ModePerm) | protocol.FlagDirectory,
-						Modified: info.ModTime().Unix(),
-					}
-					if debug {
-						dlog.Println("dir:", cf, f)
-					}
-					*res = append(*res, f)
+				cf = w.CurrentFiler.CurrentFile(rn)
+			}
+			if cf.Name == rn && cf.Modified == info.ModTime().Unix() && cf.Flags == w.flags(info, cf) {
+				if debug {
+					dlog.Println("unchanged:", cf)
 				}
-				return nil
+				*res = append(*res, cf)
+			} else {
+				f := File{
+					Name:     rn,
+					Version:  lamport.Default.Tick(0),
+					Flags:    w.flags(info, cf),
+					Modified: info.ModTime().Unix(),
+					Created:  w.createTime(info),
+				}
+				if debug {
+					dlog.Println("dir:", cf, f)
+				}
+				*res = append(*res, f)
+			}
+			if w.atMaxDepth(rn) {
+				// The directory is returned, but not its contents
+				if debug {
+					dlog.Println("too deep:", rn)
+				}
+				w.deep = append(w.deep, rn)
+				return filepath.SkipDir
 			}
+			return nil
 		}
 
 		if info.Mode().IsRegular() {
+			var cf File
+			if w.CurrentFiler != nil {
+				cf = w.CurrentFiler.CurrentFile(rn)
+			}
+			if w.isPlaceholder(p, rn, info, cf) {
+				if !cf.Invalid || cf.InvalidReason != protocol.InvalidReasonPlaceholder {
+					log.Printf("INFO: %q looks like a placeholder for contents not present locally; not announcing it.", p)
+					w.placeholders = append(w.placeholders, rn)
+				}
+				f := File{
+					Name:     rn,
+					Flags:    w.flags(info, cf),
+					Modified: info.ModTime().Unix(),
+				}
+				*res = append(*res, invalidFile(f, cf, protocol.InvalidReasonPlaceholder))
+				return nil
+			}
+
+			var unchanged bool
 			if w.CurrentFiler != nil {
-				cf := w.CurrentFiler.CurrentFile(rn)
-				if cf.Flags&protocol.FlagDeleted == 0 && cf.Modified == info.ModTime().Unix() {
+				unchanged = cf.Flags&protocol.FlagDeleted == 0 && !cf.Invalid && cf.Modified == info.ModTime().Unix()
+				if unchanged && w.CheckSize && cf.Size != info.Size() {
 					if debug {
-						dlog.Println("unchanged:", cf)
+						dlog.Println("size changed:", cf, info.Size())
 					}
-					*res = append(*res, cf)
-					return nil
+					unchanged = false
 				}
-
-				if w.Suppressor != nil && w.Suppressor.Suppress(rn, info) {
+				if unchanged {
+					if w.ForceRehash == nil || !w.ForceRehash(rn) {
+						if debug {
+							dlog.Println("unchanged:", cf)
+						}
+						*res = append(*res, cf)
+						return nil
+					}
+				} else if w.Suppressor != nil && w.Suppressor.Suppress(rn, info) {
 					if !w.suppressed[rn] {
 						w.suppressed[rn] = true
 						log.Printf("INFO: Changes to %q are being temporarily suppressed because it changes too frequently.", p)
-						cf.Suppressed = true
+						cf.Invalid = true
+						cf.InvalidReason = protocol.InvalidReasonSuppressed
 						cf.Version++
 					}
 					if debug {
@@ -222,21 +446,64 @@ func (w *Walker) walkAndHashFiles(res *[]File, ign map[string][]string) filepath
 				}
 			}
 
-			fd, err := os.Open(p)
+			if w.settling(info) {
+				if debug {
+					dlog.Println("settling:", rn)
+				}
+				f := File{
+					Name:     rn,
+					Flags:    w.flags(info, cf),
+					Modified: info.ModTime().Unix(),
+				}
+				*res = append(*res, invalidFile(f, cf, protocol.InvalidReasonSettling))
+				return nil
+			}
+
+			fd, err := w.FS.Open(p)
 			if err != nil {
 				if debug {
 					dlog.Println("open:", p, err)
 				}
+				w.appendUnreadable(res, rn)
 				return nil
 			}
 			defer fd.Close()
 
+			if w.ContentFilter != nil {
+				head, err := w.readHead(fd)
+				if err != nil {
+					if debug {
+						dlog.Println("read error:", rn, err)
+					}
+					w.appendUnreadable(res, rn)
+					return nil
+				}
+				if !w.ContentFilter(rn, head) {
+					w.veto(res, rn, info)
+					return nil
+				}
+			}
+
+			vfs.Advise(fd, vfs.AdviceSequential)
+
+			var r io.Reader = fd
+			if w.ReadLimit != nil {
+				r = ratelimit.Reader(fd, w.ReadLimit)
+			}
+
 			t0 := time.Now()
-			blocks, err := Blocks(fd, w.BlockSize)
+			hf := sha256.New()
+			blocks, err := Blocks(io.TeeReader(r, hf), w.BlockSize)
+			if info.Size() >= dropCacheSize {
+				// Don't let a scan push out the page cache the rest of
+				// the system is using.
+				vfs.Advise(fd, vfs.AdviceDontNeed)
+			}
 			if err != nil {
 				if debug {
 					dlog.Println("hash error:", rn, err)
 				}
+				w.appendUnreadable(res, rn)
 				return nil
 			}
 			if debug {
@@ -247,9 +514,19 @@ func (w *Walker) walkAndHashFiles(res *[]File, ign map[string][]string) filepath
 				Name:     rn,
 				Version:  lamport.Default.Tick(0),
 				Size:     info.Size(),
-				Flags:    uint32(info.Mode()),
+				Flags:    w.flags(info, cf),
 				Modified: info.ModTime().Unix(),
+				Created:  w.createTime(info),
 				Blocks:   blocks,
+				Hash:     hf.Sum(nil),
+			}
+			if unchanged && cf.Flags == f.Flags && cf.Size == f.Size && SameBlocks(cf.Blocks, f.Blocks) {
+				// A forced rehash of a file that hasn't changed
+				if debug {
+					dlog.Println("rehashed unchanged:", cf)
+				}
+				*res = append(*res, cf)
+				return nil
 			}
 			*res = append(*res, f)
 		}
@@ -258,14 +535,163 @@ func (w *Walker) walkAndHashFiles(res *[]File, ign map[string][]string) filepath
 	}
 }
 
-func (w *Walker) cleanTempFile(path string, info os.FileInfo, err error) error {
-	if err != nil {
-		return err
+// readHead returns the start of the file, as passed to the content filter.
+func (w *Walker) readHead(fd vfs.File) ([]byte, error) {
+	size := w.ContentFilterSize
+	if size <= 0 {
+		size = w.BlockSize
 	}
-	if info.Mode()&os.ModeType == 0 && w.TempNamer.IsTemporary(path) {
-		os.Remove(path)
+	head := make([]byte, size)
+	n, err := fd.ReadAt(head, 0)
+	if err == io.EOF {
+		err = nil
 	}
-	return nil
+	return head[:n], err
+}
+
+// veto leaves out a file vetoed by a filter. A file already in the index
+// is kept there as invalid, so that it isn't announced as deleted.
+func (w *Walker) veto(res *[]File, rn string, info os.FileInfo) {
+	if debug {
+		dlog.Println("vetoed:", rn)
+	}
+	if w.CurrentFiler == nil {
+		return
+	}
+	cf := w.CurrentFiler.CurrentFile(rn)
+	if cf.Name != rn || cf.Flags&protocol.FlagDeleted != 0 {
+		return
+	}
+	f := File{
+		Name:     rn,
+		Flags:    cf.Flags,
+		Modified: info.ModTime().Unix(),
+	}
+	*res = append(*res, invalidFile(f, cf, protocol.InvalidReasonFiltered))
+}
+
+// flags returns the flags for the regular file or directory, given the file
+// as seen at the last scan.
+func (w *Walker) flags(info os.FileInfo, cf File) uint32 {
+	if !w.IgnorePerms {
+		if info.IsDir() {
+			return uint32(info.Mode()&os.ModePerm) | protocol.FlagDirectory
+		}
+		return uint32(info.Mode())
+	}
+	perm := uint32(0644)
+	if info.IsDir() {
+		perm = 0755
+	}
+	if cf.Name != "" && cf.Flags&protocol.FlagDeleted == 0 {
+		perm = cf.Flags & uint32(os.ModePerm)
+	}
+	if info.IsDir() {
+		return perm | protocol.FlagDirectory
+	}
+	return perm
+}
+
+// createTime returns the creation time of the file, or zero if it isn't
+// recorded.
+func (w *Walker) createTime(info os.FileInfo) int64 {
+	if !w.CreateTimes {
+		return 0
+	}
+	if t, ok := vfs.CreateTime(info); ok {
+		return t.Unix()
+	}
+	return 0
+}
+
+// isPlaceholder returns true if the regular file at p is a placeholder
+// standing in for contents not present locally, given the file as seen at
+// the last scan.
+func (w *Walker) isPlaceholder(p, rn string, info os.FileInfo, cf File) bool {
+	if w.IsPlaceholder != nil && w.IsPlaceholder(p, info) {
+		return true
+	}
+	if !w.GuardPlaceholders || info.Size() != 0 {
+		return false
+	}
+	if cf.Name != rn || cf.Flags&protocol.FlagDeleted != 0 || cf.Modified != info.ModTime().Unix() {
+		return false
+	}
+	if cf.Invalid && cf.InvalidReason == protocol.InvalidReasonPlaceholder {
+		return true
+	}
+	return len(cf.Blocks) > 1
+}
+
+// Placeholders returns the files newly found to be placeholders during the
+// last walk. Files that were placeholders already at the previous scan are
+// not included.
+func (w *Walker) Placeholders() []string {
+	return w.placeholders
+}
+
+// appendUnreadable adds the previously known version of a file that could not
+// be read to the result, marked as invalid. This keeps the file from being
+// considered deleted. Files not previously known are left out.
+func (w *Walker) appendUnreadable(res *[]File, rn string) {
+	if w.CurrentFiler == nil {
+		return
+	}
+	cf := w.CurrentFiler.CurrentFile(rn)
+	if cf.Name != rn || cf.Flags&protocol.FlagDeleted != 0 {
+		return
+	}
+	*res = append(*res, invalidFile(cf, cf, protocol.InvalidReasonUnreadable))
+}
+
+// invalidFile returns f marked as invalid for the given reason. The version
+// is kept from the current file cf when that is already invalid for the same
+// reason, so that an unchanged state doesn't cause a new version on every
+// scan.
+func invalidFile(f, cf File, reason uint32) File {
+	if cf.Name == f.Name && cf.Invalid && cf.InvalidReason == reason {
+		return cf
+	}
+	f.Invalid = true
+	f.InvalidReason = reason
+	f.Blocks = nil
+	f.Hash = nil
+	f.Size = 0
+	f.Version = lamport.Default.Tick(cf.Version)
+	return f
+}
+
+// settling returns true if the file was modified so recently that it may
+// still be being written. Modification times in the future are taken to be
+// from a skewed clock rather than a write in progress.
+func (w *Walker) settling(info os.FileInfo) bool {
+	if w.SettleTime <= 0 {
+		return false
+	}
+	age := time.Since(info.ModTime())
+	return age >= 0 && age < w.SettleTime
+}
+
+// atMaxDepth returns true if the directory rn is as deep below Dir as the
+// walk descends, so that its contents are not walked.
+func (w *Walker) atMaxDepth(rn string) bool {
+	return w.LimitDepth && strings.Count(rn, string(os.PathSeparator)) >= w.MaxDepth
+}
+
+// TooDeep returns the directories whose contents were left out of the last
+// walk by the depth limit. The files below them should not be considered
+// deleted.
+func (w *Walker) TooDeep() []string {
+	return w.deep
+}
+
+func (w *Walker) skipPath(rn string) bool {
+	for _, p := range w.SkipPaths {
+		if rn == p {
+			return true
+		}
+	}
+	return false
 }
 
 func (w *Walker) ignoreFile(patterns map[string][]string, file string) bool {
@@ -282,8 +708,8 @@ func (w *Walker) ignoreFile(patterns map[string][]string, file string) bool {
 	return false
 }
 
-func checkDir(dir string) error {
-	if info, err := os.Stat(dir); err != nil {
+func checkDir(fs vfs.FS, dir string) error {
+	if info, err := fs.Stat(dir); err != nil {
 		return err
 	} else if !info.IsDir() {
 		return errors.New(dir + ": not a directory")
@@ -0,0 +1,103 @@
+package scanner
+
+import (
+	"bufio"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"testing"
+
+	"github.com/calmh/syncthing/vfs"
+)
+
+// BenchmarkWalkLarge scans large files that are not in the page cache and
+// logs how much the page cache grew by doing so.
+func BenchmarkWalkLarge(b *testing.B) {
+	const files = 16
+	const size = 2 * dropCacheSize
+
+	dir, err := ioutil.TempDir("", "walklarge")
+	if err != nil {
+		b.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	data := make([]byte, size)
+	for i := 0; i < files; i++ {
+		for j := range data {
+			data[j] = byte(i + j)
+		}
+		fd, err := os.Create(filepath.Join(dir, fmt.Sprintf("file%d", i)))
+		if err != nil {
+			b.Fatal(err)
+		}
+		_, err = fd.Write(data)
+		if err == nil {
+			err = fd.Sync()
+		}
+		fd.Close()
+		if err != nil {
+			b.Fatal(err)
+		}
+	}
+
+	var grown int64
+	b.SetBytes(files * size)
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		b.StopTimer()
+		for j := 0; j < files; j++ {
+			evict(b, filepath.Join(dir, fmt.Sprintf("file%d", j)))
+		}
+		before := cachedKB(b)
+		b.StartTimer()
+
+		w := Walker{Dir: dir, BlockSize: 128 * 1024}
+		if fs, _, err := w.Walk(); err != nil || len(fs) != files {
+			b.Fatalf("Walked %d files != %d; %v", len(fs), files, err)
+		}
+
+		b.StopTimer()
+		after := cachedKB(b)
+		b.Logf("Cached %d kB before, %d kB after", before, after)
+		grown += after - before
+		b.StartTimer()
+	}
+	b.Logf("Page cache grew %d kB per scan of %d kB", grown/int64(b.N), files*size/1024)
+}
+
+// evict drops the file from the page cache.
+func evict(b *testing.B, name string) {
+	fd, err := vfs.OS.Open(name)
+	if err != nil {
+		b.Fatal(err)
+	}
+	vfs.Advise(fd, vfs.AdviceDontNeed)
+	fd.Close()
+}
+
+// cachedKB returns the size of the page cache according to /proc/meminfo.
+func cachedKB(b *testing.B) int64 {
+	fd, err := os.Open("/proc/meminfo")
+	if err != nil {
+		b.Fatal(err)
+	}
+	defer fd.Close()
+
+	sc := bufio.NewScanner(fd)
+	for sc.Scan() {
+		fields := strings.Fields(sc.Text())
+		if len(fields) >= 2 && fields[0] == "Cached:" {
+			kb, err := strconv.ParseInt(fields[1], 10, 64)
+			if err != nil {
+				b.Fatal(err)
+			}
+			return kb
+		}
+	}
+	b.Fatal("No Cached line in /proc/meminfo")
+	return 0
+}
@@ -1,10 +1,18 @@
 package scanner
 
 import (
+	"bytes"
+	"crypto/sha256"
 	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
 	"reflect"
 	"testing"
 	"time"
+
+	"github.com/calmh/syncthing/protocol"
+	"github.com/juju/ratelimit"
 )
 
 var testdata = []struct {
@@ -13,6 +21,7 @@ var testdata = []struct {
 	hash string
 }{
 	{"bar", 10, "2f72cc11a6fcd0271ecef8c61056ee1eb1243be3805bf9a9df98f92f7636b05c"},
+	{"baz", 0, ""}, // directory
 	{"empty", 0, "e3b0c44298fc1c149afbf4c8996fb92427ae41e4649b934ca495991b7852b855"},
 	{"foo", 7, "aec070645fe53ee3b3763059376134f058cc337247c978add178b6ccdfb0019f"},
 }
@@ -42,10 +51,22 @@ func TestWalk(t *testing.T) {
 			t.Errorf("Incorrect file name %q != %q for case #%d", n1, n2, i)
 		}
 
+		if files[i].Flags&protocol.FlagDirectory != 0 {
+			if testdata[i].hash != "" {
+				t.Errorf("Unexpected directory for case #%d", i)
+			}
+			continue
+		}
+
 		if h1, h2 := fmt.Sprintf("%x", files[i].Blocks[0].Hash), testdata[i].hash; h1 != h2 {
 			t.Errorf("Incorrect hash %q != %q for case #%d", h1, h2, i)
 		}
 
+		// All test files are single block, so the file hash is the block hash
+		if h1, h2 := fmt.Sprintf("%x", files[i].Hash), testdata[i].hash; h1 != h2 {
+			t.Errorf("Incorrect file hash %q != %q for case #%d", h1, h2, i)
+		}
+
 		t0 := time.Date(2010, 1, 1, 0, 0, 0, 0, time.UTC).Unix()
 		t1 := time.Date(2020, 1, 1, 0, 0, 0, 0, time.UTC).Unix()
 		if mt := files[i].Modified; mt < t0 || mt > t1 {
@@ -114,3 +135,519 @@ func TestIgnore(t *testing.T) {
 		}
 	}
 }
+
+type fakeCurrentFiler map[string]File
+
+func (f fakeCurrentFiler) CurrentFile(name string) File {
+	return f[name]
+}
+
+type fakeSuppressor bool
+
+func (s fakeSuppressor) Suppress(name string, fi os.FileInfo) bool {
+	return bool(s)
+}
+
+func walkOne(t *testing.T, w Walker, name string) File {
+	files, _, err := w.Walk()
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, f := range files {
+		if f.Name == name {
+			return f
+		}
+	}
+	t.Fatalf("%q not in walk result", name)
+	return File{}
+}
+
+func TestWalkInvalidSuppressed(t *testing.T) {
+	cf := fakeCurrentFiler{
+		"foo": File{Name: "foo", Version: 1000},
+	}
+	w := Walker{
+		Dir:          "testdata",
+		BlockSize:    128 * 1024,
+		CurrentFiler: cf,
+		Suppressor:   fakeSuppressor(true),
+	}
+
+	f := walkOne(t, w, "foo")
+	if !f.Invalid || f.InvalidReason != protocol.InvalidReasonSuppressed {
+		t.Errorf("Incorrect invalid state %v %d", f.Invalid, f.InvalidReason)
+	}
+}
+
+func TestWalkInvalidUnreadable(t *testing.T) {
+	dir, err := ioutil.TempDir("", "walk")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	fn := filepath.Join(dir, "unreadable")
+	if err := ioutil.WriteFile(fn, []byte("data"), 0); err != nil {
+		t.Fatal(err)
+	}
+	if fd, err := os.Open(fn); err == nil {
+		fd.Close()
+		t.Skip("file permissions not enforced (running as root?)")
+	}
+
+	cf := fakeCurrentFiler{
+		"unreadable": File{Name: "unreadable", Version: 1000},
+	}
+	w := Walker{
+		Dir:          dir,
+		BlockSize:    128 * 1024,
+		CurrentFiler: cf,
+	}
+
+	f := walkOne(t, w, "unreadable")
+	if !f.Invalid || f.InvalidReason != protocol.InvalidReasonUnreadable {
+		t.Errorf("Incorrect invalid state %v %d", f.Invalid, f.InvalidReason)
+	}
+	if f.Version <= 1000 {
+		t.Errorf("Version should have been bumped, not %d", f.Version)
+	}
+
+	// Unchanged invalid state keeps the version
+
+	cf["unreadable"] = f
+	if f2 := walkOne(t, w, "unreadable"); f2.Version != f.Version {
+		t.Errorf("Version changed on rescan; %d != %d", f2.Version, f.Version)
+	}
+}
+
+func TestWalkInvalidName(t *testing.T) {
+	dir, err := ioutil.TempDir("", "walk")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	name := "bad\xffname"
+	if err := ioutil.WriteFile(filepath.Join(dir, name), []byte("data"), 0644); err != nil {
+		t.Skip("cannot create file with invalid UTF-8 name:", err)
+	}
+
+	w := Walker{
+		Dir:       dir,
+		BlockSize: 128 * 1024,
+	}
+
+	f := walkOne(t, w, name)
+	if !f.Invalid || f.InvalidReason != protocol.InvalidReasonBadName {
+		t.Errorf("Incorrect invalid state %v %d", f.Invalid, f.InvalidReason)
+	}
+	if len(f.Blocks) != 0 {
+		t.Error("Invalid file should not be hashed")
+	}
+}
+
+func TestWalkReadLimit(t *testing.T) {
+	dir, err := ioutil.TempDir("", "walk")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	if err := ioutil.WriteFile(filepath.Join(dir, "file"), make([]byte, 10000), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	// The bucket starts out full with 5000 bytes, the remaining 5000 take a
+	// second to become available.
+	w := Walker{
+		Dir:       dir,
+		BlockSize: 128 * 1024,
+		ReadLimit: ratelimit.NewBucketWithRate(5000, 5000),
+	}
+	t0 := time.Now()
+	files, _, err := w.Walk()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if d := time.Since(t0); d < 900*time.Millisecond {
+		t.Errorf("Hashing was not throttled; took %v", d)
+	}
+	if len(files) != 1 || files[0].Size != 10000 {
+		t.Errorf("Incorrect files %v", files)
+	}
+}
+
+func TestWalkLargeFileHash(t *testing.T) {
+	dir, err := ioutil.TempDir("", "walk")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	// Large enough to be dropped from the page cache after hashing.
+	data := make([]byte, dropCacheSize+12345)
+	for i := range data {
+		data[i] = byte(i * 7)
+	}
+	if err := ioutil.WriteFile(filepath.Join(dir, "large"), data, 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	w := Walker{
+		Dir:       dir,
+		BlockSize: 128 * 1024,
+	}
+	files, _, err := w.Walk()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(files) != 1 {
+		t.Fatalf("Incorrect files %v", files)
+	}
+
+	blocks, err := Blocks(bytes.NewReader(data), 128*1024)
+	if err != nil {
+		t.Fatal(err)
+	}
+	hash := sha256.Sum256(data)
+	if !SameBlocks(files[0].Blocks, blocks) {
+		t.Error("Incorrect blocks for large file")
+	}
+	if !bytes.Equal(files[0].Hash, hash[:]) {
+		t.Errorf("Incorrect hash %x != %x", files[0].Hash, hash)
+	}
+}
+
+func TestWalkPlaceholder(t *testing.T) {
+	dir, err := ioutil.TempDir("", "walk")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	fn := filepath.Join(dir, "file")
+	if err := ioutil.WriteFile(fn, nil, 0644); err != nil {
+		t.Fatal(err)
+	}
+	fi, err := os.Stat(fn)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Two blocks at the last scan, empty now with the same mtime.
+	cf := fakeCurrentFiler{
+		"file": File{
+			Name:     "file",
+			Version:  1000,
+			Flags:    0644,
+			Modified: fi.ModTime().Unix(),
+			Size:     200,
+			Blocks:   []Block{{Offset: 0, Size: 128}, {Offset: 128, Size: 72}},
+		},
+	}
+	w := &Walker{
+		Dir:               dir,
+		BlockSize:         128,
+		CurrentFiler:      cf,
+		GuardPlaceholders: true,
+	}
+
+	f := walkOne(t, *w, "file")
+	if !f.Invalid || f.InvalidReason != protocol.InvalidReasonPlaceholder {
+		t.Fatalf("Incorrect invalid state %v %d", f.Invalid, f.InvalidReason)
+	}
+	if f.Version <= 1000 {
+		t.Errorf("Version should have been bumped, not %d", f.Version)
+	}
+	if _, _, err := w.Walk(); err != nil {
+		t.Fatal(err)
+	}
+	if p := w.Placeholders(); len(p) != 1 || p[0] != "file" {
+		t.Errorf("Incorrect placeholders %v", p)
+	}
+
+	// Still a placeholder on the next scan, but not newly so.
+	cf["file"] = f
+	if f2 := walkOne(t, *w, "file"); f2.Version != f.Version || !f2.Invalid {
+		t.Errorf("Placeholder changed on rescan; %+v", f2)
+	}
+	if _, _, err := w.Walk(); err != nil {
+		t.Fatal(err)
+	}
+	if p := w.Placeholders(); len(p) != 0 {
+		t.Errorf("Incorrect placeholders %v", p)
+	}
+
+	// The same goes for a file marked changed since the last scan, as
+	// when reconciling the index at startup, which would otherwise be
+	// rehashed and found empty.
+	changed := File{
+		Name:          "file",
+		Version:       1000,
+		Flags:         0644,
+		Modified:      fi.ModTime().Unix(),
+		Size:          200,
+		Blocks:        []Block{{Offset: 0, Size: 128}, {Offset: 128, Size: 72}},
+		Invalid:       true,
+		InvalidReason: protocol.InvalidReasonChanged,
+	}
+	cf["file"] = changed
+	if f := walkOne(t, *w, "file"); !f.Invalid || f.InvalidReason != protocol.InvalidReasonPlaceholder {
+		t.Errorf("Incorrect invalid state %v %d", f.Invalid, f.InvalidReason)
+	}
+
+	// Without the guard the file is truncated.
+	w.GuardPlaceholders = false
+	if f := walkOne(t, *w, "file"); f.Invalid || f.Size != 0 {
+		t.Errorf("Incorrect truncated file %+v", f)
+	}
+
+	// A detector can tell placeholders by itself.
+	w.IsPlaceholder = func(p string, info os.FileInfo) bool {
+		return p == fn
+	}
+	if f := walkOne(t, *w, "file"); !f.Invalid || f.InvalidReason != protocol.InvalidReasonPlaceholder {
+		t.Errorf("Incorrect invalid state %v %d", f.Invalid, f.InvalidReason)
+	}
+}
+
+func TestWalkCheckSize(t *testing.T) {
+	dir, err := ioutil.TempDir("", "walk")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	fn := filepath.Join(dir, "file")
+	if err := ioutil.WriteFile(fn, []byte("original"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	cf := make(fakeCurrentFiler)
+	w := Walker{
+		Dir:          dir,
+		BlockSize:    128,
+		CurrentFiler: cf,
+	}
+	f := walkOne(t, w, "file")
+	cf["file"] = f
+
+	// Edited in place, keeping the modification time.
+	fi, err := os.Stat(fn)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := ioutil.WriteFile(fn, []byte("changed and longer"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Chtimes(fn, fi.ModTime(), fi.ModTime()); err != nil {
+		t.Fatal(err)
+	}
+
+	// Without the size check the change goes unnoticed.
+	if f2 := walkOne(t, w, "file"); f2.Version != f.Version || f2.Size != f.Size {
+		t.Errorf("File rehashed without size check; %v", f2)
+	}
+
+	w.CheckSize = true
+	f2 := walkOne(t, w, "file")
+	if f2.Version == f.Version || f2.Size != 18 || SameBlocks(f2.Blocks, f.Blocks) {
+		t.Errorf("File not rehashed with size check; %v", f2)
+	}
+
+	// Unchanged sizes don't cause a rehash.
+	cf["file"] = f2
+	if f3 := walkOne(t, w, "file"); f3.Version != f2.Version {
+		t.Errorf("Unchanged file rehashed; %v", f3)
+	}
+}
+
+func TestWalkSuppressedPruned(t *testing.T) {
+	dir, err := ioutil.TempDir("", "walk")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	cf := make(fakeCurrentFiler)
+	for i := 0; i < 20; i++ {
+		name := fmt.Sprintf("file%d", i)
+		cf[name] = File{Name: name, Version: 1000}
+	}
+	w := Walker{
+		Dir:          dir,
+		BlockSize:    128 * 1024,
+		CurrentFiler: cf,
+		Suppressor:   fakeSuppressor(true),
+	}
+
+	// Files come and go, each suppressed while it exists.
+	for i := 0; i < 20; i++ {
+		if i >= 3 {
+			if err := os.Remove(filepath.Join(dir, fmt.Sprintf("file%d", i-3))); err != nil {
+				t.Fatal(err)
+			}
+		}
+		if err := ioutil.WriteFile(filepath.Join(dir, fmt.Sprintf("file%d", i)), []byte("data"), 0644); err != nil {
+			t.Fatal(err)
+		}
+		if _, _, err := w.Walk(); err != nil {
+			t.Fatal(err)
+		}
+		exp := i + 1
+		if exp > 3 {
+			exp = 3
+		}
+		if l := len(w.suppressed); l != exp {
+			t.Fatalf("%d suppressed files remembered after walk %d, expected %d", l, i, exp)
+		}
+	}
+}
+
+func TestWalkFilters(t *testing.T) {
+	dir, err := ioutil.TempDir("", "walk")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	ioutil.WriteFile(filepath.Join(dir, "public"), []byte("nothing to see"), 0644)
+	ioutil.WriteFile(filepath.Join(dir, "new"), []byte("SECRET plans"), 0644)
+	ioutil.WriteFile(filepath.Join(dir, "known"), []byte("SECRET now"), 0644)
+	ioutil.WriteFile(filepath.Join(dir, "late"), []byte("much later a SECRET"), 0644)
+	ioutil.WriteFile(filepath.Join(dir, "id.key"), []byte("key"), 0644)
+	os.Mkdir(filepath.Join(dir, "dir.key"), 0755)
+
+	// known was indexed before it got a secret.
+	cf := fakeCurrentFiler{
+		"known": File{Name: "known", Version: 1000, Flags: 0644, Size: 4, Blocks: []Block{{Size: 4}}},
+	}
+	var heads []string
+	w := Walker{
+		Dir:          dir,
+		BlockSize:    128,
+		CurrentFiler: cf,
+		NameFilter: func(name string) bool {
+			return filepath.Ext(name) != ".key"
+		},
+		ContentFilter: func(name string, head []byte) bool {
+			heads = append(heads, string(head))
+			return !bytes.Contains(head, []byte("SECRET"))
+		},
+		ContentFilterSize: 8,
+	}
+	files, _, err := w.Walk()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var names []string
+	for _, f := range files {
+		names = append(names, f.Name)
+	}
+	if exp := []string{"dir.key", "known", "late", "public"}; !reflect.DeepEqual(names, exp) {
+		t.Errorf("Incorrect files %v, expected %v", names, exp)
+	}
+	f := walkOne(t, w, "known")
+	if !f.Invalid || f.InvalidReason != protocol.InvalidReasonFiltered || f.Flags&protocol.FlagDeleted != 0 || f.Version <= 1000 {
+		t.Errorf("Incorrect vetoed file %+v", f)
+	}
+
+	// Only the start of the files is passed to the content filter.
+	if exp := []string{"SECRET n", "much lat", "SECRET p", "nothing "}; !reflect.DeepEqual(heads[:4], exp) {
+		t.Errorf("Incorrect heads %q, expected %q", heads[:4], exp)
+	}
+}
+
+func TestWalkMaxDepth(t *testing.T) {
+	dir, err := ioutil.TempDir("", "walk")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	os.MkdirAll(filepath.Join(dir, "a", "b", "c"), 0755)
+	os.MkdirAll(filepath.Join(dir, "a", "skip", "d"), 0755)
+	os.Mkdir(filepath.Join(dir, "e"), 0755)
+	ioutil.WriteFile(filepath.Join(dir, "top"), []byte("top"), 0644)
+	ioutil.WriteFile(filepath.Join(dir, "a", "one"), []byte("one"), 0644)
+	ioutil.WriteFile(filepath.Join(dir, "a", "b", "two"), []byte("two"), 0644)
+	ioutil.WriteFile(filepath.Join(dir, "a", "b", "c", "three"), []byte("three"), 0644)
+	ioutil.WriteFile(filepath.Join(dir, "a", ".stignore"), []byte("skip\n"), 0644)
+
+	cases := []struct {
+		depth int
+		files []string
+		deep  []string
+	}{
+		{0, []string{"a", "e", "top"}, []string{"a", "e"}},
+		{1, []string{"a", "a/b", "a/one", "e", "top"}, []string{"a/b"}},
+		{2, []string{"a", "a/b", "a/b/c", "a/b/two", "a/one", "e", "top"}, []string{"a/b/c"}},
+	}
+
+	for _, tc := range cases {
+		w := Walker{
+			Dir:        dir,
+			BlockSize:  128,
+			IgnoreFile: ".stignore",
+			LimitDepth: true,
+			MaxDepth:   tc.depth,
+		}
+		files, _, err := w.Walk()
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		var names []string
+		for _, f := range files {
+			names = append(names, filepath.ToSlash(f.Name))
+		}
+		if !reflect.DeepEqual(names, tc.files) {
+			t.Errorf("Depth %d: incorrect files %v, expected %v", tc.depth, names, tc.files)
+		}
+		var deep []string
+		for _, d := range w.TooDeep() {
+			deep = append(deep, filepath.ToSlash(d))
+		}
+		if !reflect.DeepEqual(deep, tc.deep) {
+			t.Errorf("Depth %d: incorrect directories too deep %v, expected %v", tc.depth, deep, tc.deep)
+		}
+	}
+}
+
+func TestWalkSettling(t *testing.T) {
+	dir, err := ioutil.TempDir("", "walk")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	old := time.Now().Add(-time.Hour)
+	ioutil.WriteFile(filepath.Join(dir, "settled"), []byte("settled"), 0644)
+	os.Chtimes(filepath.Join(dir, "settled"), old, old)
+	ioutil.WriteFile(filepath.Join(dir, "writing"), []byte("partial"), 0644)
+
+	cf := fakeCurrentFiler{
+		"writing": File{Name: "writing", Version: 1000, Flags: 0644, Modified: old.Unix(), Size: 3, Blocks: []Block{{Size: 3}}},
+	}
+	w := Walker{
+		Dir:          dir,
+		BlockSize:    128,
+		CurrentFiler: cf,
+		SettleTime:   time.Minute,
+	}
+
+	if f := walkOne(t, w, "settled"); f.Invalid || len(f.Blocks) != 1 {
+		t.Errorf("Settled file not hashed; %+v", f)
+	}
+	f := walkOne(t, w, "writing")
+	if !f.Invalid || f.InvalidReason != protocol.InvalidReasonSettling || len(f.Blocks) != 0 || f.Version <= 1000 {
+		t.Errorf("File being written not deferred; %+v", f)
+	}
+
+	// Once the file has been left alone, it is hashed.
+	os.Chtimes(filepath.Join(dir, "writing"), old, old)
+	cf["writing"] = f
+	if f := walkOne(t, w, "writing"); f.Invalid || f.Size != 7 {
+		t.Errorf("Settled file not hashed; %+v", f)
+	}
+}
@@ -0,0 +1,440 @@
+// Package testutil provides helpers for tests, such as an in-memory
+// filesystem.
+package testutil
+
+import (
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+
+	"github.com/calmh/syncthing/vfs"
+)
+
+// FakeFS is an in-memory implementation of vfs.FS. Errors can be injected
+// for specific operations on specific paths, to test error handling that is
+// hard to provoke on a real filesystem.
+type FakeFS struct {
+	entries map[string]*fakeEntry // cleaned path -> entry
+	errs    map[fakeOp]error
+	mut     sync.Mutex
+}
+
+type fakeOp struct {
+	op   string
+	name string
+}
+
+type fakeEntry struct {
+	data  []byte
+	mode  os.FileMode
+	mtime time.Time
+}
+
+// NewFakeFS returns an empty filesystem. The root directory always exists.
+func NewFakeFS() *FakeFS {
+	return &FakeFS{
+		entries: make(map[string]*fakeEntry),
+		errs:    make(map[fakeOp]error),
+	}
+}
+
+// SetError makes the operation op on the named path fail with err. The
+// operations are named after the methods of vfs.FS in lower case, plus
+// "write" for writes to an open file. For "rename" the name is the source.
+// A nil err removes the error.
+func (fs *FakeFS) SetError(op, name string, err error) {
+	fs.mut.Lock()
+	defer fs.mut.Unlock()
+	key := fakeOp{op, filepath.Clean(name)}
+	if err == nil {
+		delete(fs.errs, key)
+	} else {
+		fs.errs[key] = err
+	}
+}
+
+// WriteFile creates the named file with the given contents and permissions.
+func (fs *FakeFS) WriteFile(name string, data []byte, perm os.FileMode) error {
+	fd, err := fs.Create(name)
+	if err != nil {
+		return err
+	}
+	if _, err := fd.Write(data); err != nil {
+		return err
+	}
+	if err := fd.Close(); err != nil {
+		return err
+	}
+	return fs.Chmod(name, perm)
+}
+
+func (fs *FakeFS) Open(name string) (vfs.File, error) {
+	fs.mut.Lock()
+	defer fs.mut.Unlock()
+	name = filepath.Clean(name)
+	if err := fs.check("open", name); err != nil {
+		return nil, err
+	}
+	e, ok := fs.entries[name]
+	if !ok {
+		return nil, notExist("open", name)
+	}
+	if e.mode.IsDir() {
+		return nil, &os.PathError{Op: "open", Path: name, Err: syscall.EISDIR}
+	}
+	return &fakeFile{fs: fs, name: name, entry: e}, nil
+}
+
+func (fs *FakeFS) Create(name string) (vfs.File, error) {
+	fs.mut.Lock()
+	defer fs.mut.Unlock()
+	name = filepath.Clean(name)
+	if err := fs.check("create", name); err != nil {
+		return nil, err
+	}
+	if err := fs.checkParent("create", name); err != nil {
+		return nil, err
+	}
+	e, ok := fs.entries[name]
+	if ok && e.mode.IsDir() {
+		return nil, &os.PathError{Op: "create", Path: name, Err: syscall.EISDIR}
+	}
+	if !ok {
+		e = &fakeEntry{mode: 0666}
+		fs.entries[name] = e
+	}
+	e.data = nil
+	e.mtime = time.Now()
+	return &fakeFile{fs: fs, name: name, entry: e}, nil
+}
+
+func (fs *FakeFS) Rename(from, to string) error {
+	fs.mut.Lock()
+	defer fs.mut.Unlock()
+	from, to = filepath.Clean(from), filepath.Clean(to)
+	if err := fs.check("rename", from); err != nil {
+		return err
+	}
+	e, ok := fs.entries[from]
+	if !ok {
+		return notExist("rename", from)
+	}
+	if err := fs.checkParent("rename", to); err != nil {
+		return err
+	}
+	if t, ok := fs.entries[to]; ok && t.mode.IsDir() && len(fs.children(to)) > 0 {
+		return &os.PathError{Op: "rename", Path: to, Err: syscall.ENOTEMPTY}
+	}
+	if e.mode.IsDir() {
+		for _, c := range fs.descendants(from) {
+			fs.entries[to+c[len(from):]] = fs.entries[c]
+			delete(fs.entries, c)
+		}
+	}
+	delete(fs.entries, from)
+	fs.entries[to] = e
+	return nil
+}
+
+// Link makes name another name for the existing file, sharing its contents
+// and metadata. Directories can't be linked.
+func (fs *FakeFS) Link(existing, name string) error {
+	fs.mut.Lock()
+	defer fs.mut.Unlock()
+	existing, name = filepath.Clean(existing), filepath.Clean(name)
+	if err := fs.check("link", existing); err != nil {
+		return err
+	}
+	e, ok := fs.entries[existing]
+	if !ok {
+		return notExist("link", existing)
+	}
+	if e.mode.IsDir() {
+		return &os.LinkError{Op: "link", Old: existing, New: name, Err: syscall.EPERM}
+	}
+	if err := fs.checkParent("link", name); err != nil {
+		return err
+	}
+	if _, ok := fs.entries[name]; ok || isRoot(name) {
+		return &os.LinkError{Op: "link", Old: existing, New: name, Err: os.ErrExist}
+	}
+	fs.entries[name] = e
+	return nil
+}
+
+func (fs *FakeFS) Remove(name string) error {
+	fs.mut.Lock()
+	defer fs.mut.Unlock()
+	name = filepath.Clean(name)
+	if err := fs.check("remove", name); err != nil {
+		return err
+	}
+	if _, ok := fs.entries[name]; !ok {
+		return notExist("remove", name)
+	}
+	if len(fs.children(name)) > 0 {
+		return &os.PathError{Op: "remove", Path: name, Err: syscall.ENOTEMPTY}
+	}
+	delete(fs.entries, name)
+	return nil
+}
+
+func (fs *FakeFS) Stat(name string) (os.FileInfo, error) {
+	return fs.stat("stat", name)
+}
+
+// Lstat is the same as Stat, as symlinks are not followed.
+func (fs *FakeFS) Lstat(name string) (os.FileInfo, error) {
+	return fs.stat("lstat", name)
+}
+
+func (fs *FakeFS) stat(op, name string) (os.FileInfo, error) {
+	fs.mut.Lock()
+	defer fs.mut.Unlock()
+	name = filepath.Clean(name)
+	if err := fs.check(op, name); err != nil {
+		return nil, err
+	}
+	if isRoot(name) {
+		return fakeInfo{name: name, mode: os.ModeDir | 0777}, nil
+	}
+	e, ok := fs.entries[name]
+	if !ok {
+		return nil, notExist(op, name)
+	}
+	return e.info(name), nil
+}
+
+func (fs *FakeFS) Chtimes(name string, atime, mtime time.Time) error {
+	fs.mut.Lock()
+	defer fs.mut.Unlock()
+	name = filepath.Clean(name)
+	if err := fs.check("chtimes", name); err != nil {
+		return err
+	}
+	e, ok := fs.entries[name]
+	if !ok {
+		return notExist("chtimes", name)
+	}
+	e.mtime = mtime
+	return nil
+}
+
+func (fs *FakeFS) Chmod(name string, mode os.FileMode) error {
+	fs.mut.Lock()
+	defer fs.mut.Unlock()
+	name = filepath.Clean(name)
+	if err := fs.check("chmod", name); err != nil {
+		return err
+	}
+	e, ok := fs.entries[name]
+	if !ok {
+		return notExist("chmod", name)
+	}
+	e.mode = e.mode&os.ModeType | mode&os.ModePerm
+	return nil
+}
+
+func (fs *FakeFS) MkdirAll(name string, perm os.FileMode) error {
+	fs.mut.Lock()
+	defer fs.mut.Unlock()
+	name = filepath.Clean(name)
+	if err := fs.check("mkdirall", name); err != nil {
+		return err
+	}
+	for p := name; !isRoot(p); p = filepath.Dir(p) {
+		if e, ok := fs.entries[p]; ok {
+			if !e.mode.IsDir() {
+				return &os.PathError{Op: "mkdir", Path: p, Err: syscall.ENOTDIR}
+			}
+			continue
+		}
+		fs.entries[p] = &fakeEntry{mode: os.ModeDir | perm&os.ModePerm, mtime: time.Now()}
+	}
+	return nil
+}
+
+func (fs *FakeFS) ReadDir(name string) ([]os.FileInfo, error) {
+	fs.mut.Lock()
+	defer fs.mut.Unlock()
+	name = filepath.Clean(name)
+	if err := fs.check("readdir", name); err != nil {
+		return nil, err
+	}
+	if e, ok := fs.entries[name]; !isRoot(name) && (!ok || !e.mode.IsDir()) {
+		return nil, notExist("readdir", name)
+	}
+	children := fs.children(name)
+	sort.Strings(children)
+	infos := make([]os.FileInfo, len(children))
+	for i, c := range children {
+		infos[i] = fs.entries[c].info(c)
+	}
+	return infos, nil
+}
+
+// Symlink creates a symlink. Symlinks can be read with Readlink but are not
+// followed by any other operation.
+func (fs *FakeFS) Symlink(target, name string) error {
+	fs.mut.Lock()
+	defer fs.mut.Unlock()
+	name = filepath.Clean(name)
+	if err := fs.check("symlink", name); err != nil {
+		return err
+	}
+	if _, ok := fs.entries[name]; ok || isRoot(name) {
+		return &os.LinkError{Op: "symlink", Old: target, New: name, Err: os.ErrExist}
+	}
+	fs.entries[name] = &fakeEntry{data: []byte(target), mode: os.ModeSymlink | 0777, mtime: time.Now()}
+	return nil
+}
+
+func (fs *FakeFS) Readlink(name string) (string, error) {
+	fs.mut.Lock()
+	defer fs.mut.Unlock()
+	name = filepath.Clean(name)
+	if err := fs.check("readlink", name); err != nil {
+		return "", err
+	}
+	e, ok := fs.entries[name]
+	if !ok {
+		return "", notExist("readlink", name)
+	}
+	if e.mode&os.ModeSymlink == 0 {
+		return "", &os.PathError{Op: "readlink", Path: name, Err: syscall.EINVAL}
+	}
+	return string(e.data), nil
+}
+
+// check returns the injected error for the operation, if any.
+func (fs *FakeFS) check(op, name string) error {
+	if err, ok := fs.errs[fakeOp{op, name}]; ok {
+		return &os.PathError{Op: op, Path: name, Err: err}
+	}
+	return nil
+}
+
+func (fs *FakeFS) checkParent(op, name string) error {
+	dir := filepath.Dir(name)
+	if isRoot(dir) {
+		return nil
+	}
+	if e, ok := fs.entries[dir]; !ok || !e.mode.IsDir() {
+		return notExist(op, name)
+	}
+	return nil
+}
+
+// children returns the paths of the entries directly below dir.
+func (fs *FakeFS) children(dir string) []string {
+	var res []string
+	for p := range fs.entries {
+		if p != dir && filepath.Dir(p) == dir {
+			res = append(res, p)
+		}
+	}
+	return res
+}
+
+// descendants returns the paths of all entries below dir.
+func (fs *FakeFS) descendants(dir string) []string {
+	var res []string
+	prefix := dir + string(os.PathSeparator)
+	for p := range fs.entries {
+		if strings.HasPrefix(p, prefix) {
+			res = append(res, p)
+		}
+	}
+	return res
+}
+
+func isRoot(name string) bool {
+	return name == "." || name == string(os.PathSeparator) || filepath.Dir(name) == name
+}
+
+func notExist(op, name string) error {
+	return &os.PathError{Op: op, Path: name, Err: os.ErrNotExist}
+}
+
+func (e *fakeEntry) info(name string) os.FileInfo {
+	return fakeInfo{
+		name:  filepath.Base(name),
+		size:  int64(len(e.data)),
+		mode:  e.mode,
+		mtime: e.mtime,
+	}
+}
+
+type fakeInfo struct {
+	name  string
+	size  int64
+	mode  os.FileMode
+	mtime time.Time
+}
+
+func (i fakeInfo) Name() string       { return i.name }
+func (i fakeInfo) Size() int64        { return i.size }
+func (i fakeInfo) Mode() os.FileMode  { return i.mode }
+func (i fakeInfo) ModTime() time.Time { return i.mtime }
+func (i fakeInfo) IsDir() bool        { return i.mode.IsDir() }
+func (i fakeInfo) Sys() interface{}   { return nil }
+
+type fakeFile struct {
+	fs     *FakeFS
+	name   string
+	entry  *fakeEntry
+	offset int64
+}
+
+func (f *fakeFile) Read(bs []byte) (int, error) {
+	n, err := f.ReadAt(bs, f.offset)
+	f.offset += int64(n)
+	if err == io.EOF && n > 0 {
+		err = nil
+	}
+	return n, err
+}
+
+func (f *fakeFile) ReadAt(bs []byte, offset int64) (int, error) {
+	f.fs.mut.Lock()
+	defer f.fs.mut.Unlock()
+	if offset >= int64(len(f.entry.data)) {
+		return 0, io.EOF
+	}
+	n := copy(bs, f.entry.data[offset:])
+	if n < len(bs) {
+		return n, io.EOF
+	}
+	return n, nil
+}
+
+func (f *fakeFile) Write(bs []byte) (int, error) {
+	n, err := f.WriteAt(bs, f.offset)
+	f.offset += int64(n)
+	return n, err
+}
+
+func (f *fakeFile) WriteAt(bs []byte, offset int64) (int, error) {
+	f.fs.mut.Lock()
+	defer f.fs.mut.Unlock()
+	if err := f.fs.check("write", f.name); err != nil {
+		return 0, err
+	}
+	if end := offset + int64(len(bs)); end > int64(len(f.entry.data)) {
+		data := make([]byte, end)
+		copy(data, f.entry.data)
+		f.entry.data = data
+	}
+	copy(f.entry.data[offset:], bs)
+	f.entry.mtime = time.Now()
+	return len(bs), nil
+}
+
+func (f *fakeFile) Close() error {
+	return nil
+}
@@ -0,0 +1,180 @@
+package testutil
+
+import (
+	"os"
+	"path/filepath"
+	"reflect"
+	"syscall"
+	"testing"
+	"time"
+
+	"github.com/calmh/syncthing/vfs"
+)
+
+func TestFakeFSReadWrite(t *testing.T) {
+	fs := NewFakeFS()
+	if err := fs.MkdirAll(filepath.Join("a", "b"), 0755); err != nil {
+		t.Fatal(err)
+	}
+
+	name := filepath.Join("a", "b", "file")
+	fd, err := fs.Create(name)
+	if err != nil {
+		t.Fatal(err)
+	}
+	fd.Write([]byte("hello"))
+	fd.WriteAt([]byte("world"), 10)
+	fd.Close()
+
+	bs, err := vfs.ReadFile(fs, name)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if exp := "hello\x00\x00\x00\x00\x00world"; string(bs) != exp {
+		t.Errorf("Incorrect contents %q != %q", bs, exp)
+	}
+
+	info, err := fs.Stat(name)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if info.Size() != 15 || info.IsDir() || info.Name() != "file" {
+		t.Errorf("Incorrect file info %v %v %v", info.Size(), info.IsDir(), info.Name())
+	}
+
+	if _, err := fs.Create(filepath.Join("missing", "file")); !os.IsNotExist(err) {
+		t.Errorf("Unexpected error creating file in missing directory: %v", err)
+	}
+	if _, err := fs.Open("missing"); !os.IsNotExist(err) {
+		t.Errorf("Unexpected error opening missing file: %v", err)
+	}
+}
+
+func TestFakeFSMetadata(t *testing.T) {
+	fs := NewFakeFS()
+	if err := fs.WriteFile("file", []byte("data"), 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	mtime := time.Unix(1234567890, 0)
+	if err := fs.Chtimes("file", mtime, mtime); err != nil {
+		t.Fatal(err)
+	}
+	if err := fs.Chmod("file", 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	info, err := fs.Lstat("file")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !info.ModTime().Equal(mtime) {
+		t.Errorf("Incorrect modtime %v != %v", info.ModTime(), mtime)
+	}
+	if info.Mode() != 0644 {
+		t.Errorf("Incorrect mode %v != 0644", info.Mode())
+	}
+}
+
+func TestFakeFSRenameRemove(t *testing.T) {
+	fs := NewFakeFS()
+	fs.MkdirAll("dir", 0755)
+	fs.WriteFile(filepath.Join("dir", "file"), []byte("data"), 0644)
+
+	if err := fs.Remove("dir"); err == nil {
+		t.Error("Unexpected nil error removing non-empty directory")
+	}
+
+	if err := fs.Rename("dir", "moved"); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := fs.Stat(filepath.Join("dir", "file")); !os.IsNotExist(err) {
+		t.Error("File still present at old location")
+	}
+	if bs, _ := vfs.ReadFile(fs, filepath.Join("moved", "file")); string(bs) != "data" {
+		t.Errorf("Incorrect contents after rename %q", bs)
+	}
+
+	if err := fs.Remove(filepath.Join("moved", "file")); err != nil {
+		t.Fatal(err)
+	}
+	if err := fs.Remove("moved"); err != nil {
+		t.Fatal(err)
+	}
+	if infos, _ := fs.ReadDir("."); len(infos) != 0 {
+		t.Errorf("Unexpected entries left %v", infos)
+	}
+}
+
+func TestFakeFSLink(t *testing.T) {
+	fs := NewFakeFS()
+	fs.WriteFile("file", []byte("data"), 0644)
+
+	if err := fs.Link("file", "link"); err != nil {
+		t.Fatal(err)
+	}
+	if err := fs.Link("file", "link"); !os.IsExist(err) {
+		t.Errorf("Incorrect error %v linking to an existing name", err)
+	}
+	if err := fs.Link("nonexistent", "other"); !os.IsNotExist(err) {
+		t.Errorf("Incorrect error %v linking a nonexistent file", err)
+	}
+
+	// The names share the contents until one is replaced.
+	fs.WriteFile("file", []byte("changed"), 0644)
+	if bs, _ := vfs.ReadFile(fs, "link"); string(bs) != "changed" {
+		t.Errorf("Incorrect contents through link %q", bs)
+	}
+	fs.WriteFile("new", []byte("new"), 0644)
+	fs.Rename("new", "file")
+	if bs, _ := vfs.ReadFile(fs, "link"); string(bs) != "changed" {
+		t.Errorf("Incorrect contents after replacing the other name %q", bs)
+	}
+}
+
+func TestFakeFSInjectedErrors(t *testing.T) {
+	fs := NewFakeFS()
+	fs.WriteFile("full", nil, 0644)
+
+	fs.SetError("write", "full", syscall.ENOSPC)
+	fd, _ := fs.Open("full")
+	if _, err := fd.WriteAt([]byte("data"), 0); err == nil || err.(*os.PathError).Err != syscall.ENOSPC {
+		t.Errorf("Incorrect write error %v", err)
+	}
+
+	fs.SetError("rename", "full", syscall.EXDEV)
+	if err := fs.Rename("full", "other"); err == nil || err.(*os.PathError).Err != syscall.EXDEV {
+		t.Errorf("Incorrect rename error %v", err)
+	}
+
+	fs.SetError("rename", "full", nil)
+	if err := fs.Rename("full", "other"); err != nil {
+		t.Errorf("Unexpected error after clearing: %v", err)
+	}
+}
+
+func TestFakeFSWalk(t *testing.T) {
+	fs := NewFakeFS()
+	fs.MkdirAll(filepath.Join("root", "b", "skipped"), 0755)
+	fs.MkdirAll(filepath.Join("root", "a"), 0755)
+	fs.WriteFile(filepath.Join("root", "a", "file"), nil, 0644)
+	fs.WriteFile(filepath.Join("root", "b", "skipped", "file"), nil, 0644)
+	fs.WriteFile(filepath.Join("root", "c"), nil, 0644)
+
+	var walked []string
+	vfs.Walk(fs, "root", func(path string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		walked = append(walked, filepath.ToSlash(path))
+		if info.Name() == "skipped" {
+			return filepath.SkipDir
+		}
+		return nil
+	})
+
+	expected := []string{"root", "root/a", "root/a/file", "root/b", "root/b/skipped", "root/c"}
+	if !reflect.DeepEqual(walked, expected) {
+		t.Errorf("Incorrect walk\n  %v\n  %v", walked, expected)
+	}
+}
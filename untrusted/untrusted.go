@@ -0,0 +1,240 @@
+// Package untrusted implements the encryption of file names and contents for
+// repositories shared with untrusted nodes. An untrusted node stores and
+// serves the encrypted form of each file without being able to read it; only
+// nodes that have the repository key can.
+//
+// The encrypted form of a file consists of its blocks, each encrypted on its
+// own, followed by a trailer block holding the encrypted file metadata. File
+// names are replaced by deterministic tokens. See the protocol specification
+// for details.
+package untrusted
+
+import (
+	"bytes"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/base32"
+	"encoding/binary"
+	"errors"
+	"strings"
+
+	"github.com/calmh/syncthing/protocol"
+)
+
+const (
+	nonceSize = 12
+	tagSize   = 16
+
+	// Overhead is the number of bytes an encrypted block is larger than
+	// the plaintext block.
+	Overhead = nonceSize + tagSize
+
+	// The longest path component of a file name token.
+	maxComponent = 200
+
+	// The number of PBKDF2 iterations when deriving the key from a
+	// password.
+	keyIterations = 100000
+
+	// The block index used for the trailer in the additional data.
+	trailerIndex = ^uint32(0)
+)
+
+var (
+	ErrInvalidToken = errors.New("invalid file name token")
+	ErrDecrypt      = errors.New("decryption failed")
+)
+
+// A Key encrypts and decrypts the files of one repository.
+type Key struct {
+	aead    cipher.AEAD
+	nonceMk []byte // key for deriving deterministic nonces
+}
+
+// NewKey derives the key for the repository from the password.
+func NewKey(repo, password string) *Key {
+	master := pbkdf2([]byte(password), []byte("syncthing untrusted "+repo), keyIterations)
+
+	block, err := aes.NewCipher(subkey(master, "encryption"))
+	if err != nil {
+		panic(err)
+	}
+	aead, err := cipher.NewGCM(block)
+	if err != nil {
+		panic(err)
+	}
+	return &Key{
+		aead:    aead,
+		nonceMk: subkey(master, "nonce"),
+	}
+}
+
+func subkey(master []byte, purpose string) []byte {
+	h := hmac.New(sha256.New, master)
+	h.Write([]byte(purpose))
+	return h.Sum(nil)
+}
+
+// nonce returns a nonce derived from the given parts. Equal parts result in
+// equal ciphertexts, which keeps the encrypted index stable; different parts
+// never share a nonce.
+func (k *Key) nonce(parts ...[]byte) []byte {
+	h := hmac.New(sha256.New, k.nonceMk)
+	for _, p := range parts {
+		var l [4]byte
+		binary.BigEndian.PutUint32(l[:], uint32(len(p)))
+		h.Write(l[:])
+		h.Write(p)
+	}
+	return h.Sum(nil)[:nonceSize]
+}
+
+func (k *Key) seal(nonce, plain, ad []byte) []byte {
+	out := make([]byte, nonceSize, nonceSize+len(plain)+tagSize)
+	copy(out, nonce)
+	return k.aead.Seal(out, nonce, plain, ad)
+}
+
+func (k *Key) open(enc, ad []byte) ([]byte, error) {
+	if len(enc) < Overhead {
+		return nil, ErrDecrypt
+	}
+	plain, err := k.aead.Open(nil, enc[:nonceSize], enc[nonceSize:], ad)
+	if err != nil {
+		return nil, ErrDecrypt
+	}
+	return plain, nil
+}
+
+var tokenEncoding = base32.StdEncoding
+
+// EncryptName returns the token that replaces the file name. The same name
+// always results in the same token. Tokens use only upper case letters and
+// digits, split into path components short enough for any file system.
+func (k *Key) EncryptName(name string) string {
+	enc := k.seal(k.nonce([]byte("name"), []byte(name)), []byte(name), nil)
+	s := strings.TrimRight(tokenEncoding.EncodeToString(enc), "=")
+
+	var parts []string
+	for len(s) > maxComponent {
+		parts = append(parts, s[:maxComponent])
+		s = s[maxComponent:]
+	}
+	parts = append(parts, s)
+	return strings.Join(parts, "/")
+}
+
+// DecryptName returns the file name that the token replaces.
+func (k *Key) DecryptName(token string) (string, error) {
+	s := strings.Replace(token, "/", "", -1)
+	if pad := len(s) % 8; pad != 0 {
+		s += strings.Repeat("=", 8-pad)
+	}
+	enc, err := tokenEncoding.DecodeString(s)
+	if err != nil {
+		return "", ErrInvalidToken
+	}
+	name, err := k.open(enc, nil)
+	if err != nil {
+		return "", ErrInvalidToken
+	}
+	return string(name), nil
+}
+
+// blockAD binds an encrypted block to its place in a given version of the
+// file, so that blocks can't be swapped around by the untrusted node.
+func blockAD(token string, version uint64, index uint32) []byte {
+	var buf bytes.Buffer
+	buf.WriteString(token)
+	binary.Write(&buf, binary.BigEndian, version)
+	binary.Write(&buf, binary.BigEndian, index)
+	return buf.Bytes()
+}
+
+// EncryptBlock returns the encrypted form of block number index of the
+// given version of the file with the given token.
+func (k *Key) EncryptBlock(token string, version uint64, index int, plain []byte) []byte {
+	ad := blockAD(token, version, uint32(index))
+	hash := sha256.Sum256(plain)
+	return k.seal(k.nonce([]byte("block"), ad, hash[:]), plain, ad)
+}
+
+// DecryptBlock returns the plaintext of an encrypted block, verifying that
+// it is block number index of the given version of the file.
+func (k *Key) DecryptBlock(token string, version uint64, index int, enc []byte) ([]byte, error) {
+	return k.open(enc, blockAD(token, version, uint32(index)))
+}
+
+// EncryptTrailer returns the trailer block for the file, holding its
+// metadata. The block list is not included; the plaintext block sizes
+// follow from the encrypted ones.
+func (k *Key) EncryptTrailer(token string, f protocol.FileInfo) []byte {
+	f.Blocks = nil
+	plain := f.MarshalXDR()
+	ad := blockAD(token, f.Version, trailerIndex)
+	hash := sha256.Sum256(plain)
+	return k.seal(k.nonce([]byte("trailer"), ad, hash[:]), plain, ad)
+}
+
+// DecryptTrailer returns the file metadata held in the trailer block.
+func (k *Key) DecryptTrailer(token string, version uint64, enc []byte) (protocol.FileInfo, error) {
+	var f protocol.FileInfo
+	plain, err := k.open(enc, blockAD(token, version, trailerIndex))
+	if err != nil {
+		return f, err
+	}
+	if err := f.UnmarshalXDR(plain); err != nil {
+		return f, err
+	}
+	if f.Version != version {
+		return f, ErrDecrypt
+	}
+	return f, nil
+}
+
+// EncryptFileInfo returns the file as announced to untrusted nodes. The
+// block function returns the plaintext of each block of the file.
+func (k *Key) EncryptFileInfo(f protocol.FileInfo, block func(index int) ([]byte, error)) (protocol.FileInfo, error) {
+	token := k.EncryptName(f.Name)
+	ef := protocol.FileInfo{
+		Name:     token,
+		Flags:    protocol.FlagEncrypted | 0644,
+		Modified: f.Modified,
+		Version:  f.Version,
+	}
+	if f.Flags&protocol.FlagDeleted != 0 {
+		ef.Flags |= protocol.FlagDeleted
+		return ef, nil
+	}
+
+	for i := range f.Blocks {
+		plain, err := block(i)
+		if err != nil {
+			return protocol.FileInfo{}, err
+		}
+		ef.Blocks = append(ef.Blocks, encryptedBlockInfo(k.EncryptBlock(token, f.Version, i, plain)))
+	}
+	ef.Blocks = append(ef.Blocks, encryptedBlockInfo(k.EncryptTrailer(token, f)))
+	return ef, nil
+}
+
+func encryptedBlockInfo(enc []byte) protocol.BlockInfo {
+	hash := sha256.Sum256(enc)
+	return protocol.BlockInfo{Size: uint32(len(enc)), Hash: hash[:]}
+}
+
+// BlockIndex returns the index of the encrypted block at the given offset
+// in the encrypted form of a file, given the sizes of its encrypted blocks,
+// and whether it is the trailer block.
+func BlockIndex(blocks []protocol.BlockInfo, offset int64) (index int, trailer bool, ok bool) {
+	var o int64
+	for i, b := range blocks {
+		if o == offset {
+			return i, i == len(blocks)-1, true
+		}
+		o += int64(b.Size)
+	}
+	return 0, false, false
+}
@@ -0,0 +1,345 @@
+package untrusted
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"io"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/calmh/syncthing/protocol"
+)
+
+const testBlockSize = 1024
+
+func TestPBKDF2(t *testing.T) {
+	// RFC 7914, section 11
+	key := pbkdf2([]byte("passwd"), []byte("salt"), 1)
+	exp := "55ac046e56e3089fec1691c22544b605f94185216dde0465e68b9d57c20dacbc"
+	if h := hex.EncodeToString(key); h != exp {
+		t.Errorf("Incorrect key %s != expected %s", h, exp)
+	}
+}
+
+func TestNameTokens(t *testing.T) {
+	k := NewKey("default", "secret")
+
+	names := []string{
+		"a",
+		"dir/file.txt",
+		"räksmörgås",
+		strings.Repeat("long/", 100) + "name",
+	}
+	for _, name := range names {
+		token := k.EncryptName(name)
+		if strings.Contains(token, name) {
+			t.Errorf("Token %q contains the name", token)
+		}
+		for _, c := range strings.Split(token, "/") {
+			if len(c) == 0 || len(c) > maxComponent {
+				t.Errorf("Token %q has an invalid component length %d", token, len(c))
+			}
+		}
+		if again := k.EncryptName(name); again != token {
+			t.Errorf("Token for %q not deterministic: %q != %q", name, again, token)
+		}
+		dec, err := k.DecryptName(token)
+		if err != nil {
+			t.Error(err)
+		}
+		if dec != name {
+			t.Errorf("Incorrect decrypted name %q != %q", dec, name)
+		}
+	}
+
+	if _, err := NewKey("default", "wrong").DecryptName(k.EncryptName("a")); err != ErrInvalidToken {
+		t.Errorf("Unexpected error %v decrypting with the wrong key", err)
+	}
+	if _, err := NewKey("other", "secret").DecryptName(k.EncryptName("a")); err != ErrInvalidToken {
+		t.Errorf("Unexpected error %v decrypting with another repository's key", err)
+	}
+}
+
+func TestBlockBinding(t *testing.T) {
+	k := NewKey("default", "secret")
+	token := k.EncryptName("file")
+	enc := k.EncryptBlock(token, 1000, 1, []byte("block data"))
+
+	if len(enc) != len("block data")+Overhead {
+		t.Errorf("Incorrect encrypted size %d", len(enc))
+	}
+	if plain, err := k.DecryptBlock(token, 1000, 1, enc); err != nil || string(plain) != "block data" {
+		t.Errorf("Incorrect decryption %q, %v", plain, err)
+	}
+	if _, err := k.DecryptBlock(token, 1000, 2, enc); err != ErrDecrypt {
+		t.Error("Block decrypted at another index")
+	}
+	if _, err := k.DecryptBlock(token, 1001, 1, enc); err != ErrDecrypt {
+		t.Error("Block decrypted for another version")
+	}
+	if _, err := k.DecryptBlock(k.EncryptName("other"), 1000, 1, enc); err != ErrDecrypt {
+		t.Error("Block decrypted for another file")
+	}
+}
+
+// trustedModel serves the files of a repository in encrypted form, as a
+// trusted node does towards an untrusted one.
+type trustedModel struct {
+	key   *Key
+	files map[string][]byte // plaintext name -> data
+	index []protocol.FileInfo
+}
+
+func newTrustedModel(key *Key, files map[string][]byte) *trustedModel {
+	m := &trustedModel{key: key, files: files}
+	for name := range files {
+		f := protocol.FileInfo{
+			Name:     name,
+			Flags:    0640,
+			Modified: 1400000000,
+			Version:  1000,
+			Blocks:   plainBlocks(files[name]),
+		}
+		ef, err := key.EncryptFileInfo(f, func(i int) ([]byte, error) {
+			return blockData(files[name], i), nil
+		})
+		if err != nil {
+			panic(err)
+		}
+		m.index = append(m.index, ef)
+	}
+	return m
+}
+
+func plainBlocks(data []byte) []protocol.BlockInfo {
+	var blocks []protocol.BlockInfo
+	for i := 0; i*testBlockSize < len(data); i++ {
+		b := blockData(data, i)
+		hash := sha256.Sum256(b)
+		blocks = append(blocks, protocol.BlockInfo{Size: uint32(len(b)), Hash: hash[:]})
+	}
+	return blocks
+}
+
+func blockData(data []byte, i int) []byte {
+	end := (i + 1) * testBlockSize
+	if end > len(data) {
+		end = len(data)
+	}
+	return data[i*testBlockSize : end]
+}
+
+func (m *trustedModel) Index(nodeID, repo string, files []protocol.FileInfo)       {}
+func (m *trustedModel) IndexUpdate(nodeID, repo string, files []protocol.FileInfo) {}
+func (m *trustedModel) ClusterConfig(nodeID string, config protocol.ClusterConfigMessage) {
+}
+func (m *trustedModel) Close(nodeID string, err error) {}
+
+func (m *trustedModel) Request(nodeID, repo, token string, offset int64, size int) ([]byte, error) {
+	name, err := m.key.DecryptName(token)
+	if err != nil {
+		return nil, err
+	}
+	for _, ef := range m.index {
+		if ef.Name != token {
+			continue
+		}
+		i, trailer, ok := BlockIndex(ef.Blocks, offset)
+		if !ok {
+			break
+		}
+		if trailer {
+			f := protocol.FileInfo{Name: name, Flags: 0640, Modified: ef.Modified, Version: ef.Version}
+			return m.key.EncryptTrailer(token, f), nil
+		}
+		return m.key.EncryptBlock(token, ef.Version, i, blockData(m.files[name], i)), nil
+	}
+	return nil, io.EOF
+}
+
+// untrustedModel stores the encrypted files it is given and serves them
+// verbatim, as an untrusted node does.
+type untrustedModel struct {
+	indexes chan []protocol.FileInfo
+	index   []protocol.FileInfo
+	data    map[string][]byte // token -> encrypted file
+}
+
+func (m *untrustedModel) Index(nodeID, repo string, files []protocol.FileInfo) {
+	m.indexes <- files
+}
+func (m *untrustedModel) IndexUpdate(nodeID, repo string, files []protocol.FileInfo) {}
+func (m *untrustedModel) ClusterConfig(nodeID string, config protocol.ClusterConfigMessage) {
+}
+func (m *untrustedModel) Close(nodeID string, err error) {}
+
+func (m *untrustedModel) Request(nodeID, repo, token string, offset int64, size int) ([]byte, error) {
+	data, ok := m.data[token]
+	if !ok || offset+int64(size) > int64(len(data)) {
+		return nil, io.EOF
+	}
+	return data[offset : offset+int64(size)], nil
+}
+
+// pull fetches all blocks of the encrypted files from the connection.
+func (m *untrustedModel) pull(c protocol.Connection, repo string) error {
+	m.data = make(map[string][]byte)
+	for _, ef := range m.index {
+		var data []byte
+		for _, b := range ef.Blocks {
+			bs, err := c.Request(repo, ef.Name, int64(len(data)), int(b.Size))
+			if err != nil {
+				return err
+			}
+			if hash := sha256.Sum256(bs); !bytes.Equal(hash[:], b.Hash) {
+				return ErrDecrypt
+			}
+			data = append(data, bs...)
+		}
+		m.data[ef.Name] = data
+	}
+	return nil
+}
+
+type indexModel struct {
+	indexes chan []protocol.FileInfo
+}
+
+func (m *indexModel) Index(nodeID, repo string, files []protocol.FileInfo) {
+	m.indexes <- files
+}
+func (m *indexModel) IndexUpdate(nodeID, repo string, files []protocol.FileInfo) {}
+func (m *indexModel) ClusterConfig(nodeID string, config protocol.ClusterConfigMessage) {
+}
+func (m *indexModel) Close(nodeID string, err error) {}
+func (m *indexModel) Request(nodeID, repo, name string, offset int64, size int) ([]byte, error) {
+	return nil, io.EOF
+}
+
+func connect(aID string, a protocol.Model, bID string, b protocol.Model) (protocol.Connection, protocol.Connection) {
+	ar, aw := io.Pipe()
+	br, bw := io.Pipe()
+	// The connection to a node is named after the remote node.
+	ac := protocol.NewConnection(bID, ar, bw, a)
+	bc := protocol.NewConnection(aID, br, aw, b)
+	return ac, bc
+}
+
+func receive(t *testing.T, ch chan []protocol.FileInfo) []protocol.FileInfo {
+	select {
+	case idx := <-ch:
+		return idx
+	case <-time.After(5 * time.Second):
+		t.Fatal("Timeout waiting for index")
+	}
+	return nil
+}
+
+// Node A shares a file with node B, relayed by the untrusted node U that
+// only ever sees the encrypted form.
+func TestRelayThroughUntrusted(t *testing.T) {
+	const repo = "default"
+	contents := make([]byte, 3*testBlockSize+17)
+	for i := range contents {
+		contents[i] = byte(i % 251)
+	}
+	name := "dir/secret file.txt"
+
+	a := newTrustedModel(NewKey(repo, "secret"), map[string][]byte{name: contents})
+	u := &untrustedModel{indexes: make(chan []protocol.FileInfo, 1)}
+	b := &indexModel{indexes: make(chan []protocol.FileInfo, 1)}
+
+	aToU, uToA := connect("a", a, "u", u)
+	uToB, bToU := connect("u", u, "b", b)
+
+	// A announces the encrypted file to U, which pulls it.
+
+	aToU.Index(repo, a.index)
+	u.index = receive(t, u.indexes)
+	if len(u.index) != 1 {
+		t.Fatalf("Incorrect index received by U: %v", u.index)
+	}
+	ef := u.index[0]
+	if ef.Name == name || strings.Contains(ef.Name, "secret") {
+		t.Errorf("Plaintext name %q visible to U", ef.Name)
+	}
+	if ef.Flags&protocol.FlagEncrypted == 0 {
+		t.Error("Encrypted flag not set")
+	}
+	if l := len(ef.Blocks); l != 5 {
+		t.Errorf("Incorrect number of encrypted blocks %d != 5", l)
+	}
+	if err := u.pull(uToA, repo); err != nil {
+		t.Fatal(err)
+	}
+	if bytes.Contains(u.data[ef.Name], contents[:64]) {
+		t.Error("Plaintext contents visible to U")
+	}
+
+	// U relays the file, as received, to B.
+
+	uToB.Index(repo, u.index)
+	idx := receive(t, b.indexes)
+	if len(idx) != 1 {
+		t.Fatalf("Incorrect index received by B: %v", idx)
+	}
+	ef = idx[0]
+
+	key := NewKey(repo, "secret")
+	dec, err := key.DecryptName(ef.Name)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if dec != name {
+		t.Errorf("Incorrect name %q != %q", dec, name)
+	}
+
+	var offset int64
+	for _, b := range ef.Blocks[:len(ef.Blocks)-1] {
+		offset += int64(b.Size)
+	}
+	trailer := ef.Blocks[len(ef.Blocks)-1]
+	bs, err := bToU.Request(repo, ef.Name, offset, int(trailer.Size))
+	if err != nil {
+		t.Fatal(err)
+	}
+	f, err := key.DecryptTrailer(ef.Name, ef.Version, bs)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if f.Name != name || f.Flags != 0640 || f.Modified != 1400000000 {
+		t.Errorf("Incorrect file info in trailer: %+v", f)
+	}
+
+	var data []byte
+	offset = 0
+	for i, b := range ef.Blocks[:len(ef.Blocks)-1] {
+		bs, err := bToU.Request(repo, ef.Name, offset, int(b.Size))
+		if err != nil {
+			t.Fatal(err)
+		}
+		plain, err := key.DecryptBlock(ef.Name, ef.Version, i, bs)
+		if err != nil {
+			t.Fatal(err)
+		}
+		data = append(data, plain...)
+		offset += int64(b.Size)
+	}
+	if !bytes.Equal(data, contents) {
+		t.Error("Incorrect contents received by B")
+	}
+
+	// A block tampered with by U fails to decrypt.
+
+	stored := u.data[ef.Name]
+	stored[Overhead] ^= 1
+	bs, err = bToU.Request(repo, ef.Name, 0, int(ef.Blocks[0].Size))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := key.DecryptBlock(ef.Name, ef.Version, 0, bs); err != ErrDecrypt {
+		t.Error("Tampered block decrypted")
+	}
+}
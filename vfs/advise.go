@@ -0,0 +1,35 @@
+package vfs
+
+import "os"
+
+// Advice is a hint about how the contents of an open file will be used.
+type Advice int
+
+const (
+	// The file will be read sequentially from start to end.
+	AdviceSequential Advice = iota
+	// The file contents will not be needed again soon and need not be kept
+	// in the page cache.
+	AdviceDontNeed
+)
+
+type advisor interface {
+	Advise(advice Advice)
+}
+
+// Advise passes the hint on to the file, if it accepts hints. Hints are
+// best effort; errors are ignored and the file behaves the same either way.
+func Advise(fd File, advice Advice) {
+	if a, ok := fd.(advisor); ok {
+		a.Advise(advice)
+	}
+}
+
+// osFile is a file opened for reading by OS.
+type osFile struct {
+	*os.File
+}
+
+func (f osFile) Advise(advice Advice) {
+	fadvise(f.File, advice)
+}
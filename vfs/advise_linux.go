@@ -0,0 +1,22 @@
+// +build linux,amd64 linux,arm64
+
+package vfs
+
+import (
+	"os"
+	"syscall"
+)
+
+func fadvise(fd *os.File, advice Advice) {
+	var adv uintptr
+	switch advice {
+	case AdviceSequential:
+		adv = 2 // POSIX_FADV_SEQUENTIAL
+	case AdviceDontNeed:
+		adv = 4 // POSIX_FADV_DONTNEED
+	default:
+		return
+	}
+	// Offset and length zero covers the whole file.
+	syscall.Syscall6(syscall.SYS_FADVISE64, fd.Fd(), 0, 0, adv, 0, 0)
+}
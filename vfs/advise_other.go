@@ -0,0 +1,8 @@
+// +build !linux !amd64,!arm64
+
+package vfs
+
+import "os"
+
+func fadvise(fd *os.File, advice Advice) {
+}
@@ -0,0 +1,44 @@
+package vfs
+
+import (
+	"bytes"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestOpenAdvise(t *testing.T) {
+	dir, err := ioutil.TempDir("", "vfs")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	data := []byte("some data to read back")
+	name := filepath.Join(dir, "file")
+	if err := ioutil.WriteFile(name, data, 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	fd, err := OS.Open(name)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer fd.Close()
+
+	Advise(fd, AdviceSequential)
+	bs, err := ioutil.ReadAll(fd)
+	if err != nil {
+		t.Fatal(err)
+	}
+	Advise(fd, AdviceDontNeed)
+
+	if !bytes.Equal(bs, data) {
+		t.Errorf("Incorrect data %q != %q", bs, data)
+	}
+
+	if _, err := OS.Open(filepath.Join(dir, "missing")); !os.IsNotExist(err) {
+		t.Errorf("Incorrect error %v for missing file", err)
+	}
+}
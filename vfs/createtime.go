@@ -0,0 +1,34 @@
+package vfs
+
+import (
+	"errors"
+	"os"
+	"time"
+)
+
+// ErrNoCreateTime is returned when the creation time of a file cannot be
+// set, because the filesystem or platform doesn't support it.
+var ErrNoCreateTime = errors.New("creation time not supported")
+
+// CreateTime returns the creation time of the file described by info, if
+// the platform records one.
+func CreateTime(info os.FileInfo) (time.Time, bool) {
+	return createTime(info)
+}
+
+type createTimeSetter interface {
+	SetCreateTime(name string, t time.Time) error
+}
+
+// SetCreateTime sets the creation time of the named file. Returns
+// ErrNoCreateTime if the filesystem doesn't support it.
+func SetCreateTime(fs FS, name string, t time.Time) error {
+	if s, ok := fs.(createTimeSetter); ok {
+		return s.SetCreateTime(name, t)
+	}
+	return ErrNoCreateTime
+}
+
+func (osFS) SetCreateTime(name string, t time.Time) error {
+	return setCreateTime(name, t)
+}
@@ -0,0 +1,30 @@
+package vfs
+
+import (
+	"os"
+	"syscall"
+	"time"
+)
+
+func createTime(info os.FileInfo) (time.Time, bool) {
+	st, ok := info.Sys().(*syscall.Stat_t)
+	if !ok {
+		return time.Time{}, false
+	}
+	return time.Unix(st.Birthtimespec.Unix()), true
+}
+
+// There is no call to set the birth time, but the filesystem moves it back
+// when the modification time is set to before it. It can thus only be made
+// earlier. The access and modification times are restored afterwards.
+func setCreateTime(name string, t time.Time) error {
+	info, err := os.Lstat(name)
+	if err != nil {
+		return err
+	}
+	st := info.Sys().(*syscall.Stat_t)
+	if err := os.Chtimes(name, t, t); err != nil {
+		return err
+	}
+	return os.Chtimes(name, time.Unix(st.Atimespec.Unix()), info.ModTime())
+}
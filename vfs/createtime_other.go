@@ -0,0 +1,18 @@
+// +build !darwin,!windows
+
+package vfs
+
+import (
+	"os"
+	"time"
+)
+
+// Linux records a birth time on some filesystems, but it cannot be set.
+
+func createTime(info os.FileInfo) (time.Time, bool) {
+	return time.Time{}, false
+}
+
+func setCreateTime(name string, t time.Time) error {
+	return ErrNoCreateTime
+}
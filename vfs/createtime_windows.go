@@ -0,0 +1,32 @@
+package vfs
+
+import (
+	"os"
+	"syscall"
+	"time"
+)
+
+func createTime(info os.FileInfo) (time.Time, bool) {
+	d, ok := info.Sys().(*syscall.Win32FileAttributeData)
+	if !ok {
+		return time.Time{}, false
+	}
+	return time.Unix(0, d.CreationTime.Nanoseconds()), true
+}
+
+func setCreateTime(name string, t time.Time) error {
+	p, err := syscall.UTF16PtrFromString(name)
+	if err != nil {
+		return err
+	}
+	h, err := syscall.CreateFile(p, syscall.FILE_WRITE_ATTRIBUTES, syscall.FILE_SHARE_WRITE, nil, syscall.OPEN_EXISTING, syscall.FILE_FLAG_BACKUP_SEMANTICS, 0)
+	if err != nil {
+		return &os.PathError{Op: "setcreatetime", Path: name, Err: err}
+	}
+	defer syscall.Close(h)
+	ct := syscall.NsecToFiletime(t.UnixNano())
+	if err := syscall.SetFileTime(h, &ct, nil, nil); err != nil {
+		return &os.PathError{Op: "setcreatetime", Path: name, Err: err}
+	}
+	return nil
+}
@@ -0,0 +1,25 @@
+package vfs
+
+import "errors"
+
+// ErrNoFreeSpace is returned when the free space of a filesystem cannot be
+// told, because the filesystem or platform doesn't support it.
+var ErrNoFreeSpace = errors.New("free space not supported")
+
+type freeSpacer interface {
+	FreeSpace(name string) (int64, error)
+}
+
+// FreeSpace returns the number of bytes available for writing to the
+// filesystem holding the named file or directory. Returns ErrNoFreeSpace if
+// the filesystem doesn't support it.
+func FreeSpace(fs FS, name string) (int64, error) {
+	if s, ok := fs.(freeSpacer); ok {
+		return s.FreeSpace(name)
+	}
+	return 0, ErrNoFreeSpace
+}
+
+func (osFS) FreeSpace(name string) (int64, error) {
+	return freeSpace(name)
+}
@@ -0,0 +1,7 @@
+// +build !linux,!darwin,!freebsd,!dragonfly,!windows
+
+package vfs
+
+func freeSpace(name string) (int64, error) {
+	return 0, ErrNoFreeSpace
+}
@@ -0,0 +1,31 @@
+package vfs
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"runtime"
+	"testing"
+)
+
+func TestFreeSpace(t *testing.T) {
+	dir, err := ioutil.TempDir("", "vfs")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	free, err := FreeSpace(OS, dir)
+	switch {
+	case err == ErrNoFreeSpace:
+		t.Skip("free space not supported on", runtime.GOOS)
+	case err != nil:
+		t.Fatal(err)
+	case free <= 0:
+		t.Errorf("Implausible free space %d", free)
+	}
+
+	if _, err := FreeSpace(OS, filepath.Join(dir, "missing")); err == nil {
+		t.Error("No error for a missing directory")
+	}
+}
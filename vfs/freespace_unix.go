@@ -0,0 +1,17 @@
+// +build linux darwin freebsd dragonfly
+
+package vfs
+
+import (
+	"os"
+	"syscall"
+)
+
+func freeSpace(name string) (int64, error) {
+	var st syscall.Statfs_t
+	if err := syscall.Statfs(name, &st); err != nil {
+		return 0, &os.PathError{Op: "statfs", Path: name, Err: err}
+	}
+	// Bavail excludes the blocks reserved for the superuser.
+	return int64(st.Bavail) * int64(st.Bsize), nil
+}
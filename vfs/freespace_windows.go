@@ -0,0 +1,24 @@
+package vfs
+
+import (
+	"os"
+	"syscall"
+	"unsafe"
+)
+
+var procGetDiskFreeSpaceEx = syscall.NewLazyDLL("kernel32.dll").NewProc("GetDiskFreeSpaceExW")
+
+func freeSpace(name string) (int64, error) {
+	p, err := syscall.UTF16PtrFromString(name)
+	if err != nil {
+		return 0, err
+	}
+	// The bytes available to the calling user, which may be less than the
+	// bytes free on the volume because of quotas.
+	var avail int64
+	r, _, err := procGetDiskFreeSpaceEx.Call(uintptr(unsafe.Pointer(p)), uintptr(unsafe.Pointer(&avail)), 0, 0)
+	if r == 0 {
+		return 0, &os.PathError{Op: "getdiskfreespaceex", Path: name, Err: err}
+	}
+	return avail, nil
+}
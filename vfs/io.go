@@ -0,0 +1,73 @@
+package vfs
+
+import (
+	"fmt"
+	"io"
+	"os"
+	"syscall"
+)
+
+// The number of successive reads or writes that may transfer nothing, without
+// an error, before giving up.
+const maxNoProgress = 100
+
+// An IOError records a read or write that could not be completed, and where.
+type IOError struct {
+	Op     string // "read" or "write"
+	Name   string
+	Offset int64 // where the failed transfer would have continued
+	Err    error
+}
+
+func (e *IOError) Error() string {
+	return fmt.Sprintf("%s %s at offset %d: %v", e.Op, e.Name, e.Offset, e.Err)
+}
+
+// ReadFullAt reads len(buf) bytes at offset off from the file with the given
+// name, repeating short and interrupted reads. A file ending before the
+// buffer is filled gives an IOError wrapping io.ErrUnexpectedEOF.
+func ReadFullAt(r io.ReaderAt, name string, buf []byte, off int64) error {
+	return fullAt("read", r.ReadAt, name, buf, off)
+}
+
+// WriteFullAt writes buf at offset off to the file with the given name,
+// repeating short and interrupted writes.
+func WriteFullAt(w io.WriterAt, name string, buf []byte, off int64) error {
+	return fullAt("write", w.WriteAt, name, buf, off)
+}
+
+func fullAt(op string, fn func([]byte, int64) (int, error), name string, buf []byte, off int64) error {
+	var done, idle int
+	for done < len(buf) {
+		n, err := fn(buf[done:], off+int64(done))
+		done += n
+		if done >= len(buf) {
+			// Reads at the end of the file may return io.EOF along with
+			// the last bytes.
+			return nil
+		}
+		switch {
+		case err == io.EOF && op == "read":
+			err = io.ErrUnexpectedEOF
+		case isInterrupted(err):
+			continue
+		case err == nil && n == 0:
+			if idle++; idle < maxNoProgress {
+				continue
+			}
+			err = io.ErrNoProgress
+		case err == nil:
+			idle = 0
+			continue
+		}
+		return &IOError{Op: op, Name: name, Offset: off + int64(done), Err: err}
+	}
+	return nil
+}
+
+func isInterrupted(err error) bool {
+	if pe, ok := err.(*os.PathError); ok {
+		err = pe.Err
+	}
+	return err == syscall.EINTR
+}
@@ -0,0 +1,108 @@
+package vfs
+
+import (
+	"bytes"
+	"io"
+	"os"
+	"syscall"
+	"testing"
+)
+
+// shortFile is a file in memory that transfers at most max bytes per call
+// and is interrupted on every other call.
+type shortFile struct {
+	data  []byte
+	max   int
+	calls int
+}
+
+func (f *shortFile) next(n int) (int, error) {
+	f.calls++
+	if f.calls%2 == 1 {
+		return 0, &os.PathError{Op: "read", Path: "short", Err: syscall.EINTR}
+	}
+	if n > f.max {
+		n = f.max
+	}
+	return n, nil
+}
+
+func (f *shortFile) ReadAt(p []byte, off int64) (int, error) {
+	if off >= int64(len(f.data)) {
+		return 0, io.EOF
+	}
+	n, err := f.next(len(p))
+	if err != nil {
+		return 0, err
+	}
+	n = copy(p[:n], f.data[off:])
+	if off+int64(n) == int64(len(f.data)) {
+		return n, io.EOF
+	}
+	return n, nil
+}
+
+func (f *shortFile) WriteAt(p []byte, off int64) (int, error) {
+	n, err := f.next(len(p))
+	if err != nil {
+		return 0, err
+	}
+	if end := int(off) + n; end > len(f.data) {
+		f.data = append(f.data, make([]byte, end-len(f.data))...)
+	}
+	copy(f.data[off:], p[:n])
+	return n, nil
+}
+
+func TestReadFullAt(t *testing.T) {
+	f := &shortFile{data: []byte("0123456789abcdef"), max: 3}
+
+	buf := make([]byte, 10)
+	if err := ReadFullAt(f, "short", buf, 4); err != nil {
+		t.Fatal(err)
+	}
+	if string(buf) != "456789abcd" {
+		t.Errorf("Incorrect data %q", buf)
+	}
+
+	// Up to the end of the file.
+	buf = make([]byte, 6)
+	if err := ReadFullAt(f, "short", buf, 10); err != nil {
+		t.Fatal(err)
+	}
+	if string(buf) != "abcdef" {
+		t.Errorf("Incorrect data %q", buf)
+	}
+
+	// Beyond it.
+	err := ReadFullAt(f, "short", buf, 12)
+	ioe, ok := err.(*IOError)
+	if !ok || ioe.Err != io.ErrUnexpectedEOF || ioe.Name != "short" || ioe.Offset != 16 {
+		t.Errorf("Incorrect error %v", err)
+	}
+}
+
+func TestWriteFullAt(t *testing.T) {
+	f := &shortFile{max: 3}
+	data := []byte("0123456789")
+	if err := WriteFullAt(f, "short", data, 2); err != nil {
+		t.Fatal(err)
+	}
+	if exp := append([]byte{0, 0}, data...); !bytes.Equal(f.data, exp) {
+		t.Errorf("Incorrect data %q", f.data)
+	}
+}
+
+type stuckWriter struct{}
+
+func (stuckWriter) WriteAt(p []byte, off int64) (int, error) {
+	return 0, nil
+}
+
+func TestWriteFullAtNoProgress(t *testing.T) {
+	err := WriteFullAt(stuckWriter{}, "stuck", []byte("data"), 8)
+	ioe, ok := err.(*IOError)
+	if !ok || ioe.Err != io.ErrNoProgress || ioe.Op != "write" || ioe.Offset != 8 {
+		t.Errorf("Incorrect error %v", err)
+	}
+}
@@ -0,0 +1,17 @@
+package vfs
+
+import (
+	"os"
+	"syscall"
+)
+
+// openRead opens the file for reading without updating its access time,
+// when we are permitted to. O_NOATIME is only allowed for the owner of the
+// file (or root), so we fall back to a plain open on EPERM.
+func openRead(name string) (*os.File, error) {
+	fd, err := os.OpenFile(name, os.O_RDONLY|syscall.O_NOATIME, 0)
+	if pe, ok := err.(*os.PathError); ok && pe.Err == syscall.EPERM {
+		return os.Open(name)
+	}
+	return fd, err
+}
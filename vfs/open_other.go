@@ -0,0 +1,9 @@
+// +build !linux
+
+package vfs
+
+import "os"
+
+func openRead(name string) (*os.File, error) {
+	return os.Open(name)
+}
@@ -0,0 +1,89 @@
+package vfs
+
+import (
+	"errors"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// The number of symlinks followed when resolving a path before giving up.
+const maxSymlinks = 255
+
+var errTooManySymlinks = errors.New("too many levels of symbolic links")
+
+type symlinkEvaluator interface {
+	EvalSymlinks(path string) (string, error)
+}
+
+// EvalSymlinks returns the path after resolving any symbolic links in it,
+// like filepath.EvalSymlinks does for the filesystem of the operating
+// system. Filesystems without a way of their own are resolved one path
+// element at a time using Lstat and Readlink.
+func EvalSymlinks(fs FS, path string) (string, error) {
+	if e, ok := fs.(symlinkEvaluator); ok {
+		return e.EvalSymlinks(path)
+	}
+	return evalSymlinks(fs, path)
+}
+
+func (osFS) EvalSymlinks(path string) (string, error) {
+	return filepath.EvalSymlinks(path)
+}
+
+func evalSymlinks(fs FS, path string) (string, error) {
+	var dir, rest string
+	start := func(path string) {
+		vol := filepath.VolumeName(path)
+		dir, rest = vol, path[len(vol):]
+		if len(rest) > 0 && os.IsPathSeparator(rest[0]) {
+			dir += string(filepath.Separator)
+		}
+	}
+	start(filepath.Clean(path))
+
+	links := 0
+	for rest != "" {
+		var name string
+		if i := strings.IndexRune(rest, filepath.Separator); i >= 0 {
+			name, rest = rest[:i], rest[i+1:]
+		} else {
+			name, rest = rest, ""
+		}
+		if name == "" || name == "." {
+			continue
+		}
+
+		next := filepath.Join(dir, name)
+		info, err := fs.Lstat(next)
+		if err != nil {
+			return "", err
+		}
+		if info.Mode()&os.ModeSymlink == 0 {
+			dir = next
+			continue
+		}
+
+		links++
+		if links > maxSymlinks {
+			return "", errTooManySymlinks
+		}
+		target, err := fs.Readlink(next)
+		if err != nil {
+			return "", err
+		}
+		if rest != "" {
+			target += string(filepath.Separator) + rest
+		}
+		if filepath.IsAbs(target) {
+			start(target)
+		} else {
+			rest = target
+		}
+	}
+
+	if dir == "" {
+		return ".", nil
+	}
+	return filepath.Clean(dir), nil
+}
@@ -0,0 +1,58 @@
+// +build !windows
+
+package vfs
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestEvalSymlinksMatchesFilepath(t *testing.T) {
+	tmp, err := ioutil.TempDir("", "vfs")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(tmp)
+	dir, err := filepath.EvalSymlinks(tmp)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	os.MkdirAll(filepath.Join(dir, "real", "a", "b"), 0755)
+	os.Symlink(filepath.Join(dir, "real"), filepath.Join(dir, "abs"))
+	os.Symlink(filepath.Join("real", "a"), filepath.Join(dir, "rel"))
+	os.Symlink(filepath.Join("rel", "b"), filepath.Join(dir, "chain"))
+	os.Symlink(filepath.Join("..", "..", "abs"), filepath.Join(dir, "real", "a", "up"))
+	os.Symlink("loop2", filepath.Join(dir, "loop1"))
+	os.Symlink("loop1", filepath.Join(dir, "loop2"))
+
+	for _, name := range []string{
+		"real",
+		"abs",
+		filepath.Join("abs", "a", "b"),
+		"rel",
+		filepath.Join("rel", "b"),
+		"chain",
+		filepath.Join("chain", ".."),
+		filepath.Join("rel", "up", "a"),
+		filepath.Join("abs", "a", "up", "a", "up"),
+	} {
+		path := filepath.Join(dir, name)
+		exp, err := filepath.EvalSymlinks(path)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if res, err := evalSymlinks(OS, path); err != nil || res != exp {
+			t.Errorf("evalSymlinks(%q) = %q, %v; expected %q", name, res, err, exp)
+		}
+	}
+
+	if _, err := evalSymlinks(OS, filepath.Join(dir, "loop1")); err != errTooManySymlinks {
+		t.Errorf("Incorrect error for symlink loop: %v", err)
+	}
+	if _, err := evalSymlinks(OS, filepath.Join(dir, "missing")); !os.IsNotExist(err) {
+		t.Errorf("Incorrect error for missing path: %v", err)
+	}
+}
@@ -0,0 +1,120 @@
+// Package vfs defines the filesystem operations used on repositories, so that
+// they can be implemented by something other than the operating system.
+package vfs
+
+import (
+	"io"
+	"io/ioutil"
+	"os"
+	"runtime"
+	"time"
+)
+
+// FS is the set of filesystem operations performed on a repository. Paths
+// use the native separator.
+type FS interface {
+	Open(name string) (File, error)
+	Create(name string) (File, error)
+	Rename(from, to string) error
+	// Link creates name as a hard link to the existing file.
+	Link(existing, name string) error
+	Remove(name string) error
+	Stat(name string) (os.FileInfo, error)
+	Lstat(name string) (os.FileInfo, error)
+	Chtimes(name string, atime, mtime time.Time) error
+	Chmod(name string, mode os.FileMode) error
+	MkdirAll(name string, perm os.FileMode) error
+	// ReadDir returns the entries of the directory sorted by name.
+	ReadDir(name string) ([]os.FileInfo, error)
+	Readlink(name string) (string, error)
+	Symlink(target, name string) error
+}
+
+type File interface {
+	io.Reader
+	io.ReaderAt
+	io.Writer
+	io.WriterAt
+	io.Closer
+}
+
+// OS is the filesystem of the operating system.
+var OS FS = osFS{}
+
+type osFS struct{}
+
+// Open opens the file for reading. The returned file accepts hints given
+// with Advise.
+func (osFS) Open(name string) (File, error) {
+	fd, err := openRead(name)
+	if err != nil {
+		return nil, err
+	}
+	return osFile{fd}, nil
+}
+
+func (osFS) Create(name string) (File, error) {
+	return os.Create(name)
+}
+
+// Rename replaces any existing file at the target, also on Windows where
+// os.Rename refuses to do so.
+func (osFS) Rename(from, to string) error {
+	if runtime.GOOS == "windows" {
+		err := os.Remove(to)
+		if err != nil && !os.IsNotExist(err) {
+			return err
+		}
+	}
+	return os.Rename(from, to)
+}
+
+func (osFS) Link(existing, name string) error {
+	return os.Link(existing, name)
+}
+
+func (osFS) Remove(name string) error {
+	return os.Remove(name)
+}
+
+func (osFS) Stat(name string) (os.FileInfo, error) {
+	return os.Stat(name)
+}
+
+func (osFS) Lstat(name string) (os.FileInfo, error) {
+	return os.Lstat(name)
+}
+
+func (osFS) Chtimes(name string, atime, mtime time.Time) error {
+	return os.Chtimes(name, atime, mtime)
+}
+
+func (osFS) Chmod(name string, mode os.FileMode) error {
+	return os.Chmod(name, mode)
+}
+
+func (osFS) MkdirAll(name string, perm os.FileMode) error {
+	return os.MkdirAll(name, perm)
+}
+
+func (osFS) ReadDir(name string) ([]os.FileInfo, error) {
+	return ioutil.ReadDir(name)
+}
+
+func (osFS) Readlink(name string) (string, error) {
+	return os.Readlink(name)
+}
+
+func (osFS) Symlink(target, name string) error {
+	return os.Symlink(target, name)
+}
+
+// ReadFile returns the contents of the named file.
+func ReadFile(fs FS, name string) ([]byte, error) {
+	fd, err := fs.Open(name)
+	if err != nil {
+		return nil, err
+	}
+	defer fd.Close()
+	return ioutil.ReadAll(fd)
+}
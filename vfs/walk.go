@@ -0,0 +1,44 @@
+package vfs
+
+import (
+	"os"
+	"path/filepath"
+)
+
+// Walk walks the file tree rooted at root in lexical order, calling walkFn
+// for each file or directory, like filepath.Walk does for the operating
+// system's filesystem.
+func Walk(fs FS, root string, walkFn filepath.WalkFunc) error {
+	info, err := fs.Lstat(root)
+	if err != nil {
+		return walkFn(root, nil, err)
+	}
+	return walk(fs, root, info, walkFn)
+}
+
+func walk(fs FS, path string, info os.FileInfo, walkFn filepath.WalkFunc) error {
+	err := walkFn(path, info, nil)
+	if err != nil {
+		if info.IsDir() && err == filepath.SkipDir {
+			return nil
+		}
+		return err
+	}
+
+	if !info.IsDir() {
+		return nil
+	}
+
+	infos, err := fs.ReadDir(path)
+	if err != nil {
+		return walkFn(path, info, err)
+	}
+
+	for _, fi := range infos {
+		err = walk(fs, filepath.Join(path, fi.Name()), fi, walkFn)
+		if err != nil && (!fi.IsDir() || err != filepath.SkipDir) {
+			return err
+		}
+	}
+	return nil
+}
@@ -0,0 +1,45 @@
+package vfs
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+)
+
+func TestWalkMatchesFilepath(t *testing.T) {
+	dir, err := ioutil.TempDir("", "vfs")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	os.MkdirAll(filepath.Join(dir, "b", "c"), 0755)
+	os.MkdirAll(filepath.Join(dir, "a"), 0755)
+	ioutil.WriteFile(filepath.Join(dir, "a", "file"), nil, 0644)
+	ioutil.WriteFile(filepath.Join(dir, "b", "c", "file"), nil, 0644)
+	ioutil.WriteFile(filepath.Join(dir, "d"), nil, 0644)
+
+	walker := func(res *[]string) filepath.WalkFunc {
+		return func(path string, info os.FileInfo, err error) error {
+			if err != nil {
+				return err
+			}
+			*res = append(*res, path)
+			if info.Name() == "c" {
+				return filepath.SkipDir
+			}
+			return nil
+		}
+	}
+
+	var expected, walked []string
+	filepath.Walk(dir, walker(&expected))
+	if err := Walk(OS, dir, walker(&walked)); err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(walked, expected) {
+		t.Errorf("Incorrect walk\n  %v\n  %v", walked, expected)
+	}
+}